@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/longhorn-engine/pkg/bench"
+	"github.com/longhorn/longhorn-engine/pkg/controller"
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+	"github.com/longhorn/longhorn-engine/pkg/frontend/socket"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+const (
+	benchPatternRandom     = "random"
+	benchPatternSequential = "sequential"
+)
+
+func BenchCmd() cli.Command {
+	return cli.Command{
+		Name:  "bench",
+		Usage: "benchmark the socket frontend of a running controller, or the data server of a single replica",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "socket",
+				Usage: "path of the socket frontend of the controller. Defaults to the one of --volume-name",
+			},
+			cli.BoolFlag{
+				Name:  "data-checksum",
+				Usage: "protect the frames of the data connection with a CRC32C, if the other end supports it",
+			},
+			cli.StringFlag{
+				Name:  "replica",
+				Usage: "address of the replica to benchmark instead of the controller, e.g. tcp://localhost:9502. The replica must be open",
+			},
+			cli.BoolFlag{
+				Name:  "destructive",
+				Usage: "allow writes to --replica, which overwrite its data behind the back of any controller. Refused anyway if the replica serves a controller",
+			},
+			cli.StringFlag{
+				Name:  "data-server-protocol",
+				Value: string(types.DataServerProtocolTCP),
+				Usage: "protocol of the replica data server, tcp or unix",
+			},
+			cli.StringFlag{
+				Name:  "block-size, bs",
+				Value: "4k",
+			},
+			cli.IntFlag{
+				Name:  "queue-depth, qd",
+				Value: 32,
+			},
+			cli.IntFlag{
+				Name:  "read-percent",
+				Value: 100,
+				Usage: "share of reads from 0 to 100, the rest are writes",
+			},
+			cli.StringFlag{
+				Name:  "pattern",
+				Value: benchPatternRandom,
+				Usage: "random or sequential",
+			},
+			cli.DurationFlag{
+				Name:  "duration",
+				Value: 30 * time.Second,
+			},
+			cli.StringFlag{
+				Name:  "offset",
+				Value: "0",
+				Usage: "start of the range to benchmark",
+			},
+			cli.StringFlag{
+				Name:  "size",
+				Usage: "length of the range to benchmark. Defaults to the rest of the volume or replica",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the result as JSON",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := runBench(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running bench command")
+			}
+		},
+	}
+}
+
+func runBench(c *cli.Context) error {
+	pattern := c.String("pattern")
+	if pattern != benchPatternRandom && pattern != benchPatternSequential {
+		return fmt.Errorf("invalid pattern %v, must be %v or %v", pattern, benchPatternRandom, benchPatternSequential)
+	}
+	blockSize, err := units.RAMInBytes(c.String("block-size"))
+	if err != nil {
+		return errors.Wrapf(err, "invalid block size %v", c.String("block-size"))
+	}
+	offset, err := units.RAMInBytes(c.String("offset"))
+	if err != nil {
+		return errors.Wrapf(err, "invalid offset %v", c.String("offset"))
+	}
+
+	conn, targetSize, err := connectBenchTarget(c)
+	if err != nil {
+		return err
+	}
+	client, err := dataconn.NewClient([]net.Conn{conn},
+		util.NewSharedTimeouts(controller.DefaultEngineReplicaTimeout, controller.DefaultEngineReplicaTimeout),
+		dataFeatures(c), dataconn.ClientOptions{})
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	size := targetSize - offset
+	if c.String("size") != "" {
+		if size, err = units.RAMInBytes(c.String("size")); err != nil {
+			return errors.Wrapf(err, "invalid size %v", c.String("size"))
+		}
+	}
+	if offset+size > targetSize {
+		return fmt.Errorf("range of %v bytes at offset %v is beyond the size %v", size, offset, targetSize)
+	}
+
+	result, err := bench.Run(client, bench.Options{
+		BlockSize:   blockSize,
+		QueueDepth:  c.Int("queue-depth"),
+		ReadPercent: c.Int("read-percent"),
+		Random:      pattern == benchPatternRandom,
+		Duration:    c.Duration("duration"),
+		Offset:      offset,
+		Size:        size,
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		output, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+		return nil
+	}
+	return printBenchResult(result)
+}
+
+func connectBenchTarget(c *cli.Context) (net.Conn, int64, error) {
+	volumeName := c.GlobalString("volume-name")
+	if replicaAddress := c.String("replica"); replicaAddress != "" {
+		if c.Int("read-percent") < 100 {
+			if err := checkReplicaWritable(volumeName, replicaAddress, c.Bool("destructive")); err != nil {
+				return nil, 0, err
+			}
+		}
+		return connectReplicaData(volumeName, replicaAddress, types.DataServerProtocol(c.String("data-server-protocol")))
+	}
+
+	controllerClient, err := getControllerClient(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if errClose := controllerClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close controller client")
+		}
+	}()
+	volume, err := controllerClient.VolumeGet()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	socketPath := c.String("socket")
+	if socketPath == "" {
+		socketPath = (&socket.Socket{Volume: volume.Name}).GetSocketPath()
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to connect to socket frontend %v", socketPath)
+	}
+	return conn, volume.Size, nil
+}
+
+// checkReplicaWritable refuses to write to a replica directly unless asked to, and never while a controller is
+// connected to it: the writes would bypass the controller and leave the replica out of sync with the others.
+func checkReplicaWritable(volumeName, address string, destructive bool) error {
+	if !destructive {
+		return fmt.Errorf("writing to replica %v overwrites its data, use --read-percent 100 or pass --destructive", address)
+	}
+	metrics, err := getReplicaMetrics(address, volumeName)
+	if err != nil {
+		return err
+	}
+	if metrics.DataConnections > 0 {
+		return fmt.Errorf("cannot write to replica %v, %v connections are open to its data server, it may serve a controller",
+			address, metrics.DataConnections)
+	}
+	return nil
+}
+
+func printBenchResult(result *bench.Result) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 20, 1, ' ', 0)
+	fmt.Fprintf(tw, "OP\tIOPS\tTHROUGHPUT\tMEAN\tP50\tP90\tP99\tP99.9\tMAX\n")
+	for _, op := range []struct {
+		name   string
+		result bench.OpResult
+	}{
+		{"read", result.Read},
+		{"write", result.Write},
+	} {
+		if op.result.Ops == 0 {
+			continue
+		}
+		l := op.result.Latency
+		fmt.Fprintf(tw, "%s\t%.0f\t%s/s\t%v\t%v\t%v\t%v\t%v\t%v\n", op.name, op.result.IOPS,
+			units.BytesSize(op.result.Throughput), l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/longhorn-engine/pkg/controller"
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+	"github.com/longhorn/longhorn-engine/pkg/iocapture"
+	replicaClient "github.com/longhorn/longhorn-engine/pkg/replica/client"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+func CaptureCmd() cli.Command {
+	return cli.Command{
+		Name:  "capture",
+		Usage: "record the offset, length, type and timing of the I/O going through the controller",
+		Subcommands: []cli.Command{
+			CaptureStartCmd(),
+			CaptureStopCmd(),
+		},
+	}
+}
+
+func CaptureStartCmd() cli.Command {
+	return cli.Command{
+		Name:      "start",
+		Usage:     "start capturing into a new file on the controller host: capture start <file>",
+		ArgsUsage: "<file>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "data-hash",
+				Usage: "also record the hash of the data of every read and write",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := startCapture(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running capture start command")
+			}
+		},
+	}
+}
+
+func CaptureStopCmd() cli.Command {
+	return cli.Command{
+		Name: "stop",
+		Action: func(c *cli.Context) {
+			if err := stopCapture(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running capture stop command")
+			}
+		},
+	}
+}
+
+func startCapture(c *cli.Context) error {
+	file := c.Args().First()
+	if file == "" {
+		return fmt.Errorf("capture file is required")
+	}
+
+	controllerClient, err := getControllerClient(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := controllerClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close controller client")
+		}
+	}()
+
+	return controllerClient.CaptureStart(file, c.Bool("data-hash"))
+}
+
+func stopCapture(c *cli.Context) error {
+	controllerClient, err := getControllerClient(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := controllerClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close controller client")
+		}
+	}()
+
+	file, records, err := controllerClient.CaptureStop()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v: %v requests recorded\n", file, records)
+	return nil
+}
+
+func ReplayCmd() cli.Command {
+	return cli.Command{
+		Name:      "replay",
+		Usage:     "replay a capture against a controller socket frontend or a single replica: replay <file>",
+		ArgsUsage: "<file>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "socket",
+				Usage: "path of the socket frontend of the controller, e.g. /var/run/longhorn-<volume>.sock",
+			},
+			cli.BoolFlag{
+				Name:  "data-checksum",
+				Usage: "protect the frames of the data connection with a CRC32C, if the other end supports it",
+			},
+			cli.StringFlag{
+				Name:  "replica",
+				Usage: "address of the replica, e.g. tcp://localhost:9502. The replica must be open",
+			},
+			cli.StringFlag{
+				Name:  "data-server-protocol",
+				Value: string(types.DataServerProtocolTCP),
+				Usage: "protocol of the replica data server, tcp or unix",
+			},
+			cli.Float64Flag{
+				Name:  "speed",
+				Value: 1,
+				Usage: "pace of the replay relative to the capture, e.g. 2 for twice as fast. 0 replays as fast as possible",
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Value: 32,
+				Usage: "maximum number of requests in flight",
+			},
+			cli.BoolFlag{
+				Name:  "verify",
+				Usage: "compare the data read with the captured hashes. Only useful if the target has the captured data",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := replayCapture(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running replay command")
+			}
+		},
+	}
+}
+
+func replayCapture(c *cli.Context) error {
+	path := c.Args().First()
+	if path == "" {
+		return fmt.Errorf("capture file is required")
+	}
+	socketPath := c.String("socket")
+	replicaAddress := c.String("replica")
+	if (socketPath == "") == (replicaAddress == "") {
+		return fmt.Errorf("exactly one of --socket and --replica is required")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open capture file %v", path)
+	}
+	defer func() {
+		if errClose := file.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close capture file %v", path)
+		}
+	}()
+
+	reader, err := iocapture.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	var conn net.Conn
+	if socketPath != "" {
+		conn, err = net.Dial("unix", socketPath)
+	} else {
+		conn, _, err = connectReplicaData(c.GlobalString("volume-name"), replicaAddress,
+			types.DataServerProtocol(c.String("data-server-protocol")))
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := dataconn.NewClient([]net.Conn{conn},
+		util.NewSharedTimeouts(controller.DefaultEngineReplicaTimeout, controller.DefaultEngineReplicaTimeout),
+		dataFeatures(c), dataconn.ClientOptions{})
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	result, err := iocapture.Replay(reader, client, iocapture.ReplayOptions{
+		Speed:       c.Float64("speed"),
+		Concurrency: c.Int("concurrency"),
+		Verify:      c.Bool("verify"),
+	})
+	if err != nil {
+		return err
+	}
+
+	output, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+// connectReplicaData connects to the data server of an open replica, and returns the connection and the size of the
+// replica.
+func connectReplicaData(volumeName, address string, dataServerProtocol types.DataServerProtocol) (net.Conn, int64, error) {
+	repClient, err := replicaClient.NewReplicaClient(address, volumeName, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if errClose := repClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close replica client for replica address %s", address)
+		}
+	}()
+
+	r, err := repClient.GetReplica()
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.State != string(types.ReplicaStateOpen) && r.State != string(types.ReplicaStateDirty) {
+		return nil, 0, fmt.Errorf("replica %v is %v, it must be open to drive I/O to it", address, r.State)
+	}
+	size, err := strconv.ParseInt(r.Size, 10, 64)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "invalid size %v of replica %v", r.Size, address)
+	}
+
+	_, dataAddress, _, _, err := util.GetAddresses(volumeName, util.GetGRPCAddress(address), dataServerProtocol)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.Dial(string(dataServerProtocol), dataAddress)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to connect to data server %v of replica %v", dataAddress, address)
+	}
+	return conn, size, nil
+}
+
+// dataFeatures returns the dataconn features asked for by the flags of the command.
+func dataFeatures(c *cli.Context) uint32 {
+	if c.Bool("data-checksum") {
+		return dataconn.DefaultFeatures | dataconn.FeatureChecksum
+	}
+	return dataconn.DefaultFeatures
+}
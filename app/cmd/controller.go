@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"net/http"
 	"os"
 	"strings"
 	"syscall"
@@ -12,11 +13,14 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/longhorn/longhorn-engine/pkg/backend/dynamic"
+	"github.com/longhorn/longhorn-engine/pkg/backend/fault"
 	"github.com/longhorn/longhorn-engine/pkg/backend/file"
 	"github.com/longhorn/longhorn-engine/pkg/backend/remote"
 	"github.com/longhorn/longhorn-engine/pkg/controller"
 	"github.com/longhorn/longhorn-engine/pkg/controller/client"
 	controllerrpc "github.com/longhorn/longhorn-engine/pkg/controller/rpc"
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+	"github.com/longhorn/longhorn-engine/pkg/frontend/rest"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 	"github.com/longhorn/longhorn-engine/pkg/util"
 )
@@ -67,6 +71,10 @@ func ControllerCmd() cli.Command {
 				Value:  int64(controller.DefaultEngineReplicaTimeout.Seconds()),
 				Usage:  "In seconds. Timeout between engine and replica(s)",
 			},
+			cli.Int64Flag{
+				Name:  "replica-reconnect-grace-period",
+				Usage: "In seconds. How long a failed replica may reconnect and catch up before it needs a rebuild. 0 disables reconnecting",
+			},
 			cli.StringFlag{
 				Name:  "data-server-protocol",
 				Value: "tcp",
@@ -92,6 +100,53 @@ func ControllerCmd() cli.Command {
 				Name:  "snapshot-max-size",
 				Usage: "Maximum total snapshot size in bytes or human readable 42kb, 42mb, 42gb",
 			},
+			cli.StringFlag{
+				Name:  "fault-injection-listen",
+				Usage: "Address to serve the fault rules of the fault backend on, either unix:///path/to/socket or a loopback address such as localhost:9600. Only for testing",
+			},
+			cli.StringFlag{
+				Name:  "nvme-tcp-listen",
+				Usage: "Address the nvme-tcp frontend listens on, e.g. 0.0.0.0:4420. An ephemeral port on all addresses by default",
+			},
+			cli.StringFlag{
+				Name:  "iscsi-listen",
+				Usage: "Address the embedded iSCSI target listens on, e.g. 0.0.0.0:3260. Port 3260 on all addresses by default",
+			},
+			cli.BoolFlag{
+				Name:  "embedded-iscsi-target",
+				Usage: "Serve the tgt-iscsi frontend with the embedded iSCSI target instead of tgt",
+			},
+			cli.StringFlag{
+				Name:  "fuse-snapshot-directory",
+				Usage: "Directory of a replica of the volume on this node. The fuse frontend presents its snapshots read-only",
+			},
+			cli.StringFlag{
+				Name:  "rest-listen",
+				Usage: "Address the rest frontend listens on, e.g. 0.0.0.0:9414. localhost:9414 by default. Other addresses than loopback ones need --rest-token-file or --rest-tls-client-ca",
+			},
+			cli.StringFlag{
+				Name:  "rest-token-file",
+				Usage: "File holding the token the clients of the rest frontend must send as 'Authorization: Bearer <token>'",
+			},
+			cli.StringFlag{
+				Name:  "rest-tls-cert",
+				Usage: "Certificate file of the rest frontend. With --rest-tls-key, it serves HTTPS",
+			},
+			cli.StringFlag{
+				Name:  "rest-tls-key",
+				Usage: "Private key file of the rest frontend certificate",
+			},
+			cli.StringFlag{
+				Name:  "rest-tls-client-ca",
+				Usage: "CA file the certificates the clients of the rest frontend must present are verified with",
+			},
+			cli.BoolFlag{
+				Name:  "data-checksum",
+				Usage: "Protect the frames of the data connections to the replicas with a CRC32C, if the replicas support it",
+			},
+		},
+		Subcommands: []cli.Command{
+			ControllerWatchCmd(),
 		},
 		Action: func(c *cli.Context) {
 			if err := startController(c); err != nil {
@@ -167,15 +222,51 @@ func startController(c *cli.Context) error {
 		case "file":
 			factories[backend] = file.New()
 		case "tcp":
-			factories[backend] = remote.New()
+			features := dataconn.DefaultFeatures
+			if c.Bool("data-checksum") {
+				features |= dataconn.FeatureChecksum
+			}
+			factories[backend] = remote.NewWithDataFeatures(features)
+		case "fault":
+			// The fault backend wraps the backends of the other enabled schemes.
+			injector := fault.NewInjector()
+			factories[backend] = fault.New(dynamic.New(factories), injector)
+			if listen := c.String("fault-injection-listen"); listen != "" {
+				l, err := fault.Listen(listen)
+				if err != nil {
+					return err
+				}
+				logrus.Warnf("FAULT INJECTION IS ENABLED: anyone who can reach %v can fail the I/O of volume %v", listen, volumeName)
+				go func() {
+					if err := http.Serve(l, injector.Handler()); err != nil {
+						logrus.WithError(err).Error("Failed to serve fault rules")
+					}
+				}()
+			}
 		default:
 			logrus.Fatalf("Unsupported backend: %s", backend)
 		}
 	}
 
+	frontendOptions := controller.FrontendOptions{
+		NvmeTCPListenAddress:  c.String("nvme-tcp-listen"),
+		ISCSIListenAddress:    c.String("iscsi-listen"),
+		EmbeddedISCSITarget:   c.Bool("embedded-iscsi-target"),
+		FuseSnapshotDirectory: c.String("fuse-snapshot-directory"),
+		Rest: rest.Options{
+			ListenAddress:   c.String("rest-listen"),
+			TokenFile:       c.String("rest-token-file"),
+			TLSCertFile:     c.String("rest-tls-cert"),
+			TLSKeyFile:      c.String("rest-tls-key"),
+			TLSClientCAFile: c.String("rest-tls-client-ca"),
+		},
+	}
+	if err := rest.CheckListenAddress(frontendOptions.Rest); err != nil {
+		return err
+	}
 	var frontend types.Frontend
 	if frontendName != "" {
-		f, err := controller.NewFrontend(frontendName, iscsiTargetRequestTimeout)
+		f, err := controller.NewFrontend(frontendName, iscsiTargetRequestTimeout, frontendOptions)
 		if err != nil {
 			return errors.Wrapf(err, "failed to find frontend: %s", frontendName)
 		}
@@ -196,6 +287,8 @@ func startController(c *cli.Context) error {
 		salvageRequested, unmapMarkSnapChainRemoved, iscsiTargetRequestTimeout, engineReplicaTimeoutShort,
 		engineReplicaTimeoutLong, types.DataServerProtocol(dataServerProtocol), fileSyncHTTPClientTimeout,
 		snapshotMaxCount, snapshotMaxSize)
+	control.SetReplicaReconnectGracePeriod(time.Duration(c.Int64("replica-reconnect-grace-period")) * time.Second)
+	control.SetFrontendOptions(frontendOptions)
 
 	// need to wait for Shutdown() completion
 	control.ShutdownWG.Add(1)
@@ -39,7 +39,8 @@ func getProfilerClient(c *cli.Context) (*profiler.Client, error) {
 	url := c.GlobalString("url")
 	volumeName := c.GlobalString("volume-name")
 	engineInstanceName := c.GlobalString("engine-instance-name")
-	dialOpts := []grpc.DialOption{interceptor.WithIdentityValidationClientInterceptor(volumeName, engineInstanceName)}
+	dialOpts := []grpc.DialOption{interceptor.WithIdentityValidationClientInterceptor(volumeName, engineInstanceName),
+		interceptor.WithTracingClientInterceptor()}
 	return profiler.NewClient(url, volumeName, dialOpts...)
 }
 
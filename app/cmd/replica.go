@@ -35,6 +35,10 @@ func ReplicaCmd() cli.Command {
 				Name:  "backing-file",
 				Usage: "qcow file or encapsulating directory to use as the base image of this disk",
 			},
+			cli.StringFlag{
+				Name:  "backing-file-checksum",
+				Usage: "SHA512 checksum the backing file must have, such as the checksum of the backing image. The replica refuses to start on a mismatch",
+			},
 			cli.BoolTFlag{
 				Name: "sync-agent",
 			},
@@ -83,6 +87,24 @@ func ReplicaCmd() cli.Command {
 				Name:  "snapshot-max-size",
 				Usage: "Maximum total snapshot size in bytes or human readable 42kb, 42mb, 42gb",
 			},
+			cli.StringFlag{
+				Name:  "io-engine",
+				Value: replica.IOEngineSync,
+				Usage: "How the disk files are read and written. Available options are \"sync\" and \"io_uring\". \"io_uring\" falls back to \"sync\" if the kernel does not support it",
+			},
+			cli.IntFlag{
+				Name:  "io-uring-entries",
+				Value: 256,
+				Usage: "Maximum number of reads and writes in flight in io_uring",
+			},
+			cli.BoolFlag{
+				Name:  "sync-writes",
+				Usage: "Flush the data of every write to the disk before acknowledging it",
+			},
+			cli.BoolFlag{
+				Name:  "detect-zeroes",
+				Usage: "Punch the aligned all-zero blocks of writes out of the volume head instead of writing them, where no snapshot holds data for them",
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := startReplica(c); err != nil {
@@ -102,6 +124,28 @@ func startReplica(c *cli.Context) (err error) {
 	if err != nil {
 		return err
 	}
+	if backingFile != nil {
+		checksumCache := filepath.Join(dir, backingfile.ChecksumCacheName)
+		if expected := c.String("backing-file-checksum"); expected != "" {
+			// The replica must not start on another backing file, so this waits for the checksum unless it is cached.
+			if err := backingFile.VerifyChecksum(expected, checksumCache); err != nil {
+				_ = backingFile.Disk.Close()
+				return err
+			}
+			logrus.Infof("Backing file %v has checksum %v", backingFile.Path, backingFile.Checksum())
+		} else {
+			// The checksum is unknown to the replicas compared with this one until it is computed.
+			go func() {
+				if err := backingFile.VerifyChecksum("", checksumCache); err != nil {
+					logrus.WithError(err).Errorf("Failed to checksum backing file %v", backingFile.Path)
+					return
+				}
+				logrus.Infof("Backing file %v has checksum %v", backingFile.Path, backingFile.Checksum())
+			}()
+		}
+	} else if c.String("backing-file-checksum") != "" {
+		return errors.New("backing-file-checksum is set without a backing file")
+	}
 
 	disableRevCounter := c.Bool("disableRevCounter")
 	unmapMarkDiskChainRemoved := c.Bool("unmap-mark-disk-chain-removed")
@@ -116,6 +160,11 @@ func startReplica(c *cli.Context) (err error) {
 		}
 	}
 
+	if err := replica.SetIOEngine(c.String("io-engine"), uint32(c.Int("io-uring-entries")), c.Bool("sync-writes")); err != nil {
+		return err
+	}
+	replica.SetZeroDetection(c.Bool("detect-zeroes"))
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
 		if err != nil {
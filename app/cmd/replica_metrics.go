@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	replicaClient "github.com/longhorn/longhorn-engine/pkg/replica/client"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+func ReplicaMetricsCmd() cli.Command {
+	return cli.Command{
+		Name:  "replica-metrics",
+		Usage: "show the metrics of the replica processes of the volume, such as the bytes saved by zero detection",
+		Action: func(c *cli.Context) {
+			if err := replicaMetrics(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running replica-metrics command")
+			}
+		},
+	}
+}
+
+func replicaMetrics(c *cli.Context) error {
+	controllerClient, err := getControllerClient(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := controllerClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close controller client")
+		}
+	}()
+
+	volumeName := c.GlobalString("volume-name")
+
+	reps, err := controllerClient.ReplicaList()
+	if err != nil {
+		return err
+	}
+
+	format := "%s\t%s\t%v\t%v\n"
+	tw := tabwriter.NewWriter(os.Stdout, 0, 20, 1, ' ', 0)
+	_, _ = fmt.Fprintf(tw, format, "ADDRESS", "MODE", "ZERO-DETECTED", "ZERO-SAVED")
+	for _, r := range reps {
+		if r.Mode == types.ERR {
+			_, _ = fmt.Fprintf(tw, format, r.Address, r.Mode, "", "")
+			continue
+		}
+		metrics, err := getReplicaMetrics(r.Address, volumeName)
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to get metrics of replica %v", r.Address)
+			_, _ = fmt.Fprintf(tw, format, r.Address, r.Mode, "", "")
+			continue
+		}
+		_, _ = fmt.Fprintf(tw, format, r.Address, r.Mode, metrics.ZeroBytesDetected, metrics.ZeroBytesSaved)
+	}
+	if errFlush := tw.Flush(); errFlush != nil {
+		logrus.WithError(errFlush).Error("Failed to flush")
+	}
+
+	return nil
+}
+
+func getReplicaMetrics(address, volumeName string) (*types.ReplicaMetrics, error) {
+	// We don't know the replica's instanceName, so create a client without it.
+	repClient, err := replicaClient.NewReplicaClient(address, volumeName, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := repClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close replica client for replica address %s", address)
+		}
+	}()
+
+	return repClient.GetMetrics()
+}
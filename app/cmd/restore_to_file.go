@@ -3,9 +3,9 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,10 +13,8 @@ import (
 	"github.com/urfave/cli"
 	"gopkg.in/cheggaaa/pb.v2"
 
-	lhexec "github.com/longhorn/go-common-libs/exec"
-	lhtypes "github.com/longhorn/go-common-libs/types"
-
 	"github.com/longhorn/backupstore"
+	"github.com/longhorn/longhorn-engine/pkg/qcow"
 	"github.com/longhorn/longhorn-engine/pkg/replica"
 	"github.com/longhorn/longhorn-engine/pkg/util"
 )
@@ -24,12 +22,12 @@ import (
 const (
 	DefaultOutputFormat   = "qcow2"
 	DefaultOutputFileName = "volume"
-	QEMUImageBinary       = "qemu-img"
 	BackupFilePath        = "backup.img"
-	BackupFileConverted   = "backup.img.converted"
-	BackingFileCopy       = "backing.img.cp"
 
 	PeriodicRefreshIntervalInSeconds = 2
+
+	// imageBlockSize is the granularity at which the blocks of zeros are skipped
+	imageBlockSize = 4096
 )
 
 var SupportedImageFormats = []string{
@@ -140,7 +138,7 @@ func restoreToFile(c *cli.Context) error {
 	}
 	logrus.Infof("Output file path=%s", outputFilePath)
 
-	defer CleanupTempFiles(outputFile, BackupFilePath, BackupFileConverted, BackingFileCopy)
+	defer CleanupTempFiles(outputFile, BackupFilePath)
 
 	logrus.Infof("Start to restore %s to %s", backupURL, BackupFilePath)
 	if err := restore(backupURL, concurrentLimit); err != nil {
@@ -162,17 +160,8 @@ func restoreToFile(c *cli.Context) error {
 		if err := CheckBackingFileFormat(backingFilepath); err != nil {
 			return err
 		}
-		if err := CopyFile(backingFilepath, BackingFileCopy); err != nil {
-			return err
-		}
 		logrus.Infof("Done preparing and checking backing file: %s", backingFilepath)
-		if err := ConvertImage(BackupFilePath, BackupFileConverted, DefaultOutputFormat); err != nil {
-			return err
-		}
-		if err := MergeSnapshotsToBackingFile(BackupFileConverted, BackingFileCopy); err != nil {
-			return err
-		}
-		if err := ConvertImage(BackingFileCopy, outputFile, outputFormat); err != nil {
+		if err := MergeBackingFile(BackupFilePath, backingFilepath, outputFile, outputFormat); err != nil {
 			return err
 		}
 	}
@@ -189,24 +178,13 @@ func outputFormatSupported(desiredFormat string) bool {
 	return false
 }
 
+// CheckBackingFileFormat makes sure the backing file is a qcow2 image the restore can read.
 func CheckBackingFileFormat(backingFilePath string) error {
-	exec := lhexec.NewExecutor().Execute
-	output, err := exec(nil, QEMUImageBinary, []string{"info", backingFilePath}, lhtypes.ExecuteNoTimeout)
+	backingFile, err := qcow.Open(backingFilePath)
 	if err != nil {
 		return errors.Wrapf(err, "failed CheckBackingFileFormat %s", backingFilePath)
 	}
-	if !strings.Contains(output, "file format: qcow2") {
-		return fmt.Errorf("the format of backing file is not qcow2. backing file info=%s", output)
-	}
-	return nil
-}
-
-func CopyFile(backingFilepath, outputFile string) error {
-	exec := lhexec.NewExecutor().Execute
-	if _, err := exec(nil, "cp", []string{backingFilepath, outputFile}, lhtypes.ExecuteNoTimeout); err != nil {
-		return err
-	}
-	return nil
+	return backingFile.Close()
 }
 
 func CleanupTempFiles(outputFile string, files ...string) {
@@ -231,46 +209,131 @@ func CleanupTempFiles(outputFile string, files ...string) {
 	}
 }
 
+// ConvertImage writes the raw image srcFilepath to dstFilepath in format.
 func ConvertImage(srcFilepath, dstFilepath, format string) error {
-	logrus.Infof("Start ConvertImage (%s) %s -> %s", format, srcFilepath, dstFilepath)
-	exec := lhexec.NewExecutor().Execute
-	_, err := exec(nil, QEMUImageBinary, []string{"convert", "-O", format, srcFilepath, dstFilepath}, lhtypes.ExecuteNoTimeout)
+	src, err := os.Open(srcFilepath)
 	if err != nil {
-		return errors.Wrapf(err, "failed convertImage (%s) %s -> %s", format, srcFilepath, dstFilepath)
+		return err
 	}
-	logrus.Infof("Done ConvertImage (%s) %s -> %s", format, srcFilepath, dstFilepath)
-	return nil
-}
+	defer src.Close()
 
-func MergeSnapshotsToBackingFile(snapFilepath, backingFilepath string) error {
-	logrus.Infof("Start MergeSnapshotsToBackingFile %s -> %s", snapFilepath, backingFilepath)
-	if err := rebaseSnapshot(snapFilepath, backingFilepath); err != nil {
-		return errors.Wrapf(err, "failed MergeSnapshotsToBackingFile %s -> %s", snapFilepath, backingFilepath)
+	info, err := src.Stat()
+	if err != nil {
+		return err
 	}
-	logrus.Infof("Done MergeSnapshotsToBackingFile %s -> %s", snapFilepath, backingFilepath)
-	return commitSnapshot(snapFilepath)
+	return writeImage(src, info.Size(), dstFilepath, format)
 }
 
-func rebaseSnapshot(snapFilepath, backingFilepath string) error {
-	logrus.Infof("Start rebaseSnapshot %s -> %s", snapFilepath, backingFilepath)
-	exec := lhexec.NewExecutor().Execute
-	_, err := exec(nil, QEMUImageBinary, []string{"rebase", "-u", "-b", backingFilepath, "-F", DefaultOutputFormat, snapFilepath}, lhtypes.ExecuteNoTimeout)
+// MergeBackingFile writes the raw image snapFilepath on top of the qcow2 backing file backingFilepath to
+// dstFilepath in format. The blocks of the snapshot that are all zeros are taken from the backing file.
+func MergeBackingFile(snapFilepath, backingFilepath, dstFilepath, format string) error {
+	logrus.Infof("Start MergeBackingFile %s -> %s", snapFilepath, backingFilepath)
+	snap, err := os.Open(snapFilepath)
 	if err != nil {
-		return errors.Wrapf(err, "failed rebaseSnapshot %s -> %s", snapFilepath, backingFilepath)
+		return err
 	}
-	logrus.Infof("Done rebaseSnapshot %s -> %s", snapFilepath, backingFilepath)
+	defer snap.Close()
+
+	info, err := snap.Stat()
+	if err != nil {
+		return err
+	}
+	backingFile, err := qcow.Open(backingFilepath)
+	if err != nil {
+		return err
+	}
+	defer backingFile.Close()
+
+	backingSize, err := backingFile.Size()
+	if err != nil {
+		return err
+	}
+	overlay := &overlayReader{top: snap, base: backingFile, baseSize: backingSize}
+	if err := writeImage(overlay, info.Size(), dstFilepath, format); err != nil {
+		return errors.Wrapf(err, "failed MergeBackingFile %s -> %s", snapFilepath, backingFilepath)
+	}
+	logrus.Infof("Done MergeBackingFile %s -> %s", snapFilepath, backingFilepath)
 	return nil
 }
 
-// qemu-img commit will allows you to merge from a 'top' image (snapFilepath)
-// into a lower-level 'base' image (backingFilepath).
-func commitSnapshot(snapFilepath string) error {
-	logrus.Infof("Start commitSnapshot %s", snapFilepath)
-	exec := lhexec.NewExecutor().Execute
-	_, err := exec(nil, QEMUImageBinary, []string{"commit", snapFilepath}, lhtypes.ExecuteNoTimeout)
+func writeImage(src io.ReaderAt, size int64, dstFilepath, format string) error {
+	logrus.Infof("Start writing the %s image %s", format, dstFilepath)
+	var err error
+	switch format {
+	case "qcow2":
+		err = qcow.Create(dstFilepath, size, src)
+	case "raw":
+		err = writeRawImage(src, size, dstFilepath)
+	default:
+		err = fmt.Errorf("unsupported output image format: %s", format)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "failed commitSnapshot %s", snapFilepath)
+		return errors.Wrapf(err, "failed to write the %s image %s", format, dstFilepath)
 	}
-	logrus.Infof("Done commitSnapshot %s", snapFilepath)
+	logrus.Infof("Done writing the %s image %s", format, dstFilepath)
 	return nil
 }
+
+// writeRawImage writes src to a sparse file, leaving holes for the blocks that are all zeros.
+func writeRawImage(src io.ReaderAt, size int64, dstFilepath string) error {
+	dst, err := os.OpenFile(dstFilepath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+	buf := make([]byte, imageBlockSize)
+	for off := int64(0); off < size; off += imageBlockSize {
+		n, err := src.ReadAt(buf[:min(imageBlockSize, size-off)], off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if isZeroes(buf[:n]) {
+			continue
+		}
+		if _, err := dst.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+	}
+	return dst.Sync()
+}
+
+// overlayReader reads top, except for the blocks of top that are all zeros, which are read from base. base reads
+// zeros beyond baseSize.
+type overlayReader struct {
+	top      io.ReaderAt
+	base     io.ReaderAt
+	baseSize int64
+}
+
+func (r *overlayReader) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := r.top.ReadAt(buf, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, err
+	}
+	for start := 0; start < n; {
+		end := min(n, start+int(imageBlockSize-(off+int64(start))%imageBlockSize))
+		block := buf[start:end]
+		blockOff := off + int64(start)
+		if isZeroes(block) && blockOff < r.baseSize {
+			length := min(int64(len(block)), r.baseSize-blockOff)
+			if _, err := r.base.ReadAt(block[:length], blockOff); err != nil && !errors.Is(err, io.EOF) {
+				return start, err
+			}
+		}
+		start = end
+	}
+	return n, err
+}
+
+func isZeroes(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
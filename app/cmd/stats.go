@@ -1,8 +1,22 @@
 package cmd
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+	"github.com/longhorn/longhorn-engine/pkg/opjournal"
+)
+
+const (
+	journalFormatPerfetto = "perfetto"
+	journalFormatJSON     = "json"
 )
 
 // Journal flush operations since last flush
@@ -15,6 +29,9 @@ func Journal() cli.Command {
 				Value: 0,
 			},
 		},
+		Subcommands: []cli.Command{
+			JournalExportCmd(),
+		},
 		Action: func(c *cli.Context) {
 			controllerClient, err := getControllerClient(c)
 			if err != nil {
@@ -32,3 +49,107 @@ func Journal() cli.Command {
 		},
 	}
 }
+
+func JournalExportCmd() cli.Command {
+	return cli.Command{
+		Name:  "export",
+		Usage: "export the timing of the in-flight and latest completed dataconn ops of the controller and its replicas, which must run with --enable-op-journal",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "format",
+				Value: journalFormatPerfetto,
+				Usage: "output format, perfetto (a trace to load in ui.perfetto.dev) or json",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: "-",
+				Usage: "file to write to, - for stdout",
+			},
+			cli.IntFlag{
+				Name:  "limit",
+				Value: 0,
+				Usage: "the maximum number of completed ops to export from each process, 0 for all the ops still kept",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := exportJournal(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running journal export command")
+			}
+		},
+	}
+}
+
+func exportJournal(c *cli.Context) error {
+	format := c.String("format")
+	if format != journalFormatPerfetto && format != journalFormatJSON {
+		return fmt.Errorf("invalid format %v, must be %v or %v", format, journalFormatPerfetto, journalFormatJSON)
+	}
+	limit := c.Int("limit")
+	volumeName := c.GlobalString("volume-name")
+
+	controllerClient, err := getControllerClient(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := controllerClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close controller client")
+		}
+	}()
+
+	replicas, err := controllerClient.ReplicaList()
+	if err != nil {
+		return err
+	}
+
+	controllerOps, err := exportJournalFrom(c.GlobalString("url"), volumeName, c.GlobalString("engine-instance-name"), limit)
+	if err != nil {
+		return err
+	}
+	processes := []opjournal.Process{{Name: "controller " + c.GlobalString("url"), Ops: controllerOps}}
+
+	for _, r := range replicas {
+		ops, err := exportJournalFrom(r.Address, volumeName, "", limit)
+		if err != nil {
+			// The journal of the other processes is still worth looking at, e.g. to find out why a replica
+			// went away.
+			logrus.WithError(err).Warnf("Failed to export journal of replica %v", r.Address)
+			continue
+		}
+		processes = append(processes, opjournal.Process{Name: "replica " + r.Address, Ops: ops})
+	}
+	exportedAt := time.Now()
+
+	var w io.Writer = os.Stdout
+	if output := c.String("output"); output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create %v", output)
+		}
+		defer func() {
+			if errClose := f.Close(); errClose != nil {
+				logrus.WithError(errClose).Errorf("Failed to close %v", output)
+			}
+		}()
+		w = f
+	}
+
+	if format == journalFormatJSON {
+		return opjournal.WriteJSON(w, processes)
+	}
+	return opjournal.WritePerfetto(w, processes, exportedAt)
+}
+
+func exportJournalFrom(address, volumeName, instanceName string, limit int) ([]dataconn.JournalOp, error) {
+	client, err := opjournal.NewClient(address, volumeName, instanceName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := client.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close journal client for %v", address)
+		}
+	}()
+
+	return client.Export(limit)
+}
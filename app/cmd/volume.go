@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"text/tabwriter"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+
+	"github.com/longhorn/longhorn-engine/pkg/sync"
 )
 
 func InfoCmd() cli.Command {
@@ -63,6 +69,7 @@ func FrontendCmd() cli.Command {
 		Subcommands: []cli.Command{
 			FrontendStartCmd(),
 			FrontendShutdownCmd(),
+			FrontendLsCmd(),
 		},
 	}
 }
@@ -71,6 +78,16 @@ func FrontendStartCmd() cli.Command {
 	return cli.Command{
 		Name:  "start",
 		Usage: "start <frontend name>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "Start the frontend under this name besides the frontend of the volume",
+			},
+			cli.BoolFlag{
+				Name:  "read-only",
+				Usage: "Reject the writes and unmaps coming through the named frontend",
+			},
+		},
 		Action: func(c *cli.Context) {
 			if err := startFrontend(c); err != nil {
 				logrus.WithError(err).Fatalf("Error running frontend start command")
@@ -83,6 +100,12 @@ func FrontendShutdownCmd() cli.Command {
 	return cli.Command{
 		Name:  "shutdown",
 		Usage: "shutdown",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "Shut down the frontend started under this name instead of the frontend of the volume",
+			},
+		},
 		Action: func(c *cli.Context) {
 			if err := shutdownFrontend(c); err != nil {
 				logrus.WithError(err).Fatalf("Error running frontend shutdown command")
@@ -91,6 +114,51 @@ func FrontendShutdownCmd() cli.Command {
 	}
 }
 
+func FrontendLsCmd() cli.Command {
+	return cli.Command{
+		Name:  "ls",
+		Usage: "list the frontend of the volume and the named frontends",
+		Action: func(c *cli.Context) {
+			if err := lsFrontend(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running frontend ls command")
+			}
+		},
+	}
+}
+
+func VolumeCmd() cli.Command {
+	return cli.Command{
+		Name: "volume",
+		Subcommands: []cli.Command{
+			VolumeFlattenCmd(),
+			VolumeFlattenStatusCmd(),
+		},
+	}
+}
+
+func VolumeFlattenCmd() cli.Command {
+	return cli.Command{
+		Name:  "flatten",
+		Usage: "copy the backing file into the oldest snapshot of every replica and detach it from the volume",
+		Action: func(c *cli.Context) {
+			if err := flattenVolume(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running volume flatten command")
+			}
+		},
+	}
+}
+
+func VolumeFlattenStatusCmd() cli.Command {
+	return cli.Command{
+		Name: "flatten-status",
+		Action: func(c *cli.Context) {
+			if err := flattenVolumeStatus(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running volume flatten status command")
+			}
+		},
+	}
+}
+
 func info(c *cli.Context) error {
 	controllerClient, err := getControllerClient(c)
 	if err != nil {
@@ -147,6 +215,12 @@ func startFrontend(c *cli.Context) error {
 		}
 	}()
 
+	if name := c.String("name"); name != "" {
+		return controllerClient.FrontendStart(name, frontendName, c.Bool("read-only"))
+	}
+	if c.Bool("read-only") {
+		return fmt.Errorf("only a named frontend can be read-only")
+	}
 	return controllerClient.VolumeFrontendStart(frontendName)
 }
 
@@ -161,9 +235,45 @@ func shutdownFrontend(c *cli.Context) error {
 		}
 	}()
 
+	if name := c.String("name"); name != "" {
+		return controllerClient.FrontendShutdown(name)
+	}
 	return controllerClient.VolumeFrontendShutdown()
 }
 
+func lsFrontend(c *cli.Context) error {
+	controllerClient, err := getControllerClient(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := controllerClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close controller client")
+		}
+	}()
+
+	frontends, err := controllerClient.FrontendList()
+	if err != nil {
+		return err
+	}
+
+	format := "%s\t%s\t%s\t%v\t%s\n"
+	tw := tabwriter.NewWriter(os.Stdout, 0, 20, 1, ' ', 0)
+	_, _ = fmt.Fprintf(tw, format, "NAME", "FRONTEND", "STATE", "READ-ONLY", "ENDPOINT")
+	for _, f := range frontends {
+		name := f.Name
+		if name == "" {
+			name = "-"
+		}
+		_, _ = fmt.Fprintf(tw, format, name, f.Frontend, f.State, f.ReadOnly, f.Endpoint)
+	}
+	if errFlush := tw.Flush(); errFlush != nil {
+		logrus.WithError(errFlush).Error("Failed to flush")
+	}
+
+	return nil
+}
+
 func unmapMarkSnapChainRemoved(c *cli.Context) error {
 	enabled := c.Bool("enable")
 	disabled := c.Bool("disable")
@@ -186,3 +296,46 @@ func unmapMarkSnapChainRemoved(c *cli.Context) error {
 
 	return controllerClient.VolumeUnmapMarkSnapChainRemovedSet(enabled)
 }
+
+func flattenVolume(c *cli.Context) error {
+	url := c.GlobalString("url")
+	volumeName := c.GlobalString("volume-name")
+	engineInstanceName := c.GlobalString("engine-instance-name")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	task, err := sync.NewTask(ctx, url, volumeName, engineInstanceName)
+	if err != nil {
+		return err
+	}
+
+	if err := task.FlattenVolume(); err != nil {
+		return errors.Wrap(err, "failed to flatten volume")
+	}
+
+	return nil
+}
+
+func flattenVolumeStatus(c *cli.Context) error {
+	url := c.GlobalString("url")
+	volumeName := c.GlobalString("volume-name")
+	engineInstanceName := c.GlobalString("engine-instance-name")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	task, err := sync.NewTask(ctx, url, volumeName, engineInstanceName)
+	if err != nil {
+		return err
+	}
+
+	statusMap, err := task.FlattenVolumeStatus()
+	if err != nil {
+		return err
+	}
+
+	output, err := json.MarshalIndent(statusMap, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(output))
+	return nil
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	watchRetryInterval = 2 * time.Second
+)
+
+func ControllerWatchCmd() cli.Command {
+	return cli.Command{
+		Name:  "watch",
+		Usage: "Stream volume, replica and metrics events of the controller as JSON lines",
+		Flags: []cli.Flag{
+			cli.Uint64Flag{
+				Name:  "since",
+				Usage: "Resume after the event with this sequence number. 0 means only new events",
+			},
+			cli.StringSliceFlag{
+				Name:  "type",
+				Usage: "Only show events of this type (volume, replica or metrics). Can be specified multiple times",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := watchController(c); err != nil {
+				logrus.WithError(err).Fatalf("Error running controller watch command")
+			}
+		},
+	}
+}
+
+func watchController(c *cli.Context) error {
+	since := c.Uint64("since")
+	eventTypes := c.StringSlice("type")
+	for _, t := range eventTypes {
+		switch t {
+		case types.EventTypeVolume, types.EventTypeReplica, types.EventTypeMetrics:
+		default:
+			return fmt.Errorf("invalid event type %v", t)
+		}
+	}
+
+	controllerClient, err := getControllerClient(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := controllerClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close controller client")
+		}
+	}()
+
+	handler := func(e *types.Event) error {
+		output, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+		if e.Seq != 0 {
+			since = e.Seq
+		}
+		return nil
+	}
+
+	// The stream breaks when the controller restarts or this watcher falls behind. Resume from the last event seen,
+	// or from now on if the controller no longer has it.
+	for {
+		err := controllerClient.Watch(context.Background(), since, eventTypes, handler)
+		if status.Code(errors.Cause(err)) == codes.OutOfRange {
+			logrus.WithError(err).Warnf("Cannot resume watching from event %v, watching new events only", since)
+			since = 0
+			continue
+		}
+		logrus.WithError(err).Warnf("Event stream is broken, retrying in %v", watchRetryInterval)
+		time.Sleep(watchRetryInterval)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -13,11 +14,19 @@ import (
 	"github.com/moby/moby/pkg/reexec"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/longhorn/sparse-tools/cli/ssync"
 
 	"github.com/longhorn/longhorn-engine/app/cmd"
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
 	"github.com/longhorn/longhorn-engine/pkg/meta"
+	"github.com/longhorn/longhorn-engine/pkg/tracing"
+)
+
+const (
+	tracingShutdownTimeout = 5 * time.Second
 )
 
 // following variables will be filled by `-ldflags "-X ..."`
@@ -70,6 +79,15 @@ func onUsageError(c *cli.Context, err error, isSubcommand bool) error {
 	panic(fmt.Errorf("usage error, please check your command"))
 }
 
+// isServerCommand tells if the command runs a long-lived server rather than doing one thing and exiting.
+func isServerCommand(command string) bool {
+	switch command {
+	case "controller", "replica", "sync-agent":
+		return true
+	}
+	return false
+}
+
 func longhornCli() {
 	pprofFile := os.Getenv("PPROFILE")
 	if pprofFile != "" {
@@ -101,10 +119,43 @@ func longhornCli() {
 		FullTimestamp:   true,
 	})
 
+	var shutdownTracing func(context.Context) error
+	var commandSpan trace.Span
 	a.Before = func(c *cli.Context) error {
 		if c.GlobalBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+
+		command := c.Args().First()
+		var err error
+		shutdownTracing, err = tracing.Setup(tracing.Options{
+			OTLPEndpoint:        c.GlobalString("tracing-otlp-endpoint"),
+			File:                c.GlobalString("tracing-file"),
+			SampleRatio:         c.GlobalFloat64("tracing-sample-ratio"),
+			DataconnSampleRatio: c.GlobalFloat64("tracing-dataconn-sample-ratio"),
+			Command:             command,
+		})
+		if err != nil {
+			return err
+		}
+		dataconn.EnableJournal(c.GlobalBool("enable-op-journal"))
+		if !isServerCommand(command) {
+			commandSpan = tracing.StartCommandSpan(command, attribute.StringSlice("longhorn.args", c.Args().Tail()))
+		}
+		return nil
+	}
+	a.After = func(c *cli.Context) error {
+		if commandSpan != nil {
+			commandSpan.End()
+		}
+		if shutdownTracing == nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to flush traces")
+		}
 		return nil
 	}
 	a.Flags = []cli.Flag{
@@ -125,6 +176,33 @@ func longhornCli() {
 		cli.BoolFlag{
 			Name: "debug",
 		},
+		cli.StringFlag{
+			Name:   "tracing-otlp-endpoint",
+			EnvVar: "LONGHORN_TRACING_OTLP_ENDPOINT",
+			Usage:  "Export OpenTelemetry traces to this OTLP gRPC collector, e.g. localhost:4317",
+		},
+		cli.StringFlag{
+			Name:   "tracing-file",
+			EnvVar: "LONGHORN_TRACING_FILE",
+			Usage:  "Append OpenTelemetry traces to this file as JSON. Ignored if --tracing-otlp-endpoint is set",
+		},
+		cli.Float64Flag{
+			Name:   "tracing-sample-ratio",
+			EnvVar: "LONGHORN_TRACING_SAMPLE_RATIO",
+			Value:  1,
+			Usage:  "Fraction of traces to sample when tracing is enabled",
+		},
+		cli.Float64Flag{
+			Name:   "tracing-dataconn-sample-ratio",
+			EnvVar: "LONGHORN_TRACING_DATACONN_SAMPLE_RATIO",
+			Value:  0,
+			Usage:  "Fraction of data connection requests between the controller and the replicas to trace",
+		},
+		cli.BoolFlag{
+			Name:   "enable-op-journal",
+			EnvVar: "LONGHORN_ENABLE_OP_JOURNAL",
+			Usage:  "Record the timing of the data connection requests of this process for 'journal export'",
+		},
 	}
 	a.Commands = []cli.Command{
 		cmd.ControllerCmd(),
@@ -135,6 +213,7 @@ func longhornCli() {
 		cmd.AddReplicaCmd(),
 		cmd.VerifyRebuildReplicaCmd(),
 		cmd.LsReplicaCmd(),
+		cmd.ReplicaMetricsCmd(),
 		cmd.RmReplicaCmd(),
 		cmd.UpdateReplicaCmd(),
 		cmd.RebuildStatusCmd(),
@@ -146,8 +225,12 @@ func longhornCli() {
 		cmd.ExpandCmd(),
 		cmd.UnmapMarkSnapChainRemovedCmd(),
 		cmd.Journal(),
+		cmd.CaptureCmd(),
+		cmd.ReplayCmd(),
+		cmd.BenchCmd(),
 		cmd.InfoCmd(),
 		cmd.FrontendCmd(),
+		cmd.VolumeCmd(),
 		cmd.SystemBackupCmd(),
 		cmd.ProfilerCmd(),
 		VersionCmd(),
@@ -0,0 +1,87 @@
+package fault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Listen listens for the fault API on address, which is either unix:///path/to/socket or a loopback host:port. Anyone
+// who can reach the API can fail the I/O of the volume, and it has no authentication, so other addresses are refused.
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fault injection address %v: %w", address, err)
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("fault injection address %v must be a unix socket or a loopback address", address)
+		}
+	}
+	return net.Listen("tcp", address)
+}
+
+// Handler serves the rules of the injector over HTTP:
+//
+//	GET    /v1/faults       lists the rules
+//	POST   /v1/faults       adds the rule in the JSON body, and returns it with its ID
+//	DELETE /v1/faults       removes all the rules
+//	DELETE /v1/faults/{id}  removes a rule
+func (i *Injector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/faults", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, i.ListRules())
+	})
+	mux.HandleFunc("POST /v1/faults", func(w http.ResponseWriter, r *http.Request) {
+		var rule Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := i.AddRule(rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logrus.Infof("Added fault rule %v: %+v", id, rule)
+		rule.ID = id
+		writeJSON(w, http.StatusCreated, rule)
+	})
+	mux.HandleFunc("DELETE /v1/faults", func(w http.ResponseWriter, r *http.Request) {
+		i.Clear()
+		logrus.Info("Removed all fault rules")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /v1/faults/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := i.RemoveRule(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logrus.Infof("Removed fault rule %v", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Warn("Failed to write fault API response")
+	}
+}
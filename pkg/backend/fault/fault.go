@@ -0,0 +1,318 @@
+package fault
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+// PingInterval is how often the ping rules are checked. It matches the ping interval of the remote backend.
+const PingInterval = 2 * time.Second
+
+// Factory creates backends that wrap the backends of another factory and inject the faults described by the rules
+// of its Injector. A fault address is the wrapped address with the fault:// scheme in front, e.g.
+// fault://tcp://10.0.0.1:9502, and the rules refer to it by the wrapped address. The controller only knows the fault
+// address, so it is meant for tests and for controllers that do not rebuild or back up the wrapped replicas.
+type Factory struct {
+	inner    types.BackendFactory
+	injector *Injector
+}
+
+func New(inner types.BackendFactory, injector *Injector) types.BackendFactory {
+	return &Factory{
+		inner:    inner,
+		injector: injector,
+	}
+}
+
+func (f *Factory) Create(volumeName, address string, dataServerProtocol types.DataServerProtocol,
+	sharedTimeouts types.SharedTimeouts) (types.Backend, error) {
+	logrus.Infof("Creating fault backend for %v", address)
+
+	backend, err := f.inner.Create(volumeName, address, dataServerProtocol, sharedTimeouts)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backend{
+		Backend:     backend,
+		target:      address,
+		injector:    f.injector,
+		monitorChan: make(types.MonitorChannel, 5),
+		stopChan:    make(chan struct{}, 5),
+		closed:      make(chan struct{}),
+	}
+	go b.monitor(backend.GetMonitorChannel(), b.stopChan, b.monitorChan)
+	return b, nil
+}
+
+// Backend is a backend with faults injected into its ops.
+type Backend struct {
+	types.Backend
+
+	target   string
+	injector *Injector
+
+	// monitorLock guards the monitoring channels, which Reconnect replaces
+	monitorLock sync.Mutex
+	monitorChan types.MonitorChannel
+	stopChan    chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// apply waits out the delays and hangs of the rules matching the op, and returns the first rule that changes the
+// result of the op, if any.
+func (b *Backend) apply(op string, off, length int64) *Rule {
+	for _, r := range b.injector.match(b.target, op, off, length) {
+		switch r.Action {
+		case ActionDelay:
+			select {
+			case <-time.After(r.delay):
+			case <-b.closed:
+			}
+		case ActionHang:
+			select {
+			case <-r.released:
+			case <-b.closed:
+			}
+		default:
+			return &r
+		}
+	}
+	return nil
+}
+
+func injectedError(r *Rule, op string) error {
+	if r.Message != "" {
+		return fmt.Errorf("%v", r.Message)
+	}
+	return fmt.Errorf("injected %v fault by rule %v", op, r.ID)
+}
+
+func limitBytes(r *Rule, length int) int {
+	if r.Bytes > length {
+		return length
+	}
+	return r.Bytes
+}
+
+func (b *Backend) ReadAt(p []byte, off int64) (int, error) {
+	r := b.apply(OpRead, off, int64(len(p)))
+	if r == nil {
+		return b.Backend.ReadAt(p, off)
+	}
+
+	switch r.Action {
+	case ActionENOSPC:
+		return 0, types.ErrNoSpaceLeftOnDevice
+	case ActionPartial:
+		n, err := b.Backend.ReadAt(p[:limitBytes(r, len(p))], off)
+		if err != nil {
+			return n, err
+		}
+		return n, fmt.Errorf("partial read of %v out of %v bytes at offset %v", n, len(p), off)
+	}
+	return 0, injectedError(r, OpRead)
+}
+
+func (b *Backend) WriteAt(p []byte, off int64) (int, error) {
+	r := b.apply(OpWrite, off, int64(len(p)))
+	if r == nil {
+		return b.Backend.WriteAt(p, off)
+	}
+
+	switch r.Action {
+	case ActionENOSPC, ActionPartial:
+		n := 0
+		if limit := limitBytes(r, len(p)); limit > 0 {
+			var err error
+			if n, err = b.Backend.WriteAt(p[:limit], off); err != nil {
+				return n, err
+			}
+		}
+		if r.Action == ActionENOSPC {
+			return n, types.ErrNoSpaceLeftOnDevice
+		}
+		return n, fmt.Errorf("partial write of %v out of %v bytes at offset %v", n, len(p), off)
+	}
+	return 0, injectedError(r, OpWrite)
+}
+
+// WriteZeroesAt is subject to the rules of writes.
+func (b *Backend) WriteZeroesAt(length uint32, off int64) (int, error) {
+	r := b.apply(OpWrite, off, int64(length))
+	if r == nil {
+		return util.WriteZeroesAt(b.Backend, length, off)
+	}
+
+	switch r.Action {
+	case ActionENOSPC, ActionPartial:
+		n := 0
+		if limit := limitBytes(r, int(length)); limit > 0 {
+			var err error
+			if n, err = util.WriteZeroesAt(b.Backend, uint32(limit), off); err != nil {
+				return n, err
+			}
+		}
+		if r.Action == ActionENOSPC {
+			return n, types.ErrNoSpaceLeftOnDevice
+		}
+		return n, fmt.Errorf("partial write of %v out of %v bytes at offset %v", n, length, off)
+	}
+	return 0, injectedError(r, OpWrite)
+}
+
+func (b *Backend) UnmapAt(length uint32, off int64) (int, error) {
+	r := b.apply(OpUnmap, off, int64(length))
+	if r == nil {
+		return b.Backend.UnmapAt(length, off)
+	}
+
+	switch r.Action {
+	case ActionENOSPC:
+		return 0, types.ErrNoSpaceLeftOnDevice
+	case ActionPartial:
+		n, err := b.Backend.UnmapAt(uint32(limitBytes(r, int(length))), off)
+		if err != nil {
+			return n, err
+		}
+		return n, fmt.Errorf("partial unmap of %v out of %v bytes at offset %v", n, length, off)
+	}
+	return 0, injectedError(r, OpUnmap)
+}
+
+// Flush is subject to the rules of writes, as a write to the whole volume.
+func (b *Backend) Flush() error {
+	if r := b.apply(OpWrite, 0, math.MaxInt64); r != nil && r.Action != ActionPartial {
+		if r.Action == ActionENOSPC {
+			return types.ErrNoSpaceLeftOnDevice
+		}
+		return injectedError(r, OpWrite)
+	}
+	if f, ok := b.Backend.(types.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (b *Backend) GetLastModifyTime() (int64, error) {
+	if r := b.apply(OpInfo, 0, 0); r != nil {
+		if r.Action != ActionOverride {
+			return 0, injectedError(r, OpInfo)
+		}
+		if r.LastModifyTime != nil {
+			return *r.LastModifyTime, nil
+		}
+	}
+	return b.Backend.GetLastModifyTime()
+}
+
+func (b *Backend) GetHeadFileSize() (int64, error) {
+	if r := b.apply(OpInfo, 0, 0); r != nil {
+		if r.Action != ActionOverride {
+			return 0, injectedError(r, OpInfo)
+		}
+		if r.HeadFileSize != nil {
+			return *r.HeadFileSize, nil
+		}
+	}
+	return b.Backend.GetHeadFileSize()
+}
+
+func (b *Backend) GetRevisionCounter() (int64, error) {
+	if r := b.apply(OpInfo, 0, 0); r != nil {
+		if r.Action != ActionOverride {
+			return 0, injectedError(r, OpInfo)
+		}
+		if r.RevisionCounter != nil {
+			return *r.RevisionCounter, nil
+		}
+	}
+	return b.Backend.GetRevisionCounter()
+}
+
+// monitor forwards the result of the monitoring of the wrapped backend, and fails the monitoring if a ping is
+// dropped.
+func (b *Backend) monitor(inner types.MonitorChannel, stopChan chan struct{}, monitorChan types.MonitorChannel) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-inner:
+			monitorChan <- err
+			return
+		case <-stopChan:
+			monitorChan <- nil
+			return
+		case <-b.closed:
+			return
+		case <-ticker.C:
+			if r := b.apply(OpPing, 0, 0); r != nil {
+				monitorChan <- fmt.Errorf("ping of %v dropped by fault rule %v", b.target, r.ID)
+				return
+			}
+		}
+	}
+}
+
+func (b *Backend) GetMonitorChannel() types.MonitorChannel {
+	b.monitorLock.Lock()
+	defer b.monitorLock.Unlock()
+	return b.monitorChan
+}
+
+func (b *Backend) StopMonitoring() {
+	b.Backend.StopMonitoring()
+	b.monitorLock.Lock()
+	defer b.monitorLock.Unlock()
+	select {
+	case b.stopChan <- struct{}{}:
+	default:
+	}
+}
+
+// Reconnect reconnects the wrapped backend if it can. It fails while pings are dropped, like a replica that cannot
+// be reached.
+func (b *Backend) Reconnect() error {
+	inner, ok := b.Backend.(types.ReconnectableBackend)
+	if !ok {
+		return fmt.Errorf("backend of %v cannot reconnect", b.target)
+	}
+	if r := b.apply(OpPing, 0, 0); r != nil {
+		return fmt.Errorf("reconnect to %v dropped by fault rule %v", b.target, r.ID)
+	}
+	if err := inner.Reconnect(); err != nil {
+		return err
+	}
+
+	b.monitorLock.Lock()
+	defer b.monitorLock.Unlock()
+	b.stopChan = make(chan struct{}, 5)
+	b.monitorChan = make(types.MonitorChannel, 5)
+	go b.monitor(inner.GetMonitorChannel(), b.stopChan, b.monitorChan)
+	return nil
+}
+
+func (b *Backend) GetChain() ([]string, error) {
+	inner, ok := b.Backend.(types.ReconnectableBackend)
+	if !ok {
+		return nil, fmt.Errorf("backend of %v cannot tell its chain", b.target)
+	}
+	return inner.GetChain()
+}
+
+// Close releases the ops that are delayed or hung, and closes the wrapped backend.
+func (b *Backend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	return b.Backend.Close()
+}
@@ -0,0 +1,228 @@
+package fault
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	OpRead  = "read"
+	OpWrite = "write"
+	OpUnmap = "unmap"
+	// OpPing is checked every PingInterval. A matching drop rule fails the backend monitoring the way a replica
+	// that stops answering pings does.
+	OpPing = "ping"
+	// OpInfo covers GetLastModifyTime, GetHeadFileSize and GetRevisionCounter, which salvage relies on.
+	OpInfo = "info"
+
+	// ActionDelay delays the op by Delay and lets the following rules apply.
+	ActionDelay = "delay"
+	// ActionError fails the op with Message.
+	ActionError = "error"
+	// ActionENOSPC fails the op with types.ErrNoSpaceLeftOnDevice after Bytes bytes were written.
+	ActionENOSPC = "enospc"
+	// ActionPartial writes the first Bytes bytes only and fails the op.
+	ActionPartial = "partial"
+	// ActionHang blocks the op until the rule is removed or the backend is closed.
+	ActionHang = "hang"
+	// ActionDrop drops the pings.
+	ActionDrop = "drop"
+	// ActionOverride replaces the values returned by the info ops with the ones set in the rule.
+	ActionOverride = "override"
+)
+
+// Rule describes a fault injected into the ops of the fault backends. Every field of the match part that is left
+// empty matches everything.
+type Rule struct {
+	ID int `json:"id"`
+
+	// Target is the address wrapped by the fault backend, e.g. tcp://10.0.0.1:9502.
+	Target string `json:"target,omitempty"`
+	Op     string `json:"op,omitempty"`
+	// OffsetStart and OffsetEnd match the ops that overlap [OffsetStart, OffsetEnd). OffsetEnd 0 means no end.
+	OffsetStart int64 `json:"offsetStart,omitempty"`
+	OffsetEnd   int64 `json:"offsetEnd,omitempty"`
+	// Probability is the chance that a matching op is affected, from 0 to 1. 0 means always.
+	Probability float64 `json:"probability,omitempty"`
+	// Count is the number of ops the rule affects. The rule stays in place afterwards, so the ops it hangs are not
+	// released until it is removed. 0 means no limit.
+	Count int `json:"count,omitempty"`
+
+	Action  string `json:"action"`
+	Delay   string `json:"delay,omitempty"`
+	Message string `json:"message,omitempty"`
+	Bytes   int    `json:"bytes,omitempty"`
+
+	LastModifyTime  *int64 `json:"lastModifyTime,omitempty"`
+	HeadFileSize    *int64 `json:"headFileSize,omitempty"`
+	RevisionCounter *int64 `json:"revisionCounter,omitempty"`
+
+	// Hits is the number of ops the rule has affected so far.
+	Hits int `json:"hits"`
+
+	delay    time.Duration
+	released chan struct{}
+}
+
+func (r *Rule) validate() error {
+	switch r.Op {
+	case "", OpRead, OpWrite, OpUnmap, OpPing, OpInfo:
+	default:
+		return fmt.Errorf("invalid op %v", r.Op)
+	}
+
+	switch r.Action {
+	case ActionDelay:
+		d, err := time.ParseDuration(r.Delay)
+		if err != nil {
+			return fmt.Errorf("invalid delay %v: %v", r.Delay, err)
+		}
+		r.delay = d
+	case ActionError, ActionHang:
+	case ActionENOSPC, ActionPartial:
+		if r.Bytes < 0 {
+			return fmt.Errorf("invalid bytes %v", r.Bytes)
+		}
+	case ActionDrop:
+		if r.Op != OpPing {
+			return fmt.Errorf("action %v only applies to op %v", r.Action, OpPing)
+		}
+	case ActionOverride:
+		if r.Op != OpInfo {
+			return fmt.Errorf("action %v only applies to op %v", r.Action, OpInfo)
+		}
+	default:
+		return fmt.Errorf("invalid action %v", r.Action)
+	}
+
+	if r.OffsetStart < 0 || (r.OffsetEnd != 0 && r.OffsetEnd <= r.OffsetStart) {
+		return fmt.Errorf("invalid offset range [%v, %v)", r.OffsetStart, r.OffsetEnd)
+	}
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("invalid probability %v", r.Probability)
+	}
+	return nil
+}
+
+func (r *Rule) matches(target, op string, off, length int64) bool {
+	if r.Target != "" && r.Target != target {
+		return false
+	}
+	if r.Op == "" {
+		// Rules without an op only apply to the I/O ops.
+		if op != OpRead && op != OpWrite && op != OpUnmap {
+			return false
+		}
+	} else if r.Op != op {
+		return false
+	}
+	if op == OpRead || op == OpWrite || op == OpUnmap {
+		if off+length <= r.OffsetStart || (r.OffsetEnd != 0 && off >= r.OffsetEnd) {
+			return false
+		}
+	}
+	return r.Probability == 0 || rand.Float64() < r.Probability
+}
+
+// Injector keeps the fault rules shared by all the backends created by a Factory. It is safe for concurrent use.
+type Injector struct {
+	sync.Mutex
+
+	rules  map[int]*Rule
+	nextID int
+}
+
+func NewInjector() *Injector {
+	return &Injector{
+		rules:  map[int]*Rule{},
+		nextID: 1,
+	}
+}
+
+// AddRule validates rule and adds it, and returns its ID.
+func (i *Injector) AddRule(rule Rule) (int, error) {
+	if err := rule.validate(); err != nil {
+		return 0, err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	rule.ID = i.nextID
+	rule.Hits = 0
+	rule.released = make(chan struct{})
+	i.nextID++
+	i.rules[rule.ID] = &rule
+	return rule.ID, nil
+}
+
+// RemoveRule removes the rule and releases the ops it hangs.
+func (i *Injector) RemoveRule(id int) error {
+	i.Lock()
+	defer i.Unlock()
+
+	if _, ok := i.rules[id]; !ok {
+		return fmt.Errorf("cannot find fault rule %v", id)
+	}
+	i.removeRuleNoLock(id)
+	return nil
+}
+
+func (i *Injector) removeRuleNoLock(id int) {
+	close(i.rules[id].released)
+	delete(i.rules, id)
+}
+
+// Clear removes all the rules.
+func (i *Injector) Clear() {
+	i.Lock()
+	defer i.Unlock()
+
+	for id := range i.rules {
+		i.removeRuleNoLock(id)
+	}
+}
+
+// ListRules returns a copy of the rules in the order they were added.
+func (i *Injector) ListRules() []Rule {
+	i.Lock()
+	defer i.Unlock()
+
+	rules := make([]Rule, 0, len(i.rules))
+	for _, r := range i.rules {
+		rules = append(rules, *r)
+	}
+	sort.Slice(rules, func(a, b int) bool {
+		return rules[a].ID < rules[b].ID
+	})
+	return rules
+}
+
+// match returns copies of the rules that apply to the op, in the order they were added, and counts the hits.
+func (i *Injector) match(target, op string, off, length int64) []Rule {
+	i.Lock()
+	defer i.Unlock()
+
+	ids := make([]int, 0, len(i.rules))
+	for id := range i.rules {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	matched := []Rule{}
+	for _, id := range ids {
+		r := i.rules[id]
+		if r.Count != 0 && r.Hits >= r.Count {
+			continue
+		}
+		if !r.matches(target, op, off, length) {
+			continue
+		}
+		r.Hits++
+		matched = append(matched, *r)
+	}
+	return matched
+}
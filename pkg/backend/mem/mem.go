@@ -0,0 +1,562 @@
+package mem
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
+)
+
+const (
+	blockSize = util.BlockSizeLinux
+
+	OpSnapshot           = "snapshot"
+	OpExpand             = "expand"
+	OpGetRevisionCounter = "get-revision-counter"
+	OpSetRevisionCounter = "set-revision-counter"
+)
+
+// Factory creates backends for the in-memory replicas added to it. The address of a replica is mem://<name>. The
+// replicas outlive the backends, the same way replica processes outlive their connections to a controller, so a test
+// can check them after the controller is gone or connect a new controller to them.
+type Factory struct {
+	sync.Mutex
+	replicas map[string]*Replica
+}
+
+func New() *Factory {
+	return &Factory{
+		replicas: map[string]*Replica{},
+	}
+}
+
+// AddReplica adds an empty open replica of size bytes.
+func (f *Factory) AddReplica(name string, size int64) (*Replica, error) {
+	if size <= 0 || size%diskutil.VolumeSectorSize != 0 {
+		return nil, fmt.Errorf("size %v is not a positive multiple of volume sector size %v", size, diskutil.VolumeSectorSize)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.replicas[name]; ok {
+		return nil, fmt.Errorf("replica %v already exists", name)
+	}
+	r := &Replica{
+		name:             name,
+		size:             size,
+		state:            string(types.ReplicaStateOpen),
+		snapshotMaxCount: types.MaximumTotalSnapshotCount,
+		failures:         map[string]error{},
+	}
+	r.disks = []*Disk{r.newHead()}
+	f.replicas[name] = r
+	return r, nil
+}
+
+func (f *Factory) Replica(name string) *Replica {
+	f.Lock()
+	defer f.Unlock()
+	return f.replicas[name]
+}
+
+func (f *Factory) Create(volumeName, address string, dataServerProtocol types.DataServerProtocol,
+	sharedTimeouts types.SharedTimeouts) (types.Backend, error) {
+	r := f.Replica(address)
+	if r == nil {
+		return nil, fmt.Errorf("cannot find memory replica %v", address)
+	}
+
+	logrus.Infof("Connecting to memory replica %v", address)
+	b := &Backend{
+		Replica:     r,
+		monitorChan: make(types.MonitorChannel, 5),
+	}
+	r.attach(b)
+	return b, nil
+}
+
+// Disk is a snapshot or the volume head of a replica. Only the blocks written to it are kept.
+type Disk struct {
+	Name        string
+	UserCreated bool
+	Created     string
+	Labels      map[string]string
+	Removed     bool
+	Size        int64
+
+	blocks map[int64][]byte
+}
+
+// Replica is an in-memory replica. Its data is kept in a chain of disks like the one of a real replica, so
+// snapshots, unmaps and the snapshot usage behave the same way.
+type Replica struct {
+	sync.RWMutex
+
+	name  string
+	size  int64
+	state string
+	// disks is the chain from the oldest snapshot to the volume head.
+	disks []*Disk
+
+	revisionCounter           int64
+	revisionCounterDisabled   bool
+	lastModifyTime            int64
+	unmapMarkSnapChainRemoved bool
+	snapshotMaxCount          int
+	snapshotMaxSize           int64
+	rebuilding                bool
+
+	failures map[string]error
+	backends []*Backend
+}
+
+func (r *Replica) newHead() *Disk {
+	return &Disk{
+		Name:    fmt.Sprintf("volume-head-%03d.img", len(r.disks)),
+		Created: util.Now(),
+		Size:    r.size,
+		blocks:  map[int64][]byte{},
+	}
+}
+
+func (r *Replica) head() *Disk {
+	return r.disks[len(r.disks)-1]
+}
+
+func (r *Replica) attach(b *Backend) {
+	r.Lock()
+	defer r.Unlock()
+	r.backends = append(r.backends, b)
+}
+
+// FailNext makes the next call of op (OpSnapshot, OpExpand, OpGetRevisionCounter or OpSetRevisionCounter) fail with
+// err. Expand returns err as is, so a *types.Error can tell the controller whether the replica rolled back.
+func (r *Replica) FailNext(op string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.failures[op] = err
+}
+
+func (r *Replica) takeFailureNoLock(op string) error {
+	err := r.failures[op]
+	delete(r.failures, op)
+	return err
+}
+
+// Disconnect fails the monitoring of the backends connected to the replica, the way a crashed replica process
+// does, and puts the replica in the error state.
+func (r *Replica) Disconnect(err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.state = string(types.ReplicaStateError)
+	for _, b := range r.backends {
+		select {
+		case b.monitorChan <- err:
+		default:
+		}
+	}
+}
+
+func (r *Replica) SetState(state types.ReplicaState) {
+	r.Lock()
+	defer r.Unlock()
+	r.state = string(state)
+}
+
+func (r *Replica) SetRevisionCounterDisabled(disabled bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.revisionCounterDisabled = disabled
+}
+
+// SetLastModifyTime overrides the time of the last write, so salvage can be tested without waiting.
+func (r *Replica) SetLastModifyTime(t time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.lastModifyTime = t.UnixNano()
+}
+
+func (r *Replica) RevisionCounter() int64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.revisionCounter
+}
+
+func (r *Replica) Name() string {
+	return r.name
+}
+
+// Disks returns the chain of disks from the oldest snapshot to the volume head.
+func (r *Replica) Disks() []Disk {
+	r.RLock()
+	defer r.RUnlock()
+
+	disks := make([]Disk, 0, len(r.disks))
+	for _, d := range r.disks {
+		disk := *d
+		disk.blocks = nil
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+// readBlockNoLock reads a block through the chain. A block that is not in any disk reads as zeros.
+func (r *Replica) readBlockNoLock(block int64) []byte {
+	for i := len(r.disks) - 1; i >= 0; i-- {
+		if data, ok := r.disks[i].blocks[block]; ok {
+			return data
+		}
+	}
+	return nil
+}
+
+func (r *Replica) checkRangeNoLock(op string, length int, off int64) error {
+	if r.state != string(types.ReplicaStateOpen) && r.state != string(types.ReplicaStateDirty) {
+		return fmt.Errorf("cannot %v on replica %v in state %v", op, r.name, r.state)
+	}
+	if off < 0 || off+int64(length) > r.size {
+		return fmt.Errorf("EOF: %v of %v bytes at offset %v is beyond replica size %v", op, length, off, r.size)
+	}
+	return nil
+}
+
+func (r *Replica) modifiedNoLock() {
+	r.state = string(types.ReplicaStateDirty)
+	if !r.revisionCounterDisabled {
+		r.revisionCounter++
+	}
+	r.lastModifyTime = time.Now().UnixNano()
+}
+
+func (r *Replica) ReadAt(p []byte, off int64) (int, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if err := r.checkRangeNoLock("read", len(p), off); err != nil {
+		return 0, err
+	}
+
+	for n := 0; n < len(p); {
+		block := (off + int64(n)) / blockSize
+		inBlock := int((off + int64(n)) % blockSize)
+		count := min(blockSize-inBlock, len(p)-n)
+		if data := r.readBlockNoLock(block); data != nil {
+			copy(p[n:n+count], data[inBlock:])
+		} else {
+			clear(p[n : n+count])
+		}
+		n += count
+	}
+	return len(p), nil
+}
+
+func (r *Replica) WriteAt(p []byte, off int64) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.checkRangeNoLock("write", len(p), off); err != nil {
+		return 0, err
+	}
+
+	head := r.head()
+	for n := 0; n < len(p); {
+		block := (off + int64(n)) / blockSize
+		inBlock := int((off + int64(n)) % blockSize)
+		count := min(blockSize-inBlock, len(p)-n)
+
+		data, ok := head.blocks[block]
+		if !ok {
+			data = make([]byte, blockSize)
+			if count != blockSize {
+				if old := r.readBlockNoLock(block); old != nil {
+					copy(data, old)
+				}
+			}
+			head.blocks[block] = data
+		}
+		copy(data[inBlock:], p[n:n+count])
+		n += count
+	}
+	r.modifiedNoLock()
+	return len(p), nil
+}
+
+// UnmapAt punches the whole blocks in the range out of the volume head and out of the removed snapshots right
+// behind it, like a real replica does.
+func (r *Replica) UnmapAt(length uint32, off int64) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.checkRangeNoLock("unmap", int(length), off); err != nil {
+		return 0, err
+	}
+
+	unmappable := []*Disk{r.head()}
+	for i := len(r.disks) - 2; i >= 0; i-- {
+		disk := r.disks[i]
+		if r.unmapMarkSnapChainRemoved {
+			disk.Removed = true
+		}
+		if !disk.Removed {
+			break
+		}
+		unmappable = append(unmappable, disk)
+	}
+
+	first := (off + blockSize - 1) / blockSize
+	end := (off + int64(length)) / blockSize
+	for block := first; block < end; block++ {
+		for _, disk := range unmappable {
+			delete(disk.blocks, block)
+		}
+	}
+	r.modifiedNoLock()
+	return int(length), nil
+}
+
+func (r *Replica) snapshotNoLock(name string, userCreated bool, created string, labels map[string]string) error {
+	if r.snapshotMaxCount-r.snapshotCountUsageNoLock() <= 0 {
+		return fmt.Errorf("too many active disks: %v", len(r.disks))
+	}
+	if r.snapshotMaxSize != 0 && r.snapshotSizeUsageNoLock() >= r.snapshotMaxSize {
+		return fmt.Errorf("total snapshot size %v reaches the limit %v", r.snapshotSizeUsageNoLock(), r.snapshotMaxSize)
+	}
+
+	diskName := diskutil.GenerateSnapshotDiskName(name)
+	for _, d := range r.disks {
+		if d.Name == diskName {
+			return fmt.Errorf("snapshot %v is already existing", diskName)
+		}
+	}
+
+	head := r.head()
+	head.Name = diskName
+	head.UserCreated = userCreated
+	head.Created = created
+	head.Labels = labels
+	r.disks = append(r.disks, r.newHead())
+	return nil
+}
+
+func (r *Replica) snapshotCountUsageNoLock() int {
+	count := 0
+	for _, d := range r.disks[:len(r.disks)-1] {
+		if !d.Removed {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Replica) snapshotSizeUsageNoLock() int64 {
+	var size int64
+	for _, d := range r.disks[:len(r.disks)-1] {
+		if !d.Removed {
+			size += int64(len(d.blocks)) * blockSize
+		}
+	}
+	return size
+}
+
+// Backend is the connection of a controller to an in-memory replica.
+type Backend struct {
+	*Replica
+
+	monitorChan types.MonitorChannel
+	closeOnce   sync.Once
+}
+
+func (b *Backend) Close() error {
+	b.closeOnce.Do(func() {
+		r := b.Replica
+		r.Lock()
+		defer r.Unlock()
+		for i, backend := range r.backends {
+			if backend == b {
+				r.backends = append(r.backends[:i], r.backends[i+1:]...)
+				break
+			}
+		}
+	})
+	return nil
+}
+
+func (b *Backend) Snapshot(name string, userCreated bool, created string, labels map[string]string) error {
+	r := b.Replica
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.takeFailureNoLock(OpSnapshot); err != nil {
+		return err
+	}
+	return r.snapshotNoLock(name, userCreated, created, labels)
+}
+
+func (b *Backend) Expand(size int64) error {
+	r := b.Replica
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.takeFailureNoLock(OpExpand); err != nil {
+		return err
+	}
+	if size%diskutil.VolumeSectorSize != 0 {
+		return fmt.Errorf("failed to expand replica size %v, because it is not multiple of volume sector size %v", size, diskutil.VolumeSectorSize)
+	}
+	if r.size > size {
+		return fmt.Errorf("cannot expand replica to a smaller size %v", size)
+	} else if r.size == size {
+		return nil
+	}
+
+	if err := r.snapshotNoLock(diskutil.GenerateExpansionSnapshotName(size), false, util.Now(),
+		diskutil.GenerateExpansionSnapshotLabels(size)); err != nil {
+		return err
+	}
+	r.size = size
+	r.head().Size = size
+	return nil
+}
+
+func (b *Backend) Size() (int64, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.size, nil
+}
+
+func (b *Backend) SectorSize() (int64, error) {
+	return diskutil.VolumeSectorSize, nil
+}
+
+func (b *Backend) GetRevisionCounter() (int64, error) {
+	r := b.Replica
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.takeFailureNoLock(OpGetRevisionCounter); err != nil {
+		return 0, err
+	}
+	return r.revisionCounter, nil
+}
+
+func (b *Backend) SetRevisionCounter(counter int64) error {
+	r := b.Replica
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.takeFailureNoLock(OpSetRevisionCounter); err != nil {
+		return err
+	}
+	r.revisionCounter = counter
+	return nil
+}
+
+func (b *Backend) GetState() (string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.state, nil
+}
+
+func (b *Backend) GetMonitorChannel() types.MonitorChannel {
+	b.RLock()
+	defer b.RUnlock()
+	return b.monitorChan
+}
+
+func (b *Backend) StopMonitoring() {
+	b.RLock()
+	defer b.RUnlock()
+	select {
+	case b.monitorChan <- nil:
+	default:
+	}
+}
+
+// Reconnect fails unless the replica is open, e.g. after SetState brought a disconnected replica back.
+func (b *Backend) Reconnect() error {
+	r := b.Replica
+	r.Lock()
+	defer r.Unlock()
+
+	if r.state != string(types.ReplicaStateOpen) && r.state != string(types.ReplicaStateDirty) {
+		return fmt.Errorf("cannot reconnect to replica %v in state %v", r.name, r.state)
+	}
+	b.monitorChan = make(types.MonitorChannel, 5)
+	return nil
+}
+
+func (b *Backend) GetChain() ([]string, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	chain := make([]string, 0, len(b.disks))
+	for i := len(b.disks) - 1; i >= 0; i-- {
+		chain = append(chain, b.disks[i].Name)
+	}
+	return chain, nil
+}
+
+func (b *Backend) IsRevisionCounterDisabled() (bool, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.revisionCounterDisabled, nil
+}
+
+func (b *Backend) GetLastModifyTime() (int64, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.lastModifyTime, nil
+}
+
+func (b *Backend) GetHeadFileSize() (int64, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return int64(len(b.head().blocks)) * blockSize, nil
+}
+
+func (b *Backend) GetUnmapMarkSnapChainRemoved() (bool, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.unmapMarkSnapChainRemoved, nil
+}
+
+func (b *Backend) SetUnmapMarkSnapChainRemoved(enabled bool) error {
+	b.Lock()
+	defer b.Unlock()
+	b.unmapMarkSnapChainRemoved = enabled
+	return nil
+}
+
+func (b *Backend) ResetRebuild() error {
+	b.Lock()
+	defer b.Unlock()
+	b.rebuilding = false
+	return nil
+}
+
+func (b *Backend) SetSnapshotMaxCount(count int) error {
+	b.Lock()
+	defer b.Unlock()
+	b.snapshotMaxCount = count
+	return nil
+}
+
+func (b *Backend) SetSnapshotMaxSize(size int64) error {
+	b.Lock()
+	defer b.Unlock()
+	b.snapshotMaxSize = size
+	return nil
+}
+
+func (b *Backend) GetSnapshotCountAndSizeUsage() (int, int, int64, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.snapshotCountUsageNoLock(), len(b.disks), b.snapshotSizeUsageNoLock(), nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/longhorn/types/pkg/generated/enginerpc"
@@ -26,11 +28,21 @@ const (
 	// NOT mark a replica as ERR if it fails to receive a response within PingInterval. See monitorPing for details.
 	PingInterval = 2 * time.Second
 
-	NumberOfConnections = 2
+	// NumberOfConnections is the number of data connections a replica is opened with. The dataconn client adds
+	// connections up to MaxNumberOfConnections under load.
+	NumberOfConnections    = 2
+	MaxNumberOfConnections = 8
 )
 
 func New() types.BackendFactory {
-	return &Factory{}
+	return NewWithDataFeatures(dataconn.DefaultFeatures)
+}
+
+// NewWithDataFeatures returns a factory whose data connections ask the replicas for the given dataconn features.
+func NewWithDataFeatures(features uint32) types.BackendFactory {
+	return &Factory{
+		dataFeatures: features,
+	}
 }
 
 type RevisionCounter struct {
@@ -38,27 +50,69 @@ type RevisionCounter struct {
 }
 
 type Factory struct {
+	dataFeatures uint32
 }
 
 type Remote struct {
-	types.ReaderWriterUnmapperAt
+	// client is the data connection, which Reconnect replaces while the I/O of other goroutines may still load it
+	client            atomic.Pointer[dataconn.Client]
 	name              string
 	replicaServiceURL string
 	closeChan         chan struct{}
 	monitorChan       types.MonitorChannel
 	volumeName        string
+
+	// dataLock serializes the replacement of the data connection and guards the monitoring channels
+	dataLock sync.Mutex
+	closed   bool
+	// dial opens a new data connection to the replica, which fences the previous ones
+	dial func() (*dataconn.Client, error)
+	// fenceID identifies the data connections of the remote, and fenceEpoch counts them
+	fenceID    string
+	fenceEpoch atomic.Int64
+}
+
+func (r *Remote) ReadAt(buf []byte, off int64) (int, error) {
+	return r.client.Load().ReadAt(buf, off)
+}
+
+func (r *Remote) WriteAt(buf []byte, off int64) (int, error) {
+	return r.client.Load().WriteAt(buf, off)
+}
+
+func (r *Remote) UnmapAt(length uint32, off int64) (int, error) {
+	return r.client.Load().UnmapAt(length, off)
+}
+
+// WriteZeroesAt zeroes a range of the replica, without sending the zeros if the data connection supports it.
+func (r *Remote) WriteZeroesAt(length uint32, off int64) (int, error) {
+	return util.WriteZeroesAt(r.client.Load(), length, off)
+}
+
+// Flush makes the data written to the replica so far durable. Replicas that do not support flush requests are only
+// flushed by their snapshots.
+func (r *Remote) Flush() error {
+	client := r.client.Load()
+	if client.Features()&dataconn.FeatureFlush == 0 {
+		return nil
+	}
+	return client.Flush()
 }
 
 func (r *Remote) Close() error {
 	logrus.Infof("Closing: %s", r.name)
 
 	// Close the dataconn client to avoid orphaning goroutines.
-	if dataconnClient, ok := r.ReaderWriterUnmapperAt.(*dataconn.Client); ok {
+	r.dataLock.Lock()
+	r.closed = true
+	dataconnClient := r.client.Load()
+	r.dataLock.Unlock()
+	if dataconnClient != nil {
 		dataconnClient.Close()
 	}
 
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -83,7 +137,7 @@ func (r *Remote) Close() error {
 func (r *Remote) open() error {
 	logrus.Infof("Opening remote: %s", r.name)
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -109,7 +163,7 @@ func (r *Remote) Snapshot(name string, userCreated bool, created string, labels
 	logrus.Infof("Starting to snapshot: %s %s UserCreated %v Created at %v, Labels %v",
 		r.name, name, userCreated, created, labels)
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -144,7 +198,7 @@ func (r *Remote) Expand(size int64) (err error) {
 	}()
 
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -171,7 +225,7 @@ func (r *Remote) SetRevisionCounter(counter int64) error {
 	logrus.Infof("Set revision counter of %s to : %v", r.name, counter)
 
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -292,7 +346,7 @@ func (r *Remote) SetUnmapMarkSnapChainRemoved(enabled bool) error {
 	logrus.Infof("Setting UnmapMarkSnapChainRemoved of %s to : %v", r.name, enabled)
 
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "failed connecting to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -329,7 +383,7 @@ func (r *Remote) ResetRebuild() error {
 	logrus.Warnf("Resetting %v rebuild", r.name)
 
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "failed connecting to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -359,7 +413,7 @@ func (r *Remote) SetSnapshotMaxCount(count int) error {
 
 	conn, err := grpc.NewClient(r.replicaServiceURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %s", r.replicaServiceURL)
 	}
@@ -388,7 +442,7 @@ func (r *Remote) SetSnapshotMaxSize(size int64) error {
 
 	conn, err := grpc.NewClient(r.replicaServiceURL,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %s", r.replicaServiceURL)
 	}
@@ -413,7 +467,7 @@ func (r *Remote) SetSnapshotMaxSize(size int64) error {
 
 func (r *Remote) info() (*types.ReplicaInfo, error) {
 	conn, err := grpc.NewClient(r.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""))
+		interceptor.WithIdentityValidationClientInterceptor(r.volumeName, ""), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot connect to ReplicaService %v", r.replicaServiceURL)
 	}
@@ -452,6 +506,7 @@ func (rf *Factory) Create(volumeName, address string, dataServerProtocol types.D
 		closeChan:   make(chan struct{}, 5),
 		monitorChan: make(types.MonitorChannel, 5),
 		volumeName:  volumeName,
+		fenceID:     util.UUID(),
 	}
 
 	replica, err := r.info()
@@ -463,25 +518,104 @@ func (rf *Factory) Create(volumeName, address string, dataServerProtocol types.D
 		return nil, fmt.Errorf("replica must be closed, cannot add in state: %s", replica.State)
 	}
 
+	r.dial = func() (*dataconn.Client, error) {
+		fence := dataconn.Fence{ID: r.fenceID, Epoch: r.fenceEpoch.Add(1)}
+		return rf.dataConnect(dataServerProtocol, dataAddress, sharedTimeouts, fence)
+	}
+	dataConnClient, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.client.Store(dataConnClient)
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	go r.monitorPing(dataConnClient, r.closeChan, r.monitorChan)
+
+	return r, nil
+}
+
+func (rf *Factory) dataConnect(dataServerProtocol types.DataServerProtocol, dataAddress string,
+	sharedTimeouts types.SharedTimeouts, fence dataconn.Fence) (*dataconn.Client, error) {
 	var conns []net.Conn
 	for i := 0; i < NumberOfConnections; i++ {
 		conn, err := connect(dataServerProtocol, dataAddress)
 		if err != nil {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
 			return nil, err
 		}
 		conns = append(conns, conn)
 	}
 
-	dataConnClient := dataconn.NewClient(conns, sharedTimeouts)
-	r.ReaderWriterUnmapperAt = dataConnClient
-
-	if err := r.open(); err != nil {
+	dataConnClient, err := dataconn.NewClient(conns, sharedTimeouts, rf.dataFeatures, dataconn.ClientOptions{
+		Dial: func() (net.Conn, error) {
+			return connect(dataServerProtocol, dataAddress)
+		},
+		MinConnections: NumberOfConnections,
+		MaxConnections: MaxNumberOfConnections,
+		Fence:          fence,
+	})
+	if err != nil {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
 		return nil, err
 	}
+	return dataConnClient, nil
+}
 
-	go r.monitorPing(dataConnClient)
+// Reconnect opens a new data connection to the replica, which must still be open, and monitors it. The failed data
+// connection is closed. The replica fences it first, so none of its writes still running there lands once Reconnect
+// returns.
+func (r *Remote) Reconnect() error {
+	replicaInfo, err := r.info()
+	if err != nil {
+		return err
+	}
+	switch replicaInfo.State {
+	case "open", "dirty":
+	default:
+		return fmt.Errorf("cannot reconnect to replica %v in state %v", r.name, replicaInfo.State)
+	}
 
-	return r, nil
+	logrus.Infof("Reconnecting to remote: %s", r.name)
+	dataConnClient, err := r.dial()
+	if err != nil {
+		return err
+	}
+	if dataConnClient.Features()&dataconn.FeatureFence == 0 {
+		dataConnClient.Close()
+		return fmt.Errorf("replica %v cannot fence its previous data connection", r.name)
+	}
+
+	r.dataLock.Lock()
+	if r.closed {
+		r.dataLock.Unlock()
+		dataConnClient.Close()
+		return fmt.Errorf("remote %v is closed", r.name)
+	}
+	old := r.client.Swap(dataConnClient)
+	r.closeChan = make(chan struct{}, 5)
+	r.monitorChan = make(types.MonitorChannel, 5)
+	go r.monitorPing(dataConnClient, r.closeChan, r.monitorChan)
+	r.dataLock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (r *Remote) GetChain() ([]string, error) {
+	replicaInfo, err := r.info()
+	if err != nil {
+		return nil, err
+	}
+	return replicaInfo.Chain, nil
 }
 
 func connect(dataServerProtocol types.DataServerProtocol, address string) (net.Conn, error) {
@@ -508,19 +642,19 @@ func connect(dataServerProtocol types.DataServerProtocol, address string) (net.C
 //     keepalives (15s + 15s * 9 = 150s) or a closing of the connection from the replica side to prompt marking the
 //     replica ERR. In the keepalive case, another Longhorn component (e.g. the engine monitor in longhorn-manager) may
 //     detect the problem first.
-func (r *Remote) monitorPing(client *dataconn.Client) {
+func (r *Remote) monitorPing(client *dataconn.Client, closeChan chan struct{}, monitorChan types.MonitorChannel) {
 	ticker := time.NewTicker(PingInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-r.closeChan:
-			r.monitorChan <- nil
+		case <-closeChan:
+			monitorChan <- nil
 			return
 		case <-ticker.C:
 			if err := client.Ping(); err != nil {
 				client.SetError(err)
-				r.monitorChan <- err
+				monitorChan <- err
 				return
 			}
 		}
@@ -528,9 +662,14 @@ func (r *Remote) monitorPing(client *dataconn.Client) {
 }
 
 func (r *Remote) GetMonitorChannel() types.MonitorChannel {
+	r.dataLock.Lock()
+	defer r.dataLock.Unlock()
 	return r.monitorChan
 }
 
 func (r *Remote) StopMonitoring() {
-	r.closeChan <- struct{}{}
+	r.dataLock.Lock()
+	closeChan := r.closeChan
+	r.dataLock.Unlock()
+	closeChan <- struct{}{}
 }
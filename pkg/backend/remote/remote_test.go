@@ -0,0 +1,241 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/longhorn/types/pkg/generated/enginerpc"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+// testReplicaService answers the replica service calls Reconnect and Close make for an open replica.
+type testReplicaService struct {
+	enginerpc.UnimplementedReplicaServiceServer
+}
+
+func (s *testReplicaService) ReplicaGet(ctx context.Context, req *emptypb.Empty) (*enginerpc.ReplicaGetResponse, error) {
+	return &enginerpc.ReplicaGetResponse{Replica: &enginerpc.Replica{State: string(types.ReplicaStateOpen)}}, nil
+}
+
+func (s *testReplicaService) ReplicaClose(ctx context.Context, req *emptypb.Empty) (*enginerpc.ReplicaCloseResponse, error) {
+	return &enginerpc.ReplicaCloseResponse{}, nil
+}
+
+// testDisk is the in-memory data of the replica. While hold is set, the writes tell started and wait for it to be
+// closed.
+type testDisk struct {
+	sync.Mutex
+	data    []byte
+	hold    chan struct{}
+	started chan struct{}
+}
+
+func (d *testDisk) ReadAt(buf []byte, off int64) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	return copy(buf, d.data[off:]), nil
+}
+
+func (d *testDisk) WriteAt(buf []byte, off int64) (int, error) {
+	d.Lock()
+	hold, started := d.hold, d.started
+	d.Unlock()
+	if hold != nil {
+		started <- struct{}{}
+		<-hold
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	return copy(d.data[off:], buf), nil
+}
+
+func (d *testDisk) UnmapAt(length uint32, off int64) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	clear(d.data[off : off+int64(length)])
+	return int(length), nil
+}
+
+func (d *testDisk) PingResponse() error {
+	return nil
+}
+
+func (d *testDisk) read(off int64, length int) []byte {
+	d.Lock()
+	defer d.Unlock()
+	return append([]byte(nil), d.data[off:off+int64(length)]...)
+}
+
+// newTestRemote returns a remote connected to a replica served on loopback addresses, its disk, and a function
+// stopping the replica once the remote is closed.
+func newTestRemote(c *C) (*Remote, *testDisk, func()) {
+	controlListener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	server := grpc.NewServer()
+	enginerpc.RegisterReplicaServiceServer(server, &testReplicaService{})
+	go func() {
+		_ = server.Serve(controlListener)
+	}()
+
+	dataListener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	disk := &testDisk{data: make([]byte, 1<<20)}
+	go func() {
+		for {
+			conn, err := dataListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = dataconn.NewServer(conn, disk).Handle()
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	rf := NewWithDataFeatures(dataconn.DefaultFeatures).(*Factory)
+	r := &Remote{
+		name:              dataListener.Addr().String(),
+		replicaServiceURL: controlListener.Addr().String(),
+		closeChan:         make(chan struct{}, 5),
+		monitorChan:       make(types.MonitorChannel, 5),
+		volumeName:        "test-volume",
+		fenceID:           util.UUID(),
+	}
+	r.dial = func() (*dataconn.Client, error) {
+		return rf.dataConnect(types.DataServerProtocolTCP, dataListener.Addr().String(),
+			util.NewSharedTimeouts(time.Minute, time.Minute), dataconn.Fence{ID: r.fenceID, Epoch: r.fenceEpoch.Add(1)})
+	}
+	client, err := r.dial()
+	c.Assert(err, IsNil)
+	r.client.Store(client)
+	go r.monitorPing(client, r.closeChan, r.monitorChan)
+
+	return r, disk, func() {
+		server.Stop()
+		_ = dataListener.Close()
+	}
+}
+
+func closeTestRemote(c *C, r *Remote) {
+	r.StopMonitoring()
+	c.Assert(r.Close(), IsNil)
+}
+
+func (s *TestSuite) TestReconnectDuringIO(c *C) {
+	r, _, stop := newTestRemote(c)
+	defer stop()
+	defer closeTestRemote(c, r)
+
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	done := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		workers.Add(1)
+		go func(off int64) {
+			defer workers.Done()
+			buf := make([]byte, len(data))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// The I/O sent to a connection being replaced may fail, but it must not race with the replacement.
+				_, _ = r.WriteAt(data, off)
+				_, _ = r.ReadAt(buf, off)
+				_, _ = r.WriteZeroesAt(512, off)
+				_, _ = r.UnmapAt(512, off)
+				_ = r.Flush()
+			}
+		}(int64(i) * 8192)
+	}
+
+	for i := 0; i < 5; i++ {
+		c.Assert(r.Reconnect(), IsNil)
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(done)
+	workers.Wait()
+
+	// The I/O goes on with the last connection.
+	_, err := r.WriteAt(data, 65536)
+	c.Assert(err, IsNil)
+	buf := make([]byte, len(data))
+	_, err = r.ReadAt(buf, 65536)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, data)
+}
+
+func (s *TestSuite) TestReconnectAfterClose(c *C) {
+	r, _, stop := newTestRemote(c)
+	defer stop()
+	closeTestRemote(c, r)
+
+	c.Assert(r.Reconnect(), ErrorMatches, ".*is closed.*")
+}
+
+func (s *TestSuite) TestReconnectFencesDelayedWrite(c *C) {
+	r, disk, stop := newTestRemote(c)
+	defer stop()
+	defer closeTestRemote(c, r)
+
+	// A write on the failed connection is still running on the replica when it reconnects.
+	hold := make(chan struct{})
+	disk.Lock()
+	disk.hold, disk.started = hold, make(chan struct{}, 1)
+	disk.Unlock()
+	stale := make(chan error, 1)
+	go func() {
+		_, err := r.WriteAt(bytes.Repeat([]byte{1}, 4096), 0)
+		stale <- err
+	}()
+	<-disk.started
+	disk.Lock()
+	disk.hold, disk.started = nil, nil
+	disk.Unlock()
+
+	reconnected := make(chan error, 1)
+	go func() {
+		reconnected <- r.Reconnect()
+	}()
+	select {
+	case err := <-reconnected:
+		c.Fatalf("reconnected while a write of the failed connection is running: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(hold)
+	c.Assert(<-reconnected, IsNil)
+	// The delayed write landed before Reconnect returned, whether or not it was answered before the failed
+	// connection was closed.
+	c.Assert(disk.read(0, 4096), DeepEquals, bytes.Repeat([]byte{1}, 4096))
+	<-stale
+
+	// What is written once reconnected is not overwritten by the delayed write.
+	data := bytes.Repeat([]byte{2}, 4096)
+	_, err := r.WriteAt(data, 0)
+	c.Assert(err, IsNil)
+	buf := make([]byte, len(data))
+	_, err = r.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, data)
+}
@@ -1,20 +1,28 @@
 package backingfile
 
 import (
-	"bufio"
-	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
-	"strings"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/longhorn/sparse-tools/sparse"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	"github.com/longhorn/longhorn-engine/pkg/qcow"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 	"github.com/longhorn/longhorn-engine/pkg/util"
 	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
+	"github.com/longhorn/longhorn-engine/pkg/vhd"
+	"github.com/longhorn/longhorn-engine/pkg/vhdx"
+	"github.com/longhorn/longhorn-engine/pkg/vmdk"
 )
 
 type BackingFile struct {
@@ -22,51 +30,168 @@ type BackingFile struct {
 	SectorSize int64
 	Path       string
 	Disk       types.DiffDisk
+
+	// lock guards checksum, which VerifyChecksum sets
+	lock     sync.RWMutex
+	checksum string
 }
 
-func detectFileFormat(file string) (string, error) {
+const (
+	// checksumBufferSize is the size of the reads done to checksum the backing file
+	checksumBufferSize = 1 << 20
+	checksumMethod     = "sha512"
+
+	// ChecksumCacheName is the file of the replica directory that keeps the checksum of the backing file, so that
+	// it is not computed again on every start
+	ChecksumCacheName = "backing-file.checksum"
+)
+
+// checksumCache is what the checksum cache holds. The checksum is valid as long as the backing file at Path keeps
+// its size and change time.
+type checksumCache struct {
+	Method     string `json:"method"`
+	Checksum   string `json:"checksum"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	ChangeTime string `json:"change_time"`
+}
+
+// Checksum returns the SHA512 of the backing file, or an empty string until VerifyChecksum has computed it.
+func (b *BackingFile) Checksum() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.checksum
+}
+
+// VerifyChecksum computes the SHA512 of the backing file as stored, which is how backing images are checksummed,
+// and keeps it for Checksum. If cachePath is not empty, the checksum is read from there when it is still valid, and
+// written there otherwise. If expected is not empty, a different checksum is an error.
+func (b *BackingFile) VerifyChecksum(expected, cachePath string) error {
+	checksum, err := b.computeChecksum(cachePath)
+	if err != nil {
+		return err
+	}
+	if expected != "" && checksum != expected {
+		return fmt.Errorf("the backing file %v has checksum %v rather than the expected %v", b.Path, checksum, expected)
+	}
+
+	b.lock.Lock()
+	b.checksum = checksum
+	b.lock.Unlock()
+	return nil
+}
 
-	/* Example command outputs
-	   $ qemu-img info parrot.raw
-	   image: parrot.raw
-	   file format: raw
-	   virtual size: 32M (33554432 bytes)
-	   disk size: 2.2M
-
-	   $ qemu-img info parrot.qcow2
-	   image: parrot.qcow2
-	   file format: qcow2
-	   virtual size: 32M (33554432 bytes)
-	   disk size: 2.3M
-	   cluster_size: 65536
-	   Format specific information:
-	       compat: 1.1
-	       lazy refcounts: false
-	       refcount bits: 16
-	       corrupt: false
-	*/
-
-	cmd := exec.Command("qemu-img", "info", file)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGKILL,
-	}
-	var output, stderr bytes.Buffer
-	cmd.Stdout = &output
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to check backing file format with command [qume-img info %v], output %s, stderr, %s, error %v",
-			file, output.String(), stderr.String(), err)
-	}
-
-	scanner := bufio.NewScanner(strings.NewReader(output.String()))
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "file format: ") {
-			return strings.TrimPrefix(line, "file format: "), nil
+func (b *BackingFile) computeChecksum(cachePath string) (string, error) {
+	f, err := os.Open(b.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	current := checksumCache{
+		Method:     checksumMethod,
+		Path:       b.Path,
+		Size:       info.Size(),
+		ChangeTime: time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec)).String(),
+	}
+	if cachePath != "" {
+		if cached, err := readChecksumCache(cachePath); err == nil && cached.Checksum != "" {
+			checksum := cached.Checksum
+			cached.Checksum = ""
+			if *cached == current {
+				return checksum, nil
+			}
+		}
+	}
+
+	h := sha512.New()
+	if _, err := io.CopyBuffer(h, f, make([]byte, checksumBufferSize)); err != nil {
+		return "", errors.Wrapf(err, "failed to checksum the backing file %v", b.Path)
+	}
+	current.Checksum = hex.EncodeToString(h.Sum(nil))
+	if cachePath != "" {
+		// The cache only saves time, the checksum is fine without it.
+		if err := writeChecksumCache(cachePath, &current); err != nil {
+			logrus.WithError(err).Warnf("Failed to cache the checksum of the backing file %v in %v", b.Path, cachePath)
 		}
 	}
+	return current.Checksum, nil
+}
+
+func readChecksumCache(path string) (*checksumCache, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cache checksumCache
+	if err := json.NewDecoder(f).Decode(&cache); err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+func writeChecksumCache(path string, cache *checksumCache) error {
+	// The replica directory is made when the replica is created, which may be after it starts.
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(cache); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// detectFileFormat tells the format of the backing file from its magic bytes. Files without a known magic are
+// raw.
+func detectFileFormat(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
 
-	return "", fmt.Errorf("cannot find the file format in the output %s", output.String())
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	detectors := []struct {
+		format string
+		detect func() (bool, error)
+	}{
+		{"qcow2", func() (bool, error) { return qcow.IsQcow(f) }},
+		{"vhdx", func() (bool, error) { return vhdx.IsVhdx(f) }},
+		{"vmdk", func() (bool, error) { return vmdk.IsVmdk(f) }},
+		// A fixed VHD only has a footer, so it goes last.
+		{"vhd", func() (bool, error) { return vhd.IsVhd(f, info.Size()) }},
+	}
+	for _, d := range detectors {
+		ok, err := d.detect()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to check the format of the backing file %v", file)
+		}
+		if ok {
+			return d.format, nil
+		}
+	}
+	return "raw", nil
 }
 
 func OpenBackingFile(file string) (*BackingFile, error) {
@@ -89,6 +214,18 @@ func OpenBackingFile(file string) (*BackingFile, error) {
 		if f, err = qcow.Open(file); err != nil {
 			return nil, err
 		}
+	case "vmdk":
+		if f, err = vmdk.Open(file); err != nil {
+			return nil, err
+		}
+	case "vhd":
+		if f, err = vhd.Open(file); err != nil {
+			return nil, err
+		}
+	case "vhdx":
+		if f, err = vhdx.Open(file); err != nil {
+			return nil, err
+		}
 	case "raw":
 		if f, err = sparse.NewDirectFileIoProcessor(file, os.O_RDONLY, 04444, false); err != nil {
 			return nil, err
@@ -99,9 +236,11 @@ func OpenBackingFile(file string) (*BackingFile, error) {
 
 	size, err := f.Size()
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
 	if size%diskutil.BackingImageSectorSize != 0 {
+		_ = f.Close()
 		return nil, fmt.Errorf("the backing file size %v should be a multiple of %v bytes since Longhorn uses directIO by default", size, diskutil.BackingImageSectorSize)
 	}
 
@@ -0,0 +1,424 @@
+package backingfile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/qcow"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+var (
+	be = binary.BigEndian
+	le = binary.LittleEndian
+)
+
+// pattern returns length bytes that differ from one image, and one place in it, to the other.
+func pattern(seed, length int) []byte {
+	buf := make([]byte, length)
+	for i := range buf {
+		buf[i] = byte((seed*31+i)%251 + 1)
+	}
+	return buf
+}
+
+func writeImage(c *C, name string, data []byte) string {
+	path := filepath.Join(c.MkDir(), name)
+	c.Assert(os.WriteFile(path, data, 0644), IsNil)
+	return path
+}
+
+// checkImage opens an image as a backing file of the format and compares its virtual disk with expected.
+func checkImage(c *C, path, format string, expected []byte) {
+	detected, err := detectFileFormat(path)
+	c.Assert(err, IsNil)
+	c.Assert(detected, Equals, format)
+
+	b, err := OpenBackingFile(path)
+	c.Assert(err, IsNil)
+	defer b.Disk.Close()
+	c.Assert(b.Size, Equals, int64(len(expected)))
+	buf := make([]byte, len(expected))
+	n, err := b.Disk.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(expected))
+	c.Assert(buf, DeepEquals, expected)
+}
+
+// vhdFooter returns a VHD footer of a disk of size bytes.
+func vhdFooter(size int64, diskType uint32, dataOffset uint64) []byte {
+	buf := make([]byte, 512)
+	copy(buf, "conectix")
+	be.PutUint32(buf[8:], 2)
+	be.PutUint32(buf[12:], 0x00010000)
+	be.PutUint64(buf[16:], dataOffset)
+	copy(buf[28:], "tap ")
+	be.PutUint64(buf[40:], uint64(size))
+	be.PutUint64(buf[48:], uint64(size))
+	be.PutUint32(buf[60:], diskType)
+	be.PutUint32(buf[64:], vhdChecksum(buf, 64))
+	return buf
+}
+
+func vhdChecksum(buf []byte, field int) uint32 {
+	var sum uint32
+	for i, b := range buf {
+		if i < field || i >= field+4 {
+			sum += uint32(b)
+		}
+	}
+	return ^sum
+}
+
+func (s *TestSuite) TestVhd(c *C) {
+	// A fixed image is the disk followed by the footer.
+	disk := pattern(1, 8192)
+	checkImage(c, writeImage(c, "fixed.vhd", append(disk, vhdFooter(8192, 2, ^uint64(0))...)), "vhd", disk)
+
+	// A dynamic image of 4 blocks of 4 KiB: a copy of the footer, the dynamic disk header at 512, the block
+	// allocation table at 1536, then blocks 0 and 2, which are a sector bitmap followed by the data.
+	const blockSize = 4096
+	image := vhdFooter(4*blockSize, 3, 512)
+	header := make([]byte, 1024)
+	copy(header, "cxsparse")
+	be.PutUint64(header[8:], ^uint64(0))
+	be.PutUint64(header[16:], 1536)
+	be.PutUint32(header[24:], 0x00010000)
+	be.PutUint32(header[28:], 4)
+	be.PutUint32(header[32:], blockSize)
+	be.PutUint32(header[36:], vhdChecksum(header, 36))
+	image = append(image, header...)
+	bat := bytes.Repeat([]byte{0xff}, 512)
+	be.PutUint32(bat[0:], 4)
+	be.PutUint32(bat[8:], 13)
+	image = append(image, bat...)
+	// Only sectors 0 and 2 of block 0 are marked in its bitmap, the others read zeros whatever the file holds.
+	bitmap := make([]byte, 512)
+	bitmap[0] = 0xa0
+	image = append(append(image, bitmap...), pattern(2, blockSize)...)
+	bitmap = make([]byte, 512)
+	bitmap[0] = 0xff
+	image = append(append(image, bitmap...), pattern(3, blockSize)...)
+	image = append(image, vhdFooter(4*blockSize, 3, 512)...)
+
+	expected := make([]byte, 4*blockSize)
+	copy(expected[0:512], pattern(2, blockSize)[0:512])
+	copy(expected[1024:1536], pattern(2, blockSize)[1024:1536])
+	copy(expected[2*blockSize:], pattern(3, blockSize))
+	checkImage(c, writeImage(c, "dynamic.vhd", image), "vhd", expected)
+}
+
+func (s *TestSuite) TestVhdCookieInRawImage(c *C) {
+	// Raw images whose last sector happens to start with the cookie of a VHD footer.
+	noChecksum := pattern(1, 4096)
+	copy(noChecksum[4096-512:], "conectix")
+	badType := append(pattern(2, 4096), vhdFooter(4096, 2, ^uint64(0))...)
+	badType[len(badType)-512+63] = 5
+	be.PutUint32(badType[len(badType)-512+64:], vhdChecksum(badType[len(badType)-512:], 64))
+	badChecksum := append(pattern(3, 4096), vhdFooter(4096, 2, ^uint64(0))...)
+	badChecksum[len(badChecksum)-1] ^= 1
+
+	for name, image := range map[string][]byte{
+		"no checksum":  noChecksum,
+		"bad type":     badType,
+		"bad checksum": badChecksum,
+	} {
+		path := writeImage(c, "image.img", image)
+		format, err := detectFileFormat(path)
+		c.Assert(err, IsNil)
+		c.Assert(format, Equals, "raw", Commentf(name))
+		b, err := OpenBackingFile(path)
+		c.Assert(err, IsNil, Commentf(name))
+		c.Assert(b.Size, Equals, int64(len(image)), Commentf(name))
+		c.Assert(b.Disk.Close(), IsNil)
+	}
+}
+
+// guid returns the on-disk form of a GUID, whose first three fields are little-endian.
+func guid(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		panic(err)
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+func vhdxChecksum(buf []byte) {
+	le.PutUint32(buf[4:], 0)
+	le.PutUint32(buf[4:], crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+func (s *TestSuite) TestVhdx(c *C) {
+	const (
+		mib       = 1 << 20
+		blockSize = mib
+		size      = 3 * blockSize
+	)
+	image := make([]byte, 4*mib)
+	copy(image, "vhdxfile")
+
+	// Both headers are valid, the second one is current.
+	for i, off := range []int{64 << 10, 128 << 10} {
+		header := image[off : off+4096]
+		copy(header, "head")
+		le.PutUint64(header[8:], uint64(i+1))
+		le.PutUint16(header[66:], 1)
+		vhdxChecksum(header)
+	}
+
+	// The block allocation table is at 1 MiB and the metadata at 2 MiB.
+	regions := image[192<<10 : 256<<10]
+	copy(regions, "regi")
+	le.PutUint32(regions[8:], 2)
+	for i, r := range []struct {
+		id     string
+		offset uint64
+	}{
+		{"2DC27766-F623-4200-9D64-115E9BFD4A08", mib},
+		{"8B7CA206-4790-4B9A-B8FE-575F050F886E", 2 * mib},
+	} {
+		entry := regions[16+i*32:]
+		copy(entry, guid(r.id))
+		le.PutUint64(entry[16:], r.offset)
+		le.PutUint32(entry[24:], mib)
+		le.PutUint32(entry[28:], 1)
+	}
+	vhdxChecksum(regions)
+
+	metadata := image[2*mib : 3*mib]
+	copy(metadata, "metadata")
+	items := []struct {
+		id   string
+		data []byte
+	}{
+		{"CAA16737-FA36-4D43-B3B6-33F0AA44E76B", le.AppendUint32(le.AppendUint32(nil, blockSize), 0)},
+		{"2FA54224-CD1B-4876-B211-5DBED83BF4B8", le.AppendUint64(nil, size)},
+		{"8141BF1D-A96F-4709-BA47-F233A8FAAB5F", le.AppendUint32(nil, 512)},
+	}
+	le.PutUint16(metadata[10:], uint16(len(items)))
+	for i, item := range items {
+		entry := metadata[32+i*32:]
+		offset := 64<<10 + i*4096
+		copy(entry, guid(item.id))
+		le.PutUint32(entry[16:], uint32(offset))
+		le.PutUint32(entry[20:], uint32(len(item.data)))
+		le.PutUint32(entry[24:], 1<<2)
+		copy(metadata[offset:], item.data)
+	}
+
+	// Block 0 is present at 3 MiB, block 1 is zero, and block 2 is not present.
+	le.PutUint64(image[mib:], 3*mib|6)
+	le.PutUint64(image[mib+8:], 2)
+	copy(image[3*mib:], pattern(1, blockSize))
+
+	expected := make([]byte, size)
+	copy(expected, pattern(1, blockSize))
+	checkImage(c, writeImage(c, "image.vhdx", image), "vhdx", expected)
+}
+
+// vmdkHeader returns the header of a sparse extent of capacity sectors, in grains of 8 sectors and grain tables of
+// 4 entries.
+func vmdkHeader(capacity, gdOffset uint64, flags uint32, compression uint16) []byte {
+	buf := make([]byte, 512)
+	copy(buf, "KDMV")
+	le.PutUint32(buf[4:], 3)
+	le.PutUint32(buf[8:], flags|1)
+	le.PutUint64(buf[12:], capacity)
+	le.PutUint64(buf[20:], 8)
+	le.PutUint64(buf[28:], 1)
+	le.PutUint64(buf[36:], 1)
+	le.PutUint32(buf[44:], 4)
+	le.PutUint64(buf[56:], gdOffset)
+	copy(buf[73:], "\n \r\n")
+	le.PutUint16(buf[77:], compression)
+	return buf
+}
+
+func vmdkDescriptor(createType string) []byte {
+	buf := make([]byte, 512)
+	copy(buf, "# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=ffffffff\ncreateType=\""+createType+
+		"\"\n\n# Extent description\nRW 64 SPARSE \"image.vmdk\"\n")
+	return buf
+}
+
+func sector(entries ...uint32) []byte {
+	buf := make([]byte, 512)
+	for i, e := range entries {
+		le.PutUint32(buf[i*4:], e)
+	}
+	return buf
+}
+
+func (s *TestSuite) TestSparseVmdk(c *C) {
+	// 64 sectors in 8 grains: the grain directory at sector 2 has the first grain table, at sector 3, allocated.
+	// Grain 0 is at sector 4, grain 2 is zeroed and grain 3 is at sector 12.
+	image := vmdkHeader(64, 2, 1<<2, 0)
+	image = append(image, vmdkDescriptor("monolithicSparse")...)
+	image = append(image, sector(3, 0)...)
+	image = append(image, sector(4, 0, 1, 12)...)
+	image = append(image, pattern(1, 4096)...)
+	image = append(image, pattern(2, 4096)...)
+
+	expected := make([]byte, 64*512)
+	copy(expected, pattern(1, 4096))
+	copy(expected[3*4096:], pattern(2, 4096))
+	checkImage(c, writeImage(c, "sparse.vmdk", image), "vmdk", expected)
+}
+
+func (s *TestSuite) TestStreamOptimizedVmdk(c *C) {
+	compress := func(lba uint64, data []byte) []byte {
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		_, err := w.Write(data)
+		c.Assert(err, IsNil)
+		c.Assert(w.Close(), IsNil)
+		grain := le.AppendUint32(le.AppendUint64(nil, lba), uint32(b.Len()))
+		grain = append(grain, b.Bytes()...)
+		return append(grain, make([]byte, (512-len(grain)%512)%512)...)
+	}
+	marker := func(size uint64, kind uint32) []byte {
+		buf := make([]byte, 512)
+		le.PutUint64(buf, size)
+		le.PutUint32(buf[12:], kind)
+		return buf
+	}
+	const flags = 1<<16 | 1<<17
+
+	// 4 grains of 8 sectors. The header does not know where the grain directory is, the footer that precedes the
+	// end-of-stream marker does. Grains 0 and 3 are written, the last one with fewer bytes than a grain.
+	image := vmdkHeader(32, ^uint64(0), flags, 1)
+	image = append(image, vmdkDescriptor("streamOptimized")...)
+	grain0 := uint32(len(image) / 512)
+	image = append(image, compress(0, pattern(1, 4096))...)
+	grain3 := uint32(len(image) / 512)
+	image = append(image, compress(24, pattern(2, 1000))...)
+	image = append(image, marker(1, 1)...)
+	gt := uint32(len(image) / 512)
+	image = append(image, sector(grain0, 0, 0, grain3)...)
+	image = append(image, marker(1, 2)...)
+	gd := uint64(len(image) / 512)
+	image = append(image, sector(gt)...)
+	image = append(image, marker(1, 3)...)
+	image = append(image, vmdkHeader(32, gd, flags, 1)...)
+	image = append(image, make([]byte, 512)...)
+
+	expected := make([]byte, 32*512)
+	copy(expected, pattern(1, 4096))
+	copy(expected[3*4096:], pattern(2, 1000))
+	checkImage(c, writeImage(c, "stream.vmdk", image), "vmdk", expected)
+}
+
+func (s *TestSuite) TestSectorAlignment(c *C) {
+	_, err := OpenBackingFile(writeImage(c, "image.img", pattern(1, 1000)))
+	c.Assert(err, ErrorMatches, "the backing file size 1000 should be a multiple of 512 bytes.*")
+
+	// The size that matters is the one of the virtual disk, not the one of the image.
+	path := filepath.Join(c.MkDir(), "image.qcow2")
+	c.Assert(qcow.Create(path, 1000, bytes.NewReader(pattern(2, 1000))), IsNil)
+	_, err = OpenBackingFile(path)
+	c.Assert(err, ErrorMatches, "the backing file size 1000 should be a multiple of 512 bytes.*")
+
+	path = filepath.Join(c.MkDir(), "image.qcow2")
+	c.Assert(qcow.Create(path, 1024, bytes.NewReader(pattern(2, 1024))), IsNil)
+	checkImage(c, path, "qcow2", pattern(2, 1024))
+}
+
+func (s *TestSuite) TestVerifyChecksum(c *C) {
+	// The SHA512 of the image as stored, not of its virtual disk.
+	const emptyChecksum = "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce" +
+		"47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
+	path := writeImage(c, "image.img", nil)
+	b := &BackingFile{Path: path}
+	c.Assert(b.Checksum(), Equals, "")
+	c.Assert(b.VerifyChecksum("", ""), IsNil)
+	c.Assert(b.Checksum(), Equals, emptyChecksum)
+	c.Assert(b.VerifyChecksum(emptyChecksum, ""), IsNil)
+
+	path = writeImage(c, "image.img", pattern(1, 3<<20))
+	b = &BackingFile{Path: path}
+	c.Assert(b.VerifyChecksum("", ""), IsNil)
+	checksum := b.Checksum()
+	c.Assert(checksum, HasLen, 128)
+	c.Assert(checksum, Not(Equals), emptyChecksum)
+
+	// A mismatch is an error, and leaves the checksum unset.
+	b = &BackingFile{Path: path}
+	err := b.VerifyChecksum(emptyChecksum, "")
+	c.Assert(err, ErrorMatches, "the backing file .* has checksum "+checksum+" rather than the expected "+emptyChecksum)
+	c.Assert(b.Checksum(), Equals, "")
+
+	b = &BackingFile{Path: filepath.Join(c.MkDir(), "missing")}
+	c.Assert(b.VerifyChecksum("", ""), NotNil)
+}
+
+func (s *TestSuite) TestChecksumCache(c *C) {
+	path := writeImage(c, "image.img", pattern(1, 1<<20))
+	b := &BackingFile{Path: path}
+	c.Assert(b.VerifyChecksum("", ""), IsNil)
+	checksum := b.Checksum()
+
+	// The replica directory does not exist yet.
+	cachePath := filepath.Join(c.MkDir(), "replica", ChecksumCacheName)
+	b = &BackingFile{Path: path}
+	done := make(chan error)
+	go func() {
+		done <- b.VerifyChecksum("", cachePath)
+	}()
+	// The checksum is read while it is computed, as the replica server does, and is either unknown or right.
+	for i := 0; i < 100; i++ {
+		c.Assert(b.Checksum() == "" || b.Checksum() == checksum, Equals, true)
+	}
+	c.Assert(<-done, IsNil)
+	c.Assert(b.Checksum(), Equals, checksum)
+	cache, err := readChecksumCache(cachePath)
+	c.Assert(err, IsNil)
+	c.Assert(cache.Checksum, Equals, checksum)
+	c.Assert(cache.Path, Equals, path)
+	c.Assert(cache.Size, Equals, int64(1<<20))
+
+	// The checksum of the cache is used as long as the file does not change, so a wrong one shows.
+	cache.Checksum = "cached"
+	c.Assert(writeChecksumCache(cachePath, cache), IsNil)
+	b = &BackingFile{Path: path}
+	c.Assert(b.VerifyChecksum("", cachePath), IsNil)
+	c.Assert(b.Checksum(), Equals, "cached")
+	c.Assert(b.VerifyChecksum(checksum, cachePath), ErrorMatches, ".*has checksum cached rather than the expected.*")
+
+	// A change of the file makes it checksummed again.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte{0}, 100)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	b = &BackingFile{Path: path}
+	c.Assert(b.VerifyChecksum("", cachePath), IsNil)
+	c.Assert(b.Checksum(), Not(Equals), "cached")
+	c.Assert(b.Checksum(), Not(Equals), checksum)
+	cache, err = readChecksumCache(cachePath)
+	c.Assert(err, IsNil)
+	c.Assert(cache.Checksum, Equals, b.Checksum())
+
+	// A cache that cannot be written does not fail the checksum.
+	blocked := writeImage(c, "file", nil)
+	b = &BackingFile{Path: path}
+	c.Assert(b.VerifyChecksum("", filepath.Join(blocked, ChecksumCacheName)), IsNil)
+	c.Assert(b.Checksum(), HasLen, 128)
+}
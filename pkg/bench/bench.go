@@ -0,0 +1,177 @@
+package bench
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+type Options struct {
+	// BlockSize is the size of every request in bytes. It must be a multiple of the sector size of the target.
+	BlockSize int64
+	// QueueDepth is the number of requests kept in flight.
+	QueueDepth int
+	// ReadPercent is the share of reads from 0 to 100, the rest are writes.
+	ReadPercent int
+	// Random picks the offset of every request at random. Otherwise the requests go through the range in order.
+	Random bool
+	// Duration is how long the benchmark runs.
+	Duration time.Duration
+	// Offset and Size bound the range of the target the requests go to.
+	Offset int64
+	Size   int64
+}
+
+func (o *Options) validate() error {
+	if o.BlockSize <= 0 {
+		return fmt.Errorf("invalid block size %v", o.BlockSize)
+	}
+	if o.QueueDepth <= 0 {
+		return fmt.Errorf("invalid queue depth %v", o.QueueDepth)
+	}
+	if o.ReadPercent < 0 || o.ReadPercent > 100 {
+		return fmt.Errorf("invalid read percentage %v", o.ReadPercent)
+	}
+	if o.Duration <= 0 {
+		return fmt.Errorf("invalid duration %v", o.Duration)
+	}
+	if o.Offset < 0 || o.Offset%o.BlockSize != 0 {
+		return fmt.Errorf("offset %v must be a multiple of block size %v", o.Offset, o.BlockSize)
+	}
+	if o.Size < o.BlockSize {
+		return fmt.Errorf("size %v is smaller than block size %v", o.Size, o.BlockSize)
+	}
+	return nil
+}
+
+type Latency struct {
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P99  time.Duration `json:"p99"`
+	P999 time.Duration `json:"p99.9"`
+	Max  time.Duration `json:"max"`
+}
+
+type OpResult struct {
+	Ops        uint64  `json:"ops"`
+	IOPS       float64 `json:"iops"`
+	Throughput float64 `json:"throughput"` // in bytes per second
+	Latency    Latency `json:"latency"`
+}
+
+type Result struct {
+	Duration time.Duration `json:"duration"`
+	Read     OpResult      `json:"read"`
+	Write    OpResult      `json:"write"`
+}
+
+type worker struct {
+	read  histogram
+	write histogram
+}
+
+// Run drives target with the requests described by opts until opts.Duration is up, and returns the IOPS, throughput
+// and latency distribution of the reads and writes. It stops at the first failed request.
+func Run(target types.ReaderWriterUnmapperAt, opts Options) (*Result, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	blocks := opts.Size / opts.BlockSize
+	var cursor atomic.Int64
+	var stop atomic.Bool
+	var errOnce sync.Once
+	var runErr error
+
+	workers := make([]*worker, opts.QueueDepth)
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(opts.Duration)
+	for i := range workers {
+		w := &worker{}
+		workers[i] = w
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, opts.BlockSize)
+			data := make([]byte, opts.BlockSize)
+			for j := range data {
+				data[j] = byte(rand.IntN(256))
+			}
+
+			for !stop.Load() {
+				now := time.Now()
+				if now.After(deadline) {
+					return
+				}
+
+				var block int64
+				if opts.Random {
+					block = rand.Int64N(blocks)
+				} else {
+					block = (cursor.Add(1) - 1) % blocks
+				}
+				offset := opts.Offset + block*opts.BlockSize
+
+				var err error
+				if rand.IntN(100) < opts.ReadPercent {
+					_, err = target.ReadAt(buf, offset)
+					w.read.record(time.Since(now))
+				} else {
+					_, err = target.WriteAt(data, offset)
+					w.write.record(time.Since(now))
+				}
+				if err != nil {
+					errOnce.Do(func() {
+						runErr = errors.Wrapf(err, "request of %v bytes at offset %v failed", opts.BlockSize, offset)
+						stop.Store(true)
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if runErr != nil {
+		return nil, runErr
+	}
+	elapsed := time.Since(start)
+
+	var read, write histogram
+	for _, w := range workers {
+		read.merge(&w.read)
+		write.merge(&w.write)
+	}
+
+	return &Result{
+		Duration: elapsed,
+		Read:     opResult(&read, opts.BlockSize, elapsed),
+		Write:    opResult(&write, opts.BlockSize, elapsed),
+	}, nil
+}
+
+func opResult(h *histogram, blockSize int64, elapsed time.Duration) OpResult {
+	seconds := elapsed.Seconds()
+	return OpResult{
+		Ops:        h.count,
+		IOPS:       float64(h.count) / seconds,
+		Throughput: float64(h.count) * float64(blockSize) / seconds,
+		Latency: Latency{
+			Mean: h.mean(),
+			P50:  h.percentile(50),
+			P90:  h.percentile(90),
+			P99:  h.percentile(99),
+			P999: h.percentile(99.9),
+			Max:  time.Duration(h.max),
+		},
+	}
+}
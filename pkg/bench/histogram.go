@@ -0,0 +1,92 @@
+package bench
+
+import (
+	"math/bits"
+	"time"
+)
+
+// subBuckets is the number of buckets every power of two is split into, which bounds the error of a percentile to
+// about 1/subBuckets.
+const (
+	subBucketBits = 5
+	subBuckets    = 1 << subBucketBits
+	bucketCount   = (64 - subBucketBits) * subBuckets
+)
+
+// histogram is a log-linear histogram of latencies in nanoseconds. It is not safe for concurrent use, every worker
+// keeps its own and they are merged at the end.
+type histogram struct {
+	counts [bucketCount]uint64
+	count  uint64
+	sum    uint64
+	max    uint64
+}
+
+func bucketIndex(v uint64) int {
+	if v < 2*subBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits - 1
+	return (shift+1)*subBuckets + int(v>>shift) - subBuckets
+}
+
+// bucketValue returns the middle of the range of values that fall into bucket idx.
+func bucketValue(idx int) uint64 {
+	if idx < 2*subBuckets {
+		return uint64(idx)
+	}
+	shift := idx/subBuckets - 1
+	m := uint64(idx%subBuckets + subBuckets)
+	return m<<shift + (uint64(1)<<shift)/2
+}
+
+func (h *histogram) record(d time.Duration) {
+	v := uint64(d)
+	h.counts[bucketIndex(v)]++
+	h.count++
+	h.sum += v
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	h.sum += o.sum
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / h.count)
+}
+
+// percentile returns the latency below which p percent of the requests completed.
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.count))
+	if rank >= h.count {
+		rank = h.count - 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank {
+			v := bucketValue(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v)
+		}
+	}
+	return time.Duration(h.max)
+}
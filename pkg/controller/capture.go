@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/iocapture"
+)
+
+// StartCapture starts recording the requests going from the frontend to the replicator into a new file at path.
+func (c *Controller) StartCapture(path string, withHash bool) error {
+	c.RLock()
+	size := c.size
+	c.RUnlock()
+
+	recorder, err := iocapture.NewRecorder(path, size, withHash)
+	if err != nil {
+		return err
+	}
+	if !c.capture.CompareAndSwap(nil, recorder) {
+		_, _ = recorder.Stop()
+		return fmt.Errorf("capture to %v is already running", c.capture.Load().Path())
+	}
+
+	logrus.WithField("volume", c.VolumeName).Infof("Started capturing I/O to %v with data hashes %v", path, withHash)
+	return nil
+}
+
+// StopCapture stops the running capture, and returns its file and the number of requests recorded.
+func (c *Controller) StopCapture() (string, int64, error) {
+	recorder := c.capture.Swap(nil)
+	if recorder == nil {
+		return "", 0, fmt.Errorf("no capture is running")
+	}
+
+	// Requests that loaded the recorder before the swap may still be recording, and are dropped once the file is
+	// closed.
+	records, err := recorder.Stop()
+	if err != nil {
+		return recorder.Path(), records, err
+	}
+
+	logrus.WithField("volume", c.VolumeName).Infof("Stopped capturing I/O to %v with %v requests recorded",
+		recorder.Path(), records)
+	return recorder.Path(), records, nil
+}
+
+// GetCapture returns the file of the running capture, or an empty string if there is none.
+func (c *Controller) GetCapture() string {
+	recorder := c.capture.Load()
+	if recorder == nil {
+		return ""
+	}
+	return recorder.Path()
+}
+
+func (c *Controller) recordCapture(op iocapture.Op, off int64, length uint32, data []byte, start time.Time, err error) {
+	if recorder := c.capture.Load(); recorder != nil {
+		recorder.Record(op, off, length, data, start, err != nil)
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/longhorn/types/pkg/generated/enginerpc"
 
+	"github.com/longhorn/longhorn-engine/pkg/generated/controllerrpc"
 	"github.com/longhorn/longhorn-engine/pkg/interceptor"
 	"github.com/longhorn/longhorn-engine/pkg/meta"
 	"github.com/longhorn/longhorn-engine/pkg/types"
@@ -23,8 +24,9 @@ import (
 )
 
 type ControllerServiceContext struct {
-	cc      *grpc.ClientConn
-	service enginerpc.ControllerServiceClient
+	cc         *grpc.ClientConn
+	service    enginerpc.ControllerServiceClient
+	rpcService controllerrpc.ControllerServiceClient
 }
 
 func (c ControllerServiceContext) Close() error {
@@ -44,6 +46,10 @@ func (c *ControllerClient) getControllerServiceClient() enginerpc.ControllerServ
 	return c.service
 }
 
+func (c *ControllerClient) getControllerRPCServiceClient() controllerrpc.ControllerServiceClient {
+	return c.rpcService
+}
+
 const (
 	GRPCServiceTimeout = 3 * time.Minute
 )
@@ -51,14 +57,17 @@ const (
 func NewControllerClient(address, volumeName, instanceName string) (*ControllerClient, error) {
 	getControllerServiceContext := func(serviceUrl string) (ControllerServiceContext, error) {
 		connection, err := grpc.NewClient(serviceUrl, grpc.WithTransportCredentials(insecure.NewCredentials()),
-			interceptor.WithIdentityValidationClientInterceptor(volumeName, instanceName))
+			interceptor.WithIdentityValidationClientInterceptor(volumeName, instanceName),
+			interceptor.WithIdentityValidationClientStreamInterceptor(volumeName, instanceName),
+			interceptor.WithTracingClientInterceptor(), interceptor.WithTracingClientStreamInterceptor())
 		if err != nil {
 			return ControllerServiceContext{}, errors.Wrapf(err, "cannot connect to ControllerService %v", serviceUrl)
 		}
 
 		return ControllerServiceContext{
-			cc:      connection,
-			service: enginerpc.NewControllerServiceClient(connection),
+			cc:         connection,
+			service:    enginerpc.NewControllerServiceClient(connection),
+			rpcService: controllerrpc.NewControllerServiceClient(connection),
 		}, nil
 	}
 
@@ -124,6 +133,54 @@ func GetSyncFileInfo(info *enginerpc.SyncFileInfo) types.SyncFileInfo {
 	}
 }
 
+func GetMetrics(m *enginerpc.Metrics) *types.Metrics {
+	return &types.Metrics{
+		Throughput: types.RWMetrics{
+			Read:  m.ReadThroughput,
+			Write: m.WriteThroughput,
+		},
+		TotalLatency: types.RWMetrics{
+			Read:  m.ReadLatency,
+			Write: m.WriteLatency,
+		},
+		IOPS: types.RWMetrics{
+			Read:  m.ReadIOPS,
+			Write: m.WriteIOPS,
+		},
+	}
+}
+
+func GetEvent(e *controllerrpc.Event) (*types.Event, error) {
+	event := &types.Event{
+		Seq:      e.Seq,
+		Type:     e.Type,
+		Action:   e.Action,
+		Message:  e.Message,
+		Snapshot: e.Snapshot,
+		Size:     e.Size,
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, e.Timestamp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid timestamp %v of event %v", e.Timestamp, e.Seq)
+	}
+	event.Timestamp = timestamp
+	if e.Replica != nil {
+		event.Replica = &types.Replica{
+			Address: e.Replica.Address.Address,
+			Mode:    types.GRPCReplicaModeToReplicaMode(e.Replica.Mode),
+		}
+	}
+	if e.Volume != nil {
+		event.Frontend = e.Volume.Frontend
+		event.State = types.State(e.Volume.FrontendState)
+		event.Endpoint = e.Volume.Endpoint
+	}
+	if e.Metrics != nil {
+		event.Metrics = GetMetrics(e.Metrics)
+	}
+	return event, nil
+}
+
 func (c *ControllerClient) VolumeGet() (*types.VolumeInfo, error) {
 	controllerServiceClient := c.getControllerServiceClient()
 	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceTimeout)
@@ -455,18 +512,102 @@ func (c *ControllerClient) MetricsGet() (*types.Metrics, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get metrics for volume %v", c.serviceURL)
 	}
-	return &types.Metrics{
-		Throughput: types.RWMetrics{
-			Read:  reply.Metrics.ReadThroughput,
-			Write: reply.Metrics.WriteThroughput,
-		},
-		TotalLatency: types.RWMetrics{
-			Read:  reply.Metrics.ReadLatency,
-			Write: reply.Metrics.WriteLatency,
-		},
-		IOPS: types.RWMetrics{
-			Read:  reply.Metrics.ReadIOPS,
-			Write: reply.Metrics.WriteIOPS,
-		},
-	}, nil
+	return GetMetrics(reply.Metrics), nil
+}
+
+// Watch streams the controller events published after sinceSeq to handler until ctx is done, the stream breaks or
+// handler returns an error. An empty eventTypes means all event types.
+func (c *ControllerClient) Watch(ctx context.Context, sinceSeq uint64, eventTypes []string, handler func(*types.Event) error) error {
+	rpcServiceClient := c.getControllerRPCServiceClient()
+
+	stream, err := rpcServiceClient.Watch(ctx, &controllerrpc.WatchRequest{
+		SinceSeq: sinceSeq,
+		Types:    eventTypes,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch events of volume %v", c.serviceURL)
+	}
+
+	for {
+		e, err := stream.Recv()
+		if err != nil {
+			return errors.Wrapf(err, "failed to receive event of volume %v", c.serviceURL)
+		}
+		event, err := GetEvent(e)
+		if err != nil {
+			return err
+		}
+		if err := handler(event); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *ControllerClient) CaptureStart(file string, dataHash bool) error {
+	rpcServiceClient := c.getControllerRPCServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceTimeout)
+	defer cancel()
+
+	if _, err := rpcServiceClient.CaptureStart(ctx, &controllerrpc.CaptureStartRequest{
+		File:     file,
+		DataHash: dataHash,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to start I/O capture for volume %v", c.serviceURL)
+	}
+	return nil
+}
+
+// CaptureStop stops the running I/O capture, and returns its file and the number of requests recorded.
+func (c *ControllerClient) CaptureStop() (string, int64, error) {
+	rpcServiceClient := c.getControllerRPCServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceTimeout)
+	defer cancel()
+
+	reply, err := rpcServiceClient.CaptureStop(ctx, &emptypb.Empty{})
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "failed to stop I/O capture for volume %v", c.serviceURL)
+	}
+	return reply.File, reply.Records, nil
+}
+
+// FrontendStart starts a frontend named name besides the frontend of the volume.
+func (c *ControllerClient) FrontendStart(name, frontend string, readOnly bool) error {
+	rpcServiceClient := c.getControllerRPCServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceTimeout)
+	defer cancel()
+
+	if _, err := rpcServiceClient.FrontendStart(ctx, &controllerrpc.FrontendStartRequest{
+		Name:     name,
+		Frontend: frontend,
+		ReadOnly: readOnly,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to start frontend %v as %v for volume %v", frontend, name, c.serviceURL)
+	}
+	return nil
+}
+
+func (c *ControllerClient) FrontendShutdown(name string) error {
+	rpcServiceClient := c.getControllerRPCServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceTimeout)
+	defer cancel()
+
+	if _, err := rpcServiceClient.FrontendShutdown(ctx, &controllerrpc.FrontendShutdownRequest{
+		Name: name,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to shutdown frontend %v for volume %v", name, c.serviceURL)
+	}
+	return nil
+}
+
+// FrontendList returns the frontend of the volume, which has no name, and the named frontends.
+func (c *ControllerClient) FrontendList() ([]*controllerrpc.Frontend, error) {
+	rpcServiceClient := c.getControllerRPCServiceClient()
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceTimeout)
+	defer cancel()
+
+	reply, err := rpcServiceClient.FrontendList(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list frontends for volume %v", c.serviceURL)
+	}
+	return reply.Frontends, nil
 }
@@ -5,8 +5,10 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,6 +22,7 @@ import (
 	lhutils "github.com/longhorn/go-common-libs/utils"
 	"github.com/longhorn/types/pkg/generated/enginerpc"
 
+	"github.com/longhorn/longhorn-engine/pkg/iocapture"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 	"github.com/longhorn/longhorn-engine/pkg/util"
 	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
@@ -36,6 +39,7 @@ type Controller struct {
 	frontend                  types.Frontend
 	isUpgrade                 bool
 	iscsiTargetRequestTimeout time.Duration
+	frontendOptions           FrontendOptions
 	sharedTimeouts            *util.SharedTimeouts
 	DataServerProtocol        types.DataServerProtocol
 
@@ -59,6 +63,11 @@ type Controller struct {
 	latestMetrics *types.Metrics
 	metrics       *types.Metrics
 
+	events *eventBroadcaster
+
+	// capture records the requests going to the replicator while an I/O capture is running
+	capture atomic.Pointer[iocapture.Recorder]
+
 	// lastExpansionFailedAt indicates if the error belongs to the recent expansion
 	lastExpansionFailedAt string
 	// lastExpansionError indicates the error message.
@@ -66,6 +75,20 @@ type Controller struct {
 	lastExpansionError string
 
 	fileSyncHTTPClientTimeout int
+
+	// replicaReconnectGracePeriod is how long a failed replica may reconnect before it needs a rebuild
+	replicaReconnectGracePeriod time.Duration
+	// graceWindows are the replicas in their grace period by address. They are changed with both the controller lock
+	// and graceLock held, and graceLock alone guards the ranges logged in them.
+	graceLock        sync.Mutex
+	graceWindows     map[string]*graceWindow
+	graceWindowCount atomic.Int32
+
+	// frontendsLock guards frontends, the frontends started besides frontend. It may be taken with the controller lock
+	// held, but not the other way around, and it is never held while calling into a frontend, since the frontends do
+	// I/O while they start up or shut down.
+	frontendsLock sync.Mutex
+	frontends     map[string]*namedFrontend
 }
 
 const (
@@ -80,8 +103,10 @@ func NewController(name string, factory types.BackendFactory, frontend types.Fro
 		factory:       factory,
 		VolumeName:    name,
 		frontend:      frontend,
+		frontends:     map[string]*namedFrontend{},
 		metrics:       &types.Metrics{},
 		latestMetrics: &types.Metrics{},
+		events:        newEventBroadcaster(),
 
 		isUpgrade:                 isUpgrade,
 		revisionCounterDisabled:   disableRevCounter,
@@ -284,6 +309,7 @@ func (c *Controller) Snapshot(inputName string, labels map[string]string, should
 		return "", err
 	}
 	log.Info("Finished snapshot")
+	c.publishVolumeEvent(&types.Event{Action: types.EventActionSnapshotCreate, Snapshot: name})
 	return name, nil
 }
 
@@ -333,6 +359,9 @@ func (c *Controller) Expand(size int64) error {
 					expanded = false
 				}
 			}
+			if expanded {
+				c.expandNamedFrontends(size)
+			}
 			c.finishExpansion(expanded, size)
 		}()
 
@@ -406,6 +435,7 @@ func (c *Controller) startExpansion(size int64) (err error) {
 	}
 
 	c.isExpanding = true
+	c.publishVolumeEvent(&types.Event{Action: types.EventActionExpansionStart, Size: size})
 
 	return nil
 }
@@ -423,8 +453,12 @@ func (c *Controller) finishExpansion(expanded bool, size int64) {
 			log.Infof("Controller succeeded to expand from size %v to %v", c.size, size)
 		}
 		c.size = size
+		c.publishVolumeEvent(&types.Event{Action: types.EventActionExpansionFinish, Size: size,
+			Message: c.lastExpansionError})
 	} else {
 		log.Infof("Controller failed to expand from size %v to %v", c.size, size)
+		c.publishVolumeEvent(&types.Event{Action: types.EventActionExpansionError, Size: size,
+			Message: c.lastExpansionError})
 	}
 	c.isExpanding = false
 }
@@ -481,6 +515,7 @@ func (c *Controller) addReplicaNoLock(newBackend types.Backend, address string,
 	})
 
 	c.backend.AddBackend(address, newBackend, mode)
+	c.publishReplicaEvent(types.EventActionReplicaAdd, address, mode, "")
 
 	if mode != types.ERR {
 		go c.monitoring(address, newBackend)
@@ -508,11 +543,15 @@ func (c *Controller) RemoveReplica(address string) error {
 
 	for i, r := range c.replicas {
 		if r.Address == address {
-			if len(c.replicas) == 1 && c.frontend != nil && c.frontend.State() == types.StateUp {
+			if len(c.replicas) == 1 && (c.namedFrontendUp() != "" || c.frontend != nil && c.frontend.State() == types.StateUp) {
 				return fmt.Errorf("cannot remove last replica if volume is up")
 			}
 			c.replicas = append(c.replicas[:i], c.replicas[i+1:]...)
+			if w, ok := c.graceWindows[r.Address]; ok {
+				c.closeGraceWindowNoLock(w, "the replica is removed")
+			}
 			c.backend.RemoveBackend(r.Address)
+			c.publishReplicaEvent(types.EventActionReplicaRemove, r.Address, r.Mode, "")
 		}
 	}
 
@@ -546,9 +585,13 @@ func (c *Controller) setReplicaModeNoLock(address string, mode types.Mode) {
 		if r.Address == address {
 			if r.Mode != types.ERR {
 				log.Infof("Setting replica %v to mode %v", address, mode)
+				changed := r.Mode != mode
 				r.Mode = mode
 				c.replicas[i] = r
 				c.backend.SetMode(address, mode)
+				if changed {
+					c.publishReplicaEvent(types.EventActionReplicaModeChange, address, mode, "")
+				}
 			} else {
 				log.Infof("Ignored setting replica %v to mode %v due to it's ERR", address, mode)
 			}
@@ -576,10 +619,19 @@ func (c *Controller) startFrontend() error {
 			log.WithError(err).Error("Failed to startup frontend")
 			return errors.Wrap(err, "failed to start up frontend")
 		}
+		c.publishVolumeEvent(&types.Event{Action: types.EventActionFrontendUp, Frontend: c.frontend.FrontendName(),
+			State: c.frontend.State(), Endpoint: c.frontend.Endpoint()})
 	}
 	return nil
 }
 
+// SetFrontendOptions sets the options of the frontends started afterwards.
+func (c *Controller) SetFrontendOptions(options FrontendOptions) {
+	c.Lock()
+	defer c.Unlock()
+	c.frontendOptions = options
+}
+
 func (c *Controller) StartFrontend(frontend string) error {
 	c.Lock()
 	defer c.Unlock()
@@ -590,6 +642,9 @@ func (c *Controller) StartFrontend(frontend string) error {
 	if frontend == "" {
 		return fmt.Errorf("cannot start empty frontend")
 	}
+	if conflict := c.namedFrontendConflict(frontend); conflict != "" {
+		return fmt.Errorf("frontend %v cannot be started while frontend %v is", frontend, conflict)
+	}
 	if c.frontend != nil {
 		if c.frontend.FrontendName() != frontend && c.frontend.State() != types.StateDown {
 			return fmt.Errorf("frontend %v is already started, cannot be set as %v",
@@ -597,7 +652,7 @@ func (c *Controller) StartFrontend(frontend string) error {
 		}
 	}
 
-	f, err := NewFrontend(frontend, c.iscsiTargetRequestTimeout)
+	f, err := NewFrontend(frontend, c.iscsiTargetRequestTimeout, c.frontendOptions)
 	if err != nil {
 		return errors.Wrapf(err, "failed to find frontend: %s", frontend)
 	}
@@ -1081,14 +1136,51 @@ func (c *Controller) WriteAt(b []byte, off int64) (int, error) {
 	} else {
 		n, err = c.writeInNormalMode(b, off)
 	}
+	c.logDirty(off, l)
 	c.RUnlock()
+	c.recordCapture(iocapture.OpWrite, off, uint32(l), b, startTime, err)
 	if err != nil {
-		return n, c.handleError(err)
+		return n, c.handleWriteError(err, off, l)
 	}
 	c.recordMetrics(false, l, time.Since(startTime))
 	return n, err
 }
 
+// WriteZeroesAt zeroes a range of the volume without sending the zeros to the replicas that support it.
+func (c *Controller) WriteZeroesAt(length uint32, off int64) (int, error) {
+	c.RLock()
+	if off < 0 || off+int64(length) > c.size {
+		err := fmt.Errorf("EOF: Write zeroes of %v bytes at offset %v is beyond volume size %v", length, off, c.size)
+		c.RUnlock()
+		return 0, err
+	}
+	startTime := time.Now()
+	var n int
+	var err error
+	if c.hasWOReplica() {
+		// The snapshots of a rebuilding replica are not complete yet, so it cannot tell whether punching its head is
+		// safe. Send the zeros instead.
+		n, err = util.WriteZeroBufferAt(writerAtFunc(c.writeInWOMode), length, off)
+	} else {
+		n, err = c.backend.WriteZeroesAt(length, off)
+	}
+	c.logDirty(off, int(length))
+	c.RUnlock()
+	c.recordCapture(iocapture.OpWriteZeroes, off, length, nil, startTime, err)
+	if err != nil {
+		return n, c.handleWriteError(err, off, int(length))
+	}
+	c.recordMetrics(false, int(length), time.Since(startTime))
+	return n, err
+}
+
+// writerAtFunc turns a write function into an io.WriterAt.
+type writerAtFunc func(b []byte, off int64) (int, error)
+
+func (f writerAtFunc) WriteAt(b []byte, off int64) (int, error) {
+	return f(b, off)
+}
+
 func (c *Controller) writeInWOMode(b []byte, off int64) (int, error) {
 	bufLen := len(b)
 	// buffer b is defaultSectorSize aligned
@@ -1138,6 +1230,7 @@ func (c *Controller) ReadAt(b []byte, off int64) (int, error) {
 	startTime := time.Now()
 	n, err := c.backend.ReadAt(b, off)
 	c.RUnlock()
+	c.recordCapture(iocapture.OpRead, off, uint32(l), b, startTime, err)
 	if err != nil {
 		return n, c.handleError(err)
 	}
@@ -1145,6 +1238,23 @@ func (c *Controller) ReadAt(b []byte, off int64) (int, error) {
 	return n, err
 }
 
+// Flush makes the data written to the volume so far durable on the replicas.
+func (c *Controller) Flush() error {
+	c.RLock()
+	if !c.backend.backendsAvailable {
+		c.RUnlock()
+		return ErrNoBackend
+	}
+	startTime := time.Now()
+	err := c.backend.Flush()
+	c.RUnlock()
+	c.recordCapture(iocapture.OpFlush, 0, 0, nil, startTime, err)
+	if err != nil {
+		return c.handleError(err)
+	}
+	return nil
+}
+
 func (c *Controller) UnmapAt(length uint32, off int64) (int, error) {
 	// TODO: Need to fail unmap requests
 	//  if the volume is purging snapshots or creating backups.
@@ -1179,11 +1289,13 @@ func (c *Controller) UnmapAt(length uint32, off int64) (int, error) {
 		return 0, err
 	}
 
-	// startTime := time.Now()
+	startTime := time.Now()
 	n, err := c.backend.UnmapAt(length, off)
+	c.logDirty(off, int(length))
 	c.Unlock()
+	c.recordCapture(iocapture.OpUnmap, off, length, nil, startTime, err)
 	if err != nil {
-		return n, c.handleError(err)
+		return n, c.handleWriteError(err, off, int(length))
 	}
 
 	// TODO: Add operation unmap into the metrics
@@ -1219,7 +1331,7 @@ func (c *Controller) handleErrorNoLock(err error) error {
 					noSpaceErrMap[address] = bErr.WrittenBytes[address]
 				} else {
 					log.WithError(err).Errorf("Setting replica %s to ERR", address)
-					c.setReplicaModeNoLock(address, types.ERR)
+					c.failReplicaNoLock(address, true)
 				}
 			}
 
@@ -1259,6 +1371,17 @@ func (c *Controller) handleDiskNoSpaceErrorForReplicas(replicaNoSpaceErrMap map[
 	}
 	log := logrus.WithField("volume", c.VolumeName)
 
+	noSpaceReplicas := make([]string, 0, len(replicaNoSpaceErrMap))
+	for address := range replicaNoSpaceErrMap {
+		noSpaceReplicas = append(noSpaceReplicas, address)
+	}
+	sort.Strings(noSpaceReplicas)
+	c.events.publishUnlessRepeated(&types.Event{
+		Type:    types.EventTypeVolume,
+		Action:  types.EventActionNoSpace,
+		Message: fmt.Sprintf("replicas out of space: %v", strings.Join(noSpaceReplicas, ", ")),
+	})
+
 	rwReplicaCount, rwReplicasOnEnospcMap, noSpaceWOReplicasList := c.categorizeOutOfSpaceReplicas(replicaNoSpaceErrMap)
 	for _, address := range noSpaceWOReplicasList {
 		// If the WO replica is on a disk that is out of space, it will be marked as ERR for data integrity,
@@ -1406,6 +1529,7 @@ func (c *Controller) handleError(err error) error {
 }
 
 func (c *Controller) reset() {
+	c.closeGraceWindowsNoLock("the backend is reset")
 	c.replicas = []types.Replica{}
 	c.backend = &replicator{}
 }
@@ -1420,7 +1544,11 @@ func (c *Controller) shutdownFrontend() error {
 	defer c.RUnlock()
 
 	if c.frontend != nil {
-		return c.frontend.Shutdown()
+		if err := c.frontend.Shutdown(); err != nil {
+			return err
+		}
+		c.publishVolumeEvent(&types.Event{Action: types.EventActionFrontendDown, Frontend: c.frontend.FrontendName(),
+			State: c.frontend.State()})
 	}
 	return nil
 }
@@ -1453,10 +1581,21 @@ func (c *Controller) Shutdown() error {
 	if errFrontend != nil {
 		log.WithError(errFrontend).Error("Error when shutting down frontend")
 	}
+	if err := c.shutdownNamedFrontends(); err != nil {
+		log.WithError(err).Error("Error when shutting down named frontends")
+		if errFrontend == nil {
+			errFrontend = err
+		}
+	}
 	errBackend := c.shutdownBackend()
 	if errBackend != nil {
 		log.WithError(errBackend).Error("Error when shutting down backend")
 	}
+	if c.GetCapture() != "" {
+		if _, _, err := c.StopCapture(); err != nil {
+			log.WithError(err).Error("Error when stopping I/O capture")
+		}
+	}
 	if errFrontend != nil || errBackend != nil {
 		return errors.Wrapf(errBackend, "errors when shutting down controller: frontend: %v backend", errFrontend)
 	}
@@ -1481,9 +1620,7 @@ func (c *Controller) monitoring(address string, backend types.Backend) {
 	err := <-monitorChan
 	if err != nil {
 		log.WithError(err).Errorf("Backend %v monitoring failed, mark as ERR", address)
-		if err = c.SetReplicaMode(address, types.ERR); err != nil {
-			log.WithError(err).Warnf("Failed to set replica %v to ERR", address)
-		}
+		c.failReplica(address, false)
 	}
 	log.Infof("Monitoring stopped %v", address)
 }
@@ -1531,7 +1668,14 @@ func (c *Controller) metricsStart() {
 			c.metricsLock.Lock()
 			c.latestMetrics = c.metrics
 			c.metrics = &types.Metrics{}
+			latestMetrics := *c.latestMetrics
 			c.metricsLock.Unlock()
+
+			c.events.publish(&types.Event{
+				Type:    types.EventTypeMetrics,
+				Action:  types.EventActionMetrics,
+				Metrics: &latestMetrics,
+			})
 		}
 	}()
 }
@@ -1540,25 +1684,7 @@ func (c *Controller) GetLatestMetics() *enginerpc.Metrics {
 	c.metricsLock.RLock()
 	defer c.metricsLock.RUnlock()
 
-	metrics := &enginerpc.Metrics{}
-
-	metrics.ReadThroughput = c.latestMetrics.Throughput.Read
-	metrics.WriteThroughput = c.latestMetrics.Throughput.Write
-	metrics.ReadIOPS = c.latestMetrics.IOPS.Read
-	metrics.WriteIOPS = c.latestMetrics.IOPS.Write
-
-	if c.latestMetrics.IOPS.Read != 0 {
-		metrics.ReadLatency = getAverageLatency(c.latestMetrics.TotalLatency.Read, c.latestMetrics.IOPS.Read)
-	}
-	if c.latestMetrics.IOPS.Write != 0 {
-		metrics.WriteLatency = getAverageLatency(c.latestMetrics.TotalLatency.Write, c.latestMetrics.IOPS.Write)
-	}
-
-	return metrics
-}
-
-func getAverageLatency(totalLatency, iops uint64) uint64 {
-	return totalLatency / iops
+	return types.MetricsToGRPCMetrics(c.latestMetrics)
 }
 
 // tryFreeze attempts to bind mount an existing mount point to freezePoint, then freeze the filesystem from
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	eventHistorySize      = 1024
+	eventSubscriberBuffer = 256
+)
+
+// ErrEventSeqOutOfRange is returned when a watcher asks to resume from a sequence number that is no longer (or not
+// yet) kept in the event history. The watcher needs to refresh its state and start over.
+var ErrEventSeqOutOfRange = fmt.Errorf("event sequence number is out of range")
+
+type eventSubscriber struct {
+	ch     chan *types.Event
+	closed bool
+}
+
+// eventBroadcaster fans controller events out to watchers. Publishing never blocks: a subscriber that cannot keep
+// up is dropped by closing its channel, and is expected to resume from the last sequence number it received.
+type eventBroadcaster struct {
+	sync.Mutex
+
+	seq         uint64
+	history     []*types.Event
+	subscribers map[int]*eventSubscriber
+	nextID      int
+}
+
+func newEventBroadcaster() *eventBroadcaster {
+	return &eventBroadcaster{
+		history:     []*types.Event{},
+		subscribers: map[int]*eventSubscriber{},
+	}
+}
+
+func (b *eventBroadcaster) publish(e *types.Event) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.publishLocked(e)
+}
+
+// publishLocked publishes e. It must be called with the lock held.
+func (b *eventBroadcaster) publishLocked(e *types.Event) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+
+	// Metrics are periodic samples rather than state changes, so they are not kept for resumption.
+	if e.Type != types.EventTypeMetrics {
+		b.seq++
+		e.Seq = b.seq
+		b.history = append(b.history, e)
+		if len(b.history) > eventHistorySize {
+			b.history = b.history[len(b.history)-eventHistorySize:]
+		}
+	}
+
+	for id, s := range b.subscribers {
+		select {
+		case s.ch <- e:
+		default:
+			close(s.ch)
+			s.closed = true
+			delete(b.subscribers, id)
+		}
+	}
+}
+
+// publishUnlessRepeated publishes e unless the latest event in the history has the same type, action and message.
+// It keeps conditions reported on every failing I/O from flooding the history.
+func (b *eventBroadcaster) publishUnlessRepeated(e *types.Event) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.history) != 0 {
+		last := b.history[len(b.history)-1]
+		if last.Type == e.Type && last.Action == e.Action && last.Message == e.Message {
+			return
+		}
+	}
+	b.publishLocked(e)
+}
+
+// subscribe returns the events published after sinceSeq that are still in the history, and a channel for the
+// events published from now on. sinceSeq 0 means only new events are wanted. The returned cancel function must be
+// called once the caller stops reading from the channel.
+func (b *eventBroadcaster) subscribe(sinceSeq uint64) ([]*types.Event, <-chan *types.Event, func(), error) {
+	b.Lock()
+	defer b.Unlock()
+
+	backlog := []*types.Event{}
+	if sinceSeq != 0 {
+		if sinceSeq > b.seq {
+			return nil, nil, nil, ErrEventSeqOutOfRange
+		}
+		if len(b.history) != 0 && sinceSeq+1 < b.history[0].Seq {
+			return nil, nil, nil, ErrEventSeqOutOfRange
+		}
+		for _, e := range b.history {
+			if e.Seq > sinceSeq {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	id := b.nextID
+	b.nextID++
+	s := &eventSubscriber{
+		ch: make(chan *types.Event, eventSubscriberBuffer),
+	}
+	b.subscribers[id] = s
+
+	cancel := func() {
+		b.Lock()
+		defer b.Unlock()
+		if !s.closed {
+			close(s.ch)
+			s.closed = true
+			delete(b.subscribers, id)
+		}
+	}
+
+	return backlog, s.ch, cancel, nil
+}
+
+// WatchEvents subscribes to the controller events. See eventBroadcaster.subscribe.
+func (c *Controller) WatchEvents(sinceSeq uint64) ([]*types.Event, <-chan *types.Event, func(), error) {
+	return c.events.subscribe(sinceSeq)
+}
+
+func (c *Controller) publishReplicaEvent(action, address string, mode types.Mode, message string) {
+	c.events.publish(&types.Event{
+		Type:    types.EventTypeReplica,
+		Action:  action,
+		Replica: &types.Replica{Address: address, Mode: mode},
+		Message: message,
+	})
+}
+
+func (c *Controller) publishVolumeEvent(e *types.Event) {
+	e.Type = types.EventTypeVolume
+	c.events.publish(e)
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"sync"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+func (s *TestSuite) TestEventBroadcasterResume(c *C) {
+	b := newEventBroadcaster()
+
+	for i := 0; i < 3; i++ {
+		b.publish(&types.Event{Type: types.EventTypeReplica, Action: types.EventActionReplicaAdd})
+	}
+	b.publish(&types.Event{Type: types.EventTypeMetrics, Action: types.EventActionMetrics})
+
+	backlog, events, cancel, err := b.subscribe(1)
+	c.Assert(err, IsNil)
+	c.Assert(backlog, HasLen, 2)
+	c.Assert(backlog[0].Seq, Equals, uint64(2))
+	c.Assert(backlog[1].Seq, Equals, uint64(3))
+
+	b.publish(&types.Event{Type: types.EventTypeVolume, Action: types.EventActionFrontendUp})
+	e := <-events
+	c.Assert(e.Seq, Equals, uint64(4))
+	c.Assert(e.Timestamp.IsZero(), Equals, false)
+
+	// Metrics events are delivered but not numbered.
+	b.publish(&types.Event{Type: types.EventTypeMetrics, Action: types.EventActionMetrics})
+	e = <-events
+	c.Assert(e.Seq, Equals, uint64(0))
+
+	cancel()
+	_, ok := <-events
+	c.Assert(ok, Equals, false)
+	cancel()
+
+	_, _, _, err = b.subscribe(5)
+	c.Assert(err, Equals, ErrEventSeqOutOfRange)
+
+	for i := 0; i < eventHistorySize; i++ {
+		b.publish(&types.Event{Type: types.EventTypeReplica, Action: types.EventActionReplicaModeChange})
+	}
+	_, _, _, err = b.subscribe(1)
+	c.Assert(err, Equals, ErrEventSeqOutOfRange)
+}
+
+func (s *TestSuite) TestEventBroadcasterSlowSubscriber(c *C) {
+	b := newEventBroadcaster()
+
+	_, events, cancel, err := b.subscribe(0)
+	c.Assert(err, IsNil)
+	defer cancel()
+
+	for i := 0; i < eventSubscriberBuffer+1; i++ {
+		b.publish(&types.Event{Type: types.EventTypeReplica, Action: types.EventActionReplicaAdd})
+	}
+
+	count := 0
+	for range events {
+		count++
+	}
+	c.Assert(count, Equals, eventSubscriberBuffer)
+}
+
+func (s *TestSuite) TestEventBroadcasterUnlessRepeated(c *C) {
+	b := newEventBroadcaster()
+
+	e := types.Event{Type: types.EventTypeVolume, Action: types.EventActionNoSpace, Message: "replicas out of space: a"}
+	e1, e2 := e, e
+	b.publishUnlessRepeated(&e1)
+	b.publishUnlessRepeated(&e2)
+	c.Assert(b.seq, Equals, uint64(1))
+}
+
+func (s *TestSuite) TestEventBroadcasterUnlessRepeatedConcurrent(c *C) {
+	b := newEventBroadcaster()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.publishUnlessRepeated(&types.Event{Type: types.EventTypeVolume, Action: types.EventActionNoSpace, Message: "replicas out of space: a"})
+		}()
+	}
+	wg.Wait()
+	c.Assert(b.seq, Equals, uint64(1))
+}
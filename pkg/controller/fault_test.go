@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/fault"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+func (s *TestSuite) TestFaultInjectedWriteErrorMarksReplicaERR(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+	defer tc.shutdown()
+	ctrl, injector := tc.ctrl, tc.injector
+
+	buf := make([]byte, 4096)
+	_, err := ctrl.WriteAt(buf, 0)
+	c.Assert(err, IsNil)
+
+	_, err = injector.AddRule(fault.Rule{
+		Target:      tc.faultTarget(1),
+		Op:          fault.OpWrite,
+		OffsetStart: 8192,
+		OffsetEnd:   12288,
+		Action:      fault.ActionError,
+	})
+	c.Assert(err, IsNil)
+
+	// Writes outside of the range of the rule are not affected.
+	_, err = ctrl.WriteAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(tc.modes()[1], Equals, types.RW)
+
+	n, err := ctrl.WriteAt(buf, 8192)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(buf))
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.ERR})
+}
+
+func (s *TestSuite) TestFaultInjectedNoSpaceOnAllReplicas(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b", "c")
+	defer tc.shutdown()
+	ctrl, injector := tc.ctrl, tc.injector
+
+	// Replica a writes fewer bytes than b and c before running out of space, so it is the one set to ERR.
+	for i, written := range []int{0, 2048, 2048} {
+		_, err := injector.AddRule(fault.Rule{
+			Target: tc.faultTarget(i),
+			Op:     fault.OpWrite,
+			Action: fault.ActionENOSPC,
+			Bytes:  written,
+			Count:  1,
+		})
+		c.Assert(err, IsNil)
+	}
+
+	_, err := ctrl.WriteAt(make([]byte, 4096), 0)
+	c.Assert(err, Equals, types.ErrNoSpaceLeftOnDevice)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.ERR, types.RW, types.RW})
+
+	// The rules are used up, so the volume is writable again.
+	_, err = ctrl.WriteAt(make([]byte, 4096), 0)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestFaultInjectedDelayAndHang(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a")
+	defer tc.shutdown()
+	ctrl, injector := tc.ctrl, tc.injector
+
+	_, err := injector.AddRule(fault.Rule{Op: fault.OpRead, Action: fault.ActionDelay, Delay: "50ms", Count: 1})
+	c.Assert(err, IsNil)
+	start := time.Now()
+	_, err = ctrl.ReadAt(make([]byte, 4096), 0)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+
+	id, err := injector.AddRule(fault.Rule{Op: fault.OpRead, Action: fault.ActionHang})
+	c.Assert(err, IsNil)
+	done := make(chan error)
+	go func() {
+		_, err := ctrl.ReadAt(make([]byte, 4096), 0)
+		done <- err
+	}()
+	select {
+	case <-done:
+		c.Fatal("read is not hung")
+	case <-time.After(100 * time.Millisecond):
+	}
+	err = injector.RemoveRule(id)
+	c.Assert(err, IsNil)
+	c.Assert(<-done, IsNil)
+}
@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	devtypes "github.com/longhorn/go-iscsi-helper/types"
+
+	"github.com/longhorn/longhorn-engine/pkg/frontend/iscsi"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+var ErrReadOnlyFrontend = errors.New("frontend is read-only")
+
+// namedFrontend is a frontend started besides the frontend of the volume. All of them share the I/O path and the
+// metrics of the controller.
+type namedFrontend struct {
+	frontend types.Frontend
+	readOnly bool
+	// busy is set while the frontend starts up or shuts down, which is done without frontendsLock held.
+	busy bool
+}
+
+// FrontendInfo describes a frontend of the volume. The frontend of the volume itself has no name.
+type FrontendInfo struct {
+	Name     string
+	Frontend string
+	State    types.State
+	Endpoint string
+	ReadOnly bool
+}
+
+// readOnlyVolume is the volume as the read-only frontends see it.
+type readOnlyVolume struct {
+	c *Controller
+}
+
+func (v *readOnlyVolume) ReadAt(b []byte, off int64) (int, error) {
+	return v.c.ReadAt(b, off)
+}
+
+func (v *readOnlyVolume) WriteAt(b []byte, off int64) (int, error) {
+	return 0, ErrReadOnlyFrontend
+}
+
+func (v *readOnlyVolume) UnmapAt(length uint32, off int64) (int, error) {
+	return 0, ErrReadOnlyFrontend
+}
+
+// frontendKind groups the frontend types that cannot run together for the same volume, e.g. both tgt frontends
+// create the same target, which the embedded iSCSI target serves on the same port.
+func frontendKind(frontendType string) string {
+	switch frontendType {
+	case devtypes.FrontendTGTBlockDev, devtypes.FrontendTGTISCSI, iscsi.FrontendName:
+		return "tgt"
+	}
+	return frontendType
+}
+
+// StartNamedFrontend starts a frontend of frontendType named name besides the frontend of the volume.
+func (c *Controller) StartNamedFrontend(name, frontendType string, readOnly bool) error {
+	if frontendType == "" {
+		return fmt.Errorf("cannot start empty frontend")
+	}
+
+	c.RLock()
+	options := c.frontendOptions
+	c.RUnlock()
+
+	f, err := NewFrontend(frontendType, c.iscsiTargetRequestTimeout, options)
+	if err != nil {
+		return errors.Wrapf(err, "failed to find frontend: %s", frontendType)
+	}
+	return c.startNamedFrontend(name, f, readOnly)
+}
+
+func (c *Controller) startNamedFrontend(name string, f types.Frontend, readOnly bool) error {
+	log := logrus.WithFields(logrus.Fields{"volume": c.VolumeName, "frontend": name})
+
+	if name == "" {
+		return fmt.Errorf("cannot start frontend without a name")
+	}
+
+	nf, size, sectorSize, err := c.reserveNamedFrontend(name, f, readOnly)
+	if err != nil {
+		return err
+	}
+
+	var rwu types.ReaderWriterUnmapperAt = c
+	if readOnly {
+		rwu = &readOnlyVolume{c: c}
+	}
+	if err := f.Init(c.VolumeName, size, sectorSize); err != nil {
+		log.WithError(err).Error("Failed to init frontend")
+		c.releaseNamedFrontend(name, nf, true)
+		return errors.Wrapf(err, "failed to init frontend %v", name)
+	}
+	if err := f.Startup(rwu); err != nil {
+		log.WithError(err).Error("Failed to startup frontend")
+		c.releaseNamedFrontend(name, nf, true)
+		return errors.Wrapf(err, "failed to start up frontend %v", name)
+	}
+	c.releaseNamedFrontend(name, nf, false)
+
+	log.Infof("Started frontend %v, read-only %v", f.FrontendName(), readOnly)
+	c.publishVolumeEvent(&types.Event{Action: types.EventActionFrontendUp, Frontend: f.FrontendName(),
+		State: f.State(), Endpoint: f.Endpoint(), Message: fmt.Sprintf("frontend %v", name)})
+	return nil
+}
+
+// reserveNamedFrontend checks that f can be started as name and adds it to the named frontends as busy, so no other
+// frontend of its kind can be started meanwhile. It returns the size of the volume to start f with.
+func (c *Controller) reserveNamedFrontend(name string, f types.Frontend, readOnly bool) (*namedFrontend, int64, int64, error) {
+	c.RLock()
+	defer c.RUnlock()
+	c.frontendsLock.Lock()
+	defer c.frontendsLock.Unlock()
+
+	if _, ok := c.frontends[name]; ok {
+		return nil, 0, 0, fmt.Errorf("frontend %v is already started", name)
+	}
+	kind := frontendKind(f.FrontendName())
+	for otherName, other := range c.frontends {
+		if frontendKind(other.frontend.FrontendName()) == kind {
+			return nil, 0, 0, fmt.Errorf("frontend %v is already started as %v", other.frontend.FrontendName(), otherName)
+		}
+	}
+	if c.isExpanding {
+		return nil, 0, 0, fmt.Errorf("cannot start frontend during the engine expansion")
+	}
+	if len(c.replicas) == 0 {
+		return nil, 0, 0, fmt.Errorf("cannot start frontend %v before the volume is started", name)
+	}
+	if c.frontend != nil && c.frontend.State() != types.StateDown && frontendKind(c.frontend.FrontendName()) == kind {
+		return nil, 0, 0, fmt.Errorf("frontend %v is already started for the volume", c.frontend.FrontendName())
+	}
+
+	nf := &namedFrontend{frontend: f, readOnly: readOnly, busy: true}
+	c.frontends[name] = nf
+	return nf, c.size, c.sectorSize, nil
+}
+
+// releaseNamedFrontend clears the busy flag of nf once it is started up or shut down, and forgets it if remove is
+// set.
+func (c *Controller) releaseNamedFrontend(name string, nf *namedFrontend, remove bool) {
+	c.frontendsLock.Lock()
+	defer c.frontendsLock.Unlock()
+	nf.busy = false
+	if remove {
+		delete(c.frontends, name)
+	}
+}
+
+// ShutdownNamedFrontend shuts down and forgets the frontend named name.
+func (c *Controller) ShutdownNamedFrontend(name string) error {
+	c.frontendsLock.Lock()
+	nf, ok := c.frontends[name]
+	if !ok {
+		c.frontendsLock.Unlock()
+		return fmt.Errorf("frontend %v is not found", name)
+	}
+	if nf.busy {
+		c.frontendsLock.Unlock()
+		return fmt.Errorf("frontend %v is starting up or shutting down", name)
+	}
+	nf.busy = true
+	c.frontendsLock.Unlock()
+
+	return c.shutdownNamedFrontend(name, nf)
+}
+
+func (c *Controller) shutdownNamedFrontends() error {
+	c.frontendsLock.Lock()
+	toShutdown := map[string]*namedFrontend{}
+	for name, nf := range c.frontends {
+		if !nf.busy {
+			nf.busy = true
+			toShutdown[name] = nf
+		}
+	}
+	c.frontendsLock.Unlock()
+
+	var errs []error
+	for name, nf := range toShutdown {
+		if err := c.shutdownNamedFrontend(name, nf); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to shut down frontends: %v", errs)
+	}
+	return nil
+}
+
+// shutdownNamedFrontend shuts down nf, which the caller marked busy.
+func (c *Controller) shutdownNamedFrontend(name string, nf *namedFrontend) error {
+	if err := nf.frontend.Shutdown(); err != nil {
+		c.releaseNamedFrontend(name, nf, false)
+		return errors.Wrapf(err, "failed to shut down frontend %v", name)
+	}
+	c.releaseNamedFrontend(name, nf, true)
+	logrus.WithFields(logrus.Fields{"volume": c.VolumeName, "frontend": name}).Infof("Shut down frontend %v",
+		nf.frontend.FrontendName())
+	c.publishVolumeEvent(&types.Event{Action: types.EventActionFrontendDown, Frontend: nf.frontend.FrontendName(),
+		State: nf.frontend.State(), Message: fmt.Sprintf("frontend %v", name)})
+	return nil
+}
+
+// ListFrontends returns the frontend of the volume, if any, and the named frontends by name.
+func (c *Controller) ListFrontends() []FrontendInfo {
+	var infos []FrontendInfo
+
+	c.RLock()
+	primary := c.frontend
+	c.RUnlock()
+	if primary != nil {
+		infos = append(infos, FrontendInfo{
+			Frontend: primary.FrontendName(),
+			State:    primary.State(),
+			Endpoint: primary.Endpoint(),
+		})
+	}
+
+	c.frontendsLock.Lock()
+	defer c.frontendsLock.Unlock()
+	names := make([]string, 0, len(c.frontends))
+	for name := range c.frontends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nf := c.frontends[name]
+		infos = append(infos, FrontendInfo{
+			Name:     name,
+			Frontend: nf.frontend.FrontendName(),
+			State:    nf.frontend.State(),
+			Endpoint: nf.frontend.Endpoint(),
+			ReadOnly: nf.readOnly,
+		})
+	}
+	return infos
+}
+
+// namedFrontendUp returns the name of a named frontend that is up, starting up or shutting down, or an empty string
+// if there is none.
+func (c *Controller) namedFrontendUp() string {
+	c.frontendsLock.Lock()
+	defer c.frontendsLock.Unlock()
+	for name, nf := range c.frontends {
+		if nf.busy || nf.frontend.State() == types.StateUp {
+			return name
+		}
+	}
+	return ""
+}
+
+// namedFrontendConflict returns the named frontend that cannot run together with a frontend of frontendType.
+func (c *Controller) namedFrontendConflict(frontendType string) string {
+	c.frontendsLock.Lock()
+	defer c.frontendsLock.Unlock()
+	for name, nf := range c.frontends {
+		if frontendKind(nf.frontend.FrontendName()) == frontendKind(frontendType) {
+			return name
+		}
+	}
+	return ""
+}
+
+// expandNamedFrontends tells the named frontends the new size of the volume. Like the frontend of the volume, they
+// are expanded without any lock held, since expanding waits for their I/O in flight.
+func (c *Controller) expandNamedFrontends(size int64) {
+	c.frontendsLock.Lock()
+	toExpand := map[string]*namedFrontend{}
+	for name, nf := range c.frontends {
+		if !nf.busy {
+			toExpand[name] = nf
+		}
+	}
+	c.frontendsLock.Unlock()
+
+	for name, nf := range toExpand {
+		if err := nf.frontend.Expand(size); err != nil {
+			logrus.WithFields(logrus.Fields{"volume": c.VolumeName, "frontend": name}).WithError(err).Error(
+				"Failed to expand the frontend")
+		}
+	}
+}
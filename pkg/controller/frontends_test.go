@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"bytes"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+func (s *TestSuite) TestNamedFrontends(c *C) {
+	tc := newTestCluster(c, testClusterOptions{}, "a")
+	defer tc.shutdown()
+
+	// The volume must be started first.
+	err := tc.ctrl.startNamedFrontend("ro", &testFrontend{name: "ro-type"}, true)
+	c.Assert(err, NotNil)
+	tc.start(c)
+
+	ro := &testFrontend{name: "ro-type"}
+	c.Assert(tc.ctrl.startNamedFrontend("ro", ro, true), IsNil)
+	rw := &testFrontend{name: "rw-type"}
+	c.Assert(tc.ctrl.startNamedFrontend("rw", rw, false), IsNil)
+	c.Assert(ro.size, Equals, int64(testVolumeSize))
+
+	// Names are unique, and so are the kinds of frontend, including the frontend of the volume.
+	c.Assert(tc.ctrl.startNamedFrontend("rw", &testFrontend{name: "other"}, false), ErrorMatches, ".*already started.*")
+	c.Assert(tc.ctrl.startNamedFrontend("rw2", &testFrontend{name: "rw-type"}, false), ErrorMatches, ".*already started.*")
+	c.Assert(tc.ctrl.startNamedFrontend("test", &testFrontend{}, false), ErrorMatches, ".*already started.*")
+	c.Assert(tc.ctrl.StartFrontend("rw-type"), ErrorMatches, ".*cannot be started.*")
+
+	// All frontends share the volume, and the read-only ones reject writes and unmaps.
+	data := bytes.Repeat([]byte{0xab}, 4096)
+	_, err = rw.rwu.WriteAt(data, 4096)
+	c.Assert(err, IsNil)
+	buf := make([]byte, 4096)
+	_, err = ro.rwu.ReadAt(buf, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, data)
+	_, err = ro.rwu.WriteAt(data, 0)
+	c.Assert(err, Equals, ErrReadOnlyFrontend)
+	_, err = ro.rwu.UnmapAt(4096, 0)
+	c.Assert(err, Equals, ErrReadOnlyFrontend)
+
+	infos := tc.ctrl.ListFrontends()
+	c.Assert(infos, DeepEquals, []FrontendInfo{
+		{Frontend: "test", State: types.StateUp},
+		{Name: "ro", Frontend: "ro-type", State: types.StateUp, ReadOnly: true},
+		{Name: "rw", Frontend: "rw-type", State: types.StateUp},
+	})
+
+	newSize := int64(2 * testVolumeSize)
+	c.Assert(tc.ctrl.Expand(newSize), IsNil)
+	waitForExpansion(c, tc.ctrl)
+	c.Assert(ro.size, Equals, newSize)
+	c.Assert(rw.size, Equals, newSize)
+
+	// The last replica cannot be removed while a named frontend is up, even if the frontend of the volume is down.
+	c.Assert(tc.ctrl.ShutdownFrontend(), IsNil)
+	c.Assert(tc.ctrl.RemoveReplica(tc.addresses[0]), ErrorMatches, ".*volume is up.*")
+
+	c.Assert(tc.ctrl.ShutdownNamedFrontend("ro"), IsNil)
+	c.Assert(ro.state, Equals, types.StateDown)
+	c.Assert(tc.ctrl.ShutdownNamedFrontend("ro"), ErrorMatches, ".*not found.*")
+	c.Assert(tc.ctrl.ListFrontends(), HasLen, 2)
+
+	c.Assert(tc.ctrl.Shutdown(), IsNil)
+	c.Assert(rw.state, Equals, types.StateDown)
+	c.Assert(tc.ctrl.ListFrontends(), HasLen, 1)
+}
+
+func (s *TestSuite) TestNamedFrontendStarting(c *C) {
+	tc := newTestCluster(c, testClusterOptions{}, "a")
+	defer tc.shutdown()
+	tc.start(c)
+	c.Assert(tc.ctrl.ShutdownFrontend(), IsNil)
+
+	slow := &testFrontend{name: "slow-type", startup: make(chan struct{})}
+	started := make(chan error, 1)
+	go func() {
+		started <- tc.ctrl.startNamedFrontend("slow", slow, false)
+	}()
+	for i := 0; ; i++ {
+		tc.ctrl.frontendsLock.Lock()
+		_, reserved := tc.ctrl.frontends["slow"]
+		tc.ctrl.frontendsLock.Unlock()
+		if reserved {
+			break
+		}
+		c.Assert(i < 1000, Equals, true)
+		time.Sleep(time.Millisecond)
+	}
+
+	// A frontend starting up counts as up, and holds its kind and its name.
+	c.Assert(tc.ctrl.StartFrontend("slow-type"), ErrorMatches, ".*cannot be started.*")
+	c.Assert(tc.ctrl.startNamedFrontend("slow", &testFrontend{name: "other"}, false), ErrorMatches, ".*already started.*")
+	c.Assert(tc.ctrl.RemoveReplica(tc.addresses[0]), ErrorMatches, ".*volume is up.*")
+	c.Assert(tc.ctrl.ShutdownNamedFrontend("slow"), ErrorMatches, ".*starting up or shutting down.*")
+
+	close(slow.startup)
+	c.Assert(<-started, IsNil)
+	c.Assert(tc.ctrl.ShutdownNamedFrontend("slow"), IsNil)
+	c.Assert(tc.ctrl.RemoveReplica(tc.addresses[0]), IsNil)
+}
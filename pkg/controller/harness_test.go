@@ -0,0 +1,147 @@
+package controller
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/dynamic"
+	"github.com/longhorn/longhorn-engine/pkg/backend/fault"
+	"github.com/longhorn/longhorn-engine/pkg/backend/mem"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const testVolumeSize = 1024 * 1024
+
+// testFrontend is a frontend that does nothing but record the volume size, so controller operations that need a
+// frontend, such as snapshot and expansion, can run in tests. It keeps the volume it is started with, so tests can
+// do I/O through it.
+type testFrontend struct {
+	name  string
+	size  int64
+	state types.State
+	rwu   types.ReaderWriterUnmapperAt
+	// startup blocks Startup until it is closed, if set
+	startup chan struct{}
+}
+
+func (f *testFrontend) FrontendName() string {
+	if f.name != "" {
+		return f.name
+	}
+	return "test"
+}
+
+func (f *testFrontend) Init(name string, size, sectorSize int64) error {
+	f.size = size
+	return nil
+}
+
+func (f *testFrontend) Startup(rwu types.ReaderWriterUnmapperAt) error {
+	if f.startup != nil {
+		<-f.startup
+	}
+	f.rwu = rwu
+	f.state = types.StateUp
+	return nil
+}
+
+func (f *testFrontend) Shutdown() error {
+	f.state = types.StateDown
+	return nil
+}
+
+func (f *testFrontend) State() types.State {
+	return f.state
+}
+
+func (f *testFrontend) Endpoint() string {
+	return ""
+}
+
+func (f *testFrontend) Upgrade(name string, size, sectorSize int64, rwu types.ReaderWriterUnmapperAt) error {
+	f.size = size
+	f.state = types.StateUp
+	return nil
+}
+
+func (f *testFrontend) Expand(size int64) error {
+	f.size = size
+	return nil
+}
+
+type testClusterOptions struct {
+	revisionCounterDisabled bool
+	salvageRequested        bool
+}
+
+// testCluster is a controller and its in-memory replicas running in the test process. Every replica is reached
+// through the fault backend, so tests can inject faults as well as change the replicas directly.
+type testCluster struct {
+	ctrl     *Controller
+	frontend *testFrontend
+	mem      *mem.Factory
+	injector *fault.Injector
+	replicas []*mem.Replica
+	// addresses are the addresses of the replicas known by the controller, in the order of the replicas.
+	addresses []string
+}
+
+// newTestCluster creates the replicas and the controller. The controller is not started, so tests can prepare the
+// replicas first.
+func newTestCluster(c *C, opts testClusterOptions, names ...string) *testCluster {
+	tc := &testCluster{
+		frontend: &testFrontend{},
+		mem:      mem.New(),
+		injector: fault.NewInjector(),
+	}
+
+	factories := map[string]types.BackendFactory{
+		"mem": tc.mem,
+	}
+	factories["fault"] = fault.New(dynamic.New(factories), tc.injector)
+
+	tc.ctrl = NewController("test", dynamic.New(factories), tc.frontend, false, opts.revisionCounterDisabled,
+		opts.salvageRequested, false, DefaultEngineReplicaTimeout, DefaultEngineReplicaTimeout,
+		DefaultEngineReplicaTimeout, types.DataServerProtocolTCP, 5, types.MaximumTotalSnapshotCount, 0)
+
+	for _, name := range names {
+		r, err := tc.mem.AddReplica(name, testVolumeSize)
+		c.Assert(err, IsNil)
+		r.SetRevisionCounterDisabled(opts.revisionCounterDisabled)
+		tc.replicas = append(tc.replicas, r)
+		tc.addresses = append(tc.addresses, "fault://mem://"+name)
+	}
+	return tc
+}
+
+func startTestCluster(c *C, opts testClusterOptions, names ...string) *testCluster {
+	tc := newTestCluster(c, opts, names...)
+	tc.start(c)
+	return tc
+}
+
+func (tc *testCluster) start(c *C) {
+	err := tc.ctrl.Start(testVolumeSize, testVolumeSize, tc.addresses...)
+	c.Assert(err, IsNil)
+}
+
+func (tc *testCluster) shutdown() {
+	_ = tc.ctrl.Shutdown()
+}
+
+// faultTarget returns the target of fault rules for the replica at index i.
+func (tc *testCluster) faultTarget(i int) string {
+	return tc.addresses[i][len("fault://"):]
+}
+
+func (tc *testCluster) modes() []types.Mode {
+	modes := map[string]types.Mode{}
+	for _, r := range tc.ctrl.ListReplicas() {
+		modes[r.Address] = r.Mode
+	}
+
+	result := []types.Mode{}
+	for _, address := range tc.addresses {
+		result = append(result, modes[address])
+	}
+	return result
+}
@@ -5,9 +5,13 @@ import (
 	"time"
 
 	devtypes "github.com/longhorn/go-iscsi-helper/types"
+	"github.com/longhorn/longhorn-engine/pkg/frontend/fuse"
+	"github.com/longhorn/longhorn-engine/pkg/frontend/iscsi"
+	"github.com/longhorn/longhorn-engine/pkg/frontend/nvmetcp"
 	"github.com/longhorn/longhorn-engine/pkg/frontend/rest"
 	"github.com/longhorn/longhorn-engine/pkg/frontend/socket"
 	"github.com/longhorn/longhorn-engine/pkg/frontend/tgt"
+	"github.com/longhorn/longhorn-engine/pkg/frontend/vhostblk"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 	"github.com/sirupsen/logrus"
 )
@@ -25,15 +29,40 @@ const (
 	additionalBufferTimeout = 30 * time.Second
 )
 
-func NewFrontend(frontendType string, iscsiTargetRequestTimeout time.Duration) (types.Frontend, error) {
+// FrontendOptions are the settings of the frontends that take some.
+type FrontendOptions struct {
+	// NvmeTCPListenAddress is the address the nvme-tcp frontend listens on
+	NvmeTCPListenAddress string
+	// ISCSIListenAddress is the address the embedded iSCSI target listens on
+	ISCSIListenAddress string
+	// EmbeddedISCSITarget makes the embedded iSCSI target serve the tgt-iscsi frontend instead of tgt
+	EmbeddedISCSITarget bool
+	// FuseSnapshotDirectory is the directory of a replica on this node, whose snapshots the fuse frontend presents
+	FuseSnapshotDirectory string
+	// Rest are the listen address and the authentication of the rest frontend
+	Rest rest.Options
+}
+
+func NewFrontend(frontendType string, iscsiTargetRequestTimeout time.Duration, options FrontendOptions) (types.Frontend, error) {
 	switch frontendType {
 	case "rest":
-		return rest.New(), nil
+		return rest.New(options.Rest), nil
 	case "socket":
 		return socket.New(), nil
+	case "vhost-user-blk":
+		return vhostblk.New(), nil
+	case "nvme-tcp":
+		return nvmetcp.New(options.NvmeTCPListenAddress), nil
+	case iscsi.FrontendName:
+		return iscsi.New(iscsi.FrontendName, options.ISCSIListenAddress), nil
+	case "fuse":
+		return fuse.New(options.FuseSnapshotDirectory), nil
 	case devtypes.FrontendTGTBlockDev:
 		return tgt.New(devtypes.FrontendTGTBlockDev, defaultScsiTimeout, defaultIscsiAbortTimeout, iscsiTargetRequestTimeout), nil
 	case devtypes.FrontendTGTISCSI:
+		if options.EmbeddedISCSITarget {
+			return iscsi.New(devtypes.FrontendTGTISCSI, options.ISCSIListenAddress), nil
+		}
 		return tgt.New(devtypes.FrontendTGTISCSI, defaultScsiTimeout, defaultIscsiAbortTimeout, iscsiTargetRequestTimeout), nil
 	default:
 		return nil, fmt.Errorf("unsupported frontend type: %v", frontendType)
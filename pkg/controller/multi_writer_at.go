@@ -4,6 +4,8 @@ import (
 	"io"
 	"strings"
 	"sync"
+
+	"github.com/longhorn/longhorn-engine/pkg/util"
 )
 
 type MultiWriterAt struct {
@@ -35,6 +37,19 @@ func (m *MultiWriterError) Error() string {
 }
 
 func (m *MultiWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return m.writeAll(len(p), func(w io.WriterAt) (int, error) {
+		return w.WriteAt(p, off)
+	})
+}
+
+// WriteZeroesAt zeroes the range on all writers, without a buffer of zeros for the writers that support it.
+func (m *MultiWriterAt) WriteZeroesAt(length uint32, off int64) (int, error) {
+	return m.writeAll(int(length), func(w io.WriterAt) (int, error) {
+		return util.WriteZeroesAt(w, length, off)
+	})
+}
+
+func (m *MultiWriterAt) writeAll(length int, write func(w io.WriterAt) (int, error)) (int, error) {
 	errs := make([]error, len(m.writers))
 	wbs := make([]int, len(m.writers))
 	wg := sync.WaitGroup{}
@@ -42,7 +57,7 @@ func (m *MultiWriterAt) WriteAt(p []byte, off int64) (int, error) {
 	for i, w := range m.writers {
 		wg.Add(1)
 		go func(index int, w io.WriterAt) {
-			wn, err := w.WriteAt(p, off)
+			wn, err := write(w)
 			if err != nil {
 				errs[index] = err
 				wbs[index] = wn
@@ -65,7 +80,7 @@ func (m *MultiWriterAt) WriteAt(p []byte, off int64) (int, error) {
 				WrittenBytes: wbs,
 			}
 		} else {
-			n = len(p)
+			n = length
 		}
 	}
 
@@ -71,6 +71,18 @@ func (c *Controller) VerifyRebuildReplica(address, instanceName string) (err err
 		return err
 	}
 
+	fromBackingFile, err := GetReplicaBackingFile(rwReplica.Address, c.VolumeName, "")
+	if err != nil {
+		return err
+	}
+	toBackingFile, err := GetReplicaBackingFile(address, c.VolumeName, instanceName)
+	if err != nil {
+		return err
+	}
+	if err := types.CheckSameBackingFile(fromBackingFile, toBackingFile); err != nil {
+		return errors.Wrapf(err, "replica %v does not have the backing file of RW replica %v", address, rwReplica.Address)
+	}
+
 	// The `Children` field of disk info may contain volume head. And the head file index of rebuilt replica
 	// is different from that of health replicas. Hence we cannot directly compare the disk info map here.
 	if len(fromDisks) != len(toDisks) {
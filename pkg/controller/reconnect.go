@@ -0,0 +1,408 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	// graceRetryInterval is the time between two attempts to reconnect a failed replica
+	graceRetryInterval = time.Second
+	// graceMaxDirtyBytes bounds the data written while a replica is away, or during a round of copying it to the
+	// replica once it reconnects. A replica with more to catch up on is rebuilt instead.
+	graceMaxDirtyBytes = 256 << 20
+	graceCopySize      = 1 << 20
+	// graceCatchUpRounds is how many times the data written meanwhile is copied without the volume locked, before
+	// what is left is copied with the volume locked. The rounds stop early once less than graceLockedCopyBytes was
+	// copied.
+	graceCatchUpRounds   = 4
+	graceLockedCopyBytes = 4 << 20
+)
+
+// graceWindow tracks a failed replica while it may still reconnect. The ranges written to the volume meanwhile are
+// logged, and copied from a healthy replica to the failed one when it comes back with the same chain, so it does not
+// need a rebuild.
+type graceWindow struct {
+	address  string
+	backend  types.ReconnectableBackend
+	deadline time.Time
+	// revisionCounter is the revision counter of the healthy replicas when the replica failed. The replica may miss
+	// up to lost of the writes counted, as they failed on it.
+	revisionCounter int64
+	lost            int64
+	done            chan struct{}
+
+	// dirty, dirtyBytes and overflow are guarded by the graceLock of the controller
+	dirty      []dirtyRange
+	dirtyBytes int64
+	overflow   bool
+}
+
+type dirtyRange struct {
+	off    int64
+	length int64
+}
+
+// SetReplicaReconnectGracePeriod sets how long a replica that failed may reconnect before it needs a rebuild. Zero
+// disables reconnecting.
+func (c *Controller) SetReplicaReconnectGracePeriod(period time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.replicaReconnectGracePeriod = period
+}
+
+// failReplicaNoLock sets a replica to ERR. A RW replica gets a grace period to reconnect, if it is enabled and the
+// revision counter can tell whether the replica missed writes. failedIO tells whether an I/O failed on the replica.
+func (c *Controller) failReplicaNoLock(address string, failedIO bool) {
+	if w, ok := c.graceWindows[address]; ok {
+		if failedIO {
+			w.lost++
+		}
+		return
+	}
+
+	var mode types.Mode
+	for _, r := range c.replicas {
+		if r.Address == address {
+			mode = r.Mode
+		}
+	}
+	c.setReplicaModeNoLock(address, types.ERR)
+	if mode != types.RW || c.replicaReconnectGracePeriod <= 0 || c.revisionCounterDisabled {
+		return
+	}
+	c.openGraceWindowNoLock(address, failedIO)
+}
+
+func (c *Controller) failReplica(address string, failedIO bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.failReplicaNoLock(address, failedIO)
+}
+
+func (c *Controller) openGraceWindowNoLock(address string, failedIO bool) {
+	log := logrus.WithField("volume", c.VolumeName)
+
+	b, ok := c.backend.backends[address]
+	if !ok {
+		return
+	}
+	backend, ok := b.backend.(types.ReconnectableBackend)
+	if !ok {
+		return
+	}
+	healthy := c.healthyReplicaNoLock()
+	if healthy == "" {
+		return
+	}
+	counter, err := c.backend.GetRevisionCounter(healthy)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to get the revision counter of %v, replica %v cannot reconnect", healthy, address)
+		return
+	}
+
+	w := &graceWindow{
+		address:         address,
+		backend:         backend,
+		deadline:        time.Now().Add(c.replicaReconnectGracePeriod),
+		revisionCounter: counter,
+		done:            make(chan struct{}),
+	}
+	if failedIO {
+		w.lost = 1
+	}
+	c.graceLock.Lock()
+	c.graceWindows[address] = w
+	c.graceLock.Unlock()
+	c.graceWindowCount.Add(1)
+
+	log.Infof("Replica %v may reconnect within %v", address, c.replicaReconnectGracePeriod)
+	go c.reconnectReplica(w)
+}
+
+// closeGraceWindowNoLock ends the grace period of a replica. It stays ERR unless it rejoined.
+func (c *Controller) closeGraceWindowNoLock(w *graceWindow, reason string) {
+	if c.graceWindows[w.address] != w {
+		return
+	}
+	c.graceLock.Lock()
+	delete(c.graceWindows, w.address)
+	c.graceLock.Unlock()
+	c.graceWindowCount.Add(-1)
+	close(w.done)
+
+	if reason != "" {
+		logrus.WithField("volume", c.VolumeName).Infof("Replica %v cannot reconnect: %v", w.address, reason)
+	}
+}
+
+func (c *Controller) closeGraceWindowsNoLock(reason string) {
+	for _, w := range c.graceWindows {
+		c.closeGraceWindowNoLock(w, reason)
+	}
+	c.graceWindows = map[string]*graceWindow{}
+}
+
+func (c *Controller) healthyReplicaNoLock() string {
+	for _, r := range c.replicas {
+		if r.Mode == types.RW {
+			return r.Address
+		}
+	}
+	return ""
+}
+
+// logDirty logs a range written to the volume for the replicas in their grace period, once it is written. The caller
+// holds the controller lock, at least for reading, so a replica cannot rejoin before the range is logged.
+func (c *Controller) logDirty(off int64, length int) {
+	if c.graceWindowCount.Load() == 0 || length == 0 {
+		return
+	}
+
+	c.graceLock.Lock()
+	defer c.graceLock.Unlock()
+	for _, w := range c.graceWindows {
+		if w.overflow {
+			continue
+		}
+		w.dirty = append(w.dirty, dirtyRange{off: off, length: int64(length)})
+		w.dirtyBytes += int64(length)
+		if w.dirtyBytes > graceMaxDirtyBytes {
+			w.overflow = true
+			w.dirty = nil
+		}
+	}
+}
+
+// handleWriteError handles the error of a write like handleError. The write is logged once more, for the grace
+// periods the error started.
+func (c *Controller) handleWriteError(err error, off int64, length int) error {
+	c.Lock()
+	defer c.Unlock()
+	err = c.handleErrorNoLock(err)
+	c.logDirty(off, length)
+	return err
+}
+
+func (c *Controller) reconnectReplica(w *graceWindow) {
+	log := logrus.WithField("volume", c.VolumeName)
+
+	ticker := time.NewTicker(graceRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Now().After(w.deadline) {
+			c.Lock()
+			c.closeGraceWindowNoLock(w, "grace period expired")
+			c.Unlock()
+			return
+		}
+
+		// The failed connection is fenced once Reconnect returns, so none of its writes lands on the replica after
+		// the revision counter is checked and the writes logged meanwhile are copied.
+		if err := w.backend.Reconnect(); err != nil {
+			log.WithError(err).Debugf("Failed to reconnect replica %v", w.address)
+			continue
+		}
+
+		if err := c.rejoinReplica(w); err != nil {
+			c.Lock()
+			c.closeGraceWindowNoLock(w, err.Error())
+			c.Unlock()
+		}
+		return
+	}
+}
+
+// rejoinReplica checks that a reconnected replica only missed the logged writes, copies them to it and sets it back
+// to RW. The writes logged so far are copied without the volume locked, as they may add up to graceMaxDirtyBytes,
+// while the writes go on and are logged again. Only the last of them are copied with the volume locked, before the
+// replica is set back to RW, like a rebuild.
+func (c *Controller) rejoinReplica(w *graceWindow) error {
+	c.Lock()
+	_, err := c.checkRejoinNoLock(w)
+	if err == nil {
+		err = c.checkRevisionCounterNoLock(w)
+	}
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var copied int64
+	for round := 0; round < graceCatchUpRounds; round++ {
+		ranges, err := c.takeDirty(w)
+		if err != nil {
+			return err
+		}
+		n, err := c.copyDirty(w, ranges, false)
+		copied += n
+		if err != nil {
+			return err
+		}
+		if n <= graceLockedCopyBytes {
+			break
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	n, err := c.finishRejoinNoLock(w)
+	if err != nil {
+		return err
+	}
+	logrus.WithField("volume", c.VolumeName).Infof("Replica %v reconnected, copied %v bytes written meanwhile, %v of them with the volume locked",
+		w.address, copied+n, n)
+	return nil
+}
+
+// checkRejoinNoLock checks that the grace period of a replica is not over and that its chain is the chain of a
+// healthy replica, which it returns. A snapshot, expansion or revert meanwhile changes the chain of the healthy
+// replicas, so the replica cannot rejoin after those.
+func (c *Controller) checkRejoinNoLock(w *graceWindow) (string, error) {
+	if c.graceWindows[w.address] != w {
+		return "", fmt.Errorf("replica is gone")
+	}
+
+	healthy := c.healthyReplicaNoLock()
+	if healthy == "" {
+		return "", fmt.Errorf("no healthy replica to catch up from")
+	}
+	healthyBackend, ok := c.backend.backends[healthy].backend.(types.ReconnectableBackend)
+	if !ok {
+		return "", fmt.Errorf("cannot get the chain of healthy replica %v", healthy)
+	}
+	healthyChain, err := healthyBackend.GetChain()
+	if err != nil {
+		return "", err
+	}
+	chain, err := w.backend.GetChain()
+	if err != nil {
+		return "", err
+	}
+	if !slices.Equal(chain, healthyChain) {
+		return "", fmt.Errorf("chain %v differs from chain %v of healthy replica %v", chain, healthyChain, healthy)
+	}
+	return healthy, nil
+}
+
+// checkRevisionCounterNoLock checks that the replica missed no more writes than the ones that failed on it. It is
+// checked before anything is copied to the replica, which counts the copies as writes.
+func (c *Controller) checkRevisionCounterNoLock(w *graceWindow) error {
+	counter, err := w.backend.GetRevisionCounter()
+	if err != nil {
+		return err
+	}
+	if counter > w.revisionCounter || counter < w.revisionCounter-w.lost {
+		return fmt.Errorf("revision counter %v does not match %v with %v failed requests", counter, w.revisionCounter, w.lost)
+	}
+	return nil
+}
+
+// takeDirty returns the ranges logged for a replica so far, merged, and starts a new log.
+func (c *Controller) takeDirty(w *graceWindow) ([]dirtyRange, error) {
+	c.graceLock.Lock()
+	defer c.graceLock.Unlock()
+	if w.overflow {
+		return nil, fmt.Errorf("more than %v bytes were written meanwhile", graceMaxDirtyBytes)
+	}
+	dirty := w.dirty
+	w.dirty = nil
+	w.dirtyBytes = 0
+	return mergeDirtyRanges(dirty), nil
+}
+
+// copyDirty copies the ranges from the healthy replicas to a reconnected replica, and returns the number of bytes
+// copied. Unless locked, the volume is locked for reading while each chunk is read, like the reads of the volume.
+// A write landing meanwhile is logged once done, so it is copied again by the next round.
+func (c *Controller) copyDirty(w *graceWindow, ranges []dirtyRange, locked bool) (int64, error) {
+	var copied int64
+	buf := make([]byte, graceCopySize)
+	for _, r := range ranges {
+		for off := r.off; off < r.off+r.length; off += graceCopySize {
+			n := min(r.off+r.length-off, graceCopySize)
+			if !locked {
+				c.RLock()
+			}
+			_, err := c.backend.ReadAt(buf[:n], off)
+			if !locked {
+				c.RUnlock()
+			}
+			if err != nil {
+				return copied, err
+			}
+			if _, err := w.backend.WriteAt(buf[:n], off); err != nil {
+				return copied, err
+			}
+			copied += n
+		}
+	}
+	return copied, nil
+}
+
+// finishRejoinNoLock copies the last of the writes logged for a reconnected replica with the volume locked, so no
+// write is missed, and sets the replica back to RW. It returns the number of bytes copied.
+func (c *Controller) finishRejoinNoLock(w *graceWindow) (int64, error) {
+	healthy, err := c.checkRejoinNoLock(w)
+	if err != nil {
+		return 0, err
+	}
+	ranges, err := c.takeDirty(w)
+	if err != nil {
+		return 0, err
+	}
+	copied, err := c.copyDirty(w, ranges, true)
+	if err != nil {
+		return copied, err
+	}
+
+	current, err := c.backend.GetRevisionCounter(healthy)
+	if err != nil {
+		return copied, err
+	}
+	if err := w.backend.SetRevisionCounter(current); err != nil {
+		return copied, err
+	}
+
+	for i, r := range c.replicas {
+		if r.Address == w.address {
+			r.Mode = types.RW
+			c.replicas[i] = r
+		}
+	}
+	c.backend.SetMode(w.address, types.RW)
+	c.closeGraceWindowNoLock(w, "")
+	c.publishReplicaEvent(types.EventActionReplicaModeChange, w.address, types.RW, "")
+	go c.monitoring(w.address, w.backend)
+	return copied, nil
+}
+
+// mergeDirtyRanges sorts the ranges and merges the ones that overlap or touch.
+func mergeDirtyRanges(ranges []dirtyRange) []dirtyRange {
+	sorted := append([]dirtyRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].off < sorted[j].off
+	})
+
+	var merged []dirtyRange
+	for _, r := range sorted {
+		if last := len(merged) - 1; last >= 0 && r.off <= merged[last].off+merged[last].length {
+			merged[last].length = max(merged[last].length, r.off+r.length-merged[last].off)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
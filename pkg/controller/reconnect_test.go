@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"bytes"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/fault"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+// failReplicaUntilCleared fails the writes and the pings of the replica at index i, like a replica that cannot be
+// reached, until the rules of the injector are cleared.
+func failReplicaUntilCleared(c *C, tc *testCluster, i int) {
+	for _, op := range []string{fault.OpWrite, fault.OpPing} {
+		action := fault.ActionError
+		if op == fault.OpPing {
+			action = fault.ActionDrop
+		}
+		_, err := tc.injector.AddRule(fault.Rule{Target: tc.faultTarget(i), Op: op, Action: action})
+		c.Assert(err, IsNil)
+	}
+}
+
+func waitForGraceWindows(c *C, tc *testCluster) {
+	for start := time.Now(); tc.ctrl.graceWindowCount.Load() != 0; time.Sleep(50 * time.Millisecond) {
+		c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+	}
+}
+
+func (s *TestSuite) TestReplicaReconnectsWithinGracePeriod(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+	defer tc.shutdown()
+	ctrl := tc.ctrl
+	ctrl.SetReplicaReconnectGracePeriod(time.Minute)
+
+	_, err := ctrl.WriteAt(bytes.Repeat([]byte{1}, 4096), 0)
+	c.Assert(err, IsNil)
+
+	failReplicaUntilCleared(c, tc, 1)
+	_, err = ctrl.WriteAt(bytes.Repeat([]byte{2}, 4096), 4096)
+	c.Assert(err, IsNil)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.ERR})
+
+	// Written while the replica is away.
+	_, err = ctrl.WriteAt(bytes.Repeat([]byte{3}, 8192), 6144)
+	c.Assert(err, IsNil)
+	_, err = ctrl.UnmapAt(4096, 0)
+	c.Assert(err, IsNil)
+
+	tc.injector.Clear()
+	waitForGraceWindows(c, tc)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.RW})
+
+	expected := make([]byte, 16384)
+	actual := make([]byte, 16384)
+	_, err = tc.replicas[0].ReadAt(expected, 0)
+	c.Assert(err, IsNil)
+	_, err = tc.replicas[1].ReadAt(actual, 0)
+	c.Assert(err, IsNil)
+	c.Assert(actual, DeepEquals, expected)
+	c.Assert(tc.replicas[1].RevisionCounter(), Equals, tc.replicas[0].RevisionCounter())
+
+	// The replica is monitored and written again.
+	_, err = ctrl.WriteAt(bytes.Repeat([]byte{4}, 4096), 0)
+	c.Assert(err, IsNil)
+	_, err = tc.replicas[1].ReadAt(actual[:4096], 0)
+	c.Assert(err, IsNil)
+	c.Assert(actual[:4096], DeepEquals, bytes.Repeat([]byte{4}, 4096))
+}
+
+func (s *TestSuite) TestReplicaCannotReconnectAfterSnapshot(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+	defer tc.shutdown()
+	ctrl := tc.ctrl
+	ctrl.SetReplicaReconnectGracePeriod(time.Minute)
+
+	failReplicaUntilCleared(c, tc, 1)
+	_, err := ctrl.WriteAt(make([]byte, 4096), 0)
+	c.Assert(err, IsNil)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.ERR})
+
+	_, err = ctrl.Snapshot("snap", nil, false)
+	c.Assert(err, IsNil)
+
+	tc.injector.Clear()
+	waitForGraceWindows(c, tc)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.ERR})
+}
+
+func (s *TestSuite) TestReplicaCannotReconnectWithoutGracePeriod(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+	defer tc.shutdown()
+
+	failReplicaUntilCleared(c, tc, 1)
+	_, err := tc.ctrl.WriteAt(make([]byte, 4096), 0)
+	c.Assert(err, IsNil)
+	c.Assert(tc.ctrl.graceWindowCount.Load(), Equals, int32(0))
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.ERR})
+}
+
+func (s *TestSuite) TestMergeDirtyRanges(c *C) {
+	merged := mergeDirtyRanges([]dirtyRange{{off: 8192, length: 4096}, {off: 0, length: 4096}, {off: 4096, length: 1024},
+		{off: 12288, length: 512}, {off: 20480, length: 4096}, {off: 9000, length: 100}})
+	c.Assert(merged, DeepEquals, []dirtyRange{{off: 0, length: 5120}, {off: 8192, length: 4608}, {off: 20480, length: 4096}})
+}
+
+func (s *TestSuite) TestReplicaReconnectCopiesWithoutVolumeLocked(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+	defer tc.shutdown()
+	ctrl := tc.ctrl
+	ctrl.SetReplicaReconnectGracePeriod(time.Minute)
+
+	failReplicaUntilCleared(c, tc, 1)
+	_, err := ctrl.WriteAt(make([]byte, 4096), 0)
+	c.Assert(err, IsNil)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.ERR})
+
+	// Every other block is written while the replica is away, so each is copied on its own and slowly.
+	for off := int64(0); off < testVolumeSize; off += 8192 {
+		_, err = ctrl.WriteAt(bytes.Repeat([]byte{byte(off >> 13)}, 4096), off)
+		c.Assert(err, IsNil)
+	}
+	tc.injector.Clear()
+	_, err = tc.injector.AddRule(fault.Rule{Target: tc.faultTarget(1), Op: fault.OpWrite, Action: fault.ActionDelay,
+		Delay: "20ms"})
+	c.Assert(err, IsNil)
+
+	// The volume is written while the replica catches up, without waiting for the copy.
+	var slowest time.Duration
+	for i := 0; tc.ctrl.graceWindowCount.Load() != 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+		start := time.Now()
+		_, err = ctrl.WriteAt(bytes.Repeat([]byte{byte(i)}, 4096), 4096)
+		c.Assert(err, IsNil)
+		slowest = max(slowest, time.Since(start))
+		c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+	}
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.RW})
+	c.Assert(slowest < time.Second, Equals, true, Commentf("a write took %v", slowest))
+
+	expected := make([]byte, testVolumeSize)
+	actual := make([]byte, testVolumeSize)
+	_, err = tc.replicas[0].ReadAt(expected, 0)
+	c.Assert(err, IsNil)
+	_, err = tc.replicas[1].ReadAt(actual, 0)
+	c.Assert(err, IsNil)
+	c.Assert(actual, DeepEquals, expected)
+	c.Assert(tc.replicas[1].RevisionCounter(), Equals, tc.replicas[0].RevisionCounter())
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/mem"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
+)
+
+func waitForExpansion(c *C, ctrl *Controller) {
+	for i := 0; i < 100 && ctrl.IsExpanding(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(ctrl.IsExpanding(), Equals, false)
+}
+
+func (s *TestSuite) TestRevisionCounterMismatchMarksReplicaERR(c *C) {
+	tc := newTestCluster(c, testClusterOptions{}, "a", "b", "c")
+	defer tc.shutdown()
+
+	// Replica c missed the last write.
+	buf := make([]byte, 4096)
+	for i, writes := range []int{2, 2, 1} {
+		for j := 0; j < writes; j++ {
+			_, err := tc.replicas[i].WriteAt(buf, 0)
+			c.Assert(err, IsNil)
+		}
+	}
+	tc.start(c)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.RW, types.RW, types.ERR})
+
+	_, err := tc.ctrl.WriteAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(tc.replicas[0].RevisionCounter(), Equals, int64(3))
+	c.Assert(tc.replicas[1].RevisionCounter(), Equals, int64(3))
+	c.Assert(tc.replicas[2].RevisionCounter(), Equals, int64(1))
+}
+
+func (s *TestSuite) TestSalvagePicksBestReplica(c *C) {
+	tc := newTestCluster(c, testClusterOptions{revisionCounterDisabled: true, salvageRequested: true}, "a", "b", "c")
+	defer tc.shutdown()
+
+	// Replica b has the largest head among the replicas modified recently enough. Replica c has an even larger
+	// head, but it stopped being written long before the others.
+	now := time.Now()
+	for i, r := range []struct {
+		blocks       int
+		lastModified time.Time
+	}{
+		{1, now},
+		{2, now.Add(-time.Second)},
+		{4, now.Add(-time.Minute)},
+	} {
+		for j := 0; j < r.blocks; j++ {
+			_, err := tc.replicas[i].WriteAt(make([]byte, 4096), int64(j)*4096)
+			c.Assert(err, IsNil)
+		}
+		tc.replicas[i].SetLastModifyTime(r.lastModified)
+	}
+	tc.start(c)
+	c.Assert(tc.modes(), DeepEquals, []types.Mode{types.ERR, types.RW, types.ERR})
+}
+
+func (s *TestSuite) TestSnapshotAndReadThroughChain(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+	defer tc.shutdown()
+
+	_, err := tc.ctrl.WriteAt(bytes.Repeat([]byte{1}, 8192), 0)
+	c.Assert(err, IsNil)
+	_, err = tc.ctrl.Snapshot("snap1", nil, false)
+	c.Assert(err, IsNil)
+	_, err = tc.ctrl.WriteAt(bytes.Repeat([]byte{2}, 512), 4096+512)
+	c.Assert(err, IsNil)
+
+	expected := bytes.Repeat([]byte{1}, 8192)
+	copy(expected[4096+512:], bytes.Repeat([]byte{2}, 512))
+	buf := make([]byte, 8192)
+	_, err = tc.ctrl.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(buf, expected), Equals, true)
+
+	for _, r := range tc.replicas {
+		disks := r.Disks()
+		c.Assert(disks, HasLen, 2)
+		c.Assert(disks[0].Name, Equals, diskutil.GenerateSnapshotDiskName("snap1"))
+		c.Assert(disks[0].UserCreated, Equals, true)
+	}
+}
+
+func (s *TestSuite) TestWriteZeroes(c *C) {
+	tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+	defer tc.shutdown()
+
+	_, err := tc.ctrl.WriteAt(bytes.Repeat([]byte{1}, 8192), 0)
+	c.Assert(err, IsNil)
+	n, err := tc.ctrl.WriteZeroesAt(4096, 2048)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4096)
+
+	expected := bytes.Repeat([]byte{1}, 8192)
+	copy(expected[2048:], make([]byte, 4096))
+	for _, r := range tc.replicas {
+		buf := make([]byte, 8192)
+		_, err = r.ReadAt(buf, 0)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(buf, expected), Equals, true)
+	}
+
+	_, err = tc.ctrl.WriteZeroesAt(4096, testVolumeSize-2048)
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestExpansionRollback(c *C) {
+	rollbackSucceeded := types.NewError(types.ErrorCodeFunctionFailedRollbackSucceeded, "injected expansion failure", "")
+	rollbackFailed := fmt.Errorf("injected expansion failure")
+	newSize := int64(2 * testVolumeSize)
+
+	testCases := []struct {
+		name     string
+		failures []error
+		expanded bool
+		modes    []types.Mode
+	}{
+		{"partial failure", []error{nil, rollbackSucceeded}, true, []types.Mode{types.RW, types.ERR}},
+		{"all rolled back", []error{rollbackSucceeded, rollbackSucceeded}, false, []types.Mode{types.RW, types.RW}},
+		{"rollback failure", []error{rollbackSucceeded, rollbackFailed}, false, []types.Mode{types.RW, types.ERR}},
+	}
+	for _, tt := range testCases {
+		comment := Commentf("test case %v", tt.name)
+
+		tc := startTestCluster(c, testClusterOptions{}, "a", "b")
+		for i, err := range tt.failures {
+			if err != nil {
+				tc.replicas[i].FailNext(mem.OpExpand, err)
+			}
+		}
+
+		err := tc.ctrl.Expand(newSize)
+		c.Assert(err, IsNil, comment)
+		waitForExpansion(c, tc.ctrl)
+
+		expansionError, _ := tc.ctrl.GetExpansionErrorInfo()
+		c.Assert(expansionError, Not(Equals), "", comment)
+		c.Assert(tc.modes(), DeepEquals, tt.modes, comment)
+		if tt.expanded {
+			c.Assert(tc.ctrl.Size(), Equals, newSize, comment)
+			c.Assert(tc.frontend.size, Equals, newSize, comment)
+		} else {
+			c.Assert(tc.ctrl.Size(), Equals, int64(testVolumeSize), comment)
+			c.Assert(tc.frontend.size, Equals, int64(testVolumeSize), comment)
+		}
+		tc.shutdown()
+	}
+}
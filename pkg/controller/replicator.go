@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
 )
 
 var (
@@ -133,23 +134,40 @@ func (r *replicator) WriteAt(p []byte, off int64) (int, error) {
 
 	n, err := r.writer.WriteAt(p, off)
 	if err != nil {
-		errors := map[string]error{
-			r.writerIndex[0]: err,
-		}
-		var wbs map[string]int
-		if mErr, ok := err.(*MultiWriterError); ok {
-			errors = map[string]error{}
-			wbs = make(map[string]int, len(mErr.WrittenBytes))
-			for index, err := range mErr.Errors {
-				if err != nil {
-					errors[r.writerIndex[index]] = err
-					wbs[r.writerIndex[index]] = mErr.WrittenBytes[index]
-				}
+		return n, r.writeError(err)
+	}
+	return n, err
+}
+
+func (r *replicator) WriteZeroesAt(length uint32, off int64) (int, error) {
+	if !r.backendsAvailable {
+		return 0, ErrNoBackend
+	}
+
+	n, err := util.WriteZeroesAt(r.writer, length, off)
+	if err != nil {
+		return n, r.writeError(err)
+	}
+	return n, err
+}
+
+// writeError turns the error of a write to all writers into a BackendError telling which backends failed.
+func (r *replicator) writeError(err error) error {
+	errors := map[string]error{
+		r.writerIndex[0]: err,
+	}
+	var wbs map[string]int
+	if mErr, ok := err.(*MultiWriterError); ok {
+		errors = map[string]error{}
+		wbs = make(map[string]int, len(mErr.WrittenBytes))
+		for index, err := range mErr.Errors {
+			if err != nil {
+				errors[r.writerIndex[index]] = err
+				wbs[r.writerIndex[index]] = mErr.WrittenBytes[index]
 			}
 		}
-		return n, &BackendError{Errors: errors, WrittenBytes: wbs}
 	}
-	return n, err
+	return &BackendError{Errors: errors, WrittenBytes: wbs}
 }
 
 func (r *replicator) UnmapAt(length uint32, off int64) (int, error) {
@@ -251,6 +269,38 @@ func (r *replicator) Snapshot(name string, userCreated bool, created string, lab
 	return nil
 }
 
+// Flush flushes the backends that are not ERR, at the same time.
+func (r *replicator) Flush() error {
+	retErrorLock := sync.Mutex{}
+	retError := &BackendError{
+		Errors: map[string]error{},
+	}
+	wg := sync.WaitGroup{}
+
+	for addr, backend := range r.backends {
+		flusher, ok := backend.backend.(types.Flusher)
+		if !ok || backend.mode == types.ERR {
+			continue
+		}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			if err := flusher.Flush(); err != nil {
+				retErrorLock.Lock()
+				retError.Errors[address] = err
+				retErrorLock.Unlock()
+			}
+		}(addr)
+	}
+
+	wg.Wait()
+
+	if len(retError.Errors) != 0 {
+		return retError
+	}
+	return nil
+}
+
 // Expand tries to handle the expansion for all replicas, as well as the rollback result if the rollback is applied.
 // It returns 1 boolean and 2 errors:
 //   - The boolean indicates if the expansion succeeds or not.
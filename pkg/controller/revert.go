@@ -75,6 +75,10 @@ func (c *Controller) Revert(name string) error {
 	c.Lock()
 	defer c.Unlock()
 
+	if frontend := c.namedFrontendUp(); frontend != "" {
+		return fmt.Errorf("volume frontend %v enabled, aborting snapshot revert", frontend)
+	}
+
 	minimalSuccess := false
 	now := util.Now()
 	for address, rClient := range clients {
@@ -91,6 +95,7 @@ func (c *Controller) Revert(name string) error {
 	if !minimalSuccess {
 		return fmt.Errorf("failed to revert to %v on all replicas", name)
 	}
+	c.publishVolumeEvent(&types.Event{Action: types.EventActionSnapshotRevert, Snapshot: name})
 
 	return nil
 }
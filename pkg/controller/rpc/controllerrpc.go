@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/longhorn/longhorn-engine/pkg/controller"
+	"github.com/longhorn/longhorn-engine/pkg/generated/controllerrpc"
+)
+
+// ControllerRPCServer serves controllerrpc.ControllerService. It is registered on the same gRPC server as
+// ControllerServer.
+type ControllerRPCServer struct {
+	controllerrpc.UnimplementedControllerServiceServer
+	c *controller.Controller
+}
+
+func NewControllerRPCServer(c *controller.Controller) *ControllerRPCServer {
+	return &ControllerRPCServer{
+		c: c,
+	}
+}
+
+func (cs *ControllerRPCServer) CaptureStart(ctx context.Context, req *controllerrpc.CaptureStartRequest) (*emptypb.Empty, error) {
+	if req.File == "" {
+		return nil, status.Error(codes.InvalidArgument, "capture file is required")
+	}
+	if err := cs.c.StartCapture(req.File, req.DataHash); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (cs *ControllerRPCServer) CaptureStop(ctx context.Context, req *emptypb.Empty) (*controllerrpc.CaptureStopResponse, error) {
+	file, records, err := cs.c.StopCapture()
+	if err != nil {
+		return nil, err
+	}
+	return &controllerrpc.CaptureStopResponse{
+		File:    file,
+		Records: records,
+	}, nil
+}
+
+func (cs *ControllerRPCServer) FrontendStart(ctx context.Context, req *controllerrpc.FrontendStartRequest) (*emptypb.Empty, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "frontend name is required")
+	}
+	if err := cs.c.StartNamedFrontend(req.Name, req.Frontend, req.ReadOnly); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (cs *ControllerRPCServer) FrontendShutdown(ctx context.Context, req *controllerrpc.FrontendShutdownRequest) (*emptypb.Empty, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "frontend name is required")
+	}
+	if err := cs.c.ShutdownNamedFrontend(req.Name); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (cs *ControllerRPCServer) FrontendList(ctx context.Context, req *emptypb.Empty) (*controllerrpc.FrontendListResponse, error) {
+	resp := &controllerrpc.FrontendListResponse{}
+	for _, f := range cs.c.ListFrontends() {
+		resp.Frontends = append(resp.Frontends, &controllerrpc.Frontend{
+			Name:     f.Name,
+			Frontend: f.Frontend,
+			State:    string(f.State),
+			Endpoint: f.Endpoint,
+			ReadOnly: f.ReadOnly,
+		})
+	}
+	return resp, nil
+}
@@ -16,8 +16,11 @@ import (
 	"github.com/longhorn/types/pkg/generated/profilerrpc"
 
 	"github.com/longhorn/longhorn-engine/pkg/controller"
+	"github.com/longhorn/longhorn-engine/pkg/generated/controllerrpc"
+	"github.com/longhorn/longhorn-engine/pkg/generated/journalrpc"
 	"github.com/longhorn/longhorn-engine/pkg/interceptor"
 	"github.com/longhorn/longhorn-engine/pkg/meta"
+	"github.com/longhorn/longhorn-engine/pkg/opjournal"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 )
 
@@ -48,11 +51,15 @@ func NewControllerHealthCheckServer(cs *ControllerServer) *ControllerHealthCheck
 
 func GetControllerGRPCServer(volumeName, instanceName string, c *controller.Controller) *grpc.Server {
 	cs := NewControllerServer(c)
-	server := grpc.NewServer(interceptor.WithIdentityValidationControllerServerInterceptor(volumeName, instanceName))
+	server := grpc.NewServer(interceptor.WithIdentityValidationControllerServerInterceptor(volumeName, instanceName),
+		interceptor.WithIdentityValidationControllerServerStreamInterceptor(volumeName, instanceName),
+		interceptor.WithTracingServerInterceptor(), interceptor.WithTracingServerStreamInterceptor())
 	enginerpc.RegisterControllerServiceServer(server, cs)
+	controllerrpc.RegisterControllerServiceServer(server, NewControllerRPCServer(c))
 	healthpb.RegisterHealthServer(server, NewControllerHealthCheckServer(cs))
 	reflection.Register(server)
 	profilerrpc.RegisterProfilerServer(server, profiler.NewServer(volumeName))
+	journalrpc.RegisterJournalServiceServer(server, opjournal.NewServer())
 	return server
 }
 
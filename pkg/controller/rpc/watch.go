@@ -0,0 +1,92 @@
+package rpc
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/types/pkg/generated/enginerpc"
+
+	"github.com/longhorn/longhorn-engine/pkg/controller"
+	"github.com/longhorn/longhorn-engine/pkg/generated/controllerrpc"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+func (cs *ControllerRPCServer) Watch(req *controllerrpc.WatchRequest, stream controllerrpc.ControllerService_WatchServer) error {
+	log := logrus.WithField("volume", cs.c.VolumeName)
+
+	backlog, events, cancel, err := cs.c.WatchEvents(req.SinceSeq)
+	if err != nil {
+		if err == controller.ErrEventSeqOutOfRange {
+			return status.Errorf(codes.OutOfRange, "cannot resume watching from sequence number %v: %v", req.SinceSeq, err)
+		}
+		return err
+	}
+	defer cancel()
+
+	wanted := map[string]bool{}
+	for _, t := range req.Types {
+		wanted[t] = true
+	}
+
+	send := func(e *types.Event) error {
+		if len(wanted) != 0 && !wanted[e.Type] {
+			return nil
+		}
+		return stream.Send(eventToControllerFormat(e))
+	}
+
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				log.Warn("Event watcher cannot keep up with the events, stopping it")
+				return status.Error(codes.ResourceExhausted, "event watcher is too slow and has fallen behind")
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func eventToControllerFormat(e *types.Event) *controllerrpc.Event {
+	event := &controllerrpc.Event{
+		Seq:       e.Seq,
+		Type:      e.Type,
+		Action:    e.Action,
+		Timestamp: e.Timestamp.Format(time.RFC3339Nano),
+		Message:   e.Message,
+		Snapshot:  e.Snapshot,
+		Size:      e.Size,
+	}
+	if e.Replica != nil {
+		event.Replica = &enginerpc.ControllerReplica{
+			Address: &enginerpc.ReplicaAddress{
+				Address: e.Replica.Address,
+			},
+			Mode: types.ReplicaModeToGRPCReplicaMode(e.Replica.Mode),
+		}
+	}
+	if e.Frontend != "" {
+		event.Volume = &enginerpc.Volume{
+			Frontend:      e.Frontend,
+			FrontendState: string(e.State),
+			Endpoint:      e.Endpoint,
+		}
+	}
+	if e.Metrics != nil {
+		event.Metrics = types.MetricsToGRPCMetrics(e.Metrics)
+	}
+	return event
+}
@@ -10,6 +10,21 @@ import (
 	"github.com/longhorn/longhorn-engine/pkg/types"
 )
 
+func GetReplicaBackingFile(address, volumeName, instanceName string) (*types.BackingFileInfo, error) {
+	// We may not know the replica instance name. Validation is best effort, so it's fine to pass an empty string.
+	repClient, err := client.NewReplicaClient(address, volumeName, instanceName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get replica client for %v", address)
+	}
+	defer func() {
+		if errClose := repClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close replica client for %v", address)
+		}
+	}()
+
+	return repClient.GetBackingFile()
+}
+
 func GetReplicaDisksAndHead(address, volumeName, instanceName string) (map[string]types.DiskInfo, string, error) {
 	// We may not know the replica instance name. Validation is best effort, so it's fine to pass an empty string.
 	repClient, err := client.NewReplicaClient(address, volumeName, instanceName)
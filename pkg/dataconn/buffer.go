@@ -0,0 +1,54 @@
+package dataconn
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minBufferShift = 12 // 4KiB
+	maxBufferShift = 24 // 16MiB
+)
+
+// bufferPools keeps the payload buffers of messages by size class, each class twice the size of the previous one,
+// so small random I/O does not allocate a buffer per message.
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+func bufferClass(size int) int {
+	if size <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minBufferShift
+}
+
+// getBuffer returns a buffer of length size. If it comes from a pool, it is also returned as the second value, to be
+// given back to putBuffer once the message is done with it.
+func getBuffer(size int) ([]byte, []byte) {
+	class := bufferClass(size)
+	if class >= len(bufferPools) {
+		return make([]byte, size), nil
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*b)[:size], *b
+	}
+	b := make([]byte, 1<<(class+minBufferShift))
+	return b[:size], b
+}
+
+func putBuffer(b []byte) {
+	class := bufferClass(cap(b))
+	if class >= len(bufferPools) || cap(b) != 1<<(class+minBufferShift) {
+		return
+	}
+	b = b[:cap(b)]
+	bufferPools[class].Put(&b)
+}
+
+// release gives the pooled payload buffer of the message back. The data of the message must not be used after.
+func (m *Message) release() {
+	if m.buffer != nil {
+		putBuffer(m.buffer)
+		m.buffer = nil
+		m.Data = nil
+	}
+}
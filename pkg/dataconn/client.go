@@ -1,56 +1,127 @@
 package dataconn
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	journal "github.com/longhorn/sparse-tools/stats"
 
+	"github.com/longhorn/longhorn-engine/pkg/tracing"
 	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
 )
 
 var (
 	//ErrRWTimeout r/w operation timeout
 	ErrRWTimeout = errors.New("r/w timeout")
+	//ErrClientClosed the client is closed before the request completes
+	ErrClientClosed = errors.New("data connection client is closed")
 )
 
-// Client replica client
+// cancelledResponseTimeout is how long the response to a cancelled request is waited for, to drop it quietly.
+const cancelledResponseTimeout = time.Minute
+
+// Client replica client. Requests are spread over several connections by their load and latency. A failed or
+// stalled connection is replaced. Its reads are sent again on the other connections, and its writes fail.
 type Client struct {
-	end            chan struct{}
-	requests       chan *Message
-	send           chan *Message
-	responses      chan *Message
-	seq            uint32
-	messages       map[uint32]*Message
-	wires          []*Wire
-	peerAddr       string
-	sharedTimeouts types.SharedTimeouts
+	end               chan struct{}
+	done              chan struct{}
+	requests          chan *Message
+	responses         chan *Message
+	cancels           chan *Message
+	dials             chan dialResult
+	seq               uint32
+	messages          map[uint32]*Message
+	peerAddr          string
+	sharedTimeouts    types.SharedTimeouts
+	version           uint16
+	features          uint32
+	requestedFeatures uint32
+	opts              ClientOptions
+	closing           atomic.Bool
+
+	// connsLock guards conns for Close, only the loop changes them
+	connsLock sync.Mutex
+	conns     []*clientConn
+	// backlog holds the requests no connection can take yet, in order
+	backlog []*Message
+	// inflight is the number of requests sent on the connections, peakInflight its maximum since the last tick
+	inflight     int
+	peakInflight int
+	// ioInflight is the number of I/O requests taken by the loop and not replied to yet, for the r/w timeout
+	ioInflight   int
+	dialing      int
+	dialFailures int
+	idleTicks    int
 }
 
-// NewClient replica client
-func NewClient(conns []net.Conn, sharedTimeouts types.SharedTimeouts) *Client {
+// NewClient replica client. The protocol of every connection is negotiated with the server first, asking for the
+// given features. See the handshake in handshake.go.
+func NewClient(conns []net.Conn, sharedTimeouts types.SharedTimeouts, features uint32, opts ClientOptions) (*Client, error) {
 	var wires []*Wire
-	for _, conn := range conns {
-		wires = append(wires, NewWire(conn))
+	var version uint16
+	var negotiated uint32
+	for i, conn := range conns {
+		wire := NewWire(conn)
+		v, f, err := handshake(wire, features)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to negotiate the protocol with %v", conn.RemoteAddr())
+		}
+		if i > 0 && (v != version || f != negotiated) {
+			return nil, fmt.Errorf("connections to %v negotiated different protocols", conn.RemoteAddr())
+		}
+		if f&FeatureFence != 0 && opts.Fence.ID != "" {
+			if err := sendFence(wire, opts.Fence); err != nil {
+				return nil, errors.Wrapf(err, "failed to fence the previous connections to %v", conn.RemoteAddr())
+			}
+		}
+		version, negotiated = v, f
+		wires = append(wires, wire)
+	}
+	logrus.Infof("Negotiated protocol version %v features 0x%x with %v", version, negotiated, conns[0].RemoteAddr())
+
+	if opts.MinConnections <= 0 {
+		opts.MinConnections = len(conns)
+	}
+	opts.MaxConnections = max(opts.MaxConnections, opts.MinConnections, len(conns))
+	if opts.StallTimeout <= 0 {
+		opts.StallTimeout = DefaultStallTimeout
 	}
+
 	c := &Client{
-		wires:          wires,
-		peerAddr:       conns[0].RemoteAddr().String(),
-		end:            make(chan struct{}, 1024),
-		requests:       make(chan *Message, 1024),
-		send:           make(chan *Message, 1024),
-		responses:      make(chan *Message, 1024),
-		messages:       map[uint32]*Message{},
-		sharedTimeouts: sharedTimeouts,
+		version:           version,
+		features:          negotiated,
+		requestedFeatures: features,
+		opts:              opts,
+		peerAddr:          conns[0].RemoteAddr().String(),
+		end:               make(chan struct{}, 1024),
+		done:              make(chan struct{}),
+		requests:          make(chan *Message, 1024),
+		responses:         make(chan *Message, 1024),
+		cancels:           make(chan *Message, 1024),
+		dials:             make(chan dialResult, 16),
+		messages:          map[uint32]*Message{},
+		sharedTimeouts:    sharedTimeouts,
+	}
+	for _, wire := range wires {
+		c.addConn(wire)
 	}
 	go c.loop()
-	c.write()
-	c.read()
-	return c
+	return c, nil
+}
+
+// Features returns the features negotiated with the server.
+func (c *Client) Features() uint32 {
+	return c.features
 }
 
 // TargetID operation target ID
@@ -60,12 +131,38 @@ func (c *Client) TargetID() string {
 
 // WriteAt replica client
 func (c *Client) WriteAt(buf []byte, offset int64) (int, error) {
-	return c.operation(TypeWrite, buf, uint32(len(buf)), offset)
+	return c.operation(context.Background(), TypeWrite, buf, uint32(len(buf)), offset, nil)
+}
+
+// WriteAtContext writes like WriteAt, unless ctx is done first. Then the request is cancelled and ctx.Err() is
+// returned, but the data may or may not be written. The deadline of ctx is sent along, so the server skips the
+// request if it expires before the write starts.
+func (c *Client) WriteAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	if ctx.Done() != nil {
+		// The request can outlive the call, so buf may be reused while it is still being sent.
+		buf = append([]byte(nil), buf...)
+	}
+	return c.operation(ctx, TypeWrite, buf, uint32(len(buf)), offset, nil)
+}
+
+// WriteExtents writes the extents in one request. buf holds the data of the extents one after another. The
+// extents are written in order, and the first failure fails the request.
+func (c *Client) WriteExtents(buf []byte, extents []Extent) (int, error) {
+	return c.batchOperation(TypeWriteBatch, buf, extents)
 }
 
 // UnmapAt replica client
 func (c *Client) UnmapAt(length uint32, offset int64) (int, error) {
-	return c.operation(TypeUnmap, nil, length, offset)
+	return c.operation(context.Background(), TypeUnmap, nil, length, offset, nil)
+}
+
+// WriteZeroesAt zeroes length bytes at offset without sending the zeros, if the server supports it. Otherwise it
+// writes a buffer of zeros.
+func (c *Client) WriteZeroesAt(length uint32, offset int64) (int, error) {
+	if c.features&FeatureWriteZeroes == 0 {
+		return util.WriteZeroBufferAt(c, length, offset)
+	}
+	return c.operation(context.Background(), TypeWriteZeroes, nil, length, offset, nil)
 }
 
 // SetError replica client transport error
@@ -77,33 +174,121 @@ func (c *Client) SetError(err error) {
 
 // ReadAt replica client
 func (c *Client) ReadAt(buf []byte, offset int64) (int, error) {
-	return c.operation(TypeRead, buf, uint32(len(buf)), offset)
+	return c.operation(context.Background(), TypeRead, buf, uint32(len(buf)), offset, nil)
+}
+
+// ReadAtContext reads like ReadAt, unless ctx is done first. Then the request is cancelled and ctx.Err() is
+// returned. The deadline of ctx is sent along, so the server skips the request if it expires before the read starts.
+func (c *Client) ReadAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	return c.operation(ctx, TypeRead, buf, uint32(len(buf)), offset, nil)
+}
+
+// ReadExtents reads the extents in one request into buf, one after another. If the end of the volume is reached,
+// the data read so far is returned with io.EOF.
+func (c *Client) ReadExtents(buf []byte, extents []Extent) (int, error) {
+	return c.batchOperation(TypeReadBatch, buf, extents)
 }
 
 // Ping replica client
 func (c *Client) Ping() error {
-	_, err := c.operation(TypePing, nil, 0, 0)
+	_, err := c.operation(context.Background(), TypePing, nil, 0, 0, nil)
 	return err
 }
 
-func (c *Client) operation(op uint32, buf []byte, length uint32, offset int64) (int, error) {
+// Flush makes the data written so far durable on the server.
+func (c *Client) Flush() error {
+	if c.features&FeatureFlush == 0 {
+		return fmt.Errorf("server %v does not support flush", c.peerAddr)
+	}
+	_, err := c.operation(context.Background(), TypeFlush, nil, 0, 0, nil)
+	return err
+}
+
+func (c *Client) batchOperation(op uint32, buf []byte, extents []Extent) (int, error) {
+	if c.features&FeatureBatch == 0 {
+		return 0, fmt.Errorf("server %v does not support batched requests", c.peerAddr)
+	}
+	if len(extents) == 0 || len(extents) > MaxBatchExtents {
+		return 0, fmt.Errorf("invalid extent count %v, the maximum is %v", len(extents), MaxBatchExtents)
+	}
+	var length uint64
+	for _, extent := range extents {
+		length += uint64(extent.Length)
+	}
+	if length != uint64(len(buf)) {
+		return 0, fmt.Errorf("extents add up to %v bytes but the buffer has %v bytes", length, len(buf))
+	}
+	return c.operation(context.Background(), op, buf, uint32(length), extents[0].Offset, extents)
+}
+
+func (c *Client) operation(ctx context.Context, op uint32, buf []byte, length uint32, offset int64, extents []Extent) (n int, err error) {
+	if (op == TypeRead || op == TypeWrite || isBatch(op)) && length > MaxFrameDataSize {
+		return 0, fmt.Errorf("request of %v bytes is larger than the maximum %v", length, MaxFrameDataSize)
+	}
+	if op != TypePing && tracing.SampleDataconn() {
+		_, span := tracing.StartSpan(ctx, "dataconn.Client/"+opName(op),
+			attribute.String("server.address", c.peerAddr), attribute.Int64("offset", offset), attribute.Int64("length", int64(length)))
+		defer func() {
+			tracing.EndSpan(span, err)
+		}()
+	}
+
 	msg := Message{
 		Complete: make(chan struct{}, 1),
 		Type:     op,
 		Offset:   offset,
 		Size:     length,
 		Data:     nil,
+		Extents:  extents,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Deadline = deadline
 	}
 
-	if op == TypeWrite {
+	if op == TypeWrite || op == TypeWriteBatch {
 		msg.Data = buf
 	}
+	if op != TypePing {
+		msg.journalOp = opsJournal.begin(JournalSideClient, c.peerAddr, &msg)
+	}
 
-	c.requests <- &msg
+	// The loop stops taking requests and completing them once the client is closed.
+	select {
+	case c.requests <- &msg:
+	case <-c.done:
+		opsJournal.end(msg.journalOp, true)
+		return 0, ErrClientClosed
+	}
 
-	<-msg.Complete
+	select {
+	case <-msg.Complete:
+	case <-ctx.Done():
+		msg.cancelErr = ctx.Err()
+		select {
+		case c.cancels <- &msg:
+		case <-c.done:
+			opsJournal.end(msg.journalOp, true)
+			return 0, ErrClientClosed
+		}
+		select {
+		case <-msg.Complete:
+		case <-c.done:
+			opsJournal.end(msg.journalOp, true)
+			return 0, ErrClientClosed
+		}
+	case <-c.done:
+		opsJournal.end(msg.journalOp, true)
+		return 0, ErrClientClosed
+	}
+	defer msg.release()
+	if msg.failErr != nil {
+		return 0, msg.failErr
+	}
+	if msg.cancelled.Load() {
+		return 0, msg.cancelErr
+	}
 	// Only copy the message if a read is requested
-	if op == TypeRead && (msg.Type == TypeResponse || msg.Type == TypeEOF) {
+	if (op == TypeRead || op == TypeReadBatch) && (msg.Type == TypeResponse || msg.Type == TypeEOF) {
 		copy(buf, msg.Data)
 	}
 	if msg.Type == TypeError {
@@ -121,24 +306,34 @@ func (c *Client) Close() {
 		"peerAddr": c.peerAddr,
 	})
 
-	for _, wire := range c.wires {
-		if errClose := wire.Close(); errClose != nil {
+	c.closing.Store(true)
+	c.connsLock.Lock()
+	for _, cc := range c.conns {
+		if errClose := cc.wire.Close(); errClose != nil {
 			log.WithError(errClose).Error("Failed to close wire")
 		}
 	}
+	c.connsLock.Unlock()
 
 	log.Info("Closing data connection client")
 	c.end <- struct{}{}
 }
 
 func (c *Client) loop() {
-	defer close(c.send)
+	defer func() {
+		close(c.done)
+		for _, cc := range append([]*clientConn(nil), c.conns...) {
+			c.removeConn(cc)
+		}
+	}()
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
 	var clientError error
-	var ioInflight int
 	var timeOfLastActivity time.Time
+	// cancelled keeps the sequence numbers of the requests cancelled while in flight, so their responses are dropped
+	// quietly
+	cancelled := map[uint32]time.Time{}
 
 	log := logrus.WithFields(logrus.Fields{
 		"peerAddr": c.peerAddr,
@@ -160,10 +355,12 @@ func (c *Client) loop() {
 	handleClientError := func(err error) {
 		clientError = err
 		for _, msg := range c.messages {
+			c.untrack(msg)
 			c.replyError(msg, err)
 		}
+		c.backlog = nil
 
-		ioInflight = 0
+		c.ioInflight = 0
 		timeOfLastActivity = time.Time{}
 	}
 
@@ -173,7 +370,18 @@ func (c *Client) loop() {
 			log.Info("Data connection client loop ended")
 			return
 		case <-ticker.C:
-			if timeOfLastActivity.IsZero() || ioInflight == 0 {
+			for seq, at := range cancelled {
+				if time.Since(at) > cancelledResponseTimeout {
+					delete(cancelled, seq)
+				}
+			}
+			if clientError == nil {
+				if err := c.checkConns(time.Now()); err != nil {
+					handleClientError(err)
+				}
+			}
+
+			if timeOfLastActivity.IsZero() || c.ioInflight == 0 {
 				continue
 			}
 
@@ -185,34 +393,101 @@ func (c *Client) loop() {
 				journal.PrintLimited(1000)
 			}
 		case req := <-c.requests:
+			if req.cancelled.Load() {
+				// Cancelled before it was even handled.
+				c.replyCancelled(req)
+				continue
+			}
 			if clientError != nil {
 				c.replyError(req, clientError)
 				continue
 			}
 
-			if req.Type == TypeRead || req.Type == TypeWrite || req.Type == TypeUnmap {
-				if ioInflight == 0 {
+			if isIO(req.Type) {
+				if c.ioInflight == 0 {
 					// If nothing is in-flight, we should get a fresh timeout.
 					timeOfLastActivity = time.Now()
 				}
-				ioInflight++
+				c.ioInflight++
 			}
 
 			c.handleRequest(req)
+		case req := <-c.cancels:
+			if req.Seq == 0 {
+				// The request is still queued, it is replied to once handled.
+				req.cancelled.Store(true)
+				continue
+			}
+			if _, pending := c.messages[req.Seq]; !pending {
+				// Completed already.
+				continue
+			}
+			if isIO(req.Type) {
+				c.ioInflight--
+				timeOfLastActivity = time.Now()
+			}
+			// The writer of the request checks whether it is cancelled after taking it, so either it skips the
+			// request or the cancel follows it on the same connection. A cancel is best effort, so it is dropped if
+			// the connection is backed up.
+			req.cancelled.Store(true)
+			if cc := req.conn; cc != nil && c.features&FeatureDeadline != 0 {
+				select {
+				case cc.cancels <- &Message{
+					MagicVersion: MagicVersion,
+					Seq:          req.Seq,
+					Type:         TypeCancel,
+				}:
+				default:
+				}
+			}
+			c.untrack(req)
+			cancelled[req.Seq] = time.Now()
+			c.replyCancelled(req)
+		case r := <-c.dials:
+			if clientError != nil {
+				c.dialing--
+				if r.wire != nil {
+					_ = r.wire.Close()
+				}
+				continue
+			}
+			if err := c.dialed(r); err != nil {
+				handleClientError(err)
+			}
 		case resp := <-c.responses:
 			if resp.transportErr != nil {
-				handleClientError(resp.transportErr)
+				if resp.conn == nil {
+					handleClientError(resp.transportErr)
+					continue
+				}
+				if clientError != nil || c.closing.Load() {
+					continue
+				}
+				if err := c.dropConn(resp.conn, resp.transportErr); err != nil {
+					handleClientError(err)
+				}
 				continue
 			}
 
 			req, pending := c.messages[resp.Seq]
 			if !pending {
+				if _, ok := cancelled[resp.Seq]; ok {
+					delete(cancelled, resp.Seq)
+					resp.release()
+					continue
+				}
 				log.Warnf("Received response message id %v seq %v type %v for non pending request", resp.ID, resp.Seq, resp.Type)
 				continue
 			}
+			if req.conn != resp.conn {
+				// Answered on a dropped connection after the request was sent again.
+				resp.release()
+				continue
+			}
+			c.answered(req, resp)
 
-			if req.Type == TypeRead || req.Type == TypeWrite || req.Type == TypeUnmap {
-				ioInflight--
+			if isIO(req.Type) {
+				c.ioInflight--
 				timeOfLastActivity = time.Now()
 			}
 
@@ -223,6 +498,8 @@ func (c *Client) loop() {
 
 			c.handleResponse(resp)
 		}
+		// Connections may have come up or freed up meanwhile.
+		c.drainBacklog()
 	}
 }
 
@@ -239,28 +516,66 @@ func (c *Client) replyError(req *Message, err error) {
 		}).Warn("Error removing pending operation")
 	}
 	delete(c.messages, req.Seq)
+	opsJournal.end(req.journalOp, true)
 	req.Type = TypeError
 	req.Data = []byte(err.Error())
 	req.Complete <- struct{}{}
 }
 
+// replyFailed fails a request sent on a dropped connection. Like replyCancelled, it leaves the type and data of the
+// request alone, as the writer of the connection may still be sending it.
+func (c *Client) replyFailed(req *Message, err error) {
+	if opErr := journal.RemovePendingOp(req.ID, false); opErr != nil {
+		logrus.WithError(opErr).WithFields(logrus.Fields{
+			"seq": req.Seq,
+			"id":  req.ID,
+		}).Warn("Error removing pending operation")
+	}
+	delete(c.messages, req.Seq)
+	opsJournal.end(req.journalOp, true)
+	req.failErr = err
+	req.Complete <- struct{}{}
+}
+
+// replyCancelled completes a request the caller gave up on. The type and data of the request are left alone, as a
+// writer may still be sending it.
+func (c *Client) replyCancelled(req *Message) {
+	if req.Seq != 0 {
+		if opErr := journal.RemovePendingOp(req.ID, false); opErr != nil {
+			logrus.WithError(opErr).WithFields(logrus.Fields{
+				"seq": req.Seq,
+				"id":  req.ID,
+			}).Warn("Error removing pending operation")
+		}
+	}
+	delete(c.messages, req.Seq)
+	opsJournal.end(req.journalOp, true)
+	req.cancelled.Store(true)
+	req.Complete <- struct{}{}
+}
+
 func (c *Client) handleRequest(req *Message) {
 	seq := c.nextSeq()
 	switch req.Type {
-	case TypeRead:
+	case TypeRead, TypeReadBatch:
 		req.ID = journal.InsertPendingOp(time.Now(), c.TargetID(), seq, journal.OpRead, int(req.Offset), int(req.Size))
-	case TypeWrite:
+	case TypeWrite, TypeWriteBatch:
 		req.ID = journal.InsertPendingOp(time.Now(), c.TargetID(), seq, journal.OpWrite, int(req.Offset), int(req.Size))
 	case TypeUnmap:
 		req.ID = journal.InsertPendingOp(time.Now(), c.TargetID(), seq, journal.OpUnmap, int(req.Offset), int(req.Size))
+	case TypeWriteZeroes:
+		req.ID = journal.InsertPendingOp(time.Now(), c.TargetID(), seq, journal.OpWrite, int(req.Offset), int(req.Size))
 	case TypePing:
 		req.ID = journal.InsertPendingOp(time.Now(), c.TargetID(), seq, journal.OpPing, 0, 0)
+	case TypeFlush:
+		req.ID = journal.InsertPendingOp(time.Now(), c.TargetID(), seq, journal.OpWrite, 0, 0)
 	}
 
 	req.MagicVersion = MagicVersion
 	req.Seq = seq
+	opsJournal.assigned(req.journalOp, seq)
 	c.messages[req.Seq] = req
-	c.send <- req
+	c.dispatch(req)
 }
 
 func (c *Client) handleResponse(resp *Message) {
@@ -273,41 +588,12 @@ func (c *Client) handleResponse(resp *Message) {
 			}).Warn("Error removing pending operation")
 		}
 		delete(c.messages, resp.Seq)
+		opsJournal.processed(req.journalOp, resp.received)
+		opsJournal.end(req.journalOp, resp.Type != TypeResponse && resp.Type != TypeEOF)
 		req.Type = resp.Type
 		req.Size = resp.Size
 		req.Data = resp.Data
+		req.buffer = resp.buffer
 		req.Complete <- struct{}{}
 	}
 }
-
-func (c *Client) write() {
-	for _, wire := range c.wires {
-		go func(w *Wire) {
-			for msg := range c.send {
-				if err := w.Write(msg); err != nil {
-					c.responses <- &Message{
-						transportErr: err,
-					}
-				}
-			}
-		}(wire)
-	}
-}
-
-func (c *Client) read() {
-	for _, wire := range c.wires {
-		go func(w *Wire) {
-			for {
-				msg, err := w.Read()
-				if err != nil {
-					logrus.WithError(err).Errorf("Error reading from wire %v", c.peerAddr)
-					c.responses <- &Message{
-						transportErr: err,
-					}
-					break
-				}
-				c.responses <- msg
-			}
-		}(wire)
-	}
-}
@@ -0,0 +1,431 @@
+package dataconn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStallTimeout is how long a connection may go without a response to its requests while the other
+	// connections of the client get responses, before it is given up.
+	DefaultStallTimeout = 4 * time.Second
+
+	// maxReconnectAttempts is how many times in a row the client tries to connect again once it has no connection
+	// left, before it fails
+	maxReconnectAttempts = 3
+	reconnectBackoff     = 100 * time.Millisecond
+
+	// A connection is added when the busiest moment since the last tick had more than connGrowInflight requests
+	// in flight per connection, and one is closed after connShrinkTicks ticks in a row below connShrinkInflight.
+	connGrowInflight   = 16
+	connShrinkInflight = 2
+	connShrinkTicks    = 30
+
+	// connLatencyFloor keeps connections without a latency sample yet from looking infinitely fast
+	connLatencyFloor = 100 * time.Microsecond
+)
+
+// ClientOptions are the optional settings of a client.
+type ClientOptions struct {
+	// Dial opens a new connection to the server. Without it, the client only has the connections it is created
+	// with, and a failed connection is not replaced.
+	Dial func() (net.Conn, error)
+	// MinConnections and MaxConnections bound the number of connections. With Dial, the client opens connections
+	// while requests pile up on the ones it has and closes them again once it is idle. Both default to the number
+	// of connections the client is created with.
+	MinConnections int
+	MaxConnections int
+	// StallTimeout defaults to DefaultStallTimeout.
+	StallTimeout time.Duration
+	// Fence is sent on every connection if the server supports FeatureFence, so the connections of the previous
+	// clients with the same fence ID and an older epoch change no more data. See fence.go.
+	Fence Fence
+}
+
+// clientConn is one connection of a client, with a writer and a reader goroutine. The fields below the channels
+// are only used by the client loop.
+type clientConn struct {
+	wire    *Wire
+	send    chan *Message
+	cancels chan *Message
+
+	// inflight is the number of requests sent on the connection and not answered yet
+	inflight int
+	// latency is a moving average of the response time
+	latency time.Duration
+	// lastProgress is when the connection last got a response, or went from idle to busy
+	lastProgress time.Time
+	lastResponse time.Time
+	// draining connections get no more requests and are closed once idle
+	draining bool
+	closed   bool
+}
+
+type dialResult struct {
+	wire *Wire
+	err  error
+}
+
+func (c *Client) addConn(wire *Wire) {
+	cc := &clientConn{
+		wire:         wire,
+		send:         make(chan *Message, 1024),
+		cancels:      make(chan *Message, 1024),
+		lastResponse: time.Now(),
+	}
+	c.connsLock.Lock()
+	c.conns = append(c.conns, cc)
+	c.connsLock.Unlock()
+	go c.write(cc)
+	go c.read(cc)
+}
+
+func (c *Client) removeConn(cc *clientConn) {
+	if cc.closed {
+		return
+	}
+	cc.closed = true
+	c.connsLock.Lock()
+	for i := range c.conns {
+		if c.conns[i] == cc {
+			c.conns = append(c.conns[:i], c.conns[i+1:]...)
+			break
+		}
+	}
+	c.connsLock.Unlock()
+	close(cc.send)
+	_ = cc.wire.Close()
+}
+
+// dropConn closes a failed connection. Its reads, flushes and pings are sent again on the other connections, as
+// sending them twice is harmless. Its writes, unmaps and write zeroes fail instead: the server may still apply them
+// after newer writes to the same blocks went through the other connections, and each of them counts in the revision
+// counter of the replica. Failing them lets the controller mark the replica ERR. An error is returned if the client
+// cannot go on.
+func (c *Client) dropConn(cc *clientConn, err error) error {
+	if cc.closed {
+		return nil
+	}
+	logrus.WithError(err).Warnf("Dropping a data connection to %v with %v requests in flight", c.peerAddr, cc.inflight)
+	c.removeConn(cc)
+
+	var requeue []*Message
+	var failed []*Message
+	for _, req := range c.messages {
+		if req.conn != cc {
+			continue
+		}
+		if isIdempotent(req.Type) {
+			requeue = append(requeue, req)
+		} else {
+			failed = append(failed, req)
+		}
+	}
+	sort.Slice(requeue, func(i, j int) bool {
+		return requeue[i].Seq < requeue[j].Seq
+	})
+	for _, req := range requeue {
+		c.untrack(req)
+	}
+	c.backlog = append(requeue, c.backlog...)
+	for _, req := range failed {
+		c.untrack(req)
+		c.ioInflight--
+		c.replyFailed(req, errors.Wrapf(err, "data connection to %v dropped with %v in flight", c.peerAddr, opName(req.Type)))
+	}
+
+	if c.opts.Dial == nil {
+		if len(c.conns) == 0 {
+			return err
+		}
+		return nil
+	}
+	if len(c.conns) == 0 || len(c.conns)+c.dialing < c.opts.MinConnections {
+		c.startDial(0)
+	}
+	return nil
+}
+
+// dialed handles the result of a connection attempt. An error is returned if the client cannot go on.
+func (c *Client) dialed(r dialResult) error {
+	c.dialing--
+	if r.err == nil {
+		c.dialFailures = 0
+		c.addConn(r.wire)
+		return nil
+	}
+
+	c.dialFailures++
+	logrus.WithError(r.err).Warnf("Failed to open a data connection to %v", c.peerAddr)
+	if len(c.conns) > 0 || c.dialing > 0 {
+		return nil
+	}
+	if c.dialFailures >= maxReconnectAttempts {
+		return errors.Wrapf(r.err, "failed to reconnect to %v %v times", c.peerAddr, c.dialFailures)
+	}
+	c.startDial(reconnectBackoff << (c.dialFailures - 1))
+	return nil
+}
+
+func (c *Client) startDial(delay time.Duration) {
+	c.dialing++
+	go func() {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-c.done:
+				return
+			}
+		}
+		wire, err := c.dial()
+		select {
+		case c.dials <- dialResult{wire: wire, err: err}:
+		case <-c.done:
+			if wire != nil {
+				_ = wire.Close()
+			}
+		}
+	}()
+}
+
+func (c *Client) dial() (*Wire, error) {
+	conn, err := c.opts.Dial()
+	if err != nil {
+		return nil, err
+	}
+	wire := NewWire(conn)
+	version, features, err := handshake(wire, c.requestedFeatures)
+	if err != nil {
+		_ = wire.Close()
+		return nil, errors.Wrapf(err, "failed to negotiate the protocol with %v", conn.RemoteAddr())
+	}
+	if version != c.version || features != c.features {
+		_ = wire.Close()
+		return nil, fmt.Errorf("connection to %v negotiated protocol version %v features 0x%x instead of version %v features 0x%x",
+			conn.RemoteAddr(), version, features, c.version, c.features)
+	}
+	if features&FeatureFence != 0 && c.opts.Fence.ID != "" {
+		if err := sendFence(wire, c.opts.Fence); err != nil {
+			_ = wire.Close()
+			return nil, errors.Wrapf(err, "failed to fence the previous connections to %v", conn.RemoteAddr())
+		}
+	}
+	return wire, nil
+}
+
+// pickConn returns the connection a request is best sent on, or nil if none can take it now. The expected wait
+// grows with the requests in flight and the latency of a connection.
+func (c *Client) pickConn() *clientConn {
+	var best *clientConn
+	var bestScore float64
+	for _, cc := range c.conns {
+		if cc.draining || len(cc.send) == cap(cc.send) {
+			continue
+		}
+		score := float64(cc.inflight+1) * float64(cc.latency+connLatencyFloor)
+		if best == nil || score < bestScore {
+			best, bestScore = cc, score
+		}
+	}
+	return best
+}
+
+// dispatch sends a request on a connection, or keeps it in the backlog until one can take it.
+func (c *Client) dispatch(req *Message) {
+	c.backlog = append(c.backlog, req)
+	c.drainBacklog()
+}
+
+func (c *Client) drainBacklog() {
+	for len(c.backlog) > 0 {
+		req := c.backlog[0]
+		if c.messages[req.Seq] != req {
+			// Cancelled or failed meanwhile.
+			c.backlog = c.backlog[1:]
+			continue
+		}
+		cc := c.pickConn()
+		if cc == nil {
+			return
+		}
+		c.backlog = c.backlog[1:]
+
+		now := time.Now()
+		req.conn = cc
+		req.dispatched = now
+		cc.inflight++
+		if cc.inflight == 1 {
+			cc.lastProgress = now
+		}
+		c.inflight++
+		c.peakInflight = max(c.peakInflight, c.inflight)
+		cc.send <- req
+	}
+}
+
+// untrack takes a request off the books of its connection, once it is answered, cancelled or sent again.
+func (c *Client) untrack(req *Message) {
+	cc := req.conn
+	if cc == nil {
+		return
+	}
+	req.conn = nil
+	cc.inflight--
+	c.inflight--
+	if cc.draining && cc.inflight == 0 {
+		c.removeConn(cc)
+	}
+}
+
+// answered updates the health of the connection a request is answered on.
+func (c *Client) answered(req, resp *Message) {
+	cc := req.conn
+	cc.lastProgress = resp.received
+	cc.lastResponse = resp.received
+	sample := resp.received.Sub(req.dispatched)
+	if cc.latency == 0 {
+		cc.latency = sample
+	} else {
+		cc.latency += (sample - cc.latency) / 8
+	}
+	c.untrack(req)
+}
+
+// checkConns drops stalled connections and adjusts the number of connections to the load. It runs on every tick
+// of the client loop. An error is returned if the client cannot go on.
+func (c *Client) checkConns(now time.Time) error {
+	for _, cc := range append([]*clientConn(nil), c.conns...) {
+		if cc.inflight == 0 {
+			// Let an idle connection recover from a slow spell.
+			cc.latency -= cc.latency / 8
+			continue
+		}
+		if now.Sub(cc.lastProgress) <= c.opts.StallTimeout || !c.progressedElsewhere(cc, now) {
+			continue
+		}
+		if err := c.dropConn(cc, fmt.Errorf("no response in %v", now.Sub(cc.lastProgress))); err != nil {
+			return err
+		}
+	}
+
+	load := c.peakInflight + len(c.backlog)
+	c.peakInflight = c.inflight
+	if c.opts.Dial == nil || len(c.conns) == 0 {
+		return nil
+	}
+
+	var active []*clientConn
+	for _, cc := range c.conns {
+		if !cc.draining {
+			active = append(active, cc)
+		}
+	}
+	count := len(active) + c.dialing
+	switch {
+	case count < c.opts.MinConnections:
+		c.idleTicks = 0
+		c.startDial(0)
+	case load > connGrowInflight*len(active) && count < c.opts.MaxConnections:
+		c.idleTicks = 0
+		c.startDial(0)
+	case load < connShrinkInflight*len(active) && len(active) > c.opts.MinConnections:
+		c.idleTicks++
+		if c.idleTicks >= connShrinkTicks {
+			c.idleTicks = 0
+			cc := active[len(active)-1]
+			cc.draining = true
+			if cc.inflight == 0 {
+				c.removeConn(cc)
+			}
+		}
+	default:
+		c.idleTicks = 0
+	}
+	return nil
+}
+
+func (c *Client) progressedElsewhere(stalled *clientConn, now time.Time) bool {
+	for _, cc := range c.conns {
+		if cc != stalled && now.Sub(cc.lastResponse) <= c.opts.StallTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) write(cc *clientConn) {
+	// Requests are flushed once no more are queued, so a burst of requests shares syscalls while a lone request is
+	// sent right away.
+	var unflushed []*Message
+	failed := false
+	fail := func(err error) {
+		failed = true
+		c.responses <- &Message{
+			conn:         cc,
+			transportErr: err,
+		}
+	}
+	for {
+		var msg *Message
+		select {
+		case m, ok := <-cc.send:
+			if !ok {
+				return
+			}
+			if !m.cancelled.Load() {
+				msg = m
+			}
+		case msg = <-cc.cancels:
+		}
+		if failed {
+			// Drain the connection until the loop closes it, its requests are sent again elsewhere.
+			continue
+		}
+		if msg != nil {
+			if err := cc.wire.Write(msg); err != nil {
+				fail(err)
+				continue
+			}
+			unflushed = append(unflushed, msg)
+		}
+		if len(unflushed) == 0 || len(cc.send) > 0 || len(cc.cancels) > 0 {
+			continue
+		}
+		if err := cc.wire.Flush(); err != nil {
+			fail(err)
+			continue
+		}
+		for _, msg := range unflushed {
+			opsJournal.dispatched(msg.journalOp)
+		}
+		unflushed = unflushed[:0]
+	}
+}
+
+func (c *Client) read(cc *clientConn) {
+	for {
+		msg, err := cc.wire.Read()
+		if err != nil {
+			if !c.closing.Load() {
+				logrus.WithError(err).Errorf("Error reading from wire %v", c.peerAddr)
+			}
+			if errors.Is(err, ErrChecksumMismatch) {
+				// Nothing read from the connection can be trusted anymore.
+				_ = cc.wire.Close()
+			}
+			c.responses <- &Message{
+				conn:         cc,
+				transportErr: err,
+			}
+			return
+		}
+		msg.received = time.Now()
+		msg.conn = cc
+		c.responses <- msg
+	}
+}
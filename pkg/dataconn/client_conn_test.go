@@ -0,0 +1,157 @@
+package dataconn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+// stallConn stops handing what it reads to the client once stalled is set, like a connection whose responses are
+// lost, while what the client writes still reaches the server.
+type stallConn struct {
+	net.Conn
+	stalled   atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStallConn(conn net.Conn) *stallConn {
+	return &stallConn{Conn: conn, closed: make(chan struct{})}
+}
+
+func (s *stallConn) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+	if s.stalled.Load() {
+		<-s.closed
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (s *stallConn) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return s.Conn.Close()
+}
+
+func (s *TestSuite) TestClientStalledConnectionFailsWrites(c *C) {
+	disk := newTestDisk()
+	disk.started = make(chan uint32, 1024)
+	ts := newTestServer(c, disk)
+	defer ts.close()
+
+	first, err := ts.dial()
+	c.Assert(err, IsNil)
+	stalling := newStallConn(first)
+	second, err := ts.dial()
+	c.Assert(err, IsNil)
+	client, err := NewClient([]net.Conn{stalling, second}, util.NewSharedTimeouts(time.Minute, time.Minute),
+		DefaultFeatures, ClientOptions{StallTimeout: 200 * time.Millisecond})
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	// The first write goes to the first connection, which loses the response after the server applied it.
+	stalling.stalled.Store(true)
+	older := bytes.Repeat([]byte{0xaa}, 4096)
+	newer := bytes.Repeat([]byte{0xbb}, 4096)
+	olderDone := make(chan error, 1)
+	go func() {
+		_, err := client.WriteAt(older, 0)
+		olderDone <- err
+	}()
+	c.Assert(<-disk.started, Equals, uint32(TypeWrite))
+
+	// An overlapping write goes through the other connection.
+	_, err = client.WriteAt(newer, 0)
+	c.Assert(err, IsNil)
+	c.Assert(<-disk.started, Equals, uint32(TypeWrite))
+	c.Assert(disk.read(0, 4096), DeepEquals, newer)
+
+	// Reads keep the other connection busy until the stalled one is dropped. Those sent to the stalled connection
+	// are sent again. The stalled write fails rather than being sent again, which would roll the newer write back.
+	var reads sync.WaitGroup
+	readErrs := make(chan error, 1024)
+	for done := false; !done; {
+		select {
+		case err = <-olderDone:
+			done = true
+		case <-time.After(20 * time.Millisecond):
+			reads.Add(1)
+			go func() {
+				defer reads.Done()
+				buf := make([]byte, 4096)
+				_, errRead := client.ReadAt(buf, 0)
+				if errRead == nil && !bytes.Equal(buf, newer) {
+					errRead = fmt.Errorf("read %x instead of the newer write", buf[0])
+				}
+				readErrs <- errRead
+			}()
+		}
+	}
+	reads.Wait()
+	close(readErrs)
+	for errRead := range readErrs {
+		c.Assert(errRead, IsNil)
+	}
+	c.Assert(err, ErrorMatches, ".*dropped with write in flight.*")
+	c.Assert(disk.read(0, 4096), DeepEquals, newer)
+	// Only reads reached the server since.
+	for len(disk.started) > 0 {
+		c.Assert(<-disk.started, Equals, uint32(TypeRead))
+	}
+
+	// The client goes on with the remaining connection.
+	_, err = client.WriteAt(older, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(disk.read(4096, 4096), DeepEquals, older)
+}
+
+func (s *TestSuite) TestClientStalledConnectionResendsReads(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+
+	data := bytes.Repeat([]byte{0xcc}, 4096)
+	disk.Lock()
+	copy(disk.data, data)
+	disk.Unlock()
+
+	first, err := ts.dial()
+	c.Assert(err, IsNil)
+	stalling := newStallConn(first)
+	client, err := NewClient([]net.Conn{stalling}, util.NewSharedTimeouts(time.Minute, time.Minute),
+		DefaultFeatures, ClientOptions{Dial: ts.dial, StallTimeout: 200 * time.Millisecond})
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	// The only connection fails with a read in flight, which is answered on a new connection.
+	stalling.stalled.Store(true)
+	readDone := make(chan error, 1)
+	buf := make([]byte, 4096)
+	go func() {
+		_, err := client.ReadAt(buf, 0)
+		readDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = stalling.Close()
+	c.Assert(<-readDone, IsNil)
+	c.Assert(buf, DeepEquals, data)
+}
+
+func (s *TestSuite) TestIsIdempotent(c *C) {
+	for _, op := range []uint32{TypeRead, TypeReadBatch, TypeFlush, TypePing} {
+		c.Assert(isIdempotent(op), Equals, true, Commentf(opName(op)))
+	}
+	for _, op := range []uint32{TypeWrite, TypeWriteBatch, TypeUnmap, TypeWriteZeroes} {
+		c.Assert(isIdempotent(op), Equals, false, Commentf(opName(op)))
+	}
+}
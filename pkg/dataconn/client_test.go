@@ -0,0 +1,227 @@
+package dataconn
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+const testDiskSize = 1 << 20
+
+// testDisk is an in-memory disk served by the test servers. While hold is set, the I/O waits for it to be closed.
+type testDisk struct {
+	sync.Mutex
+	data []byte
+	hold chan struct{}
+	// started gets the type of every I/O as it starts, if set
+	started chan uint32
+}
+
+func newTestDisk() *testDisk {
+	return &testDisk{data: make([]byte, testDiskSize)}
+}
+
+func (d *testDisk) wait(op uint32) {
+	d.Lock()
+	hold, started := d.hold, d.started
+	d.Unlock()
+	if started != nil {
+		started <- op
+	}
+	if hold != nil {
+		<-hold
+	}
+}
+
+func (d *testDisk) ReadAt(buf []byte, off int64) (int, error) {
+	d.wait(TypeRead)
+	d.Lock()
+	defer d.Unlock()
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, d.data[off:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *testDisk) WriteAt(buf []byte, off int64) (int, error) {
+	d.wait(TypeWrite)
+	d.Lock()
+	defer d.Unlock()
+	if off+int64(len(buf)) > int64(len(d.data)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(d.data[off:], buf), nil
+}
+
+func (d *testDisk) UnmapAt(length uint32, off int64) (int, error) {
+	d.wait(TypeUnmap)
+	d.Lock()
+	defer d.Unlock()
+	clear(d.data[off : off+int64(length)])
+	return int(length), nil
+}
+
+func (d *testDisk) PingResponse() error {
+	return nil
+}
+
+func (d *testDisk) read(off int64, length int) []byte {
+	d.Lock()
+	defer d.Unlock()
+	return append([]byte(nil), d.data[off:off+int64(length)]...)
+}
+
+// testServer serves a testDisk on a loopback address, with the protocol of a replica data server.
+type testServer struct {
+	l    net.Listener
+	disk *testDisk
+
+	connsLock sync.Mutex
+	conns     []net.Conn
+}
+
+func newTestServer(c *C, disk *testDisk) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	ts := &testServer{l: l, disk: disk}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ts.connsLock.Lock()
+			ts.conns = append(ts.conns, conn)
+			ts.connsLock.Unlock()
+			go func() {
+				_ = NewServer(conn, disk).Handle()
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return ts
+}
+
+func (ts *testServer) dial() (net.Conn, error) {
+	return net.Dial("tcp", ts.l.Addr().String())
+}
+
+func (ts *testServer) close() {
+	_ = ts.l.Close()
+	ts.connsLock.Lock()
+	defer ts.connsLock.Unlock()
+	for _, conn := range ts.conns {
+		_ = conn.Close()
+	}
+}
+
+func newTestClient(c *C, ts *testServer, connCount int, features uint32, opts ClientOptions) *Client {
+	var conns []net.Conn
+	for i := 0; i < connCount; i++ {
+		conn, err := ts.dial()
+		c.Assert(err, IsNil)
+		conns = append(conns, conn)
+	}
+	client, err := NewClient(conns, util.NewSharedTimeouts(time.Minute, time.Minute), features, opts)
+	c.Assert(err, IsNil)
+	return client
+}
+
+func (s *TestSuite) TestClientReadWrite(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+	client := newTestClient(c, ts, 2, DefaultFeatures, ClientOptions{})
+	defer client.Close()
+
+	data := make([]byte, 8192)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	n, err := client.WriteAt(data, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(data))
+	c.Assert(disk.read(4096, len(data)), DeepEquals, data)
+
+	buf := make([]byte, len(data))
+	n, err = client.ReadAt(buf, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(data))
+	c.Assert(buf, DeepEquals, data)
+
+	n, err = client.UnmapAt(4096, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4096)
+	c.Assert(disk.read(4096, 4096), DeepEquals, make([]byte, 4096))
+	c.Assert(client.Ping(), IsNil)
+}
+
+func (s *TestSuite) TestClientClosedWithRequestsInFlight(c *C) {
+	disk := newTestDisk()
+	disk.hold = make(chan struct{})
+	disk.started = make(chan uint32, 16)
+	defer close(disk.hold)
+	ts := newTestServer(c, disk)
+	defer ts.close()
+	client := newTestClient(c, ts, 1, DefaultFeatures, ClientOptions{})
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.ReadAt(make([]byte, 4096), 0)
+		read <- err
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	readContext := make(chan error, 1)
+	go func() {
+		_, err := client.ReadAtContext(ctx, make([]byte, 4096), 0)
+		readContext <- err
+	}()
+	<-disk.started
+	<-disk.started
+
+	// The requests in flight and the ones made afterwards fail rather than wait forever.
+	client.Close()
+	c.Assert(<-read, Equals, ErrClientClosed)
+	c.Assert(<-readContext, Equals, ErrClientClosed)
+	_, err := client.ReadAt(make([]byte, 4096), 0)
+	c.Assert(err, Equals, ErrClientClosed)
+	_, err = client.ReadAtContext(ctx, make([]byte, 4096), 0)
+	c.Assert(err, Equals, ErrClientClosed)
+}
+
+func (s *TestSuite) TestClientCancel(c *C) {
+	disk := newTestDisk()
+	disk.hold = make(chan struct{})
+	disk.started = make(chan uint32, 16)
+	ts := newTestServer(c, disk)
+	defer ts.close()
+	client := newTestClient(c, ts, 1, DefaultFeatures, ClientOptions{})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readContext := make(chan error, 1)
+	go func() {
+		_, err := client.ReadAtContext(ctx, make([]byte, 4096), 0)
+		readContext <- err
+	}()
+	<-disk.started
+	cancel()
+	c.Assert(<-readContext, Equals, context.Canceled)
+
+	// The client goes on once the cancelled request is answered.
+	close(disk.hold)
+	c.Assert(client.Ping(), IsNil)
+	_, err := client.ReadAt(make([]byte, 4096), 0)
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,154 @@
+package dataconn
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A client that replaces its data connections, like the controller reconnecting a replica in its grace period, fences
+// the connections it had before. Otherwise a write sent on one of them may still be running on the server, and land
+// after the data written on the new connections:
+//   - The connections of a client carry a Fence, whose ID is the same across the reconnects of the client and whose
+//     epoch grows with each of them. The client sends it in a fence request right after the handshake, if
+//     FeatureFence is negotiated.
+//   - The server fails the requests changing data on the connections with the same fence ID and an older epoch from
+//     then on, and waits for the ones already running before it answers.
+//   - A connection with an older epoch than the newest one seen for its fence ID is refused.
+
+// Fence identifies the data connections of a client across its reconnects. The zero Fence fences nothing.
+type Fence struct {
+	ID    string
+	Epoch int64
+}
+
+var errFenced = errors.New("connection is fenced by a newer connection of the client")
+
+// fences are the fences of the connections served by this process.
+var fences = &fenceRegistry{
+	epochs:  map[string]int64{},
+	servers: map[string]map[*Server]struct{}{},
+}
+
+type fenceRegistry struct {
+	lock sync.Mutex
+	// epochs is the newest epoch seen for each fence ID. It is kept once the connections close, so a late
+	// connection of an older epoch is still refused.
+	epochs  map[string]int64
+	servers map[string]map[*Server]struct{}
+}
+
+// register records the fence of the connection of a server, and returns the connections it fences.
+func (r *fenceRegistry) register(s *Server, fence Fence) ([]*Server, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if newest, ok := r.epochs[fence.ID]; ok && fence.Epoch < newest {
+		return nil, fmt.Errorf("fence epoch %v is older than epoch %v of another connection", fence.Epoch, newest)
+	}
+	r.epochs[fence.ID] = fence.Epoch
+
+	servers, ok := r.servers[fence.ID]
+	if !ok {
+		servers = map[*Server]struct{}{}
+		r.servers[fence.ID] = servers
+	}
+	var stale []*Server
+	for other := range servers {
+		if other.fence.Epoch < fence.Epoch {
+			stale = append(stale, other)
+			delete(servers, other)
+		}
+	}
+	s.fence = fence
+	servers[s] = struct{}{}
+	return stale, nil
+}
+
+func (r *fenceRegistry) unregister(s *Server) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if s.fence.ID == "" {
+		return
+	}
+	delete(r.servers[s.fence.ID], s)
+	if len(r.servers[s.fence.ID]) == 0 {
+		delete(r.servers, s.fence.ID)
+	}
+}
+
+// handleFence registers the fence of the connection, and fences the older connections of the client.
+func (s *Server) handleFence(msg *Message) {
+	fence := Fence{ID: string(msg.Data), Epoch: msg.Offset}
+	msg.release()
+	msg.Data = nil
+
+	stale, err := fences.register(s, fence)
+	for _, other := range stale {
+		other.fenceOff()
+	}
+	if len(stale) > 0 {
+		logrus.Infof("Fenced %v connections of epoch older than %v from %v", len(stale), fence.Epoch, s.peerAddr)
+	}
+	s.pushResponse(0, msg, err)
+}
+
+// fenceOff fails the requests changing data from now on, once the ones running are done.
+func (s *Server) fenceOff() {
+	s.fenceLock.Lock()
+	s.fenced = true
+	s.fenceLock.Unlock()
+}
+
+// handleUnlessFenced handles a request changing data, unless the connection is fenced. Fencing waits for it.
+func (s *Server) handleUnlessFenced(msg *Message, handle func(*Message)) {
+	s.fenceLock.RLock()
+	defer s.fenceLock.RUnlock()
+	if s.fenced {
+		opsJournal.dispatched(msg.journalOp)
+		s.pushResponse(0, msg, errFenced)
+		return
+	}
+	handle(msg)
+}
+
+// sendFence sends the fence of a client on a wire whose handshake negotiated FeatureFence, and waits until the
+// server fenced the older connections of the client.
+func sendFence(w *Wire, fence Fence) error {
+	if err := w.conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	defer func() {
+		_ = w.conn.SetDeadline(time.Time{})
+	}()
+
+	req := &Message{
+		MagicVersion: MagicVersion,
+		Type:         TypeFence,
+		Offset:       fence.Epoch,
+		Size:         uint32(len(fence.ID)),
+		Data:         []byte(fence.ID),
+	}
+	if err := w.Write(req); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	resp, err := w.Read()
+	if err != nil {
+		return err
+	}
+	defer resp.release()
+	switch resp.Type {
+	case TypeResponse:
+		return nil
+	case TypeError:
+		return fmt.Errorf("failed to fence: %v", string(resp.Data))
+	default:
+		return fmt.Errorf("unexpected response type %v to fence", resp.Type)
+	}
+}
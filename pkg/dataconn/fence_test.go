@@ -0,0 +1,99 @@
+package dataconn
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+func (s *TestSuite) TestFenceFailsWritesOfOlderConnections(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+	id := util.UUID()
+
+	old := newTestClient(c, ts, 2, DefaultFeatures, ClientOptions{Fence: Fence{ID: id, Epoch: 1}})
+	defer old.Close()
+	other := newTestClient(c, ts, 1, DefaultFeatures, ClientOptions{Fence: Fence{ID: util.UUID(), Epoch: 1}})
+	defer other.Close()
+	_, err := old.WriteAt(bytes.Repeat([]byte{1}, 4096), 0)
+	c.Assert(err, IsNil)
+
+	client := newTestClient(c, ts, 2, DefaultFeatures, ClientOptions{Fence: Fence{ID: id, Epoch: 2}})
+	defer client.Close()
+	c.Assert(client.Features()&FeatureFence, Equals, FeatureFence)
+
+	// The older connections change no more data, but can still read.
+	_, err = old.WriteAt(bytes.Repeat([]byte{2}, 4096), 0)
+	c.Assert(err, ErrorMatches, ".*connection is fenced.*")
+	_, err = old.UnmapAt(4096, 0)
+	c.Assert(err, ErrorMatches, ".*connection is fenced.*")
+	c.Assert(disk.read(0, 4096), DeepEquals, bytes.Repeat([]byte{1}, 4096))
+	buf := make([]byte, 4096)
+	_, err = old.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+
+	// Neither the new connections nor the ones of another client are fenced.
+	_, err = client.WriteAt(bytes.Repeat([]byte{3}, 4096), 0)
+	c.Assert(err, IsNil)
+	_, err = other.WriteAt(bytes.Repeat([]byte{4}, 4096), 4096)
+	c.Assert(err, IsNil)
+	c.Assert(disk.read(0, 8192), DeepEquals, append(bytes.Repeat([]byte{3}, 4096), bytes.Repeat([]byte{4}, 4096)...))
+
+	// A connection of an older epoch is refused.
+	conn, err := ts.dial()
+	c.Assert(err, IsNil)
+	_, err = NewClient([]net.Conn{conn}, util.NewSharedTimeouts(time.Minute, time.Minute), DefaultFeatures,
+		ClientOptions{Fence: Fence{ID: id, Epoch: 1}})
+	c.Assert(err, ErrorMatches, ".*fence epoch 1 is older than epoch 2.*")
+	_ = conn.Close()
+}
+
+func (s *TestSuite) TestFenceWaitsForRunningWrites(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+	id := util.UUID()
+
+	old := newTestClient(c, ts, 1, DefaultFeatures, ClientOptions{Fence: Fence{ID: id, Epoch: 1}})
+	defer old.Close()
+	hold := make(chan struct{})
+	disk.Lock()
+	disk.hold, disk.started = hold, make(chan uint32, 1)
+	disk.Unlock()
+	written := make(chan error, 1)
+	go func() {
+		_, err := old.WriteAt(bytes.Repeat([]byte{1}, 4096), 0)
+		written <- err
+	}()
+	c.Assert(<-disk.started, Equals, uint32(TypeWrite))
+	disk.Lock()
+	disk.hold, disk.started = nil, nil
+	disk.Unlock()
+
+	// The new client is not connected until the write of the older connection is done.
+	conn, err := ts.dial()
+	c.Assert(err, IsNil)
+	var client *Client
+	connected := make(chan error, 1)
+	go func() {
+		var err error
+		client, err = NewClient([]net.Conn{conn}, util.NewSharedTimeouts(time.Minute, time.Minute), DefaultFeatures,
+			ClientOptions{Fence: Fence{ID: id, Epoch: 2}})
+		connected <- err
+	}()
+	select {
+	case err := <-connected:
+		c.Fatalf("connected while a write of the older connection is running: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(hold)
+	c.Assert(<-connected, IsNil)
+	defer client.Close()
+	c.Assert(<-written, IsNil)
+	c.Assert(disk.read(0, 4096), DeepEquals, bytes.Repeat([]byte{1}, 4096))
+}
@@ -0,0 +1,151 @@
+package dataconn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// The protocol of a connection is negotiated by a handshake when the client connects:
+//   - The client sends a ping whose data is a hello with the versions and features it supports.
+//   - A server that knows about the handshake answers with the version and features picked for the connection, and
+//     switches to them for the frames that follow.
+//   - A server that does not echoes the data of the ping like it always did, which the client takes as protocol
+//     version 1 without features. Clients that never send a hello get the same.
+const (
+	// ProtocolVersion1 is the original protocol. Frames have no checksum.
+	ProtocolVersion1 = uint16(1)
+	// ProtocolVersion2 frames carry a CRC32C trailer if FeatureChecksum is negotiated, and requests carry their
+	// timeout if FeatureDeadline is.
+	ProtocolVersion2 = uint16(2)
+
+	MagicVersion2 = uint16(0x1b02)
+
+	// FeatureChecksum protects the header and payload of every frame with a CRC32C. It needs ProtocolVersion2.
+	FeatureChecksum = uint32(1 << 0)
+	// FeatureBatch allows batched reads and writes, see Client.ReadExtents and Client.WriteExtents.
+	FeatureBatch = uint32(1 << 1)
+	// FeatureFlush allows flush requests, see Client.Flush.
+	FeatureFlush = uint32(1 << 2)
+
+	// FeatureDeadline makes read, write, unmap and flush requests carry the time left until they expire, and allows
+	// cancel messages. The server skips requests that expired or were cancelled before they touch the disk. It needs
+	// ProtocolVersion2.
+	FeatureDeadline = uint32(1 << 3)
+	// FeatureWriteZeroes allows write zeroes requests, see Client.WriteZeroesAt.
+	FeatureWriteZeroes = uint32(1 << 4)
+	// FeatureFence allows fence requests, which fail the writes still coming on the previous connections of a client
+	// that reconnected. See fence.go.
+	FeatureFence = uint32(1 << 5)
+	// DefaultFeatures are the features requested by clients unless told otherwise. Checksums cost CPU on both ends,
+	// so they are opt-in.
+	DefaultFeatures = FeatureBatch | FeatureFlush | FeatureDeadline | FeatureWriteZeroes | FeatureFence
+
+	handshakeTimeout = 10 * time.Second
+	helloSize        = 12
+)
+
+var (
+	clientHelloMagic = []byte("LHHI")
+	serverHelloMagic = []byte("LHOK")
+)
+
+func magicOf(version uint16) uint16 {
+	if version >= ProtocolVersion2 {
+		return MagicVersion2
+	}
+	return MagicVersion
+}
+
+// hello is the data of the handshake ping and of its response.
+type hello struct {
+	minVersion uint16
+	maxVersion uint16
+	features   uint32
+}
+
+func (h hello) encode(magic []byte) []byte {
+	buf := make([]byte, helloSize)
+	copy(buf, magic)
+	binary.LittleEndian.PutUint16(buf[4:], h.minVersion)
+	binary.LittleEndian.PutUint16(buf[6:], h.maxVersion)
+	binary.LittleEndian.PutUint32(buf[8:], h.features)
+	return buf
+}
+
+func decodeHello(magic, data []byte) (hello, bool) {
+	if len(data) != helloSize || !bytes.Equal(data[:4], magic) {
+		return hello{}, false
+	}
+	return hello{
+		minVersion: binary.LittleEndian.Uint16(data[4:]),
+		maxVersion: binary.LittleEndian.Uint16(data[6:]),
+		features:   binary.LittleEndian.Uint32(data[8:]),
+	}, true
+}
+
+// handshake negotiates the protocol of the wire with the server. It must be done before any other frame is sent.
+// It returns the negotiated version and features.
+func handshake(w *Wire, features uint32) (uint16, uint32, error) {
+	if err := w.conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = w.conn.SetDeadline(time.Time{})
+	}()
+
+	request := hello{minVersion: ProtocolVersion1, maxVersion: ProtocolVersion2, features: features}
+	ping := &Message{
+		MagicVersion: MagicVersion,
+		Type:         TypePing,
+		Data:         request.encode(clientHelloMagic),
+	}
+	if err := w.Write(ping); err != nil {
+		return 0, 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	resp, err := w.Read()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.release()
+	if resp.Type != TypeResponse {
+		return 0, 0, fmt.Errorf("unexpected response type %v to handshake", resp.Type)
+	}
+
+	reply, ok := decodeHello(serverHelloMagic, resp.Data)
+	if !ok {
+		// The server echoed the ping, it predates the handshake.
+		return ProtocolVersion1, 0, nil
+	}
+	if reply.maxVersion < ProtocolVersion1 || reply.maxVersion > ProtocolVersion2 ||
+		reply.features&^features != 0 {
+		return 0, 0, fmt.Errorf("server picked unsupported protocol version %v features 0x%x", reply.maxVersion, reply.features)
+	}
+	w.setWriteProtocol(reply.maxVersion, reply.features)
+	w.setReadProtocol(reply.maxVersion, reply.features)
+	return reply.maxVersion, reply.features, nil
+}
+
+// negotiate picks the protocol of a connection for the hello of a client, out of the features the server supports.
+// ok is false if the data is not a hello.
+func negotiate(data []byte, supported uint32) (version uint16, features uint32, ok bool) {
+	request, ok := decodeHello(clientHelloMagic, data)
+	if !ok {
+		return 0, 0, false
+	}
+	if request.minVersion > ProtocolVersion2 || request.maxVersion < ProtocolVersion1 {
+		// No version in common. Answer with version 1 and let the client decide whether it can go on.
+		return ProtocolVersion1, 0, true
+	}
+	version = min(request.maxVersion, ProtocolVersion2)
+	features = request.features & supported
+	if version < ProtocolVersion2 {
+		features &^= FeatureChecksum | FeatureDeadline
+	}
+	return version, features, true
+}
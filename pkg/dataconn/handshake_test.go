@@ -0,0 +1,212 @@
+package dataconn
+
+import (
+	"encoding/binary"
+	"net"
+
+	. "gopkg.in/check.v1"
+)
+
+// serveHandshake answers the first frame read from conn with reply as the data of the response, or echoes the
+// data of the frame like a server that predates the handshake if reply is nil. It returns the wire to go on with.
+func serveHandshake(c *C, conn net.Conn, reply []byte) *Wire {
+	w := NewWire(conn)
+	msg, err := w.Read()
+	c.Assert(err, IsNil)
+	c.Assert(msg.Type, Equals, uint32(TypePing))
+	data := append([]byte(nil), msg.Data...)
+	if reply != nil {
+		data = reply
+	}
+	c.Assert(w.Write(&Message{Seq: msg.Seq, Type: TypeResponse, Size: uint32(len(data)), Data: data}), IsNil)
+	c.Assert(w.Flush(), IsNil)
+	return w
+}
+
+func (s *TestSuite) TestNegotiate(c *C) {
+	supported := FeatureChecksum | FeatureBatch | FeatureDeadline | FeatureFlush
+
+	for _, t := range []struct {
+		request  hello
+		version  uint16
+		features uint32
+	}{
+		// Features are those asked for and supported.
+		{hello{ProtocolVersion1, ProtocolVersion2, DefaultFeatures | FeatureChecksum}, ProtocolVersion2,
+			FeatureChecksum | FeatureBatch | FeatureDeadline | FeatureFlush},
+		{hello{ProtocolVersion1, ProtocolVersion2, FeatureBatch}, ProtocolVersion2, FeatureBatch},
+		// A client only speaking version 1 gets no feature that needs version 2.
+		{hello{ProtocolVersion1, ProtocolVersion1, DefaultFeatures | FeatureChecksum}, ProtocolVersion1,
+			FeatureBatch | FeatureFlush},
+		// A newer client gets the newest version the server knows.
+		{hello{ProtocolVersion1, 7, FeatureChecksum}, ProtocolVersion2, FeatureChecksum},
+		// No version in common.
+		{hello{5, 7, FeatureChecksum}, ProtocolVersion1, 0},
+	} {
+		version, features, ok := negotiate(t.request.encode(clientHelloMagic), supported)
+		c.Assert(ok, Equals, true)
+		c.Assert(version, Equals, t.version, Commentf("%+v", t.request))
+		c.Assert(features, Equals, t.features, Commentf("%+v", t.request))
+	}
+
+	// The data of a plain ping is not a hello.
+	_, _, ok := negotiate([]byte("ping"), supported)
+	c.Assert(ok, Equals, false)
+	_, _, ok = negotiate(hello{}.encode(serverHelloMagic), supported)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TestSuite) TestHandshakeWithVersion1Server(c *C) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan *Wire)
+	go func() {
+		done <- serveHandshake(c, server, nil)
+	}()
+	w := NewWire(client)
+	version, features, err := handshake(w, DefaultFeatures|FeatureChecksum)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, ProtocolVersion1)
+	c.Assert(features, Equals, uint32(0))
+	serverWire := <-done
+
+	// The frames that follow are 0x1b01 frames without checksum or deadline.
+	go func() {
+		c.Check(w.Write(&Message{Seq: 1, Type: TypeRead, Size: 512}), IsNil)
+		c.Check(w.Flush(), IsNil)
+	}()
+	msg, err := serverWire.Read()
+	c.Assert(err, IsNil)
+	c.Assert(msg.MagicVersion, Equals, MagicVersion)
+	c.Assert(msg.Size, Equals, uint32(512))
+}
+
+func (s *TestSuite) TestHandshakeWithVersion1Client(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+	conn, err := ts.dial()
+	c.Assert(err, IsNil)
+	w := NewWire(conn)
+	defer w.Close()
+
+	// A client that predates the handshake pings with any data and gets it echoed.
+	c.Assert(w.Write(&Message{Seq: 1, Type: TypePing}), IsNil)
+	c.Assert(w.Flush(), IsNil)
+	resp, err := w.Read()
+	c.Assert(err, IsNil)
+	c.Assert(resp.MagicVersion, Equals, MagicVersion)
+	c.Assert(resp.Type, Equals, uint32(TypeResponse))
+
+	// The server stays on 0x1b01 frames.
+	data := []byte("written by a version 1 client")
+	c.Assert(w.Write(&Message{Seq: 2, Type: TypeWrite, Offset: 512, Size: uint32(len(data)), Data: data}), IsNil)
+	c.Assert(w.Flush(), IsNil)
+	resp, err = w.Read()
+	c.Assert(err, IsNil)
+	c.Assert(resp.Type, Equals, uint32(TypeResponse))
+	c.Assert(resp.Seq, Equals, uint32(2))
+	c.Assert(disk.read(512, len(data)), DeepEquals, data)
+}
+
+func (s *TestSuite) TestHandshakeWithVersion2Server(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+
+	for _, requested := range []uint32{0, DefaultFeatures, DefaultFeatures | FeatureChecksum} {
+		conn, err := ts.dial()
+		c.Assert(err, IsNil)
+		w := NewWire(conn)
+		version, features, err := handshake(w, requested)
+		c.Assert(err, IsNil)
+		c.Assert(version, Equals, ProtocolVersion2)
+		// The test disk can neither flush nor write zeroes.
+		c.Assert(features, Equals, requested&^(FeatureFlush|FeatureWriteZeroes))
+		c.Assert(w.writeMagic, Equals, MagicVersion2)
+		c.Assert(w.readMagic, Equals, MagicVersion2)
+		c.Assert(w.writeChecksum, Equals, requested&FeatureChecksum != 0)
+		_ = w.Close()
+	}
+}
+
+func (s *TestSuite) TestHandshakeMismatchedFeatures(c *C) {
+	for _, reply := range []hello{
+		// A feature not asked for.
+		{ProtocolVersion2, ProtocolVersion2, FeatureBatch | FeatureChecksum},
+		// An unknown version.
+		{3, 3, FeatureBatch},
+		{0, 0, 0},
+	} {
+		client, server := net.Pipe()
+		go serveHandshake(c, server, reply.encode(serverHelloMagic))
+		_, _, err := handshake(NewWire(client), FeatureBatch)
+		c.Assert(err, ErrorMatches, ".*unsupported protocol.*", Commentf("%+v", reply))
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func (s *TestSuite) TestClientMissingFeatures(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+
+	// The server cannot flush nor write zeroes, so the client does without.
+	client := newTestClient(c, ts, 1, DefaultFeatures, ClientOptions{})
+	defer client.Close()
+	c.Assert(client.Features()&(FeatureFlush|FeatureWriteZeroes), Equals, uint32(0))
+	c.Assert(client.Flush(), ErrorMatches, ".*does not support flush.*")
+
+	disk.Lock()
+	for i := range disk.data[:8192] {
+		disk.data[i] = 0xff
+	}
+	disk.Unlock()
+	n, err := client.WriteZeroesAt(4096, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4096)
+	c.Assert(disk.read(4096, 4096), DeepEquals, make([]byte, 4096))
+	c.Assert(disk.read(0, 1)[0], Equals, byte(0xff))
+
+	// Nor does a client that did not ask for batched requests.
+	client = newTestClient(c, ts, 1, DefaultFeatures&^FeatureBatch, ClientOptions{})
+	defer client.Close()
+	_, err = client.ReadExtents(make([]byte, 512), []Extent{{Offset: 0, Length: 512}})
+	c.Assert(err, ErrorMatches, ".*does not support batched requests.*")
+}
+
+func (s *TestSuite) TestClientReconnectNegotiatesSameProtocol(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+	client := newTestClient(c, ts, 1, DefaultFeatures, ClientOptions{})
+	defer client.Close()
+
+	// A server answering a reconnection with other features is refused.
+	client.opts.Dial = func() (net.Conn, error) {
+		conn, server := net.Pipe()
+		reply := hello{ProtocolVersion2, ProtocolVersion2, FeatureBatch}
+		go serveHandshake(c, server, reply.encode(serverHelloMagic))
+		return conn, nil
+	}
+	_, err := client.dial()
+	c.Assert(err, ErrorMatches, ".*negotiated protocol version 2 features 0x2 instead of.*")
+}
+
+func (s *TestSuite) TestHelloEncoding(c *C) {
+	h := hello{minVersion: ProtocolVersion1, maxVersion: ProtocolVersion2, features: DefaultFeatures}
+	data := h.encode(clientHelloMagic)
+	c.Assert(data, HasLen, helloSize)
+	c.Assert(string(data[:4]), Equals, "LHHI")
+	c.Assert(binary.LittleEndian.Uint32(data[8:]), Equals, DefaultFeatures)
+	decoded, ok := decodeHello(clientHelloMagic, data)
+	c.Assert(ok, Equals, true)
+	c.Assert(decoded, Equals, h)
+	_, ok = decodeHello(serverHelloMagic, data)
+	c.Assert(ok, Equals, false)
+	_, ok = decodeHello(clientHelloMagic, data[:helloSize-1])
+	c.Assert(ok, Equals, false)
+}
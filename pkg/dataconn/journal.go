@@ -0,0 +1,200 @@
+package dataconn
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	journalBufferSize = 4096
+
+	JournalSideClient = "client"
+	JournalSideServer = "server"
+)
+
+// JournalOp records the timing of one dataconn request on one side of the connection. The request goes through the
+// same three phases on both sides, so the phases split the latency into queueing, the work on the other end of the
+// connection (or on the disk) and replying:
+//
+//	client: Start (ReadAt/WriteAt/UnmapAt called), Dispatched (written to the wire), Processed (response read from
+//	        the wire), End (returned to the caller)
+//	server: Start (read from the wire), Dispatched (disk I/O started), Processed (disk I/O done), End (response
+//	        written to the wire)
+type JournalOp struct {
+	Side   string `json:"side"`
+	Peer   string `json:"peer"`
+	Seq    uint32 `json:"seq"`
+	Op     string `json:"op"`
+	Offset int64  `json:"offset"`
+	Size   uint32 `json:"size"`
+	Failed bool   `json:"failed"`
+
+	Start      time.Time `json:"start"`
+	Dispatched time.Time `json:"dispatched"`
+	Processed  time.Time `json:"processed"`
+	End        time.Time `json:"end"`
+}
+
+// Pending tells if the op has not completed yet when the journal is exported.
+func (op *JournalOp) Pending() bool {
+	return op.End.IsZero()
+}
+
+// journalEnabled turns the op journal on. It is off by default, so the I/O path pays for nothing but this check
+// unless someone asks for the journal.
+var journalEnabled atomic.Bool
+
+// EnableJournal turns the op journal of this process on or off. Ops in flight when the journal is turned on are not
+// recorded.
+func EnableJournal(enabled bool) {
+	journalEnabled.Store(enabled)
+}
+
+// JournalEnabled tells if the op journal of this process is on.
+func JournalEnabled() bool {
+	return journalEnabled.Load()
+}
+
+// journalEntry is an in-flight op. The fields of JournalOp are set once in begin. The phases reached in between are
+// updated without taking the journal lock, so only begin and end of an op contend with other ops.
+type journalEntry struct {
+	op JournalOp
+
+	seq        atomic.Uint32
+	dispatched atomic.Int64
+	processed  atomic.Int64
+}
+
+func (e *journalEntry) snapshot() JournalOp {
+	op := e.op
+	op.Seq = e.seq.Load()
+	op.Dispatched = unixNanoToTime(e.dispatched.Load())
+	op.Processed = unixNanoToTime(e.processed.Load())
+	return op
+}
+
+func unixNanoToTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// opJournal keeps the in-flight ops and a cyclic buffer of the latest completed ops of all the dataconn clients and
+// servers of this process.
+type opJournal struct {
+	sync.Mutex
+
+	pending   map[*journalEntry]struct{}
+	completed []JournalOp
+	next      int
+	full      bool
+}
+
+var opsJournal = &opJournal{
+	pending:   map[*journalEntry]struct{}{},
+	completed: make([]JournalOp, journalBufferSize),
+}
+
+// begin records the start of an op. It returns nil if the journal is off, and the other methods do nothing for a
+// nil entry.
+func (j *opJournal) begin(side, peer string, msg *Message) *journalEntry {
+	if !journalEnabled.Load() {
+		return nil
+	}
+
+	e := &journalEntry{
+		op: JournalOp{
+			Side:   side,
+			Peer:   peer,
+			Op:     opName(msg.Type),
+			Offset: msg.Offset,
+			Size:   msg.Size,
+			Start:  time.Now(),
+		},
+	}
+	e.seq.Store(msg.Seq)
+
+	j.Lock()
+	defer j.Unlock()
+	j.pending[e] = struct{}{}
+	return e
+}
+
+func (j *opJournal) assigned(e *journalEntry, seq uint32) {
+	if e == nil {
+		return
+	}
+	e.seq.Store(seq)
+}
+
+func (j *opJournal) dispatched(e *journalEntry) {
+	if e == nil {
+		return
+	}
+	e.dispatched.Store(time.Now().UnixNano())
+}
+
+func (j *opJournal) processed(e *journalEntry, at time.Time) {
+	if e == nil {
+		return
+	}
+	e.processed.Store(at.UnixNano())
+}
+
+func (j *opJournal) end(e *journalEntry, failed bool) {
+	if e == nil {
+		return
+	}
+	op := e.snapshot()
+	op.End = time.Now()
+	op.Failed = failed
+
+	j.Lock()
+	defer j.Unlock()
+
+	if _, ok := j.pending[e]; !ok {
+		return
+	}
+	delete(j.pending, e)
+
+	j.completed[j.next] = op
+	j.next = (j.next + 1) % len(j.completed)
+	if j.next == 0 {
+		j.full = true
+	}
+}
+
+// ExportJournal returns up to limit of the latest completed ops followed by all the in-flight ops, each group in the
+// order they started. A limit of 0 means all the completed ops still in the buffer.
+func ExportJournal(limit int) []JournalOp {
+	j := opsJournal
+	j.Lock()
+	defer j.Unlock()
+
+	count := j.next
+	if j.full {
+		count = len(j.completed)
+	}
+	if limit > 0 && limit < count {
+		count = limit
+	}
+
+	ops := make([]JournalOp, 0, count+len(j.pending))
+	for i := count; i > 0; i-- {
+		idx := (j.next - i + len(j.completed)) % len(j.completed)
+		ops = append(ops, j.completed[idx])
+	}
+
+	pending := make([]JournalOp, 0, len(j.pending))
+	for e := range j.pending {
+		pending = append(pending, e.snapshot())
+	}
+	sort.Slice(pending, func(a, b int) bool {
+		return pending[a].Start.Before(pending[b].Start)
+	})
+
+	return append(ops, pending...)
+}
@@ -0,0 +1,119 @@
+package dataconn
+
+import (
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+func resetJournal() {
+	opsJournal.Lock()
+	defer opsJournal.Unlock()
+	clear(opsJournal.pending)
+	opsJournal.next = 0
+	opsJournal.full = false
+}
+
+func (s *TestSuite) TestJournalDisabled(c *C) {
+	EnableJournal(false)
+	resetJournal()
+
+	e := opsJournal.begin(JournalSideClient, "peer", &Message{Type: TypeWrite, Offset: 4096, Size: 512})
+	c.Assert(e, IsNil)
+	opsJournal.assigned(e, 1)
+	opsJournal.dispatched(e)
+	opsJournal.processed(e, time.Now())
+	opsJournal.end(e, false)
+
+	c.Assert(ExportJournal(0), HasLen, 0)
+}
+
+func (s *TestSuite) TestJournalExport(c *C) {
+	EnableJournal(true)
+	defer EnableJournal(false)
+	resetJournal()
+
+	done := opsJournal.begin(JournalSideClient, "peer", &Message{Type: TypeWrite, Offset: 4096, Size: 512})
+	c.Assert(done, NotNil)
+	opsJournal.assigned(done, 7)
+	opsJournal.dispatched(done)
+	opsJournal.processed(done, time.Now())
+	opsJournal.end(done, false)
+	// A second end of the same op is ignored.
+	opsJournal.end(done, true)
+
+	inflight := opsJournal.begin(JournalSideServer, "peer", &Message{Type: TypeRead, Seq: 8, Offset: 0, Size: 4096})
+	opsJournal.dispatched(inflight)
+
+	ops := ExportJournal(0)
+	c.Assert(ops, HasLen, 2)
+
+	c.Assert(ops[0].Side, Equals, JournalSideClient)
+	c.Assert(ops[0].Seq, Equals, uint32(7))
+	c.Assert(ops[0].Offset, Equals, int64(4096))
+	c.Assert(ops[0].Size, Equals, uint32(512))
+	c.Assert(ops[0].Failed, Equals, false)
+	c.Assert(ops[0].Pending(), Equals, false)
+	c.Assert(ops[0].Dispatched.IsZero(), Equals, false)
+	c.Assert(ops[0].Processed.IsZero(), Equals, false)
+
+	c.Assert(ops[1].Side, Equals, JournalSideServer)
+	c.Assert(ops[1].Seq, Equals, uint32(8))
+	c.Assert(ops[1].Pending(), Equals, true)
+	c.Assert(ops[1].Dispatched.IsZero(), Equals, false)
+	c.Assert(ops[1].Processed.IsZero(), Equals, true)
+
+	opsJournal.end(inflight, true)
+	c.Assert(ExportJournal(1), HasLen, 1)
+	c.Assert(ExportJournal(1)[0].Failed, Equals, true)
+}
+
+func (s *TestSuite) TestJournalWrapAround(c *C) {
+	EnableJournal(true)
+	defer EnableJournal(false)
+	resetJournal()
+
+	for i := 0; i < journalBufferSize+3; i++ {
+		e := opsJournal.begin(JournalSideClient, "peer", &Message{Type: TypeWrite, Seq: uint32(i)})
+		opsJournal.end(e, false)
+	}
+
+	ops := ExportJournal(0)
+	c.Assert(ops, HasLen, journalBufferSize)
+	c.Assert(ops[0].Seq, Equals, uint32(3))
+	c.Assert(ops[len(ops)-1].Seq, Equals, uint32(journalBufferSize+2))
+}
+
+func benchmarkJournal(b *testing.B, enabled bool) {
+	EnableJournal(enabled)
+	defer EnableJournal(false)
+	resetJournal()
+
+	msg := &Message{Type: TypeWrite, Offset: 4096, Size: 4096}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			e := opsJournal.begin(JournalSideClient, "peer", msg)
+			opsJournal.assigned(e, 1)
+			opsJournal.dispatched(e)
+			opsJournal.processed(e, time.Now())
+			opsJournal.end(e, false)
+		}
+	})
+}
+
+func BenchmarkJournalDisabled(b *testing.B) {
+	benchmarkJournal(b, false)
+}
+
+func BenchmarkJournalEnabled(b *testing.B) {
+	benchmarkJournal(b, true)
+}
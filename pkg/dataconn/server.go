@@ -1,33 +1,67 @@
 package dataconn
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/longhorn/longhorn-engine/pkg/tracing"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 )
 
 type Server struct {
+	peerAddr  string
 	wire      *Wire
 	responses chan *Message
 	done      chan struct{}
 	data      types.DataProcessor
+	// handshaken is set once the first frame is read, after which a ping is just a ping
+	handshaken bool
+	// deadlines is set if FeatureDeadline is negotiated. The requests being handled are then kept in pending, so
+	// cancel messages can find them.
+	deadlines   bool
+	pendingLock sync.Mutex
+	pending     map[uint32]*Message
+	// fence is the fence of the connection, guarded by the lock of fences. Once fenced, the requests changing data
+	// fail, and fenceLock is held for writing to wait for the ones running.
+	fence     Fence
+	fenceLock sync.RWMutex
+	fenced    bool
+}
+
+var (
+	errRequestCancelled = errors.New("request cancelled")
+	errDeadlineExceeded = errors.New("request deadline exceeded")
+	errReadTooLarge     = fmt.Errorf("read is larger than the maximum %v bytes of a frame", MaxFrameDataSize)
+)
+
+// flusher is implemented by the data processors that can make the data written so far durable.
+type flusher interface {
+	Flush() error
 }
 
 func NewServer(conn net.Conn, data types.DataProcessor) *Server {
 	return &Server{
+		peerAddr:  conn.RemoteAddr().String(),
 		wire:      NewWire(conn),
 		responses: make(chan *Message, 1024),
 		done:      make(chan struct{}, 5),
 		data:      data,
+		pending:   map[uint32]*Message{},
 	}
 }
 
 func (s *Server) Handle() error {
 	go s.write()
 	defer func() {
+		fences.unregister(s)
 		s.done <- struct{}{}
 	}()
 	return s.read()
@@ -40,18 +74,62 @@ func (s *Server) readFromWire(ret chan<- error) {
 		return
 	} else if err != nil {
 		logrus.WithError(err).Error("Failed to read")
+		if errors.Is(err, ErrChecksumMismatch) {
+			// Nothing read from the connection can be trusted anymore.
+			if errClose := s.wire.Close(); errClose != nil {
+				logrus.WithError(errClose).Warn("Failed to close connection")
+			}
+		}
 		ret <- err
 		return
 	}
+	if !s.handshaken {
+		s.handshaken = true
+		if msg.Type == TypePing && s.handleHello(msg) {
+			ret <- nil
+			return
+		}
+	}
+	if msg.Type == TypeCancel {
+		s.handleCancel(msg)
+		ret <- nil
+		return
+	}
+	if msg.Type == TypeFence {
+		// The client sends nothing else until it gets the response.
+		s.handleFence(msg)
+		ret <- nil
+		return
+	}
+	if isIO(msg.Type) {
+		msg.journalOp = opsJournal.begin(JournalSideServer, s.peerAddr, msg)
+		if s.deadlines {
+			s.pendingLock.Lock()
+			s.pending[msg.Seq] = msg
+			s.pendingLock.Unlock()
+		}
+	}
+	if msg.Type != TypePing && tracing.SampleDataconn() {
+		_, msg.span = tracing.StartSpan(context.Background(), "dataconn.Server/"+opName(msg.Type),
+			attribute.Int64("offset", msg.Offset), attribute.Int64("length", int64(msg.Size)))
+	}
 	switch msg.Type {
 	case TypeRead:
 		go s.handleRead(msg)
 	case TypeWrite:
-		go s.handleWrite(msg)
+		go s.handleUnlessFenced(msg, s.handleWrite)
 	case TypeUnmap:
-		go s.handleUnmap(msg)
+		go s.handleUnlessFenced(msg, s.handleUnmap)
 	case TypePing:
 		go s.handlePing(msg)
+	case TypeReadBatch:
+		go s.handleReadBatch(msg)
+	case TypeWriteBatch:
+		go s.handleUnlessFenced(msg, s.handleWriteBatch)
+	case TypeFlush:
+		go s.handleFlush(msg)
+	case TypeWriteZeroes:
+		go s.handleUnlessFenced(msg, s.handleWriteZeroes)
 	}
 	ret <- nil
 }
@@ -79,30 +157,181 @@ func (s *Server) Stop() {
 }
 
 func (s *Server) handleRead(msg *Message) {
-	msg.Data = make([]byte, msg.Size)
+	opsJournal.dispatched(msg.journalOp)
+	if err := s.checkExpired(msg); err != nil {
+		s.pushResponse(0, msg, err)
+		return
+	}
+	if msg.Size > MaxFrameDataSize {
+		s.pushResponse(0, msg, errReadTooLarge)
+		return
+	}
+	msg.Data, msg.buffer = getBuffer(int(msg.Size))
 	c, err := s.data.ReadAt(msg.Data, msg.Offset)
 	s.pushResponse(c, msg, err)
 }
 
+func (s *Server) handleReadBatch(msg *Message) {
+	opsJournal.dispatched(msg.journalOp)
+	if err := s.checkExpired(msg); err != nil {
+		s.pushResponse(0, msg, err)
+		return
+	}
+	if msg.Size > MaxFrameDataSize {
+		s.pushResponse(0, msg, errReadTooLarge)
+		return
+	}
+	msg.Data, msg.buffer = getBuffer(int(msg.Size))
+	count := 0
+	var err error
+	for _, extent := range msg.Extents {
+		var c int
+		c, err = s.data.ReadAt(msg.Data[count:count+int(extent.Length)], extent.Offset)
+		count += c
+		if err != nil {
+			break
+		}
+	}
+	s.pushResponse(count, msg, err)
+}
+
+func (s *Server) handleWriteBatch(msg *Message) {
+	opsJournal.dispatched(msg.journalOp)
+	if err := s.checkExpired(msg); err != nil {
+		s.pushResponse(0, msg, err)
+		return
+	}
+	count := 0
+	var err error
+	for _, extent := range msg.Extents {
+		var c int
+		c, err = s.data.WriteAt(msg.Data[count:count+int(extent.Length)], extent.Offset)
+		count += c
+		if err != nil {
+			break
+		}
+	}
+	s.pushResponse(count, msg, err)
+}
+
 func (s *Server) handleWrite(msg *Message) {
+	opsJournal.dispatched(msg.journalOp)
+	if err := s.checkExpired(msg); err != nil {
+		s.pushResponse(0, msg, err)
+		return
+	}
 	c, err := s.data.WriteAt(msg.Data, msg.Offset)
 	s.pushResponse(c, msg, err)
 }
 
 func (s *Server) handleUnmap(msg *Message) {
+	opsJournal.dispatched(msg.journalOp)
+	if err := s.checkExpired(msg); err != nil {
+		s.pushResponse(0, msg, err)
+		return
+	}
 	c, err := s.data.UnmapAt(msg.Size, msg.Offset)
 	s.pushResponse(c, msg, err)
 }
 
+// checkExpired returns an error if the request was cancelled or its deadline passed, so it is dropped before it
+// touches the disk.
+func (s *Server) checkExpired(msg *Message) error {
+	if msg.cancelled.Load() {
+		return errRequestCancelled
+	}
+	if !msg.Deadline.IsZero() && time.Now().After(msg.Deadline) {
+		return errDeadlineExceeded
+	}
+	return nil
+}
+
+// handleCancel marks the request the cancel message is for as cancelled. If the request is already being handled,
+// it completes as usual. Cancel messages get no response.
+func (s *Server) handleCancel(msg *Message) {
+	s.pendingLock.Lock()
+	if req, ok := s.pending[msg.Seq]; ok {
+		req.cancelled.Store(true)
+	}
+	s.pendingLock.Unlock()
+	msg.release()
+}
+
+// handleHello answers the hello of a client and switches to the negotiated protocol. It returns false if the ping
+// is not a hello.
+func (s *Server) handleHello(msg *Message) bool {
+	supported := FeatureChecksum | FeatureBatch | FeatureDeadline | FeatureFence
+	if _, ok := s.data.(flusher); ok {
+		supported |= FeatureFlush
+	}
+	if _, ok := s.data.(types.ZeroWriterAt); ok {
+		supported |= FeatureWriteZeroes
+	}
+	version, features, ok := negotiate(msg.Data, supported)
+	if !ok {
+		return false
+	}
+	logrus.Infof("Negotiated protocol version %v features 0x%x with %v", version, features, s.peerAddr)
+
+	// The client sends nothing else until it gets the response, so the frames read from now on follow the
+	// negotiated protocol. The response itself still follows the original one.
+	s.wire.setReadProtocol(version, features)
+	s.deadlines = features&FeatureDeadline != 0
+	reply := &hello{minVersion: version, maxVersion: version, features: features}
+	msg.release()
+	msg.MagicVersion = MagicVersion
+	msg.Type = TypeResponse
+	msg.Data = reply.encode(serverHelloMagic)
+	msg.Size = uint32(len(msg.Data))
+	msg.negotiated = reply
+	s.responses <- msg
+	return true
+}
+
+func (s *Server) handleFlush(msg *Message) {
+	opsJournal.dispatched(msg.journalOp)
+	if err := s.checkExpired(msg); err != nil {
+		s.pushResponse(0, msg, err)
+		return
+	}
+	err := fmt.Errorf("flush is not supported")
+	if f, ok := s.data.(flusher); ok {
+		err = f.Flush()
+	}
+	s.pushResponse(0, msg, err)
+}
+
+func (s *Server) handleWriteZeroes(msg *Message) {
+	opsJournal.dispatched(msg.journalOp)
+	if err := s.checkExpired(msg); err != nil {
+		s.pushResponse(0, msg, err)
+		return
+	}
+	zw, ok := s.data.(types.ZeroWriterAt)
+	if !ok {
+		s.pushResponse(0, msg, fmt.Errorf("write zeroes is not supported"))
+		return
+	}
+	c, err := zw.WriteZeroesAt(msg.Size, msg.Offset)
+	s.pushResponse(c, msg, err)
+}
+
 func (s *Server) handlePing(msg *Message) {
 	err := s.data.PingResponse()
 	s.pushResponse(0, msg, err)
 }
 
 func (s *Server) pushResponse(count int, msg *Message, err error) {
+	opsJournal.processed(msg.journalOp, time.Now())
+	if s.deadlines && isIO(msg.Type) {
+		s.pendingLock.Lock()
+		delete(s.pending, msg.Seq)
+		s.pendingLock.Unlock()
+	}
 	msg.MagicVersion = MagicVersion
 	msg.Size = uint32(len(msg.Data))
-	if msg.Type == TypeWrite || msg.Type == TypeUnmap {
+	if msg.Type == TypeWrite || msg.Type == TypeWriteBatch || msg.Type == TypeUnmap || msg.Type == TypeWriteZeroes {
+		msg.release()
 		msg.Data = nil
 		msg.Size = uint32(count)
 	}
@@ -113,24 +342,54 @@ func (s *Server) pushResponse(count int, msg *Message, err error) {
 		msg.Data = msg.Data[:count]
 		msg.Size = uint32(len(msg.Data))
 	} else if err == types.ErrNoSpaceLeftOnDevice {
+		msg.release()
 		msg.Type = TypeENOSPC
 		msg.Data = []byte(err.Error())
 		msg.Size = uint32(len(msg.Data))
 	} else if err != nil {
+		msg.release()
 		msg.Type = TypeError
 		msg.Data = []byte(err.Error())
 		msg.Size = uint32(len(msg.Data))
 	}
+	if msg.span != nil {
+		tracing.EndSpan(msg.span, err)
+		msg.span = nil
+	}
 	s.responses <- msg
 }
 
 func (s *Server) write() {
+	// Responses are flushed once no more are queued, so a burst of responses shares syscalls while a lone response
+	// is sent right away.
+	var unflushed []*Message
 	for {
 		select {
 		case msg := <-s.responses:
-			if err := s.wire.Write(msg); err != nil {
+			err := s.wire.Write(msg)
+			if err != nil {
 				logrus.WithError(err).Error("Failed to write")
 			}
+			if msg.negotiated != nil {
+				s.wire.setWriteProtocol(msg.negotiated.maxVersion, msg.negotiated.features)
+			}
+			msg.release()
+			if err != nil {
+				opsJournal.end(msg.journalOp, true)
+			} else {
+				unflushed = append(unflushed, msg)
+			}
+			if len(s.responses) > 0 {
+				continue
+			}
+			err = s.wire.Flush()
+			if err != nil {
+				logrus.WithError(err).Error("Failed to flush")
+			}
+			for _, msg := range unflushed {
+				opsJournal.end(msg.journalOp, err != nil || (msg.Type != TypeResponse && msg.Type != TypeEOF))
+			}
+			unflushed = unflushed[:0]
 		case <-s.done:
 			msg := &Message{
 				Type: TypeClose,
@@ -138,6 +397,8 @@ func (s *Server) write() {
 			//Best effort to notify client to close connection
 			if err := s.wire.Write(msg); err != nil {
 				logrus.WithError(err).Warn("Failed to write")
+			} else if err := s.wire.Flush(); err != nil {
+				logrus.WithError(err).Warn("Failed to flush")
 			}
 		}
 	}
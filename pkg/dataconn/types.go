@@ -1,6 +1,13 @@
 package dataconn
 
-import journal "github.com/longhorn/sparse-tools/stats"
+import (
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	journal "github.com/longhorn/sparse-tools/stats"
+)
 
 const (
 	TypeRead = iota
@@ -12,6 +19,12 @@ const (
 	TypePing
 	TypeUnmap
 	TypeENOSPC
+	TypeReadBatch
+	TypeWriteBatch
+	TypeFlush
+	TypeCancel
+	TypeWriteZeroes
+	TypeFence
 
 	messageSize     = (32 + 32 + 32 + 64) / 8 //TODO: unused?
 	readBufferSize  = 8096
@@ -20,8 +33,18 @@ const (
 
 const (
 	MagicVersion = uint16(0x1b01) // LongHorn01
+
+	// MaxBatchExtents is the maximum number of extents of a batched read or write.
+	MaxBatchExtents = 1024
+	extentSize      = 8 + 4
 )
 
+// Extent is a range of a batched read or write.
+type Extent struct {
+	Offset int64
+	Length uint32
+}
+
 type Message struct {
 	Complete chan struct{}
 
@@ -31,7 +54,83 @@ type Message struct {
 	Offset       int64
 	Size         uint32
 	Data         []byte
+	// Extents are the ranges of a batched read or write. The data of a batched write is the data of the extents one
+	// after another, and so is the data of the response to a batched read.
+	Extents      []Extent
 	transportErr error
+	// buffer is the pooled buffer Data is in, if any
+	buffer []byte
+	// negotiated is set on the response to a handshake. The server switches to its protocol once it is written.
+	negotiated *hello
 
 	ID journal.OpID //Seq and ID can apparently be collapsed into one (ID)
+
+	// span traces the request on the server side if it is sampled
+	span trace.Span
+	// journalOp records the timing of read, write and unmap requests if the op journal is on
+	journalOp *journalEntry
+	// received is when a response is read from the wire
+	received time.Time
+
+	// Deadline is when the request expires, if it has a deadline. It is sent to the server if FeatureDeadline is
+	// negotiated, so the server skips requests nobody waits for anymore.
+	Deadline time.Time
+	// cancelled is set once the request is given up on, by the caller on the client side or by a cancel message on
+	// the server side
+	cancelled atomic.Bool
+	// cancelErr is the error returned for a request cancelled on the client side
+	cancelErr error
+	// failErr is the error returned for a request failed by the client loop without touching its type and data
+	failErr error
+	// conn is the client connection a request is sent on or a response is read from
+	conn *clientConn
+	// dispatched is when a request is handed to the writer of its connection
+	dispatched time.Time
+}
+
+func opName(op uint32) string {
+	switch op {
+	case TypeRead:
+		return "read"
+	case TypeWrite:
+		return "write"
+	case TypeUnmap:
+		return "unmap"
+	case TypePing:
+		return "ping"
+	case TypeReadBatch:
+		return "read-batch"
+	case TypeWriteBatch:
+		return "write-batch"
+	case TypeFlush:
+		return "flush"
+	case TypeCancel:
+		return "cancel"
+	case TypeWriteZeroes:
+		return "write-zeroes"
+	case TypeFence:
+		return "fence"
+	}
+	return "unknown"
+}
+
+func isIO(op uint32) bool {
+	switch op {
+	case TypeRead, TypeWrite, TypeUnmap, TypeReadBatch, TypeWriteBatch, TypeFlush, TypeWriteZeroes:
+		return true
+	}
+	return false
+}
+
+// isIdempotent tells if a request can be sent again without changing the outcome.
+func isIdempotent(op uint32) bool {
+	switch op {
+	case TypeRead, TypeReadBatch, TypeFlush, TypePing:
+		return true
+	}
+	return false
+}
+
+func isBatch(op uint32) bool {
+	return op == TypeReadBatch || op == TypeWriteBatch
 }
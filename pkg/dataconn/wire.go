@@ -3,18 +3,47 @@ package dataconn
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
+	"time"
 	"unsafe"
 )
 
+// ErrChecksumMismatch is returned by Wire.Read if the checksum of a frame does not match its content. The
+// connection cannot be trusted anymore and must be closed.
+var ErrChecksumMismatch = errors.New("dataconn frame checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// MaxFrameDataSize bounds the payload of a frame, including the extents of a batched request. The length in the
+// header is only covered by the checksum once the whole frame is read, so a longer frame is refused before anything
+// is allocated for it.
+const MaxFrameDataSize = 64 << 20
+
+// Wire reads and writes the frames of a connection. Reading and writing can be done concurrently, each by a
+// single goroutine, so the settings of each direction are changed by the goroutine of that direction only.
 type Wire struct {
 	conn        net.Conn
 	writer      *bufio.Writer
 	reader      io.Reader
 	writeHeader []byte
 	readHeader  []byte
+
+	// writeMagic and readMagic are the MagicVersion of the frames of the negotiated protocol version.
+	writeMagic uint16
+	readMagic  uint16
+	// writeChecksum and readChecksum are set if frames carry a CRC32C of their header and payload.
+	writeChecksum bool
+	readChecksum  bool
+	writeCRC      uint32
+	readCRC       uint32
+	// writeDeadline and readDeadline are set if requests carry the nanoseconds left until they expire right after
+	// the header, zero for no deadline.
+	writeDeadline bool
+	readDeadline  bool
 }
 
 func NewWire(conn net.Conn) *Wire {
@@ -24,13 +53,48 @@ func NewWire(conn net.Conn) *Wire {
 		reader:      bufio.NewReaderSize(conn, readBufferSize),
 		writeHeader: make([]byte, getRequestHeaderSize()),
 		readHeader:  make([]byte, getRequestHeaderSize()),
+		writeMagic:  MagicVersion,
+		readMagic:   MagicVersion,
+	}
+}
+
+// setWriteProtocol makes the frames written from now on follow the negotiated version and features.
+func (w *Wire) setWriteProtocol(version uint16, features uint32) {
+	w.writeMagic = magicOf(version)
+	w.writeChecksum = version >= ProtocolVersion2 && features&FeatureChecksum != 0
+	w.writeDeadline = version >= ProtocolVersion2 && features&FeatureDeadline != 0
+}
+
+// setReadProtocol makes the frames read from now on follow the negotiated version and features.
+func (w *Wire) setReadProtocol(version uint16, features uint32) {
+	w.readMagic = magicOf(version)
+	w.readChecksum = version >= ProtocolVersion2 && features&FeatureChecksum != 0
+	w.readDeadline = version >= ProtocolVersion2 && features&FeatureDeadline != 0
+}
+
+func (w *Wire) write(p []byte) error {
+	if w.writeChecksum {
+		w.writeCRC = crc32.Update(w.writeCRC, castagnoli, p)
+	}
+	_, err := w.writer.Write(p)
+	return err
+}
+
+func (w *Wire) read(p []byte) error {
+	if _, err := io.ReadFull(w.reader, p); err != nil {
+		return err
+	}
+	if w.readChecksum {
+		w.readCRC = crc32.Update(w.readCRC, castagnoli, p)
 	}
+	return nil
 }
 
 func (w *Wire) Write(msg *Message) error {
 	offset := 0
+	w.writeCRC = 0
 
-	binary.LittleEndian.PutUint16(w.writeHeader[offset:], msg.MagicVersion)
+	binary.LittleEndian.PutUint16(w.writeHeader[offset:], w.writeMagic)
 	offset += int(unsafe.Sizeof(msg.MagicVersion))
 
 	binary.LittleEndian.PutUint32(w.writeHeader[offset:], msg.Seq)
@@ -45,16 +109,68 @@ func (w *Wire) Write(msg *Message) error {
 	binary.LittleEndian.PutUint32(w.writeHeader[offset:], msg.Size)
 	offset += int(unsafe.Sizeof(msg.Size))
 
-	binary.LittleEndian.PutUint32(w.writeHeader[offset:], uint32(len(msg.Data)))
+	length := len(msg.Data)
+	if isBatch(msg.Type) {
+		length += 4 + len(msg.Extents)*extentSize
+	}
+	if length > MaxFrameDataSize {
+		return fmt.Errorf("frame seq %v type %v has %v bytes of data, more than the maximum %v", msg.Seq, msg.Type, length, MaxFrameDataSize)
+	}
+	binary.LittleEndian.PutUint32(w.writeHeader[offset:], uint32(length))
 
-	if _, err := w.writer.Write(w.writeHeader); err != nil {
+	if err := w.write(w.writeHeader); err != nil {
 		return err
 	}
+	if w.writeDeadline && isIO(msg.Type) {
+		var timeout [8]byte
+		if !msg.Deadline.IsZero() {
+			// The time left rather than the deadline itself is sent, so the clocks of both ends need not agree.
+			// A request that already expired still gets a timeout, so it is not taken for one without deadline.
+			binary.LittleEndian.PutUint64(timeout[:], uint64(max(time.Until(msg.Deadline), 1)))
+		}
+		if err := w.write(timeout[:]); err != nil {
+			return err
+		}
+	}
+	if isBatch(msg.Type) {
+		if err := w.writeExtents(msg.Extents); err != nil {
+			return err
+		}
+	}
 	if len(msg.Data) > 0 {
-		if _, err := w.writer.Write(msg.Data); err != nil {
+		if err := w.write(msg.Data); err != nil {
+			return err
+		}
+	}
+	if w.writeChecksum {
+		var trailer [4]byte
+		binary.LittleEndian.PutUint32(trailer[:], w.writeCRC)
+		if _, err := w.writer.Write(trailer[:]); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+func (w *Wire) writeExtents(extents []Extent) error {
+	var buf [extentSize]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(extents)))
+	if err := w.write(buf[:4]); err != nil {
+		return err
+	}
+	for _, extent := range extents {
+		binary.LittleEndian.PutUint64(buf[:], uint64(extent.Offset))
+		binary.LittleEndian.PutUint32(buf[8:], extent.Length)
+		if err := w.write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush sends the messages written so far. Writers flush when they have no more messages to write, so messages
+// written in a burst share syscalls.
+func (w *Wire) Flush() error {
 	return w.writer.Flush()
 }
 
@@ -65,13 +181,14 @@ func (w *Wire) Read() (*Message, error) {
 	)
 
 	offset := 0
+	w.readCRC = 0
 
-	if _, err := io.ReadFull(w.reader, w.readHeader); err != nil {
+	if err := w.read(w.readHeader); err != nil {
 		return nil, err
 	}
 
 	msg.MagicVersion = binary.LittleEndian.Uint16(w.readHeader[offset:])
-	if msg.MagicVersion != MagicVersion {
+	if msg.MagicVersion != w.readMagic {
 		return nil, fmt.Errorf("wrong API version received: 0x%x", msg.MagicVersion)
 	}
 	offset += int(unsafe.Sizeof(msg.MagicVersion))
@@ -89,9 +206,41 @@ func (w *Wire) Read() (*Message, error) {
 	offset += int(unsafe.Sizeof(msg.Size))
 
 	length = binary.LittleEndian.Uint32(w.readHeader[offset:])
+	if length > MaxFrameDataSize {
+		return nil, fmt.Errorf("frame seq %v type %v has %v bytes of data, more than the maximum %v", msg.Seq, msg.Type, length, MaxFrameDataSize)
+	}
+	if w.readDeadline && isIO(msg.Type) {
+		var timeout [8]byte
+		if err := w.read(timeout[:]); err != nil {
+			return nil, err
+		}
+		if ns := binary.LittleEndian.Uint64(timeout[:]); ns != 0 {
+			msg.Deadline = time.Now().Add(time.Duration(ns))
+		}
+	}
 	if length > 0 {
-		msg.Data = make([]byte, length)
-		if _, err := io.ReadFull(w.reader, msg.Data); err != nil {
+		msg.Data, msg.buffer = getBuffer(int(length))
+		if err := w.read(msg.Data); err != nil {
+			msg.release()
+			return nil, err
+		}
+	}
+
+	if w.readChecksum {
+		var trailer [4]byte
+		if _, err := io.ReadFull(w.reader, trailer[:]); err != nil {
+			msg.release()
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(trailer[:]) != w.readCRC {
+			msg.release()
+			return nil, fmt.Errorf("%w: frame seq %v type %v", ErrChecksumMismatch, msg.Seq, msg.Type)
+		}
+	}
+
+	if isBatch(msg.Type) {
+		if err := readExtents(&msg); err != nil {
+			msg.release()
 			return nil, err
 		}
 	}
@@ -99,6 +248,38 @@ func (w *Wire) Read() (*Message, error) {
 	return &msg, nil
 }
 
+// readExtents moves the extents of a batched request from the head of its data to msg.Extents.
+func readExtents(msg *Message) error {
+	if len(msg.Data) < 4 {
+		return fmt.Errorf("batched request seq %v is too short", msg.Seq)
+	}
+	count := int(binary.LittleEndian.Uint32(msg.Data))
+	if count == 0 || count > MaxBatchExtents || len(msg.Data) < 4+count*extentSize {
+		return fmt.Errorf("invalid extent count %v of batched request seq %v", count, msg.Seq)
+	}
+
+	var total uint64
+	msg.Extents = make([]Extent, count)
+	for i := range msg.Extents {
+		extent := msg.Data[4+i*extentSize:]
+		msg.Extents[i].Offset = int64(binary.LittleEndian.Uint64(extent))
+		msg.Extents[i].Length = binary.LittleEndian.Uint32(extent[8:])
+		total += uint64(msg.Extents[i].Length)
+	}
+	msg.Data = msg.Data[4+count*extentSize:]
+
+	if total != uint64(msg.Size) {
+		return fmt.Errorf("extents of batched request seq %v add up to %v instead of %v", msg.Seq, total, msg.Size)
+	}
+	if msg.Type == TypeWriteBatch && uint64(len(msg.Data)) != total {
+		return fmt.Errorf("batched write seq %v has %v bytes of data instead of %v", msg.Seq, len(msg.Data), total)
+	}
+	if msg.Type == TypeReadBatch && len(msg.Data) != 0 {
+		return fmt.Errorf("batched read seq %v has unexpected data", msg.Seq)
+	}
+	return nil
+}
+
 func (w *Wire) Close() error {
 	return w.conn.Close()
 }
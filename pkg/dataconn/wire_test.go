@@ -0,0 +1,158 @@
+package dataconn
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type testProtocol struct {
+	version  uint16
+	features uint32
+}
+
+var testProtocols = []testProtocol{
+	{ProtocolVersion1, 0},
+	{ProtocolVersion2, 0},
+	{ProtocolVersion2, FeatureChecksum},
+	{ProtocolVersion2, FeatureChecksum | FeatureDeadline},
+}
+
+// encodeFrame returns the bytes of msg as written with the protocol.
+func encodeFrame(c *C, p testProtocol, msg *Message) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	w := NewWire(client)
+	w.setWriteProtocol(p.version, p.features)
+	go func() {
+		c.Check(w.Write(msg), IsNil)
+		c.Check(w.Flush(), IsNil)
+		_ = client.Close()
+	}()
+	raw, err := io.ReadAll(server)
+	c.Assert(err, IsNil)
+	return raw
+}
+
+// decodeFrame reads a frame from raw with the protocol.
+func decodeFrame(p testProtocol, raw []byte) (*Message, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_, _ = client.Write(raw)
+		_ = client.Close()
+	}()
+	w := NewWire(server)
+	w.setReadProtocol(p.version, p.features)
+	return w.Read()
+}
+
+func (s *TestSuite) TestWireRoundTrip(c *C) {
+	data := make([]byte, 6000)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	deadline := time.Now().Add(time.Hour)
+	messages := []*Message{
+		{Seq: 1, Type: TypeWrite, Offset: 4096, Size: uint32(len(data)), Data: data, Deadline: deadline},
+		{Seq: 2, Type: TypeRead, Offset: 8192, Size: 512},
+		{Seq: 3, Type: TypeResponse, Size: uint32(len(data)), Data: data},
+		{Seq: 4, Type: TypeWriteBatch, Size: 6000, Data: data,
+			Extents: []Extent{{Offset: 0, Length: 4096}, {Offset: 1 << 20, Length: 1904}}},
+		{Seq: 5, Type: TypeReadBatch, Size: 1024, Extents: []Extent{{Offset: 512, Length: 1024}}},
+	}
+
+	for _, p := range testProtocols {
+		for _, msg := range messages {
+			read, err := decodeFrame(p, encodeFrame(c, p, msg))
+			c.Assert(err, IsNil)
+			c.Assert(read.MagicVersion, Equals, magicOf(p.version))
+			c.Assert(read.Seq, Equals, msg.Seq)
+			c.Assert(read.Type, Equals, msg.Type)
+			c.Assert(read.Offset, Equals, msg.Offset)
+			c.Assert(read.Size, Equals, msg.Size)
+			c.Assert(len(read.Data), Equals, len(msg.Data))
+			if len(msg.Data) > 0 {
+				c.Assert(read.Data, DeepEquals, msg.Data)
+			}
+			c.Assert(read.Extents, DeepEquals, msg.Extents)
+			if p.features&FeatureDeadline != 0 && !msg.Deadline.IsZero() {
+				c.Assert(read.Deadline.Sub(deadline) < time.Minute, Equals, true)
+			} else {
+				c.Assert(read.Deadline.IsZero(), Equals, true)
+			}
+			read.release()
+		}
+	}
+}
+
+func (s *TestSuite) TestWireChecksumMismatch(c *C) {
+	p := testProtocol{ProtocolVersion2, FeatureChecksum}
+	msg := &Message{Seq: 7, Type: TypeWrite, Offset: 4096, Size: 4096, Data: make([]byte, 4096)}
+	raw := encodeFrame(c, p, msg)
+	headerSize := getRequestHeaderSize()
+
+	// Any flipped bit, in the header, the payload or the checksum itself, is caught.
+	for _, at := range []int{2, headerSize - 6, headerSize, headerSize + 2048, len(raw) - 1} {
+		corrupt := append([]byte(nil), raw...)
+		corrupt[at] ^= 0x10
+		_, err := decodeFrame(p, corrupt)
+		c.Assert(err, ErrorMatches, ".*"+ErrChecksumMismatch.Error()+".*", Commentf("byte %v", at))
+	}
+
+	// The same corruption goes unnoticed without checksums.
+	p = testProtocol{ProtocolVersion2, 0}
+	raw = encodeFrame(c, p, msg)
+	raw[headerSize+2048] ^= 0x10
+	read, err := decodeFrame(p, raw)
+	c.Assert(err, IsNil)
+	c.Assert(read.Data[2048], Equals, byte(0x10))
+}
+
+func (s *TestSuite) TestWireFrameTooLarge(c *C) {
+	for _, p := range testProtocols {
+		raw := encodeFrame(c, p, &Message{Seq: 1, Type: TypeResponse, Size: 16, Data: make([]byte, 16)})
+		// Patch the length of the data in the header, which is not checked against the checksum yet when it is read.
+		binary.LittleEndian.PutUint32(raw[getRequestHeaderSize()-4:], MaxFrameDataSize+1)
+		_, err := decodeFrame(p, raw)
+		c.Assert(err, ErrorMatches, ".*more than the maximum.*")
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	err := NewWire(client).Write(&Message{Type: TypeWrite, Data: make([]byte, MaxFrameDataSize+1)})
+	c.Assert(err, ErrorMatches, ".*more than the maximum.*")
+}
+
+func (s *TestSuite) TestClientChecksum(c *C) {
+	disk := newTestDisk()
+	ts := newTestServer(c, disk)
+	defer ts.close()
+
+	// Checksums are only used if asked for.
+	client := newTestClient(c, ts, 1, DefaultFeatures, ClientOptions{})
+	c.Assert(client.Features()&FeatureChecksum, Equals, uint32(0))
+	client.Close()
+
+	client = newTestClient(c, ts, 2, DefaultFeatures|FeatureChecksum, ClientOptions{})
+	defer client.Close()
+	c.Assert(client.Features()&FeatureChecksum, Equals, FeatureChecksum)
+
+	data := make([]byte, 16384)
+	for i := range data {
+		data[i] = byte(i % 241)
+	}
+	_, err := client.WriteAt(data, 0)
+	c.Assert(err, IsNil)
+	buf := make([]byte, len(data))
+	_, err = client.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, data)
+
+	_, err = client.ReadAt(make([]byte, MaxFrameDataSize+1), 0)
+	c.Assert(err, ErrorMatches, ".*larger than the maximum.*")
+}
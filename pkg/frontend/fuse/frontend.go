@@ -0,0 +1,254 @@
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	frontendName = "fuse"
+
+	MountDirectory = "/var/run/longhorn-fuse"
+
+	devicePath = "/dev/fuse"
+	// connectionsDirectory is where the fusectl file system lets a FUSE connection be aborted
+	connectionsDirectory = "/sys/fs/fuse/connections"
+	workers              = 8
+)
+
+func New(snapshotDirectory string) *Fuse {
+	return &Fuse{snapshotDirectory: snapshotDirectory, fd: -1}
+}
+
+// Fuse mounts a FUSE file system that presents the volume as the file `volume`. The volume cannot be truncated, so
+// it is written with e.g. `dd conv=notrunc`, and punching a hole unmaps the range. With a snapshot directory,
+// which is the directory of a replica of the volume on this node, the snapshots of the replica are presented
+// read-only under `snapshots/` as well.
+type Fuse struct {
+	Volume     string
+	Size       int64
+	SectorSize int
+
+	isUp              bool
+	snapshotDirectory string
+	mountPath         string
+	// connection is the number of the FUSE connection in connectionsDirectory
+	connection uint32
+	startTime  time.Time
+
+	// fdLock guards fd, which is closed by the last worker once the file system is unmounted
+	fdLock sync.Mutex
+	fd     int
+
+	// lock guards rwu and Size. The requests hold it for reading while they are served.
+	lock sync.RWMutex
+	rwu  types.ReaderWriterUnmapperAt
+
+	// nodeLock guards the nodes of the snapshots and their handles
+	nodeLock      sync.Mutex
+	snapshotNodes map[string]uint64
+	snapshotNames map[uint64]string
+	nextNodeID    uint64
+	snapshots     map[string]*snapshotFile
+	handles       map[uint64]*snapshotFile
+	nextHandle    uint64
+}
+
+func (f *Fuse) FrontendName() string {
+	return frontendName
+}
+
+func (f *Fuse) Init(name string, size, sectorSize int64) error {
+	f.Volume = name
+	f.Size = size
+	f.SectorSize = int(sectorSize)
+
+	return f.Shutdown()
+}
+
+func (f *Fuse) Startup(rwu types.ReaderWriterUnmapperAt) error {
+	if f.snapshotDirectory != "" {
+		if st, err := os.Stat(f.snapshotDirectory); err != nil || !st.IsDir() {
+			return fmt.Errorf("invalid snapshot directory %v", f.snapshotDirectory)
+		}
+	}
+
+	mountPath := f.GetMountPath()
+	// A controller that crashed may have left its mount behind.
+	_ = unix.Unmount(mountPath, unix.MNT_DETACH)
+	if err := os.MkdirAll(mountPath, 0755); err != nil {
+		return errors.Wrapf(err, "cannot create directory %v", mountPath)
+	}
+
+	fd, err := unix.Open(devicePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %v", devicePath)
+	}
+	options := fmt.Sprintf("fd=%d,rootmode=%o,user_id=%d,group_id=%d,allow_other,default_permissions", fd,
+		syscall.S_IFDIR, os.Getuid(), os.Getgid())
+	if err := unix.Mount("longhorn", mountPath, "fuse.longhorn", unix.MS_NOSUID|unix.MS_NODEV, options); err != nil {
+		_ = unix.Close(fd)
+		return errors.Wrapf(err, "failed to mount FUSE file system on %v", mountPath)
+	}
+
+	f.lock.Lock()
+	f.rwu = rwu
+	f.mountPath = mountPath
+	f.startTime = time.Now()
+	f.snapshotNodes = map[string]uint64{}
+	f.snapshotNames = map[uint64]string{}
+	f.nextNodeID = firstSnapshotNodeID
+	f.snapshots = map[string]*snapshotFile{}
+	f.handles = map[uint64]*snapshotFile{}
+	f.lock.Unlock()
+
+	f.fdLock.Lock()
+	f.fd = fd
+	f.fdLock.Unlock()
+	f.serve(fd)
+
+	// The kernel waits for the workers to answer the stat.
+	var st unix.Stat_t
+	if err := unix.Stat(mountPath, &st); err != nil {
+		logrus.WithError(err).Warnf("Failed to get the FUSE connection of %v", mountPath)
+	}
+	f.lock.Lock()
+	f.connection = unix.Minor(st.Dev)
+	f.lock.Unlock()
+
+	f.isUp = true
+	logrus.Infof("Mounted FUSE file system of %v on %v", f.Volume, mountPath)
+
+	return nil
+}
+
+func (f *Fuse) Shutdown() error {
+	f.lock.Lock()
+	mountPath, rwu := f.mountPath, f.rwu
+	f.mountPath = ""
+	f.lock.Unlock()
+
+	if mountPath != "" {
+		logrus.Infof("Shutting down FUSE file system of %v", f.Volume)
+		if err := f.unmount(mountPath); err != nil {
+			logrus.WithError(err).Warnf("Failed to unmount %v", mountPath)
+		}
+		// Wait for the requests in flight, so none reaches the volume once it is down. Those still to come fail.
+		f.lock.Lock()
+		f.rwu = nil
+		f.lock.Unlock()
+		if rwu != nil {
+			f.closeSnapshots()
+		}
+	}
+	f.isUp = false
+
+	return nil
+}
+
+// unmount unmounts the file system. If some files are still open, the connection is aborted so they fail.
+func (f *Fuse) unmount(mountPath string) error {
+	err := unix.Unmount(mountPath, 0)
+	if err == nil || errors.Is(err, unix.EINVAL) {
+		return nil
+	}
+	if !errors.Is(err, unix.EBUSY) {
+		return err
+	}
+	abort := filepath.Join(connectionsDirectory, fmt.Sprint(f.connection), "abort")
+	if err := os.WriteFile(abort, []byte("1"), 0200); err != nil {
+		logrus.WithError(err).Warnf("Failed to abort the FUSE connection of %v, its open files fail once the volume is down", mountPath)
+	}
+	return unix.Unmount(mountPath, unix.MNT_DETACH)
+}
+
+func (f *Fuse) State() types.State {
+	if f.isUp {
+		return types.StateUp
+	}
+	return types.StateDown
+}
+
+func (f *Fuse) Endpoint() string {
+	if f.isUp {
+		return f.GetMountPath()
+	}
+	return ""
+}
+
+func (f *Fuse) GetMountPath() string {
+	if f.Volume == "" {
+		panic("Invalid volume name")
+	}
+	return filepath.Join(MountDirectory, f.Volume)
+}
+
+func (f *Fuse) Upgrade(name string, size, sectorSize int64, rwu types.ReaderWriterUnmapperAt) error {
+	return fmt.Errorf("upgrade is not supported")
+}
+
+// Expand sets the size of the volume file, and drops the attributes the kernel cached for it.
+func (f *Fuse) Expand(size int64) error {
+	f.lock.Lock()
+	f.Size = size
+	f.lock.Unlock()
+
+	f.fdLock.Lock()
+	defer f.fdLock.Unlock()
+	if f.fd >= 0 {
+		inval := make([]byte, 24)
+		le.PutUint64(inval[0:], volumeNodeID)
+		// A negative offset only drops the attributes.
+		le.PutUint64(inval[8:], ^uint64(0))
+		if err := writeNotify(f.fd, notifyInvalInode, inval); err != nil {
+			logrus.WithError(err).Warnf("Failed to invalidate the size of the FUSE volume file of %v", f.Volume)
+		}
+	}
+	return nil
+}
+
+// serve starts the workers reading the requests of the kernel. They stop once the file system is unmounted, and
+// the last one closes fd.
+func (f *Fuse) serve(fd int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, readBufferSize)
+			for {
+				n, err := unix.Read(fd, buf)
+				if err != nil {
+					switch {
+					case errors.Is(err, unix.EINTR), errors.Is(err, unix.EAGAIN), errors.Is(err, unix.ENOENT):
+						// ENOENT tells the request was interrupted before it was read.
+						continue
+					case !errors.Is(err, unix.ENODEV):
+						logrus.WithError(err).Errorf("Failed to read FUSE request of %v", f.Volume)
+					}
+					return
+				}
+				f.handle(fd, buf[:n])
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		f.fdLock.Lock()
+		defer f.fdLock.Unlock()
+		if f.fd == fd {
+			f.fd = -1
+		}
+		_ = unix.Close(fd)
+	}()
+}
@@ -0,0 +1,545 @@
+package fuse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/replica"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
+)
+
+const (
+	rootNodeID          = 1
+	volumeNodeID        = 2
+	snapshotsNodeID     = 3
+	firstSnapshotNodeID = 4
+
+	VolumeFileName   = "volume"
+	SnapshotsDirName = "snapshots"
+
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+	fallocZeroRange = 0x10
+
+	// maxRangeLength is the largest range unmapped or zeroed at once
+	maxRangeLength = 1 << 30
+)
+
+// snapshotFile is a snapshot opened for reading. It is shared by the handles of the snapshot.
+type snapshotFile struct {
+	name    string
+	replica *replica.Replica
+	size    int64
+	refs    int
+}
+
+// handle serves the request of the kernel in buf, and replies on fd.
+func (f *Fuse) handle(fd int, buf []byte) {
+	req, ok := parseRequest(buf)
+	if !ok {
+		logrus.Errorf("Invalid FUSE request of %v bytes for %v", len(buf), f.Volume)
+		return
+	}
+
+	// The lock keeps the volume up until the request is served.
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var payload []byte
+	var errno syscall.Errno
+	switch {
+	case req.opcode == opForget || req.opcode == opBatchForget || req.opcode == opInterrupt:
+		// Nodes are never dropped, and requests not interrupted. These have no reply.
+		return
+	case f.rwu == nil:
+		// The volume is down, and the file system is being unmounted.
+		errno = syscall.EIO
+	default:
+		payload, errno = f.handleRequest(req)
+	}
+
+	if err := writeReply(fd, req.unique, errno, payload); err != nil && !errors.Is(err, syscall.ENOENT) {
+		// ENOENT tells the request was interrupted meanwhile.
+		logrus.WithError(err).Warnf("Failed to reply to FUSE request %v of %v", req.opcode, f.Volume)
+	}
+}
+
+func (f *Fuse) handleRequest(req *request) (payload []byte, errno syscall.Errno) {
+	switch req.opcode {
+	case opInit:
+		payload, errno = f.init(req)
+	case opDestroy:
+	case opLookup:
+		payload, errno = f.lookup(req)
+	case opGetattr:
+		payload, errno = f.getattr(req.nodeID)
+	case opSetattr:
+		payload, errno = f.setattr(req)
+	case opOpen:
+		payload, errno = f.open(req)
+	case opRead:
+		payload, errno = f.read(req)
+	case opWrite:
+		payload, errno = f.write(req)
+	case opFallocate:
+		errno = f.fallocate(req)
+	case opFsync:
+		errno = f.fsync(req)
+	case opFlush, opFsyncdir, opReleasedir:
+	case opRelease:
+		f.release(req)
+	case opOpendir:
+		if req.nodeID != rootNodeID && !(req.nodeID == snapshotsNodeID && f.snapshotDirectory != "") {
+			errno = syscall.ENOTDIR
+			break
+		}
+		payload = make([]byte, openOutSize)
+	case opReaddir:
+		payload, errno = f.readdir(req)
+	case opStatfs:
+		payload = f.statfs()
+	case opCreate, opMknod, opMkdir, opSymlink, opLink, opUnlink, opRmdir, opRename, opRename2, opSetxattr,
+		opRemovexattr:
+		// The files are those of the volume, none can be created, removed or renamed.
+		errno = syscall.EPERM
+	default:
+		errno = syscall.ENOSYS
+	}
+	return payload, errno
+}
+
+func (f *Fuse) init(req *request) ([]byte, syscall.Errno) {
+	if len(req.body) < 16 {
+		return nil, syscall.EINVAL
+	}
+	major, minor := le.Uint32(req.body[0:]), le.Uint32(req.body[4:])
+	maxReadahead, flags := le.Uint32(req.body[8:]), le.Uint32(req.body[12:])
+	if major != kernelVersion || minor < kernelMinVersion {
+		logrus.Errorf("Unsupported FUSE kernel protocol %v.%v for %v, %v.%v or later is needed", major, minor,
+			f.Volume, kernelVersion, kernelMinVersion)
+		return nil, syscall.EPROTO
+	}
+
+	out := make([]byte, initOutSize)
+	le.PutUint32(out[0:], kernelVersion)
+	le.PutUint32(out[4:], min(minor, kernelMaxVersion))
+	le.PutUint32(out[8:], maxReadahead)
+	le.PutUint16(out[16:], 16)
+	le.PutUint16(out[18:], 12)
+	le.PutUint32(out[24:], 1)
+	if flags&initMaxPages != 0 {
+		le.PutUint32(out[12:], flags&(initAsyncRead|initBigWrites|initMaxPages))
+		le.PutUint32(out[20:], maxWrite)
+		le.PutUint16(out[28:], maxWrite/pageSize)
+	} else {
+		le.PutUint32(out[12:], flags&(initAsyncRead|initBigWrites))
+		le.PutUint32(out[20:], smallMaxWrite)
+	}
+	return out, 0
+}
+
+func (f *Fuse) lookup(req *request) ([]byte, syscall.Errno) {
+	name := strings.TrimRight(string(req.body), "\x00")
+	var id uint64
+	switch {
+	case req.nodeID == rootNodeID && name == VolumeFileName:
+		id = volumeNodeID
+	case req.nodeID == rootNodeID && name == SnapshotsDirName && f.snapshotDirectory != "":
+		id = snapshotsNodeID
+	case req.nodeID == snapshotsNodeID:
+		if _, err := os.Stat(f.snapshotPath(name)); err != nil {
+			return nil, syscall.ENOENT
+		}
+		id = f.snapshotNodeID(name)
+	default:
+		return nil, syscall.ENOENT
+	}
+	a, errno := f.attr(id)
+	if errno != 0 {
+		return nil, errno
+	}
+	return entryOut(a), 0
+}
+
+func (f *Fuse) getattr(id uint64) ([]byte, syscall.Errno) {
+	a, errno := f.attr(id)
+	if errno != 0 {
+		return nil, errno
+	}
+	return attrOut(a), 0
+}
+
+func (f *Fuse) attr(id uint64) (*attr, syscall.Errno) {
+	a := &attr{ino: id, nlink: 1, mtime: f.startTime, uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+	switch id {
+	case rootNodeID:
+		a.mode, a.nlink = syscall.S_IFDIR|0755, 2
+		if f.snapshotDirectory != "" {
+			a.nlink = 3
+		}
+	case volumeNodeID:
+		a.mode, a.size = syscall.S_IFREG|0600, uint64(f.Size)
+	case snapshotsNodeID:
+		if f.snapshotDirectory == "" {
+			return nil, syscall.ENOENT
+		}
+		a.mode, a.nlink = syscall.S_IFDIR|0555, 2
+	default:
+		name, ok := f.snapshotName(id)
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		st, err := os.Stat(f.snapshotPath(name))
+		if err != nil {
+			return nil, syscall.ENOENT
+		}
+		info, err := replica.ReadInfo(f.snapshotDirectory)
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to read the volume info of replica %v", f.snapshotDirectory)
+			return nil, syscall.EIO
+		}
+		a.mode, a.size, a.mtime = syscall.S_IFREG|0400, uint64(info.Size), st.ModTime()
+	}
+	return a, 0
+}
+
+// setattr only accepts the times, which are not kept, and the current size. The volume cannot be truncated, so
+// `dd` needs conv=notrunc.
+func (f *Fuse) setattr(req *request) ([]byte, syscall.Errno) {
+	if len(req.body) < 24 {
+		return nil, syscall.EINVAL
+	}
+	valid := le.Uint32(req.body[0:])
+	if valid&setattrOwner != 0 {
+		return nil, syscall.EPERM
+	}
+	a, errno := f.attr(req.nodeID)
+	if errno != 0 {
+		return nil, errno
+	}
+	if valid&setattrSize != 0 && le.Uint64(req.body[16:]) != a.size {
+		if req.nodeID != volumeNodeID {
+			return nil, syscall.EROFS
+		}
+		return nil, syscall.EPERM
+	}
+	return attrOut(a), 0
+}
+
+func (f *Fuse) open(req *request) ([]byte, syscall.Errno) {
+	if len(req.body) < 4 {
+		return nil, syscall.EINVAL
+	}
+	flags := int(le.Uint32(req.body[0:]))
+	out := make([]byte, openOutSize)
+	switch req.nodeID {
+	case volumeNodeID:
+		// The data of the volume is not cached, so writes reach the replicas before they complete.
+		le.PutUint32(out[8:], openDirectIO)
+		return out, 0
+	case rootNodeID, snapshotsNodeID:
+		return nil, syscall.EISDIR
+	}
+
+	name, ok := f.snapshotName(req.nodeID)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, syscall.EROFS
+	}
+	fh, err := f.openSnapshot(name)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to open snapshot %v of %v", name, f.Volume)
+		return nil, syscall.EIO
+	}
+	le.PutUint64(out[0:], fh)
+	le.PutUint32(out[8:], openKeepCache)
+	return out, 0
+}
+
+func (f *Fuse) read(req *request) ([]byte, syscall.Errno) {
+	if len(req.body) < 24 {
+		return nil, syscall.EINVAL
+	}
+	fh, off, size := le.Uint64(req.body[0:]), int64(le.Uint64(req.body[8:])), int64(le.Uint32(req.body[16:]))
+
+	var r interface {
+		ReadAt([]byte, int64) (int, error)
+	}
+	var fileSize int64
+	if req.nodeID == volumeNodeID {
+		r, fileSize = f.rwu, f.Size
+	} else {
+		s := f.getSnapshot(fh)
+		if s == nil {
+			return nil, syscall.EBADF
+		}
+		r, fileSize = s.replica, s.size
+	}
+	if off < 0 {
+		return nil, syscall.EINVAL
+	}
+	if off >= fileSize {
+		return nil, 0
+	}
+	buf := make([]byte, min(size, fileSize-off))
+	if _, err := r.ReadAt(buf, off); err != nil {
+		logrus.WithError(err).Warnf("Failed to read %v bytes at %v of %v", len(buf), off, f.Volume)
+		return nil, errno(err)
+	}
+	return buf, 0
+}
+
+func (f *Fuse) write(req *request) ([]byte, syscall.Errno) {
+	if len(req.body) < 40 {
+		return nil, syscall.EINVAL
+	}
+	if req.nodeID != volumeNodeID {
+		return nil, syscall.EROFS
+	}
+	off, size := int64(le.Uint64(req.body[8:])), int(le.Uint32(req.body[16:]))
+	data := req.body[40:]
+	if size > len(data) || off < 0 {
+		return nil, syscall.EINVAL
+	}
+	// The volume does not grow, the part beyond it is not written.
+	volumeSize := f.Size
+	if off >= volumeSize {
+		return nil, syscall.ENOSPC
+	}
+	data = data[:min(int64(size), volumeSize-off)]
+	if _, err := f.rwu.WriteAt(data, off); err != nil {
+		logrus.WithError(err).Warnf("Failed to write %v bytes at %v of %v", len(data), off, f.Volume)
+		return nil, errno(err)
+	}
+	out := make([]byte, writeOutSize)
+	le.PutUint32(out, uint32(len(data)))
+	return out, 0
+}
+
+// fallocate punches a hole with an unmap, and zeroes a range with a write zeroes. Like a discard, a punched range
+// may read back the data of the snapshots below the head. Preallocating is not supported, the volume is thin.
+func (f *Fuse) fallocate(req *request) syscall.Errno {
+	if len(req.body) < 28 {
+		return syscall.EINVAL
+	}
+	if req.nodeID != volumeNodeID {
+		return syscall.EROFS
+	}
+	off, length, mode := int64(le.Uint64(req.body[8:])), int64(le.Uint64(req.body[16:])), le.Uint32(req.body[24:])
+	if off < 0 || length <= 0 {
+		return syscall.EINVAL
+	}
+
+	var op func(length uint32, off int64) (int, error)
+	switch mode {
+	case fallocPunchHole | fallocKeepSize:
+		op = f.rwu.UnmapAt
+	case fallocZeroRange, fallocZeroRange | fallocKeepSize:
+		op = func(length uint32, off int64) (int, error) {
+			return util.WriteZeroesAt(f.rwu, length, off)
+		}
+	default:
+		return syscall.EOPNOTSUPP
+	}
+	volumeSize := f.Size
+	if mode&fallocKeepSize == 0 && off+length > volumeSize {
+		return syscall.EFBIG
+	}
+	end := min(off+length, volumeSize)
+	for off < end {
+		n := min(end-off, maxRangeLength)
+		if _, err := op(uint32(n), off); err != nil {
+			logrus.WithError(err).Warnf("Failed to fallocate %v bytes at %v of %v with mode 0x%x", n, off, f.Volume, mode)
+			return errno(err)
+		}
+		off += n
+	}
+	return 0
+}
+
+func (f *Fuse) fsync(req *request) syscall.Errno {
+	if req.nodeID != volumeNodeID {
+		return 0
+	}
+	if flusher, ok := f.rwu.(types.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			logrus.WithError(err).Warnf("Failed to flush %v", f.Volume)
+			return errno(err)
+		}
+	}
+	return 0
+}
+
+func (f *Fuse) readdir(req *request) ([]byte, syscall.Errno) {
+	if len(req.body) < 20 {
+		return nil, syscall.EINVAL
+	}
+	off, size := le.Uint64(req.body[8:]), int(le.Uint32(req.body[16:]))
+
+	type entry struct {
+		ino  uint64
+		name string
+		typ  uint32
+	}
+	var entries []entry
+	switch req.nodeID {
+	case rootNodeID:
+		entries = []entry{{rootNodeID, ".", syscall.DT_DIR}, {rootNodeID, "..", syscall.DT_DIR},
+			{volumeNodeID, VolumeFileName, syscall.DT_REG}}
+		if f.snapshotDirectory != "" {
+			entries = append(entries, entry{snapshotsNodeID, SnapshotsDirName, syscall.DT_DIR})
+		}
+	case snapshotsNodeID:
+		names, err := f.listSnapshots()
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to list the snapshots in %v", f.snapshotDirectory)
+			return nil, syscall.EIO
+		}
+		entries = []entry{{snapshotsNodeID, ".", syscall.DT_DIR}, {rootNodeID, "..", syscall.DT_DIR}}
+		for _, name := range names {
+			entries = append(entries, entry{f.snapshotNodeID(name), name, syscall.DT_REG})
+		}
+	default:
+		return nil, syscall.ENOTDIR
+	}
+
+	var out []byte
+	for i := off; i < uint64(len(entries)); i++ {
+		var ok bool
+		if out, ok = appendDirent(out, size, entries[i].ino, i+1, entries[i].name, entries[i].typ); !ok {
+			break
+		}
+	}
+	return out, 0
+}
+
+func (f *Fuse) statfs() []byte {
+	out := make([]byte, statfsOutSize)
+	blocks := uint64(f.Size) / pageSize
+	le.PutUint64(out[0:], blocks)
+	le.PutUint32(out[40:], pageSize)
+	le.PutUint32(out[44:], 255)
+	le.PutUint32(out[48:], pageSize)
+	return out
+}
+
+func (f *Fuse) snapshotPath(name string) string {
+	if name == "" || strings.ContainsRune(name, '/') || name == "." || name == ".." {
+		return ""
+	}
+	return filepath.Join(f.snapshotDirectory, diskutil.GenerateSnapshotDiskName(name))
+}
+
+// listSnapshots returns the names of the snapshots in the replica directory.
+func (f *Fuse) listSnapshots() ([]string, error) {
+	files, err := os.ReadDir(f.snapshotDirectory)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		name, err := diskutil.GetSnapshotNameFromDiskName(file.Name())
+		if err != nil || file.IsDir() {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// snapshotNodeID returns the node of a snapshot. A snapshot keeps its node once it is looked up.
+func (f *Fuse) snapshotNodeID(name string) uint64 {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+	if id, ok := f.snapshotNodes[name]; ok {
+		return id
+	}
+	id := f.nextNodeID
+	f.nextNodeID++
+	f.snapshotNodes[name] = id
+	f.snapshotNames[id] = name
+	return id
+}
+
+func (f *Fuse) snapshotName(id uint64) (string, bool) {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+	name, ok := f.snapshotNames[id]
+	return name, ok
+}
+
+// openSnapshot opens a snapshot with replica.OpenSnapshot, or shares the replica it is already open with, and
+// returns the handle to read it with.
+func (f *Fuse) openSnapshot(name string) (uint64, error) {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+
+	s, ok := f.snapshots[name]
+	if !ok {
+		r, err := replica.OpenSnapshot(f.snapshotDirectory, name)
+		if err != nil {
+			return 0, err
+		}
+		s = &snapshotFile{name: name, replica: r, size: r.Info().Size}
+		f.snapshots[name] = s
+	}
+	s.refs++
+	f.nextHandle++
+	f.handles[f.nextHandle] = s
+	return f.nextHandle, nil
+}
+
+func (f *Fuse) getSnapshot(fh uint64) *snapshotFile {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+	return f.handles[fh]
+}
+
+func (f *Fuse) release(req *request) {
+	if len(req.body) < 8 || req.nodeID == volumeNodeID {
+		return
+	}
+	fh := le.Uint64(req.body[0:])
+
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+	s, ok := f.handles[fh]
+	if !ok {
+		return
+	}
+	delete(f.handles, fh)
+	if s.refs--; s.refs == 0 {
+		delete(f.snapshots, s.name)
+		s.replica.CloseWithoutWritingMetaData()
+	}
+}
+
+// closeSnapshots closes the snapshots still open once the file system is unmounted.
+func (f *Fuse) closeSnapshots() {
+	f.nodeLock.Lock()
+	defer f.nodeLock.Unlock()
+	for name, s := range f.snapshots {
+		s.replica.CloseWithoutWritingMetaData()
+		delete(f.snapshots, name)
+	}
+	f.handles = map[uint64]*snapshotFile{}
+}
+
+// errno returns the error number a request fails with for an error of the volume.
+func errno(err error) syscall.Errno {
+	if errors.Is(err, types.ErrNoSpaceLeftOnDevice) {
+		return syscall.ENOSPC
+	}
+	return syscall.EIO
+}
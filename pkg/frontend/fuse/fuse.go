@@ -0,0 +1,193 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var le = binary.LittleEndian
+
+// The FUSE kernel protocol, see include/uapi/linux/fuse.h
+const (
+	kernelVersion = 7
+	// kernelMinVersion is the first minor version the structures below are laid out for, and the one with the
+	// full size INIT reply
+	kernelMinVersion = 23
+	kernelMaxVersion = 31
+
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opReadlink    = 5
+	opSymlink     = 6
+	opMknod       = 8
+	opMkdir       = 9
+	opUnlink      = 10
+	opRmdir       = 11
+	opRename      = 12
+	opLink        = 13
+	opOpen        = 14
+	opRead        = 15
+	opWrite       = 16
+	opStatfs      = 17
+	opRelease     = 18
+	opFsync       = 20
+	opSetxattr    = 21
+	opRemovexattr = 24
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opFsyncdir    = 30
+	opCreate      = 35
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+	opFallocate   = 43
+	opRename2     = 45
+
+	// notifyInvalInode is the notification that drops the cached attributes and data of an inode
+	notifyInvalInode = 2
+
+	initAsyncRead = 1 << 0
+	initBigWrites = 1 << 5
+	initMaxPages  = 1 << 22
+
+	// Attributes of a SETATTR
+	setattrMode  = 1 << 0
+	setattrUID   = 1 << 1
+	setattrGID   = 1 << 2
+	setattrSize  = 1 << 3
+	setattrOwner = setattrMode | setattrUID | setattrGID
+
+	openDirectIO  = 1 << 0
+	openKeepCache = 1 << 1
+
+	inHeaderSize  = 40
+	outHeaderSize = 16
+	initOutSize   = 64
+	attrSize      = 88
+	entryOutSize  = 40 + attrSize
+	attrOutSize   = 16 + attrSize
+	openOutSize   = 16
+	writeOutSize  = 8
+	statfsOutSize = 80
+	direntSize    = 24
+
+	// maxWrite is the largest read or write. Kernels without max_pages use smallMaxWrite, their default.
+	maxWrite      = 1 << 20
+	smallMaxWrite = 128 << 10
+	pageSize      = 4096
+	// readBufferSize fits the largest write with its headers
+	readBufferSize = maxWrite + pageSize
+
+	// validity is how long the kernel caches the names and attributes
+	validity = time.Second
+)
+
+// request is a request of the kernel, read from /dev/fuse.
+type request struct {
+	opcode uint32
+	unique uint64
+	nodeID uint64
+	body   []byte
+}
+
+func parseRequest(buf []byte) (*request, bool) {
+	if len(buf) < inHeaderSize || int(le.Uint32(buf)) != len(buf) {
+		return nil, false
+	}
+	return &request{
+		opcode: le.Uint32(buf[4:]),
+		unique: le.Uint64(buf[8:]),
+		nodeID: le.Uint64(buf[16:]),
+		body:   buf[inHeaderSize:],
+	}, true
+}
+
+// attr are the attributes of a node.
+type attr struct {
+	ino   uint64
+	size  uint64
+	mode  uint32
+	nlink uint32
+	mtime time.Time
+	uid   uint32
+	gid   uint32
+}
+
+func (a *attr) encode(b []byte) {
+	le.PutUint64(b[0:], a.ino)
+	le.PutUint64(b[8:], a.size)
+	le.PutUint64(b[16:], (a.size+511)/512)
+	sec, nsec := uint64(a.mtime.Unix()), uint32(a.mtime.Nanosecond())
+	for i := 0; i < 3; i++ {
+		le.PutUint64(b[24+8*i:], sec)
+		le.PutUint32(b[48+4*i:], nsec)
+	}
+	le.PutUint32(b[60:], a.mode)
+	le.PutUint32(b[64:], a.nlink)
+	le.PutUint32(b[68:], a.uid)
+	le.PutUint32(b[72:], a.gid)
+	le.PutUint32(b[80:], pageSize)
+}
+
+func entryOut(a *attr) []byte {
+	out := make([]byte, entryOutSize)
+	le.PutUint64(out[0:], a.ino)
+	le.PutUint64(out[16:], uint64(validity/time.Second))
+	le.PutUint64(out[24:], uint64(validity/time.Second))
+	a.encode(out[40:])
+	return out
+}
+
+func attrOut(a *attr) []byte {
+	out := make([]byte, attrOutSize)
+	le.PutUint64(out[0:], uint64(validity/time.Second))
+	a.encode(out[16:])
+	return out
+}
+
+// appendDirent appends a directory entry to the READDIR reply buf. It returns false once the entry does not fit in
+// size bytes.
+func appendDirent(buf []byte, size int, ino, off uint64, name string, typ uint32) ([]byte, bool) {
+	length := (direntSize + len(name) + 7) &^ 7
+	if len(buf)+length > size {
+		return buf, false
+	}
+	entry := make([]byte, length)
+	le.PutUint64(entry[0:], ino)
+	le.PutUint64(entry[8:], off)
+	le.PutUint32(entry[16:], uint32(len(name)))
+	le.PutUint32(entry[20:], typ)
+	copy(entry[direntSize:], name)
+	return append(buf, entry...), true
+}
+
+// writeReply replies to the request unique. A negative errno is the error, as the kernel expects it.
+func writeReply(fd int, unique uint64, errno syscall.Errno, payload []byte) error {
+	header := make([]byte, outHeaderSize)
+	if errno != 0 {
+		payload = nil
+	}
+	le.PutUint32(header[0:], uint32(outHeaderSize+len(payload)))
+	le.PutUint32(header[4:], uint32(-int32(errno)))
+	le.PutUint64(header[8:], unique)
+	_, err := unix.Writev(fd, [][]byte{header, payload})
+	return err
+}
+
+// writeNotify sends a notification to the kernel. Notifications have no unique, and the code in place of the
+// error.
+func writeNotify(fd int, code int32, payload []byte) error {
+	header := make([]byte, outHeaderSize)
+	le.PutUint32(header[0:], uint32(outHeaderSize+len(payload)))
+	le.PutUint32(header[4:], uint32(code))
+	_, err := unix.Writev(fd, [][]byte{header, payload})
+	return err
+}
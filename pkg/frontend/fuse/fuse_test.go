@@ -0,0 +1,492 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/mem"
+	"github.com/longhorn/longhorn-engine/pkg/replica"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const testVolumeSize = 1 << 20
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+// testFuse serves the requests of a file system that is not mounted. A socket pair stands for /dev/fuse, the test
+// reading the replies on the other end.
+type testFuse struct {
+	c       *C
+	f       *Fuse
+	replica *mem.Replica
+	fd      int
+	kernel  int
+	unique  uint64
+}
+
+func newTestFuse(c *C, snapshotDirectory string) *testFuse {
+	r, err := mem.New().AddReplica("r", testVolumeSize)
+	c.Assert(err, IsNil)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	c.Assert(err, IsNil)
+
+	f := New(snapshotDirectory)
+	f.Volume, f.Size = "test", testVolumeSize
+	f.rwu = r
+	f.startTime = time.Now()
+	f.snapshotNodes = map[string]uint64{}
+	f.snapshotNames = map[uint64]string{}
+	f.nextNodeID = firstSnapshotNodeID
+	f.snapshots = map[string]*snapshotFile{}
+	f.handles = map[uint64]*snapshotFile{}
+	f.fd = fds[0]
+	return &testFuse{c: c, f: f, replica: r, fd: fds[0], kernel: fds[1]}
+}
+
+func (t *testFuse) close() {
+	t.f.closeSnapshots()
+	_ = unix.Close(t.fd)
+	_ = unix.Close(t.kernel)
+}
+
+// readMessage reads a reply or notification of the file system, and returns its error or code and its payload.
+func (t *testFuse) readMessage() (uint64, int32, []byte) {
+	buf := make([]byte, readBufferSize)
+	n, err := unix.Read(t.kernel, buf)
+	t.c.Assert(err, IsNil)
+	t.c.Assert(n >= outHeaderSize, Equals, true)
+	t.c.Assert(int(le.Uint32(buf)), Equals, n)
+	return le.Uint64(buf[8:]), int32(le.Uint32(buf[4:])), buf[outHeaderSize:n]
+}
+
+// request sends a request of the kernel and returns the errno and payload of the reply.
+func (t *testFuse) request(opcode uint32, nodeID uint64, body []byte) (syscall.Errno, []byte) {
+	t.unique++
+	buf := make([]byte, inHeaderSize+len(body))
+	le.PutUint32(buf[0:], uint32(len(buf)))
+	le.PutUint32(buf[4:], opcode)
+	le.PutUint64(buf[8:], t.unique)
+	le.PutUint64(buf[16:], nodeID)
+	copy(buf[inHeaderSize:], body)
+	t.f.handle(t.fd, buf)
+
+	unique, code, payload := t.readMessage()
+	t.c.Assert(unique, Equals, t.unique)
+	if code != 0 {
+		t.c.Assert(payload, HasLen, 0)
+	}
+	return syscall.Errno(-code), payload
+}
+
+func (t *testFuse) assertNoReply() {
+	n, _, err := unix.Recvfrom(t.kernel, make([]byte, 1), unix.MSG_DONTWAIT)
+	t.c.Assert(err, Equals, unix.EAGAIN, Commentf("unexpected reply of %v bytes", n))
+}
+
+func (t *testFuse) lookup(parent uint64, name string) (syscall.Errno, []byte) {
+	return t.request(opLookup, parent, append([]byte(name), 0))
+}
+
+func (t *testFuse) open(nodeID uint64, flags int) (syscall.Errno, uint64) {
+	body := make([]byte, 8)
+	le.PutUint32(body, uint32(flags))
+	errno, out := t.request(opOpen, nodeID, body)
+	if errno != 0 {
+		return errno, 0
+	}
+	t.c.Assert(out, HasLen, openOutSize)
+	return 0, le.Uint64(out)
+}
+
+func (t *testFuse) read(nodeID, fh uint64, off int64, size int) (syscall.Errno, []byte) {
+	body := make([]byte, 40)
+	le.PutUint64(body[0:], fh)
+	le.PutUint64(body[8:], uint64(off))
+	le.PutUint32(body[16:], uint32(size))
+	return t.request(opRead, nodeID, body)
+}
+
+func (t *testFuse) write(nodeID uint64, off int64, data []byte) (syscall.Errno, int) {
+	body := make([]byte, 40+len(data))
+	le.PutUint64(body[8:], uint64(off))
+	le.PutUint32(body[16:], uint32(len(data)))
+	copy(body[40:], data)
+	errno, out := t.request(opWrite, nodeID, body)
+	if errno != 0 {
+		return errno, 0
+	}
+	t.c.Assert(out, HasLen, writeOutSize)
+	return 0, int(le.Uint32(out))
+}
+
+// fallocate sends a fallocate of the volume.
+func (t *testFuse) fallocate(off, length int64, mode uint32) syscall.Errno {
+	body := make([]byte, 32)
+	le.PutUint64(body[8:], uint64(off))
+	le.PutUint64(body[16:], uint64(length))
+	le.PutUint32(body[24:], mode)
+	errno, _ := t.request(opFallocate, volumeNodeID, body)
+	return errno
+}
+
+// readdir returns the names in a directory, read size bytes at a time.
+func (t *testFuse) readdir(nodeID uint64, size int) []string {
+	var names []string
+	var off uint64
+	for {
+		body := make([]byte, 40)
+		le.PutUint64(body[8:], off)
+		le.PutUint32(body[16:], uint32(size))
+		errno, out := t.request(opReaddir, nodeID, body)
+		t.c.Assert(errno, Equals, syscall.Errno(0))
+		t.c.Assert(len(out) <= size, Equals, true)
+		if len(out) == 0 {
+			return names
+		}
+		for len(out) > 0 {
+			namelen := int(le.Uint32(out[16:]))
+			names = append(names, string(out[direntSize:direntSize+namelen]))
+			off = le.Uint64(out[8:])
+			length := (direntSize + namelen + 7) &^ 7
+			t.c.Assert(length%8, Equals, 0)
+			out = out[length:]
+		}
+	}
+}
+
+func (s *TestSuite) TestParseRequest(c *C) {
+	buf := make([]byte, inHeaderSize+5)
+	le.PutUint32(buf[0:], uint32(len(buf)))
+	le.PutUint32(buf[4:], opLookup)
+	le.PutUint64(buf[8:], 42)
+	le.PutUint64(buf[16:], rootNodeID)
+	copy(buf[inHeaderSize:], "name")
+	req, ok := parseRequest(buf)
+	c.Assert(ok, Equals, true)
+	c.Assert(req.opcode, Equals, uint32(opLookup))
+	c.Assert(req.unique, Equals, uint64(42))
+	c.Assert(req.nodeID, Equals, uint64(rootNodeID))
+	c.Assert(req.body, DeepEquals, buf[inHeaderSize:])
+
+	_, ok = parseRequest(buf[:inHeaderSize-1])
+	c.Assert(ok, Equals, false)
+	// The length must be that of the request read.
+	_, ok = parseRequest(buf[:inHeaderSize+2])
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TestSuite) TestAppendDirent(c *C) {
+	buf, ok := appendDirent(nil, 64, 7, 1, "volume", syscall.DT_REG)
+	c.Assert(ok, Equals, true)
+	c.Assert(buf, HasLen, 32)
+	c.Assert(le.Uint64(buf), Equals, uint64(7))
+	c.Assert(le.Uint32(buf[16:]), Equals, uint32(6))
+	c.Assert(le.Uint32(buf[20:]), Equals, uint32(syscall.DT_REG))
+	c.Assert(string(buf[direntSize:direntSize+6]), Equals, "volume")
+
+	_, ok = appendDirent(buf, 64, 8, 2, "snapshots", syscall.DT_DIR)
+	c.Assert(ok, Equals, false)
+	buf, ok = appendDirent(buf, 72, 8, 2, "snapshots", syscall.DT_DIR)
+	c.Assert(ok, Equals, true)
+	c.Assert(buf, HasLen, 72)
+}
+
+func (s *TestSuite) TestInit(c *C) {
+	t := newTestFuse(c, "")
+	defer t.close()
+
+	body := make([]byte, 16)
+	le.PutUint32(body[0:], kernelVersion)
+	le.PutUint32(body[4:], 38)
+	le.PutUint32(body[8:], 128<<10)
+	le.PutUint32(body[12:], initAsyncRead|initBigWrites|initMaxPages|1<<3)
+	errno, out := t.request(opInit, 0, body)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(out, HasLen, initOutSize)
+	c.Assert(le.Uint32(out[4:]), Equals, uint32(kernelMaxVersion))
+	c.Assert(le.Uint32(out[8:]), Equals, uint32(128<<10))
+	c.Assert(le.Uint32(out[12:]), Equals, uint32(initAsyncRead|initBigWrites|initMaxPages))
+	c.Assert(le.Uint32(out[20:]), Equals, uint32(maxWrite))
+	c.Assert(le.Uint16(out[28:]), Equals, uint16(maxWrite/pageSize))
+
+	// A kernel without max_pages.
+	le.PutUint32(body[4:], kernelMinVersion)
+	le.PutUint32(body[12:], initBigWrites)
+	errno, out = t.request(opInit, 0, body)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(le.Uint32(out[4:]), Equals, uint32(kernelMinVersion))
+	c.Assert(le.Uint32(out[12:]), Equals, uint32(initBigWrites))
+	c.Assert(le.Uint32(out[20:]), Equals, uint32(smallMaxWrite))
+
+	le.PutUint32(body[4:], kernelMinVersion-1)
+	errno, _ = t.request(opInit, 0, body)
+	c.Assert(errno, Equals, syscall.EPROTO)
+	errno, _ = t.request(opInit, 0, body[:8])
+	c.Assert(errno, Equals, syscall.EINVAL)
+}
+
+func (s *TestSuite) TestNodes(c *C) {
+	t := newTestFuse(c, "")
+	defer t.close()
+
+	errno, out := t.lookup(rootNodeID, VolumeFileName)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(out, HasLen, entryOutSize)
+	c.Assert(le.Uint64(out), Equals, uint64(volumeNodeID))
+	c.Assert(le.Uint64(out[48:]), Equals, uint64(testVolumeSize))
+	c.Assert(le.Uint32(out[100:]), Equals, uint32(syscall.S_IFREG|0600))
+
+	// The snapshots are only there with a snapshot directory.
+	errno, _ = t.lookup(rootNodeID, SnapshotsDirName)
+	c.Assert(errno, Equals, syscall.ENOENT)
+	errno, _ = t.lookup(volumeNodeID, "x")
+	c.Assert(errno, Equals, syscall.ENOENT)
+	c.Assert(t.readdir(rootNodeID, 4096), DeepEquals, []string{".", "..", VolumeFileName})
+	// One entry at a time.
+	c.Assert(t.readdir(rootNodeID, 32), DeepEquals, []string{".", "..", VolumeFileName})
+	errno, _ = t.request(opOpendir, volumeNodeID, make([]byte, 8))
+	c.Assert(errno, Equals, syscall.ENOTDIR)
+	errno, _ = t.request(opOpendir, snapshotsNodeID, make([]byte, 8))
+	c.Assert(errno, Equals, syscall.ENOTDIR)
+
+	errno, out = t.request(opGetattr, rootNodeID, make([]byte, 16))
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(le.Uint32(out[16+60:]), Equals, uint32(syscall.S_IFDIR|0755))
+
+	// Only the times and the current size can be set.
+	setattr := make([]byte, 88)
+	le.PutUint32(setattr, setattrSize)
+	le.PutUint64(setattr[16:], testVolumeSize)
+	errno, _ = t.request(opSetattr, volumeNodeID, setattr)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	le.PutUint64(setattr[16:], 0)
+	errno, _ = t.request(opSetattr, volumeNodeID, setattr)
+	c.Assert(errno, Equals, syscall.EPERM)
+	le.PutUint32(setattr, setattrMode)
+	errno, _ = t.request(opSetattr, volumeNodeID, setattr)
+	c.Assert(errno, Equals, syscall.EPERM)
+
+	for _, opcode := range []uint32{opCreate, opMknod, opUnlink, opRename} {
+		errno, _ = t.request(opcode, rootNodeID, []byte("x\x00"))
+		c.Assert(errno, Equals, syscall.EPERM)
+	}
+	errno, _ = t.request(0x7777, rootNodeID, nil)
+	c.Assert(errno, Equals, syscall.ENOSYS)
+
+	errno, out = t.request(opStatfs, rootNodeID, nil)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(le.Uint64(out), Equals, uint64(testVolumeSize/pageSize))
+}
+
+func (s *TestSuite) TestVolumeReadWrite(c *C) {
+	t := newTestFuse(c, "")
+	defer t.close()
+
+	errno, fh := t.open(volumeNodeID, syscall.O_RDWR)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	data := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	errno, n := t.write(volumeNodeID, 4096, data)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(n, Equals, len(data))
+	stored := make([]byte, len(data))
+	_, err := t.replica.ReadAt(stored, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, data)
+
+	errno, out := t.read(volumeNodeID, fh, 4096, len(data))
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(out, DeepEquals, data)
+
+	// The part beyond the end is neither written nor read.
+	errno, n = t.write(volumeNodeID, testVolumeSize-512, data)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(n, Equals, 512)
+	errno, _ = t.write(volumeNodeID, testVolumeSize, data)
+	c.Assert(errno, Equals, syscall.ENOSPC)
+	errno, out = t.read(volumeNodeID, fh, testVolumeSize-512, 4096)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(out, DeepEquals, data[:512])
+	errno, out = t.read(volumeNodeID, fh, testVolumeSize, 4096)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(out, HasLen, 0)
+	errno, _ = t.read(volumeNodeID, fh, -1, 4096)
+	c.Assert(errno, Equals, syscall.EINVAL)
+
+	// A write shorter than its size.
+	body := make([]byte, 40+16)
+	le.PutUint32(body[16:], 17)
+	errno, _ = t.request(opWrite, volumeNodeID, body)
+	c.Assert(errno, Equals, syscall.EINVAL)
+	errno, _ = t.write(rootNodeID, 0, data)
+	c.Assert(errno, Equals, syscall.EROFS)
+
+	errno, _ = t.request(opFsync, volumeNodeID, make([]byte, 16))
+	c.Assert(errno, Equals, syscall.Errno(0))
+	errno, _ = t.request(opRelease, volumeNodeID, make([]byte, 24))
+	c.Assert(errno, Equals, syscall.Errno(0))
+
+	t.replica.SetState(types.ReplicaStateError)
+	errno, _ = t.write(volumeNodeID, 0, data)
+	c.Assert(errno, Equals, syscall.EIO)
+	errno, _ = t.read(volumeNodeID, fh, 0, 512)
+	c.Assert(errno, Equals, syscall.EIO)
+}
+
+func (s *TestSuite) TestFallocate(c *C) {
+	t := newTestFuse(c, "")
+	defer t.close()
+
+	data := bytes.Repeat([]byte{0xaa}, 16384)
+	errno, _ := t.write(volumeNodeID, 0, data)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	errno, _ = t.write(volumeNodeID, testVolumeSize-4096, data[:4096])
+	c.Assert(errno, Equals, syscall.Errno(0))
+
+	c.Assert(t.fallocate(1024, 2048, fallocPunchHole|fallocKeepSize), Equals, syscall.Errno(0))
+	c.Assert(t.fallocate(8192, 4096, fallocZeroRange), Equals, syscall.Errno(0))
+	// A range kept within the size is cut at the end.
+	c.Assert(t.fallocate(testVolumeSize-1024, 4096, fallocZeroRange|fallocKeepSize), Equals, syscall.Errno(0))
+
+	expected := append([]byte(nil), data...)
+	clear(expected[1024:3072])
+	clear(expected[8192:12288])
+	stored := make([]byte, len(data))
+	_, err := t.replica.ReadAt(stored, 0)
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, expected)
+	stored = make([]byte, 4096)
+	_, err = t.replica.ReadAt(stored, testVolumeSize-4096)
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, append(bytes.Repeat([]byte{0xaa}, 3072), make([]byte, 1024)...))
+
+	for _, e := range []struct {
+		off, length int64
+		mode        uint32
+		errno       syscall.Errno
+	}{
+		// Preallocating
+		{0, 4096, 0, syscall.EOPNOTSUPP},
+		{0, 4096, fallocKeepSize, syscall.EOPNOTSUPP},
+		{0, 4096, fallocPunchHole, syscall.EOPNOTSUPP},
+		{testVolumeSize - 1024, 4096, fallocZeroRange, syscall.EFBIG},
+		{-1, 4096, fallocZeroRange, syscall.EINVAL},
+		{0, 0, fallocZeroRange, syscall.EINVAL},
+	} {
+		c.Assert(t.fallocate(e.off, e.length, e.mode), Equals, e.errno, Commentf("%+v", e))
+	}
+}
+
+func (s *TestSuite) TestSnapshots(c *C) {
+	dir := c.MkDir()
+	r, err := replica.New(context.Background(), testVolumeSize, 512, dir, nil, false, false, 250, 0)
+	c.Assert(err, IsNil)
+	snapshotData := bytes.Repeat([]byte{0x11}, 4096)
+	_, err = r.WriteAt(snapshotData, 8192)
+	c.Assert(err, IsNil)
+	c.Assert(r.Snapshot("snap1", true, time.Now().UTC().Format(time.RFC3339), nil), IsNil)
+	_, err = r.WriteAt(bytes.Repeat([]byte{0x22}, 4096), 8192)
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), IsNil)
+
+	t := newTestFuse(c, dir)
+	defer t.close()
+
+	c.Assert(t.readdir(rootNodeID, 4096), DeepEquals, []string{".", "..", VolumeFileName, SnapshotsDirName})
+	errno, _ := t.request(opOpendir, snapshotsNodeID, make([]byte, 8))
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(t.readdir(snapshotsNodeID, 4096), DeepEquals, []string{".", "..", "snap1"})
+
+	errno, out := t.lookup(snapshotsNodeID, "snap1")
+	c.Assert(errno, Equals, syscall.Errno(0))
+	id := le.Uint64(out)
+	c.Assert(id, Equals, uint64(firstSnapshotNodeID))
+	c.Assert(le.Uint64(out[48:]), Equals, uint64(testVolumeSize))
+	c.Assert(le.Uint32(out[100:]), Equals, uint32(syscall.S_IFREG|0400))
+	// The snapshot keeps its node.
+	_, out = t.lookup(snapshotsNodeID, "snap1")
+	c.Assert(le.Uint64(out), Equals, id)
+	for _, name := range []string{"snap2", "..", "../snap1", ""} {
+		errno, _ = t.lookup(snapshotsNodeID, name)
+		c.Assert(errno, Equals, syscall.ENOENT, Commentf(name))
+	}
+
+	errno, _ = t.open(id, syscall.O_RDWR)
+	c.Assert(errno, Equals, syscall.EROFS)
+	errno, fh1 := t.open(id, syscall.O_RDONLY)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	errno, fh2 := t.open(id, syscall.O_RDONLY)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(fh1, Not(Equals), fh2)
+	c.Assert(t.f.snapshots, HasLen, 1)
+
+	errno, out = t.read(id, fh1, 4096, 12288)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(out, DeepEquals, append(make([]byte, 4096), append(snapshotData, make([]byte, 4096)...)...))
+	errno, _ = t.write(id, 0, snapshotData)
+	c.Assert(errno, Equals, syscall.EROFS)
+	errno, _ = t.request(opFallocate, id, make([]byte, 32))
+	c.Assert(errno, Equals, syscall.EROFS)
+
+	// The snapshot is closed with its last handle.
+	release := make([]byte, 24)
+	le.PutUint64(release, fh1)
+	errno, _ = t.request(opRelease, id, release)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(t.f.snapshots, HasLen, 1)
+	errno, _ = t.read(id, fh1, 0, 512)
+	c.Assert(errno, Equals, syscall.EBADF)
+	le.PutUint64(release, fh2)
+	errno, _ = t.request(opRelease, id, release)
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(t.f.snapshots, HasLen, 0)
+}
+
+func (s *TestSuite) TestVolumeDown(c *C) {
+	t := newTestFuse(c, "")
+	defer t.close()
+
+	// Requests without a reply.
+	for _, opcode := range []uint32{opForget, opBatchForget, opInterrupt} {
+		buf := make([]byte, inHeaderSize+16)
+		le.PutUint32(buf, uint32(len(buf)))
+		le.PutUint32(buf[4:], opcode)
+		t.f.handle(t.fd, buf)
+		t.assertNoReply()
+	}
+	// An invalid request is dropped.
+	t.f.handle(t.fd, make([]byte, inHeaderSize))
+	t.assertNoReply()
+
+	t.f.rwu = nil
+	errno, _ := t.lookup(rootNodeID, VolumeFileName)
+	c.Assert(errno, Equals, syscall.EIO)
+}
+
+func (s *TestSuite) TestExpand(c *C) {
+	t := newTestFuse(c, "")
+	defer t.close()
+
+	c.Assert(t.f.Expand(2*testVolumeSize), IsNil)
+	unique, code, payload := t.readMessage()
+	c.Assert(unique, Equals, uint64(0))
+	c.Assert(code, Equals, int32(notifyInvalInode))
+	c.Assert(payload, HasLen, 24)
+	c.Assert(le.Uint64(payload), Equals, uint64(volumeNodeID))
+	c.Assert(int64(le.Uint64(payload[8:])), Equals, int64(-1))
+
+	errno, out := t.request(opGetattr, volumeNodeID, make([]byte, 16))
+	c.Assert(errno, Equals, syscall.Errno(0))
+	c.Assert(le.Uint64(out[16+8:]), Equals, uint64(2*testVolumeSize))
+}
@@ -0,0 +1,518 @@
+package iscsi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRecvDataSegmentLength bounds the data of a PDU from an initiator
+	maxRecvDataSegmentLength = 256 * 1024
+	// maxTransferLength bounds the data of a SCSI command, it is the maximum transfer length of the block limits
+	maxTransferLength = 1024 * 1024
+	maxBurstLength    = maxTransferLength
+	// queueDepth is how many commands an initiator may send ahead of ExpCmdSN
+	queueDepth = 128
+
+	// Defaults of the operational keys an initiator does not negotiate
+	defaultMaxRecvDataSegmentLength = 8192
+	defaultMaxBurstLength           = 256 * 1024
+	defaultFirstBurstLength         = 64 * 1024
+
+	// Task management functions
+	tmfAbortTask       = 1
+	tmfAbortTaskSet    = 2
+	tmfClearTaskSet    = 4
+	tmfLUNReset        = 5
+	tmfTargetWarmReset = 6
+	tmfTargetColdReset = 7
+	tmfTaskReassign    = 8
+
+	// Task management responses
+	tmfComplete                = 0
+	tmfReassignNotSupported    = 4
+	tmfFunctionNotSupported    = 5
+	logoutRemoveForRecovery    = 2
+	logoutRecoveryNotSupported = 2
+)
+
+// conn is the connection of a session. Sessions have a single connection, so the connection holds the session
+// state as well. The reader goroutine takes the PDUs off the connection, and runs each SCSI command in a goroutine
+// of its own once its data arrived.
+type conn struct {
+	target  *Target
+	netConn net.Conn
+	reader  *bufio.Reader
+
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+	// statSN is the StatSN of the next response, guarded by writeLock
+	statSN uint32
+
+	// Set by the login, the digests only once it completes
+	headerDigest        bool
+	dataDigest          bool
+	pendingHeaderDigest bool
+	pendingDataDigest   bool
+	declaredRecvLength  bool
+	// maxSendDataSegmentLength is the MaxRecvDataSegmentLength of the initiator
+	maxSendDataSegmentLength int
+	maxBurstLength           int
+	firstBurstLength         int
+	immediateData            bool
+	discovery                bool
+	initiatorName            string
+	targetName               string
+	isid                     [6]byte
+	// tsih and loggedIn are guarded by the lock of the target
+	tsih     uint16
+	loggedIn bool
+
+	expCmdSN atomic.Uint32
+	// unitAttention tells whether the capacity data changed since the last command
+	unitAttention atomic.Bool
+
+	// transfers are the commands waiting for their data, by target transfer tag. Only the reader uses them.
+	transfers       map[uint32]*transfer
+	nextTransferTag uint32
+	// tasks are the running commands, by initiator task tag
+	tasksLock sync.Mutex
+	tasks     map[uint32]*task
+	inflight  sync.WaitGroup
+}
+
+// task is a SCSI command.
+type task struct {
+	itt   uint32
+	lun   []byte
+	cdb   []byte
+	flags uint8
+	// length is the expected data transfer length
+	length  int
+	aborted atomic.Bool
+	done    chan struct{}
+}
+
+// transfer is the data of a SCSI command requested with R2Ts, a burst at a time.
+type transfer struct {
+	task     *task
+	data     []byte
+	received int
+	burstEnd int
+	r2tSN    uint32
+}
+
+func newConn(t *Target, netConn net.Conn) *conn {
+	return &conn{
+		target:                   t,
+		netConn:                  netConn,
+		reader:                   bufio.NewReaderSize(netConn, 64*1024),
+		writer:                   bufio.NewWriterSize(netConn, 64*1024),
+		maxSendDataSegmentLength: defaultMaxRecvDataSegmentLength,
+		maxBurstLength:           defaultMaxBurstLength,
+		firstBurstLength:         defaultFirstBurstLength,
+		immediateData:            true,
+		transfers:                map[uint32]*transfer{},
+		tasks:                    map[uint32]*task{},
+	}
+}
+
+// serve handles the session until the initiator logs out or the connection fails.
+func (c *conn) serve() error {
+	defer c.close()
+
+	if err := c.login(); err != nil {
+		return err
+	}
+	for {
+		p, err := c.readPDU(maxRecvDataSegmentLength)
+		if err != nil {
+			return err
+		}
+		switch p.opcode() {
+		case opNopOut:
+			err = c.nopOut(p)
+		case opSCSICommand:
+			err = c.receiveCommand(p)
+		case opSCSIDataOut:
+			err = c.receiveData(p)
+		case opTaskMgmtReq:
+			err = c.taskManagement(p)
+		case opTextReq:
+			err = c.text(p)
+		case opLogoutReq:
+			return c.logout(p)
+		default:
+			// SNACKs are only for error recovery levels above 0.
+			err = c.reject(p, rejectCommandNotSupported)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) close() {
+	_ = c.netConn.Close()
+	c.inflight.Wait()
+}
+
+// received accounts for a request of the initiator. A session with a single connection gets the requests in
+// order, so a request that is not immediate has the expected CmdSN.
+func (c *conn) received(p *pdu) {
+	if !p.immediate() && p.cmdSN() == c.expCmdSN.Load() {
+		c.expCmdSN.Add(1)
+	}
+}
+
+// putSN sets the StatSN, ExpCmdSN and MaxCmdSN of a response, the caller holds the writeLock. status tells whether
+// the response takes a StatSN.
+func (c *conn) putSN(bhs []byte, status bool) {
+	be.PutUint32(bhs[24:], c.statSN)
+	if status {
+		c.statSN++
+	}
+	expCmdSN := c.expCmdSN.Load()
+	be.PutUint32(bhs[28:], expCmdSN)
+	be.PutUint32(bhs[32:], expCmdSN+queueDepth-1)
+}
+
+// send writes a response that takes a StatSN.
+func (c *conn) send(bhs, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.putSN(bhs, true)
+	if err := c.writePDU(bhs, data); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *conn) reject(p *pdu, reason uint8) error {
+	bhs := newBHS(opReject, flagFinal)
+	bhs[2] = reason
+	be.PutUint32(bhs[16:], reservedTag)
+	return c.send(bhs, p.bhs)
+}
+
+func (c *conn) nopOut(p *pdu) error {
+	c.received(p)
+	if p.itt() == reservedTag {
+		return nil
+	}
+	bhs := newBHS(opNopIn, flagFinal)
+	copy(bhs[8:], p.lun())
+	be.PutUint32(bhs[16:], p.itt())
+	be.PutUint32(bhs[20:], reservedTag)
+	data := p.data
+	if len(data) > c.maxSendDataSegmentLength {
+		data = data[:c.maxSendDataSegmentLength]
+	}
+	return c.send(bhs, data)
+}
+
+// receiveCommand takes a SCSI command. The data of a command from the initiator is either immediate data, or
+// requested with R2Ts and handled once it all arrived.
+func (c *conn) receiveCommand(p *pdu) error {
+	c.received(p)
+	if c.discovery {
+		return c.reject(p, rejectProtocolError)
+	}
+	t := &task{
+		itt:    p.itt(),
+		lun:    append([]byte{}, p.lun()...),
+		cdb:    append([]byte{}, p.bhs[32:48]...),
+		flags:  p.flags(),
+		length: int(be.Uint32(p.bhs[20:])),
+		done:   make(chan struct{}),
+	}
+
+	if t.flags&flagWrite == 0 {
+		if len(p.data) > 0 {
+			return newProtocolError("immediate data of command 0x%x without the write flag", t.itt)
+		}
+		c.dispatch(t, nil)
+		return nil
+	}
+	if len(p.data) > 0 && (!c.immediateData || len(p.data) > c.firstBurstLength || len(p.data) > t.length) {
+		return newProtocolError("%v bytes of immediate data of command 0x%x out of %v", len(p.data), t.itt, t.length)
+	}
+	if t.length > maxTransferLength {
+		// The initiator sends nothing but the immediate data without an R2T.
+		c.complete(t, checkCondition(senseIllegalRequest, ascInvalidFieldInCDB))
+		return nil
+	}
+	if len(p.data) == t.length {
+		c.dispatch(t, p.data)
+		return nil
+	}
+
+	tr := &transfer{task: t, data: make([]byte, t.length), received: len(p.data)}
+	copy(tr.data, p.data)
+	c.nextTransferTag++
+	if c.nextTransferTag == reservedTag {
+		c.nextTransferTag = 0
+	}
+	c.transfers[c.nextTransferTag] = tr
+	return c.requestData(c.nextTransferTag, tr)
+}
+
+// requestData asks the initiator for the next burst of the data of a transfer with an R2T.
+func (c *conn) requestData(ttt uint32, tr *transfer) error {
+	length := min(c.maxBurstLength, len(tr.data)-tr.received)
+	tr.burstEnd = tr.received + length
+
+	bhs := newBHS(opR2T, flagFinal)
+	copy(bhs[8:], tr.task.lun)
+	be.PutUint32(bhs[16:], tr.task.itt)
+	be.PutUint32(bhs[20:], ttt)
+	be.PutUint32(bhs[36:], tr.r2tSN)
+	be.PutUint32(bhs[40:], uint32(tr.received))
+	be.PutUint32(bhs[44:], uint32(length))
+	tr.r2tSN++
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.putSN(bhs, false)
+	if err := c.writePDU(bhs, nil); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *conn) receiveData(p *pdu) error {
+	tr, ok := c.transfers[p.ttt()]
+	if !ok {
+		// The data of an aborted command may still arrive.
+		logrus.Debugf("Dropping iSCSI data of unknown target transfer tag 0x%x of %v", p.ttt(), c.target.Volume)
+		return nil
+	}
+	if tr.task.itt != p.itt() {
+		return newProtocolError("command 0x%x does not match target transfer tag 0x%x", p.itt(), p.ttt())
+	}
+	offset := int(be.Uint32(p.bhs[40:]))
+	if offset != tr.received || len(p.data) > tr.burstEnd-offset {
+		return newProtocolError("%v bytes of data at offset %v out of the burst from %v to %v of command 0x%x",
+			len(p.data), offset, tr.received, tr.burstEnd, tr.task.itt)
+	}
+	copy(tr.data[offset:], p.data)
+	tr.received += len(p.data)
+	if p.flags()&flagFinal == 0 {
+		return nil
+	}
+	if tr.received != tr.burstEnd {
+		return newProtocolError("last data of command 0x%x after %v out of %v bytes", tr.task.itt, tr.received, tr.burstEnd)
+	}
+	if tr.received < len(tr.data) {
+		return c.requestData(p.ttt(), tr)
+	}
+	delete(c.transfers, p.ttt())
+	c.dispatch(tr.task, tr.data)
+	return nil
+}
+
+// dispatch runs a command whose data arrived.
+func (c *conn) dispatch(t *task, data []byte) {
+	c.tasksLock.Lock()
+	c.tasks[t.itt] = t
+	c.tasksLock.Unlock()
+
+	c.inflight.Add(1)
+	go func() {
+		defer c.inflight.Done()
+		defer close(t.done)
+
+		c.complete(t, c.execute(t, data))
+
+		c.tasksLock.Lock()
+		if c.tasks[t.itt] == t {
+			delete(c.tasks, t.itt)
+		}
+		c.tasksLock.Unlock()
+	}()
+}
+
+// complete sends the status of a command, after its data if it returns some. Nothing is sent for an aborted
+// command.
+func (c *conn) complete(t *task, r *result) {
+	data := r.data
+	if t.flags&flagRead == 0 || r.status != statusGood {
+		data = nil
+	}
+	var flags uint8
+	var residual int
+	if t.flags&flagRead != 0 {
+		if len(data) > t.length {
+			flags, residual = flagOverflow, len(data)-t.length
+			data = data[:t.length]
+		} else if len(data) < t.length {
+			flags, residual = flagUnderflow, t.length-len(data)
+		}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if t.aborted.Load() {
+		return
+	}
+	err := func() error {
+		if len(data) > 0 {
+			return c.sendDataIn(t, data, flags, residual)
+		}
+		bhs := newBHS(opSCSIResponse, flagFinal|flags)
+		bhs[3] = r.status
+		be.PutUint32(bhs[16:], t.itt)
+		be.PutUint32(bhs[44:], uint32(residual))
+		c.putSN(bhs, true)
+		var sense []byte
+		if len(r.sense) > 0 {
+			sense = make([]byte, 2+len(r.sense))
+			be.PutUint16(sense, uint16(len(r.sense)))
+			copy(sense[2:], r.sense)
+		}
+		if err := c.writePDU(bhs, sense); err != nil {
+			return err
+		}
+		return c.writer.Flush()
+	}()
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to complete iSCSI command 0x%x of %v", t.itt, c.target.Volume)
+		// The reader notices the closed connection.
+		_ = c.netConn.Close()
+	}
+}
+
+// sendDataIn sends the data of a read in Data-In PDUs, the last one carries the good status as well. The caller
+// holds the writeLock.
+func (c *conn) sendDataIn(t *task, data []byte, flags uint8, residual int) error {
+	for offset, dataSN := 0, uint32(0); offset < len(data); dataSN++ {
+		burstEnd := (offset/c.maxBurstLength + 1) * c.maxBurstLength
+		n := min(c.maxSendDataSegmentLength, len(data)-offset, burstEnd-offset)
+		last := offset+n == len(data)
+
+		bhs := newBHS(opSCSIDataIn, 0)
+		if last || offset+n == burstEnd {
+			bhs[1] |= flagFinal
+		}
+		copy(bhs[8:], t.lun)
+		be.PutUint32(bhs[16:], t.itt)
+		be.PutUint32(bhs[20:], reservedTag)
+		be.PutUint32(bhs[36:], dataSN)
+		be.PutUint32(bhs[40:], uint32(offset))
+		if last {
+			bhs[1] |= flags | flagStatus
+			bhs[3] = statusGood
+			be.PutUint32(bhs[44:], uint32(residual))
+		}
+		c.putSN(bhs, last)
+		if err := c.writePDU(bhs, data[offset:offset+n]); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return c.writer.Flush()
+}
+
+// taskManagement aborts the commands a task management function covers, and waits for the running ones. A
+// session has no other LUN to reset, so the resets abort the commands of the session as well.
+func (c *conn) taskManagement(p *pdu) error {
+	c.received(p)
+	function := p.flags() &^ flagFinal
+	response := uint8(tmfComplete)
+	switch function {
+	case tmfAbortTask:
+		ref := be.Uint32(p.bhs[20:])
+		c.abortTasks(func(t *task) bool { return t.itt == ref })
+	case tmfAbortTaskSet, tmfClearTaskSet, tmfLUNReset, tmfTargetWarmReset, tmfTargetColdReset:
+		c.abortTasks(func(*task) bool { return true })
+	case tmfTaskReassign:
+		response = tmfReassignNotSupported
+	default:
+		response = tmfFunctionNotSupported
+	}
+	logrus.Infof("iSCSI task management function %v of initiator %v on %v, response %v", function, c.initiatorName,
+		c.target.Volume, response)
+
+	bhs := newBHS(opTaskMgmtResp, flagFinal)
+	bhs[2] = response
+	be.PutUint32(bhs[16:], p.itt())
+	if err := c.send(bhs, nil); err != nil {
+		return err
+	}
+	if function == tmfTargetColdReset {
+		return fmt.Errorf("initiator %v reset the target", c.initiatorName)
+	}
+	return nil
+}
+
+func (c *conn) abortTasks(match func(t *task) bool) {
+	for ttt, tr := range c.transfers {
+		if match(tr.task) {
+			delete(c.transfers, ttt)
+		}
+	}
+
+	var running []*task
+	c.tasksLock.Lock()
+	for _, t := range c.tasks {
+		if match(t) {
+			t.aborted.Store(true)
+			running = append(running, t)
+		}
+	}
+	c.tasksLock.Unlock()
+	for _, t := range running {
+		<-t.done
+	}
+}
+
+// text answers SendTargets, the only text request, with the target and the portal of the connection.
+func (c *conn) text(p *pdu) error {
+	c.received(p)
+	if p.flags()&flagContinue != 0 {
+		return c.reject(p, rejectCommandNotSupported)
+	}
+	pairs, err := parseText(p.data)
+	if err != nil {
+		return c.reject(p, rejectProtocolError)
+	}
+	var resp []keyValue
+	for _, kv := range pairs {
+		if kv.key != "SendTargets" {
+			resp = append(resp, keyValue{key: kv.key, value: valueNotUnderstood})
+			continue
+		}
+		if (kv.value == "All" && c.discovery) || kv.value == "" || kv.value == c.target.iqn {
+			resp = append(resp,
+				keyValue{key: "TargetName", value: c.target.iqn},
+				keyValue{key: "TargetAddress", value: fmt.Sprintf("%v,%v", c.netConn.LocalAddr(), targetPortalGroupTag)})
+		}
+	}
+
+	bhs := newBHS(opTextResp, flagFinal)
+	be.PutUint32(bhs[16:], p.itt())
+	be.PutUint32(bhs[20:], reservedTag)
+	return c.send(bhs, encodeText(resp))
+}
+
+// logout waits for the running commands, and answers before the connection is closed.
+func (c *conn) logout(p *pdu) error {
+	c.received(p)
+	response := uint8(0)
+	if p.flags()&^flagFinal == logoutRemoveForRecovery {
+		response = logoutRecoveryNotSupported
+	}
+	c.transfers = map[uint32]*transfer{}
+	c.inflight.Wait()
+
+	bhs := newBHS(opLogoutResp, flagFinal)
+	bhs[2] = response
+	be.PutUint32(bhs[16:], p.itt())
+	logrus.Infof("iSCSI initiator %v logged out of %v", c.initiatorName, c.target.Volume)
+	return c.send(bhs, nil)
+}
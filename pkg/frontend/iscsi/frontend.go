@@ -0,0 +1,264 @@
+package iscsi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/go-iscsi-helper/iscsidev"
+	devtypes "github.com/longhorn/go-iscsi-helper/types"
+	iscsiutil "github.com/longhorn/go-iscsi-helper/util"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	FrontendName = "iscsi"
+
+	DefaultListenAddress = ":3260"
+
+	// diskLUN is the LUN of the volume, as tgt has it
+	diskLUN              = 1
+	targetPortalGroupTag = 1
+
+	vendorID        = "LONGHORN"
+	productID       = "Longhorn Volume"
+	productRevision = "1.0"
+	minBlockSize    = 512
+)
+
+// New returns an iSCSI target serving the volume as frontendName, which is either FrontendName or the tgt-iscsi
+// frontend that the target replaces tgt for.
+func New(frontendName, listenAddress string) *Target {
+	if listenAddress == "" {
+		listenAddress = DefaultListenAddress
+	}
+	return &Target{frontendName: frontendName, listenAddress: listenAddress}
+}
+
+// Target serves the volume as LUN 1 of an iSCSI target, which initiators log in to without tgt, e.g. with
+// `iscsiadm -m discovery -t sendtargets -p <address>` and `iscsiadm -m node -T <iqn> -l`. Every session has a
+// single connection, and error recovery level 0.
+type Target struct {
+	Volume     string
+	Size       int64
+	SectorSize int
+
+	frontendName  string
+	listenAddress string
+	isUp          bool
+	iqn           string
+	serial        string
+	naa           [16]byte
+	blockSize     int
+	rwu           types.ReaderWriterUnmapperAt
+	// writeCache is the write cache enable bit of the caching mode page
+	writeCache atomic.Bool
+
+	lock     sync.Mutex
+	listener net.Listener
+	conns    map[*conn]struct{}
+	nextTSIH uint16
+	wg       sync.WaitGroup
+}
+
+func (t *Target) FrontendName() string {
+	return t.frontendName
+}
+
+func (t *Target) Init(name string, size, sectorSize int64) error {
+	t.Volume = name
+	t.Size = size
+	t.SectorSize = int(sectorSize)
+
+	t.iqn = iscsidev.GetTargetName(name)
+	sum := sha256.Sum256([]byte(name))
+	copy(t.naa[:], sum[:])
+	// NAA IEEE Registered Extended, with the rest of the identifier derived from the volume name
+	t.naa[0] = 0x60 | t.naa[0]&0x0f
+	t.serial = hex.EncodeToString(sum[:])[:20]
+	t.blockSize = max(t.SectorSize, minBlockSize)
+	t.writeCache.Store(true)
+
+	return t.Shutdown()
+}
+
+func (t *Target) Startup(rwu types.ReaderWriterUnmapperAt) error {
+	listener, err := net.Listen("tcp", t.listenAddress)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %v", t.listenAddress)
+	}
+
+	t.lock.Lock()
+	t.rwu = rwu
+	t.listener = listener
+	t.conns = map[*conn]struct{}{}
+	t.lock.Unlock()
+
+	t.wg.Add(1)
+	go t.serve(listener)
+
+	t.isUp = true
+	logrus.Infof("Serving iSCSI target %v on %v", t.iqn, listener.Addr())
+
+	return nil
+}
+
+func (t *Target) Shutdown() error {
+	t.lock.Lock()
+	listener, conns := t.listener, t.conns
+	t.listener, t.conns = nil, nil
+	t.lock.Unlock()
+
+	if listener != nil {
+		logrus.Infof("Shutting down iSCSI target for %v", t.Volume)
+		if err := listener.Close(); err != nil {
+			logrus.WithError(err).Warnf("Failed to close iSCSI listener %v", listener.Addr())
+		}
+		for c := range conns {
+			_ = c.netConn.Close()
+		}
+		// Wait for the commands in flight, so none reaches the volume once it is down.
+		t.wg.Wait()
+	}
+	t.isUp = false
+
+	return nil
+}
+
+func (t *Target) State() types.State {
+	if t.isUp {
+		return types.StateUp
+	}
+	return types.StateDown
+}
+
+// Endpoint returns the IQN of the target as tgt-iscsi, like tgt does. Otherwise it returns the portal and the
+// LUN as well, as iscsi://<address>:<port>/<iqn>/1.
+func (t *Target) Endpoint() string {
+	if !t.isUp {
+		return ""
+	}
+	if t.frontendName == devtypes.FrontendTGTISCSI {
+		return t.iqn
+	}
+	t.lock.Lock()
+	listener := t.listener
+	t.lock.Unlock()
+	if listener == nil {
+		return ""
+	}
+
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		ip, err := iscsiutil.GetIPToHost()
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to get the IP of the host for the iSCSI endpoint")
+			return ""
+		}
+		host = ip
+	}
+	return fmt.Sprintf("iscsi://%v/%v/%v", net.JoinHostPort(host, strconv.Itoa(addr.Port)), t.iqn, diskLUN)
+}
+
+func (t *Target) Upgrade(name string, size, sectorSize int64, rwu types.ReaderWriterUnmapperAt) error {
+	return fmt.Errorf("upgrade is not supported")
+}
+
+// Expand grows the LUN, and reports a capacity data change unit attention to every session with its next
+// command, so the initiators read the capacity again.
+func (t *Target) Expand(size int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Size = size
+	for c := range t.conns {
+		if c.loggedIn && !c.discovery {
+			c.unitAttention.Store(true)
+		}
+	}
+	return nil
+}
+
+func (t *Target) getSize() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.Size
+}
+
+// serve accepts the connections of the initiators until the listener is closed.
+func (t *Target) serve(listener net.Listener) {
+	defer t.wg.Done()
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Errorf("Failed to accept iSCSI connection for %v", t.Volume)
+			}
+			return
+		}
+		if tcpConn, ok := netConn.(*net.TCPConn); ok {
+			_ = tcpConn.SetNoDelay(true)
+		}
+
+		c := newConn(t, netConn)
+		t.lock.Lock()
+		if t.listener != listener {
+			t.lock.Unlock()
+			_ = netConn.Close()
+			return
+		}
+		t.conns[c] = struct{}{}
+		t.wg.Add(1)
+		t.lock.Unlock()
+
+		go func() {
+			defer t.wg.Done()
+			if err := c.serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Warnf("iSCSI connection %v of %v closed", netConn.RemoteAddr(), t.Volume)
+			}
+
+			t.lock.Lock()
+			delete(t.conns, c)
+			t.lock.Unlock()
+		}()
+	}
+}
+
+// addSession gives a connection whose login completes its TSIH. A new session of the same initiator and ISID
+// reinstates the old one, which is dropped once its commands in flight are done.
+func (t *Target) addSession(c *conn) {
+	t.lock.Lock()
+	var old []*conn
+	for other := range t.conns {
+		if other != c && other.loggedIn && !other.discovery && !c.discovery &&
+			other.initiatorName == c.initiatorName && other.isid == c.isid {
+			old = append(old, other)
+		}
+	}
+	t.nextTSIH++
+	if t.nextTSIH == 0 {
+		t.nextTSIH++
+	}
+	c.tsih = t.nextTSIH
+	c.loggedIn = true
+	t.lock.Unlock()
+
+	for _, other := range old {
+		logrus.Infof("Reinstating iSCSI session 0x%x of initiator %v on %v", other.tsih, other.initiatorName, t.Volume)
+		_ = other.netConn.Close()
+		other.inflight.Wait()
+	}
+}
@@ -0,0 +1,640 @@
+package iscsi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/mem"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	testVolumeSize    = 4 << 20
+	testBlockSize     = 512
+	testInitiatorName = "iqn.2004-10.com.ubuntu:01:test"
+)
+
+// testInitiator is an iSCSI initiator with a session of a single connection, like open-iscsi. It runs a command
+// at a time.
+type testInitiator struct {
+	c            *C
+	conn         net.Conn
+	reader       *bufio.Reader
+	headerDigest bool
+	dataDigest   bool
+	itt          uint32
+	cmdSN        uint32
+	statSN       uint32
+	tsih         uint16
+	// maxBurstLength is the burst of the R2Ts the test expects
+	maxBurstLength int
+}
+
+// response is a SCSI command completion, with the data read and the sense data.
+type response struct {
+	status   uint8
+	flags    uint8
+	residual uint32
+	sense    []byte
+	data     []byte
+}
+
+func startTestTarget(c *C) (*Target, *mem.Replica) {
+	replica, err := mem.New().AddReplica("r", testVolumeSize)
+	c.Assert(err, IsNil)
+	t := New(FrontendName, "127.0.0.1:0")
+	c.Assert(t.Init("test", testVolumeSize, testBlockSize), IsNil)
+	c.Assert(t.Startup(replica), IsNil)
+	return t, replica
+}
+
+func dialTestInitiator(c *C, t *Target) *testInitiator {
+	conn, err := net.Dial("tcp", t.listener.Addr().String())
+	c.Assert(err, IsNil)
+	return &testInitiator{c: c, conn: conn, reader: bufio.NewReader(conn), itt: 1, maxBurstLength: defaultMaxBurstLength}
+}
+
+func (i *testInitiator) close() {
+	_ = i.conn.Close()
+}
+
+func (i *testInitiator) write(bhs, data []byte) {
+	_, err := i.conn.Write(encodePDU(bhs, 0, data, i.headerDigest, i.dataDigest))
+	i.c.Assert(err, IsNil)
+}
+
+func (i *testInitiator) read() *pdu {
+	i.c.Assert(i.conn.SetReadDeadline(time.Now().Add(10*time.Second)), IsNil)
+	p, err := (&conn{reader: i.reader, headerDigest: i.headerDigest, dataDigest: i.dataDigest}).readPDU(1 << 24)
+	i.c.Assert(err, IsNil)
+	i.statSN = be.Uint32(p.bhs[24:])
+	return p
+}
+
+func (i *testInitiator) newBHS(opcode, flags uint8, immediate bool) []byte {
+	bhs := make([]byte, bhsSize)
+	bhs[0], bhs[1] = opcode, flags
+	if immediate {
+		bhs[0] |= flagImmediate
+	}
+	be.PutUint32(bhs[16:], i.itt)
+	i.itt++
+	be.PutUint32(bhs[24:], i.cmdSN)
+	if !immediate {
+		i.cmdSN++
+	}
+	be.PutUint32(bhs[28:], i.statSN+1)
+	return bhs
+}
+
+// loginRequest sends a login request of the text, and returns the status and the text of the response.
+func (i *testInitiator) loginRequest(flags uint8, text string) (uint16, *pdu, map[string]string) {
+	bhs := i.newBHS(opLoginReq, flags, true)
+	copy(bhs[8:14], []byte{0x00, 0x02, 0x3d, 0x00, 0x00, 0x01})
+	i.write(bhs, []byte(text))
+	p := i.read()
+	i.c.Assert(p.opcode(), Equals, uint8(opLoginResp))
+	pairs, err := parseText(p.data)
+	i.c.Assert(err, IsNil)
+	values := map[string]string{}
+	for _, kv := range pairs {
+		values[kv.key] = kv.value
+	}
+	return be.Uint16(p.bhs[36:]), p, values
+}
+
+func keys(pairs ...string) string {
+	return strings.Join(pairs, "\x00") + "\x00"
+}
+
+// login logs in from the security stage to the full feature phase, with the digests if asked for.
+func (i *testInitiator) login(targetName, sessionType string, digests bool, operational ...string) map[string]string {
+	status, _, values := i.loginRequest(flagTransit|stageSecurity<<2|stageOperational, keys("InitiatorName="+testInitiatorName,
+		"TargetName="+targetName, "SessionType="+sessionType, "AuthMethod=CHAP,None"))
+	i.c.Assert(status, Equals, uint16(loginSuccess))
+	i.c.Assert(values["AuthMethod"], Equals, valueNone)
+
+	digest := "None"
+	if digests {
+		digest = "CRC32C,None"
+	}
+	pairs := append([]string{"HeaderDigest=" + digest, "DataDigest=" + digest, "MaxRecvDataSegmentLength=8192",
+		"ErrorRecoveryLevel=0"}, operational...)
+	status, p, operationalValues := i.loginRequest(flagTransit|stageOperational<<2|stageFullFeature, keys(pairs...))
+	i.c.Assert(status, Equals, uint16(loginSuccess))
+	i.c.Assert(p.flags()&flagTransit, Equals, uint8(flagTransit))
+	i.tsih = be.Uint16(p.bhs[14:])
+	i.c.Assert(i.tsih, Not(Equals), uint16(0))
+	for k, v := range operationalValues {
+		values[k] = v
+	}
+	i.headerDigest = values["HeaderDigest"] == valueCRC32C
+	i.dataDigest = values["DataDigest"] == valueCRC32C
+	return values
+}
+
+func lun(n int) []byte {
+	return []byte{0, byte(n), 0, 0, 0, 0, 0, 0}
+}
+
+// command runs a SCSI command of LUN 1, sending the data out as immediate data up to immediate bytes and the rest
+// on the R2Ts of the target.
+func (i *testInitiator) command(cdb []byte, out []byte, length int, immediate int) *response {
+	return i.commandLUN(diskLUN, cdb, out, length, immediate)
+}
+
+func (i *testInitiator) commandLUN(n int, cdb []byte, out []byte, length int, immediate int) *response {
+	flags := uint8(flagFinal)
+	if out != nil {
+		flags |= flagWrite
+		length = len(out)
+	} else if length > 0 {
+		flags |= flagRead
+	}
+	bhs := i.newBHS(opSCSICommand, flags, false)
+	copy(bhs[8:], lun(n))
+	be.PutUint32(bhs[20:], uint32(length))
+	copy(bhs[32:], cdb)
+	itt := be.Uint32(bhs[16:])
+	immediate = min(immediate, len(out))
+	i.write(bhs, out[:immediate])
+
+	resp := &response{}
+	for {
+		p := i.read()
+		i.c.Assert(p.itt(), Equals, itt)
+		switch p.opcode() {
+		case opR2T:
+			offset, burst := int(be.Uint32(p.bhs[40:])), int(be.Uint32(p.bhs[44:]))
+			i.c.Assert(burst <= i.maxBurstLength, Equals, true)
+			i.c.Assert(offset+burst <= len(out), Equals, true)
+			// A burst in PDUs of at most 8 KiB.
+			for sent := 0; sent < burst; {
+				chunk := min(8192, burst-sent)
+				dbhs := i.newBHS(opSCSIDataOut, 0, true)
+				copy(dbhs[8:], lun(n))
+				be.PutUint32(dbhs[16:], itt)
+				be.PutUint32(dbhs[20:], p.ttt())
+				be.PutUint32(dbhs[40:], uint32(offset+sent))
+				if sent+chunk == burst {
+					dbhs[1] = flagFinal
+				}
+				i.write(dbhs, out[offset+sent:offset+sent+chunk])
+				sent += chunk
+			}
+		case opSCSIDataIn:
+			i.c.Assert(int(be.Uint32(p.bhs[40:])), Equals, len(resp.data))
+			resp.data = append(resp.data, p.data...)
+			if p.flags()&flagStatus != 0 {
+				resp.status, resp.flags, resp.residual = p.bhs[3], p.flags(), be.Uint32(p.bhs[44:])
+				return resp
+			}
+		case opSCSIResponse:
+			resp.status, resp.flags, resp.residual = p.bhs[3], p.flags(), be.Uint32(p.bhs[44:])
+			if len(p.data) > 0 {
+				resp.sense = p.data[2 : 2+be.Uint16(p.data)]
+			}
+			return resp
+		default:
+			i.c.Fatalf("unexpected opcode 0x%x", p.opcode())
+		}
+	}
+}
+
+func (i *testInitiator) assertGood(resp *response) {
+	i.c.Assert(resp.status, Equals, uint8(statusGood), Commentf("sense %x", resp.sense))
+}
+
+func (i *testInitiator) assertSense(resp *response, key uint8, asc int) {
+	i.c.Assert(resp.status, Equals, uint8(statusCheckCondition))
+	i.c.Assert(resp.sense, HasLen, fixedSenseSize)
+	i.c.Assert(resp.sense[2], Equals, key)
+	i.c.Assert(int(resp.sense[12])<<8|int(resp.sense[13]), Equals, asc)
+}
+
+func rw16(op uint8, lba uint64, blocks uint32) []byte {
+	cdb := make([]byte, 16)
+	cdb[0] = op
+	be.PutUint64(cdb[2:], lba)
+	be.PutUint32(cdb[10:], blocks)
+	return cdb
+}
+
+func rw10(op uint8, lba uint32, blocks uint16) []byte {
+	cdb := make([]byte, 10)
+	cdb[0] = op
+	be.PutUint32(cdb[2:], lba)
+	be.PutUint16(cdb[7:], blocks)
+	return cdb
+}
+
+func (i *testInitiator) readCapacity() (uint64, uint32) {
+	cdb := make([]byte, 16)
+	cdb[0], cdb[1] = scsiServiceActionIn16, saReadCapacity16
+	be.PutUint32(cdb[10:], 32)
+	resp := i.command(cdb, nil, 32, 0)
+	i.assertGood(resp)
+	return be.Uint64(resp.data), be.Uint32(resp.data[8:])
+}
+
+func (i *testInitiator) logout() {
+	i.write(i.newBHS(opLogoutReq, flagFinal, true), nil)
+	p := i.read()
+	i.c.Assert(p.opcode(), Equals, uint8(opLogoutResp))
+	i.c.Assert(p.bhs[2], Equals, uint8(0))
+	_, err := i.reader.ReadByte()
+	i.c.Assert(err, Equals, io.EOF)
+}
+
+func (s *TestSuite) TestDiscovery(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	i := dialTestInitiator(c, t)
+	defer i.close()
+	values := i.login("", "Discovery", false)
+	c.Assert(values["TargetPortalGroupTag"], Equals, "")
+
+	bhs := i.newBHS(opTextReq, flagFinal, false)
+	be.PutUint32(bhs[20:], reservedTag)
+	i.write(bhs, []byte(keys("SendTargets=All")))
+	p := i.read()
+	c.Assert(p.opcode(), Equals, uint8(opTextResp))
+	c.Assert(string(p.data), Equals, keys("TargetName="+t.iqn, "TargetAddress="+t.listener.Addr().String()+",1"))
+
+	// A discovery session runs no command.
+	i.write(i.newBHS(opSCSICommand, flagFinal, false), nil)
+	p = i.read()
+	c.Assert(p.opcode(), Equals, uint8(opReject))
+	c.Assert(p.bhs[2], Equals, uint8(rejectProtocolError))
+	i.logout()
+}
+
+func (s *TestSuite) TestLoginRejected(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+
+	for _, e := range []struct {
+		comment string
+		flags   uint8
+		text    string
+		status  uint16
+	}{
+		{"unknown target", flagTransit | stageOperational<<2 | stageFullFeature,
+			keys("InitiatorName="+testInitiatorName, "TargetName=iqn.2019-10.io.longhorn:other"), loginTargetNotFound},
+		{"no target", flagTransit | stageOperational<<2 | stageFullFeature,
+			keys("InitiatorName=" + testInitiatorName), loginMissingParameter},
+		{"no initiator", flagTransit | stageOperational<<2 | stageFullFeature,
+			keys("TargetName=" + t.iqn), loginMissingParameter},
+		{"authentication required", flagTransit | stageSecurity<<2 | stageOperational,
+			keys("InitiatorName="+testInitiatorName, "TargetName="+t.iqn, "AuthMethod=CHAP"), loginAuthFailure},
+		{"invalid stage transition", flagTransit | stageOperational<<2 | stageSecurity,
+			keys("InitiatorName="+testInitiatorName, "TargetName="+t.iqn), loginInvalidRequest},
+		{"invalid session type", flagTransit | stageOperational<<2 | stageFullFeature,
+			keys("InitiatorName="+testInitiatorName, "SessionType=Other"), loginInitiatorError},
+		{"invalid text", flagTransit | stageOperational<<2 | stageFullFeature, "InitiatorName\x00", loginInitiatorError},
+	} {
+		i := dialTestInitiator(c, t)
+		status, p, _ := i.loginRequest(e.flags, e.text)
+		c.Assert(status, Equals, e.status, Commentf(e.comment))
+		c.Assert(be.Uint16(p.bhs[14:]), Equals, uint16(0))
+		// The connection is dropped.
+		_, err := i.reader.ReadByte()
+		c.Assert(err, Equals, io.EOF, Commentf(e.comment))
+		i.close()
+	}
+
+	// A PDU other than a login request before the full feature phase.
+	i := dialTestInitiator(c, t)
+	defer i.close()
+	i.write(i.newBHS(opSCSICommand, flagFinal, false), nil)
+	_, err := i.reader.ReadByte()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *TestSuite) TestReadWrite(c *C) {
+	for _, digests := range []bool{false, true} {
+		t, replica := startTestTarget(c)
+		i := dialTestInitiator(c, t)
+		values := i.login(t.iqn, "Normal", digests, "ImmediateData=Yes", "FirstBurstLength=4096",
+			"MaxBurstLength=65536", "InitialR2T=No")
+		c.Assert(i.headerDigest, Equals, digests)
+		c.Assert(values["TargetPortalGroupTag"], Equals, "1")
+		c.Assert(values["MaxRecvDataSegmentLength"], Equals, fmt.Sprint(maxRecvDataSegmentLength))
+		c.Assert(values["MaxBurstLength"], Equals, "65536")
+		c.Assert(values["InitialR2T"], Equals, valueYes)
+		i.maxBurstLength = 65536
+
+		blocks, blockSize := i.readCapacity()
+		c.Assert(blocks, Equals, uint64(testVolumeSize/testBlockSize-1))
+		c.Assert(blockSize, Equals, uint32(testBlockSize))
+
+		// Immediate data only, then immediate data and three bursts.
+		small := bytes.Repeat([]byte{0x33}, 2*testBlockSize)
+		i.assertGood(i.command(rw10(scsiWrite10, 1, 2), small, 0, len(small)))
+		large := make([]byte, 160<<10)
+		for n := range large {
+			large[n] = byte(n % 251)
+		}
+		i.assertGood(i.command(rw16(scsiWrite16, 64, uint32(len(large)/testBlockSize)), large, 0, 4096))
+		stored := make([]byte, len(large))
+		_, err := replica.ReadAt(stored, 64*testBlockSize)
+		c.Assert(err, IsNil)
+		c.Assert(stored, DeepEquals, large)
+
+		// Read back in Data-In PDUs of at most the 8 KiB of the initiator.
+		resp := i.command(rw16(scsiRead16, 64, uint32(len(large)/testBlockSize)), nil, len(large), 0)
+		i.assertGood(resp)
+		c.Assert(resp.data, DeepEquals, large)
+		resp = i.command(rw10(scsiRead10, 0, 3), nil, 3*testBlockSize, 0)
+		i.assertGood(resp)
+		c.Assert(resp.data, DeepEquals, append(make([]byte, testBlockSize), small...))
+		// A read of less than the expected length.
+		resp = i.command(rw10(scsiRead10, 1, 1), nil, 4*testBlockSize, 0)
+		i.assertGood(resp)
+		c.Assert(resp.flags&flagUnderflow, Equals, uint8(flagUnderflow))
+		c.Assert(resp.residual, Equals, uint32(3*testBlockSize))
+
+		sync := make([]byte, 10)
+		sync[0] = scsiSynchronizeCache10
+		i.assertGood(i.command(sync, nil, 0, 0))
+
+		// Unmap two ranges, and zero one with a write same.
+		unmap := make([]byte, 8+2*unmapDescriptorSize)
+		be.PutUint16(unmap[2:], 2*unmapDescriptorSize)
+		be.PutUint64(unmap[8:], 1)
+		be.PutUint32(unmap[16:], 1)
+		be.PutUint64(unmap[24:], 70)
+		be.PutUint32(unmap[32:], 2)
+		cdb := make([]byte, 10)
+		cdb[0] = scsiUnmap
+		be.PutUint16(cdb[7:], uint16(len(unmap)))
+		i.assertGood(i.command(cdb, unmap, 0, len(unmap)))
+		i.assertGood(i.command(rw16(scsiWriteSame16, 64, 2), make([]byte, testBlockSize), 0, testBlockSize))
+		// A write same of a pattern.
+		pattern := bytes.Repeat([]byte{0x7e}, testBlockSize)
+		i.assertGood(i.command(rw16(scsiWriteSame16, 100, 3), pattern, 0, testBlockSize))
+
+		resp = i.command(rw16(scsiRead16, 64, 40), nil, 40*testBlockSize, 0)
+		i.assertGood(resp)
+		expected := append([]byte(nil), large[:40*testBlockSize]...)
+		clear(expected[:2*testBlockSize])
+		clear(expected[6*testBlockSize : 8*testBlockSize])
+		copy(expected[36*testBlockSize:], bytes.Repeat(pattern, 3))
+		c.Assert(resp.data, DeepEquals, expected)
+		resp = i.command(rw10(scsiRead10, 1, 2), nil, 2*testBlockSize, 0)
+		c.Assert(resp.data, DeepEquals, append(make([]byte, testBlockSize), small[testBlockSize:]...))
+
+		i.logout()
+		i.close()
+		c.Assert(t.Shutdown(), IsNil)
+	}
+}
+
+func (s *TestSuite) TestCommandErrors(c *C) {
+	t, replica := startTestTarget(c)
+	defer t.Shutdown()
+	i := dialTestInitiator(c, t)
+	defer i.close()
+	i.login(t.iqn, "Normal", false, "ImmediateData=Yes", "FirstBurstLength=65536")
+
+	blocks := uint64(testVolumeSize / testBlockSize)
+	i.assertSense(i.command(rw16(scsiRead16, blocks-1, 2), nil, 2*testBlockSize, 0), senseIllegalRequest,
+		ascLBAOutOfRange)
+	i.assertSense(i.command(rw16(scsiRead16, 1<<63, 1), nil, testBlockSize, 0), senseIllegalRequest, ascLBAOutOfRange)
+	i.assertSense(i.command(rw16(scsiWrite16, blocks, 1), make([]byte, testBlockSize), 0, testBlockSize),
+		senseIllegalRequest, ascLBAOutOfRange)
+	i.assertSense(i.command(rw16(scsiRead16, 0, maxTransferLength/testBlockSize+1), nil, 0, 0), senseIllegalRequest,
+		ascInvalidFieldInCDB)
+	i.assertSense(i.command(rw16(scsiWriteSame16, 0, 0), make([]byte, testBlockSize), 0, testBlockSize),
+		senseIllegalRequest, ascInvalidFieldInCDB)
+	i.assertSense(i.command([]byte{0xc0}, nil, 0, 0), senseIllegalRequest, ascInvalidOpcode)
+	unmap := make([]byte, 8+unmapDescriptorSize)
+	be.PutUint16(unmap[2:], unmapDescriptorSize)
+	be.PutUint64(unmap[8:], blocks-1)
+	be.PutUint32(unmap[16:], 2)
+	cdb := make([]byte, 10)
+	cdb[0] = scsiUnmap
+	be.PutUint16(cdb[7:], uint16(len(unmap)))
+	i.assertSense(i.command(cdb, unmap, 0, len(unmap)), senseIllegalRequest, ascLBAOutOfRange)
+
+	// LUN 0 only reports the LUNs.
+	i.assertSense(i.commandLUN(0, rw10(scsiRead10, 0, 1), nil, testBlockSize, 0), senseIllegalRequest,
+		ascLUNNotSupported)
+	report := make([]byte, 12)
+	report[0] = scsiReportLUNs
+	be.PutUint32(report[6:], 16)
+	resp := i.commandLUN(0, report, nil, 16, 0)
+	i.assertGood(resp)
+	c.Assert(resp.data, DeepEquals, append([]byte{0, 0, 0, 8, 0, 0, 0, 0}, lun(diskLUN)...))
+	inquiry := []byte{scsiInquiry, 0, 0, 0, 96, 0}
+	resp = i.commandLUN(0, inquiry, nil, 96, 0)
+	i.assertGood(resp)
+	c.Assert(resp.data[0], Equals, uint8(peripheralNoDevice))
+	resp = i.command(inquiry, nil, 96, 0)
+	i.assertGood(resp)
+	c.Assert(resp.data, HasLen, 66)
+	c.Assert(resp.data[0], Equals, uint8(peripheralDisk))
+	c.Assert(string(resp.data[8:16]), Equals, vendorID)
+	// The serial number page, cut at the allocation length.
+	resp = i.command([]byte{scsiInquiry, 1, 0x80, 0, 10, 0}, nil, 10, 0)
+	i.assertGood(resp)
+	c.Assert(string(resp.data[4:]), Equals, t.serial[:6])
+
+	// The errors of the volume are medium errors.
+	replica.SetState(types.ReplicaStateError)
+	i.assertSense(i.command(rw10(scsiRead10, 0, 1), nil, testBlockSize, 0), senseMediumError, ascUnrecoveredReadError)
+	i.assertSense(i.command(rw10(scsiWrite10, 0, 1), make([]byte, testBlockSize), 0, testBlockSize), senseMediumError,
+		ascWriteError)
+}
+
+func (s *TestSuite) TestProtocolErrors(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+
+	for _, e := range []struct {
+		comment string
+		send    func(i *testInitiator)
+	}{
+		{"immediate data of a read", func(i *testInitiator) {
+			bhs := i.newBHS(opSCSICommand, flagFinal|flagRead, false)
+			copy(bhs[8:], lun(diskLUN))
+			copy(bhs[32:], rw10(scsiRead10, 0, 1))
+			i.write(bhs, make([]byte, testBlockSize))
+		}},
+		{"immediate data beyond the first burst", func(i *testInitiator) {
+			bhs := i.newBHS(opSCSICommand, flagFinal|flagWrite, false)
+			copy(bhs[8:], lun(diskLUN))
+			be.PutUint32(bhs[20:], 128<<10)
+			copy(bhs[32:], rw10(scsiWrite10, 0, 256))
+			i.write(bhs, make([]byte, 128<<10))
+		}},
+		{"data out of the burst", func(i *testInitiator) {
+			bhs := i.newBHS(opSCSICommand, flagFinal|flagWrite, false)
+			copy(bhs[8:], lun(diskLUN))
+			be.PutUint32(bhs[20:], 2*testBlockSize)
+			copy(bhs[32:], rw10(scsiWrite10, 0, 2))
+			i.write(bhs, nil)
+			r2t := i.read()
+			i.c.Assert(r2t.opcode(), Equals, uint8(opR2T))
+			dbhs := i.newBHS(opSCSIDataOut, flagFinal, true)
+			be.PutUint32(dbhs[16:], r2t.itt())
+			be.PutUint32(dbhs[20:], r2t.ttt())
+			be.PutUint32(dbhs[40:], testBlockSize)
+			i.write(dbhs, make([]byte, testBlockSize))
+		}},
+		{"data beyond the limit", func(i *testInitiator) {
+			i.write(i.newBHS(opNopOut, flagFinal, true), make([]byte, maxRecvDataSegmentLength+4))
+		}},
+	} {
+		i := dialTestInitiator(c, t)
+		i.login(t.iqn, "Normal", true)
+		e.send(i)
+		// The connection is dropped, and reset if the data sent was not all read.
+		_, err := i.reader.ReadByte()
+		c.Assert(err, NotNil, Commentf(e.comment))
+		i.close()
+	}
+
+	// Unsupported requests are rejected, and the session goes on.
+	i := dialTestInitiator(c, t)
+	defer i.close()
+	i.login(t.iqn, "Normal", false)
+	i.write(i.newBHS(opSNACKReq, flagFinal, false), nil)
+	p := i.read()
+	c.Assert(p.opcode(), Equals, uint8(opReject))
+	c.Assert(p.bhs[2], Equals, uint8(rejectCommandNotSupported))
+	c.Assert(p.data[0]&opcodeMask, Equals, uint8(opSNACKReq))
+
+	nop := i.newBHS(opNopOut, flagFinal, true)
+	be.PutUint32(nop[20:], reservedTag)
+	i.write(nop, []byte("ping"))
+	p = i.read()
+	c.Assert(p.opcode(), Equals, uint8(opNopIn))
+	c.Assert(string(p.data), Equals, "ping")
+}
+
+func (s *TestSuite) TestTaskManagement(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	i := dialTestInitiator(c, t)
+	defer i.close()
+	i.login(t.iqn, "Normal", false, "ImmediateData=No")
+
+	// A write waiting for its data is aborted, and its data dropped.
+	bhs := i.newBHS(opSCSICommand, flagFinal|flagWrite, false)
+	copy(bhs[8:], lun(diskLUN))
+	be.PutUint32(bhs[20:], testBlockSize)
+	copy(bhs[32:], rw10(scsiWrite10, 0, 1))
+	itt := be.Uint32(bhs[16:])
+	i.write(bhs, nil)
+	r2t := i.read()
+	c.Assert(r2t.opcode(), Equals, uint8(opR2T))
+
+	for _, e := range []struct {
+		function uint8
+		response uint8
+	}{
+		{tmfAbortTask, tmfComplete},
+		{tmfLUNReset, tmfComplete},
+		{tmfTaskReassign, tmfReassignNotSupported},
+		{0x7f, tmfFunctionNotSupported},
+	} {
+		tmf := i.newBHS(opTaskMgmtReq, flagFinal|e.function, true)
+		copy(tmf[8:], lun(diskLUN))
+		be.PutUint32(tmf[20:], itt)
+		i.write(tmf, nil)
+		p := i.read()
+		c.Assert(p.opcode(), Equals, uint8(opTaskMgmtResp))
+		c.Assert(p.bhs[2], Equals, e.response)
+	}
+	dbhs := i.newBHS(opSCSIDataOut, flagFinal, true)
+	be.PutUint32(dbhs[16:], itt)
+	be.PutUint32(dbhs[20:], r2t.ttt())
+	i.write(dbhs, make([]byte, testBlockSize))
+
+	// The session goes on.
+	i.assertGood(i.command([]byte{scsiTestUnitReady, 0, 0, 0, 0, 0}, nil, 0, 0))
+}
+
+func (s *TestSuite) TestExpandUnitAttention(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	i := dialTestInitiator(c, t)
+	defer i.close()
+	i.login(t.iqn, "Normal", false)
+
+	c.Assert(t.Expand(2*testVolumeSize), IsNil)
+	tur := []byte{scsiTestUnitReady, 0, 0, 0, 0, 0}
+	i.assertSense(i.command(tur, nil, 0, 0), senseUnitAttention, ascCapacityDataChanged)
+	// The unit attention is reported once.
+	i.assertGood(i.command(tur, nil, 0, 0))
+	blocks, _ := i.readCapacity()
+	c.Assert(blocks, Equals, uint64(2*testVolumeSize/testBlockSize-1))
+
+	// Through REQUEST SENSE this time.
+	c.Assert(t.Expand(3*testVolumeSize), IsNil)
+	resp := i.command([]byte{scsiRequestSense, 0, 0, 0, fixedSenseSize, 0}, nil, fixedSenseSize, 0)
+	i.assertGood(resp)
+	c.Assert(resp.data[2], Equals, uint8(senseUnitAttention))
+	blocks, _ = i.readCapacity()
+	c.Assert(blocks, Equals, uint64(3*testVolumeSize/testBlockSize-1))
+}
+
+func (s *TestSuite) TestModeSenseSelect(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	i := dialTestInitiator(c, t)
+	defer i.close()
+	i.login(t.iqn, "Normal", false)
+
+	sense := func() []byte {
+		resp := i.command([]byte{scsiModeSense6, 0x08, modePageCaching, 0, 255, 0}, nil, 255, 0)
+		i.assertGood(resp)
+		c.Assert(resp.data[3], Equals, uint8(0))
+		return resp.data[4:]
+	}
+	c.Assert(sense()[2]&cachingWCE, Equals, uint8(cachingWCE))
+
+	// Disable the write cache.
+	data := make([]byte, 4+20)
+	data[4], data[5] = modePageCaching, 18
+	i.assertGood(i.command([]byte{scsiModeSelect6, 0x10, 0, 0, uint8(len(data)), 0}, data, 0, len(data)))
+	c.Assert(sense()[2]&cachingWCE, Equals, uint8(0))
+	c.Assert(t.writeCache.Load(), Equals, false)
+
+	// A page longer than the parameter list.
+	data[5] = 30
+	i.assertSense(i.command([]byte{scsiModeSelect6, 0x10, 0, 0, uint8(len(data)), 0}, data, 0, len(data)),
+		senseIllegalRequest, ascParameterListLengthError)
+	i.assertSense(i.command([]byte{scsiModeSense6, 0, modePageControlSaved<<6 | modePageCaching, 0, 255, 0}, nil, 255, 0),
+		senseIllegalRequest, ascSavingNotSupported)
+}
+
+func (s *TestSuite) TestSessionReinstatement(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	first := dialTestInitiator(c, t)
+	defer first.close()
+	first.login(t.iqn, "Normal", false)
+
+	// The same initiator and ISID replace the session.
+	second := dialTestInitiator(c, t)
+	defer second.close()
+	second.login(t.iqn, "Normal", false)
+	c.Assert(second.tsih, Not(Equals), first.tsih)
+	_, err := first.reader.ReadByte()
+	c.Assert(err, NotNil)
+	second.assertGood(second.command([]byte{scsiTestUnitReady, 0, 0, 0, 0, 0}, nil, 0, 0))
+
+	c.Assert(t.Shutdown(), IsNil)
+	c.Assert(t.State(), Equals, types.StateDown)
+	_, err = second.reader.ReadByte()
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,183 @@
+package iscsi
+
+import (
+	"errors"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+const (
+	// maxUnmapLength is the largest range unmapped at once, an unmapped range is split into such chunks
+	maxUnmapLength      = 1 << 30
+	maxUnmapDescriptors = 256
+	unmapDescriptorSize = 16
+	// maxWriteSameLength bounds the range of a write same
+	maxWriteSameLength = 1 << 30
+	// writeSameChunkSize is how much of a pattern of a write same is written at once
+	writeSameChunkSize = 1024 * 1024
+
+	cdbFUA         = 0x08
+	cdbNoDataOut   = 0x01
+	cdbParamLength = 7
+)
+
+// ioFailure maps an error of the volume to sense data. A volume out of space is write protected.
+func ioFailure(err error, asc int) *result {
+	if errors.Is(err, types.ErrNoSpaceLeftOnDevice) {
+		return checkCondition(senseDataProtect, ascSpaceAllocationFailed)
+	}
+	return checkCondition(senseMediumError, asc)
+}
+
+func (t *Target) blocks() int64 {
+	return t.getSize() / int64(t.blockSize)
+}
+
+// lbaRange checks that blocks at lba are in the volume, and returns their offset and length.
+func (t *Target) lbaRange(lba, blocks uint64) (int64, int64, *result) {
+	total := uint64(t.blocks())
+	if lba > total || blocks > total-lba {
+		return 0, 0, checkCondition(senseIllegalRequest, ascLBAOutOfRange)
+	}
+	return int64(lba * uint64(t.blockSize)), int64(blocks * uint64(t.blockSize)), nil
+}
+
+// readWrite handles the READ and WRITE commands of all sizes. A write with FUA, or with the write cache disabled,
+// is flushed before it completes.
+func (t *Target) readWrite(cdb []byte, data []byte) *result {
+	var lba, blocks uint64
+	fua := cdb[1]&cdbFUA != 0
+	switch cdb[0] {
+	case scsiRead6, scsiWrite6:
+		lba, blocks = uint64(be.Uint32(cdb[0:])&0x1fffff), uint64(cdb[4])
+		if blocks == 0 {
+			blocks = 256
+		}
+		fua = false
+	case scsiRead10, scsiWrite10:
+		lba, blocks = uint64(be.Uint32(cdb[2:])), uint64(be.Uint16(cdb[7:]))
+	case scsiRead12, scsiWrite12:
+		lba, blocks = uint64(be.Uint32(cdb[2:])), uint64(be.Uint32(cdb[6:]))
+	default:
+		lba, blocks = be.Uint64(cdb[2:]), uint64(be.Uint32(cdb[10:]))
+	}
+	off, length, r := t.lbaRange(lba, blocks)
+	if r != nil {
+		return r
+	}
+	if length > maxTransferLength {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+	}
+	if length == 0 {
+		return good(nil)
+	}
+
+	switch cdb[0] {
+	case scsiRead6, scsiRead10, scsiRead12, scsiRead16:
+		buf := make([]byte, length)
+		if _, err := t.rwu.ReadAt(buf, off); err != nil {
+			return ioFailure(err, ascUnrecoveredReadError)
+		}
+		return good(buf)
+	}
+	if int64(len(data)) < length {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+	}
+	if _, err := t.rwu.WriteAt(data[:length], off); err != nil {
+		return ioFailure(err, ascWriteError)
+	}
+	if fua || !t.writeCache.Load() {
+		return t.flush()
+	}
+	return good(nil)
+}
+
+func (t *Target) flush() *result {
+	if flusher, ok := t.rwu.(types.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			return ioFailure(err, ascWriteError)
+		}
+	}
+	return good(nil)
+}
+
+// unmap unmaps the ranges of the block descriptors of an UNMAP command.
+func (t *Target) unmap(cdb []byte, data []byte) *result {
+	data = truncate(data, int(be.Uint16(cdb[cdbParamLength:])))
+	if len(data) == 0 {
+		return good(nil)
+	}
+	if len(data) < 8 {
+		return checkCondition(senseIllegalRequest, ascParameterListLengthError)
+	}
+	descriptors := truncate(data[8:], int(be.Uint16(data[2:])))
+	if len(descriptors)/unmapDescriptorSize > maxUnmapDescriptors {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInParameterList)
+	}
+
+	for ; len(descriptors) >= unmapDescriptorSize; descriptors = descriptors[unmapDescriptorSize:] {
+		off, length, r := t.lbaRange(be.Uint64(descriptors[0:]), uint64(be.Uint32(descriptors[8:])))
+		if r != nil {
+			return r
+		}
+		for length > 0 {
+			n := min(length, maxUnmapLength)
+			if _, err := t.rwu.UnmapAt(uint32(n), off); err != nil {
+				return ioFailure(err, ascWriteError)
+			}
+			off += n
+			length -= n
+		}
+	}
+	return good(nil)
+}
+
+// writeSame writes the block of a WRITE SAME command to a range. A block of zeros, or none with NDOB, zeroes the
+// range, which the UNMAP bit cannot make an unmap since unmapped blocks do not read zeros.
+func (t *Target) writeSame(cdb []byte, data []byte) *result {
+	var lba, blocks uint64
+	noDataOut := false
+	if cdb[0] == scsiWriteSame10 {
+		lba, blocks = uint64(be.Uint32(cdb[2:])), uint64(be.Uint16(cdb[7:]))
+	} else {
+		lba, blocks = be.Uint64(cdb[2:]), uint64(be.Uint32(cdb[10:]))
+		noDataOut = cdb[1]&cdbNoDataOut != 0
+	}
+	if blocks == 0 {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+	}
+	off, length, r := t.lbaRange(lba, blocks)
+	if r != nil {
+		return r
+	}
+	if length > maxWriteSameLength {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+	}
+
+	if noDataOut || (len(data) >= t.blockSize && util.IsZeroes(data[:t.blockSize])) {
+		if _, err := util.WriteZeroesAt(t.rwu, uint32(length), off); err != nil {
+			return ioFailure(err, ascWriteError)
+		}
+	} else {
+		if len(data) < t.blockSize {
+			return checkCondition(senseIllegalRequest, ascParameterListLengthError)
+		}
+		chunk := make([]byte, min(length, writeSameChunkSize))
+		for i := 0; i < len(chunk); i += t.blockSize {
+			copy(chunk[i:], data[:t.blockSize])
+		}
+		for length > 0 {
+			n := min(length, int64(len(chunk)))
+			if _, err := t.rwu.WriteAt(chunk[:n], off); err != nil {
+				return ioFailure(err, ascWriteError)
+			}
+			off += n
+			length -= n
+		}
+	}
+	if !t.writeCache.Load() {
+		return t.flush()
+	}
+	return good(nil)
+}
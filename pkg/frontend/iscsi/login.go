@@ -0,0 +1,231 @@
+package iscsi
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stageSecurity    = 0
+	stageOperational = 1
+	stageFullFeature = 3
+
+	flagTransit = 0x80
+
+	// Login statuses, the class in the high byte and the detail in the low one
+	loginSuccess             = 0x0000
+	loginInitiatorError      = 0x0200
+	loginAuthFailure         = 0x0201
+	loginTargetNotFound      = 0x0203
+	loginUnsupportedVersion  = 0x0205
+	loginMissingParameter    = 0x0207
+	loginSessionDoesNotExist = 0x020a
+	loginInvalidRequest      = 0x020b
+)
+
+// login runs the login phase of a connection, up to the full feature phase. Only AuthMethod None is offered.
+func (c *conn) login() error {
+	var text []byte
+	identified := false
+	for first := true; ; first = false {
+		p, err := c.readPDU(maxRecvDataSegmentLength)
+		if err != nil {
+			return err
+		}
+		if p.opcode() != opLoginReq {
+			return newProtocolError("opcode 0x%x during login", p.opcode())
+		}
+		transit, csg, nsg := p.flags()&flagTransit != 0, int(p.flags()>>2)&3, int(p.flags())&3
+
+		if first {
+			copy(c.isid[:], p.bhs[8:14])
+			c.statSN = be.Uint32(p.bhs[28:])
+			c.expCmdSN.Store(p.cmdSN())
+			if p.bhs[3] > 0 {
+				return c.loginReject(p, loginUnsupportedVersion)
+			}
+			// A session has a single connection, so there is no session to add a connection to.
+			if be.Uint16(p.bhs[14:]) != 0 {
+				return c.loginReject(p, loginSessionDoesNotExist)
+			}
+		}
+		if csg == stageFullFeature || (transit && (nsg <= csg || nsg == 2)) {
+			return c.loginReject(p, loginInvalidRequest)
+		}
+
+		text = append(text, p.data...)
+		if p.flags()&flagContinue != 0 {
+			// More of the text follows, which is answered once it is complete.
+			if err := c.loginRespond(p, false, csg, nsg, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		pairs, err := parseText(text)
+		if err != nil {
+			return c.loginReject(p, loginInitiatorError)
+		}
+		text = nil
+
+		resp, status := c.negotiate(pairs)
+		if status == loginSuccess && !identified {
+			status = c.identify()
+			if status == loginSuccess && !c.discovery {
+				resp = append(resp, keyValue{key: "TargetPortalGroupTag", value: strconv.Itoa(targetPortalGroupTag)})
+			}
+			identified = true
+		}
+		if status != loginSuccess {
+			return c.loginReject(p, status)
+		}
+		final := transit && nsg == stageFullFeature
+		if !c.declaredRecvLength && (csg == stageOperational || final) {
+			resp = append(resp, keyValue{key: "MaxRecvDataSegmentLength", value: strconv.Itoa(maxRecvDataSegmentLength)})
+			c.declaredRecvLength = true
+		}
+		if final {
+			c.target.addSession(c)
+		}
+		if err := c.loginRespond(p, transit, csg, nsg, resp); err != nil {
+			return err
+		}
+		if final {
+			break
+		}
+	}
+
+	c.headerDigest, c.dataDigest = c.pendingHeaderDigest, c.pendingDataDigest
+	c.firstBurstLength = min(c.firstBurstLength, c.maxBurstLength)
+	sessionType := "normal"
+	if c.discovery {
+		sessionType = "discovery"
+	}
+	logrus.Infof("iSCSI initiator %v logged in to %v from %v, %v session 0x%x", c.initiatorName, c.target.Volume,
+		c.netConn.RemoteAddr(), sessionType, c.tsih)
+	return nil
+}
+
+// identify checks the initiator and the target named in the first login request.
+func (c *conn) identify() int {
+	if c.initiatorName == "" {
+		return loginMissingParameter
+	}
+	if c.discovery {
+		return loginSuccess
+	}
+	if c.targetName == "" {
+		return loginMissingParameter
+	}
+	if c.targetName != c.target.iqn {
+		return loginTargetNotFound
+	}
+	return loginSuccess
+}
+
+// negotiate answers the keys of a login request.
+func (c *conn) negotiate(pairs []keyValue) ([]keyValue, int) {
+	var resp []keyValue
+	for _, kv := range pairs {
+		value := valueReject
+		n, numeric := parseNumber(kv.value)
+		switch kv.key {
+		case "InitiatorName":
+			c.initiatorName = kv.value
+			continue
+		case "InitiatorAlias":
+			continue
+		case "TargetName":
+			c.targetName = kv.value
+			continue
+		case "SessionType":
+			switch kv.value {
+			case "Discovery":
+				c.discovery = true
+			case "Normal":
+				c.discovery = false
+			default:
+				return nil, loginInitiatorError
+			}
+			continue
+		case "MaxRecvDataSegmentLength":
+			if !numeric || n < 512 {
+				return nil, loginInitiatorError
+			}
+			c.maxSendDataSegmentLength = n
+			continue
+		case "AuthMethod":
+			value = chooseValue(kv.value, valueNone)
+			if value == valueReject {
+				return nil, loginAuthFailure
+			}
+		case "HeaderDigest":
+			value = chooseValue(kv.value, valueCRC32C, valueNone)
+			c.pendingHeaderDigest = value == valueCRC32C
+		case "DataDigest":
+			value = chooseValue(kv.value, valueCRC32C, valueNone)
+			c.pendingDataDigest = value == valueCRC32C
+		case "MaxBurstLength":
+			if numeric && n >= 512 {
+				c.maxBurstLength = min(n, maxBurstLength)
+				value = strconv.Itoa(c.maxBurstLength)
+			}
+		case "FirstBurstLength":
+			if numeric && n >= 512 {
+				c.firstBurstLength = min(n, maxBurstLength)
+				value = strconv.Itoa(c.firstBurstLength)
+			}
+		case "ImmediateData":
+			if kv.value == valueYes || kv.value == valueNo {
+				c.immediateData = kv.value == valueYes
+				value = kv.value
+			}
+		case "InitialR2T", "DataPDUInOrder", "DataSequenceInOrder":
+			value = valueYes
+		case "MaxOutstandingR2T", "MaxConnections":
+			value = "1"
+		case "ErrorRecoveryLevel", "DefaultTime2Retain":
+			value = "0"
+		case "DefaultTime2Wait":
+			if numeric {
+				value = strconv.Itoa(max(n, 2))
+			}
+		case "IFMarker", "OFMarker":
+			value = valueNo
+		case "IFMarkInt", "OFMarkInt":
+			value = valueIrrelevant
+		default:
+			value = valueNotUnderstood
+		}
+		resp = append(resp, keyValue{key: kv.key, value: value})
+	}
+	return resp, loginSuccess
+}
+
+// loginRespond answers a login request. The TSIH is only set in the response that ends the login.
+func (c *conn) loginRespond(p *pdu, transit bool, csg, nsg int, pairs []keyValue) error {
+	bhs := newBHS(opLoginResp, uint8(csg)<<2)
+	if transit {
+		bhs[1] |= flagTransit | uint8(nsg)
+		if nsg == stageFullFeature {
+			be.PutUint16(bhs[14:], c.tsih)
+		}
+	}
+	copy(bhs[8:14], c.isid[:])
+	be.PutUint32(bhs[16:], p.itt())
+	return c.send(bhs, encodeText(pairs))
+}
+
+// loginReject fails the login with status.
+func (c *conn) loginReject(p *pdu, status int) error {
+	bhs := newBHS(opLoginResp, 0)
+	copy(bhs[8:14], c.isid[:])
+	be.PutUint32(bhs[16:], p.itt())
+	be.PutUint16(bhs[36:], uint16(status))
+	if err := c.send(bhs, nil); err != nil {
+		return err
+	}
+	return fmt.Errorf("rejected login of initiator %q from %v with status 0x%04x", c.initiatorName,
+		c.netConn.RemoteAddr(), status)
+}
@@ -0,0 +1,201 @@
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	be = binary.BigEndian
+	le = binary.LittleEndian
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	// Initiator opcodes
+	opNopOut      = 0x00
+	opSCSICommand = 0x01
+	opTaskMgmtReq = 0x02
+	opLoginReq    = 0x03
+	opTextReq     = 0x04
+	opSCSIDataOut = 0x05
+	opLogoutReq   = 0x06
+	opSNACKReq    = 0x10
+
+	// Target opcodes
+	opNopIn        = 0x20
+	opSCSIResponse = 0x21
+	opTaskMgmtResp = 0x22
+	opLoginResp    = 0x23
+	opTextResp     = 0x24
+	opSCSIDataIn   = 0x25
+	opLogoutResp   = 0x26
+	opR2T          = 0x31
+	opReject       = 0x3f
+
+	opcodeMask    = 0x3f
+	flagImmediate = 0x40
+	flagFinal     = 0x80
+	flagContinue  = 0x40
+	flagRead      = 0x40
+	flagWrite     = 0x20
+	flagOverflow  = 0x04
+	flagUnderflow = 0x02
+	flagStatus    = 0x01
+
+	bhsSize    = 48
+	digestSize = 4
+
+	reservedTag = 0xffffffff
+
+	// Reasons of Reject PDUs
+	rejectDataDigestError     = 0x02
+	rejectCommandNotSupported = 0x05
+	rejectProtocolError       = 0x04
+	rejectInvalidPDUField     = 0x09
+)
+
+// pdu is a PDU read from an initiator. The additional header segments, the digests and the padding are not part
+// of it.
+type pdu struct {
+	bhs  []byte
+	data []byte
+}
+
+func (p *pdu) opcode() uint8 {
+	return p.bhs[0] & opcodeMask
+}
+
+func (p *pdu) immediate() bool {
+	return p.bhs[0]&flagImmediate != 0
+}
+
+func (p *pdu) flags() uint8 {
+	return p.bhs[1]
+}
+
+func (p *pdu) lun() []byte {
+	return p.bhs[8:16]
+}
+
+func (p *pdu) itt() uint32 {
+	return be.Uint32(p.bhs[16:])
+}
+
+func (p *pdu) ttt() uint32 {
+	return be.Uint32(p.bhs[20:])
+}
+
+func (p *pdu) cmdSN() uint32 {
+	return be.Uint32(p.bhs[24:])
+}
+
+// protocolError is a fatal error of the initiator. At error recovery level 0 the connection, and with it the
+// session, is dropped.
+type protocolError struct {
+	msg string
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("iSCSI protocol error: %v", e.msg)
+}
+
+func newProtocolError(format string, args ...interface{}) error {
+	return &protocolError{msg: fmt.Sprintf(format, args...)}
+}
+
+// newBHS returns the basic header segment of a PDU to an initiator.
+func newBHS(opcode, flags uint8) []byte {
+	bhs := make([]byte, bhsSize)
+	bhs[0] = opcode
+	bhs[1] = flags
+	return bhs
+}
+
+func padding(length int) int {
+	return (4 - length%4) % 4
+}
+
+func digest(b ...[]byte) []byte {
+	var sum uint32
+	for _, s := range b {
+		sum = crc32.Update(sum, crc32c, s)
+	}
+	d := make([]byte, digestSize)
+	le.PutUint32(d, sum)
+	return d
+}
+
+// readPDU reads a PDU of the initiator, whose data must fit in maxData bytes.
+func (c *conn) readPDU(maxData int) (*pdu, error) {
+	bhs := make([]byte, bhsSize)
+	if _, err := io.ReadFull(c.reader, bhs); err != nil {
+		return nil, err
+	}
+	ahs := make([]byte, int(bhs[4])*4)
+	if _, err := io.ReadFull(c.reader, ahs); err != nil {
+		return nil, err
+	}
+	if c.headerDigest {
+		d := make([]byte, digestSize)
+		if _, err := io.ReadFull(c.reader, d); err != nil {
+			return nil, err
+		}
+		if string(d) != string(digest(bhs, ahs)) {
+			return nil, newProtocolError("header digest of opcode 0x%x does not match", bhs[0]&opcodeMask)
+		}
+	}
+
+	length := int(bhs[5])<<16 | int(be.Uint16(bhs[6:]))
+	if length > maxData {
+		return nil, newProtocolError("%v bytes of data of opcode 0x%x exceed %v", length, bhs[0]&opcodeMask, maxData)
+	}
+	data := make([]byte, length+padding(length))
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return nil, err
+	}
+	if c.dataDigest && length > 0 {
+		d := make([]byte, digestSize)
+		if _, err := io.ReadFull(c.reader, d); err != nil {
+			return nil, err
+		}
+		if string(d) != string(digest(data)) {
+			return nil, newProtocolError("data digest of opcode 0x%x does not match", bhs[0]&opcodeMask)
+		}
+	}
+	return &pdu{bhs: bhs, data: data[:length]}, nil
+}
+
+// writePDU writes a PDU to the initiator, the caller holds the writeLock. The data segment length is set from
+// data.
+func (c *conn) writePDU(bhs, data []byte) error {
+	bhs[5] = byte(len(data) >> 16)
+	be.PutUint16(bhs[6:], uint16(len(data)))
+	if _, err := c.writer.Write(bhs); err != nil {
+		return err
+	}
+	if c.headerDigest {
+		if _, err := c.writer.Write(digest(bhs)); err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	pad := make([]byte, padding(len(data)))
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(pad); err != nil {
+		return err
+	}
+	if c.dataDigest {
+		if _, err := c.writer.Write(digest(data, pad)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
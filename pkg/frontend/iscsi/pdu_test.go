@@ -0,0 +1,154 @@
+package iscsi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+// encodePDU encodes a PDU the way an initiator does, with an additional header segment of ahsLength words.
+func encodePDU(bhs []byte, ahsLength int, data []byte, headerDigest, dataDigest bool) []byte {
+	bhs = append([]byte(nil), bhs...)
+	bhs[4] = uint8(ahsLength)
+	bhs[5] = byte(len(data) >> 16)
+	be.PutUint16(bhs[6:], uint16(len(data)))
+	ahs := make([]byte, ahsLength*4)
+	raw := append(bhs, ahs...)
+	if headerDigest {
+		raw = append(raw, digest(bhs, ahs)...)
+	}
+	if len(data) > 0 {
+		padded := append(append([]byte(nil), data...), make([]byte, padding(len(data)))...)
+		raw = append(raw, padded...)
+		if dataDigest {
+			raw = append(raw, digest(padded)...)
+		}
+	}
+	return raw
+}
+
+func newTestConn(raw []byte, headerDigest, dataDigest bool) *conn {
+	return &conn{reader: bufio.NewReader(bytes.NewReader(raw)), headerDigest: headerDigest, dataDigest: dataDigest}
+}
+
+func (s *TestSuite) TestReadPDU(c *C) {
+	bhs := make([]byte, bhsSize)
+	bhs[0] = opSCSICommand | flagImmediate
+	bhs[1] = flagFinal | flagWrite
+	be.PutUint32(bhs[16:], 0x1234)
+	be.PutUint32(bhs[24:], 7)
+	for _, data := range [][]byte{nil, []byte("data"), []byte("odd length")} {
+		for _, digests := range []bool{false, true} {
+			for _, ahsLength := range []int{0, 2} {
+				raw := encodePDU(bhs, ahsLength, data, digests, digests)
+				// A second PDU follows.
+				raw = append(raw, encodePDU(bhs, 0, nil, digests, digests)...)
+				conn := newTestConn(raw, digests, digests)
+
+				p, err := conn.readPDU(maxRecvDataSegmentLength)
+				c.Assert(err, IsNil)
+				c.Assert(p.opcode(), Equals, uint8(opSCSICommand))
+				c.Assert(p.immediate(), Equals, true)
+				c.Assert(p.flags(), Equals, uint8(flagFinal|flagWrite))
+				c.Assert(p.itt(), Equals, uint32(0x1234))
+				c.Assert(p.cmdSN(), Equals, uint32(7))
+				c.Assert(p.data, HasLen, len(data))
+				c.Assert(string(p.data), Equals, string(data))
+				p, err = conn.readPDU(maxRecvDataSegmentLength)
+				c.Assert(err, IsNil)
+				c.Assert(p.data, HasLen, 0)
+			}
+		}
+	}
+}
+
+func (s *TestSuite) TestReadPDUInvalid(c *C) {
+	bhs := make([]byte, bhsSize)
+	bhs[0] = opSCSIDataOut
+	raw := encodePDU(bhs, 0, []byte("data"), true, true)
+
+	var perr *protocolError
+	corrupt := append([]byte(nil), raw...)
+	corrupt[20] ^= 1
+	_, err := newTestConn(corrupt, true, true).readPDU(maxRecvDataSegmentLength)
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(err, ErrorMatches, ".*header digest.*")
+
+	corrupt = append([]byte(nil), raw...)
+	corrupt[bhsSize+digestSize] ^= 1
+	_, err = newTestConn(corrupt, true, true).readPDU(maxRecvDataSegmentLength)
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(err, ErrorMatches, ".*data digest.*")
+
+	// The data is bounded before it is read.
+	big := encodePDU(bhs, 0, make([]byte, 4096), false, false)
+	_, err = newTestConn(big[:bhsSize], false, false).readPDU(4095)
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(err, ErrorMatches, ".*4096 bytes of data.*exceed 4095.*")
+
+	_, err = newTestConn(raw[:bhsSize+2], true, true).readPDU(maxRecvDataSegmentLength)
+	c.Assert(err, NotNil)
+	c.Assert(errors.As(err, &perr), Equals, false)
+}
+
+func (s *TestSuite) TestWritePDU(c *C) {
+	for _, digests := range []bool{false, true} {
+		var out bytes.Buffer
+		conn := &conn{writer: bufio.NewWriter(&out), headerDigest: digests, dataDigest: digests}
+		bhs := newBHS(opSCSIDataIn, flagFinal)
+		be.PutUint32(bhs[16:], 9)
+		c.Assert(conn.writePDU(bhs, []byte("read data")), IsNil)
+		c.Assert(conn.writer.Flush(), IsNil)
+
+		// The target PDU reads back as an initiator one would.
+		p, err := newTestConn(out.Bytes(), digests, digests).readPDU(maxRecvDataSegmentLength)
+		c.Assert(err, IsNil)
+		c.Assert(p.opcode(), Equals, uint8(opSCSIDataIn))
+		c.Assert(p.itt(), Equals, uint32(9))
+		c.Assert(string(p.data), Equals, "read data")
+		c.Assert(out.Len()%4, Equals, 0)
+	}
+}
+
+func (s *TestSuite) TestText(c *C) {
+	pairs, err := parseText([]byte("InitiatorName=iqn.2004-10.com.ubuntu:01:host\x00HeaderDigest=CRC32C,None\x00Empty=\x00\x00"))
+	c.Assert(err, IsNil)
+	c.Assert(pairs, DeepEquals, []keyValue{
+		{key: "InitiatorName", value: "iqn.2004-10.com.ubuntu:01:host"},
+		{key: "HeaderDigest", value: "CRC32C,None"},
+		{key: "Empty", value: ""},
+	})
+	c.Assert(encodeText(pairs), DeepEquals,
+		[]byte("InitiatorName=iqn.2004-10.com.ubuntu:01:host\x00HeaderDigest=CRC32C,None\x00Empty=\x00"))
+	_, err = parseText([]byte("NoValue\x00"))
+	c.Assert(err, ErrorMatches, ".*invalid text key.*")
+
+	for _, t := range []struct {
+		value string
+		n     int
+		ok    bool
+	}{
+		{"8192", 8192, true},
+		{"0x2000", 8192, true},
+		{"-1", 0, false},
+		{"x", 0, false},
+		{"4294967296", 0, false},
+	} {
+		n, ok := parseNumber(t.value)
+		c.Assert([]interface{}{n, ok}, DeepEquals, []interface{}{t.n, t.ok}, Commentf(t.value))
+	}
+
+	c.Assert(chooseValue("CRC32C,None", valueCRC32C, valueNone), Equals, valueCRC32C)
+	c.Assert(chooseValue("None,CRC32C", valueCRC32C, valueNone), Equals, valueNone)
+	c.Assert(chooseValue("CHAP", valueNone), Equals, valueReject)
+}
@@ -0,0 +1,371 @@
+package iscsi
+
+const (
+	// SCSI operation codes
+	scsiTestUnitReady         = 0x00
+	scsiRequestSense          = 0x03
+	scsiRead6                 = 0x08
+	scsiWrite6                = 0x0a
+	scsiInquiry               = 0x12
+	scsiModeSelect6           = 0x15
+	scsiModeSense6            = 0x1a
+	scsiStartStopUnit         = 0x1b
+	scsiPreventAllowRemoval   = 0x1e
+	scsiReadCapacity10        = 0x25
+	scsiRead10                = 0x28
+	scsiWrite10               = 0x2a
+	scsiVerify10              = 0x2f
+	scsiSynchronizeCache10    = 0x35
+	scsiWriteSame10           = 0x41
+	scsiUnmap                 = 0x42
+	scsiModeSelect10          = 0x55
+	scsiModeSense10           = 0x5a
+	scsiRead16                = 0x88
+	scsiWrite16               = 0x8a
+	scsiVerify16              = 0x8f
+	scsiSynchronizeCache16    = 0x91
+	scsiWriteSame16           = 0x93
+	scsiServiceActionIn16     = 0x9e
+	scsiReportLUNs            = 0xa0
+	scsiRead12                = 0xa8
+	scsiWrite12               = 0xaa
+	scsiVerify12              = 0xaf
+	saReadCapacity16          = 0x10
+	statusGood                = 0x00
+	statusCheckCondition      = 0x02
+	senseNoSense              = 0x00
+	senseMediumError          = 0x03
+	senseIllegalRequest       = 0x05
+	senseUnitAttention        = 0x06
+	senseDataProtect          = 0x07
+	fixedSenseSize            = 18
+	peripheralDisk            = 0x00
+	peripheralNoDevice        = 0x7f
+	modePageCaching           = 0x08
+	modePageControl           = 0x0a
+	modePageAll               = 0x3f
+	modePageControlChangeable = 1
+	modePageControlSaved      = 3
+	cachingWCE                = 0x04
+	modeDPOFUA                = 0x10
+)
+
+// Additional sense codes and qualifiers, as ASC << 8 | ASCQ
+const (
+	ascNone                        = 0x0000
+	ascWriteError                  = 0x0c00
+	ascUnrecoveredReadError        = 0x1100
+	ascParameterListLengthError    = 0x1a00
+	ascInvalidOpcode               = 0x2000
+	ascLBAOutOfRange               = 0x2100
+	ascInvalidFieldInCDB           = 0x2400
+	ascLUNNotSupported             = 0x2500
+	ascInvalidFieldInParameterList = 0x2600
+	ascSpaceAllocationFailed       = 0x2707
+	ascCapacityDataChanged         = 0x2a09
+	ascSavingNotSupported          = 0x3900
+)
+
+// result is the outcome of a SCSI command.
+type result struct {
+	status uint8
+	sense  []byte
+	data   []byte
+}
+
+func good(data []byte) *result {
+	return &result{status: statusGood, data: data}
+}
+
+func checkCondition(key uint8, asc int) *result {
+	return &result{status: statusCheckCondition, sense: senseData(key, asc)}
+}
+
+// senseData returns fixed format sense data.
+func senseData(key uint8, asc int) []byte {
+	sense := make([]byte, fixedSenseSize)
+	sense[0] = 0x70
+	sense[2] = key
+	sense[7] = fixedSenseSize - 8
+	sense[12] = uint8(asc >> 8)
+	sense[13] = uint8(asc)
+	return sense
+}
+
+// truncate cuts the data of a command to its allocation length.
+func truncate(data []byte, allocationLength int) []byte {
+	if len(data) > allocationLength {
+		return data[:allocationLength]
+	}
+	return data
+}
+
+// lunNumber decodes the LUN of a command, which is in the peripheral or the flat space addressing method.
+func lunNumber(lun []byte) int {
+	if lun[0]>>6 > 1 {
+		return -1
+	}
+	return int(lun[0]&0x3f)<<8 | int(lun[1])
+}
+
+// execute runs a SCSI command. The volume is LUN 1, LUN 0 only reports the LUNs like the controller LUN of tgt.
+func (c *conn) execute(t *task, data []byte) *result {
+	target := c.target
+	op := t.cdb[0]
+
+	switch op {
+	case scsiInquiry:
+		return target.inquiry(t.cdb, lunNumber(t.lun) == diskLUN)
+	case scsiReportLUNs:
+		return target.reportLUNs(t.cdb)
+	}
+	if lunNumber(t.lun) != diskLUN {
+		if op == scsiRequestSense {
+			return good(truncate(senseData(senseIllegalRequest, ascLUNNotSupported), int(t.cdb[4])))
+		}
+		return checkCondition(senseIllegalRequest, ascLUNNotSupported)
+	}
+	if op == scsiRequestSense {
+		sense := senseData(senseNoSense, ascNone)
+		if c.unitAttention.CompareAndSwap(true, false) {
+			sense = senseData(senseUnitAttention, ascCapacityDataChanged)
+		}
+		return good(truncate(sense, int(t.cdb[4])))
+	}
+	// The volume was expanded since the last command.
+	if c.unitAttention.CompareAndSwap(true, false) {
+		return checkCondition(senseUnitAttention, ascCapacityDataChanged)
+	}
+
+	switch op {
+	case scsiTestUnitReady, scsiStartStopUnit, scsiPreventAllowRemoval, scsiVerify10, scsiVerify12, scsiVerify16:
+		return good(nil)
+	case scsiReadCapacity10:
+		return target.readCapacity10()
+	case scsiServiceActionIn16:
+		if t.cdb[1]&0x1f == saReadCapacity16 {
+			return target.readCapacity16(t.cdb)
+		}
+	case scsiModeSense6, scsiModeSense10:
+		return target.modeSense(t.cdb)
+	case scsiModeSelect6, scsiModeSelect10:
+		return target.modeSelect(t.cdb, data)
+	case scsiRead6, scsiRead10, scsiRead12, scsiRead16, scsiWrite6, scsiWrite10, scsiWrite12, scsiWrite16:
+		return target.readWrite(t.cdb, data)
+	case scsiSynchronizeCache10, scsiSynchronizeCache16:
+		return target.flush()
+	case scsiUnmap:
+		return target.unmap(t.cdb, data)
+	case scsiWriteSame10, scsiWriteSame16:
+		return target.writeSame(t.cdb, data)
+	}
+	return checkCondition(senseIllegalRequest, ascInvalidOpcode)
+}
+
+// inquiry returns the standard inquiry data, or a vital product data page. A LUN without the volume has no
+// vital product data.
+func (t *Target) inquiry(cdb []byte, disk bool) *result {
+	evpd, page, allocationLength := cdb[1]&0x01 != 0, cdb[2], int(be.Uint16(cdb[3:]))
+	if !evpd {
+		if page != 0 {
+			return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+		}
+		data := make([]byte, 66)
+		data[0] = peripheralDisk
+		if !disk {
+			data[0] = peripheralNoDevice
+		}
+		// SPC-4, HiSup and response data format 2, command queuing
+		data[2] = 0x06
+		data[3] = 0x12
+		data[4] = uint8(len(data) - 5)
+		data[7] = 0x02
+		copy(data[8:16], padded(vendorID, 8))
+		copy(data[16:32], padded(productID, 16))
+		copy(data[32:36], padded(productRevision, 4))
+		// Version descriptors of SAM-5, iSCSI, SPC-4 and SBC-3
+		for i, v := range []uint16{0x00a0, 0x0960, 0x0460, 0x04c0} {
+			be.PutUint16(data[58+2*i:], v)
+		}
+		return good(truncate(data, allocationLength))
+	}
+	if !disk {
+		return checkCondition(senseIllegalRequest, ascLUNNotSupported)
+	}
+
+	var payload []byte
+	switch page {
+	case 0x00:
+		// Supported pages
+		payload = []byte{0x00, 0x80, 0x83, 0xb0, 0xb1, 0xb2}
+	case 0x80:
+		// Unit serial number
+		payload = []byte(t.serial)
+	case 0x83:
+		// Device identification: the NAA and the T10 vendor ID designators of the volume
+		payload = append(payload, 0x01, 0x03, 0x00, uint8(len(t.naa)))
+		payload = append(payload, t.naa[:]...)
+		vendorSpecific := padded(vendorID, 8) + t.serial
+		payload = append(payload, 0x02, 0x01, 0x00, uint8(len(vendorSpecific)))
+		payload = append(payload, vendorSpecific...)
+	case 0xb0:
+		// Block limits
+		payload = make([]byte, 0x3c)
+		blockSize := uint32(t.blockSize)
+		payload[0] = 0x01 // WSNZ, a write same of 0 blocks is not the rest of the volume
+		be.PutUint16(payload[2:], uint16(max(1, 4096/blockSize)))
+		be.PutUint32(payload[4:], maxTransferLength/blockSize)
+		be.PutUint32(payload[8:], maxTransferLength/blockSize)
+		be.PutUint32(payload[16:], maxUnmapLength/blockSize)
+		be.PutUint32(payload[20:], maxUnmapDescriptors)
+		be.PutUint32(payload[24:], max(1, 4096/blockSize))
+		be.PutUint64(payload[32:], uint64(maxWriteSameLength/blockSize))
+	case 0xb1:
+		// Block device characteristics: non rotating medium
+		payload = make([]byte, 0x3c)
+		be.PutUint16(payload[0:], 1)
+	case 0xb2:
+		// Logical block provisioning: UNMAP, and WRITE SAME with the UNMAP bit, of a thin provisioned volume.
+		// Unmapped blocks do not read zeros, the snapshots may still have data of them.
+		payload = []byte{0x00, 0xe0, 0x02, 0x00}
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+	}
+	data := make([]byte, 4, 4+len(payload))
+	data[0] = peripheralDisk
+	data[1] = page
+	be.PutUint16(data[2:], uint16(len(payload)))
+	return good(truncate(append(data, payload...), allocationLength))
+}
+
+// padded pads s with spaces to length, as the ASCII fields of the inquiry data are.
+func padded(s string, length int) string {
+	for len(s) < length {
+		s += " "
+	}
+	return s[:length]
+}
+
+func (t *Target) reportLUNs(cdb []byte) *result {
+	data := make([]byte, 16)
+	be.PutUint32(data[0:], 8)
+	data[9] = diskLUN
+	return good(truncate(data, int(be.Uint32(cdb[6:]))))
+}
+
+func (t *Target) readCapacity10() *result {
+	data := make([]byte, 8)
+	be.PutUint32(data[0:], uint32(min(t.blocks()-1, 0xffffffff)))
+	be.PutUint32(data[4:], uint32(t.blockSize))
+	return good(data)
+}
+
+func (t *Target) readCapacity16(cdb []byte) *result {
+	data := make([]byte, 32)
+	be.PutUint64(data[0:], uint64(t.blocks()-1))
+	be.PutUint32(data[8:], uint32(t.blockSize))
+	// LBPME, the volume is thin provisioned
+	data[14] = 0x80
+	return good(truncate(data, int(be.Uint32(cdb[10:]))))
+}
+
+// modeSense returns the caching and the control mode pages. Only the write cache enable bit of the caching page
+// can be changed.
+func (t *Target) modeSense(cdb []byte) *result {
+	six := cdb[0] == scsiModeSense6
+	dbd, pc, page, subpage := cdb[1]&0x08 != 0, cdb[2]>>6, cdb[2]&0x3f, cdb[3]
+	if pc == modePageControlSaved {
+		return checkCondition(senseIllegalRequest, ascSavingNotSupported)
+	}
+	if subpage != 0 && !(page == modePageAll && subpage == 0xff) {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+	}
+
+	caching := make([]byte, 20)
+	caching[0], caching[1] = modePageCaching, uint8(len(caching)-2)
+	if pc == modePageControlChangeable || t.writeCache.Load() {
+		caching[2] = cachingWCE
+	}
+	control := make([]byte, 12)
+	control[0], control[1] = modePageControl, uint8(len(control)-2)
+	if pc != modePageControlChangeable {
+		// Unrestricted reordering of the commands
+		control[3] = 0x10
+	}
+	var pages []byte
+	switch page {
+	case modePageCaching:
+		pages = caching
+	case modePageControl:
+		pages = control
+	case modePageAll:
+		pages = append(caching, control...)
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB)
+	}
+
+	var descriptor []byte
+	if !dbd {
+		descriptor = make([]byte, 8)
+		be.PutUint32(descriptor[0:], uint32(min(t.blocks(), 0xffffffff)))
+		be.PutUint32(descriptor[4:], uint32(t.blockSize))
+	}
+	var header []byte
+	if six {
+		header = make([]byte, 4)
+		header[0] = uint8(len(header) + len(descriptor) + len(pages) - 1)
+		header[2] = modeDPOFUA
+		header[3] = uint8(len(descriptor))
+		return good(truncate(append(append(header, descriptor...), pages...), int(cdb[4])))
+	}
+	header = make([]byte, 8)
+	be.PutUint16(header[0:], uint16(len(header)+len(descriptor)+len(pages)-2))
+	header[3] = modeDPOFUA
+	be.PutUint16(header[6:], uint16(len(descriptor)))
+	return good(truncate(append(append(header, descriptor...), pages...), int(be.Uint16(cdb[7:]))))
+}
+
+// modeSelect takes the write cache enable bit of the caching page, the other pages are accepted and ignored.
+func (t *Target) modeSelect(cdb []byte, data []byte) *result {
+	headerLength, descriptorLength := 4, 0
+	if cdb[0] == scsiModeSelect6 {
+		data = truncate(data, int(cdb[4]))
+		if len(data) >= headerLength {
+			descriptorLength = int(data[3])
+		}
+	} else {
+		data = truncate(data, int(be.Uint16(cdb[7:])))
+		headerLength = 8
+		if len(data) >= headerLength {
+			descriptorLength = int(be.Uint16(data[6:]))
+		}
+	}
+	if len(data) == 0 {
+		return good(nil)
+	}
+	if len(data) < headerLength+descriptorLength {
+		return checkCondition(senseIllegalRequest, ascParameterListLengthError)
+	}
+
+	for pages := data[headerLength+descriptorLength:]; len(pages) > 0; {
+		if len(pages) < 2 {
+			return checkCondition(senseIllegalRequest, ascParameterListLengthError)
+		}
+		page, offset, length := pages[0]&0x3f, 2, int(pages[1])
+		if pages[0]&0x40 != 0 {
+			// Sub-page format
+			if len(pages) < 4 {
+				return checkCondition(senseIllegalRequest, ascParameterListLengthError)
+			}
+			offset, length = 4, int(be.Uint16(pages[2:]))
+		}
+		if len(pages) < offset+length {
+			return checkCondition(senseIllegalRequest, ascParameterListLengthError)
+		}
+		if page == modePageCaching && pages[0]&0x40 == 0 && length >= 1 {
+			t.writeCache.Store(pages[2]&cachingWCE != 0)
+		}
+		pages = pages[offset+length:]
+	}
+	return good(nil)
+}
@@ -0,0 +1,71 @@
+package iscsi
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+const (
+	valueYes           = "Yes"
+	valueNo            = "No"
+	valueNone          = "None"
+	valueCRC32C        = "CRC32C"
+	valueReject        = "Reject"
+	valueIrrelevant    = "Irrelevant"
+	valueNotUnderstood = "NotUnderstood"
+)
+
+// keyValue is a key=value pair of the data of a login or text PDU.
+type keyValue struct {
+	key   string
+	value string
+}
+
+// parseText splits the null terminated key=value pairs of a login or text PDU.
+func parseText(data []byte) ([]keyValue, error) {
+	var pairs []keyValue
+	for _, field := range bytes.Split(data, []byte{0}) {
+		if len(field) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(string(field), "=")
+		if !ok {
+			return nil, newProtocolError("invalid text key %q", field)
+		}
+		pairs = append(pairs, keyValue{key: key, value: value})
+	}
+	return pairs, nil
+}
+
+func encodeText(pairs []keyValue) []byte {
+	var buf bytes.Buffer
+	for _, p := range pairs {
+		buf.WriteString(p.key)
+		buf.WriteByte('=')
+		buf.WriteString(p.value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// parseNumber parses a numerical value, which is decimal or hexadecimal with 0x.
+func parseNumber(value string) (int, bool) {
+	n, err := strconv.ParseInt(value, 0, 32)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// chooseValue returns the first value of a list of values that is supported.
+func chooseValue(values string, supported ...string) string {
+	for _, v := range strings.Split(values, ",") {
+		for _, s := range supported {
+			if v == s {
+				return v
+			}
+		}
+	}
+	return valueReject
+}
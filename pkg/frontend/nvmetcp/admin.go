@@ -0,0 +1,320 @@
+package nvmetcp
+
+import (
+	"math/bits"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	cnsNamespace           = 0x00
+	cnsController          = 0x01
+	cnsActiveNamespaces    = 0x02
+	cnsNamespaceIDs        = 0x03
+	cnsNVMController       = 0x06
+	identifySize           = 4096
+	namespaceIDTypeNGUID   = 0x02
+	logErrorInformation    = 0x01
+	logSMART               = 0x02
+	logFirmwareSlot        = 0x03
+	logChangedNamespaces   = 0x04
+	logDiscovery           = 0x70
+	logRetainAsyncEvent    = 1 << 15
+	featureVolatileWC      = 0x06
+	featureNumberOfQueues  = 0x07
+	featureAsyncEventConf  = 0x0b
+	featureKeepAliveTimer  = 0x0f
+	featureSave            = 1 << 31
+	discoveryLogHeaderSize = 1024
+	discoveryLogEntrySize  = 1024
+
+	oncsDatasetMgmt = 1 << 2
+	oncsWriteZeroes = 1 << 3
+	// keepAliveGranularity is the granularity of the keep alive timer, in units of 100ms
+	keepAliveGranularity = 10
+
+	transportTCP          = 3
+	addressFamilyIPv4     = 1
+	addressFamilyIPv6     = 2
+	subsystemTypeNVMe     = 2
+	secureChannelNotReqd  = 0x2
+	discoveryLogGenerator = 1
+)
+
+// adminCommand handles a command of the admin queue. It returns nil for the asynchronous event requests, which are
+// completed once an event occurs.
+func (c *controller) adminCommand(q *queue, cmd *command, data []byte) *completion {
+	switch cmd.opcode() {
+	case opIdentify:
+		return c.identify(cmd)
+	case opGetLogPage:
+		return c.getLogPage(q, cmd)
+	case opSetFeatures:
+		return c.setFeatures(cmd)
+	case opGetFeatures:
+		return c.getFeatures(cmd)
+	case opAsyncEventReq:
+		c.lock.Lock()
+		if len(c.asyncEvents) >= maxAsyncEvents {
+			c.lock.Unlock()
+			return failure(sctCommandSpecific, scAsyncEventLimit)
+		}
+		c.asyncEvents = append(c.asyncEvents, asyncEventRequest{q: q, cmd: cmd})
+		requests := c.takeAsyncEventsNoLock()
+		c.lock.Unlock()
+		for _, r := range requests {
+			r.q.complete(r.cmd, &completion{dw0: asyncEventNamespaceChanged})
+		}
+		return nil
+	case opKeepAlive:
+		return &completion{}
+	case opAbort:
+		// Commands are not aborted, bit 0 tells the host so.
+		return &completion{dw0: 1}
+	}
+	return failure(sctGeneric, scInvalidOpcode)
+}
+
+func (c *controller) identify(cmd *command) *completion {
+	cns := uint8(cmd.cdw(10))
+	if c.discovery && cns != cnsController {
+		return failure(sctGeneric, scInvalidField)
+	}
+
+	t := c.target
+	switch cns {
+	case cnsController:
+		return &completion{data: c.identifyController()}
+	case cnsNamespace:
+		if cmd.nsid() != namespaceID {
+			return failure(sctGeneric, scInvalidNamespace)
+		}
+		return &completion{data: t.identifyNamespace()}
+	case cnsActiveNamespaces:
+		list := make([]byte, identifySize)
+		if cmd.nsid() < namespaceID {
+			le.PutUint32(list, namespaceID)
+		}
+		return &completion{data: list}
+	case cnsNamespaceIDs:
+		if cmd.nsid() != namespaceID {
+			return failure(sctGeneric, scInvalidNamespace)
+		}
+		list := make([]byte, identifySize)
+		list[0], list[1] = namespaceIDTypeNGUID, uint8(len(t.nguid))
+		copy(list[4:], t.nguid[:])
+		return &completion{data: list}
+	case cnsNVMController:
+		// Command set identifier 0 is the NVM command set. Its limits are those of the controller, except the
+		// size of a deallocated range, which is split to fit the unmap of the volume.
+		if uint8(cmd.cdw(11)>>24) != 0 {
+			return failure(sctGeneric, scInvalidField)
+		}
+		id := make([]byte, identifySize)
+		le.PutUint32(id[4:], uint32(maxUnmapLength/t.blockSize))
+		return &completion{data: id}
+	}
+	return failure(sctGeneric, scInvalidField)
+}
+
+func (c *controller) identifyController() []byte {
+	t := c.target
+	id := make([]byte, identifySize)
+	copy(id[4:24], padded(t.serial, 20))
+	copy(id[24:64], padded(modelNumber, 40))
+	copy(id[64:72], padded(firmwareRevision, 8))
+	id[72] = 6
+	id[77] = mdts
+	le.PutUint16(id[78:], c.id)
+	le.PutUint32(id[80:], version)
+	if c.discovery {
+		id[111] = 2
+	} else {
+		le.PutUint32(id[92:], asyncEventConfigNamespaceAttr)
+		id[111] = 1
+	}
+	// Abort and asynchronous event request limits, 0's based
+	id[258] = 3
+	id[259] = maxAsyncEvents - 1
+	// The log pages can be read at an offset
+	id[261] = 1 << 2
+	le.PutUint16(id[320:], keepAliveGranularity)
+	// Submission and completion queue entry sizes
+	id[512] = 0x66
+	id[513] = 0x44
+	le.PutUint16(id[514:], ioQueueEntries)
+	if !c.discovery {
+		le.PutUint32(id[516:], 1)
+		le.PutUint16(id[520:], oncsDatasetMgmt|oncsWriteZeroes)
+		// The volume has a volatile write cache, flushed by the flush command
+		id[525] = 1
+	}
+	// SGLs are supported, with an offset for in-capsule data
+	le.PutUint32(id[536:], 1|1<<20)
+	copy(id[768:768+nqnSize], c.subNQN)
+	le.PutUint32(id[1792:], (sqeSize+inCapsuleDataSize)/16)
+	le.PutUint32(id[1796:], cqeSize/16)
+	// One SGL descriptor per command
+	id[1803] = 1
+	return id
+}
+
+func (t *NvmeTCP) identifyNamespace() []byte {
+	blocks := uint64(t.getSize()) / uint64(t.blockSize)
+	id := make([]byte, identifySize)
+	le.PutUint64(id[0:], blocks)
+	le.PutUint64(id[8:], blocks)
+	le.PutUint64(id[16:], blocks)
+	copy(id[104:120], t.nguid[:])
+	// The only LBA format has no metadata
+	id[130] = uint8(bits.TrailingZeros32(uint32(t.blockSize)))
+	return id
+}
+
+func (c *controller) getLogPage(q *queue, cmd *command) *completion {
+	lid := uint8(cmd.cdw(10))
+	length := (uint64(cmd.cdw(11)&0xffff)<<16 | uint64(cmd.cdw(10)>>16) + 1) * 4
+	offset := uint64(cmd.cdw(12)) | uint64(cmd.cdw(13))<<32
+	if offset%4 != 0 {
+		return failure(sctGeneric, scInvalidField)
+	}
+
+	var log []byte
+	switch {
+	case c.discovery && lid == logDiscovery:
+		log = c.discoveryLog(q.conn.LocalAddr())
+	case c.discovery:
+		return failure(sctGeneric, scInvalidField)
+	case lid == logErrorInformation:
+		log = make([]byte, 64)
+	case lid == logSMART:
+		log = make([]byte, 512)
+	case lid == logFirmwareSlot:
+		log = make([]byte, 512)
+		log[0] = 1
+		copy(log[8:16], padded(firmwareRevision, 8))
+	case lid == logChangedNamespaces:
+		log = make([]byte, 4096)
+		c.lock.Lock()
+		if c.changedNamespace {
+			le.PutUint32(log, namespaceID)
+		}
+		if cmd.cdw(10)&logRetainAsyncEvent == 0 {
+			c.changedNamespace = false
+		}
+		c.lock.Unlock()
+	default:
+		return failure(sctGeneric, scInvalidField)
+	}
+
+	if offset > uint64(len(log)) {
+		return failure(sctGeneric, scInvalidField)
+	}
+	data := make([]byte, length)
+	copy(data, log[offset:])
+	return &completion{data: data}
+}
+
+// discoveryLog lists the subsystem of the volume, at the address the host reached the discovery controller on.
+func (c *controller) discoveryLog(localAddr net.Addr) []byte {
+	log := make([]byte, discoveryLogHeaderSize+discoveryLogEntrySize)
+	le.PutUint64(log[0:], discoveryLogGenerator)
+	le.PutUint64(log[8:], 1)
+
+	entry := log[discoveryLogHeaderSize:]
+	entry[0] = transportTCP
+	entry[1] = addressFamilyIPv4
+	entry[2] = subsystemTypeNVMe
+	entry[3] = secureChannelNotReqd
+	le.PutUint16(entry[4:], 1)
+	le.PutUint16(entry[6:], dynamicControllerID)
+	le.PutUint16(entry[8:], adminQueueEntries)
+	if addr, ok := localAddr.(*net.TCPAddr); ok {
+		if addr.IP.To4() == nil {
+			entry[1] = addressFamilyIPv6
+		}
+		copy(entry[32:64], padded(strconv.Itoa(addr.Port), 32))
+		copy(entry[512:768], padded(addr.IP.String(), 256))
+	}
+	copy(entry[256:256+nqnSize], c.target.nqn)
+	return log
+}
+
+func (c *controller) setFeatures(cmd *command) *completion {
+	fid, value := uint8(cmd.cdw(10)), cmd.cdw(11)
+	if cmd.cdw(10)&featureSave != 0 {
+		return failure(sctGeneric, scFeatureNotSaveable)
+	}
+
+	if fid == featureKeepAliveTimer {
+		c.setKeepAliveTimeout(time.Duration(value) * time.Millisecond)
+		return &completion{}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch fid {
+	case featureAsyncEventConf:
+		c.asyncEventConfig = value
+		return &completion{}
+	}
+	if c.discovery {
+		return failure(sctGeneric, scInvalidField)
+	}
+	switch fid {
+	case featureNumberOfQueues:
+		submission, completion := value&0xffff, value>>16
+		if submission == 0xffff || completion == 0xffff {
+			return failure(sctGeneric, scInvalidField)
+		}
+		c.ioQueues = int(min(submission, completion, maxIOQueues-1)) + 1
+		return c.numberOfQueues()
+	case featureVolatileWC:
+		c.writeCache = value&1 != 0
+		return &completion{}
+	}
+	return failure(sctGeneric, scInvalidField)
+}
+
+func (c *controller) getFeatures(cmd *command) *completion {
+	fid := uint8(cmd.cdw(10))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch fid {
+	case featureKeepAliveTimer:
+		return &completion{dw0: uint32(c.kato / time.Millisecond)}
+	case featureAsyncEventConf:
+		return &completion{dw0: c.asyncEventConfig}
+	}
+	if c.discovery {
+		return failure(sctGeneric, scInvalidField)
+	}
+	switch fid {
+	case featureNumberOfQueues:
+		return c.numberOfQueues()
+	case featureVolatileWC:
+		if c.writeCache {
+			return &completion{dw0: 1}
+		}
+		return &completion{}
+	}
+	return failure(sctGeneric, scInvalidField)
+}
+
+// numberOfQueues returns the number of I/O submission and completion queues allocated, 0's based.
+func (c *controller) numberOfQueues() *completion {
+	n := uint32(c.ioQueues - 1)
+	return &completion{dw0: n | n<<16}
+}
+
+// padded returns s padded with spaces to length bytes, as the ASCII fields of the identify data are.
+func padded(s string, length int) []byte {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+	return b
+}
@@ -0,0 +1,320 @@
+package nvmetcp
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	propertyCAP  = 0x00
+	propertyVS   = 0x08
+	propertyCC   = 0x14
+	propertyCSTS = 0x1c
+
+	// version is NVMe 1.3
+	version = 0x00010300
+
+	ccEnable       = 1 << 0
+	ccShutdownMask = 3 << 14
+	cstsReady      = 1 << 0
+	cstsShstMask   = 3 << 2
+	cstsShstDone   = 2 << 2
+
+	// capTimeout is the worst time to get ready, in units of 500ms
+	capTimeout = 30
+	capCQR     = 1 << 16
+	capCSSNVM  = 1 << 37
+
+	// keepAliveGrace is added to the keep alive timeout of the host, so a host sending keep alives every timeout is
+	// not cut off
+	keepAliveGrace = 5 * time.Second
+
+	maxAsyncEvents = 4
+
+	asyncEventConfigNamespaceAttr = 1 << 8
+	// asyncEventNamespaceChanged is a notice of a namespace attribute change, for the changed namespace list
+	asyncEventNamespaceChanged = 0x2 | 0x00<<8 | logChangedNamespaces<<16
+)
+
+// controller is a controller a host created with the Connect command on an admin queue. The I/O queues connect to
+// it afterwards.
+type controller struct {
+	target    *NvmeTCP
+	id        uint16
+	discovery bool
+	subNQN    string
+	hostNQN   string
+	hostID    []byte
+
+	// The fields below are guarded by the lock
+	lock      sync.Mutex
+	cc        uint32
+	csts      uint32
+	kato      time.Duration
+	katoTimer *time.Timer
+	ioQueues  int
+	queues    map[uint16]*queue
+	// writeCache tells whether the volatile write cache is enabled. With it disabled, each write is flushed.
+	writeCache bool
+
+	asyncEventConfig uint32
+	asyncEvents      []asyncEventRequest
+	// noticePending tells whether a namespace change is not reported yet, changedNamespace whether the changed
+	// namespace list was not read since.
+	noticePending    bool
+	changedNamespace bool
+}
+
+type asyncEventRequest struct {
+	q   *queue
+	cmd *command
+}
+
+func (c *controller) touch() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.katoTimer != nil {
+		c.katoTimer.Reset(c.kato + keepAliveGrace)
+	}
+}
+
+// setKeepAliveTimeout sets the keep alive timeout. The controller is destroyed once the host sends no command for
+// that long.
+func (c *controller) setKeepAliveTimeout(kato time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.kato = kato
+	if c.katoTimer != nil {
+		c.katoTimer.Stop()
+		c.katoTimer = nil
+	}
+	if kato == 0 {
+		return
+	}
+	c.katoTimer = time.AfterFunc(kato+keepAliveGrace, func() {
+		logrus.Warnf("NVMe controller %v of host %v on %v missed its keep alive timeout of %v", c.id, c.hostNQN,
+			c.target.Volume, kato)
+		c.target.destroyController(c)
+	})
+}
+
+func (c *controller) removeQueue(q *queue) {
+	if q.qid == 0 {
+		c.target.destroyController(c)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.queues[q.qid] == q {
+		delete(c.queues, q.qid)
+	}
+}
+
+// shutdown closes the queues of the controller and stops its keep alive timer.
+func (c *controller) shutdown() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.katoTimer != nil {
+		c.katoTimer.Stop()
+		c.katoTimer = nil
+	}
+	for _, q := range c.queues {
+		_ = q.conn.Close()
+	}
+}
+
+// fabricsCommand handles the commands that connect the queues and access the controller properties.
+func (q *queue) fabricsCommand(cmd *command, data []byte) *completion {
+	switch cmd.fctype() {
+	case fctypeConnect:
+		return q.connect(cmd, data)
+	case fctypePropertyGet, fctypePropertySet:
+		if q.ctrl == nil {
+			return failure(sctGeneric, scCommandSequenceError)
+		}
+		q.ctrl.touch()
+		if q.qid != 0 {
+			return failure(sctGeneric, scInvalidField)
+		}
+		if cmd.fctype() == fctypePropertyGet {
+			return q.ctrl.getProperty(cmd)
+		}
+		return q.ctrl.setProperty(cmd)
+	}
+	return failure(sctGeneric, scInvalidOpcode)
+}
+
+// connectFailure fails a Connect command for the parameter at an offset of the command, or of its data.
+func connectFailure(offset uint16, inData bool) *completion {
+	c := failure(sctCommandSpecific, scConnectInvalidParams)
+	c.dw0 = uint32(offset) << 16
+	if inData {
+		c.dw0 |= 1
+	}
+	return c
+}
+
+func (q *queue) connect(cmd *command, data []byte) *completion {
+	if q.ctrl != nil {
+		return failure(sctGeneric, scCommandSequenceError)
+	}
+	if len(data) < connectDataSize {
+		return failure(sctGeneric, scSGLLengthInvalid)
+	}
+	recfmt, qid, sqsize := le.Uint16(cmd.sqe[40:]), le.Uint16(cmd.sqe[42:]), le.Uint16(cmd.sqe[44:])
+	kato := time.Duration(le.Uint32(cmd.sqe[48:])) * time.Millisecond
+	if recfmt != 0 {
+		return failure(sctCommandSpecific, scConnectIncompatibleFormat)
+	}
+	hostID, cntlid := data[0:16], le.Uint16(data[16:])
+	subNQN := cString(data[connectDataSubNQNOffset : connectDataSubNQNOffset+nqnSize])
+	hostNQN := cString(data[connectDataHostNQNOffset : connectDataHostNQNOffset+nqnSize])
+
+	t := q.target
+	discovery := subNQN == discoveryNQN
+	if !discovery && subNQN != t.nqn {
+		logrus.Warnf("Host %v tried to connect to unknown subsystem %v on %v", hostNQN, subNQN, t.Volume)
+		return connectFailure(connectDataSubNQNOffset, true)
+	}
+
+	if qid == 0 {
+		if cntlid != dynamicControllerID {
+			return connectFailure(16, true)
+		}
+		if sqsize == 0 || int(sqsize) >= adminQueueEntries {
+			return connectFailure(44, false)
+		}
+		ctrl := t.newController(subNQN, hostNQN, hostID, discovery, q)
+		ctrl.setKeepAliveTimeout(kato)
+		q.ctrl, q.qid, q.size = ctrl, 0, sqsize+1
+		logrus.Infof("Host %v created NVMe controller %v of %v", hostNQN, ctrl.id, subNQN)
+		return &completion{dw0: uint32(ctrl.id)}
+	}
+
+	ctrl := t.getController(cntlid)
+	if ctrl == nil || ctrl.discovery || ctrl.subNQN != subNQN {
+		return connectFailure(16, true)
+	}
+	if ctrl.hostNQN != hostNQN || !bytes.Equal(ctrl.hostID, hostID) {
+		return failure(sctCommandSpecific, scConnectInvalidHost)
+	}
+	if sqsize == 0 || int(sqsize) >= ioQueueEntries {
+		return connectFailure(44, false)
+	}
+
+	ctrl.lock.Lock()
+	defer ctrl.lock.Unlock()
+	if ctrl.csts&cstsReady == 0 || int(qid) > ctrl.ioQueues {
+		return connectFailure(42, false)
+	}
+	if _, ok := ctrl.queues[qid]; ok {
+		return connectFailure(42, false)
+	}
+	ctrl.queues[qid] = q
+	q.ctrl, q.qid, q.size = ctrl, qid, sqsize+1
+	return &completion{dw0: uint32(ctrl.id)}
+}
+
+func (c *controller) getProperty(cmd *command) *completion {
+	size8 := cmd.sqe[40]&1 != 0
+	offset := le.Uint32(cmd.sqe[44:])
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var value uint64
+	switch offset {
+	case propertyCAP:
+		mqes := uint64(ioQueueEntries - 1)
+		if c.discovery {
+			mqes = adminQueueEntries - 1
+		}
+		value = mqes | capCQR | capTimeout<<24 | capCSSNVM
+	case propertyVS:
+		value = version
+	case propertyCC:
+		value = uint64(c.cc)
+	case propertyCSTS:
+		value = uint64(c.csts)
+	default:
+		return failure(sctGeneric, scInvalidField)
+	}
+	if offset == propertyCAP && !size8 {
+		return failure(sctGeneric, scInvalidField)
+	}
+	return &completion{dw0: uint32(value), dw1: uint32(value >> 32)}
+}
+
+func (c *controller) setProperty(cmd *command) *completion {
+	offset, value := le.Uint32(cmd.sqe[44:]), uint32(le.Uint64(cmd.sqe[48:]))
+	if offset != propertyCC {
+		return failure(sctGeneric, scInvalidField)
+	}
+
+	c.lock.Lock()
+	old := c.cc
+	c.cc = value
+	var reset []*queue
+	switch {
+	case value&ccEnable != 0 && old&ccEnable == 0:
+		c.csts |= cstsReady
+	case value&ccEnable == 0 && old&ccEnable != 0:
+		// A reset drops the I/O queues.
+		c.csts &^= cstsReady | cstsShstMask
+		for qid, q := range c.queues {
+			if qid != 0 {
+				reset = append(reset, q)
+			}
+		}
+	}
+	if value&ccShutdownMask != 0 {
+		c.csts = c.csts&^cstsShstMask | cstsShstDone
+	} else if old&ccShutdownMask != 0 {
+		c.csts &^= cstsShstMask
+	}
+	c.lock.Unlock()
+
+	for _, q := range reset {
+		_ = q.conn.Close()
+	}
+	return &completion{}
+}
+
+// notifyNamespaceChange reports a change of the namespace, like its size, to the host.
+func (c *controller) notifyNamespaceChange() {
+	c.lock.Lock()
+	c.noticePending = true
+	c.changedNamespace = true
+	requests := c.takeAsyncEventsNoLock()
+	c.lock.Unlock()
+
+	for _, r := range requests {
+		r.q.complete(r.cmd, &completion{dw0: asyncEventNamespaceChanged})
+	}
+}
+
+// takeAsyncEventsNoLock takes the requests to complete with the pending events.
+func (c *controller) takeAsyncEventsNoLock() []asyncEventRequest {
+	if !c.noticePending || c.asyncEventConfig&asyncEventConfigNamespaceAttr == 0 || len(c.asyncEvents) == 0 {
+		return nil
+	}
+	c.noticePending = false
+	r := c.asyncEvents[0]
+	c.asyncEvents = c.asyncEvents[1:]
+	return []asyncEventRequest{r}
+}
+
+func (c *controller) writeCacheEnabled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.writeCache
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
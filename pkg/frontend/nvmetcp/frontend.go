@@ -0,0 +1,269 @@
+package nvmetcp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	iscsiutil "github.com/longhorn/go-iscsi-helper/util"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	frontendName = "nvme-tcp"
+
+	DefaultListenAddress = ":0"
+	NQNPrefix            = "nqn.2019-10.io.longhorn:"
+
+	discoveryNQN     = "nqn.2014-08.org.nvmexpress.discovery"
+	modelNumber      = "Longhorn Volume"
+	firmwareRevision = "1.0"
+	minBlockSize     = 512
+)
+
+func New(listenAddress string) *NvmeTCP {
+	if listenAddress == "" {
+		listenAddress = DefaultListenAddress
+	}
+	return &NvmeTCP{listenAddress: listenAddress}
+}
+
+// NvmeTCP serves the volume as the namespace of an NVMe subsystem over TCP. Hosts connect to it with the nvme-tcp
+// initiator of the kernel, e.g. `nvme connect -t tcp -a <address> -s <port> -n <nqn>`, and a discovery controller
+// is served on the same port for `nvme discover`. Each host creates a controller of its own.
+type NvmeTCP struct {
+	Volume     string
+	Size       int64
+	SectorSize int
+
+	listenAddress string
+	isUp          bool
+	nqn           string
+	serial        string
+	nguid         [16]byte
+	blockSize     int
+	rwu           types.ReaderWriterUnmapperAt
+
+	lock             sync.Mutex
+	listener         net.Listener
+	conns            map[net.Conn]struct{}
+	controllers      map[uint16]*controller
+	nextControllerID uint16
+	wg               sync.WaitGroup
+}
+
+func (t *NvmeTCP) FrontendName() string {
+	return frontendName
+}
+
+func (t *NvmeTCP) Init(name string, size, sectorSize int64) error {
+	t.Volume = name
+	t.Size = size
+	t.SectorSize = int(sectorSize)
+
+	t.nqn = NQNPrefix + name
+	sum := sha256.Sum256([]byte(name))
+	copy(t.nguid[:], sum[:])
+	t.serial = hex.EncodeToString(sum[:])[:20]
+	t.blockSize = max(t.SectorSize, minBlockSize)
+
+	return t.Shutdown()
+}
+
+func (t *NvmeTCP) Startup(rwu types.ReaderWriterUnmapperAt) error {
+	listener, err := net.Listen("tcp", t.listenAddress)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %v", t.listenAddress)
+	}
+
+	t.lock.Lock()
+	t.rwu = rwu
+	t.listener = listener
+	t.conns = map[net.Conn]struct{}{}
+	t.controllers = map[uint16]*controller{}
+	t.lock.Unlock()
+
+	t.wg.Add(1)
+	go t.serve(listener)
+
+	t.isUp = true
+	logrus.Infof("Serving NVMe/TCP subsystem %v on %v", t.nqn, listener.Addr())
+
+	return nil
+}
+
+func (t *NvmeTCP) Shutdown() error {
+	t.lock.Lock()
+	listener, conns := t.listener, t.conns
+	t.listener, t.conns = nil, nil
+	t.lock.Unlock()
+
+	if listener != nil {
+		logrus.Infof("Shutting down NVMe/TCP target for %v", t.Volume)
+		if err := listener.Close(); err != nil {
+			logrus.WithError(err).Warnf("Failed to close NVMe/TCP listener %v", listener.Addr())
+		}
+		for conn := range conns {
+			_ = conn.Close()
+		}
+		// Wait for the commands in flight, so none reaches the volume once it is down.
+		t.wg.Wait()
+	}
+	t.isUp = false
+
+	return nil
+}
+
+func (t *NvmeTCP) State() types.State {
+	if t.isUp {
+		return types.StateUp
+	}
+	return types.StateDown
+}
+
+// Endpoint returns the address and the NQN hosts connect to, as nvmf://<address>:<port>/<nqn>.
+func (t *NvmeTCP) Endpoint() string {
+	if !t.isUp {
+		return ""
+	}
+	t.lock.Lock()
+	listener := t.listener
+	t.lock.Unlock()
+	if listener == nil {
+		return ""
+	}
+
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		ip, err := iscsiutil.GetIPToHost()
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to get the IP of the host for the NVMe/TCP endpoint")
+			return ""
+		}
+		host = ip
+	}
+	return fmt.Sprintf("nvmf://%v/%v", net.JoinHostPort(host, strconv.Itoa(addr.Port)), t.nqn)
+}
+
+func (t *NvmeTCP) Upgrade(name string, size, sectorSize int64, rwu types.ReaderWriterUnmapperAt) error {
+	return fmt.Errorf("upgrade is not supported")
+}
+
+// Expand grows the namespace, and tells the connected hosts with an asynchronous event, so they rescan it.
+func (t *NvmeTCP) Expand(size int64) error {
+	t.lock.Lock()
+	t.Size = size
+	var controllers []*controller
+	for _, c := range t.controllers {
+		if !c.discovery {
+			controllers = append(controllers, c)
+		}
+	}
+	t.lock.Unlock()
+
+	for _, c := range controllers {
+		c.notifyNamespaceChange()
+	}
+	return nil
+}
+
+func (t *NvmeTCP) getSize() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.Size
+}
+
+// serve accepts the connections of the hosts until the listener is closed. Each connection is a queue.
+func (t *NvmeTCP) serve(listener net.Listener) {
+	defer t.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Errorf("Failed to accept NVMe/TCP connection for %v", t.Volume)
+			}
+			return
+		}
+
+		t.lock.Lock()
+		if t.listener != listener {
+			t.lock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.wg.Add(1)
+		t.lock.Unlock()
+
+		go func() {
+			defer t.wg.Done()
+			if err := newQueue(t, conn).serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Warnf("NVMe/TCP connection %v of %v closed", conn.RemoteAddr(), t.Volume)
+			}
+
+			t.lock.Lock()
+			delete(t.conns, conn)
+			t.lock.Unlock()
+		}()
+	}
+}
+
+// newController creates a controller for the admin queue q.
+func (t *NvmeTCP) newController(subNQN, hostNQN string, hostID []byte, discovery bool, q *queue) *controller {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Controller IDs 0xfff0 and above are reserved.
+	for {
+		t.nextControllerID = t.nextControllerID%0xffef + 1
+		if _, ok := t.controllers[t.nextControllerID]; !ok {
+			break
+		}
+	}
+	c := &controller{
+		target:     t,
+		id:         t.nextControllerID,
+		discovery:  discovery,
+		subNQN:     subNQN,
+		hostNQN:    hostNQN,
+		hostID:     append([]byte{}, hostID...),
+		ioQueues:   maxIOQueues - 1,
+		queues:     map[uint16]*queue{0: q},
+		writeCache: true,
+	}
+	t.controllers[c.id] = c
+	return c
+}
+
+func (t *NvmeTCP) getController(id uint16) *controller {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.controllers[id]
+}
+
+// destroyController drops a controller once its admin queue is gone, or its keep alive timeout expired.
+func (t *NvmeTCP) destroyController(c *controller) {
+	t.lock.Lock()
+	if t.controllers[c.id] != c {
+		t.lock.Unlock()
+		return
+	}
+	delete(t.controllers, c.id)
+	t.lock.Unlock()
+
+	logrus.Infof("Destroying NVMe controller %v of host %v on %v", c.id, c.hostNQN, t.Volume)
+	c.shutdown()
+}
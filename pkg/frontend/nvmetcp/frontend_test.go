@@ -0,0 +1,556 @@
+package nvmetcp
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/mem"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	testVolumeSize = 4 << 20
+	testBlockSize  = 4096
+
+	testHostNQN = "nqn.2014-08.org.nvmexpress:uuid:test-host"
+)
+
+var testHostID = []byte("0123456789abcdef")
+
+// testHost is an NVMe/TCP host on a queue of the target, like the nvme-tcp initiator of the kernel. It runs one
+// command at a time, except the asynchronous event requests.
+type testHost struct {
+	c      *C
+	conn   net.Conn
+	reader *bufio.Reader
+	hdgst  bool
+	ddgst  bool
+	// pending is the data of the command waiting for an R2T
+	pending []byte
+	nextCID uint16
+}
+
+func startTestTarget(c *C) (*NvmeTCP, *mem.Replica) {
+	replica, err := mem.New().AddReplica("r", testVolumeSize)
+	c.Assert(err, IsNil)
+	t := New("127.0.0.1:0")
+	c.Assert(t.Init("test", testVolumeSize, testBlockSize), IsNil)
+	c.Assert(t.Startup(replica), IsNil)
+	return t, replica
+}
+
+// dialTestHost connects a queue and exchanges the ICReq and ICResp.
+func dialTestHost(c *C, t *NvmeTCP, hdgst, ddgst bool) *testHost {
+	conn, err := net.Dial("tcp", t.listener.Addr().String())
+	c.Assert(err, IsNil)
+	h := &testHost{c: c, conn: conn, reader: bufio.NewReader(conn), nextCID: 1}
+
+	icreq := make([]byte, icHeaderSize)
+	if hdgst {
+		icreq[11] |= pduFlagHDGST
+	}
+	if ddgst {
+		icreq[11] |= pduFlagDDGST
+	}
+	h.write(pduICReq, 0, icreq, nil)
+	typ, _, header, _ := h.read()
+	c.Assert(typ, Equals, uint8(pduICResp))
+	c.Assert(header[11], Equals, icreq[11])
+	c.Assert(le.Uint32(header[12:]), Equals, uint32(maxH2CData))
+	h.hdgst, h.ddgst = hdgst, ddgst
+	return h
+}
+
+func (h *testHost) close() {
+	_ = h.conn.Close()
+}
+
+// write sends a PDU with the digests negotiated, the data right after the header.
+func (h *testHost) write(typ, flags uint8, header, data []byte) {
+	if h.hdgst && hasHeaderDigest(typ) {
+		flags |= pduFlagHDGST
+	}
+	if h.ddgst && len(data) > 0 {
+		flags |= pduFlagDDGST
+	}
+	_, err := h.conn.Write(encodePDU(typ, flags, header, 0, data))
+	h.c.Assert(err, IsNil)
+}
+
+// read reads a PDU of the target and checks its digests.
+func (h *testHost) read() (uint8, uint8, []byte, []byte) {
+	c := h.c
+	c.Assert(h.conn.SetReadDeadline(time.Now().Add(10*time.Second)), IsNil)
+	ch := make([]byte, commonHeaderSize)
+	_, err := io.ReadFull(h.reader, ch)
+	c.Assert(err, IsNil)
+	typ, flags, hlen, pdo, plen := ch[0], ch[1], int(ch[2]), int(ch[3]), int(le.Uint32(ch[4:]))
+	header := append(ch, make([]byte, hlen-commonHeaderSize)...)
+	_, err = io.ReadFull(h.reader, header[commonHeaderSize:])
+	c.Assert(err, IsNil)
+	headerEnd := hlen
+	if flags&pduFlagHDGST != 0 {
+		headerEnd += digestSize
+		digest := make([]byte, digestSize)
+		_, err = io.ReadFull(h.reader, digest)
+		c.Assert(err, IsNil)
+		c.Assert(le.Uint32(digest), Equals, crc32.Checksum(header, crc32c))
+	}
+	if plen == headerEnd {
+		return typ, flags, header, nil
+	}
+	_, err = h.reader.Discard(pdo - headerEnd)
+	c.Assert(err, IsNil)
+	dataEnd := plen
+	if flags&pduFlagDDGST != 0 {
+		dataEnd -= digestSize
+	}
+	data := make([]byte, dataEnd-pdo)
+	_, err = io.ReadFull(h.reader, data)
+	c.Assert(err, IsNil)
+	if flags&pduFlagDDGST != 0 {
+		digest := make([]byte, digestSize)
+		_, err = io.ReadFull(h.reader, digest)
+		c.Assert(err, IsNil)
+		c.Assert(le.Uint32(digest), Equals, crc32.Checksum(data, crc32c))
+	}
+	return typ, flags, header, data
+}
+
+func (h *testHost) newSQE(opcode uint8, nsid uint32) []byte {
+	sqe := make([]byte, sqeSize)
+	sqe[0] = opcode
+	le.PutUint16(sqe[2:], h.nextCID)
+	h.nextCID++
+	le.PutUint32(sqe[4:], nsid)
+	return sqe
+}
+
+// send sends a command. Its data goes in the capsule, unless r2t is set and it waits for the R2T of the target.
+func (h *testHost) send(sqe, data []byte, r2t bool) {
+	if len(data) > 0 {
+		le.PutUint32(sqe[32:], uint32(len(data)))
+		if r2t {
+			sqe[39] = sglTransport
+			h.pending = data
+			data = nil
+		} else {
+			sqe[39] = sglInCapsule
+		}
+	}
+	header := append(make([]byte, commonHeaderSize), sqe...)
+	h.write(pduCapsuleCmd, 0, header, data)
+}
+
+// wait waits for the completion of a command, sending the data asked for by R2Ts meanwhile in two H2CData PDUs.
+// It returns the completion queue entry and the data read.
+func (h *testHost) wait() ([]byte, []byte) {
+	var read []byte
+	for {
+		typ, flags, header, data := h.read()
+		switch typ {
+		case pduCapsuleResp:
+			return header[commonHeaderSize:], read
+		case pduC2HData:
+			h.c.Assert(int(le.Uint32(header[12:])), Equals, len(read))
+			h.c.Assert(int(le.Uint32(header[16:])), Equals, len(data))
+			read = append(read, data...)
+			h.c.Assert(flags&pduFlagDataLast, Equals, uint8(pduFlagDataLast))
+		case pduR2T:
+			cid, ttag := le.Uint16(header[8:]), le.Uint16(header[10:])
+			h.c.Assert(int(le.Uint32(header[12:])), Equals, 0)
+			h.c.Assert(int(le.Uint32(header[16:])), Equals, len(h.pending))
+			half := len(h.pending) / 2
+			for i, part := range [][]byte{h.pending[:half], h.pending[half:]} {
+				dh := make([]byte, dataHeaderSize)
+				le.PutUint16(dh[8:], cid)
+				le.PutUint16(dh[10:], ttag)
+				le.PutUint32(dh[12:], uint32(i*half))
+				le.PutUint32(dh[16:], uint32(len(part)))
+				var last uint8
+				if i == 1 {
+					last = pduFlagDataLast
+				}
+				h.write(pduH2CData, last, dh, part)
+			}
+			h.pending = nil
+		default:
+			h.c.Fatalf("unexpected PDU type 0x%x", typ)
+		}
+	}
+}
+
+func (h *testHost) command(sqe, data []byte, r2t bool) ([]byte, []byte) {
+	h.send(sqe, data, r2t)
+	return h.wait()
+}
+
+// statusOf returns the status code type and the status code of a completion queue entry.
+func statusOf(cqe []byte) (uint8, uint8) {
+	st := le.Uint16(cqe[14:])
+	return uint8(st>>9) & 0x7, uint8(st >> 1)
+}
+
+func (h *testHost) assertSuccess(cqe []byte) {
+	sct, sc := statusOf(cqe)
+	h.c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctGeneric, scSuccess})
+}
+
+// connect sends the Connect command of a queue and returns the controller ID.
+func (h *testHost) connect(subNQN string, qid, cntlid uint16) ([]byte, uint16) {
+	sqe := h.newSQE(opFabrics, 0)
+	sqe[4] = fctypeConnect
+	le.PutUint16(sqe[42:], qid)
+	le.PutUint16(sqe[44:], 15)
+	data := make([]byte, connectDataSize)
+	copy(data, testHostID)
+	le.PutUint16(data[16:], cntlid)
+	copy(data[connectDataSubNQNOffset:], subNQN)
+	copy(data[connectDataHostNQNOffset:], testHostNQN)
+	cqe, _ := h.command(sqe, data, false)
+	return cqe, uint16(le.Uint32(cqe))
+}
+
+func (h *testHost) property(fctype uint8, offset uint32, value uint64) []byte {
+	sqe := h.newSQE(opFabrics, 0)
+	sqe[4] = fctype
+	sqe[40] = 1
+	le.PutUint32(sqe[44:], offset)
+	le.PutUint64(sqe[48:], value)
+	cqe, _ := h.command(sqe, nil, false)
+	h.assertSuccess(cqe)
+	return cqe
+}
+
+// enable creates a controller on an admin queue, enables it and asks for the I/O queues.
+func (h *testHost) enable(subNQN string) uint16 {
+	cqe, cntlid := h.connect(subNQN, 0, dynamicControllerID)
+	h.assertSuccess(cqe)
+	h.property(fctypePropertySet, propertyCC, ccEnable)
+	cqe = h.property(fctypePropertyGet, propertyCSTS, 0)
+	h.c.Assert(le.Uint32(cqe)&cstsReady, Equals, uint32(cstsReady))
+	return cntlid
+}
+
+func (h *testHost) identify(cns uint8, nsid uint32) []byte {
+	sqe := h.newSQE(opIdentify, nsid)
+	le.PutUint32(sqe[32:], identifySize)
+	sqe[39] = sglTransport
+	le.PutUint32(sqe[40:], uint32(cns))
+	cqe, data := h.command(sqe, nil, false)
+	h.assertSuccess(cqe)
+	h.c.Assert(data, HasLen, identifySize)
+	return data
+}
+
+// io sends a read, write or write zeroes of nlb blocks at slba.
+func (h *testHost) io(opcode uint8, slba uint64, nlb int, data []byte, r2t bool) ([]byte, []byte) {
+	sqe := h.newSQE(opcode, namespaceID)
+	if opcode == opRead {
+		le.PutUint32(sqe[32:], uint32(nlb*testBlockSize))
+		sqe[39] = sglTransport
+	}
+	le.PutUint64(sqe[40:], slba)
+	le.PutUint32(sqe[48:], uint32(nlb-1))
+	return h.command(sqe, data, r2t)
+}
+
+// connectTestHosts creates a controller on an admin queue and connects an I/O queue to it.
+func connectTestHosts(c *C, t *NvmeTCP) (*testHost, *testHost) {
+	admin := dialTestHost(c, t, true, true)
+	cntlid := admin.enable(t.nqn)
+	ioq := dialTestHost(c, t, false, true)
+	cqe, id := ioq.connect(t.nqn, 1, cntlid)
+	ioq.assertSuccess(cqe)
+	c.Assert(id, Equals, cntlid)
+	return admin, ioq
+}
+
+func (s *TestSuite) TestIdentify(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	admin := dialTestHost(c, t, false, false)
+	defer admin.close()
+	cntlid := admin.enable(t.nqn)
+
+	id := admin.identify(cnsController, 0)
+	c.Assert(le.Uint16(id[78:]), Equals, cntlid)
+	c.Assert(string(bytes.TrimRight(id[24:64], " ")), Equals, modelNumber)
+	c.Assert(string(bytes.TrimRight(id[4:24], " ")), Equals, t.serial)
+	c.Assert(cString(id[768:768+nqnSize]), Equals, t.nqn)
+	c.Assert(le.Uint16(id[520:])&(oncsDatasetMgmt|oncsWriteZeroes), Equals, uint16(oncsDatasetMgmt|oncsWriteZeroes))
+
+	ns := admin.identify(cnsNamespace, namespaceID)
+	c.Assert(le.Uint64(ns), Equals, uint64(testVolumeSize/testBlockSize))
+	c.Assert(1<<ns[130], Equals, testBlockSize)
+	c.Assert(ns[104:120], DeepEquals, t.nguid[:])
+
+	list := admin.identify(cnsActiveNamespaces, 0)
+	c.Assert(le.Uint32(list), Equals, uint32(namespaceID))
+	c.Assert(le.Uint32(list[4:]), Equals, uint32(0))
+
+	// A namespace that does not exist.
+	sqe := admin.newSQE(opIdentify, 2)
+	le.PutUint32(sqe[32:], identifySize)
+	sqe[39] = sglTransport
+	cqe, _ := admin.command(sqe, nil, false)
+	sct, sc := statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctGeneric, scInvalidNamespace})
+
+	cqe = admin.property(fctypePropertyGet, propertyCAP, 0)
+	c.Assert(le.Uint32(cqe)&0xffff, Equals, uint32(ioQueueEntries-1))
+	cqe = admin.property(fctypePropertyGet, propertyVS, 0)
+	c.Assert(le.Uint32(cqe), Equals, uint32(version))
+}
+
+func (s *TestSuite) TestReadWrite(c *C) {
+	t, replica := startTestTarget(c)
+	defer t.Shutdown()
+	admin, ioq := connectTestHosts(c, t)
+	defer admin.close()
+	defer ioq.close()
+
+	// In the capsule, then through an R2T.
+	small := bytes.Repeat([]byte{0x11}, 2*testBlockSize)
+	cqe, _ := ioq.io(opWrite, 1, 2, small, false)
+	ioq.assertSuccess(cqe)
+	large := make([]byte, 64<<10)
+	for i := range large {
+		large[i] = byte(i % 249)
+	}
+	cqe, _ = ioq.io(opWrite, 16, len(large)/testBlockSize, large, true)
+	ioq.assertSuccess(cqe)
+
+	stored := make([]byte, len(small))
+	_, err := replica.ReadAt(stored, testBlockSize)
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, small)
+
+	cqe, read := ioq.io(opRead, 16, len(large)/testBlockSize, nil, false)
+	ioq.assertSuccess(cqe)
+	c.Assert(read, DeepEquals, large)
+	cqe, read = ioq.io(opRead, 0, 3, nil, false)
+	ioq.assertSuccess(cqe)
+	c.Assert(read, DeepEquals, append(make([]byte, testBlockSize), small...))
+
+	cqe, _ = ioq.command(ioq.newSQE(opFlush, nsidBroadcast), nil, false)
+	ioq.assertSuccess(cqe)
+
+	// Write zeroes, and deallocate two ranges.
+	cqe, _ = ioq.io(opWriteZeroes, 16, 2, nil, false)
+	ioq.assertSuccess(cqe)
+	sqe := ioq.newSQE(opDatasetMgmt, namespaceID)
+	le.PutUint32(sqe[40:], 1)
+	le.PutUint32(sqe[44:], dsmDeallocate)
+	ranges := make([]byte, 2*dsmRangeSize)
+	le.PutUint32(ranges[4:], 1)
+	le.PutUint64(ranges[8:], 1)
+	le.PutUint32(ranges[dsmRangeSize+4:], 2)
+	le.PutUint64(ranges[dsmRangeSize+8:], 20)
+	cqe, _ = ioq.command(sqe, ranges, false)
+	ioq.assertSuccess(cqe)
+
+	cqe, read = ioq.io(opRead, 16, len(large)/testBlockSize, nil, true)
+	ioq.assertSuccess(cqe)
+	expected := append([]byte(nil), large...)
+	clear(expected[:2*testBlockSize])
+	clear(expected[4*testBlockSize : 6*testBlockSize])
+	c.Assert(read, DeepEquals, expected)
+	cqe, read = ioq.io(opRead, 1, 2, nil, false)
+	ioq.assertSuccess(cqe)
+	c.Assert(read, DeepEquals, append(make([]byte, testBlockSize), small[testBlockSize:]...))
+}
+
+func (s *TestSuite) TestIOErrors(c *C) {
+	t, replica := startTestTarget(c)
+	defer t.Shutdown()
+	admin, ioq := connectTestHosts(c, t)
+	defer admin.close()
+	defer ioq.close()
+
+	blocks := uint64(testVolumeSize / testBlockSize)
+	for _, e := range []struct {
+		comment string
+		sqe     []byte
+		data    []byte
+		sct, sc uint8
+	}{
+		{"read beyond the end", func() []byte {
+			sqe := ioq.newSQE(opRead, namespaceID)
+			le.PutUint32(sqe[32:], 2*testBlockSize)
+			sqe[39] = sglTransport
+			le.PutUint64(sqe[40:], blocks-1)
+			le.PutUint32(sqe[48:], 1)
+			return sqe
+		}(), nil, sctGeneric, scLBAOutOfRange},
+		{"write of a wrong length", func() []byte {
+			sqe := ioq.newSQE(opWrite, namespaceID)
+			le.PutUint32(sqe[48:], 1)
+			return sqe
+		}(), make([]byte, testBlockSize), sctGeneric, scSGLLengthInvalid},
+		{"unknown namespace", ioq.newSQE(opRead, 2), nil, sctGeneric, scInvalidNamespace},
+		{"unknown opcode", ioq.newSQE(0x7e, namespaceID), nil, sctGeneric, scInvalidOpcode},
+		{"deallocate beyond the end", func() []byte {
+			sqe := ioq.newSQE(opDatasetMgmt, namespaceID)
+			le.PutUint32(sqe[44:], dsmDeallocate)
+			return sqe
+		}(), func() []byte {
+			r := make([]byte, dsmRangeSize)
+			le.PutUint32(r[4:], 2)
+			le.PutUint64(r[8:], blocks-1)
+			return r
+		}(), sctGeneric, scLBAOutOfRange},
+	} {
+		cqe, _ := ioq.command(e.sqe, e.data, false)
+		sct, sc := statusOf(cqe)
+		c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{e.sct, e.sc}, Commentf(e.comment))
+	}
+
+	// A failure of the volume may be retried.
+	replica.SetState(types.ReplicaStateError)
+	cqe, _ := ioq.io(opWrite, 0, 1, make([]byte, testBlockSize), false)
+	sct, sc := statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctMedia, scWriteFault})
+	c.Assert(le.Uint16(cqe[14:])&statusDoNotRetry, Equals, uint16(0))
+	replica.SetState(types.ReplicaStateOpen)
+	cqe, _ = ioq.io(opWrite, 0, 1, make([]byte, testBlockSize), false)
+	ioq.assertSuccess(cqe)
+}
+
+func (s *TestSuite) TestConnectErrors(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+
+	h := dialTestHost(c, t, false, false)
+	defer h.close()
+	cqe, _ := h.connect(NQNPrefix+"other", 0, dynamicControllerID)
+	sct, sc := statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctCommandSpecific, scConnectInvalidParams})
+
+	// Commands before the Connect are refused.
+	cqe, _ = h.command(h.newSQE(opKeepAlive, 0), nil, false)
+	sct, sc = statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctGeneric, scCommandSequenceError})
+
+	// An I/O queue needs a ready controller of the same host.
+	cntlid := h.enable(t.nqn)
+	other := dialTestHost(c, t, false, false)
+	defer other.close()
+	cqe, _ = other.connect(t.nqn, 1, cntlid+1)
+	sct, sc = statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctCommandSpecific, scConnectInvalidParams})
+	cqe, _ = other.connect(t.nqn, maxIOQueues, cntlid)
+	sct, sc = statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctCommandSpecific, scConnectInvalidParams})
+}
+
+func (s *TestSuite) TestExpandNotifiesHost(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	admin, ioq := connectTestHosts(c, t)
+	defer admin.close()
+	defer ioq.close()
+
+	sqe := admin.newSQE(opSetFeatures, 0)
+	le.PutUint32(sqe[40:], featureAsyncEventConf)
+	le.PutUint32(sqe[44:], asyncEventConfigNamespaceAttr)
+	cqe, _ := admin.command(sqe, nil, false)
+	admin.assertSuccess(cqe)
+	admin.send(admin.newSQE(opAsyncEventReq, 0), nil, false)
+
+	c.Assert(t.Expand(2*testVolumeSize), IsNil)
+	cqe, _ = admin.wait()
+	admin.assertSuccess(cqe)
+	c.Assert(le.Uint32(cqe), Equals, uint32(asyncEventNamespaceChanged))
+
+	sqe = admin.newSQE(opGetLogPage, 0)
+	le.PutUint32(sqe[32:], 4096)
+	sqe[39] = sglTransport
+	le.PutUint32(sqe[40:], logChangedNamespaces|(4096/4-1)<<16)
+	cqe, log := admin.command(sqe, nil, false)
+	admin.assertSuccess(cqe)
+	c.Assert(le.Uint32(log), Equals, uint32(namespaceID))
+
+	ns := admin.identify(cnsNamespace, namespaceID)
+	c.Assert(le.Uint64(ns), Equals, uint64(2*testVolumeSize/testBlockSize))
+	// A write to the new blocks passes the range check, and fails in the in-memory replica, which did not grow.
+	cqe, _ = ioq.io(opWrite, testVolumeSize/testBlockSize+1, 1, make([]byte, testBlockSize), false)
+	sct, sc := statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctMedia, scWriteFault})
+}
+
+func (s *TestSuite) TestDiscovery(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	h := dialTestHost(c, t, false, false)
+	defer h.close()
+	h.enable(discoveryNQN)
+
+	sqe := h.newSQE(opGetLogPage, 0)
+	le.PutUint32(sqe[32:], discoveryLogHeaderSize+discoveryLogEntrySize)
+	sqe[39] = sglTransport
+	le.PutUint32(sqe[40:], logDiscovery|((discoveryLogHeaderSize+discoveryLogEntrySize)/4-1)<<16)
+	cqe, log := h.command(sqe, nil, false)
+	h.assertSuccess(cqe)
+	c.Assert(le.Uint64(log[8:]), Equals, uint64(1))
+	entry := log[discoveryLogHeaderSize:]
+	c.Assert(entry[0], Equals, uint8(transportTCP))
+	c.Assert(cString(entry[256:256+nqnSize]), Equals, t.nqn)
+	_, port, err := net.SplitHostPort(t.listener.Addr().String())
+	c.Assert(err, IsNil)
+	c.Assert(string(bytes.TrimRight(entry[32:64], " ")), Equals, port)
+	c.Assert(string(bytes.TrimRight(entry[512:768], " ")), Equals, "127.0.0.1")
+
+	// A discovery controller has no namespace.
+	sqe = h.newSQE(opIdentify, namespaceID)
+	le.PutUint32(sqe[32:], identifySize)
+	sqe[39] = sglTransport
+	cqe, _ = h.command(sqe, nil, false)
+	sct, sc := statusOf(cqe)
+	c.Assert([]uint8{sct, sc}, DeepEquals, []uint8{sctGeneric, scInvalidField})
+}
+
+func (s *TestSuite) TestProtocolErrorTerminates(c *C) {
+	t, _ := startTestTarget(c)
+	defer t.Shutdown()
+	admin, ioq := connectTestHosts(c, t)
+	defer admin.close()
+	defer ioq.close()
+
+	// Data for a transfer the target did not ask for.
+	dh := make([]byte, dataHeaderSize)
+	le.PutUint16(dh[10:], 42)
+	ioq.write(pduH2CData, pduFlagDataLast, dh, make([]byte, 512))
+	typ, _, header, _ := ioq.read()
+	c.Assert(typ, Equals, uint8(pduC2HTermReq))
+	c.Assert(le.Uint16(header[8:]), Equals, uint16(fesInvalidHeaderField))
+	c.Assert(le.Uint32(header[10:]), Equals, uint32(10))
+	_, err := ioq.reader.ReadByte()
+	c.Assert(err, Equals, io.EOF)
+
+	// The controller stays, and takes a new I/O queue.
+	cntlid := le.Uint16(admin.identify(cnsController, 0)[78:])
+	again := dialTestHost(c, t, false, false)
+	defer again.close()
+	cqe, _ := again.connect(t.nqn, 1, cntlid)
+	again.assertSuccess(cqe)
+}
+
+func (s *TestSuite) TestShutdownClosesQueues(c *C) {
+	t, _ := startTestTarget(c)
+	admin, ioq := connectTestHosts(c, t)
+	defer admin.close()
+	defer ioq.close()
+
+	c.Assert(t.Shutdown(), IsNil)
+	c.Assert(t.State(), Equals, types.StateDown)
+	c.Assert(t.Endpoint(), Equals, "")
+	_, err := ioq.reader.ReadByte()
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,117 @@
+package nvmetcp
+
+import (
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+const (
+	// ioForceUnitAccess is the bit of cdw12 that makes a write reach the replicas before it completes
+	ioForceUnitAccess = 1 << 30
+	dsmDeallocate     = 1 << 2
+	dsmRangeSize      = 16
+	// maxUnmapLength is the largest range unmapped at once, a deallocated range is split into such chunks
+	maxUnmapLength = 1 << 30
+)
+
+// ioCommand handles a command of an I/O queue.
+func (q *queue) ioCommand(cmd *command, data []byte) *completion {
+	t := q.target
+	nsid := cmd.nsid()
+	if nsid != namespaceID && !(cmd.opcode() == opFlush && nsid == nsidBroadcast) {
+		return failure(sctGeneric, scInvalidNamespace)
+	}
+
+	switch cmd.opcode() {
+	case opRead, opWrite, opWriteZeroes:
+		off, length, c := t.lbaRange(cmd)
+		if c != nil {
+			return c
+		}
+		if cmd.opcode() == opWriteZeroes {
+			if _, err := util.WriteZeroesAt(t.rwu, uint32(length), off); err != nil {
+				return ioFailure(err, scWriteFault)
+			}
+			return &completion{}
+		}
+		if length != cmd.sglLength() {
+			return failure(sctGeneric, scSGLLengthInvalid)
+		}
+		if cmd.opcode() == opRead {
+			buf := make([]byte, length)
+			if _, err := t.rwu.ReadAt(buf, off); err != nil {
+				return ioFailure(err, scUnrecoveredReadError)
+			}
+			return &completion{data: buf}
+		}
+		if len(data) != length {
+			return failure(sctGeneric, scDataTransferError)
+		}
+		if _, err := t.rwu.WriteAt(data, off); err != nil {
+			return ioFailure(err, scWriteFault)
+		}
+		if cmd.cdw(12)&ioForceUnitAccess != 0 || !q.ctrl.writeCacheEnabled() {
+			return t.flush()
+		}
+		return &completion{}
+	case opFlush:
+		return t.flush()
+	case opDatasetMgmt:
+		return t.datasetManagement(cmd, data)
+	}
+	return failure(sctGeneric, scInvalidOpcode)
+}
+
+// lbaRange returns the offset and length of the blocks a read, write or write zeroes command covers.
+func (t *NvmeTCP) lbaRange(cmd *command) (int64, int, *completion) {
+	slba := uint64(cmd.cdw(10)) | uint64(cmd.cdw(11))<<32
+	nlb := uint64(cmd.cdw(12)&0xffff) + 1
+	blocks := uint64(t.getSize()) / uint64(t.blockSize)
+	if slba > blocks || nlb > blocks-slba {
+		return 0, 0, failure(sctGeneric, scLBAOutOfRange)
+	}
+	length := nlb * uint64(t.blockSize)
+	if cmd.opcode() != opWriteZeroes && length > maxDataTransfer {
+		return 0, 0, failure(sctGeneric, scInvalidField)
+	}
+	return int64(slba * uint64(t.blockSize)), int(length), nil
+}
+
+func (t *NvmeTCP) flush() *completion {
+	if flusher, ok := t.rwu.(types.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			return ioFailure(err, scWriteFault)
+		}
+	}
+	return &completion{}
+}
+
+// datasetManagement unmaps the ranges of a deallocate. The other attributes are only hints, and ignored.
+func (t *NvmeTCP) datasetManagement(cmd *command, data []byte) *completion {
+	nr := int(cmd.cdw(10)&0xff) + 1
+	if len(data) < nr*dsmRangeSize {
+		return failure(sctGeneric, scDataTransferError)
+	}
+	if cmd.cdw(11)&dsmDeallocate == 0 {
+		return &completion{}
+	}
+
+	blocks := uint64(t.getSize()) / uint64(t.blockSize)
+	for i := 0; i < nr; i++ {
+		r := data[i*dsmRangeSize:]
+		nlb, slba := uint64(le.Uint32(r[4:])), le.Uint64(r[8:])
+		if slba > blocks || nlb > blocks-slba {
+			return failure(sctGeneric, scLBAOutOfRange)
+		}
+		off, length := int64(slba*uint64(t.blockSize)), int64(nlb*uint64(t.blockSize))
+		for length > 0 {
+			n := min(length, maxUnmapLength)
+			if _, err := t.rwu.UnmapAt(uint32(n), off); err != nil {
+				return ioFailure(err, scWriteFault)
+			}
+			off += n
+			length -= n
+		}
+	}
+	return &completion{}
+}
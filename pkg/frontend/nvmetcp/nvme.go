@@ -0,0 +1,158 @@
+package nvmetcp
+
+import (
+	"errors"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	sqeSize = 64
+	cqeSize = 16
+
+	// opFabrics is the opcode of the fabrics commands, which are valid on every queue
+	opFabrics = 0x7f
+
+	fctypePropertySet = 0x00
+	fctypeConnect     = 0x01
+	fctypePropertyGet = 0x04
+
+	// Opcodes of the admin commands
+	opGetLogPage    = 0x02
+	opIdentify      = 0x06
+	opAbort         = 0x08
+	opSetFeatures   = 0x09
+	opGetFeatures   = 0x0a
+	opAsyncEventReq = 0x0c
+	opKeepAlive     = 0x18
+
+	// Opcodes of the I/O commands
+	opFlush       = 0x00
+	opWrite       = 0x01
+	opRead        = 0x02
+	opWriteZeroes = 0x08
+	opDatasetMgmt = 0x09
+
+	// The low bits of an opcode tell the direction of its data
+	dataTransferMask = 0x03
+	dataTransferH2C  = 0x01
+	dataTransferC2H  = 0x02
+
+	// sglInCapsule describes data in the command capsule, sglTransport data the host keeps until asked for with an
+	// R2T, or data sent to the host
+	sglInCapsule = 0x01
+	sglTransport = 0x5a
+
+	sctGeneric         = 0x0
+	sctCommandSpecific = 0x1
+	sctMedia           = 0x2
+
+	scSuccess              = 0x00
+	scInvalidOpcode        = 0x01
+	scInvalidField         = 0x02
+	scCommandIDConflict    = 0x03
+	scDataTransferError    = 0x04
+	scInternalError        = 0x06
+	scInvalidNamespace     = 0x0b
+	scCommandSequenceError = 0x0c
+	scFeatureNotSaveable   = 0x0d
+	scSGLLengthInvalid     = 0x0f
+	scSGLTypeInvalid       = 0x11
+	scTransientTransport   = 0x22
+	scLBAOutOfRange        = 0x80
+	scCapacityExceeded     = 0x81
+
+	// Command specific status codes
+	scAsyncEventLimit           = 0x05
+	scConnectIncompatibleFormat = 0x80
+	scConnectInvalidParams      = 0x82
+	scConnectInvalidHost        = 0x84
+
+	// Media status codes
+	scWriteFault           = 0x80
+	scUnrecoveredReadError = 0x81
+
+	statusDoNotRetry = 1 << 15
+
+	namespaceID         = 1
+	nsidBroadcast       = 0xffffffff
+	dynamicControllerID = 0xffff
+
+	connectDataSize          = 1024
+	connectDataSubNQNOffset  = 256
+	connectDataHostNQNOffset = 512
+	nqnSize                  = 256
+)
+
+// command is a command capsule of a host, a submission queue entry.
+type command struct {
+	sqe []byte
+}
+
+func (c *command) opcode() uint8 {
+	return c.sqe[0]
+}
+
+func (c *command) cid() uint16 {
+	return le.Uint16(c.sqe[2:])
+}
+
+func (c *command) nsid() uint32 {
+	return le.Uint32(c.sqe[4:])
+}
+
+// cdw returns the command dword n, from 10 to 15.
+func (c *command) cdw(n int) uint32 {
+	return le.Uint32(c.sqe[4*n:])
+}
+
+func (c *command) fctype() uint8 {
+	return c.sqe[4]
+}
+
+// sglLength, sglOffset and sglType describe the data block of the command.
+func (c *command) sglOffset() uint64 {
+	return le.Uint64(c.sqe[24:])
+}
+
+func (c *command) sglLength() int {
+	return int(le.Uint32(c.sqe[32:]))
+}
+
+func (c *command) sglType() uint8 {
+	return c.sqe[39]
+}
+
+// dataTransfer returns the direction data moves in for the command.
+func (c *command) dataTransfer() uint8 {
+	if c.opcode() == opFabrics {
+		return c.fctype() & dataTransferMask
+	}
+	return c.opcode() & dataTransferMask
+}
+
+// completion is the completion queue entry of a command, and the data returned with it.
+type completion struct {
+	dw0    uint32
+	dw1    uint32
+	status uint16
+	data   []byte
+}
+
+func status(sct, sc uint8) uint16 {
+	return uint16(sc)<<1 | uint16(sct)<<9
+}
+
+// failure returns a completion with an error status the host should not retry.
+func failure(sct, sc uint8) *completion {
+	return &completion{status: status(sct, sc) | statusDoNotRetry}
+}
+
+// ioFailure turns the error of the volume into a completion. Volume errors may go away, e.g. once a replica is
+// rebuilt, so the host may retry them.
+func ioFailure(err error, sc uint8) *completion {
+	if errors.Is(err, types.ErrNoSpaceLeftOnDevice) {
+		return &completion{status: status(sctGeneric, scCapacityExceeded)}
+	}
+	return &completion{status: status(sctMedia, sc)}
+}
@@ -0,0 +1,238 @@
+package nvmetcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	le = binary.LittleEndian
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	pduICReq       = 0x00
+	pduICResp      = 0x01
+	pduH2CTermReq  = 0x02
+	pduC2HTermReq  = 0x03
+	pduCapsuleCmd  = 0x04
+	pduCapsuleResp = 0x05
+	pduH2CData     = 0x06
+	pduC2HData     = 0x07
+	pduR2T         = 0x09
+
+	pduFlagHDGST    = 0x01
+	pduFlagDDGST    = 0x02
+	pduFlagDataLast = 0x04
+
+	commonHeaderSize = 8
+	icHeaderSize     = 128
+	termHeaderSize   = 24
+	cmdHeaderSize    = commonHeaderSize + sqeSize
+	respHeaderSize   = commonHeaderSize + cqeSize
+	dataHeaderSize   = 24
+	r2tHeaderSize    = 24
+	digestSize       = 4
+
+	// Fatal error statuses of termination requests
+	fesInvalidHeaderField     = 0x01
+	fesPDUSequenceError       = 0x02
+	fesHeaderDigestError      = 0x03
+	fesDataTransferOutOfRange = 0x04
+	fesDataTransferLimit      = 0x05
+	fesUnsupportedParameter   = 0x06
+)
+
+// pdu is a PDU read from a host. The header starts with the common header, the digest and the padding are not
+// part of it.
+type pdu struct {
+	typ    uint8
+	flags  uint8
+	header []byte
+	data   []byte
+	// dataDigestErr tells whether the data digest of the PDU did not match
+	dataDigestErr bool
+}
+
+// protocolError is a fatal transport error. The connection is terminated with a C2HTermReq telling the host why.
+type protocolError struct {
+	fes uint16
+	// fei is the offset of the invalid header field, or the unsupported parameter
+	fei uint32
+	msg string
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("NVMe/TCP protocol error 0x%x: %v", e.fes, e.msg)
+}
+
+func newProtocolError(fes uint16, fei uint32, format string, args ...interface{}) error {
+	return &protocolError{fes: fes, fei: fei, msg: fmt.Sprintf(format, args...)}
+}
+
+// pduHeaderSize returns the header size a PDU from a host must have.
+func pduHeaderSize(typ uint8) (int, bool) {
+	switch typ {
+	case pduICReq:
+		return icHeaderSize, true
+	case pduH2CTermReq:
+		return termHeaderSize, true
+	case pduCapsuleCmd:
+		return cmdHeaderSize, true
+	case pduH2CData:
+		return dataHeaderSize, true
+	}
+	return 0, false
+}
+
+// hasHeaderDigest tells whether a PDU carries a header digest once header digests are enabled. The
+// initialization and termination PDUs never do.
+func hasHeaderDigest(typ uint8) bool {
+	return typ != pduICReq && typ != pduICResp && typ != pduH2CTermReq && typ != pduC2HTermReq
+}
+
+// readPDU reads a PDU of the host. dest returns the buffer the data of the PDU goes to, or nil for a new buffer.
+func (q *queue) readPDU(dest func(p *pdu, length int) ([]byte, error)) (*pdu, error) {
+	ch := make([]byte, commonHeaderSize)
+	if _, err := io.ReadFull(q.reader, ch); err != nil {
+		return nil, err
+	}
+	p := &pdu{typ: ch[0], flags: ch[1]}
+	hlen, pdo, plen := int(ch[2]), int(ch[3]), int(le.Uint32(ch[4:]))
+
+	expected, ok := pduHeaderSize(p.typ)
+	if !ok {
+		return nil, newProtocolError(fesInvalidHeaderField, 0, "unexpected PDU type 0x%x", p.typ)
+	}
+	if hlen != expected {
+		return nil, newProtocolError(fesInvalidHeaderField, 2, "invalid header length %v of PDU type 0x%x", hlen, p.typ)
+	}
+	hdgst := q.hdgst && hasHeaderDigest(p.typ)
+	if hdgst != (p.flags&pduFlagHDGST != 0) {
+		return nil, newProtocolError(fesInvalidHeaderField, 1, "header digest flag of PDU type 0x%x does not match the negotiated digests", p.typ)
+	}
+	ddgst := p.flags&pduFlagDDGST != 0
+	if ddgst && !q.ddgst {
+		return nil, newProtocolError(fesInvalidHeaderField, 1, "data digest flag of PDU type 0x%x is set without data digests", p.typ)
+	}
+
+	headerEnd := hlen
+	if hdgst {
+		headerEnd += digestSize
+	}
+	dataStart := headerEnd
+	if pdo != 0 {
+		dataStart = pdo
+	}
+	dataEnd := plen
+	if ddgst {
+		dataEnd -= digestSize
+	}
+	if dataStart < headerEnd || dataEnd < dataStart || plen > headerEnd+maxPDUData {
+		return nil, newProtocolError(fesInvalidHeaderField, 3, "invalid data offset %v and length %v of PDU type 0x%x", pdo, plen, p.typ)
+	}
+	if dataEnd == dataStart && (pdo != 0 || ddgst) {
+		return nil, newProtocolError(fesInvalidHeaderField, 3, "data offset or digest without data in PDU type 0x%x", p.typ)
+	}
+
+	p.header = make([]byte, hlen)
+	copy(p.header, ch)
+	if _, err := io.ReadFull(q.reader, p.header[commonHeaderSize:]); err != nil {
+		return nil, err
+	}
+	if hdgst {
+		digest := make([]byte, digestSize)
+		if _, err := io.ReadFull(q.reader, digest); err != nil {
+			return nil, err
+		}
+		if le.Uint32(digest) != crc32.Checksum(p.header, crc32c) {
+			return nil, newProtocolError(fesHeaderDigestError, 0, "header digest mismatch of PDU type 0x%x", p.typ)
+		}
+	}
+	if dataEnd == dataStart {
+		return p, nil
+	}
+
+	if _, err := q.reader.Discard(dataStart - headerEnd); err != nil {
+		return nil, err
+	}
+	length := dataEnd - dataStart
+	if dest != nil {
+		buf, err := dest(p, length)
+		if err != nil {
+			return nil, err
+		}
+		p.data = buf
+	}
+	if p.data == nil {
+		p.data = make([]byte, length)
+	}
+	if _, err := io.ReadFull(q.reader, p.data); err != nil {
+		return nil, err
+	}
+	if ddgst {
+		digest := make([]byte, digestSize)
+		if _, err := io.ReadFull(q.reader, digest); err != nil {
+			return nil, err
+		}
+		p.dataDigestErr = le.Uint32(digest) != crc32.Checksum(p.data, crc32c)
+	}
+	return p, nil
+}
+
+// writePDU writes a PDU to the host, with the digests and the data alignment negotiated. header is the whole
+// header, the common header in it is filled here. The caller holds the write lock and flushes.
+func (q *queue) writePDU(typ, flags uint8, header, data []byte) error {
+	hlen := len(header)
+	hdgst := q.hdgst && hasHeaderDigest(typ)
+	ddgst := q.ddgst && len(data) > 0 && hasHeaderDigest(typ)
+
+	headerEnd := hlen
+	if hdgst {
+		headerEnd += digestSize
+		flags |= pduFlagHDGST
+	}
+	pdo, plen := 0, headerEnd
+	if len(data) > 0 {
+		pdo = (headerEnd + q.dataAlign - 1) / q.dataAlign * q.dataAlign
+		plen = pdo + len(data)
+		if ddgst {
+			plen += digestSize
+			flags |= pduFlagDDGST
+		}
+	}
+
+	header[0], header[1], header[2], header[3] = typ, flags, uint8(hlen), uint8(pdo)
+	le.PutUint32(header[4:], uint32(plen))
+	if _, err := q.writer.Write(header); err != nil {
+		return err
+	}
+	var digest [digestSize]byte
+	if hdgst {
+		le.PutUint32(digest[:], crc32.Checksum(header, crc32c))
+		if _, err := q.writer.Write(digest[:]); err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if pad := pdo - headerEnd; pad > 0 {
+		if _, err := q.writer.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+	if _, err := q.writer.Write(data); err != nil {
+		return err
+	}
+	if ddgst {
+		le.PutUint32(digest[:], crc32.Checksum(data, crc32c))
+		if _, err := q.writer.Write(digest[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
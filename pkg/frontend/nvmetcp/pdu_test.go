@@ -0,0 +1,243 @@
+package nvmetcp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+// encodePDU encodes a PDU the way a host does. The data starts at pdo, or right after the header if it is 0.
+func encodePDU(typ, flags uint8, header []byte, pdo int, data []byte) []byte {
+	hlen := len(header)
+	headerEnd := hlen
+	if flags&pduFlagHDGST != 0 {
+		headerEnd += digestSize
+	}
+	dataStart := headerEnd
+	if pdo != 0 {
+		dataStart = pdo
+	}
+	plen := headerEnd
+	if len(data) > 0 {
+		plen = dataStart + len(data)
+		if flags&pduFlagDDGST != 0 {
+			plen += digestSize
+		}
+	}
+
+	raw := append([]byte(nil), header...)
+	raw[0], raw[1], raw[2], raw[3] = typ, flags, uint8(hlen), uint8(pdo)
+	le.PutUint32(raw[4:], uint32(plen))
+	if flags&pduFlagHDGST != 0 {
+		raw = le.AppendUint32(raw, crc32.Checksum(raw, crc32c))
+	}
+	if len(data) > 0 {
+		raw = append(raw, make([]byte, dataStart-headerEnd)...)
+		raw = append(raw, data...)
+		if flags&pduFlagDDGST != 0 {
+			raw = le.AppendUint32(raw, crc32.Checksum(data, crc32c))
+		}
+	}
+	return raw
+}
+
+func newTestQueue(raw []byte, hdgst, ddgst bool) *queue {
+	return &queue{
+		reader:    bufio.NewReader(bytes.NewReader(raw)),
+		writer:    bufio.NewWriter(&bytes.Buffer{}),
+		hdgst:     hdgst,
+		ddgst:     ddgst,
+		dataAlign: 4,
+		transfers: map[uint16]*transfer{},
+	}
+}
+
+func testCommandHeader(opcode uint8, cid uint16) []byte {
+	header := make([]byte, cmdHeaderSize)
+	header[commonHeaderSize] = opcode
+	le.PutUint16(header[commonHeaderSize+2:], cid)
+	return header
+}
+
+func (s *TestSuite) TestReadPDU(c *C) {
+	data := []byte("in-capsule data")
+	for _, t := range []struct {
+		hdgst, ddgst bool
+		pdo          int
+	}{
+		{false, false, 0},
+		{true, false, 0},
+		{false, true, 0},
+		{true, true, 0},
+		// Data aligned further than the header.
+		{false, false, 128},
+		{true, true, 128},
+	} {
+		var flags uint8
+		if t.hdgst {
+			flags |= pduFlagHDGST
+		}
+		if t.ddgst {
+			flags |= pduFlagDDGST
+		}
+		raw := encodePDU(pduCapsuleCmd, flags, testCommandHeader(opWrite, 7), t.pdo, data)
+		// A second PDU follows, without data.
+		raw = append(raw, encodePDU(pduCapsuleCmd, flags&pduFlagHDGST, testCommandHeader(opFlush, 8), 0, nil)...)
+		q := newTestQueue(raw, t.hdgst, t.ddgst)
+
+		p, err := q.readPDU(nil)
+		c.Assert(err, IsNil, Commentf("%+v", t))
+		c.Assert(p.typ, Equals, uint8(pduCapsuleCmd))
+		c.Assert(p.header, HasLen, cmdHeaderSize)
+		cmd := &command{sqe: p.header[commonHeaderSize:]}
+		c.Assert(cmd.opcode(), Equals, uint8(opWrite))
+		c.Assert(cmd.cid(), Equals, uint16(7))
+		c.Assert(p.data, DeepEquals, data)
+		c.Assert(p.dataDigestErr, Equals, false)
+
+		p, err = q.readPDU(nil)
+		c.Assert(err, IsNil)
+		c.Assert((&command{sqe: p.header[commonHeaderSize:]}).cid(), Equals, uint16(8))
+		c.Assert(p.data, IsNil)
+	}
+}
+
+func (s *TestSuite) TestReadPDUDestination(c *C) {
+	header := make([]byte, dataHeaderSize)
+	raw := encodePDU(pduH2CData, pduFlagDataLast, header, 0, []byte("data"))
+	q := newTestQueue(raw, false, false)
+
+	buf := make([]byte, 8)
+	p, err := q.readPDU(func(p *pdu, length int) ([]byte, error) {
+		c.Assert(length, Equals, 4)
+		return buf[2:6], nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(buf[2:6]), Equals, "data")
+	c.Assert(&p.data[0], Equals, &buf[2])
+}
+
+func (s *TestSuite) TestReadPDUDigestErrors(c *C) {
+	raw := encodePDU(pduCapsuleCmd, pduFlagHDGST|pduFlagDDGST, testCommandHeader(opWrite, 1), 0, []byte("data"))
+
+	corrupt := append([]byte(nil), raw...)
+	corrupt[commonHeaderSize+10] ^= 1
+	_, err := newTestQueue(corrupt, true, true).readPDU(nil)
+	var perr *protocolError
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(perr.fes, Equals, uint16(fesHeaderDigestError))
+
+	// A data digest error fails the command, not the connection.
+	corrupt = append([]byte(nil), raw...)
+	corrupt[len(corrupt)-digestSize-1] ^= 1
+	p, err := newTestQueue(corrupt, true, true).readPDU(nil)
+	c.Assert(err, IsNil)
+	c.Assert(p.dataDigestErr, Equals, true)
+}
+
+func (s *TestSuite) TestReadPDUInvalid(c *C) {
+	valid := encodePDU(pduCapsuleCmd, 0, testCommandHeader(opWrite, 1), 0, []byte("data"))
+	for _, t := range []struct {
+		comment      string
+		raw          []byte
+		hdgst, ddgst bool
+		fes          uint16
+		fei          uint32
+	}{
+		{"controller PDU type", encodePDU(pduCapsuleResp, 0, make([]byte, respHeaderSize), 0, nil), false, false,
+			fesInvalidHeaderField, 0},
+		{"unknown PDU type", encodePDU(0x7f, 0, make([]byte, 8), 0, nil), false, false, fesInvalidHeaderField, 0},
+		{"header length", encodePDU(pduCapsuleCmd, 0, make([]byte, cmdHeaderSize-4), 0, nil), false, false,
+			fesInvalidHeaderField, 2},
+		{"header digest without negotiation", encodePDU(pduCapsuleCmd, pduFlagHDGST, testCommandHeader(opFlush, 1), 0, nil),
+			false, false, fesInvalidHeaderField, 1},
+		{"no header digest once negotiated", valid, true, false, fesInvalidHeaderField, 1},
+		{"data digest without negotiation", encodePDU(pduCapsuleCmd, pduFlagDDGST, testCommandHeader(opWrite, 1), 0, []byte("data")),
+			false, false, fesInvalidHeaderField, 1},
+		{"data offset inside the header", func() []byte {
+			raw := append([]byte(nil), valid...)
+			raw[3] = 16
+			return raw
+		}(), false, false, fesInvalidHeaderField, 3},
+		{"data offset without data", func() []byte {
+			raw := encodePDU(pduCapsuleCmd, 0, testCommandHeader(opFlush, 1), 0, nil)
+			raw[3] = cmdHeaderSize
+			return raw
+		}(), false, false, fesInvalidHeaderField, 3},
+		{"data beyond the limit", func() []byte {
+			raw := append([]byte(nil), valid...)
+			le.PutUint32(raw[4:], cmdHeaderSize+maxPDUData+1)
+			return raw
+		}(), false, false, fesInvalidHeaderField, 3},
+		{"length shorter than the header", func() []byte {
+			raw := append([]byte(nil), valid...)
+			le.PutUint32(raw[4:], cmdHeaderSize-1)
+			return raw
+		}(), false, false, fesInvalidHeaderField, 3},
+	} {
+		_, err := newTestQueue(t.raw, t.hdgst, t.ddgst).readPDU(nil)
+		var perr *protocolError
+		c.Assert(errors.As(err, &perr), Equals, true, Commentf("%v: %v", t.comment, err))
+		c.Assert(perr.fes, Equals, t.fes, Commentf(t.comment))
+		c.Assert(perr.fei, Equals, t.fei, Commentf(t.comment))
+	}
+}
+
+func (s *TestSuite) TestWritePDU(c *C) {
+	for _, t := range []struct {
+		hdgst, ddgst bool
+		dataAlign    int
+	}{
+		{false, false, 4},
+		{true, true, 4},
+		{true, false, 128},
+	} {
+		var out bytes.Buffer
+		q := &queue{writer: bufio.NewWriter(&out), hdgst: t.hdgst, ddgst: t.ddgst, dataAlign: t.dataAlign}
+		header := make([]byte, dataHeaderSize)
+		le.PutUint16(header[8:], 3)
+		data := []byte("read data")
+		c.Assert(q.writePDU(pduC2HData, pduFlagDataLast, header, data), IsNil)
+		c.Assert(q.writer.Flush(), IsNil)
+		raw := out.Bytes()
+
+		headerEnd := dataHeaderSize
+		if t.hdgst {
+			headerEnd += digestSize
+			c.Assert(le.Uint32(raw[dataHeaderSize:]), Equals, crc32.Checksum(raw[:dataHeaderSize], crc32c))
+		}
+		pdo := int(raw[3])
+		c.Assert(raw[0], Equals, uint8(pduC2HData))
+		c.Assert(raw[1]&pduFlagDataLast, Equals, uint8(pduFlagDataLast))
+		c.Assert(raw[1]&pduFlagHDGST != 0, Equals, t.hdgst)
+		c.Assert(raw[1]&pduFlagDDGST != 0, Equals, t.ddgst)
+		c.Assert(raw[2], Equals, uint8(dataHeaderSize))
+		c.Assert(pdo%t.dataAlign, Equals, 0)
+		c.Assert(pdo >= headerEnd, Equals, true)
+		c.Assert(raw[pdo:pdo+len(data)], DeepEquals, data)
+		plen := int(le.Uint32(raw[4:]))
+		c.Assert(plen, Equals, len(raw))
+		if t.ddgst {
+			c.Assert(le.Uint32(raw[plen-digestSize:]), Equals, crc32.Checksum(data, crc32c))
+		}
+	}
+
+	// The initialization and termination PDUs never carry digests.
+	var out bytes.Buffer
+	q := &queue{writer: bufio.NewWriter(&out), hdgst: true, ddgst: true, dataAlign: 4}
+	c.Assert(q.writePDU(pduC2HTermReq, 0, make([]byte, termHeaderSize), nil), IsNil)
+	c.Assert(q.writer.Flush(), IsNil)
+	c.Assert(out.Bytes()[1], Equals, uint8(0))
+	c.Assert(out.Len(), Equals, termHeaderSize)
+}
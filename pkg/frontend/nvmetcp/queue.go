@@ -0,0 +1,344 @@
+package nvmetcp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mdts bounds the data of a command to 2^mdts pages of 4KiB
+	mdts            = 8
+	maxDataTransfer = 4096 << mdts
+	// inCapsuleDataSize is how much data a host may send in a command capsule instead of waiting for an R2T
+	inCapsuleDataSize = 8192
+	// maxH2CData is the largest data of a H2CData PDU
+	maxH2CData = maxDataTransfer
+	maxPDUData = maxDataTransfer
+
+	adminQueueEntries = 32
+	ioQueueEntries    = 128
+	maxIOQueues       = 16
+)
+
+// queue is a queue pair of a controller. NVMe/TCP runs each queue on its own connection. The reader goroutine
+// takes the commands and their data off the connection, the admin and fabrics commands are handled by it too, and
+// each I/O command by a goroutine of its own.
+type queue struct {
+	target *NvmeTCP
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+
+	hdgst     bool
+	ddgst     bool
+	dataAlign int
+
+	// ctrl, qid and size are set by the Connect command
+	ctrl *controller
+	qid  uint16
+	size uint16
+	// received counts the commands, for the submission queue head reported in the completions
+	received atomic.Uint32
+
+	// transfers are the commands waiting for their data from the host, by transfer tag. Only the reader uses them.
+	transfers map[uint16]*transfer
+	inflight  sync.WaitGroup
+}
+
+// transfer is the data of a command requested with an R2T.
+type transfer struct {
+	cmd      *command
+	data     []byte
+	received int
+	// digestErr tells whether a data digest did not match
+	digestErr bool
+}
+
+func newQueue(t *NvmeTCP, conn net.Conn) *queue {
+	return &queue{
+		target:    t,
+		conn:      conn,
+		reader:    bufio.NewReaderSize(conn, 64*1024),
+		writer:    bufio.NewWriterSize(conn, 64*1024),
+		dataAlign: 4,
+		transfers: map[uint16]*transfer{},
+	}
+}
+
+// serve handles the queue until the host disconnects or a protocol error occurs.
+func (q *queue) serve() error {
+	defer q.close()
+
+	if err := q.initialize(); err != nil {
+		return q.terminate(err)
+	}
+	for {
+		p, err := q.readPDU(q.dataDestination)
+		if err != nil {
+			return q.terminate(err)
+		}
+		switch p.typ {
+		case pduCapsuleCmd:
+			err = q.receiveCommand(p)
+		case pduH2CData:
+			err = q.receiveData(p)
+		case pduH2CTermReq:
+			return fmt.Errorf("host terminated the connection with status 0x%x", le.Uint16(p.header[8:]))
+		default:
+			err = newProtocolError(fesPDUSequenceError, 0, "unexpected PDU type 0x%x", p.typ)
+		}
+		if err != nil {
+			return q.terminate(err)
+		}
+	}
+}
+
+// initialize exchanges the ICReq and ICResp, which set up the digests and the data alignment.
+func (q *queue) initialize() error {
+	p, err := q.readPDU(nil)
+	if err != nil {
+		return err
+	}
+	if p.typ != pduICReq {
+		return newProtocolError(fesPDUSequenceError, 0, "PDU type 0x%x before the ICReq", p.typ)
+	}
+	pfv, hpda, dgst := le.Uint16(p.header[8:]), p.header[10], p.header[11]
+	if pfv != 0 {
+		return newProtocolError(fesUnsupportedParameter, 8, "unsupported PDU format version %v", pfv)
+	}
+	if hpda > 31 {
+		return newProtocolError(fesInvalidHeaderField, 10, "invalid host PDU data alignment %v", hpda)
+	}
+	q.hdgst = dgst&pduFlagHDGST != 0
+	q.ddgst = dgst&pduFlagDDGST != 0
+	q.dataAlign = (int(hpda) + 1) * 4
+
+	resp := make([]byte, icHeaderSize)
+	resp[11] = dgst & (pduFlagHDGST | pduFlagDDGST)
+	le.PutUint32(resp[12:], maxH2CData)
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+	if err := q.writePDU(pduICResp, 0, resp, nil); err != nil {
+		return err
+	}
+	return q.writer.Flush()
+}
+
+// terminate tells the host about a protocol error before the connection is closed.
+func (q *queue) terminate(err error) error {
+	var perr *protocolError
+	if !errors.As(err, &perr) {
+		return err
+	}
+	header := make([]byte, termHeaderSize)
+	le.PutUint16(header[8:], perr.fes)
+	le.PutUint32(header[10:], perr.fei)
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+	if werr := q.writePDU(pduC2HTermReq, 0, header, nil); werr == nil {
+		_ = q.writer.Flush()
+	}
+	return err
+}
+
+func (q *queue) close() {
+	_ = q.conn.Close()
+	q.inflight.Wait()
+	if q.ctrl != nil {
+		q.ctrl.removeQueue(q)
+	}
+}
+
+// receiveCommand takes a command capsule. The data of a command from the host is either in the capsule, or
+// requested with an R2T and handled once it all arrived.
+func (q *queue) receiveCommand(p *pdu) error {
+	q.received.Add(1)
+	cmd := &command{sqe: p.header[commonHeaderSize:]}
+	if len(p.data) > inCapsuleDataSize {
+		return newProtocolError(fesDataTransferLimit, 0, "%v bytes of in-capsule data exceed %v", len(p.data), inCapsuleDataSize)
+	}
+	if p.dataDigestErr {
+		q.complete(cmd, &completion{status: status(sctGeneric, scTransientTransport)})
+		return nil
+	}
+
+	length := cmd.sglLength()
+	switch cmd.dataTransfer() {
+	case dataTransferH2C:
+		if length == 0 {
+			break
+		}
+		switch cmd.sglType() {
+		case sglInCapsule:
+			offset := cmd.sglOffset()
+			if offset > uint64(len(p.data)) || uint64(length) > uint64(len(p.data))-offset {
+				q.complete(cmd, failure(sctGeneric, scSGLLengthInvalid))
+				return nil
+			}
+			q.dispatch(cmd, p.data[offset:offset+uint64(length)])
+			return nil
+		case sglTransport:
+			if length > maxDataTransfer {
+				q.complete(cmd, failure(sctGeneric, scInvalidField))
+				return nil
+			}
+			if _, ok := q.transfers[cmd.cid()]; ok {
+				q.complete(cmd, failure(sctGeneric, scCommandIDConflict))
+				return nil
+			}
+			q.transfers[cmd.cid()] = &transfer{cmd: cmd, data: make([]byte, length)}
+			return q.requestData(cmd.cid(), length)
+		default:
+			q.complete(cmd, failure(sctGeneric, scSGLTypeInvalid))
+			return nil
+		}
+	case dataTransferC2H:
+		if length > maxDataTransfer {
+			q.complete(cmd, failure(sctGeneric, scInvalidField))
+			return nil
+		}
+	}
+	q.dispatch(cmd, nil)
+	return nil
+}
+
+// requestData asks the host for the data of a command with an R2T. The command ID is the transfer tag.
+func (q *queue) requestData(cid uint16, length int) error {
+	header := make([]byte, r2tHeaderSize)
+	le.PutUint16(header[8:], cid)
+	le.PutUint16(header[10:], cid)
+	le.PutUint32(header[16:], uint32(length))
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+	if err := q.writePDU(pduR2T, 0, header, nil); err != nil {
+		return err
+	}
+	return q.writer.Flush()
+}
+
+// dataDestination returns where the data of a H2CData PDU goes, which must be the next part of the data of its
+// transfer.
+func (q *queue) dataDestination(p *pdu, length int) ([]byte, error) {
+	if p.typ != pduH2CData {
+		return nil, nil
+	}
+	cid, ttag := le.Uint16(p.header[8:]), le.Uint16(p.header[10:])
+	offset, dataLength := int(le.Uint32(p.header[12:])), int(le.Uint32(p.header[16:]))
+	t, ok := q.transfers[ttag]
+	if !ok {
+		return nil, newProtocolError(fesInvalidHeaderField, 10, "unknown transfer tag %v", ttag)
+	}
+	if t.cmd.cid() != cid {
+		return nil, newProtocolError(fesInvalidHeaderField, 8, "command %v does not match transfer tag %v", cid, ttag)
+	}
+	if dataLength != length {
+		return nil, newProtocolError(fesInvalidHeaderField, 16, "data length %v does not match the %v bytes of the PDU", dataLength, length)
+	}
+	if offset != t.received || length > len(t.data)-offset {
+		return nil, newProtocolError(fesDataTransferOutOfRange, 12, "%v bytes at offset %v are out of the %v bytes expected at %v",
+			length, offset, len(t.data), t.received)
+	}
+	return t.data[offset : offset+length], nil
+}
+
+func (q *queue) receiveData(p *pdu) error {
+	ttag := le.Uint16(p.header[10:])
+	t, ok := q.transfers[ttag]
+	if !ok {
+		return newProtocolError(fesInvalidHeaderField, 10, "unknown transfer tag %v", ttag)
+	}
+	t.received += len(p.data)
+	if p.dataDigestErr {
+		t.digestErr = true
+	}
+	if p.flags&pduFlagDataLast == 0 {
+		return nil
+	}
+	if t.received != len(t.data) {
+		return newProtocolError(fesDataTransferOutOfRange, 12, "last data of command %v after %v out of %v bytes",
+			t.cmd.cid(), t.received, len(t.data))
+	}
+	delete(q.transfers, ttag)
+	if t.digestErr {
+		q.complete(t.cmd, &completion{status: status(sctGeneric, scTransientTransport)})
+		return nil
+	}
+	q.dispatch(t.cmd, t.data)
+	return nil
+}
+
+// dispatch handles a command whose data arrived.
+func (q *queue) dispatch(cmd *command, data []byte) {
+	if cmd.opcode() == opFabrics {
+		q.complete(cmd, q.fabricsCommand(cmd, data))
+		return
+	}
+	if q.ctrl == nil {
+		q.complete(cmd, failure(sctGeneric, scCommandSequenceError))
+		return
+	}
+	q.ctrl.touch()
+	if q.qid == 0 {
+		// Asynchronous event requests are completed later.
+		if c := q.ctrl.adminCommand(q, cmd, data); c != nil {
+			q.complete(cmd, c)
+		}
+		return
+	}
+	q.inflight.Add(1)
+	go func() {
+		defer q.inflight.Done()
+		q.complete(cmd, q.ioCommand(cmd, data))
+	}()
+}
+
+// complete sends the completion of a command, after its data if it returns some.
+func (q *queue) complete(cmd *command, c *completion) {
+	data := c.data
+	if cmd.dataTransfer() != dataTransferC2H {
+		data = nil
+	} else if length := cmd.sglLength(); len(data) > length {
+		data = data[:length]
+	}
+
+	resp := make([]byte, respHeaderSize)
+	cqe := resp[commonHeaderSize:]
+	le.PutUint32(cqe[0:], c.dw0)
+	le.PutUint32(cqe[4:], c.dw1)
+	if q.size > 0 {
+		le.PutUint16(cqe[8:], uint16(q.received.Load()%uint32(q.size)))
+	}
+	le.PutUint16(cqe[10:], q.qid)
+	le.PutUint16(cqe[12:], cmd.cid())
+	le.PutUint16(cqe[14:], c.status)
+
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+	err := func() error {
+		if len(data) > 0 {
+			header := make([]byte, dataHeaderSize)
+			le.PutUint16(header[8:], cmd.cid())
+			le.PutUint32(header[16:], uint32(len(data)))
+			if err := q.writePDU(pduC2HData, pduFlagDataLast, header, data); err != nil {
+				return err
+			}
+		}
+		if err := q.writePDU(pduCapsuleResp, 0, resp, nil); err != nil {
+			return err
+		}
+		return q.writer.Flush()
+	}()
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to complete NVMe command %v on queue %v of %v", cmd.cid(), q.qid, q.target.Volume)
+		// The reader notices the closed connection.
+		_ = q.conn.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package rest
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const bearerPrefix = "Bearer "
+
+// CheckListenAddress refuses a listen address other than a loopback one, unless the clients must authenticate with a
+// token or a client certificate. Anyone who can reach the server can read and write the volume.
+func CheckListenAddress(options Options) error {
+	if options.TokenFile != "" || options.TLSClientCAFile != "" {
+		return nil
+	}
+	address := options.ListenAddress
+	if address == "" {
+		address = DefaultListenAddress
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrapf(err, "invalid rest frontend listen address %v", address)
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("rest frontend listen address %v is not a loopback address, which needs a token file or a client CA file", address)
+		}
+	}
+	return nil
+}
+
+// loadToken reads the token of the clients from file. No file means no token is required.
+func loadToken(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read token file %v", file)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %v is empty", file)
+	}
+	return token, nil
+}
+
+// newTLSConfig returns the TLS configuration of the server, or nil if it serves plain HTTP.
+func newTLSConfig(options Options) (*tls.Config, error) {
+	if options.TLSCertFile == "" && options.TLSKeyFile == "" {
+		if options.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("client CA file %v is set without a server certificate", options.TLSClientCAFile)
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(options.TLSCertFile, options.TLSKeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load certificate %v and key %v", options.TLSCertFile, options.TLSKeyFile)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if options.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(options.TLSClientCAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read client CA file %v", options.TLSClientCAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client CA file %v", options.TLSClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// authenticate rejects the requests without `Authorization: Bearer <token>`, unless token is empty.
+func authenticate(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, bearerPrefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, bearerPrefix)), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="longhorn"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/api"
+)
+
+const (
+	// chunkSize is the largest read or write sent to the volume at once
+	chunkSize = 1 << 20
+	// maxUnmapLength is the largest unmap sent to the volume at once, which takes a 32-bit length
+	maxUnmapLength = 1 << 30
+)
+
+var errMultipleRanges = errors.New("multiple ranges are not supported")
+
+// GetData streams the volume, or the single range of the Range header.
+func (s *Server) GetData(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	if s.getVolume(apiContext, mux.Vars(req)["id"]) == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	size := s.d.getSize()
+	offset, length, ranged, err := parseRange(req.Header.Get("Range"), size)
+	if err != nil {
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(rw, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+
+	rw.Header().Set("Accept-Ranges", "bytes")
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if ranged {
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		status = http.StatusPartialContent
+	}
+	rw.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
+	buf := make([]byte, min(length, chunkSize))
+	for length > 0 {
+		n := min(length, chunkSize)
+		if _, err := s.d.readAt(buf[:n], offset); err != nil {
+			// The status is sent already, so abort the response to tell the client it is incomplete.
+			log.WithError(err).Errorf("Failed to read %v bytes at offset %v", n, offset)
+			panic(http.ErrAbortHandler)
+		}
+		if _, err := rw.Write(buf[:n]); err != nil {
+			return nil
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// PutData writes the body to the volume at the offset of the query, 0 by default, and flushes it.
+func (s *Server) PutData(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	if s.getVolume(apiContext, mux.Vars(req)["id"]) == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	size := s.d.getSize()
+	var offset int64
+	if value := req.URL.Query().Get("offset"); value != "" {
+		var err error
+		if offset, err = strconv.ParseInt(value, 10, 64); err != nil || offset < 0 || offset > size {
+			http.Error(rw, fmt.Sprintf("invalid offset %v for volume size %v", value, size), http.StatusBadRequest)
+			return nil
+		}
+	}
+	if req.ContentLength > size-offset {
+		http.Error(rw, fmt.Sprintf("%v bytes at offset %v are beyond volume size %v", req.ContentLength, offset, size),
+			http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	body := http.MaxBytesReader(rw, req.Body, size-offset)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if _, err := s.d.writeAt(buf[:n], offset); err != nil {
+				return errors.Wrapf(err, "failed to write %v bytes at offset %v", n, offset)
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(rw, fmt.Sprintf("body is beyond volume size %v, written up to offset %v", size, offset),
+				http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read body")
+		}
+	}
+
+	if err := s.d.flush(); err != nil {
+		return errors.Wrap(err, "failed to flush")
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// DeleteData unmaps the range of the Range header. The unmapped range may not read back as zeros.
+func (s *Server) DeleteData(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	if s.getVolume(apiContext, mux.Vars(req)["id"]) == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	header := req.Header.Get("Range")
+	if header == "" {
+		http.Error(rw, "a Range header is required", http.StatusBadRequest)
+		return nil
+	}
+	size := s.d.getSize()
+	offset, length, _, err := parseRange(header, size)
+	if err != nil {
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(rw, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+
+	for length > 0 {
+		n := min(length, maxUnmapLength)
+		if _, err := s.d.unmapAt(uint32(n), offset); err != nil {
+			return errors.Wrapf(err, "failed to unmap %v bytes at offset %v", n, offset)
+		}
+		offset += n
+		length -= n
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// parseRange returns the range of a Range header of a single byte range, e.g. `bytes=0-511`, `bytes=512-` or
+// `bytes=-512`. An empty header is the whole volume, and ranged is false then.
+func parseRange(header string, size int64) (offset, length int64, ranged bool, err error) {
+	if header == "" {
+		return 0, size, false, nil
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false, fmt.Errorf("invalid range %v", header)
+	}
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, errMultipleRanges
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false, fmt.Errorf("invalid range %v", header)
+	}
+
+	if first == "" {
+		// The suffix range is the last bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false, fmt.Errorf("invalid range %v for volume size %v", header, size)
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range %v for volume size %v", header, size)
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, fmt.Errorf("invalid range %v", header)
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, nil
+}
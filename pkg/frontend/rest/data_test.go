@@ -0,0 +1,49 @@
+package rest
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestParseRange(c *C) {
+	const size = 1000
+	for _, t := range []struct {
+		header         string
+		offset, length int64
+		ranged         bool
+		err            string
+	}{
+		{"", 0, size, false, ""},
+		{"bytes=0-511", 0, 512, true, ""},
+		{"bytes=512-", 512, 488, true, ""},
+		{"bytes=-100", 900, 100, true, ""},
+		{"bytes= 10-19", 10, 10, true, ""},
+		// The end and the suffix are cut at the end of the volume.
+		{"bytes=990-2000", 990, 10, true, ""},
+		{"bytes=-5000", 0, size, true, ""},
+		{"bytes=999-999", 999, 1, true, ""},
+
+		{"bytes=1000-", 0, 0, false, "invalid range .* for volume size 1000"},
+		{"bytes=1000-1001", 0, 0, false, "invalid range .* for volume size 1000"},
+		{"bytes=-1-5", 0, 0, false, "invalid range .*"},
+		{"bytes=-0", 0, 0, false, "invalid range .* for volume size 1000"},
+		{"bytes=20-10", 0, 0, false, "invalid range bytes=20-10"},
+		{"bytes=a-b", 0, 0, false, "invalid range .*"},
+		{"bytes=10", 0, 0, false, "invalid range bytes=10"},
+		{"items=0-1", 0, 0, false, "invalid range items=0-1"},
+		{"bytes=0-1,4-5", 0, 0, false, errMultipleRanges.Error()},
+		{"bytes=9223372036854775807-", 0, 0, false, "invalid range .*"},
+	} {
+		offset, length, ranged, err := parseRange(t.header, size)
+		if t.err != "" {
+			c.Assert(err, ErrorMatches, t.err, Commentf(t.header))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf(t.header))
+		c.Assert([]int64{offset, length}, DeepEquals, []int64{t.offset, t.length}, Commentf(t.header))
+		c.Assert(ranged, Equals, t.ranged, Commentf(t.header))
+	}
+
+	// An empty volume has no suffix range.
+	_, _, _, err := parseRange("bytes=-1", 0)
+	c.Assert(err, NotNil)
+}
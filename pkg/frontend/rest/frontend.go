@@ -1,35 +1,73 @@
 package rest
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	iscsiutil "github.com/longhorn/go-iscsi-helper/util"
+
 	"github.com/longhorn/longhorn-engine/pkg/types"
 )
 
 const (
 	frontendName = "rest"
+
+	DefaultListenAddress = "localhost:9414"
+
+	// shutdownTimeout is how long Shutdown waits for the requests in flight before it closes their connections
+	shutdownTimeout = 30 * time.Second
 )
 
 var (
 	log = logrus.WithFields(logrus.Fields{"pkg": "rest-frontend"})
+
+	errVolumeDown = errors.New("volume is down")
 )
 
+// Options are the settings of the rest frontend.
+type Options struct {
+	// ListenAddress is the address the server listens on, DefaultListenAddress by default. Unless it is a loopback
+	// address, TokenFile or TLSClientCAFile must be set.
+	ListenAddress string
+	// TokenFile is a file holding the token the clients must send as `Authorization: Bearer <token>`
+	TokenFile string
+	// TLSCertFile and TLSKeyFile make the server serve HTTPS
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile makes the server require client certificates signed by these CAs
+	TLSClientCAFile string
+}
+
 type Device struct {
 	Name       string
 	Size       int64
 	SectorSize int64
 
+	options Options
 	isUp    bool
+
+	// lock guards backend, Size, server and addr. The handlers hold it for reading while they use the backend.
+	lock    sync.RWMutex
 	backend types.ReaderWriterUnmapperAt
+	server  *http.Server
+	addr    net.Addr
 }
 
-func New() types.Frontend {
-	return &Device{}
+func New(options Options) types.Frontend {
+	if options.ListenAddress == "" {
+		options.ListenAddress = DefaultListenAddress
+	}
+	return &Device{options: options}
 }
 
 func (d *Device) FrontendName() string {
@@ -44,8 +82,7 @@ func (d *Device) Init(name string, size, sectorSize int64) error {
 }
 
 func (d *Device) Startup(rwu types.ReaderWriterUnmapperAt) error {
-	d.backend = rwu
-	if err := d.start(); err != nil {
+	if err := d.start(rwu); err != nil {
 		return err
 	}
 
@@ -57,24 +94,93 @@ func (d *Device) Shutdown() error {
 	return d.stop()
 }
 
-func (d *Device) start() error {
-	listen := "localhost:9414"
+func (d *Device) start(rwu types.ReaderWriterUnmapperAt) error {
+	if err := CheckListenAddress(d.options); err != nil {
+		return err
+	}
+	token, err := loadToken(d.options.TokenFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(d.options)
+	if err != nil {
+		return err
+	}
+
 	server := NewServer(d)
 	router := http.Handler(NewRouter(server))
+	router = authenticate(token, router)
+	if tlsConfig != nil {
+		router = httpsLinks(router)
+	}
 	router = handlers.LoggingHandler(os.Stdout, router)
 	router = handlers.ProxyHeaders(router)
 
-	log.Infof("Rest Frontend listening on %s", listen)
+	listener, err := net.Listen("tcp", d.options.ListenAddress)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %v", d.options.ListenAddress)
+	}
+	httpServer := &http.Server{
+		Handler:           router,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	d.lock.Lock()
+	d.backend = rwu
+	d.server = httpServer
+	d.addr = listener.Addr()
+	d.lock.Unlock()
+
+	log.Infof("Rest Frontend listening on %s", listener.Addr())
 
 	go func() {
-		if err := http.ListenAndServe(listen, router); err != nil {
-			logrus.WithError(err).Warn("Failed to start Rest Frontend server")
+		var err error
+		if tlsConfig != nil {
+			err = httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = httpServer.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Warn("Failed to serve Rest Frontend")
 		}
 	}()
 	return nil
 }
 
+// httpsLinks makes the links of the API responses HTTPS ones. They are built from X-Forwarded-Proto, which only a
+// proxy in front of the server sets.
+func httpsLinks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
 func (d *Device) stop() error {
+	d.lock.RLock()
+	server := d.server
+	d.lock.RUnlock()
+
+	if server != nil {
+		log.Infof("Shutting down Rest Frontend of %v", d.Name)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("Failed to wait for the requests in flight, closing their connections")
+			_ = server.Close()
+		}
+	}
+
+	// Wait for the handlers still using the backend, so none reaches the volume once it is down.
+	d.lock.Lock()
+	d.backend = nil
+	d.server = nil
+	d.addr = nil
+	d.lock.Unlock()
+
 	d.isUp = false
 	return nil
 }
@@ -87,10 +193,30 @@ func (d *Device) State() types.State {
 }
 
 func (d *Device) Endpoint() string {
-	if d.isUp {
-		return "http://localhost:9414"
+	if !d.isUp {
+		return ""
+	}
+	d.lock.RLock()
+	addr, ok := d.addr.(*net.TCPAddr)
+	d.lock.RUnlock()
+	if !ok {
+		return ""
+	}
+
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		ip, err := iscsiutil.GetIPToHost()
+		if err != nil {
+			log.WithError(err).Warn("Failed to get the IP of the host for the Rest Frontend endpoint")
+			return ""
+		}
+		host = ip
+	}
+	scheme := "http"
+	if d.options.TLSCertFile != "" {
+		scheme = "https"
 	}
-	return ""
+	return fmt.Sprintf("%v://%v", scheme, net.JoinHostPort(host, strconv.Itoa(addr.Port)))
 }
 
 func (d *Device) Upgrade(name string, size, sectorSize int64, rwu types.ReaderWriterUnmapperAt) error {
@@ -98,5 +224,53 @@ func (d *Device) Upgrade(name string, size, sectorSize int64, rwu types.ReaderWr
 }
 
 func (d *Device) Expand(size int64) error {
-	return fmt.Errorf("expand is not supported")
+	d.lock.Lock()
+	d.Size = size
+	d.lock.Unlock()
+	return nil
+}
+
+func (d *Device) getSize() int64 {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.Size
+}
+
+func (d *Device) readAt(buf []byte, offset int64) (int, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.backend == nil {
+		return 0, errVolumeDown
+	}
+	return d.backend.ReadAt(buf, offset)
+}
+
+func (d *Device) writeAt(buf []byte, offset int64) (int, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.backend == nil {
+		return 0, errVolumeDown
+	}
+	return d.backend.WriteAt(buf, offset)
+}
+
+func (d *Device) unmapAt(length uint32, offset int64) (int, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.backend == nil {
+		return 0, errVolumeDown
+	}
+	return d.backend.UnmapAt(length, offset)
+}
+
+func (d *Device) flush() error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.backend == nil {
+		return errVolumeDown
+	}
+	if flusher, ok := d.backend.(types.Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
 }
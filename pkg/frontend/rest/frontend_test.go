@@ -0,0 +1,376 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/mem"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	testVolumeSize = 4 << 20
+	testToken      = "secret-token"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+// testDevice is a rest frontend serving an in-memory replica on a loopback address.
+type testDevice struct {
+	c       *C
+	d       *Device
+	replica *mem.Replica
+	client  *http.Client
+	token   string
+	url     string
+}
+
+func startTestDevice(c *C, options Options) *testDevice {
+	r, err := mem.New().AddReplica("r", testVolumeSize)
+	c.Assert(err, IsNil)
+	options.ListenAddress = "127.0.0.1:0"
+	d := New(options).(*Device)
+	c.Assert(d.Init("test", testVolumeSize, 512), IsNil)
+	c.Assert(d.Startup(r), IsNil)
+	return &testDevice{
+		c:       c,
+		d:       d,
+		replica: r,
+		client:  &http.Client{},
+		url:     d.Endpoint() + "/v1/volumes/" + EncodeID("test"),
+	}
+}
+
+func (t *testDevice) do(method, path string, header map[string]string, body []byte) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, t.url+path, bytes.NewReader(body))
+	t.c.Assert(err, IsNil)
+	if t.token != "" {
+		req.Header.Set("Authorization", bearerPrefix+t.token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	t.c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	t.c.Assert(err, IsNil)
+	return resp, data
+}
+
+func (t *testDevice) action(action string, input interface{}) (*http.Response, []byte) {
+	body, err := json.Marshal(input)
+	t.c.Assert(err, IsNil)
+	return t.do(http.MethodPost, "?action="+action, map[string]string{"Content-Type": "application/json"}, body)
+}
+
+func (t *testDevice) readReplica(offset int64, length int) []byte {
+	buf := make([]byte, length)
+	_, err := t.replica.ReadAt(buf, offset)
+	t.c.Assert(err, IsNil)
+	return buf
+}
+
+func writeFile(c *C, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	c.Assert(os.WriteFile(path, []byte(content), 0600), IsNil)
+	return path
+}
+
+func (s *TestSuite) TestData(c *C) {
+	t := startTestDevice(c, Options{})
+	defer t.d.Shutdown()
+	c.Assert(t.d.Endpoint(), Matches, `http://127\.0\.0\.1:\d+`)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	resp, _ := t.do(http.MethodPut, "/data?offset=4096", nil, data)
+	c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	c.Assert(t.readReplica(4096, len(data)), DeepEquals, data)
+
+	resp, body := t.do(http.MethodGet, "/data", nil, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Accept-Ranges"), Equals, "bytes")
+	c.Assert(body, HasLen, testVolumeSize)
+	c.Assert(body[4096:4096+len(data)], DeepEquals, data)
+
+	resp, body = t.do(http.MethodGet, "/data", map[string]string{"Range": "bytes=4100-4115"}, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusPartialContent)
+	c.Assert(resp.Header.Get("Content-Range"), Equals, fmt.Sprintf("bytes 4100-4115/%d", testVolumeSize))
+	c.Assert(string(body), Equals, "456789abcdef0123")
+	resp, body = t.do(http.MethodHead, "/data", map[string]string{"Range": "bytes=-512"}, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusPartialContent)
+	c.Assert(resp.ContentLength, Equals, int64(512))
+	c.Assert(body, HasLen, 0)
+
+	resp, _ = t.do(http.MethodDelete, "/data", map[string]string{"Range": "bytes=8192-16383"}, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	c.Assert(t.readReplica(8192, 8192), DeepEquals, make([]byte, 8192))
+	c.Assert(t.readReplica(4096, 4096), DeepEquals, data[:4096])
+
+	// The action API, with the data base64 encoded.
+	resp, _ = t.action("writeat", WriteInput{Offset: 512, Length: 5, Data: EncodeData([]byte("hello"))})
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(t.readReplica(512, 5)), Equals, "hello")
+	resp, body = t.action("readat", ReadInput{Offset: 512, Length: 5})
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	var output ReadOutput
+	c.Assert(json.Unmarshal(body, &output), IsNil)
+	c.Assert(output.Data, Equals, EncodeData([]byte("hello")))
+
+	t.url = strings.TrimSuffix(t.url, EncodeID("test")) + EncodeID("other")
+	resp, _ = t.do(http.MethodGet, "/data", nil, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *TestSuite) TestRangeBounds(c *C) {
+	t := startTestDevice(c, Options{})
+	defer t.d.Shutdown()
+
+	unsatisfiable := fmt.Sprintf("bytes */%d", testVolumeSize)
+	for _, header := range []string{
+		fmt.Sprintf("bytes=%d-", testVolumeSize),
+		"bytes=20-10",
+		"bytes=0-1,4-5",
+		"bytes=-0",
+	} {
+		resp, _ := t.do(http.MethodGet, "/data", map[string]string{"Range": header}, nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusRequestedRangeNotSatisfiable, Commentf(header))
+		c.Assert(resp.Header.Get("Content-Range"), Equals, unsatisfiable)
+		resp, _ = t.do(http.MethodDelete, "/data", map[string]string{"Range": header}, nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusRequestedRangeNotSatisfiable, Commentf(header))
+	}
+	// An unmap needs a range, the whole volume is not unmapped by mistake.
+	resp, _ := t.do(http.MethodDelete, "/data", nil, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	// A range past the end is cut at the end.
+	resp, body := t.do(http.MethodGet, "/data", map[string]string{"Range": fmt.Sprintf("bytes=%d-%d",
+		testVolumeSize-10, testVolumeSize+10)}, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusPartialContent)
+	c.Assert(body, HasLen, 10)
+
+	for _, offset := range []string{"-1", "x", fmt.Sprint(testVolumeSize + 1)} {
+		resp, _ = t.do(http.MethodPut, "/data?offset="+offset, nil, []byte("data"))
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest, Commentf(offset))
+	}
+	resp, _ = t.do(http.MethodPut, fmt.Sprintf("/data?offset=%d", testVolumeSize-2), nil, []byte("data"))
+	c.Assert(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(t.readReplica(testVolumeSize-2, 2), DeepEquals, make([]byte, 2))
+	// A body without a length is stopped at the end of the volume.
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%v/data?offset=%d", t.url, testVolumeSize-2),
+		io.MultiReader(strings.NewReader("data")))
+	c.Assert(err, IsNil)
+	req.ContentLength = -1
+	resp, err = t.client.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+
+	for _, input := range []ReadInput{
+		{Offset: -1, Length: 1},
+		{Offset: 0, Length: -1},
+		{Offset: testVolumeSize - 1, Length: 2},
+		{Offset: 0, Length: 1 << 40},
+		{Offset: 1 << 62, Length: 1 << 62},
+	} {
+		resp, _ = t.action("readat", input)
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest, Commentf("%+v", input))
+	}
+	resp, _ = t.action("writeat", WriteInput{Offset: testVolumeSize - 1, Length: 2, Data: EncodeData([]byte("ab"))})
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *TestSuite) TestVolumeDown(c *C) {
+	t := startTestDevice(c, Options{})
+	t.replica.SetState(types.ReplicaStateError)
+	resp, _ := t.do(http.MethodPut, "/data", nil, []byte("data"))
+	c.Assert(resp.StatusCode, Equals, http.StatusInternalServerError)
+	// The status is set before the data is read, so a failed read aborts the response rather than send an error.
+	resp, err := t.client.Get(t.url + "/data")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	c.Assert(err, NotNil)
+
+	c.Assert(t.d.Shutdown(), IsNil)
+	c.Assert(t.d.State(), Equals, types.StateDown)
+	c.Assert(t.d.Endpoint(), Equals, "")
+	_, err = t.d.readAt(make([]byte, 1), 0)
+	c.Assert(err, Equals, errVolumeDown)
+}
+
+func (s *TestSuite) TestTokenAuth(c *C) {
+	dir := c.MkDir()
+	t := startTestDevice(c, Options{TokenFile: writeFile(c, dir, "token", testToken+"\n")})
+	defer t.d.Shutdown()
+
+	for _, header := range []string{"", "Bearer", "Bearer ", "Bearer wrong", "Basic " + testToken,
+		"bearer " + testToken, "Bearer " + testToken + "x"} {
+		resp, _ := t.do(http.MethodGet, "/data", map[string]string{"Authorization": header,
+			"Range": "bytes=0-0"}, nil)
+		c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized, Commentf(header))
+		c.Assert(resp.Header.Get("WWW-Authenticate"), Equals, `Bearer realm="longhorn"`)
+	}
+	// A client without the token does not write either.
+	resp, _ := t.do(http.MethodPut, "/data", nil, []byte("data"))
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(t.readReplica(0, 4), DeepEquals, make([]byte, 4))
+
+	t.token = testToken
+	resp, _ = t.do(http.MethodPut, "/data", nil, []byte("data"))
+	c.Assert(resp.StatusCode, Equals, http.StatusNoContent)
+	c.Assert(string(t.readReplica(0, 4)), Equals, "data")
+
+	_, err := loadToken(writeFile(c, dir, "empty", " \n"))
+	c.Assert(err, ErrorMatches, "token file .* is empty")
+	_, err = loadToken(filepath.Join(dir, "missing"))
+	c.Assert(err, ErrorMatches, "failed to read token file .*")
+	token, err := loadToken("")
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "")
+
+	d := New(Options{ListenAddress: "127.0.0.1:0", TokenFile: filepath.Join(dir, "missing")})
+	c.Assert(d.Init("test", testVolumeSize, 512), IsNil)
+	c.Assert(d.Startup(t.replica), NotNil)
+	c.Assert(d.State(), Equals, types.StateDown)
+}
+
+// writeTestCertificate writes a certificate for 127.0.0.1 and its key, signed by parent or self-signed.
+func writeTestCertificate(c *C, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+	isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	certFile := writeFile(c, dir, name+".crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile := writeFile(c, dir, name+".key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return cert, key, certFile, keyFile
+}
+
+func (s *TestSuite) TestTLSClientAuth(c *C) {
+	dir := c.MkDir()
+	ca, caKey, caFile, _ := writeTestCertificate(c, dir, "ca", nil, nil, true)
+	_, _, certFile, keyFile := writeTestCertificate(c, dir, "server", ca, caKey, false)
+	_, _, clientCertFile, clientKeyFile := writeTestCertificate(c, dir, "client", ca, caKey, false)
+	_, _, otherCertFile, otherKeyFile := writeTestCertificate(c, dir, "other", nil, nil, false)
+
+	t := startTestDevice(c, Options{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: caFile})
+	defer t.d.Shutdown()
+	c.Assert(t.d.Endpoint(), Matches, `https://127\.0\.0\.1:\d+`)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	newClient := func(certFile, keyFile string) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			c.Assert(err, IsNil)
+			config.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+
+	// Without a certificate, or with one of another CA.
+	for _, client := range []*http.Client{newClient("", ""), newClient(otherCertFile, otherKeyFile)} {
+		resp, err := client.Get(t.url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		c.Assert(err, NotNil)
+	}
+
+	t.client = newClient(clientCertFile, clientKeyFile)
+	resp, body := t.do(http.MethodGet, "", nil, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	// The links of the API are HTTPS ones.
+	var volume Volume
+	c.Assert(json.Unmarshal(body, &volume), IsNil)
+	c.Assert(volume.Links["data"], Matches, `https://.*/data`)
+
+	for _, options := range []Options{
+		{TLSClientCAFile: caFile},
+		{TLSCertFile: certFile, TLSKeyFile: filepath.Join(dir, "missing")},
+		{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: keyFile},
+	} {
+		_, err := newTLSConfig(options)
+		c.Assert(err, NotNil, Commentf("%+v", options))
+	}
+}
+
+func (s *TestSuite) TestListenAddress(c *C) {
+	for _, t := range []struct {
+		options Options
+		err     string
+	}{
+		{Options{}, ""},
+		{Options{ListenAddress: "localhost:9414"}, ""},
+		{Options{ListenAddress: "127.0.0.1:9414"}, ""},
+		{Options{ListenAddress: "[::1]:9414"}, ""},
+		{Options{ListenAddress: "0.0.0.0:9414"}, "rest frontend listen address 0.0.0.0:9414 is not a loopback address.*"},
+		{Options{ListenAddress: ":9414"}, "rest frontend listen address :9414 is not a loopback address.*"},
+		{Options{ListenAddress: "10.0.0.1:9414"}, "rest frontend listen address 10.0.0.1:9414 is not a loopback address.*"},
+		{Options{ListenAddress: "0.0.0.0:9414", TokenFile: "token"}, ""},
+		{Options{ListenAddress: "0.0.0.0:9414", TLSClientCAFile: "ca.pem"}, ""},
+		// A server certificate alone does not tell who the clients are.
+		{Options{ListenAddress: "0.0.0.0:9414", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+			"rest frontend listen address .* is not a loopback address.*"},
+		{Options{ListenAddress: "9414"}, "invalid rest frontend listen address 9414.*"},
+	} {
+		err := CheckListenAddress(t.options)
+		if t.err == "" {
+			c.Assert(err, IsNil, Commentf("%+v", t.options))
+		} else {
+			c.Assert(err, ErrorMatches, t.err, Commentf("%+v", t.options))
+		}
+	}
+
+	r, err := mem.New().AddReplica("r", testVolumeSize)
+	c.Assert(err, IsNil)
+	d := New(Options{ListenAddress: "0.0.0.0:0"})
+	c.Assert(d.Init("test", testVolumeSize, 512), IsNil)
+	c.Assert(d.Startup(r), ErrorMatches, ".*is not a loopback address.*")
+	c.Assert(d.State(), Equals, types.StateDown)
+}
@@ -44,6 +44,9 @@ func NewVolume(context *api.ApiContext, name string) *Volume {
 		Name: name,
 	}
 
+	v.Links = map[string]string{
+		"data": context.UrlBuilder.Link(v.Resource, "data"),
+	}
 	v.Actions["readat"] = context.UrlBuilder.ActionLink(v.Resource, "readat")
 	v.Actions["writeat"] = context.UrlBuilder.ActionLink(v.Resource, "writeat")
 	return v
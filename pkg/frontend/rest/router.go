@@ -33,6 +33,9 @@ func NewRouter(s *Server) *mux.Router {
 	router.Methods("GET").Path("/v1/volumes/{id}").Handler(f(schemas, s.GetVolume))
 	router.Methods("POST").Path("/v1/volumes/{id}").Queries("action", "readat").Handler(f(schemas, s.ReadAt))
 	router.Methods("POST").Path("/v1/volumes/{id}").Queries("action", "writeat").Handler(f(schemas, s.WriteAt))
+	router.Methods("GET", "HEAD").Path("/v1/volumes/{id}/data").Handler(f(schemas, s.GetData))
+	router.Methods("PUT").Path("/v1/volumes/{id}/data").Handler(f(schemas, s.PutData))
+	router.Methods("DELETE").Path("/v1/volumes/{id}/data").Handler(f(schemas, s.DeleteData))
 
 	return router
 }
@@ -49,9 +49,12 @@ func (s *Server) ReadAt(rw http.ResponseWriter, req *http.Request) error {
 	if err := apiContext.Read(&input); err != nil {
 		return err
 	}
+	if !s.inVolume(rw, input.Offset, input.Length) {
+		return nil
+	}
 
 	buf := make([]byte, input.Length)
-	_, err := s.d.backend.ReadAt(buf, input.Offset)
+	_, err := s.d.readAt(buf, input.Offset)
 	if err != nil {
 		log.Errorln("read failed: ", err.Error())
 		return errors.Wrap(err, "read failed")
@@ -90,8 +93,11 @@ func (s *Server) WriteAt(rw http.ResponseWriter, req *http.Request) error {
 	if len(buf) != input.Length {
 		return fmt.Errorf("inconsistent length in request")
 	}
+	if !s.inVolume(rw, input.Offset, int64(input.Length)) {
+		return nil
+	}
 
-	if _, err := s.d.backend.WriteAt(buf, input.Offset); err != nil {
+	if _, err := s.d.writeAt(buf, input.Offset); err != nil {
 		log.Errorln("write failed: ", err.Error())
 		return err
 	}
@@ -103,6 +109,17 @@ func (s *Server) WriteAt(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// inVolume tells whether length bytes at offset are within the volume, and fails the request if they are not.
+func (s *Server) inVolume(rw http.ResponseWriter, offset, length int64) bool {
+	size := s.d.getSize()
+	if offset < 0 || length < 0 || length > size-offset {
+		http.Error(rw, fmt.Sprintf("%v bytes at offset %v are beyond volume size %v", length, offset, size),
+			http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
 func (s *Server) listVolumes(context *api.ApiContext) []*Volume {
 	return []*Volume{
 		NewVolume(context, s.d.Name),
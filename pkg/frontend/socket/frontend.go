@@ -12,6 +12,7 @@ import (
 
 	"github.com/longhorn/longhorn-engine/pkg/dataconn"
 	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
 )
 
 const (
@@ -172,6 +173,10 @@ func (d DataProcessorWrapper) UnmapAt(length uint32, off int64) (n int, err erro
 	return d.rwu.UnmapAt(length, off)
 }
 
+func (d DataProcessorWrapper) WriteZeroesAt(length uint32, off int64) (n int, err error) {
+	return util.WriteZeroesAt(d.rwu, length, off)
+}
+
 func (d DataProcessorWrapper) PingResponse() error {
 	return nil
 }
@@ -0,0 +1,252 @@
+package vhostblk
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+var le = binary.LittleEndian
+
+const (
+	// Sectors of virtio-blk requests are always 512 bytes, whatever the block size of the device
+	sectorSize = 512
+
+	blkTypeIn          = 0
+	blkTypeOut         = 1
+	blkTypeFlush       = 4
+	blkTypeGetID       = 8
+	blkTypeDiscard     = 11
+	blkTypeWriteZeroes = 13
+
+	blkStatusOK     = 0
+	blkStatusIOErr  = 1
+	blkStatusUnsupp = 2
+
+	blkHeaderSize  = 16
+	blkSegmentSize = 16
+	blkIDBytes     = 20
+
+	blkWriteZeroesFlagUnmap = 1
+
+	// maxSegments is the number of data buffers a request may have, which the driver is told with seg_max
+	maxSegments = 126
+	// maxDiscardSectors and maxWriteZeroesSectors are 2GiB, as the lengths passed down are 32 bits
+	maxDiscardSectors     = 1 << 22
+	maxWriteZeroesSectors = 1 << 22
+
+	configSize = 60
+)
+
+// iovecs are the buffers of a request in the guest memory.
+type iovecs [][]byte
+
+func (v iovecs) size() int {
+	size := 0
+	for _, b := range v {
+		size += len(b)
+	}
+	return size
+}
+
+// slice returns the n bytes after the first skip bytes, as a single buffer if they are contiguous.
+func (v iovecs) slice(skip, n int) (iovecs, bool) {
+	var out iovecs
+	for _, b := range v {
+		if n == 0 {
+			break
+		}
+		if skip >= len(b) {
+			skip -= len(b)
+			continue
+		}
+		b = b[skip:]
+		skip = 0
+		if len(b) > n {
+			b = b[:n]
+		}
+		out = append(out, b)
+		n -= len(b)
+	}
+	return out, n == 0
+}
+
+// gather copies the n bytes after the first skip bytes out of the buffers.
+func (v iovecs) gather(skip, n int) ([]byte, bool) {
+	bufs, ok := v.slice(skip, n)
+	if !ok {
+		return nil, false
+	}
+	if len(bufs) == 1 {
+		return bufs[0], true
+	}
+	data := make([]byte, 0, n)
+	for _, b := range bufs {
+		data = append(data, b...)
+	}
+	return data, true
+}
+
+// scatter copies data into the buffers, after the first skip bytes.
+func (v iovecs) scatter(skip int, data []byte) bool {
+	bufs, ok := v.slice(skip, len(data))
+	if !ok {
+		return false
+	}
+	for _, b := range bufs {
+		data = data[copy(b, data):]
+	}
+	return true
+}
+
+// blkRequest is a virtio-blk request. The header is in the readable buffers, followed by the data of writes and the
+// segments of discards and write zeroes. The data of reads is in the writable buffers, followed by the status byte.
+type blkRequest struct {
+	typ    uint32
+	sector uint64
+	in     iovecs
+	// out excludes the status byte
+	out    iovecs
+	status []byte
+}
+
+// handleRequest handles a request of a queue and returns the number of bytes written to its writable buffers.
+func (f *VhostUserBlk) handleRequest(c *descChain) uint32 {
+	statusBuf, ok := c.writable.slice(c.writable.size()-1, 1)
+	if c.writable.size() == 0 || !ok {
+		logrus.Warnf("Dropping virtio-blk request without status byte on volume %v", f.Volume)
+		return 0
+	}
+	header, ok := c.readable.gather(0, blkHeaderSize)
+	if !ok {
+		statusBuf[0][0] = blkStatusIOErr
+		return 1
+	}
+	in, _ := c.readable.slice(blkHeaderSize, c.readable.size()-blkHeaderSize)
+	out, _ := c.writable.slice(0, c.writable.size()-1)
+	req := &blkRequest{
+		typ:    le.Uint32(header),
+		sector: le.Uint64(header[8:]),
+		in:     in,
+		out:    out,
+		status: statusBuf[0],
+	}
+
+	written, err := f.handleBlkRequest(req)
+	switch {
+	case err == errUnsupported:
+		req.status[0] = blkStatusUnsupp
+	case err != nil:
+		logrus.WithError(err).Errorf("Failed virtio-blk request of type %v at sector %v on volume %v", req.typ, req.sector, f.Volume)
+		req.status[0] = blkStatusIOErr
+	default:
+		req.status[0] = blkStatusOK
+	}
+	return uint32(written) + 1
+}
+
+var errUnsupported = fmt.Errorf("unsupported request")
+
+func (f *VhostUserBlk) handleBlkRequest(req *blkRequest) (int, error) {
+	rwu := f.rwu
+	switch req.typ {
+	case blkTypeIn:
+		off, err := f.checkRange(req.sector, uint64(req.out.size()))
+		if err != nil {
+			return 0, err
+		}
+		if len(req.out) == 1 {
+			return rwu.ReadAt(req.out[0], off)
+		}
+		buf := make([]byte, req.out.size())
+		n, err := rwu.ReadAt(buf, off)
+		req.out.scatter(0, buf[:n])
+		return n, err
+	case blkTypeOut:
+		off, err := f.checkRange(req.sector, uint64(req.in.size()))
+		if err != nil {
+			return 0, err
+		}
+		data, _ := req.in.gather(0, req.in.size())
+		_, err = rwu.WriteAt(data, off)
+		return 0, err
+	case blkTypeFlush:
+		if flusher, ok := rwu.(types.Flusher); ok {
+			return 0, flusher.Flush()
+		}
+		return 0, nil
+	case blkTypeGetID:
+		id := make([]byte, blkIDBytes)
+		copy(id, f.Volume)
+		n := min(len(id), req.out.size())
+		req.out.scatter(0, id[:n])
+		return n, nil
+	case blkTypeDiscard, blkTypeWriteZeroes:
+		return 0, f.handleSegments(req)
+	}
+	return 0, errUnsupported
+}
+
+// handleSegments handles the segments of a discard or write zeroes request.
+func (f *VhostUserBlk) handleSegments(req *blkRequest) error {
+	size := req.in.size()
+	if size == 0 || size%blkSegmentSize != 0 {
+		return fmt.Errorf("invalid segments of %v bytes", size)
+	}
+	segments, _ := req.in.gather(0, size)
+	for ; len(segments) > 0; segments = segments[blkSegmentSize:] {
+		sector, count, flags := le.Uint64(segments), le.Uint32(segments[8:]), le.Uint32(segments[12:])
+		off, err := f.checkRange(sector, uint64(count)*sectorSize)
+		if err != nil {
+			return err
+		}
+		length := uint32(uint64(count) * sectorSize)
+		if req.typ == blkTypeDiscard {
+			if count > maxDiscardSectors || flags != 0 {
+				return fmt.Errorf("invalid discard of %v sectors with flags 0x%x", count, flags)
+			}
+			_, err = f.rwu.UnmapAt(length, off)
+		} else {
+			if count > maxWriteZeroesSectors || flags&^blkWriteZeroesFlagUnmap != 0 {
+				return fmt.Errorf("invalid write zeroes of %v sectors with flags 0x%x", count, flags)
+			}
+			_, err = util.WriteZeroesAt(f.rwu, length, off)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *VhostUserBlk) checkRange(sector, length uint64) (int64, error) {
+	if sector > uint64(f.Size)/sectorSize || length > uint64(f.Size)-sector*sectorSize {
+		return 0, fmt.Errorf("%v bytes at sector %v are beyond volume size %v", length, sector, f.Size)
+	}
+	return int64(sector * sectorSize), nil
+}
+
+// config returns the configuration space of the device.
+func (f *VhostUserBlk) config(numQueues int) []byte {
+	blockSize := uint32(f.SectorSize)
+	if blockSize < sectorSize {
+		blockSize = sectorSize
+	}
+
+	config := make([]byte, configSize)
+	le.PutUint64(config[0:], uint64(f.Size)/sectorSize)
+	le.PutUint32(config[12:], maxSegments)
+	le.PutUint32(config[20:], blockSize)
+	le.PutUint16(config[34:], uint16(numQueues))
+	le.PutUint32(config[36:], maxDiscardSectors)
+	le.PutUint32(config[40:], 1)
+	le.PutUint32(config[44:], blockSize/sectorSize)
+	le.PutUint32(config[48:], maxWriteZeroesSectors)
+	le.PutUint32(config[52:], 1)
+	config[56] = 1
+	return config
+}
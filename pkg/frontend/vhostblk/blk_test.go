@@ -0,0 +1,178 @@
+package vhostblk
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) TestIovecs(c *C) {
+	v := iovecs{[]byte("abc"), []byte("defg"), []byte("h")}
+	c.Assert(v.size(), Equals, 8)
+
+	bufs, ok := v.slice(2, 3)
+	c.Assert(ok, Equals, true)
+	c.Assert(bufs, DeepEquals, iovecs{[]byte("c"), []byte("de")})
+	_, ok = v.slice(6, 3)
+	c.Assert(ok, Equals, false)
+
+	data, ok := v.gather(1, 6)
+	c.Assert(ok, Equals, true)
+	c.Assert(string(data), Equals, "bcdefg")
+	// A contiguous range is not copied.
+	data, ok = v.gather(3, 4)
+	c.Assert(ok, Equals, true)
+	c.Assert(&data[0], Equals, &v[1][0])
+
+	c.Assert(v.scatter(2, []byte("XYZ")), Equals, true)
+	c.Assert(string(v[0])+string(v[1]), Equals, "abXYZfg")
+	c.Assert(v.scatter(7, []byte("XY")), Equals, false)
+}
+
+// testRing lays descriptor tables out in a guest memory region of its own, without mapping a file.
+type testRing struct {
+	mem  *memoryTable
+	data []byte
+	q    *virtqueue
+}
+
+const (
+	testRingGuestAddr = 0x10000
+	testRingUserAddr  = 0x7f0000000000
+)
+
+func newTestRing(c *C, num uint16) *testRing {
+	data := make([]byte, 64<<10)
+	r := &testRing{
+		mem: &memoryTable{regions: []memoryRegion{{guestAddr: testRingGuestAddr, userAddr: testRingUserAddr,
+			size: uint64(len(data)), data: data}}},
+		data: data,
+		q:    newVirtqueue(0),
+	}
+	r.q.num = num
+	r.q.descAddr = testRingUserAddr
+	r.q.availAddr = testRingUserAddr + 0x1000
+	r.q.usedAddr = testRingUserAddr + 0x2000
+	c.Assert(r.q.mapRings(r.mem), IsNil)
+	return r
+}
+
+func putDesc(table []byte, i int, addr uint64, length uint32, flags, next uint16) {
+	d := table[i*descSize:]
+	le.PutUint64(d, addr)
+	le.PutUint32(d[8:], length)
+	le.PutUint16(d[12:], flags)
+	le.PutUint16(d[14:], next)
+}
+
+func (s *TestSuite) TestChain(c *C) {
+	r := newTestRing(c, 8)
+
+	// A header, two data buffers and a status byte, out of order in the table.
+	putDesc(r.q.desc, 0, testRingGuestAddr+0x4000, blkHeaderSize, descFlagNext, 3)
+	putDesc(r.q.desc, 3, testRingGuestAddr+0x5000, 512, descFlagNext|descFlagWrite, 1)
+	putDesc(r.q.desc, 1, testRingGuestAddr+0x6000, 1024, descFlagNext|descFlagWrite, 2)
+	putDesc(r.q.desc, 2, testRingGuestAddr+0x7000, 1, descFlagWrite, 0)
+	chain, err := r.q.chain(r.mem, 0)
+	c.Assert(err, IsNil)
+	c.Assert(chain.head, Equals, uint16(0))
+	c.Assert(chain.readable, HasLen, 1)
+	c.Assert(&chain.readable[0][0], Equals, &r.data[0x4000])
+	c.Assert(chain.writable, HasLen, 3)
+	c.Assert(chain.writable.size(), Equals, 1537)
+	c.Assert(&chain.writable[2][0], Equals, &r.data[0x7000])
+
+	// The same request through an indirect table.
+	indirect := r.data[0x8000:]
+	putDesc(indirect, 0, testRingGuestAddr+0x4000, blkHeaderSize, descFlagNext, 1)
+	putDesc(indirect, 1, testRingGuestAddr+0x5000, 512, descFlagNext|descFlagWrite, 2)
+	putDesc(indirect, 2, testRingGuestAddr+0x7000, 1, descFlagWrite, 0)
+	putDesc(r.q.desc, 4, testRingGuestAddr+0x8000, 3*descSize, descFlagIndirect, 0)
+	chain, err = r.q.chain(r.mem, 4)
+	c.Assert(err, IsNil)
+	c.Assert(chain.head, Equals, uint16(4))
+	c.Assert(chain.readable, HasLen, 1)
+	c.Assert(chain.writable.size(), Equals, 513)
+}
+
+func (s *TestSuite) TestChainInvalid(c *C) {
+	for _, t := range []struct {
+		comment string
+		setup   func(r *testRing)
+		err     string
+	}{
+		{"loop", func(r *testRing) {
+			putDesc(r.q.desc, 0, testRingGuestAddr, 1, descFlagNext, 1)
+			putDesc(r.q.desc, 1, testRingGuestAddr, 1, descFlagNext, 0)
+		}, ".*is too long.*"},
+		{"next out of the table", func(r *testRing) {
+			putDesc(r.q.desc, 0, testRingGuestAddr, 1, descFlagNext, 8)
+		}, ".*out of the table.*"},
+		{"unmapped buffer", func(r *testRing) {
+			putDesc(r.q.desc, 0, testRingGuestAddr+0xffff, 2, 0, 0)
+		}, ".*is not mapped.*"},
+		{"readable after writable", func(r *testRing) {
+			putDesc(r.q.desc, 0, testRingGuestAddr, 1, descFlagNext|descFlagWrite, 1)
+			putDesc(r.q.desc, 1, testRingGuestAddr, 1, 0, 0)
+		}, ".*readable descriptor after writable.*"},
+		{"nested indirect table", func(r *testRing) {
+			putDesc(r.data[0x8000:], 0, testRingGuestAddr+0x8000, descSize, descFlagIndirect, 0)
+			putDesc(r.q.desc, 0, testRingGuestAddr+0x8000, descSize, descFlagIndirect, 0)
+		}, ".*invalid indirect descriptor table.*"},
+		{"indirect table of partial descriptors", func(r *testRing) {
+			putDesc(r.q.desc, 0, testRingGuestAddr+0x8000, descSize+1, descFlagIndirect, 0)
+		}, ".*invalid indirect descriptor table.*"},
+	} {
+		r := newTestRing(c, 8)
+		t.setup(r)
+		_, err := r.q.chain(r.mem, 0)
+		c.Assert(err, ErrorMatches, t.err, Commentf(t.comment))
+	}
+}
+
+func (s *TestSuite) TestMapRingsInvalid(c *C) {
+	r := newTestRing(c, 8)
+	r.q.availAddr++
+	c.Assert(r.q.mapRings(r.mem), ErrorMatches, ".*misaligned.*")
+	r.q.availAddr--
+	r.q.usedAddr = testRingUserAddr + 64<<10 - 8
+	c.Assert(r.q.mapRings(r.mem), ErrorMatches, ".*is not mapped.*")
+}
+
+func (s *TestSuite) TestCheckRange(c *C) {
+	f := &VhostUserBlk{Volume: "test", Size: 1 << 20}
+	off, err := f.checkRange(2, 4096)
+	c.Assert(err, IsNil)
+	c.Assert(off, Equals, int64(1024))
+	_, err = f.checkRange(2047, 512)
+	c.Assert(err, IsNil)
+	_, err = f.checkRange(2047, 1024)
+	c.Assert(err, ErrorMatches, ".*beyond volume size.*")
+	_, err = f.checkRange(2049, 0)
+	c.Assert(err, ErrorMatches, ".*beyond volume size.*")
+	// A sector so large that its offset wraps around.
+	_, err = f.checkRange(1<<55, 512)
+	c.Assert(err, ErrorMatches, ".*beyond volume size.*")
+}
+
+func (s *TestSuite) TestConfig(c *C) {
+	f := &VhostUserBlk{Volume: "test", Size: 1 << 30, SectorSize: 4096}
+	config := f.config(maxQueues)
+	c.Assert(config, HasLen, configSize)
+	c.Assert(le.Uint64(config), Equals, uint64(1<<30/sectorSize))
+	c.Assert(le.Uint32(config[12:]), Equals, uint32(maxSegments))
+	c.Assert(le.Uint32(config[20:]), Equals, uint32(4096))
+	c.Assert(le.Uint16(config[34:]), Equals, uint16(maxQueues))
+	c.Assert(le.Uint32(config[44:]), Equals, uint32(8))
+
+	// The block size is never below the sector size.
+	f.SectorSize = 0
+	c.Assert(le.Uint32(f.config(1)[20:]), Equals, uint32(sectorSize))
+}
@@ -0,0 +1,174 @@
+package vhostblk
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	frontendName = "vhost-user-blk"
+
+	SocketDirectory = "/var/run"
+)
+
+func New() *VhostUserBlk {
+	return &VhostUserBlk{}
+}
+
+// VhostUserBlk serves the volume as a vhost-user-blk device on a UNIX socket. A vhost-user front-end, like QEMU with
+// a vhost-user-blk-pci device, connects to the socket and shares the guest memory, so the virtio-blk requests of the
+// guest are served straight from and into it. One front-end is served at a time.
+type VhostUserBlk struct {
+	Volume     string
+	Size       int64
+	SectorSize int
+
+	isUp       bool
+	socketPath string
+	rwu        types.ReaderWriterUnmapperAt
+
+	lock     sync.Mutex
+	listener *net.UnixListener
+	conn     *net.UnixConn
+	done     chan struct{}
+}
+
+func (f *VhostUserBlk) FrontendName() string {
+	return frontendName
+}
+
+func (f *VhostUserBlk) Init(name string, size, sectorSize int64) error {
+	f.Volume = name
+	f.Size = size
+	f.SectorSize = int(sectorSize)
+
+	return f.Shutdown()
+}
+
+func (f *VhostUserBlk) Startup(rwu types.ReaderWriterUnmapperAt) error {
+	socketPath := f.GetSocketPath()
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return errors.Wrapf(err, "cannot create directory %v", filepath.Dir(socketPath))
+	}
+	// Check and remove existing socket
+	if st, err := os.Stat(socketPath); err == nil && !st.IsDir() {
+		if err := os.Remove(socketPath); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %v", socketPath)
+	}
+
+	f.lock.Lock()
+	f.rwu = rwu
+	f.socketPath = socketPath
+	f.listener = listener
+	f.done = make(chan struct{})
+	f.lock.Unlock()
+
+	go f.serve(listener, f.done)
+
+	f.isUp = true
+
+	return nil
+}
+
+func (f *VhostUserBlk) Shutdown() error {
+	f.lock.Lock()
+	listener, conn, done := f.listener, f.conn, f.done
+	f.listener, f.conn, f.done = nil, nil, nil
+	f.lock.Unlock()
+
+	if listener != nil {
+		logrus.Infof("Shutting down vhost-user-blk server for %v", f.Volume)
+		if err := listener.Close(); err != nil {
+			logrus.WithError(err).Warnf("Failed to close socket %v", f.socketPath)
+		}
+		if conn != nil {
+			_ = conn.Close()
+		}
+		// Wait for the requests in flight, so none reaches the volume once it is down.
+		<-done
+	}
+	f.isUp = false
+
+	return nil
+}
+
+func (f *VhostUserBlk) State() types.State {
+	if f.isUp {
+		return types.StateUp
+	}
+	return types.StateDown
+}
+
+func (f *VhostUserBlk) Endpoint() string {
+	if f.isUp {
+		return f.GetSocketPath()
+	}
+	return ""
+}
+
+func (f *VhostUserBlk) GetSocketPath() string {
+	if f.Volume == "" {
+		panic("Invalid volume name")
+	}
+	return filepath.Join(SocketDirectory, "longhorn-"+f.Volume+"-vhost-user-blk.sock")
+}
+
+// serve accepts the front-ends one after the other, until the listener is closed.
+func (f *VhostUserBlk) serve(listener *net.UnixListener, done chan struct{}) {
+	defer close(done)
+
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Errorf("Failed to accept vhost-user connection for %v", f.Volume)
+			}
+			return
+		}
+
+		f.lock.Lock()
+		if f.listener != listener {
+			f.lock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		f.conn = conn
+		f.lock.Unlock()
+
+		logrus.Infof("New vhost-user connection established for %v", f.Volume)
+		if err := newSession(conn, f).serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logrus.WithError(err).Errorf("Failed to serve vhost-user connection for %v", f.Volume)
+		} else {
+			logrus.Warnf("vhost-user connection for %v closed", f.Volume)
+		}
+		_ = conn.Close()
+
+		f.lock.Lock()
+		if f.conn == conn {
+			f.conn = nil
+		}
+		f.lock.Unlock()
+	}
+}
+
+func (f *VhostUserBlk) Upgrade(name string, size, sectorSize int64, rwu types.ReaderWriterUnmapperAt) error {
+	return fmt.Errorf("upgrade is not supported")
+}
+
+func (f *VhostUserBlk) Expand(size int64) error {
+	return fmt.Errorf("expand is not supported")
+}
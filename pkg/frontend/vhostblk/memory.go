@@ -0,0 +1,82 @@
+package vhostblk
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// memoryRegion is a region of the guest memory, shared by the front-end through a file descriptor.
+type memoryRegion struct {
+	guestAddr uint64
+	userAddr  uint64
+	size      uint64
+	mapping   []byte
+	// data is the region within the mapping
+	data []byte
+}
+
+// memoryTable maps the guest memory into the process. Descriptors address the memory by guest physical address,
+// the rings by the virtual address of the front-end.
+type memoryTable struct {
+	regions []memoryRegion
+}
+
+func newMemoryTable(payload []byte, fds []int) (*memoryTable, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("memory table of %v bytes is too short", len(payload))
+	}
+	count := int(le.Uint32(payload))
+	if count > maxMemoryRegions || len(payload) < 8+count*memoryRegionSize || len(fds) != count {
+		return nil, fmt.Errorf("invalid memory table of %v regions in %v bytes with %v file descriptors", count, len(payload), len(fds))
+	}
+
+	m := &memoryTable{}
+	for i := 0; i < count; i++ {
+		p := payload[8+i*memoryRegionSize:]
+		guestAddr, size, userAddr, offset := le.Uint64(p), le.Uint64(p[8:]), le.Uint64(p[16:]), le.Uint64(p[24:])
+		mapping, err := unix.Mmap(fds[i], 0, int(offset+size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			m.unmap()
+			return nil, errors.Wrapf(err, "failed to map memory region %v of %v bytes", i, size)
+		}
+		m.regions = append(m.regions, memoryRegion{
+			guestAddr: guestAddr,
+			userAddr:  userAddr,
+			size:      size,
+			mapping:   mapping,
+			data:      mapping[offset : offset+size],
+		})
+	}
+	return m, nil
+}
+
+func (m *memoryTable) unmap() {
+	for _, r := range m.regions {
+		_ = unix.Munmap(r.mapping)
+	}
+	m.regions = nil
+}
+
+// guest returns the memory at a guest physical address.
+func (m *memoryTable) guest(addr, length uint64) ([]byte, error) {
+	for _, r := range m.regions {
+		if addr >= r.guestAddr && addr-r.guestAddr < r.size && length <= r.size-(addr-r.guestAddr) {
+			start := addr - r.guestAddr
+			return r.data[start : start+length : start+length], nil
+		}
+	}
+	return nil, fmt.Errorf("guest address 0x%x of %v bytes is not mapped", addr, length)
+}
+
+// user returns the memory at a virtual address of the front-end.
+func (m *memoryTable) user(addr, length uint64) ([]byte, error) {
+	for _, r := range m.regions {
+		if addr >= r.userAddr && addr-r.userAddr < r.size && length <= r.size-(addr-r.userAddr) {
+			start := addr - r.userAddr
+			return r.data[start : start+length : start+length], nil
+		}
+	}
+	return nil, fmt.Errorf("front-end address 0x%x of %v bytes is not mapped", addr, length)
+}
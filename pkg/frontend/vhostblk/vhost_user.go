@@ -0,0 +1,427 @@
+package vhostblk
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	vhostUserHeaderSize = 12
+	// vhostUserMaxPayload bounds the payload of a message, the largest being the memory table
+	vhostUserMaxPayload = 4096
+	vhostUserMaxFds     = 8
+
+	vhostUserFlagVersion   = 0x1
+	vhostUserFlagReply     = 0x4
+	vhostUserFlagNeedReply = 0x8
+
+	vhostUserGetFeatures         = 1
+	vhostUserSetFeatures         = 2
+	vhostUserSetOwner            = 3
+	vhostUserResetOwner          = 4
+	vhostUserSetMemTable         = 5
+	vhostUserSetVringNum         = 8
+	vhostUserSetVringAddr        = 9
+	vhostUserSetVringBase        = 10
+	vhostUserGetVringBase        = 11
+	vhostUserSetVringKick        = 12
+	vhostUserSetVringCall        = 13
+	vhostUserSetVringErr         = 14
+	vhostUserGetProtocolFeatures = 15
+	vhostUserSetProtocolFeatures = 16
+	vhostUserGetQueueNum         = 17
+	vhostUserSetVringEnable      = 18
+	vhostUserGetConfig           = 24
+	vhostUserSetConfig           = 25
+
+	// vringNoFd is set in the index of SET_VRING_KICK and SET_VRING_CALL when no file descriptor is passed
+	vringNoFd      = 1 << 8
+	vringIndexMask = 0xff
+
+	featureBlkSegMax        = 1 << 2
+	featureBlkBlkSize       = 1 << 6
+	featureBlkFlush         = 1 << 9
+	featureBlkMQ            = 1 << 12
+	featureBlkDiscard       = 1 << 13
+	featureBlkWriteZeroes   = 1 << 14
+	featureRingIndirectDesc = 1 << 28
+	featureProtocolFeatures = 1 << 30
+	featureVersion1         = 1 << 32
+	deviceFeatures          = featureBlkSegMax | featureBlkBlkSize | featureBlkFlush | featureBlkMQ | featureBlkDiscard |
+		featureBlkWriteZeroes | featureRingIndirectDesc | featureProtocolFeatures | featureVersion1
+
+	protocolFeatureMQ       = 1 << 0
+	protocolFeatureReplyAck = 1 << 3
+	protocolFeatureConfig   = 1 << 9
+	protocolFeatures        = protocolFeatureMQ | protocolFeatureReplyAck | protocolFeatureConfig
+
+	maxMemoryRegions = 8
+	memoryRegionSize = 32
+
+	// maxQueues is the number of request queues offered to the driver
+	maxQueues    = 16
+	maxQueueSize = 32768
+)
+
+type vhostUserMessage struct {
+	request uint32
+	flags   uint32
+	payload []byte
+	fds     []int
+}
+
+func (m *vhostUserMessage) u64() (uint64, error) {
+	if len(m.payload) < 8 {
+		return 0, fmt.Errorf("payload of request %v is too short", m.request)
+	}
+	return le.Uint64(m.payload), nil
+}
+
+// vringState returns the index and number of a SET_VRING_NUM, SET_VRING_BASE, GET_VRING_BASE or SET_VRING_ENABLE.
+func (m *vhostUserMessage) vringState() (uint32, uint32, error) {
+	if len(m.payload) < 8 {
+		return 0, 0, fmt.Errorf("payload of request %v is too short", m.request)
+	}
+	return le.Uint32(m.payload), le.Uint32(m.payload[4:]), nil
+}
+
+func (m *vhostUserMessage) closeFds() {
+	for _, fd := range m.fds {
+		_ = unix.Close(fd)
+	}
+	m.fds = nil
+}
+
+// session is a connection of a vhost-user front-end, like QEMU, which owns the guest memory and drives the
+// virtqueues.
+type session struct {
+	conn     *net.UnixConn
+	frontend *VhostUserBlk
+	mem      *memoryTable
+	queues   []*virtqueue
+
+	features         uint64
+	protocolFeatures uint64
+}
+
+func newSession(conn *net.UnixConn, frontend *VhostUserBlk) *session {
+	s := &session{
+		conn:     conn,
+		frontend: frontend,
+	}
+	for i := 0; i < maxQueues; i++ {
+		s.queues = append(s.queues, newVirtqueue(i))
+	}
+	return s
+}
+
+// serve handles the messages of the front-end until it disconnects.
+func (s *session) serve() error {
+	defer s.close()
+
+	for {
+		msg, err := s.readMessage()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		reply, err := s.handleMessage(msg)
+		msg.closeFds()
+		if err != nil {
+			return errors.Wrapf(err, "failed to handle vhost-user request %v", msg.request)
+		}
+		if reply == nil && msg.flags&vhostUserFlagNeedReply != 0 && s.protocolFeatures&protocolFeatureReplyAck != 0 {
+			reply = make([]byte, 8)
+		}
+		if reply != nil {
+			if err := s.writeMessage(msg.request, reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *session) readMessage() (*vhostUserMessage, error) {
+	header := make([]byte, vhostUserHeaderSize)
+	oob := make([]byte, unix.CmsgSpace(vhostUserMaxFds*4))
+	n, oobn, _, _, err := s.conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	msg := &vhostUserMessage{}
+	if oobn > 0 {
+		cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		for _, cmsg := range cmsgs {
+			fds, err := unix.ParseUnixRights(&cmsg)
+			if err != nil {
+				msg.closeFds()
+				return nil, err
+			}
+			msg.fds = append(msg.fds, fds...)
+		}
+	}
+	if n < vhostUserHeaderSize {
+		if _, err := io.ReadFull(s.conn, header[n:]); err != nil {
+			msg.closeFds()
+			return nil, err
+		}
+	}
+
+	msg.request, msg.flags = le.Uint32(header), le.Uint32(header[4:])
+	size := le.Uint32(header[8:])
+	if size > vhostUserMaxPayload {
+		msg.closeFds()
+		return nil, fmt.Errorf("payload of %v bytes of request %v is too large", size, msg.request)
+	}
+	msg.payload = make([]byte, size)
+	if _, err := io.ReadFull(s.conn, msg.payload); err != nil {
+		msg.closeFds()
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *session) writeMessage(request uint32, payload []byte) error {
+	buf := make([]byte, vhostUserHeaderSize+len(payload))
+	le.PutUint32(buf, request)
+	le.PutUint32(buf[4:], vhostUserFlagVersion|vhostUserFlagReply)
+	le.PutUint32(buf[8:], uint32(len(payload)))
+	copy(buf[vhostUserHeaderSize:], payload)
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func u64Payload(v uint64) []byte {
+	payload := make([]byte, 8)
+	le.PutUint64(payload, v)
+	return payload
+}
+
+// handleMessage handles a message of the front-end and returns the payload of the reply, if any. The file
+// descriptors of the message are closed afterwards, unless they are taken.
+func (s *session) handleMessage(msg *vhostUserMessage) ([]byte, error) {
+	switch msg.request {
+	case vhostUserGetFeatures:
+		return u64Payload(deviceFeatures), nil
+	case vhostUserSetFeatures:
+		features, err := msg.u64()
+		if err != nil {
+			return nil, err
+		}
+		if features&^deviceFeatures != 0 {
+			return nil, fmt.Errorf("unsupported features 0x%x", features&^deviceFeatures)
+		}
+		s.features = features
+		return nil, nil
+	case vhostUserGetProtocolFeatures:
+		return u64Payload(protocolFeatures), nil
+	case vhostUserSetProtocolFeatures:
+		features, err := msg.u64()
+		if err != nil {
+			return nil, err
+		}
+		s.protocolFeatures = features & protocolFeatures
+		return nil, nil
+	case vhostUserGetQueueNum:
+		return u64Payload(maxQueues), nil
+	case vhostUserSetOwner:
+		return nil, nil
+	case vhostUserResetOwner:
+		s.stopQueues()
+		return nil, nil
+	case vhostUserSetMemTable:
+		return nil, s.setMemTable(msg)
+	case vhostUserGetConfig:
+		if len(msg.payload) < 12 {
+			return nil, fmt.Errorf("payload of request %v is too short", msg.request)
+		}
+		offset, size := le.Uint32(msg.payload), le.Uint32(msg.payload[4:])
+		config := s.frontend.config(maxQueues)
+		if uint64(offset)+uint64(size) > uint64(len(config)) || int(size) > len(msg.payload)-12 {
+			return nil, fmt.Errorf("invalid config space access of %v bytes at %v", size, offset)
+		}
+		reply := append([]byte(nil), msg.payload...)
+		copy(reply[12:], config[offset:offset+size])
+		return reply, nil
+	case vhostUserSetConfig:
+		// The configuration space is read-only.
+		return nil, nil
+	}
+
+	q, err := s.queue(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch msg.request {
+	case vhostUserSetVringNum:
+		_, num, _ := msg.vringState()
+		if num == 0 || num > maxQueueSize || num&(num-1) != 0 {
+			return nil, fmt.Errorf("invalid size %v of queue %v", num, q.index)
+		}
+		q.num = uint16(num)
+	case vhostUserSetVringAddr:
+		if len(msg.payload) < 40 {
+			return nil, fmt.Errorf("payload of request %v is too short", msg.request)
+		}
+		q.descAddr, q.usedAddr, q.availAddr = le.Uint64(msg.payload[8:]), le.Uint64(msg.payload[16:]), le.Uint64(msg.payload[24:])
+		if s.mem != nil {
+			if err := q.mapRings(s.mem); err != nil {
+				return nil, err
+			}
+		}
+	case vhostUserSetVringBase:
+		_, base, _ := msg.vringState()
+		q.lastAvail = uint16(base)
+	case vhostUserGetVringBase:
+		q.stop()
+		q.closeFds()
+		reply := make([]byte, 8)
+		le.PutUint32(reply, uint32(q.index))
+		le.PutUint32(reply[4:], uint32(q.lastAvail))
+		return reply, nil
+	case vhostUserSetVringKick:
+		fd, err := takeVringFd(msg)
+		if err != nil {
+			return nil, err
+		}
+		q.stop()
+		if q.kickFd >= 0 {
+			_ = unix.Close(q.kickFd)
+		}
+		q.kickFd = fd
+		if fd >= 0 {
+			if err := unix.SetNonblock(fd, true); err != nil {
+				return nil, err
+			}
+		}
+		if s.features&featureProtocolFeatures == 0 {
+			// Without protocol features, a ring starts enabled once it is kicked.
+			q.enabled = true
+		}
+		return nil, s.startQueue(q)
+	case vhostUserSetVringCall:
+		fd, err := takeVringFd(msg)
+		if err != nil {
+			return nil, err
+		}
+		q.setCallFd(fd)
+	case vhostUserSetVringErr:
+		// Errors are logged instead.
+	case vhostUserSetVringEnable:
+		_, enable, _ := msg.vringState()
+		q.enabled = enable != 0
+		if !q.enabled {
+			q.stop()
+			return nil, nil
+		}
+		return nil, s.startQueue(q)
+	default:
+		logrus.Warnf("Ignoring unsupported vhost-user request %v for volume %v", msg.request, s.frontend.Volume)
+	}
+	return nil, nil
+}
+
+// queue returns the queue a vring message is for.
+func (s *session) queue(msg *vhostUserMessage) (*virtqueue, error) {
+	if len(msg.payload) < 4 {
+		return nil, fmt.Errorf("payload of request %v is too short", msg.request)
+	}
+	index := int(le.Uint32(msg.payload))
+	if msg.request == vhostUserSetVringKick || msg.request == vhostUserSetVringCall || msg.request == vhostUserSetVringErr {
+		index &= vringIndexMask
+	}
+	if index >= len(s.queues) {
+		return nil, fmt.Errorf("queue %v does not exist", index)
+	}
+	return s.queues[index], nil
+}
+
+// takeVringFd takes the file descriptor of a SET_VRING_KICK or SET_VRING_CALL, or returns -1 if there is none.
+func takeVringFd(msg *vhostUserMessage) (int, error) {
+	index, err := msg.u64()
+	if err != nil {
+		return -1, err
+	}
+	if index&vringNoFd != 0 {
+		return -1, nil
+	}
+	if len(msg.fds) != 1 {
+		return -1, fmt.Errorf("request %v has %v file descriptors instead of one", msg.request, len(msg.fds))
+	}
+	fd := msg.fds[0]
+	msg.fds = nil
+	return fd, nil
+}
+
+// startQueue starts a queue once it has everything it needs to run.
+func (s *session) startQueue(q *virtqueue) error {
+	if q.running || !q.enabled || q.kickFd < 0 || s.mem == nil || q.used == nil {
+		return nil
+	}
+	return q.start(s)
+}
+
+func (s *session) setMemTable(msg *vhostUserMessage) error {
+	var running []*virtqueue
+	for _, q := range s.queues {
+		if q.running {
+			running = append(running, q)
+			q.stop()
+		}
+	}
+
+	mem, err := newMemoryTable(msg.payload, msg.fds)
+	if err != nil {
+		return err
+	}
+	if s.mem != nil {
+		s.mem.unmap()
+	}
+	s.mem = mem
+
+	for _, q := range s.queues {
+		if q.num == 0 || q.usedAddr == 0 {
+			continue
+		}
+		if err := q.mapRings(mem); err != nil {
+			return err
+		}
+	}
+	for _, q := range running {
+		if err := s.startQueue(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) stopQueues() {
+	for _, q := range s.queues {
+		q.stop()
+	}
+}
+
+func (s *session) close() {
+	s.stopQueues()
+	for _, q := range s.queues {
+		q.closeFds()
+	}
+	if s.mem != nil {
+		s.mem.unmap()
+		s.mem = nil
+	}
+}
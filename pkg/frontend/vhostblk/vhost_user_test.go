@@ -0,0 +1,450 @@
+package vhostblk
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/backend/mem"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+const (
+	testVolumeSize = 4 << 20
+
+	testQueueSize = 16
+	// The guest memory shared with the device holds the rings of each queue in its first testRingArea bytes, then
+	// the buffers of the requests of each queue in testBufferArea bytes.
+	testMemorySize  = 4 << 20
+	testGuestAddr   = 0x100000
+	testUserAddr    = 0x7f1000000000
+	testRingArea    = 0x4000
+	testBufferStart = 0x100000
+	testBufferArea  = 0x40000
+)
+
+// testDriver is a vhost-user front-end and the virtio-blk driver of the guest, like QEMU and the guest kernel
+// together. It shares a memfd as the guest memory and runs one request at a time on each queue.
+type testDriver struct {
+	c      *C
+	conn   *net.UnixConn
+	memFd  int
+	mem    []byte
+	queues []*testQueue
+}
+
+type testQueue struct {
+	index       int
+	kick, call  int
+	desc, avail []byte
+	used        []byte
+	availIdx    uint16
+	usedIdx     uint16
+	buffers     []byte
+}
+
+// startTestFrontend serves a volume on a socket in dir, like Startup does in SocketDirectory.
+func startTestFrontend(c *C, dir string, rwu *mem.Replica) (*VhostUserBlk, string) {
+	f := New()
+	c.Assert(f.Init("test", testVolumeSize, 4096), IsNil)
+	socketPath := filepath.Join(dir, "vhost-user-blk.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	c.Assert(err, IsNil)
+	f.rwu = rwu
+	f.socketPath = socketPath
+	f.listener = listener
+	f.done = make(chan struct{})
+	f.isUp = true
+	go f.serve(listener, f.done)
+	return f, socketPath
+}
+
+func newTestDriver(c *C, socketPath string) *testDriver {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"})
+	c.Assert(err, IsNil)
+	memFd, err := unix.MemfdCreate("vhost-user-blk-test", unix.MFD_CLOEXEC)
+	c.Assert(err, IsNil)
+	c.Assert(unix.Ftruncate(memFd, testMemorySize), IsNil)
+	memory, err := unix.Mmap(memFd, 0, testMemorySize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	c.Assert(err, IsNil)
+	return &testDriver{c: c, conn: conn, memFd: memFd, mem: memory}
+}
+
+func (d *testDriver) close() {
+	_ = d.conn.Close()
+	for _, q := range d.queues {
+		_ = unix.Close(q.kick)
+		_ = unix.Close(q.call)
+	}
+	_ = unix.Munmap(d.mem)
+	_ = unix.Close(d.memFd)
+}
+
+func (d *testDriver) send(request, flags uint32, payload []byte, fds ...int) {
+	buf := make([]byte, vhostUserHeaderSize+len(payload))
+	le.PutUint32(buf, request)
+	le.PutUint32(buf[4:], vhostUserFlagVersion|flags)
+	le.PutUint32(buf[8:], uint32(len(payload)))
+	copy(buf[vhostUserHeaderSize:], payload)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	_, _, err := d.conn.WriteMsgUnix(buf, oob, nil)
+	d.c.Assert(err, IsNil)
+}
+
+func (d *testDriver) reply(request uint32) []byte {
+	header := make([]byte, vhostUserHeaderSize)
+	_, err := io.ReadFull(d.conn, header)
+	d.c.Assert(err, IsNil)
+	d.c.Assert(le.Uint32(header), Equals, request)
+	d.c.Assert(le.Uint32(header[4:]), Equals, uint32(vhostUserFlagVersion|vhostUserFlagReply))
+	payload := make([]byte, le.Uint32(header[8:]))
+	_, err = io.ReadFull(d.conn, payload)
+	d.c.Assert(err, IsNil)
+	return payload
+}
+
+func (d *testDriver) get(request uint32, payload []byte) []byte {
+	d.send(request, 0, payload)
+	return d.reply(request)
+}
+
+func vringState(index int, num uint32) []byte {
+	payload := make([]byte, 8)
+	le.PutUint32(payload, uint32(index))
+	le.PutUint32(payload[4:], num)
+	return payload
+}
+
+// setup negotiates the features, shares the guest memory and sets the given number of queues up.
+func (d *testDriver) setup(queueCount int) {
+	c := d.c
+	d.send(vhostUserSetOwner, 0, nil)
+	features := le.Uint64(d.get(vhostUserGetFeatures, nil))
+	c.Assert(features, Equals, uint64(deviceFeatures))
+	d.send(vhostUserSetFeatures, 0, u64Payload(featureVersion1|featureProtocolFeatures|featureBlkMQ|featureBlkFlush|
+		featureBlkDiscard|featureBlkWriteZeroes|featureRingIndirectDesc))
+	c.Assert(le.Uint64(d.get(vhostUserGetProtocolFeatures, nil)), Equals, uint64(protocolFeatures))
+	d.send(vhostUserSetProtocolFeatures, 0, u64Payload(protocolFeatureMQ|protocolFeatureReplyAck|protocolFeatureConfig))
+	c.Assert(le.Uint64(d.get(vhostUserGetQueueNum, nil)), Equals, uint64(maxQueues))
+
+	table := make([]byte, 8+memoryRegionSize)
+	le.PutUint32(table, 1)
+	le.PutUint64(table[8:], testGuestAddr)
+	le.PutUint64(table[16:], testMemorySize)
+	le.PutUint64(table[24:], testUserAddr)
+	d.send(vhostUserSetMemTable, vhostUserFlagNeedReply, table, d.memFd)
+	c.Assert(d.reply(vhostUserSetMemTable), DeepEquals, make([]byte, 8))
+
+	for i := 0; i < queueCount; i++ {
+		q := &testQueue{index: i}
+		rings := i * testRingArea
+		q.desc = d.mem[rings : rings+testQueueSize*descSize]
+		q.avail = d.mem[rings+0x1000 : rings+0x1000+4+2*testQueueSize]
+		q.used = d.mem[rings+0x2000 : rings+0x2000+4+8*testQueueSize]
+		q.buffers = d.mem[testBufferStart+i*testBufferArea : testBufferStart+(i+1)*testBufferArea]
+		var err error
+		q.kick, err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+		c.Assert(err, IsNil)
+		q.call, err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+		c.Assert(err, IsNil)
+		d.queues = append(d.queues, q)
+
+		d.send(vhostUserSetVringNum, 0, vringState(i, testQueueSize))
+		addr := make([]byte, 40)
+		le.PutUint32(addr, uint32(i))
+		le.PutUint64(addr[8:], testUserAddr+uint64(rings))
+		le.PutUint64(addr[16:], testUserAddr+uint64(rings)+0x2000)
+		le.PutUint64(addr[24:], testUserAddr+uint64(rings)+0x1000)
+		d.send(vhostUserSetVringAddr, 0, addr)
+		d.send(vhostUserSetVringBase, 0, vringState(i, 0))
+		d.send(vhostUserSetVringCall, 0, u64Payload(uint64(i)), q.call)
+		d.send(vhostUserSetVringKick, 0, u64Payload(uint64(i)), q.kick)
+		d.send(vhostUserSetVringEnable, vhostUserFlagNeedReply, vringState(i, 1))
+		c.Assert(d.reply(vhostUserSetVringEnable), DeepEquals, make([]byte, 8))
+	}
+}
+
+// testBuffer is a buffer of a request, at an offset in the buffer area of the queue.
+type testBuffer struct {
+	off      int
+	length   int
+	writable bool
+}
+
+// submit adds a descriptor chain of the buffers to the available ring, kicks the queue and waits for the request to
+// be used. It returns the number of bytes written, as reported by the device.
+func (d *testDriver) submit(q *testQueue, bufs []testBuffer) uint32 {
+	c := d.c
+	for i, b := range bufs {
+		var flags, next uint16
+		if i < len(bufs)-1 {
+			flags, next = descFlagNext, uint16(i+1)
+		}
+		if b.writable {
+			flags |= descFlagWrite
+		}
+		addr := testGuestAddr + uint64(testBufferStart+q.index*testBufferArea+b.off)
+		putDesc(q.desc, i, addr, uint32(b.length), flags, next)
+	}
+	le.PutUint16(q.avail[4+2*(q.availIdx%testQueueSize):], 0)
+	q.availIdx++
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&q.avail[0])), uint32(q.availIdx)<<16)
+
+	var one [8]byte
+	le.PutUint64(one[:], 1)
+	_, err := unix.Write(q.kick, one[:])
+	c.Assert(err, IsNil)
+
+	for q.usedIdx == uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&q.used[0])))>>16) {
+		fds := []unix.PollFd{{Fd: int32(q.call), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 10000)
+		if err == unix.EINTR {
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1, Commentf("request on queue %v was not used", q.index))
+		_, err = unix.Read(q.call, one[:])
+		c.Assert(err, IsNil)
+	}
+	slot := 4 + 8*int(q.usedIdx%testQueueSize)
+	q.usedIdx++
+	c.Assert(le.Uint32(q.used[slot:]), Equals, uint32(0))
+	return le.Uint32(q.used[slot+4:])
+}
+
+// request runs a virtio-blk request with the data as its readable payload and outLen bytes to read, and returns the
+// status and the bytes read. Payloads and buffers to read of more than a sector are split in two descriptors.
+func (d *testDriver) request(q *testQueue, typ uint32, sector uint64, data []byte, outLen int) (byte, []byte) {
+	header := q.buffers[:blkHeaderSize]
+	le.PutUint32(header, typ)
+	le.PutUint32(header[4:], 0)
+	le.PutUint64(header[8:], sector)
+	bufs := []testBuffer{{off: 0, length: blkHeaderSize}}
+
+	off := 4096
+	for _, part := range split(len(data)) {
+		copy(q.buffers[off:], data[:part])
+		data = data[part:]
+		bufs = append(bufs, testBuffer{off: off, length: part})
+		off += part + 512
+	}
+	for _, part := range split(outLen) {
+		bufs = append(bufs, testBuffer{off: off, length: part, writable: true})
+		off += part + 512
+	}
+	status := off
+	q.buffers[status] = 0xff
+	bufs = append(bufs, testBuffer{off: status, length: 1, writable: true})
+
+	written := d.submit(q, bufs)
+	d.c.Assert(written >= 1, Equals, true)
+	var out []byte
+	for _, b := range bufs {
+		if b.writable && b.off != status {
+			out = append(out, q.buffers[b.off:b.off+b.length]...)
+		}
+	}
+	d.c.Assert(int(written)-1 <= len(out), Equals, true)
+	return q.buffers[status], out[:written-1]
+}
+
+func split(length int) []int {
+	switch {
+	case length == 0:
+		return nil
+	case length <= 512:
+		return []int{length}
+	}
+	return []int{length / 2, length - length/2}
+}
+
+func segment(sector uint64, count, flags uint32) []byte {
+	s := make([]byte, blkSegmentSize)
+	le.PutUint64(s, sector)
+	le.PutUint32(s[8:], count)
+	le.PutUint32(s[12:], flags)
+	return s
+}
+
+func newTestReplica(c *C) *mem.Replica {
+	r, err := mem.New().AddReplica("r", testVolumeSize)
+	c.Assert(err, IsNil)
+	return r
+}
+
+func (s *TestSuite) TestRoundTrip(c *C) {
+	replica := newTestReplica(c)
+	f, socketPath := startTestFrontend(c, c.MkDir(), replica)
+	defer f.Shutdown()
+	d := newTestDriver(c, socketPath)
+	defer d.close()
+	d.setup(2)
+
+	config := d.get(vhostUserGetConfig, append(vringState(0, configSize), make([]byte, 4+configSize)...))
+	c.Assert(config[12:], DeepEquals, f.config(maxQueues))
+
+	for _, q := range d.queues {
+		data := make([]byte, 8192)
+		for i := range data {
+			data[i] = byte(i%251) + byte(q.index)
+		}
+		sector := uint64(q.index) * 64
+		status, _ := d.request(q, blkTypeOut, sector, data, 0)
+		c.Assert(status, Equals, byte(blkStatusOK))
+		stored := make([]byte, len(data))
+		_, err := replica.ReadAt(stored, int64(sector)*sectorSize)
+		c.Assert(err, IsNil)
+		c.Assert(stored, DeepEquals, data)
+
+		status, read := d.request(q, blkTypeIn, sector, nil, len(data))
+		c.Assert(status, Equals, byte(blkStatusOK))
+		c.Assert(read, DeepEquals, data)
+		// A read of a single buffer goes straight into it.
+		status, read = d.request(q, blkTypeIn, sector+1, nil, 512)
+		c.Assert(status, Equals, byte(blkStatusOK))
+		c.Assert(read, DeepEquals, data[512:1024])
+
+		status, _ = d.request(q, blkTypeFlush, 0, nil, 0)
+		c.Assert(status, Equals, byte(blkStatusOK))
+		status, id := d.request(q, blkTypeGetID, 0, nil, blkIDBytes)
+		c.Assert(status, Equals, byte(blkStatusOK))
+		c.Assert(string(bytes.TrimRight(id, "\x00")), Equals, "test")
+	}
+}
+
+func (s *TestSuite) TestDiscardAndWriteZeroes(c *C) {
+	replica := newTestReplica(c)
+	f, socketPath := startTestFrontend(c, c.MkDir(), replica)
+	defer f.Shutdown()
+	d := newTestDriver(c, socketPath)
+	defer d.close()
+	d.setup(1)
+	q := d.queues[0]
+
+	ones := bytes.Repeat([]byte{1}, 64<<10)
+	_, err := replica.WriteAt(ones, 0)
+	c.Assert(err, IsNil)
+
+	// Two segments in one request.
+	segments := append(segment(0, 8, 0), segment(64, 16, 0)...)
+	status, _ := d.request(q, blkTypeDiscard, 0, segments, 0)
+	c.Assert(status, Equals, byte(blkStatusOK))
+	status, _ = d.request(q, blkTypeWriteZeroes, 0, segment(16, 8, blkWriteZeroesFlagUnmap), 0)
+	c.Assert(status, Equals, byte(blkStatusOK))
+
+	status, read := d.request(q, blkTypeIn, 0, nil, 48<<10)
+	c.Assert(status, Equals, byte(blkStatusOK))
+	expected := bytes.Repeat([]byte{1}, 48<<10)
+	clear(expected[:4096])
+	clear(expected[8192:12288])
+	clear(expected[32768:40960])
+	c.Assert(read, DeepEquals, expected)
+
+	for _, t := range []struct {
+		comment  string
+		typ      uint32
+		segments []byte
+	}{
+		{"discard beyond the volume", blkTypeDiscard, segment(testVolumeSize/sectorSize-1, 2, 0)},
+		{"discard with flags", blkTypeDiscard, segment(0, 8, 1)},
+		{"unknown write zeroes flag", blkTypeWriteZeroes, segment(0, 8, 2)},
+		{"partial segment", blkTypeWriteZeroes, segment(0, 8, 0)[:12]},
+	} {
+		status, _ = d.request(q, t.typ, 0, t.segments, 0)
+		c.Assert(status, Equals, byte(blkStatusIOErr), Commentf(t.comment))
+	}
+}
+
+func (s *TestSuite) TestRequestErrors(c *C) {
+	replica := newTestReplica(c)
+	f, socketPath := startTestFrontend(c, c.MkDir(), replica)
+	defer f.Shutdown()
+	d := newTestDriver(c, socketPath)
+	defer d.close()
+	d.setup(1)
+	q := d.queues[0]
+
+	// Beyond the end of the volume.
+	status, _ := d.request(q, blkTypeIn, testVolumeSize/sectorSize-1, nil, 1024)
+	c.Assert(status, Equals, byte(blkStatusIOErr))
+	status, _ = d.request(q, blkTypeOut, testVolumeSize/sectorSize, make([]byte, 512), 0)
+	c.Assert(status, Equals, byte(blkStatusIOErr))
+
+	// A failure of the volume.
+	replica.SetState(types.ReplicaStateError)
+	status, _ = d.request(q, blkTypeOut, 0, make([]byte, 512), 0)
+	c.Assert(status, Equals, byte(blkStatusIOErr))
+	replica.SetState(types.ReplicaStateOpen)
+
+	status, _ = d.request(q, 42, 0, nil, 0)
+	c.Assert(status, Equals, byte(blkStatusUnsupp))
+
+	// A request whose header is short.
+	q.buffers[4096] = 0xff
+	written := d.submit(q, []testBuffer{{off: 0, length: 8}, {off: 4096, length: 1, writable: true}})
+	c.Assert(written, Equals, uint32(1))
+	c.Assert(q.buffers[4096], Equals, byte(blkStatusIOErr))
+
+	// The queue goes on.
+	status, _ = d.request(q, blkTypeOut, 0, make([]byte, 512), 0)
+	c.Assert(status, Equals, byte(blkStatusOK))
+}
+
+func (s *TestSuite) TestInvalidMessages(c *C) {
+	replica := newTestReplica(c)
+	f, socketPath := startTestFrontend(c, c.MkDir(), replica)
+	defer f.Shutdown()
+
+	for _, t := range []struct {
+		comment string
+		request uint32
+		payload []byte
+	}{
+		{"payload too large", vhostUserSetFeatures, make([]byte, vhostUserMaxPayload+1)},
+		{"unsupported features", vhostUserSetFeatures, u64Payload(1 << 63)},
+		{"short payload", vhostUserSetFeatures, make([]byte, 4)},
+		{"queue that does not exist", vhostUserSetVringNum, vringState(maxQueues, 16)},
+		{"queue size not a power of two", vhostUserSetVringNum, vringState(0, 12)},
+		{"memory table without file descriptors", vhostUserSetMemTable, append(vringState(1, 0), make([]byte, memoryRegionSize)...)},
+		{"config beyond the config space", vhostUserGetConfig, append(vringState(configSize-4, 8), make([]byte, 12)...)},
+	} {
+		d := newTestDriver(c, socketPath)
+		d.send(t.request, 0, t.payload)
+		// The device drops a front-end that sends an invalid message.
+		_, err := d.conn.Read(make([]byte, 1))
+		c.Assert(err, NotNil, Commentf(t.comment))
+		d.close()
+	}
+
+	// The next front-end is served.
+	d := newTestDriver(c, socketPath)
+	defer d.close()
+	d.setup(1)
+	status, _ := d.request(d.queues[0], blkTypeFlush, 0, nil, 0)
+	c.Assert(status, Equals, byte(blkStatusOK))
+}
+
+func (s *TestSuite) TestShutdownWithFrontEndConnected(c *C) {
+	replica := newTestReplica(c)
+	f, socketPath := startTestFrontend(c, c.MkDir(), replica)
+	d := newTestDriver(c, socketPath)
+	defer d.close()
+	d.setup(1)
+	status, _ := d.request(d.queues[0], blkTypeFlush, 0, nil, 0)
+	c.Assert(status, Equals, byte(blkStatusOK))
+
+	c.Assert(f.Shutdown(), IsNil)
+	c.Assert(f.State(), Equals, types.StateDown)
+	_, err := d.conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
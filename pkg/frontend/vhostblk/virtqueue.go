@@ -0,0 +1,288 @@
+package vhostblk
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	descSize = 16
+
+	descFlagNext     = 1
+	descFlagWrite    = 2
+	descFlagIndirect = 4
+
+	availFlagNoInterrupt = 1
+
+	// maxChainLength bounds the descriptors of a request, so a corrupted ring cannot loop forever
+	maxChainLength = 1024
+)
+
+// virtqueue is a split virtqueue. The rings live in the guest memory. The driver in the guest adds requests to the
+// available ring and kicks the queue, and requests are completed to the used ring and the driver is called.
+type virtqueue struct {
+	index int
+	num   uint16
+	// descAddr, availAddr and usedAddr are the front-end addresses of the rings
+	descAddr, availAddr, usedAddr uint64
+	desc, avail, used             []byte
+
+	lastAvail uint16
+	usedIdx   uint16
+	// usedLock serializes the completions, which come from the goroutines of the requests, and guards callFd
+	usedLock sync.Mutex
+
+	kickFd  int
+	callFd  int
+	enabled bool
+	running bool
+
+	// stopFd wakes the worker up to stop it
+	stopFd   int
+	stopped  chan struct{}
+	inflight sync.WaitGroup
+	slots    chan struct{}
+}
+
+func newVirtqueue(index int) *virtqueue {
+	return &virtqueue{
+		index:  index,
+		kickFd: -1,
+		callFd: -1,
+		stopFd: -1,
+	}
+}
+
+// mapRings looks the rings up in the guest memory.
+func (q *virtqueue) mapRings(mem *memoryTable) error {
+	if q.num == 0 {
+		return fmt.Errorf("size of queue %v is not set", q.index)
+	}
+	if q.availAddr%2 != 0 || q.usedAddr%4 != 0 {
+		return fmt.Errorf("rings of queue %v are misaligned", q.index)
+	}
+	var err error
+	if q.desc, err = mem.user(q.descAddr, uint64(q.num)*descSize); err != nil {
+		return err
+	}
+	if q.avail, err = mem.user(q.availAddr, 4+2*uint64(q.num)); err != nil {
+		return err
+	}
+	if q.used, err = mem.user(q.usedAddr, 4+8*uint64(q.num)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// availIdx loads the index the driver put the next request at. The available ring is only 2-byte aligned, so the
+// index is loaded with the aligned 4-byte word it is in.
+func (q *virtqueue) availIdx() uint16 {
+	if q.availAddr%4 == 0 {
+		return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&q.avail[0]))) >> 16)
+	}
+	return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&q.avail[2]))))
+}
+
+func (q *virtqueue) loadUsedIdx() uint16 {
+	return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&q.used[0]))) >> 16)
+}
+
+// storeUsedIdx publishes the used ring entries written before. The flags of the used ring are left zero, the
+// driver always kicks.
+func (q *virtqueue) storeUsedIdx(idx uint16) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&q.used[0])), uint32(idx)<<16)
+}
+
+// descChain is a request taken from the available ring. The buffers are in the guest memory.
+type descChain struct {
+	head     uint16
+	readable iovecs
+	writable iovecs
+}
+
+func (q *virtqueue) chain(mem *memoryTable, head uint16) (*descChain, error) {
+	c := &descChain{head: head}
+	table, count := q.desc, uint32(q.num)
+	indirect := false
+	idx := uint32(head)
+	for i := 0; ; i++ {
+		if i >= maxChainLength {
+			return nil, fmt.Errorf("descriptor chain of head %v is too long", head)
+		}
+		if idx >= count {
+			return nil, fmt.Errorf("descriptor %v is out of the table of %v", idx, count)
+		}
+		d := table[idx*descSize:]
+		addr, length, flags, next := le.Uint64(d), le.Uint32(d[8:]), le.Uint16(d[12:]), le.Uint16(d[14:])
+
+		if flags&descFlagIndirect != 0 {
+			if indirect || length%descSize != 0 || length == 0 {
+				return nil, fmt.Errorf("invalid indirect descriptor table of %v bytes", length)
+			}
+			buf, err := mem.guest(addr, uint64(length))
+			if err != nil {
+				return nil, err
+			}
+			table, count, idx, indirect = buf, length/descSize, 0, true
+			continue
+		}
+
+		buf, err := mem.guest(addr, uint64(length))
+		if err != nil {
+			return nil, err
+		}
+		if flags&descFlagWrite != 0 {
+			c.writable = append(c.writable, buf)
+		} else {
+			if len(c.writable) > 0 {
+				return nil, fmt.Errorf("readable descriptor after writable ones in chain of head %v", head)
+			}
+			c.readable = append(c.readable, buf)
+		}
+		if flags&descFlagNext == 0 {
+			return c, nil
+		}
+		idx = uint32(next)
+	}
+}
+
+// start runs the worker of the queue, which takes the requests from the available ring and handles each of them in
+// a goroutine, up to the size of the queue at a time.
+func (q *virtqueue) start(s *session) error {
+	stopFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	q.stopFd = stopFd
+	q.stopped = make(chan struct{})
+	q.slots = make(chan struct{}, q.num)
+	q.usedIdx = q.loadUsedIdx()
+	q.running = true
+	go q.run(s)
+	return nil
+}
+
+// stop stops the worker and waits for the requests in flight to complete.
+func (q *virtqueue) stop() {
+	if !q.running {
+		return
+	}
+	var one [8]byte
+	le.PutUint64(one[:], 1)
+	_, _ = unix.Write(q.stopFd, one[:])
+	<-q.stopped
+	q.inflight.Wait()
+	_ = unix.Close(q.stopFd)
+	q.stopFd = -1
+	q.running = false
+}
+
+func (q *virtqueue) run(s *session) {
+	defer close(q.stopped)
+
+	log := logrus.WithFields(logrus.Fields{"volume": s.frontend.Volume, "queue": q.index})
+	fds := []unix.PollFd{{Fd: int32(q.kickFd), Events: unix.POLLIN}, {Fd: int32(q.stopFd), Events: unix.POLLIN}}
+	var buf [8]byte
+	for {
+		if err := q.process(s); err != nil {
+			log.WithError(err).Error("Failed to process virtqueue, stopping it")
+			return
+		}
+
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.WithError(err).Error("Failed to wait for a kick")
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			if _, err := unix.Read(q.kickFd, buf[:]); err != nil && err != unix.EAGAIN {
+				log.WithError(err).Error("Failed to read a kick")
+				return
+			}
+		} else if fds[0].Revents != 0 {
+			log.Warn("Kick file descriptor is closed")
+			return
+		}
+	}
+}
+
+// process handles the requests added to the available ring since the last call.
+func (q *virtqueue) process(s *session) error {
+	for {
+		availIdx := q.availIdx()
+		if availIdx == q.lastAvail {
+			return nil
+		}
+		if availIdx-q.lastAvail > q.num {
+			return fmt.Errorf("available index %v is more than %v ahead of %v", availIdx, q.num, q.lastAvail)
+		}
+		for ; q.lastAvail != availIdx; q.lastAvail++ {
+			slot := q.lastAvail % q.num
+			head := le.Uint16(q.avail[4+2*uint32(slot):])
+			c, err := q.chain(s.mem, head)
+			if err != nil {
+				return err
+			}
+
+			q.slots <- struct{}{}
+			q.inflight.Add(1)
+			go func() {
+				defer q.inflight.Done()
+				written := s.frontend.handleRequest(c)
+				q.complete(c.head, written)
+				<-q.slots
+			}()
+		}
+	}
+}
+
+// complete puts a request on the used ring and calls the driver, unless it asked not to be.
+func (q *virtqueue) complete(head uint16, written uint32) {
+	q.usedLock.Lock()
+	defer q.usedLock.Unlock()
+
+	slot := uint32(q.usedIdx % q.num)
+	le.PutUint32(q.used[4+8*slot:], uint32(head))
+	le.PutUint32(q.used[8+8*slot:], written)
+	q.usedIdx++
+	q.storeUsedIdx(q.usedIdx)
+
+	if q.callFd < 0 || le.Uint16(q.avail)&availFlagNoInterrupt != 0 {
+		return
+	}
+	var one [8]byte
+	le.PutUint64(one[:], 1)
+	if _, err := unix.Write(q.callFd, one[:]); err != nil && err != unix.EAGAIN {
+		logrus.WithError(err).Warnf("Failed to call the driver of queue %v", q.index)
+	}
+}
+
+// setCallFd replaces the file descriptor the driver is called with. It may change while the queue runs.
+func (q *virtqueue) setCallFd(fd int) {
+	q.usedLock.Lock()
+	old := q.callFd
+	q.callFd = fd
+	q.usedLock.Unlock()
+	if old >= 0 {
+		_ = unix.Close(old)
+	}
+}
+
+// closeFds closes the file descriptors the front-end gave for the queue.
+func (q *virtqueue) closeFds() {
+	if q.kickFd >= 0 {
+		_ = unix.Close(q.kickFd)
+		q.kickFd = -1
+	}
+	q.setCallFd(-1)
+}
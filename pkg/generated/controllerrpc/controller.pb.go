@@ -0,0 +1,651 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: controllerrpc/controller.proto
+
+package controllerrpc
+
+import (
+	enginerpc "github.com/longhorn/types/pkg/generated/enginerpc"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type WatchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Resume after the event with this sequence number. 0 means only new events are sent.
+	SinceSeq uint64 `protobuf:"varint,1,opt,name=since_seq,json=sinceSeq,proto3" json:"since_seq,omitempty"`
+	// Only send events of these types (volume, replica, metrics). Empty means all types.
+	Types         []string `protobuf:"bytes,2,rep,name=types,proto3" json:"types,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchRequest) Reset() {
+	*x = WatchRequest{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRequest) ProtoMessage() {}
+
+func (x *WatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRequest.ProtoReflect.Descriptor instead.
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *WatchRequest) GetSinceSeq() uint64 {
+	if x != nil {
+		return x.SinceSeq
+	}
+	return 0
+}
+
+func (x *WatchRequest) GetTypes() []string {
+	if x != nil {
+		return x.Types
+	}
+	return nil
+}
+
+type Event struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Sequence number of the event. Metrics events are not kept for resumption and always have a sequence number of 0.
+	Seq           uint64                       `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	Type          string                       `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Action        string                       `protobuf:"bytes,3,opt,name=action,proto3" json:"action,omitempty"`
+	Timestamp     string                       `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Message       string                       `protobuf:"bytes,5,opt,name=message,proto3" json:"message,omitempty"`
+	Replica       *enginerpc.ControllerReplica `protobuf:"bytes,6,opt,name=replica,proto3" json:"replica,omitempty"`
+	Volume        *enginerpc.Volume            `protobuf:"bytes,7,opt,name=volume,proto3" json:"volume,omitempty"`
+	Metrics       *enginerpc.Metrics           `protobuf:"bytes,8,opt,name=metrics,proto3" json:"metrics,omitempty"`
+	Snapshot      string                       `protobuf:"bytes,9,opt,name=snapshot,proto3" json:"snapshot,omitempty"`
+	Size          int64                        `protobuf:"varint,10,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Event) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Event) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Event) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
+func (x *Event) GetTimestamp() string {
+	if x != nil {
+		return x.Timestamp
+	}
+	return ""
+}
+
+func (x *Event) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Event) GetReplica() *enginerpc.ControllerReplica {
+	if x != nil {
+		return x.Replica
+	}
+	return nil
+}
+
+func (x *Event) GetVolume() *enginerpc.Volume {
+	if x != nil {
+		return x.Volume
+	}
+	return nil
+}
+
+func (x *Event) GetMetrics() *enginerpc.Metrics {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+func (x *Event) GetSnapshot() string {
+	if x != nil {
+		return x.Snapshot
+	}
+	return ""
+}
+
+func (x *Event) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type CaptureStartRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Path of the capture file on the controller host. It must not exist yet.
+	File string `protobuf:"bytes,1,opt,name=file,proto3" json:"file,omitempty"`
+	// Record the xxHash64 of the data of every read and write.
+	DataHash      bool `protobuf:"varint,2,opt,name=data_hash,json=dataHash,proto3" json:"data_hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CaptureStartRequest) Reset() {
+	*x = CaptureStartRequest{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CaptureStartRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CaptureStartRequest) ProtoMessage() {}
+
+func (x *CaptureStartRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CaptureStartRequest.ProtoReflect.Descriptor instead.
+func (*CaptureStartRequest) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CaptureStartRequest) GetFile() string {
+	if x != nil {
+		return x.File
+	}
+	return ""
+}
+
+func (x *CaptureStartRequest) GetDataHash() bool {
+	if x != nil {
+		return x.DataHash
+	}
+	return false
+}
+
+type CaptureStopResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	File          string                 `protobuf:"bytes,1,opt,name=file,proto3" json:"file,omitempty"`
+	Records       int64                  `protobuf:"varint,2,opt,name=records,proto3" json:"records,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CaptureStopResponse) Reset() {
+	*x = CaptureStopResponse{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CaptureStopResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CaptureStopResponse) ProtoMessage() {}
+
+func (x *CaptureStopResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CaptureStopResponse.ProtoReflect.Descriptor instead.
+func (*CaptureStopResponse) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CaptureStopResponse) GetFile() string {
+	if x != nil {
+		return x.File
+	}
+	return ""
+}
+
+func (x *CaptureStopResponse) GetRecords() int64 {
+	if x != nil {
+		return x.Records
+	}
+	return 0
+}
+
+type FrontendStartRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Type of the frontend, e.g. tgt-blockdev or rest
+	Frontend string `protobuf:"bytes,2,opt,name=frontend,proto3" json:"frontend,omitempty"`
+	// Reject the writes and unmaps coming through the frontend.
+	ReadOnly      bool `protobuf:"varint,3,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FrontendStartRequest) Reset() {
+	*x = FrontendStartRequest{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FrontendStartRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FrontendStartRequest) ProtoMessage() {}
+
+func (x *FrontendStartRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FrontendStartRequest.ProtoReflect.Descriptor instead.
+func (*FrontendStartRequest) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *FrontendStartRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *FrontendStartRequest) GetFrontend() string {
+	if x != nil {
+		return x.Frontend
+	}
+	return ""
+}
+
+func (x *FrontendStartRequest) GetReadOnly() bool {
+	if x != nil {
+		return x.ReadOnly
+	}
+	return false
+}
+
+type FrontendShutdownRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FrontendShutdownRequest) Reset() {
+	*x = FrontendShutdownRequest{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FrontendShutdownRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FrontendShutdownRequest) ProtoMessage() {}
+
+func (x *FrontendShutdownRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FrontendShutdownRequest.ProtoReflect.Descriptor instead.
+func (*FrontendShutdownRequest) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *FrontendShutdownRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+type Frontend struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Name of the frontend. The frontend of the volume has none.
+	Name          string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Frontend      string `protobuf:"bytes,2,opt,name=frontend,proto3" json:"frontend,omitempty"`
+	State         string `protobuf:"bytes,3,opt,name=state,proto3" json:"state,omitempty"`
+	Endpoint      string `protobuf:"bytes,4,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
+	ReadOnly      bool   `protobuf:"varint,5,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Frontend) Reset() {
+	*x = Frontend{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Frontend) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Frontend) ProtoMessage() {}
+
+func (x *Frontend) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Frontend.ProtoReflect.Descriptor instead.
+func (*Frontend) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Frontend) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Frontend) GetFrontend() string {
+	if x != nil {
+		return x.Frontend
+	}
+	return ""
+}
+
+func (x *Frontend) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *Frontend) GetEndpoint() string {
+	if x != nil {
+		return x.Endpoint
+	}
+	return ""
+}
+
+func (x *Frontend) GetReadOnly() bool {
+	if x != nil {
+		return x.ReadOnly
+	}
+	return false
+}
+
+type FrontendListResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Frontends     []*Frontend            `protobuf:"bytes,1,rep,name=frontends,proto3" json:"frontends,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FrontendListResponse) Reset() {
+	*x = FrontendListResponse{}
+	mi := &file_controllerrpc_controller_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FrontendListResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FrontendListResponse) ProtoMessage() {}
+
+func (x *FrontendListResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_controllerrpc_controller_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FrontendListResponse.ProtoReflect.Descriptor instead.
+func (*FrontendListResponse) Descriptor() ([]byte, []int) {
+	return file_controllerrpc_controller_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *FrontendListResponse) GetFrontends() []*Frontend {
+	if x != nil {
+		return x.Frontends
+	}
+	return nil
+}
+
+var File_controllerrpc_controller_proto protoreflect.FileDescriptor
+
+const file_controllerrpc_controller_proto_rawDesc = "" +
+	"\n" +
+	"\x1econtrollerrpc/controller.proto\x12\rcontrollerrpc\x1a\x1bgoogle/protobuf/empty.proto\x1a\x17ptypes/controller.proto\"A\n" +
+	"\fWatchRequest\x12\x1b\n" +
+	"\tsince_seq\x18\x01 \x01(\x04R\bsinceSeq\x12\x14\n" +
+	"\x05types\x18\x02 \x03(\tR\x05types\"\xb5\x02\n" +
+	"\x05Event\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x04R\x03seq\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x16\n" +
+	"\x06action\x18\x03 \x01(\tR\x06action\x12\x1c\n" +
+	"\ttimestamp\x18\x04 \x01(\tR\ttimestamp\x12\x18\n" +
+	"\amessage\x18\x05 \x01(\tR\amessage\x123\n" +
+	"\areplica\x18\x06 \x01(\v2\x19.ptypes.ControllerReplicaR\areplica\x12&\n" +
+	"\x06volume\x18\a \x01(\v2\x0e.ptypes.VolumeR\x06volume\x12)\n" +
+	"\ametrics\x18\b \x01(\v2\x0f.ptypes.MetricsR\ametrics\x12\x1a\n" +
+	"\bsnapshot\x18\t \x01(\tR\bsnapshot\x12\x12\n" +
+	"\x04size\x18\n" +
+	" \x01(\x03R\x04size\"F\n" +
+	"\x13CaptureStartRequest\x12\x12\n" +
+	"\x04file\x18\x01 \x01(\tR\x04file\x12\x1b\n" +
+	"\tdata_hash\x18\x02 \x01(\bR\bdataHash\"C\n" +
+	"\x13CaptureStopResponse\x12\x12\n" +
+	"\x04file\x18\x01 \x01(\tR\x04file\x12\x18\n" +
+	"\arecords\x18\x02 \x01(\x03R\arecords\"c\n" +
+	"\x14FrontendStartRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1a\n" +
+	"\bfrontend\x18\x02 \x01(\tR\bfrontend\x12\x1b\n" +
+	"\tread_only\x18\x03 \x01(\bR\breadOnly\"-\n" +
+	"\x17FrontendShutdownRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\"\x89\x01\n" +
+	"\bFrontend\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x1a\n" +
+	"\bfrontend\x18\x02 \x01(\tR\bfrontend\x12\x14\n" +
+	"\x05state\x18\x03 \x01(\tR\x05state\x12\x1a\n" +
+	"\bendpoint\x18\x04 \x01(\tR\bendpoint\x12\x1b\n" +
+	"\tread_only\x18\x05 \x01(\bR\breadOnly\"M\n" +
+	"\x14FrontendListResponse\x125\n" +
+	"\tfrontends\x18\x01 \x03(\v2\x17.controllerrpc.FrontendR\tfrontends2\xd7\x03\n" +
+	"\x11ControllerService\x12<\n" +
+	"\x05Watch\x12\x1b.controllerrpc.WatchRequest\x1a\x14.controllerrpc.Event0\x01\x12J\n" +
+	"\fCaptureStart\x12\".controllerrpc.CaptureStartRequest\x1a\x16.google.protobuf.Empty\x12I\n" +
+	"\vCaptureStop\x12\x16.google.protobuf.Empty\x1a\".controllerrpc.CaptureStopResponse\x12L\n" +
+	"\rFrontendStart\x12#.controllerrpc.FrontendStartRequest\x1a\x16.google.protobuf.Empty\x12R\n" +
+	"\x10FrontendShutdown\x12&.controllerrpc.FrontendShutdownRequest\x1a\x16.google.protobuf.Empty\x12K\n" +
+	"\fFrontendList\x12\x16.google.protobuf.Empty\x1a#.controllerrpc.FrontendListResponseBAZ?github.com/longhorn/longhorn-engine/pkg/generated/controllerrpcb\x06proto3"
+
+var (
+	file_controllerrpc_controller_proto_rawDescOnce sync.Once
+	file_controllerrpc_controller_proto_rawDescData []byte
+)
+
+func file_controllerrpc_controller_proto_rawDescGZIP() []byte {
+	file_controllerrpc_controller_proto_rawDescOnce.Do(func() {
+		file_controllerrpc_controller_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_controllerrpc_controller_proto_rawDesc), len(file_controllerrpc_controller_proto_rawDesc)))
+	})
+	return file_controllerrpc_controller_proto_rawDescData
+}
+
+var file_controllerrpc_controller_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_controllerrpc_controller_proto_goTypes = []any{
+	(*WatchRequest)(nil),                // 0: controllerrpc.WatchRequest
+	(*Event)(nil),                       // 1: controllerrpc.Event
+	(*CaptureStartRequest)(nil),         // 2: controllerrpc.CaptureStartRequest
+	(*CaptureStopResponse)(nil),         // 3: controllerrpc.CaptureStopResponse
+	(*FrontendStartRequest)(nil),        // 4: controllerrpc.FrontendStartRequest
+	(*FrontendShutdownRequest)(nil),     // 5: controllerrpc.FrontendShutdownRequest
+	(*Frontend)(nil),                    // 6: controllerrpc.Frontend
+	(*FrontendListResponse)(nil),        // 7: controllerrpc.FrontendListResponse
+	(*enginerpc.ControllerReplica)(nil), // 8: ptypes.ControllerReplica
+	(*enginerpc.Volume)(nil),            // 9: ptypes.Volume
+	(*enginerpc.Metrics)(nil),           // 10: ptypes.Metrics
+	(*emptypb.Empty)(nil),               // 11: google.protobuf.Empty
+}
+var file_controllerrpc_controller_proto_depIdxs = []int32{
+	8,  // 0: controllerrpc.Event.replica:type_name -> ptypes.ControllerReplica
+	9,  // 1: controllerrpc.Event.volume:type_name -> ptypes.Volume
+	10, // 2: controllerrpc.Event.metrics:type_name -> ptypes.Metrics
+	6,  // 3: controllerrpc.FrontendListResponse.frontends:type_name -> controllerrpc.Frontend
+	0,  // 4: controllerrpc.ControllerService.Watch:input_type -> controllerrpc.WatchRequest
+	2,  // 5: controllerrpc.ControllerService.CaptureStart:input_type -> controllerrpc.CaptureStartRequest
+	11, // 6: controllerrpc.ControllerService.CaptureStop:input_type -> google.protobuf.Empty
+	4,  // 7: controllerrpc.ControllerService.FrontendStart:input_type -> controllerrpc.FrontendStartRequest
+	5,  // 8: controllerrpc.ControllerService.FrontendShutdown:input_type -> controllerrpc.FrontendShutdownRequest
+	11, // 9: controllerrpc.ControllerService.FrontendList:input_type -> google.protobuf.Empty
+	1,  // 10: controllerrpc.ControllerService.Watch:output_type -> controllerrpc.Event
+	11, // 11: controllerrpc.ControllerService.CaptureStart:output_type -> google.protobuf.Empty
+	3,  // 12: controllerrpc.ControllerService.CaptureStop:output_type -> controllerrpc.CaptureStopResponse
+	11, // 13: controllerrpc.ControllerService.FrontendStart:output_type -> google.protobuf.Empty
+	11, // 14: controllerrpc.ControllerService.FrontendShutdown:output_type -> google.protobuf.Empty
+	7,  // 15: controllerrpc.ControllerService.FrontendList:output_type -> controllerrpc.FrontendListResponse
+	10, // [10:16] is the sub-list for method output_type
+	4,  // [4:10] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_controllerrpc_controller_proto_init() }
+func file_controllerrpc_controller_proto_init() {
+	if File_controllerrpc_controller_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_controllerrpc_controller_proto_rawDesc), len(file_controllerrpc_controller_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_controllerrpc_controller_proto_goTypes,
+		DependencyIndexes: file_controllerrpc_controller_proto_depIdxs,
+		MessageInfos:      file_controllerrpc_controller_proto_msgTypes,
+	}.Build()
+	File_controllerrpc_controller_proto = out.File
+	file_controllerrpc_controller_proto_goTypes = nil
+	file_controllerrpc_controller_proto_depIdxs = nil
+}
@@ -0,0 +1,327 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: controllerrpc/controller.proto
+
+package controllerrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ControllerService_Watch_FullMethodName            = "/controllerrpc.ControllerService/Watch"
+	ControllerService_CaptureStart_FullMethodName     = "/controllerrpc.ControllerService/CaptureStart"
+	ControllerService_CaptureStop_FullMethodName      = "/controllerrpc.ControllerService/CaptureStop"
+	ControllerService_FrontendStart_FullMethodName    = "/controllerrpc.ControllerService/FrontendStart"
+	ControllerService_FrontendShutdown_FullMethodName = "/controllerrpc.ControllerService/FrontendShutdown"
+	ControllerService_FrontendList_FullMethodName     = "/controllerrpc.ControllerService/FrontendList"
+)
+
+// ControllerServiceClient is the client API for ControllerService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControllerServiceClient interface {
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (ControllerService_WatchClient, error)
+	CaptureStart(ctx context.Context, in *CaptureStartRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	CaptureStop(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CaptureStopResponse, error)
+	// The named frontends are started besides the frontend of the volume, which VolumeFrontendStart and
+	// VolumeFrontendShutdown of ptypes.ControllerService operate on.
+	FrontendStart(ctx context.Context, in *FrontendStartRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	FrontendShutdown(ctx context.Context, in *FrontendShutdownRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	FrontendList(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FrontendListResponse, error)
+}
+
+type controllerServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControllerServiceClient(cc grpc.ClientConnInterface) ControllerServiceClient {
+	return &controllerServiceClient{cc}
+}
+
+func (c *controllerServiceClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (ControllerService_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ControllerService_ServiceDesc.Streams[0], ControllerService_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controllerServiceWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ControllerService_WatchClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type controllerServiceWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *controllerServiceWatchClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *controllerServiceClient) CaptureStart(ctx context.Context, in *CaptureStartRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, ControllerService_CaptureStart_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) CaptureStop(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CaptureStopResponse, error) {
+	out := new(CaptureStopResponse)
+	err := c.cc.Invoke(ctx, ControllerService_CaptureStop_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) FrontendStart(ctx context.Context, in *FrontendStartRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, ControllerService_FrontendStart_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) FrontendShutdown(ctx context.Context, in *FrontendShutdownRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, ControllerService_FrontendShutdown_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controllerServiceClient) FrontendList(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FrontendListResponse, error) {
+	out := new(FrontendListResponse)
+	err := c.cc.Invoke(ctx, ControllerService_FrontendList_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ControllerServiceServer is the server API for ControllerService service.
+// All implementations must embed UnimplementedControllerServiceServer
+// for forward compatibility
+type ControllerServiceServer interface {
+	Watch(*WatchRequest, ControllerService_WatchServer) error
+	CaptureStart(context.Context, *CaptureStartRequest) (*emptypb.Empty, error)
+	CaptureStop(context.Context, *emptypb.Empty) (*CaptureStopResponse, error)
+	// The named frontends are started besides the frontend of the volume, which VolumeFrontendStart and
+	// VolumeFrontendShutdown of ptypes.ControllerService operate on.
+	FrontendStart(context.Context, *FrontendStartRequest) (*emptypb.Empty, error)
+	FrontendShutdown(context.Context, *FrontendShutdownRequest) (*emptypb.Empty, error)
+	FrontendList(context.Context, *emptypb.Empty) (*FrontendListResponse, error)
+	mustEmbedUnimplementedControllerServiceServer()
+}
+
+// UnimplementedControllerServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedControllerServiceServer struct {
+}
+
+func (UnimplementedControllerServiceServer) Watch(*WatchRequest, ControllerService_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedControllerServiceServer) CaptureStart(context.Context, *CaptureStartRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CaptureStart not implemented")
+}
+func (UnimplementedControllerServiceServer) CaptureStop(context.Context, *emptypb.Empty) (*CaptureStopResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CaptureStop not implemented")
+}
+func (UnimplementedControllerServiceServer) FrontendStart(context.Context, *FrontendStartRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FrontendStart not implemented")
+}
+func (UnimplementedControllerServiceServer) FrontendShutdown(context.Context, *FrontendShutdownRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FrontendShutdown not implemented")
+}
+func (UnimplementedControllerServiceServer) FrontendList(context.Context, *emptypb.Empty) (*FrontendListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FrontendList not implemented")
+}
+func (UnimplementedControllerServiceServer) mustEmbedUnimplementedControllerServiceServer() {}
+
+// UnsafeControllerServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControllerServiceServer will
+// result in compilation errors.
+type UnsafeControllerServiceServer interface {
+	mustEmbedUnimplementedControllerServiceServer()
+}
+
+func RegisterControllerServiceServer(s grpc.ServiceRegistrar, srv ControllerServiceServer) {
+	s.RegisterService(&ControllerService_ServiceDesc, srv)
+}
+
+func _ControllerService_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControllerServiceServer).Watch(m, &controllerServiceWatchServer{stream})
+}
+
+type ControllerService_WatchServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type controllerServiceWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *controllerServiceWatchServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ControllerService_CaptureStart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CaptureStartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).CaptureStart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_CaptureStart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).CaptureStart(ctx, req.(*CaptureStartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_CaptureStop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).CaptureStop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_CaptureStop_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).CaptureStop(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_FrontendStart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FrontendStartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).FrontendStart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_FrontendStart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).FrontendStart(ctx, req.(*FrontendStartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_FrontendShutdown_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FrontendShutdownRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).FrontendShutdown(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_FrontendShutdown_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).FrontendShutdown(ctx, req.(*FrontendShutdownRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControllerService_FrontendList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControllerServiceServer).FrontendList(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControllerService_FrontendList_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControllerServiceServer).FrontendList(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ControllerService_ServiceDesc is the grpc.ServiceDesc for ControllerService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ControllerService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "controllerrpc.ControllerService",
+	HandlerType: (*ControllerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CaptureStart",
+			Handler:    _ControllerService_CaptureStart_Handler,
+		},
+		{
+			MethodName: "CaptureStop",
+			Handler:    _ControllerService_CaptureStop_Handler,
+		},
+		{
+			MethodName: "FrontendStart",
+			Handler:    _ControllerService_FrontendStart_Handler,
+		},
+		{
+			MethodName: "FrontendShutdown",
+			Handler:    _ControllerService_FrontendShutdown_Handler,
+		},
+		{
+			MethodName: "FrontendList",
+			Handler:    _ControllerService_FrontendList_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _ControllerService_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "controllerrpc/controller.proto",
+}
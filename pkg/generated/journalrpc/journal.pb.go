@@ -0,0 +1,320 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: journalrpc/journal.proto
+
+package journalrpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ExportRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Return at most this many of the latest completed ops. 0 means all the ops still kept. In-flight ops are always
+	// returned.
+	Limit         int64 `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExportRequest) Reset() {
+	*x = ExportRequest{}
+	mi := &file_journalrpc_journal_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExportRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExportRequest) ProtoMessage() {}
+
+func (x *ExportRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_journalrpc_journal_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExportRequest.ProtoReflect.Descriptor instead.
+func (*ExportRequest) Descriptor() ([]byte, []int) {
+	return file_journalrpc_journal_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ExportRequest) GetLimit() int64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type ExportResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ops           []*Op                  `protobuf:"bytes,1,rep,name=ops,proto3" json:"ops,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExportResponse) Reset() {
+	*x = ExportResponse{}
+	mi := &file_journalrpc_journal_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExportResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExportResponse) ProtoMessage() {}
+
+func (x *ExportResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_journalrpc_journal_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExportResponse.ProtoReflect.Descriptor instead.
+func (*ExportResponse) Descriptor() ([]byte, []int) {
+	return file_journalrpc_journal_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ExportResponse) GetOps() []*Op {
+	if x != nil {
+		return x.Ops
+	}
+	return nil
+}
+
+type Op struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// client or server
+	Side string `protobuf:"bytes,1,opt,name=side,proto3" json:"side,omitempty"`
+	// Address of the other end of the dataconn connection.
+	Peer   string `protobuf:"bytes,2,opt,name=peer,proto3" json:"peer,omitempty"`
+	Seq    uint32 `protobuf:"varint,3,opt,name=seq,proto3" json:"seq,omitempty"`
+	Op     string `protobuf:"bytes,4,opt,name=op,proto3" json:"op,omitempty"`
+	Offset int64  `protobuf:"varint,5,opt,name=offset,proto3" json:"offset,omitempty"`
+	Size   uint32 `protobuf:"varint,6,opt,name=size,proto3" json:"size,omitempty"`
+	Failed bool   `protobuf:"varint,7,opt,name=failed,proto3" json:"failed,omitempty"`
+	// Unix time in nanoseconds of each phase. 0 means the op has not reached the phase.
+	Start         int64 `protobuf:"varint,8,opt,name=start,proto3" json:"start,omitempty"`
+	Dispatched    int64 `protobuf:"varint,9,opt,name=dispatched,proto3" json:"dispatched,omitempty"`
+	Processed     int64 `protobuf:"varint,10,opt,name=processed,proto3" json:"processed,omitempty"`
+	End           int64 `protobuf:"varint,11,opt,name=end,proto3" json:"end,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Op) Reset() {
+	*x = Op{}
+	mi := &file_journalrpc_journal_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Op) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Op) ProtoMessage() {}
+
+func (x *Op) ProtoReflect() protoreflect.Message {
+	mi := &file_journalrpc_journal_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Op.ProtoReflect.Descriptor instead.
+func (*Op) Descriptor() ([]byte, []int) {
+	return file_journalrpc_journal_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Op) GetSide() string {
+	if x != nil {
+		return x.Side
+	}
+	return ""
+}
+
+func (x *Op) GetPeer() string {
+	if x != nil {
+		return x.Peer
+	}
+	return ""
+}
+
+func (x *Op) GetSeq() uint32 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Op) GetOp() string {
+	if x != nil {
+		return x.Op
+	}
+	return ""
+}
+
+func (x *Op) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *Op) GetSize() uint32 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Op) GetFailed() bool {
+	if x != nil {
+		return x.Failed
+	}
+	return false
+}
+
+func (x *Op) GetStart() int64 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *Op) GetDispatched() int64 {
+	if x != nil {
+		return x.Dispatched
+	}
+	return 0
+}
+
+func (x *Op) GetProcessed() int64 {
+	if x != nil {
+		return x.Processed
+	}
+	return 0
+}
+
+func (x *Op) GetEnd() int64 {
+	if x != nil {
+		return x.End
+	}
+	return 0
+}
+
+var File_journalrpc_journal_proto protoreflect.FileDescriptor
+
+const file_journalrpc_journal_proto_rawDesc = "" +
+	"\n" +
+	"\x18journalrpc/journal.proto\x12\n" +
+	"journalrpc\"%\n" +
+	"\rExportRequest\x12\x14\n" +
+	"\x05limit\x18\x01 \x01(\x03R\x05limit\"2\n" +
+	"\x0eExportResponse\x12 \n" +
+	"\x03ops\x18\x01 \x03(\v2\x0e.journalrpc.OpR\x03ops\"\xf8\x01\n" +
+	"\x02Op\x12\x12\n" +
+	"\x04side\x18\x01 \x01(\tR\x04side\x12\x12\n" +
+	"\x04peer\x18\x02 \x01(\tR\x04peer\x12\x10\n" +
+	"\x03seq\x18\x03 \x01(\rR\x03seq\x12\x0e\n" +
+	"\x02op\x18\x04 \x01(\tR\x02op\x12\x16\n" +
+	"\x06offset\x18\x05 \x01(\x03R\x06offset\x12\x12\n" +
+	"\x04size\x18\x06 \x01(\rR\x04size\x12\x16\n" +
+	"\x06failed\x18\a \x01(\bR\x06failed\x12\x14\n" +
+	"\x05start\x18\b \x01(\x03R\x05start\x12\x1e\n" +
+	"\n" +
+	"dispatched\x18\t \x01(\x03R\n" +
+	"dispatched\x12\x1c\n" +
+	"\tprocessed\x18\n" +
+	" \x01(\x03R\tprocessed\x12\x10\n" +
+	"\x03end\x18\v \x01(\x03R\x03end2Q\n" +
+	"\x0eJournalService\x12?\n" +
+	"\x06Export\x12\x19.journalrpc.ExportRequest\x1a\x1a.journalrpc.ExportResponseB>Z<github.com/longhorn/longhorn-engine/pkg/generated/journalrpcb\x06proto3"
+
+var (
+	file_journalrpc_journal_proto_rawDescOnce sync.Once
+	file_journalrpc_journal_proto_rawDescData []byte
+)
+
+func file_journalrpc_journal_proto_rawDescGZIP() []byte {
+	file_journalrpc_journal_proto_rawDescOnce.Do(func() {
+		file_journalrpc_journal_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_journalrpc_journal_proto_rawDesc), len(file_journalrpc_journal_proto_rawDesc)))
+	})
+	return file_journalrpc_journal_proto_rawDescData
+}
+
+var file_journalrpc_journal_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_journalrpc_journal_proto_goTypes = []any{
+	(*ExportRequest)(nil),  // 0: journalrpc.ExportRequest
+	(*ExportResponse)(nil), // 1: journalrpc.ExportResponse
+	(*Op)(nil),             // 2: journalrpc.Op
+}
+var file_journalrpc_journal_proto_depIdxs = []int32{
+	2, // 0: journalrpc.ExportResponse.ops:type_name -> journalrpc.Op
+	0, // 1: journalrpc.JournalService.Export:input_type -> journalrpc.ExportRequest
+	1, // 2: journalrpc.JournalService.Export:output_type -> journalrpc.ExportResponse
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_journalrpc_journal_proto_init() }
+func file_journalrpc_journal_proto_init() {
+	if File_journalrpc_journal_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_journalrpc_journal_proto_rawDesc), len(file_journalrpc_journal_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_journalrpc_journal_proto_goTypes,
+		DependencyIndexes: file_journalrpc_journal_proto_depIdxs,
+		MessageInfos:      file_journalrpc_journal_proto_msgTypes,
+	}.Build()
+	File_journalrpc_journal_proto = out.File
+	file_journalrpc_journal_proto_goTypes = nil
+	file_journalrpc_journal_proto_depIdxs = nil
+}
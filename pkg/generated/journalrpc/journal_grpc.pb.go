@@ -0,0 +1,109 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: journalrpc/journal.proto
+
+package journalrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	JournalService_Export_FullMethodName = "/journalrpc.JournalService/Export"
+)
+
+// JournalServiceClient is the client API for JournalService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type JournalServiceClient interface {
+	Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (*ExportResponse, error)
+}
+
+type journalServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewJournalServiceClient(cc grpc.ClientConnInterface) JournalServiceClient {
+	return &journalServiceClient{cc}
+}
+
+func (c *journalServiceClient) Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (*ExportResponse, error) {
+	out := new(ExportResponse)
+	err := c.cc.Invoke(ctx, JournalService_Export_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// JournalServiceServer is the server API for JournalService service.
+// All implementations must embed UnimplementedJournalServiceServer
+// for forward compatibility
+type JournalServiceServer interface {
+	Export(context.Context, *ExportRequest) (*ExportResponse, error)
+	mustEmbedUnimplementedJournalServiceServer()
+}
+
+// UnimplementedJournalServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedJournalServiceServer struct {
+}
+
+func (UnimplementedJournalServiceServer) Export(context.Context, *ExportRequest) (*ExportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Export not implemented")
+}
+func (UnimplementedJournalServiceServer) mustEmbedUnimplementedJournalServiceServer() {}
+
+// UnsafeJournalServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to JournalServiceServer will
+// result in compilation errors.
+type UnsafeJournalServiceServer interface {
+	mustEmbedUnimplementedJournalServiceServer()
+}
+
+func RegisterJournalServiceServer(s grpc.ServiceRegistrar, srv JournalServiceServer) {
+	s.RegisterService(&JournalService_ServiceDesc, srv)
+}
+
+func _JournalService_Export_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JournalServiceServer).Export(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: JournalService_Export_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JournalServiceServer).Export(ctx, req.(*ExportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// JournalService_ServiceDesc is the grpc.ServiceDesc for JournalService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var JournalService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "journalrpc.JournalService",
+	HandlerType: (*JournalServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Export",
+			Handler:    _JournalService_Export_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "journalrpc/journal.proto",
+}
@@ -0,0 +1,225 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: replicarpc/replica.proto
+
+package replicarpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Metrics struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Bytes of the aligned all-zero sectors found in writes since the replica process started. Only counted if the
+	// replica detects zeros.
+	ZeroBytesDetected uint64 `protobuf:"varint,1,opt,name=zero_bytes_detected,json=zeroBytesDetected,proto3" json:"zero_bytes_detected,omitempty"`
+	// Bytes of those sectors that were punched out of the volume head rather than written, since no snapshot below
+	// held data for them.
+	ZeroBytesSaved uint64 `protobuf:"varint,2,opt,name=zero_bytes_saved,json=zeroBytesSaved,proto3" json:"zero_bytes_saved,omitempty"`
+	// Connections open to the data server of the replica. A replica serving a controller has at least one.
+	DataConnections uint32 `protobuf:"varint,3,opt,name=data_connections,json=dataConnections,proto3" json:"data_connections,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Metrics) Reset() {
+	*x = Metrics{}
+	mi := &file_replicarpc_replica_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Metrics) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Metrics) ProtoMessage() {}
+
+func (x *Metrics) ProtoReflect() protoreflect.Message {
+	mi := &file_replicarpc_replica_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Metrics.ProtoReflect.Descriptor instead.
+func (*Metrics) Descriptor() ([]byte, []int) {
+	return file_replicarpc_replica_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Metrics) GetZeroBytesDetected() uint64 {
+	if x != nil {
+		return x.ZeroBytesDetected
+	}
+	return 0
+}
+
+func (x *Metrics) GetZeroBytesSaved() uint64 {
+	if x != nil {
+		return x.ZeroBytesSaved
+	}
+	return 0
+}
+
+func (x *Metrics) GetDataConnections() uint32 {
+	if x != nil {
+		return x.DataConnections
+	}
+	return 0
+}
+
+type BackingFile struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Path  string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Size  int64                  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	// SHA512 of the backing file as stored, like the checksum of a backing image.
+	Checksum      string `protobuf:"bytes,3,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BackingFile) Reset() {
+	*x = BackingFile{}
+	mi := &file_replicarpc_replica_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BackingFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BackingFile) ProtoMessage() {}
+
+func (x *BackingFile) ProtoReflect() protoreflect.Message {
+	mi := &file_replicarpc_replica_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BackingFile.ProtoReflect.Descriptor instead.
+func (*BackingFile) Descriptor() ([]byte, []int) {
+	return file_replicarpc_replica_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *BackingFile) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *BackingFile) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *BackingFile) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+var File_replicarpc_replica_proto protoreflect.FileDescriptor
+
+const file_replicarpc_replica_proto_rawDesc = "" +
+	"\n" +
+	"\x18replicarpc/replica.proto\x12\n" +
+	"replicarpc\x1a\x1bgoogle/protobuf/empty.proto\"\x8e\x01\n" +
+	"\aMetrics\x12.\n" +
+	"\x13zero_bytes_detected\x18\x01 \x01(\x04R\x11zeroBytesDetected\x12(\n" +
+	"\x10zero_bytes_saved\x18\x02 \x01(\x04R\x0ezeroBytesSaved\x12)\n" +
+	"\x10data_connections\x18\x03 \x01(\rR\x0fdataConnections\"Q\n" +
+	"\vBackingFile\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x03R\x04size\x12\x1a\n" +
+	"\bchecksum\x18\x03 \x01(\tR\bchecksum2\xd3\x01\n" +
+	"\x0eReplicaService\x129\n" +
+	"\n" +
+	"MetricsGet\x12\x16.google.protobuf.Empty\x1a\x13.replicarpc.Metrics\x12C\n" +
+	"\x11BackingFileRemove\x12\x16.google.protobuf.Empty\x1a\x16.google.protobuf.Empty\x12A\n" +
+	"\x0eBackingFileGet\x12\x16.google.protobuf.Empty\x1a\x17.replicarpc.BackingFileB>Z<github.com/longhorn/longhorn-engine/pkg/generated/replicarpcb\x06proto3"
+
+var (
+	file_replicarpc_replica_proto_rawDescOnce sync.Once
+	file_replicarpc_replica_proto_rawDescData []byte
+)
+
+func file_replicarpc_replica_proto_rawDescGZIP() []byte {
+	file_replicarpc_replica_proto_rawDescOnce.Do(func() {
+		file_replicarpc_replica_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_replicarpc_replica_proto_rawDesc), len(file_replicarpc_replica_proto_rawDesc)))
+	})
+	return file_replicarpc_replica_proto_rawDescData
+}
+
+var file_replicarpc_replica_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_replicarpc_replica_proto_goTypes = []any{
+	(*Metrics)(nil),       // 0: replicarpc.Metrics
+	(*BackingFile)(nil),   // 1: replicarpc.BackingFile
+	(*emptypb.Empty)(nil), // 2: google.protobuf.Empty
+}
+var file_replicarpc_replica_proto_depIdxs = []int32{
+	2, // 0: replicarpc.ReplicaService.MetricsGet:input_type -> google.protobuf.Empty
+	2, // 1: replicarpc.ReplicaService.BackingFileRemove:input_type -> google.protobuf.Empty
+	2, // 2: replicarpc.ReplicaService.BackingFileGet:input_type -> google.protobuf.Empty
+	0, // 3: replicarpc.ReplicaService.MetricsGet:output_type -> replicarpc.Metrics
+	2, // 4: replicarpc.ReplicaService.BackingFileRemove:output_type -> google.protobuf.Empty
+	1, // 5: replicarpc.ReplicaService.BackingFileGet:output_type -> replicarpc.BackingFile
+	3, // [3:6] is the sub-list for method output_type
+	0, // [0:3] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_replicarpc_replica_proto_init() }
+func file_replicarpc_replica_proto_init() {
+	if File_replicarpc_replica_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_replicarpc_replica_proto_rawDesc), len(file_replicarpc_replica_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_replicarpc_replica_proto_goTypes,
+		DependencyIndexes: file_replicarpc_replica_proto_depIdxs,
+		MessageInfos:      file_replicarpc_replica_proto_msgTypes,
+	}.Build()
+	File_replicarpc_replica_proto = out.File
+	file_replicarpc_replica_proto_goTypes = nil
+	file_replicarpc_replica_proto_depIdxs = nil
+}
@@ -0,0 +1,192 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: replicarpc/replica.proto
+
+package replicarpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ReplicaService_MetricsGet_FullMethodName        = "/replicarpc.ReplicaService/MetricsGet"
+	ReplicaService_BackingFileRemove_FullMethodName = "/replicarpc.ReplicaService/BackingFileRemove"
+	ReplicaService_BackingFileGet_FullMethodName    = "/replicarpc.ReplicaService/BackingFileGet"
+)
+
+// ReplicaServiceClient is the client API for ReplicaService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReplicaServiceClient interface {
+	MetricsGet(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Metrics, error)
+	// BackingFileRemove detaches the backing file from a flattened replica, whose oldest snapshot holds the data of
+	// the backing file. The replica keeps running without it, and is opened without it from then on.
+	BackingFileRemove(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// BackingFileGet returns the backing file the replica reads from, with the checksum computed when it was
+	// attached. The path is empty if the replica has no backing file.
+	BackingFileGet(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BackingFile, error)
+}
+
+type replicaServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReplicaServiceClient(cc grpc.ClientConnInterface) ReplicaServiceClient {
+	return &replicaServiceClient{cc}
+}
+
+func (c *replicaServiceClient) MetricsGet(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Metrics, error) {
+	out := new(Metrics)
+	err := c.cc.Invoke(ctx, ReplicaService_MetricsGet_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *replicaServiceClient) BackingFileRemove(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, ReplicaService_BackingFileRemove_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *replicaServiceClient) BackingFileGet(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BackingFile, error) {
+	out := new(BackingFile)
+	err := c.cc.Invoke(ctx, ReplicaService_BackingFileGet_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReplicaServiceServer is the server API for ReplicaService service.
+// All implementations must embed UnimplementedReplicaServiceServer
+// for forward compatibility
+type ReplicaServiceServer interface {
+	MetricsGet(context.Context, *emptypb.Empty) (*Metrics, error)
+	// BackingFileRemove detaches the backing file from a flattened replica, whose oldest snapshot holds the data of
+	// the backing file. The replica keeps running without it, and is opened without it from then on.
+	BackingFileRemove(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	// BackingFileGet returns the backing file the replica reads from, with the checksum computed when it was
+	// attached. The path is empty if the replica has no backing file.
+	BackingFileGet(context.Context, *emptypb.Empty) (*BackingFile, error)
+	mustEmbedUnimplementedReplicaServiceServer()
+}
+
+// UnimplementedReplicaServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedReplicaServiceServer struct {
+}
+
+func (UnimplementedReplicaServiceServer) MetricsGet(context.Context, *emptypb.Empty) (*Metrics, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MetricsGet not implemented")
+}
+func (UnimplementedReplicaServiceServer) BackingFileRemove(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BackingFileRemove not implemented")
+}
+func (UnimplementedReplicaServiceServer) BackingFileGet(context.Context, *emptypb.Empty) (*BackingFile, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BackingFileGet not implemented")
+}
+func (UnimplementedReplicaServiceServer) mustEmbedUnimplementedReplicaServiceServer() {}
+
+// UnsafeReplicaServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReplicaServiceServer will
+// result in compilation errors.
+type UnsafeReplicaServiceServer interface {
+	mustEmbedUnimplementedReplicaServiceServer()
+}
+
+func RegisterReplicaServiceServer(s grpc.ServiceRegistrar, srv ReplicaServiceServer) {
+	s.RegisterService(&ReplicaService_ServiceDesc, srv)
+}
+
+func _ReplicaService_MetricsGet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReplicaServiceServer).MetricsGet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReplicaService_MetricsGet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReplicaServiceServer).MetricsGet(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReplicaService_BackingFileRemove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReplicaServiceServer).BackingFileRemove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReplicaService_BackingFileRemove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReplicaServiceServer).BackingFileRemove(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReplicaService_BackingFileGet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReplicaServiceServer).BackingFileGet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReplicaService_BackingFileGet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReplicaServiceServer).BackingFileGet(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ReplicaService_ServiceDesc is the grpc.ServiceDesc for ReplicaService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ReplicaService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "replicarpc.ReplicaService",
+	HandlerType: (*ReplicaServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "MetricsGet",
+			Handler:    _ReplicaService_MetricsGet_Handler,
+		},
+		{
+			MethodName: "BackingFileRemove",
+			Handler:    _ReplicaService_BackingFileRemove_Handler,
+		},
+		{
+			MethodName: "BackingFileGet",
+			Handler:    _ReplicaService_BackingFileGet_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "replicarpc/replica.proto",
+}
@@ -0,0 +1,158 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: syncagentrpc/syncagent.proto
+
+package syncagentrpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type VolumeFlattenStatusResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	IsFlattening  bool                   `protobuf:"varint,1,opt,name=is_flattening,json=isFlattening,proto3" json:"is_flattening,omitempty"`
+	Error         string                 `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	Progress      int32                  `protobuf:"varint,3,opt,name=progress,proto3" json:"progress,omitempty"`
+	State         string                 `protobuf:"bytes,4,opt,name=state,proto3" json:"state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VolumeFlattenStatusResponse) Reset() {
+	*x = VolumeFlattenStatusResponse{}
+	mi := &file_syncagentrpc_syncagent_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VolumeFlattenStatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VolumeFlattenStatusResponse) ProtoMessage() {}
+
+func (x *VolumeFlattenStatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_syncagentrpc_syncagent_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VolumeFlattenStatusResponse.ProtoReflect.Descriptor instead.
+func (*VolumeFlattenStatusResponse) Descriptor() ([]byte, []int) {
+	return file_syncagentrpc_syncagent_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *VolumeFlattenStatusResponse) GetIsFlattening() bool {
+	if x != nil {
+		return x.IsFlattening
+	}
+	return false
+}
+
+func (x *VolumeFlattenStatusResponse) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *VolumeFlattenStatusResponse) GetProgress() int32 {
+	if x != nil {
+		return x.Progress
+	}
+	return 0
+}
+
+func (x *VolumeFlattenStatusResponse) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+var File_syncagentrpc_syncagent_proto protoreflect.FileDescriptor
+
+const file_syncagentrpc_syncagent_proto_rawDesc = "" +
+	"\n" +
+	"\x1csyncagentrpc/syncagent.proto\x12\fsyncagentrpc\x1a\x1bgoogle/protobuf/empty.proto\"\x8a\x01\n" +
+	"\x1bVolumeFlattenStatusResponse\x12#\n" +
+	"\ris_flattening\x18\x01 \x01(\bR\fisFlattening\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\x12\x1a\n" +
+	"\bprogress\x18\x03 \x01(\x05R\bprogress\x12\x14\n" +
+	"\x05state\x18\x04 \x01(\tR\x05state2\xad\x01\n" +
+	"\x10SyncAgentService\x12?\n" +
+	"\rVolumeFlatten\x12\x16.google.protobuf.Empty\x1a\x16.google.protobuf.Empty\x12X\n" +
+	"\x13VolumeFlattenStatus\x12\x16.google.protobuf.Empty\x1a).syncagentrpc.VolumeFlattenStatusResponseB@Z>github.com/longhorn/longhorn-engine/pkg/generated/syncagentrpcb\x06proto3"
+
+var (
+	file_syncagentrpc_syncagent_proto_rawDescOnce sync.Once
+	file_syncagentrpc_syncagent_proto_rawDescData []byte
+)
+
+func file_syncagentrpc_syncagent_proto_rawDescGZIP() []byte {
+	file_syncagentrpc_syncagent_proto_rawDescOnce.Do(func() {
+		file_syncagentrpc_syncagent_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_syncagentrpc_syncagent_proto_rawDesc), len(file_syncagentrpc_syncagent_proto_rawDesc)))
+	})
+	return file_syncagentrpc_syncagent_proto_rawDescData
+}
+
+var file_syncagentrpc_syncagent_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_syncagentrpc_syncagent_proto_goTypes = []any{
+	(*VolumeFlattenStatusResponse)(nil), // 0: syncagentrpc.VolumeFlattenStatusResponse
+	(*emptypb.Empty)(nil),               // 1: google.protobuf.Empty
+}
+var file_syncagentrpc_syncagent_proto_depIdxs = []int32{
+	1, // 0: syncagentrpc.SyncAgentService.VolumeFlatten:input_type -> google.protobuf.Empty
+	1, // 1: syncagentrpc.SyncAgentService.VolumeFlattenStatus:input_type -> google.protobuf.Empty
+	1, // 2: syncagentrpc.SyncAgentService.VolumeFlatten:output_type -> google.protobuf.Empty
+	0, // 3: syncagentrpc.SyncAgentService.VolumeFlattenStatus:output_type -> syncagentrpc.VolumeFlattenStatusResponse
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_syncagentrpc_syncagent_proto_init() }
+func file_syncagentrpc_syncagent_proto_init() {
+	if File_syncagentrpc_syncagent_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_syncagentrpc_syncagent_proto_rawDesc), len(file_syncagentrpc_syncagent_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_syncagentrpc_syncagent_proto_goTypes,
+		DependencyIndexes: file_syncagentrpc_syncagent_proto_depIdxs,
+		MessageInfos:      file_syncagentrpc_syncagent_proto_msgTypes,
+	}.Build()
+	File_syncagentrpc_syncagent_proto = out.File
+	file_syncagentrpc_syncagent_proto_goTypes = nil
+	file_syncagentrpc_syncagent_proto_depIdxs = nil
+}
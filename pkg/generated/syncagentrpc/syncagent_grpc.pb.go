@@ -0,0 +1,151 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: syncagentrpc/syncagent.proto
+
+package syncagentrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	SyncAgentService_VolumeFlatten_FullMethodName       = "/syncagentrpc.SyncAgentService/VolumeFlatten"
+	SyncAgentService_VolumeFlattenStatus_FullMethodName = "/syncagentrpc.SyncAgentService/VolumeFlattenStatus"
+)
+
+// SyncAgentServiceClient is the client API for SyncAgentService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SyncAgentServiceClient interface {
+	// VolumeFlatten copies the data of the backing file into the oldest snapshot of the replica and then detaches
+	// the backing file from the replica. It returns once the job is started, VolumeFlattenStatus reports on it.
+	VolumeFlatten(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	VolumeFlattenStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*VolumeFlattenStatusResponse, error)
+}
+
+type syncAgentServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSyncAgentServiceClient(cc grpc.ClientConnInterface) SyncAgentServiceClient {
+	return &syncAgentServiceClient{cc}
+}
+
+func (c *syncAgentServiceClient) VolumeFlatten(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, SyncAgentService_VolumeFlatten_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *syncAgentServiceClient) VolumeFlattenStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*VolumeFlattenStatusResponse, error) {
+	out := new(VolumeFlattenStatusResponse)
+	err := c.cc.Invoke(ctx, SyncAgentService_VolumeFlattenStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SyncAgentServiceServer is the server API for SyncAgentService service.
+// All implementations must embed UnimplementedSyncAgentServiceServer
+// for forward compatibility
+type SyncAgentServiceServer interface {
+	// VolumeFlatten copies the data of the backing file into the oldest snapshot of the replica and then detaches
+	// the backing file from the replica. It returns once the job is started, VolumeFlattenStatus reports on it.
+	VolumeFlatten(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	VolumeFlattenStatus(context.Context, *emptypb.Empty) (*VolumeFlattenStatusResponse, error)
+	mustEmbedUnimplementedSyncAgentServiceServer()
+}
+
+// UnimplementedSyncAgentServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedSyncAgentServiceServer struct {
+}
+
+func (UnimplementedSyncAgentServiceServer) VolumeFlatten(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VolumeFlatten not implemented")
+}
+func (UnimplementedSyncAgentServiceServer) VolumeFlattenStatus(context.Context, *emptypb.Empty) (*VolumeFlattenStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VolumeFlattenStatus not implemented")
+}
+func (UnimplementedSyncAgentServiceServer) mustEmbedUnimplementedSyncAgentServiceServer() {}
+
+// UnsafeSyncAgentServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SyncAgentServiceServer will
+// result in compilation errors.
+type UnsafeSyncAgentServiceServer interface {
+	mustEmbedUnimplementedSyncAgentServiceServer()
+}
+
+func RegisterSyncAgentServiceServer(s grpc.ServiceRegistrar, srv SyncAgentServiceServer) {
+	s.RegisterService(&SyncAgentService_ServiceDesc, srv)
+}
+
+func _SyncAgentService_VolumeFlatten_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncAgentServiceServer).VolumeFlatten(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncAgentService_VolumeFlatten_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncAgentServiceServer).VolumeFlatten(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SyncAgentService_VolumeFlattenStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SyncAgentServiceServer).VolumeFlattenStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SyncAgentService_VolumeFlattenStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SyncAgentServiceServer).VolumeFlattenStatus(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SyncAgentService_ServiceDesc is the grpc.ServiceDesc for SyncAgentService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SyncAgentService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "syncagentrpc.SyncAgentService",
+	HandlerType: (*SyncAgentServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "VolumeFlatten",
+			Handler:    _SyncAgentService_VolumeFlatten_Handler,
+		},
+		{
+			MethodName: "VolumeFlattenStatus",
+			Handler:    _SyncAgentService_VolumeFlattenStatus_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "syncagentrpc/syncagent.proto",
+}
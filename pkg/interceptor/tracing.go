@@ -0,0 +1,143 @@
+package interceptor
+
+import (
+	context "context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/longhorn-engine/pkg/tracing"
+)
+
+// metadataCarrier adapts gRPC metadata to the OpenTelemetry propagation.TextMapCarrier, so the trace context travels
+// in the "traceparent" and "tracestate" metadata keys.
+type metadataCarrier metadata.MD
+
+func (mc metadataCarrier) Get(key string) string {
+	values := metadata.MD(mc).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (mc metadataCarrier) Set(key, value string) {
+	metadata.MD(mc).Set(key, value)
+}
+
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for k := range mc {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// WithTracingServerInterceptor is chained after any other unary interceptor of the server.
+func WithTracingServerInterceptor() grpc.ServerOption {
+	return grpc.ChainUnaryInterceptor(tracingServerInterceptor())
+}
+
+// WithTracingServerStreamInterceptor is chained after any other stream interceptor of the server.
+func WithTracingServerStreamInterceptor() grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(tracingServerStreamInterceptor())
+}
+
+func tracingServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		ctx, span := startServerSpan(ctx, info.FullMethod)
+		defer func() {
+			endSpan(span, err)
+		}()
+
+		return handler(ctx, req)
+	}
+}
+
+func tracingServerStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+		defer func() {
+			endSpan(span, err)
+		}()
+
+		return handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func startServerSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	return tracing.Tracer().Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", method)))
+}
+
+// WithTracingClientInterceptor is chained after any other unary interceptor of the client.
+func WithTracingClientInterceptor() grpc.DialOption {
+	return grpc.WithChainUnaryInterceptor(tracingClientInterceptor())
+}
+
+// WithTracingClientStreamInterceptor is chained after any other stream interceptor of the client.
+func WithTracingClientStreamInterceptor() grpc.DialOption {
+	return grpc.WithChainStreamInterceptor(tracingClientStreamInterceptor())
+}
+
+func tracingClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req any, reply any, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) (err error) {
+		ctx, span := startClientSpan(ctx, method, cc.Target())
+		defer func() {
+			endSpan(span, err)
+		}()
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func tracingClientStreamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		// The span only covers setting up the stream. Its lifetime is up to the caller.
+		ctx, span := startClientSpan(ctx, method, cc.Target())
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		endSpan(span, err)
+		return stream, err
+	}
+}
+
+func startClientSpan(ctx context.Context, method, target string) (context.Context, trace.Span) {
+	ctx, span := tracing.Tracer().Start(tracing.ParentContext(ctx), method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", method),
+			attribute.String("server.address", target)))
+
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	}
+	tracing.EndSpan(span, err)
+}
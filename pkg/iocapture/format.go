@@ -0,0 +1,176 @@
+package iocapture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A capture file starts with a fixed-size header followed by fixed-size records, all in little endian:
+//
+//	header: magic [8]byte, version uint32, flags uint32, start time int64 (unix nanoseconds), volume size int64
+//	record: op uint8, status uint8, reserved uint16, length uint32, offset int64, start int64 (nanoseconds since the
+//	        start of the capture), duration int64 (nanoseconds), and the xxHash64 of the data uint64 if the file has
+//	        FlagDataHash set
+const (
+	Version = 1
+
+	FlagDataHash = uint32(1 << 0)
+
+	headerSize     = 32
+	recordSize     = 32
+	recordHashSize = 8
+)
+
+var magic = [8]byte{'L', 'H', 'I', 'O', 'C', 'A', 'P', 0}
+
+type Op uint8
+
+const (
+	OpRead  = Op(1)
+	OpWrite = Op(2)
+	OpUnmap = Op(3)
+	// OpFlush is recorded for the frontends that pass flushes down. It is skipped on replay.
+	OpFlush = Op(4)
+	// OpWriteZeroes zeroes a range without data, so it records no data hash.
+	OpWriteZeroes = Op(5)
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpUnmap:
+		return "unmap"
+	case OpFlush:
+		return "flush"
+	case OpWriteZeroes:
+		return "write-zeroes"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(op))
+}
+
+const (
+	statusOK     = uint8(0)
+	statusFailed = uint8(1)
+)
+
+type Header struct {
+	Version    uint32
+	Flags      uint32
+	StartTime  time.Time
+	VolumeSize int64
+}
+
+func (h *Header) HasDataHash() bool {
+	return h.Flags&FlagDataHash != 0
+}
+
+// Record is one captured request. Start is relative to the start of the capture. Hash is the xxHash64 of the data
+// read or written, and is 0 for unmaps or if the capture has no data hashes.
+type Record struct {
+	Op       Op
+	Failed   bool
+	Length   uint32
+	Offset   int64
+	Start    time.Duration
+	Duration time.Duration
+	Hash     uint64
+}
+
+func encodeHeader(h *Header) []byte {
+	buf := make([]byte, headerSize)
+	copy(buf[0:8], magic[:])
+	binary.LittleEndian.PutUint32(buf[8:12], h.Version)
+	binary.LittleEndian.PutUint32(buf[12:16], h.Flags)
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(h.StartTime.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(h.VolumeSize))
+	return buf
+}
+
+func encodeRecord(buf []byte, r *Record, withHash bool) []byte {
+	buf = buf[:recordSize]
+	buf[0] = uint8(r.Op)
+	buf[1] = statusOK
+	if r.Failed {
+		buf[1] = statusFailed
+	}
+	binary.LittleEndian.PutUint16(buf[2:4], 0)
+	binary.LittleEndian.PutUint32(buf[4:8], r.Length)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(r.Offset))
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(r.Start))
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(r.Duration))
+	if withHash {
+		buf = binary.LittleEndian.AppendUint64(buf, r.Hash)
+	}
+	return buf
+}
+
+// Reader reads a capture file record by record.
+type Reader struct {
+	Header Header
+
+	r   *bufio.Reader
+	buf []byte
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to read capture header")
+	}
+	if [8]byte(buf[0:8]) != magic {
+		return nil, fmt.Errorf("invalid capture file magic %q", buf[0:8])
+	}
+	h := Header{
+		Version:    binary.LittleEndian.Uint32(buf[8:12]),
+		Flags:      binary.LittleEndian.Uint32(buf[12:16]),
+		StartTime:  time.Unix(0, int64(binary.LittleEndian.Uint64(buf[16:24]))),
+		VolumeSize: int64(binary.LittleEndian.Uint64(buf[24:32])),
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported capture file version %v", h.Version)
+	}
+
+	size := recordSize
+	if h.HasDataHash() {
+		size += recordHashSize
+	}
+	return &Reader{
+		Header: h,
+		r:      br,
+		buf:    make([]byte, size),
+	}, nil
+}
+
+// Next returns the next record, or io.EOF after the last one. A record cut short at the end of the file, e.g. if
+// the controller crashed while capturing, is treated as the end of the file.
+func (r *Reader) Next() (*Record, error) {
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	rec := &Record{
+		Op:       Op(r.buf[0]),
+		Failed:   r.buf[1] == statusFailed,
+		Length:   binary.LittleEndian.Uint32(r.buf[4:8]),
+		Offset:   int64(binary.LittleEndian.Uint64(r.buf[8:16])),
+		Start:    time.Duration(binary.LittleEndian.Uint64(r.buf[16:24])),
+		Duration: time.Duration(binary.LittleEndian.Uint64(r.buf[24:32])),
+	}
+	if r.Header.HasDataHash() {
+		rec.Hash = binary.LittleEndian.Uint64(r.buf[recordSize:])
+	}
+	return rec, nil
+}
@@ -0,0 +1,119 @@
+package iocapture
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Recorder writes the requests going through a volume to a capture file. It is safe for concurrent use. Once writing
+// fails the rest of the requests are dropped, and the error is returned by Stop.
+type Recorder struct {
+	sync.Mutex
+
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	withHash bool
+	start    time.Time
+	buf      []byte
+
+	records int64
+	err     error
+}
+
+func NewRecorder(path string, volumeSize int64, withHash bool) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create capture file %v", path)
+	}
+
+	h := &Header{
+		Version:    Version,
+		StartTime:  time.Now(),
+		VolumeSize: volumeSize,
+	}
+	if withHash {
+		h.Flags |= FlagDataHash
+	}
+
+	writer := bufio.NewWriterSize(file, 1<<20)
+	if _, err := writer.Write(encodeHeader(h)); err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "failed to write capture header to %v", path)
+	}
+
+	return &Recorder{
+		path:     path,
+		file:     file,
+		writer:   writer,
+		withHash: withHash,
+		start:    h.StartTime,
+		buf:      make([]byte, recordSize+recordHashSize),
+	}, nil
+}
+
+func (r *Recorder) Path() string {
+	return r.path
+}
+
+// Record adds a request that started at start and has just completed. data is the buffer read or written, and is
+// only hashed if the capture has data hashes.
+func (r *Recorder) Record(op Op, offset int64, length uint32, data []byte, start time.Time, failed bool) {
+	if r == nil {
+		return
+	}
+
+	rec := Record{
+		Op:       op,
+		Failed:   failed,
+		Length:   length,
+		Offset:   offset,
+		Start:    start.Sub(r.start),
+		Duration: time.Since(start),
+	}
+	if r.withHash && data != nil {
+		rec.Hash = xxhash.Sum64(data)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.err != nil || r.file == nil {
+		return
+	}
+	if _, err := r.writer.Write(encodeRecord(r.buf, &rec, r.withHash)); err != nil {
+		logrus.WithError(err).Errorf("Failed to write to capture file %v, dropping the rest of the capture", r.path)
+		r.err = err
+		return
+	}
+	r.records++
+}
+
+// Stop flushes and closes the capture file, and returns the number of requests recorded.
+func (r *Recorder) Stop() (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file == nil {
+		return r.records, r.err
+	}
+
+	err := r.err
+	if err == nil {
+		err = r.writer.Flush()
+	}
+	if errClose := r.file.Close(); errClose != nil && err == nil {
+		err = errClose
+	}
+	r.file = nil
+	if err != nil {
+		return r.records, errors.Wrapf(err, "failed to write capture file %v", r.path)
+	}
+	return r.records, nil
+}
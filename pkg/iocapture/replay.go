@@ -0,0 +1,142 @@
+package iocapture
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+type ReplayOptions struct {
+	// Speed scales the pace of the capture, e.g. 2 replays it twice as fast. 0 issues the requests as fast as the
+	// concurrency allows.
+	Speed float64
+	// Concurrency is the maximum number of requests in flight.
+	Concurrency int
+	// Verify compares the hash of the data read with the captured one. It only makes sense if the target holds the
+	// same data as the captured volume did, e.g. a clone of its snapshot, since the data written on replay is made up.
+	Verify bool
+}
+
+type OpStats struct {
+	Count   int64         `json:"count"`
+	Failed  int64         `json:"failed"`
+	Bytes   int64         `json:"bytes"`
+	Latency time.Duration `json:"totalLatency"`
+}
+
+type ReplayResult struct {
+	Duration   time.Duration       `json:"duration"`
+	Skipped    int64               `json:"skipped"`
+	Mismatches int64               `json:"mismatches"`
+	Ops        map[string]*OpStats `json:"ops"`
+}
+
+// Replay issues the captured requests to target with the same offsets, lengths and relative timing. Writes use a
+// pattern derived from the offset rather than the original data, which the capture does not keep.
+func Replay(r *Reader, target types.ReaderWriterUnmapperAt, opts ReplayOptions) (*ReplayResult, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	verify := opts.Verify && r.Header.HasDataHash()
+	if opts.Verify && !verify {
+		logrus.Warn("The capture has no data hashes, reads will not be verified")
+	}
+
+	result := &ReplayResult{
+		Ops: map[string]*OpStats{},
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, opts.Concurrency)
+
+	start := time.Now()
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			return nil, err
+		}
+
+		if rec.Op != OpRead && rec.Op != OpWrite && rec.Op != OpUnmap && rec.Op != OpWriteZeroes {
+			result.Skipped++
+			continue
+		}
+
+		if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Start) / opts.Speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(rec *Record) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			issued := time.Now()
+			mismatch := false
+			var err error
+			switch rec.Op {
+			case OpRead:
+				buf := make([]byte, rec.Length)
+				_, err = target.ReadAt(buf, rec.Offset)
+				if err == nil && verify && !rec.Failed && xxhash.Sum64(buf) != rec.Hash {
+					mismatch = true
+				}
+			case OpWrite:
+				_, err = target.WriteAt(writePattern(rec.Offset, rec.Length), rec.Offset)
+			case OpUnmap:
+				_, err = target.UnmapAt(rec.Length, rec.Offset)
+			case OpWriteZeroes:
+				_, err = util.WriteZeroesAt(target, rec.Length, rec.Offset)
+			}
+			latency := time.Since(issued)
+
+			lock.Lock()
+			defer lock.Unlock()
+			stats, ok := result.Ops[rec.Op.String()]
+			if !ok {
+				stats = &OpStats{}
+				result.Ops[rec.Op.String()] = stats
+			}
+			stats.Count++
+			stats.Bytes += int64(rec.Length)
+			stats.Latency += latency
+			if err != nil {
+				stats.Failed++
+				logrus.WithError(err).Debugf("Failed to replay %v of %v bytes at offset %v", rec.Op, rec.Length, rec.Offset)
+			}
+			if mismatch {
+				result.Mismatches++
+			}
+		}(rec)
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// writePattern fills each 8-byte word with its offset in the volume, so the data written is not all zeros and a
+// misplaced write can be told apart.
+func writePattern(offset int64, length uint32) []byte {
+	buf := make([]byte, length)
+	for i := 0; i+8 <= len(buf); i += 8 {
+		binary.LittleEndian.PutUint64(buf[i:], uint64(offset)+uint64(i))
+	}
+	return buf
+}
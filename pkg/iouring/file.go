@@ -0,0 +1,96 @@
+package iouring
+
+import (
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/longhorn/sparse-tools/sparse"
+)
+
+// File is a file opened for direct I/O whose reads and writes go through a ring. Everything else, such as unmap and
+// the extent map, is done by the embedded sparse.DirectFileIoProcessor.
+type File struct {
+	*sparse.DirectFileIoProcessor
+
+	ring       *Ring
+	syncWrites bool
+}
+
+// OpenFile opens a file for direct I/O like sparse.NewDirectFileIoProcessor does. If syncWrites is set, every write
+// is linked to an fdatasync.
+func OpenFile(ring *Ring, name string, flag int, perm os.FileMode, syncWrites, isCreate bool) (*File, error) {
+	f, err := sparse.NewDirectFileIoProcessor(name, flag, perm, isCreate)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		DirectFileIoProcessor: f,
+		ring:                  ring,
+		syncWrites:            syncWrites,
+	}, nil
+}
+
+// ReadAt reads like os.File.ReadAt does. Unaligned buffers are read through an aligned copy, as direct I/O requires.
+func (f *File) ReadAt(data []byte, offset int64) (int, error) {
+	buf := data
+	if !isAligned(data) {
+		buf = sparse.AllocateAligned(len(data))
+	}
+
+	n := 0
+	var err error
+	for n < len(buf) {
+		var m int
+		m, err = f.ring.ReadAt(int(f.Fd()), buf[n:], offset+int64(n))
+		if err != nil {
+			err = &os.PathError{Op: "read", Path: f.Name(), Err: err}
+			break
+		}
+		if m == 0 {
+			err = io.EOF
+			break
+		}
+		n += m
+	}
+
+	if !isAligned(data) {
+		copy(data, buf[:n])
+	}
+	return n, err
+}
+
+// WriteAt writes like os.File.WriteAt does. Unaligned buffers are written through an aligned copy, as direct I/O
+// requires.
+func (f *File) WriteAt(data []byte, offset int64) (int, error) {
+	buf := data
+	if !isAligned(data) {
+		buf = sparse.AllocateAligned(len(data))
+		copy(buf, data)
+	}
+
+	n := 0
+	for n < len(buf) {
+		m, err := f.ring.WriteAt(int(f.Fd()), buf[n:], offset+int64(n), f.syncWrites)
+		if err != nil {
+			return n, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+		}
+		if m == 0 {
+			return n, &os.PathError{Op: "write", Path: f.Name(), Err: io.ErrShortWrite}
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// Sync flushes the data of the file to the disk through the ring.
+func (f *File) Sync() error {
+	if err := f.ring.Fsync(int(f.Fd())); err != nil {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+func isAligned(data []byte) bool {
+	return len(data) == 0 || uintptr(unsafe.Pointer(&data[0]))%sparse.BlockSize == 0
+}
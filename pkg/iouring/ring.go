@@ -0,0 +1,459 @@
+package iouring
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// The kernel ABI of io_uring, see include/uapi/linux/io_uring.h. Only what the ring needs is defined.
+const (
+	opNop    = 0
+	opReadv  = 1
+	opWritev = 2
+	opFsync  = 3
+
+	sqeIOLink     = 1 << 2
+	fsyncDatasync = 1
+
+	enterGetEvents = 1
+
+	featSingleMmap = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	// closeUserData marks the NOP submitted by Close to stop the completion goroutine.
+	closeUserData = ^uint64(0)
+)
+
+type sqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type cqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        sqringOffsets
+	cqOff        cqringOffsets
+}
+
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// request is one call of the ring. It is made of one SQE, or of a write and an fsync linked to it.
+type request struct {
+	sqes    []sqe
+	iov     unix.Iovec
+	pending int
+	// res is the result of the first SQE, err the first error of all of them.
+	res  int32
+	err  error
+	done chan struct{}
+}
+
+// Ring submits reads, writes and fsyncs to an io_uring instance shared by any number of goroutines. Requests are
+// queued to a submission goroutine, which puts all the requests queued so far into the submission queue and enters
+// the kernel once for the batch. A completion goroutine reaps the completion queue and wakes up the callers.
+type Ring struct {
+	fd int
+
+	sqRing     []byte
+	cqRing     []byte
+	singleMmap bool
+	sqeMem     []byte
+	sqTail     *uint32
+	sqMask     uint32
+	sqArray    []uint32
+	sqes       []sqe
+	cqHead     *uint32
+	cqTail     *uint32
+	cqMask     uint32
+	cqes       []cqe
+	entries    uint32
+
+	// slots limits the SQEs in flight to the size of the submission queue, so the submission queue always has room
+	// for a batch and the completion queue, at least as large, cannot overflow.
+	slots     chan struct{}
+	slotsLock sync.Mutex
+	requests  chan *request
+
+	lock     sync.Mutex
+	closed   bool
+	nextID   uint64
+	inflight map[uint64]*request
+
+	submitterDone chan struct{}
+	reaperDone    chan struct{}
+	submitted     atomic.Uint64
+	batches       atomic.Uint64
+}
+
+// ErrNotSupported is returned by NewRing if the kernel has no io_uring, or if io_uring is disabled for the process.
+var ErrNotSupported = errors.New("io_uring is not supported")
+
+// NewRing creates a ring with room for entries SQEs in flight.
+func NewRing(entries uint32) (*Ring, error) {
+	p := params{}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EPERM {
+			return nil, errors.Wrapf(ErrNotSupported, "failed to set up io_uring: %v", errno)
+		}
+		return nil, errors.Wrap(errno, "failed to set up io_uring")
+	}
+
+	r := &Ring{
+		fd:            int(fd),
+		entries:       p.sqEntries,
+		slots:         make(chan struct{}, p.sqEntries),
+		requests:      make(chan *request, p.sqEntries),
+		inflight:      map[uint64]*request{},
+		submitterDone: make(chan struct{}),
+		reaperDone:    make(chan struct{}),
+	}
+	if err := r.mmap(&p); err != nil {
+		r.unmap()
+		_ = unix.Close(r.fd)
+		return nil, err
+	}
+
+	go r.submit()
+	go r.reap()
+	return r, nil
+}
+
+func (r *Ring) mmap(p *params) (err error) {
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(cqe{})))
+	r.singleMmap = p.features&featSingleMmap != 0
+	if r.singleMmap {
+		sqSize = max(sqSize, cqSize)
+	}
+
+	prot := unix.PROT_READ | unix.PROT_WRITE
+	flags := unix.MAP_SHARED | unix.MAP_POPULATE
+	if r.sqRing, err = unix.Mmap(r.fd, offSQRing, sqSize, prot, flags); err != nil {
+		return errors.Wrap(err, "failed to map io_uring submission queue")
+	}
+	if r.singleMmap {
+		r.cqRing = r.sqRing
+	} else if r.cqRing, err = unix.Mmap(r.fd, offCQRing, cqSize, prot, flags); err != nil {
+		return errors.Wrap(err, "failed to map io_uring completion queue")
+	}
+	sqeSize := int(p.sqEntries) * int(unsafe.Sizeof(sqe{}))
+	if r.sqeMem, err = unix.Mmap(r.fd, offSQEs, sqeSize, prot, flags); err != nil {
+		return errors.Wrap(err, "failed to map io_uring submission queue entries")
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+func (r *Ring) unmap() {
+	if r.sqeMem != nil {
+		_ = unix.Munmap(r.sqeMem)
+	}
+	if r.cqRing != nil && !r.singleMmap {
+		_ = unix.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		_ = unix.Munmap(r.sqRing)
+	}
+}
+
+// Close stops the ring. It must not be called while requests are in flight.
+func (r *Ring) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.lock.Unlock()
+
+	close(r.requests)
+	<-r.submitterDone
+	<-r.reaperDone
+
+	r.unmap()
+	return unix.Close(r.fd)
+}
+
+// Stats returns the number of SQEs submitted and the number of batches they were submitted in.
+func (r *Ring) Stats() (submitted, batches uint64) {
+	return r.submitted.Load(), r.batches.Load()
+}
+
+// ReadAt reads len(buf) bytes at offset of fd, or less at the end of the file. The buffer must stay valid until the
+// call returns, which it does since the call waits for the completion.
+func (r *Ring) ReadAt(fd int, buf []byte, offset int64) (int, error) {
+	return r.rw(opReadv, fd, buf, offset, false)
+}
+
+// WriteAt writes buf at offset of fd. If sync is set, an fdatasync linked to the write is submitted with it, so the
+// data is durable when the call returns.
+func (r *Ring) WriteAt(fd int, buf []byte, offset int64, sync bool) (int, error) {
+	return r.rw(opWritev, fd, buf, offset, sync)
+}
+
+// Fsync flushes the data of fd to the disk.
+func (r *Ring) Fsync(fd int) error {
+	req := &request{sqes: []sqe{{opcode: opFsync, fd: int32(fd), opFlags: fsyncDatasync}}}
+	_, err := r.do(req)
+	return err
+}
+
+func (r *Ring) rw(opcode uint8, fd int, buf []byte, offset int64, sync bool) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	req := &request{}
+	req.iov.Base = &buf[0]
+	req.iov.SetLen(len(buf))
+	req.sqes = []sqe{{
+		opcode: opcode,
+		fd:     int32(fd),
+		off:    uint64(offset),
+		addr:   uint64(uintptr(unsafe.Pointer(&req.iov))),
+		len:    1,
+	}}
+	if sync {
+		req.sqes[0].flags |= sqeIOLink
+		req.sqes = append(req.sqes, sqe{opcode: opFsync, fd: int32(fd), opFlags: fsyncDatasync})
+	}
+	return r.do(req)
+}
+
+func (r *Ring) do(req *request) (int, error) {
+	req.pending = len(req.sqes)
+	req.done = make(chan struct{})
+
+	// Requests of more than one SQE take their slots under a lock. Otherwise concurrent requests could each hold
+	// part of the slots they need and wait for each other forever.
+	r.slotsLock.Lock()
+	for range req.sqes {
+		r.slots <- struct{}{}
+	}
+	r.slotsLock.Unlock()
+
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		for range req.sqes {
+			<-r.slots
+		}
+		return 0, fmt.Errorf("io_uring is closed")
+	}
+	for i := range req.sqes {
+		r.nextID++
+		req.sqes[i].userData = r.nextID
+		r.inflight[r.nextID] = req
+	}
+	r.requests <- req
+	r.lock.Unlock()
+
+	<-req.done
+	return int(req.res), req.err
+}
+
+// submit puts the queued requests into the submission queue and enters the kernel once per batch.
+func (r *Ring) submit() {
+	defer close(r.submitterDone)
+
+	for {
+		req, ok := <-r.requests
+		if !ok {
+			r.pushNop()
+			return
+		}
+
+		count := r.push(req)
+	batch:
+		for {
+			select {
+			case req, ok := <-r.requests:
+				if !ok {
+					break batch
+				}
+				count += r.push(req)
+			default:
+				break batch
+			}
+		}
+		r.enter(count)
+	}
+}
+
+func (r *Ring) push(req *request) uint32 {
+	tail := *r.sqTail
+	for i := range req.sqes {
+		index := (tail + uint32(i)) & r.sqMask
+		r.sqes[index] = req.sqes[i]
+		r.sqArray[index] = index
+	}
+	atomic.StoreUint32(r.sqTail, tail+uint32(len(req.sqes)))
+	return uint32(len(req.sqes))
+}
+
+func (r *Ring) pushNop() {
+	tail := *r.sqTail
+	index := tail & r.sqMask
+	r.sqes[index] = sqe{opcode: opNop, userData: closeUserData}
+	r.sqArray[index] = index
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.enter(1)
+}
+
+func (r *Ring) enter(count uint32) {
+	r.batches.Add(1)
+	r.submitted.Add(uint64(count))
+	for count > 0 {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(count), 0, 0, 0, 0)
+		if errno == unix.EINTR || errno == unix.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			// The kernel did not take the SQEs, so they will not complete. Nothing else can be done with them
+			// since the submission queue is in an unknown state.
+			logrus.WithError(errno).Error("Failed to submit to io_uring")
+			r.failAll(errno)
+			return
+		}
+		count -= uint32(n)
+	}
+}
+
+// reap waits for completions and wakes up the callers of the completed requests.
+func (r *Ring) reap() {
+	defer close(r.reaperDone)
+
+	for {
+		head := atomic.LoadUint32(r.cqHead)
+		if head == atomic.LoadUint32(r.cqTail) {
+			_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), 0, 1, enterGetEvents, 0, 0)
+			if errno != 0 && errno != unix.EINTR && errno != unix.EAGAIN {
+				logrus.WithError(errno).Error("Failed to wait for io_uring completions")
+				r.failAll(errno)
+				return
+			}
+			continue
+		}
+
+		closing := false
+		for tail := atomic.LoadUint32(r.cqTail); head != tail; head++ {
+			c := r.cqes[head&r.cqMask]
+			if c.userData == closeUserData {
+				closing = true
+				continue
+			}
+			r.complete(c)
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		if closing {
+			return
+		}
+	}
+}
+
+func (r *Ring) complete(c cqe) {
+	r.lock.Lock()
+	req, ok := r.inflight[c.userData]
+	delete(r.inflight, c.userData)
+	r.lock.Unlock()
+	<-r.slots
+	if !ok {
+		return
+	}
+
+	if c.userData == req.sqes[0].userData {
+		req.res = c.res
+	}
+	// An SQE linked to a short or failed write is canceled. The result of the write tells what happened.
+	canceled := c.userData != req.sqes[0].userData && c.res == -int32(unix.ECANCELED)
+	if c.res < 0 && req.err == nil && !canceled {
+		req.err = syscall.Errno(-c.res)
+	}
+	req.pending--
+	if req.pending == 0 {
+		close(req.done)
+	}
+}
+
+func (r *Ring) failAll(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for id, req := range r.inflight {
+		delete(r.inflight, id)
+		<-r.slots
+		if req.err == nil {
+			req.err = err
+		}
+		req.pending--
+		if req.pending == 0 {
+			close(req.done)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package opjournal
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+	"github.com/longhorn/longhorn-engine/pkg/generated/journalrpc"
+	"github.com/longhorn/longhorn-engine/pkg/interceptor"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+const (
+	GRPCServiceTimeout = 1 * time.Minute
+)
+
+type Client struct {
+	serviceURL string
+	conn       *grpc.ClientConn
+	service    journalrpc.JournalServiceClient
+}
+
+// NewClient returns a client of the journal service served on the gRPC address of a controller or a replica.
+func NewClient(address, volumeName, instanceName string) (*Client, error) {
+	serviceURL := util.GetGRPCAddress(address)
+	conn, err := grpc.NewClient(serviceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		interceptor.WithIdentityValidationClientInterceptor(volumeName, instanceName),
+		interceptor.WithTracingClientInterceptor())
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to journal service %v", serviceURL)
+	}
+
+	return &Client{
+		serviceURL: serviceURL,
+		conn:       conn,
+		service:    journalrpc.NewJournalServiceClient(conn),
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Export returns up to limit of the latest completed ops and all the in-flight ops. See dataconn.ExportJournal.
+func (c *Client) Export(limit int) ([]dataconn.JournalOp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceTimeout)
+	defer cancel()
+
+	resp, err := c.service.Export(ctx, &journalrpc.ExportRequest{Limit: int64(limit)})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to export journal from %v", c.serviceURL)
+	}
+
+	ops := make([]dataconn.JournalOp, 0, len(resp.Ops))
+	for _, op := range resp.Ops {
+		ops = append(ops, dataconn.JournalOp{
+			Side:       op.Side,
+			Peer:       op.Peer,
+			Seq:        op.Seq,
+			Op:         op.Op,
+			Offset:     op.Offset,
+			Size:       op.Size,
+			Failed:     op.Failed,
+			Start:      unixNanoToTime(op.Start),
+			Dispatched: unixNanoToTime(op.Dispatched),
+			Processed:  unixNanoToTime(op.Processed),
+			End:        unixNanoToTime(op.End),
+		})
+	}
+	return ops, nil
+}
+
+func timeToUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func unixNanoToTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
@@ -0,0 +1,191 @@
+package opjournal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+)
+
+// Process is the journal exported from one controller or replica process.
+type Process struct {
+	Name string               `json:"name"`
+	Ops  []dataconn.JournalOp `json:"ops"`
+}
+
+// traceEvent is an event of the Chrome JSON trace format, which Perfetto loads as well. Timestamps and durations
+// are in microseconds.
+type traceEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`
+	Ts   float64        `json:"ts"`
+	Dur  float64        `json:"dur,omitempty"`
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+type traceFile struct {
+	TraceEvents     []traceEvent `json:"traceEvents"`
+	DisplayTimeUnit string       `json:"displayTimeUnit"`
+}
+
+// WriteJSON writes the ops of the processes as they are.
+func WriteJSON(w io.Writer, processes []Process) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(processes)
+}
+
+// WritePerfetto writes the ops of the processes as a trace that can be opened in Perfetto (ui.perfetto.dev) or
+// chrome://tracing. Every process gets a track group, and the ops of each side and peer are spread over as many tracks as
+// needed to keep concurrent ops apart. An op is a slice with a child slice for each of its phases. In-flight ops are
+// cut at exportedAt and marked pending.
+func WritePerfetto(w io.Writer, processes []Process, exportedAt time.Time) error {
+	events := []traceEvent{}
+	for i, p := range processes {
+		pid := i + 1
+		events = append(events, traceEvent{
+			Name: "process_name",
+			Ph:   "M",
+			Pid:  pid,
+			Args: map[string]any{"name": p.Name},
+		})
+		events = append(events, processEvents(pid, p.Ops, exportedAt)...)
+	}
+
+	return json.NewEncoder(w).Encode(traceFile{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ns",
+	})
+}
+
+func processEvents(pid int, ops []dataconn.JournalOp, exportedAt time.Time) []traceEvent {
+	byPeer := map[string][]dataconn.JournalOp{}
+	peers := []string{}
+	for _, op := range ops {
+		peer := op.Side + " " + op.Peer
+		if _, ok := byPeer[peer]; !ok {
+			peers = append(peers, peer)
+		}
+		byPeer[peer] = append(byPeer[peer], op)
+	}
+	sort.Strings(peers)
+
+	events := []traceEvent{}
+	tid := 0
+	for _, peer := range peers {
+		peerOps := byPeer[peer]
+		sort.SliceStable(peerOps, func(a, b int) bool {
+			return peerOps[a].Start.Before(peerOps[b].Start)
+		})
+
+		// Slices on the same track have to nest, so an op goes to the first track that is free when it starts.
+		laneEnds := []time.Time{}
+		laneTids := []int{}
+		for _, op := range peerOps {
+			end := op.End
+			if op.Pending() {
+				end = exportedAt
+			}
+
+			lane := -1
+			for l, laneEnd := range laneEnds {
+				if !op.Start.Before(laneEnd) {
+					lane = l
+					break
+				}
+			}
+			if lane < 0 {
+				tid++
+				lane = len(laneEnds)
+				laneEnds = append(laneEnds, time.Time{})
+				laneTids = append(laneTids, tid)
+				events = append(events, traceEvent{
+					Name: "thread_name",
+					Ph:   "M",
+					Pid:  pid,
+					Tid:  tid,
+					Args: map[string]any{"name": fmt.Sprintf("%v #%d", peer, lane)},
+				})
+			}
+			laneEnds[lane] = end
+
+			events = append(events, opEvents(pid, laneTids[lane], op, end)...)
+		}
+	}
+	return events
+}
+
+func opEvents(pid, tid int, op dataconn.JournalOp, end time.Time) []traceEvent {
+	events := []traceEvent{
+		{
+			Name: op.Op,
+			Cat:  op.Side,
+			Ph:   "X",
+			Ts:   toMicroseconds(op.Start),
+			Dur:  durationMicroseconds(op.Start, end),
+			Pid:  pid,
+			Tid:  tid,
+			Args: map[string]any{
+				"peer":    op.Peer,
+				"seq":     op.Seq,
+				"offset":  op.Offset,
+				"size":    op.Size,
+				"failed":  op.Failed,
+				"pending": op.Pending(),
+			},
+		},
+	}
+
+	work := "remote"
+	if op.Side == dataconn.JournalSideServer {
+		work = "disk"
+	}
+	phases := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+	}{
+		{"queue", op.Start, op.Dispatched},
+		{work, op.Dispatched, op.Processed},
+		{"reply", op.Processed, op.End},
+	}
+	for _, phase := range phases {
+		if phase.start.IsZero() {
+			break
+		}
+		phaseEnd := phase.end
+		if phaseEnd.IsZero() {
+			phaseEnd = end
+		}
+		events = append(events, traceEvent{
+			Name: phase.name,
+			Cat:  op.Side,
+			Ph:   "X",
+			Ts:   toMicroseconds(phase.start),
+			Dur:  durationMicroseconds(phase.start, phaseEnd),
+			Pid:  pid,
+			Tid:  tid,
+		})
+		if phase.end.IsZero() {
+			break
+		}
+	}
+	return events
+}
+
+func toMicroseconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Microsecond)
+}
+
+func durationMicroseconds(start, end time.Time) float64 {
+	if end.Before(start) {
+		return 0
+	}
+	return float64(end.Sub(start)) / float64(time.Microsecond)
+}
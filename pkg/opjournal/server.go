@@ -0,0 +1,49 @@
+package opjournal
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/longhorn/longhorn-engine/pkg/dataconn"
+	"github.com/longhorn/longhorn-engine/pkg/generated/journalrpc"
+)
+
+// Server exports the dataconn op journal of this process. It is registered on both the controller and the replica
+// gRPC servers.
+type Server struct {
+	journalrpc.UnimplementedJournalServiceServer
+}
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func (s *Server) Export(ctx context.Context, req *journalrpc.ExportRequest) (*journalrpc.ExportResponse, error) {
+	if !dataconn.JournalEnabled() {
+		return nil, status.Error(codes.FailedPrecondition, "op journal is not enabled, start the process with --enable-op-journal")
+	}
+
+	ops := dataconn.ExportJournal(int(req.Limit))
+
+	resp := &journalrpc.ExportResponse{
+		Ops: make([]*journalrpc.Op, 0, len(ops)),
+	}
+	for _, op := range ops {
+		resp.Ops = append(resp.Ops, &journalrpc.Op{
+			Side:       op.Side,
+			Peer:       op.Peer,
+			Seq:        op.Seq,
+			Op:         op.Op,
+			Offset:     op.Offset,
+			Size:       op.Size,
+			Failed:     op.Failed,
+			Start:      timeToUnixNano(op.Start),
+			Dispatched: timeToUnixNano(op.Dispatched),
+			Processed:  timeToUnixNano(op.Processed),
+			End:        timeToUnixNano(op.End),
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,349 @@
+package qcow
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	be = binary.BigEndian
+
+	// Magic starts every qcow image
+	Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+	ErrReadOnly = errors.New("qcow2 image is read-only")
+)
+
+const (
+	headerV2Size = 72
+	headerV3Size = 104
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// Incompatible feature bits
+	incompatDirty        = 1 << 0
+	incompatCorrupt      = 1 << 1
+	incompatExternalData = 1 << 2
+	incompatCompression  = 1 << 3
+	incompatExtendedL2   = 1 << 4
+
+	compressionDeflate = 0
+
+	// offsetMask is the host offset bits of the L1 and L2 entries
+	offsetMask      = 0x00fffffffffffe00
+	entryCopied     = 1 << 63
+	entryCompressed = 1 << 62
+	entryZero       = 1 << 0
+
+	// l2CacheSize is how many L2 tables are kept in memory
+	l2CacheSize = 64
+)
+
+// Qcow is a qcow2 image opened read-only. Clusters that are not allocated read zeros, since images with a backing
+// file are not supported.
+type Qcow struct {
+	file *os.File
+
+	size        int64
+	clusterBits uint
+	clusterSize int64
+	l2Bits      uint
+	l1          []uint64
+
+	// lock guards the caches
+	lock              sync.Mutex
+	l2Cache           map[uint64][]uint64
+	compressedOffset  uint64
+	compressedCluster []byte
+}
+
+// header is the part of the qcow2 header the reader needs.
+type header struct {
+	version              uint32
+	backingFileOffset    uint64
+	backingFileSize      uint32
+	clusterBits          uint32
+	size                 uint64
+	cryptMethod          uint32
+	l1Size               uint32
+	l1TableOffset        uint64
+	incompatibleFeatures uint64
+	compressionType      uint8
+	headerLength         uint32
+}
+
+// IsQcow tells whether r starts with the qcow magic.
+func IsQcow(r io.ReaderAt) (bool, error) {
+	buf := make([]byte, len(Magic))
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(buf, Magic), nil
+}
+
+func readHeader(r io.ReaderAt) (*header, error) {
+	buf := make([]byte, headerV3Size+8)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n < headerV2Size || !bytes.Equal(buf[:4], Magic) {
+		return nil, fmt.Errorf("not a qcow2 image")
+	}
+	h := &header{
+		version:           be.Uint32(buf[4:]),
+		backingFileOffset: be.Uint64(buf[8:]),
+		backingFileSize:   be.Uint32(buf[16:]),
+		clusterBits:       be.Uint32(buf[20:]),
+		size:              be.Uint64(buf[24:]),
+		cryptMethod:       be.Uint32(buf[32:]),
+		l1Size:            be.Uint32(buf[36:]),
+		l1TableOffset:     be.Uint64(buf[40:]),
+		headerLength:      headerV2Size,
+	}
+	switch h.version {
+	case 2:
+	case 3:
+		if n < headerV3Size {
+			return nil, fmt.Errorf("truncated qcow2 version 3 header")
+		}
+		h.incompatibleFeatures = be.Uint64(buf[72:])
+		h.headerLength = be.Uint32(buf[100:])
+		if h.headerLength > headerV3Size && n > headerV3Size {
+			h.compressionType = buf[headerV3Size]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow version %v", h.version)
+	}
+	return h, nil
+}
+
+// check refuses the images the reader cannot present faithfully.
+func (h *header) check() error {
+	if h.clusterBits < minClusterBits || h.clusterBits > maxClusterBits {
+		return fmt.Errorf("invalid qcow2 cluster bits %v", h.clusterBits)
+	}
+	if h.size > 1<<62 {
+		return fmt.Errorf("invalid qcow2 virtual size %v", h.size)
+	}
+	if h.backingFileOffset != 0 {
+		return fmt.Errorf("qcow2 image has a backing file, which is not supported")
+	}
+	if h.cryptMethod != 0 {
+		return fmt.Errorf("qcow2 image is encrypted with method %v, which is not supported", h.cryptMethod)
+	}
+	if h.incompatibleFeatures&incompatCorrupt != 0 {
+		return fmt.Errorf("qcow2 image is marked corrupt")
+	}
+	if h.incompatibleFeatures&incompatExternalData != 0 {
+		return fmt.Errorf("qcow2 image has an external data file, which is not supported")
+	}
+	if h.incompatibleFeatures&incompatExtendedL2 != 0 {
+		return fmt.Errorf("qcow2 image has extended L2 entries, which are not supported")
+	}
+	if h.incompatibleFeatures&incompatCompression != 0 && h.compressionType != compressionDeflate {
+		return fmt.Errorf("qcow2 image uses compression type %v, which is not supported", h.compressionType)
+	}
+	if unknown := h.incompatibleFeatures &^ (incompatDirty | incompatCorrupt | incompatExternalData |
+		incompatCompression | incompatExtendedL2); unknown != 0 {
+		return fmt.Errorf("qcow2 image has unknown incompatible features 0x%x", unknown)
+	}
+	clusterSize := uint64(1) << h.clusterBits
+	l2Entries := clusterSize / 8
+	if need := (h.size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries); uint64(h.l1Size) < need {
+		return fmt.Errorf("qcow2 L1 table of %v entries is too small for %v bytes", h.l1Size, h.size)
+	}
+	if h.l1TableOffset%clusterSize != 0 {
+		return fmt.Errorf("qcow2 L1 table offset %v is not aligned", h.l1TableOffset)
+	}
+	return nil
+}
+
+// Open opens the qcow2 image at path for reading.
+func Open(path string) (*Qcow, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	q, err := newQcow(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "failed to open qcow2 image %v", path)
+	}
+	return q, nil
+}
+
+func newQcow(file *os.File) (*Qcow, error) {
+	h, err := readHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+
+	q := &Qcow{
+		file:             file,
+		size:             int64(h.size),
+		clusterBits:      uint(h.clusterBits),
+		clusterSize:      1 << h.clusterBits,
+		l2Bits:           uint(h.clusterBits) - 3,
+		l2Cache:          map[uint64][]uint64{},
+		compressedOffset: ^uint64(0),
+	}
+	raw := make([]byte, int(h.l1Size)*8)
+	if _, err := file.ReadAt(raw, int64(h.l1TableOffset)); err != nil {
+		return nil, errors.Wrap(err, "failed to read the L1 table")
+	}
+	q.l1 = make([]uint64, h.l1Size)
+	for i := range q.l1 {
+		q.l1[i] = be.Uint64(raw[i*8:])
+	}
+	return q, nil
+}
+
+func (q *Qcow) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (q *Qcow) UnmapAt(length uint32, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// ReadAt reads the virtual disk. Reads beyond its end return io.EOF.
+func (q *Qcow) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset %v", off)
+	}
+	if off >= q.size {
+		return 0, io.EOF
+	}
+	count := 0
+	for count < len(buf) && off < q.size {
+		inCluster := off & (q.clusterSize - 1)
+		n := int(min(int64(len(buf)-count), q.clusterSize-inCluster, q.size-off))
+		if err := q.readCluster(buf[count:count+n], off); err != nil {
+			return count, err
+		}
+		count += n
+		off += int64(n)
+	}
+	if count < len(buf) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// readCluster reads buf, which is within a single cluster, at off.
+func (q *Qcow) readCluster(buf []byte, off int64) error {
+	entry, err := q.l2Entry(uint64(off) >> q.clusterBits)
+	if err != nil {
+		return err
+	}
+	inCluster := off & (q.clusterSize - 1)
+
+	switch {
+	case entry&entryCompressed != 0:
+		cluster, err := q.compressedClusterData(entry)
+		if err != nil {
+			return err
+		}
+		copy(buf, cluster[inCluster:])
+	case entry&entryZero != 0 || entry&offsetMask == 0:
+		clear(buf)
+	default:
+		hostOffset := int64(entry&offsetMask) + inCluster
+		if _, err := q.file.ReadAt(buf, hostOffset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("qcow2 cluster at %v is beyond the end of the image", hostOffset)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// l2Entry returns the L2 entry of a virtual cluster, or 0 if its L2 table is not allocated.
+func (q *Qcow) l2Entry(cluster uint64) (uint64, error) {
+	l1Index := cluster >> q.l2Bits
+	if l1Index >= uint64(len(q.l1)) {
+		return 0, fmt.Errorf("qcow2 cluster %v is beyond the L1 table", cluster)
+	}
+	l2Offset := q.l1[l1Index] & offsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	table, ok := q.l2Cache[l2Offset]
+	if !ok {
+		raw := make([]byte, q.clusterSize)
+		if _, err := q.file.ReadAt(raw, int64(l2Offset)); err != nil {
+			return 0, errors.Wrapf(err, "failed to read the L2 table at %v", l2Offset)
+		}
+		table = make([]uint64, q.clusterSize/8)
+		for i := range table {
+			table[i] = be.Uint64(raw[i*8:])
+		}
+		if len(q.l2Cache) >= l2CacheSize {
+			for k := range q.l2Cache {
+				delete(q.l2Cache, k)
+				break
+			}
+		}
+		q.l2Cache[l2Offset] = table
+	}
+	return table[cluster&(1<<q.l2Bits-1)], nil
+}
+
+// compressedClusterData returns the cluster of a compressed L2 entry, which is a raw deflate stream.
+func (q *Qcow) compressedClusterData(entry uint64) ([]byte, error) {
+	offsetBits := 62 - (q.clusterBits - 8)
+	hostOffset := entry & (1<<offsetBits - 1)
+	sectors := (entry&(1<<62-1))>>offsetBits + 1
+	length := int64(sectors*512 - hostOffset%512)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.compressedOffset == hostOffset {
+		return q.compressedCluster, nil
+	}
+
+	compressed := make([]byte, length)
+	n, err := q.file.ReadAt(compressed, int64(hostOffset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	cluster := make([]byte, q.clusterSize)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), cluster); err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress the qcow2 cluster at %v", hostOffset)
+	}
+	q.compressedOffset, q.compressedCluster = hostOffset, cluster
+	return cluster, nil
+}
+
+func (q *Qcow) Close() error {
+	return q.file.Close()
+}
+
+// Size returns the size of the virtual disk.
+func (q *Qcow) Size() (int64, error) {
+	return q.size, nil
+}
+
+// Fd returns the descriptor of the image file. Its layout is not the one of the virtual disk.
+func (q *Qcow) Fd() uintptr {
+	return q.file.Fd()
+}
@@ -0,0 +1,212 @@
+package qcow
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+const (
+	referenceImage       = "testdata/reference.qcow2"
+	referenceClusterSize = 4096
+	referenceSize        = 17*referenceClusterSize + 512
+	// referenceCompressed is where the compressed clusters of the reference image start, in the middle of a sector
+	referenceCompressed = 9*referenceClusterSize + 100
+)
+
+// referenceCluster returns cluster i of the virtual disk of testdata/reference.qcow2.
+//
+// qemu-img is not available where the image was made, so it was written by hand in the layout of
+// `qemu-img convert -c -O qcow2 -o cluster_size=4096`: a version 3 header of 112 bytes with the feature name table,
+// the refcount table and block, the L1 and L2 tables, then the data. Clusters 0, 9 and the last one, of which
+// only 512 bytes are in the image size, are allocated. 1 and 4 are compressed, and packed at byte offsets like qemu
+// does. 2 has the zero flag, and 5 the zero flag with a cluster still allocated. The others are unallocated.
+func referenceCluster(i int) []byte {
+	cluster := make([]byte, referenceClusterSize)
+	switch i {
+	case 0, 9, 17:
+		for j := range cluster {
+			cluster[j] = byte((i*7 + j) % 251)
+		}
+		if i == 17 {
+			clear(cluster[512:])
+		}
+	case 1, 4:
+		for j := range cluster {
+			cluster[j] = byte(j/64 + i)
+		}
+	}
+	return cluster
+}
+
+func referenceData() []byte {
+	var data []byte
+	for i := 0; i < 18; i++ {
+		data = append(data, referenceCluster(i)...)
+	}
+	return data[:referenceSize]
+}
+
+// copyImage copies an image to a file of the test that it can corrupt.
+func copyImage(c *C, path string, edit func(b []byte) []byte) string {
+	b, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+	dst := filepath.Join(c.MkDir(), "image.qcow2")
+	c.Assert(os.WriteFile(dst, edit(b), 0644), IsNil)
+	return dst
+}
+
+func (s *TestSuite) TestReferenceImage(c *C) {
+	f, err := os.Open(referenceImage)
+	c.Assert(err, IsNil)
+	isQcow, err := IsQcow(f)
+	c.Assert(err, IsNil)
+	c.Assert(isQcow, Equals, true)
+	c.Assert(f.Close(), IsNil)
+
+	q, err := Open(referenceImage)
+	c.Assert(err, IsNil)
+	defer q.Close()
+	size, err := q.Size()
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(referenceSize))
+
+	buf := make([]byte, referenceSize)
+	n, err := q.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, referenceSize)
+	expected := referenceData()
+	c.Assert(buf, DeepEquals, expected)
+
+	// Reads across clusters of every kind, at offsets within them.
+	for _, r := range []struct{ off, length int64 }{
+		{100, referenceClusterSize},
+		{referenceClusterSize - 1, 3 * referenceClusterSize},
+		{4*referenceClusterSize + 10, 2 * referenceClusterSize},
+		{referenceSize - 600, 600},
+	} {
+		buf := make([]byte, r.length)
+		n, err := q.ReadAt(buf, r.off)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, int(r.length))
+		c.Assert(buf, DeepEquals, expected[r.off:r.off+r.length], Commentf("%+v", r))
+	}
+
+	// The end of the virtual disk is not a multiple of the cluster size.
+	buf = make([]byte, 1024)
+	n, err = q.ReadAt(buf, referenceSize-512)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(n, Equals, 512)
+	c.Assert(buf[:512], DeepEquals, expected[referenceSize-512:])
+	_, err = q.ReadAt(buf, referenceSize)
+	c.Assert(err, Equals, io.EOF)
+	_, err = q.ReadAt(buf, -1)
+	c.Assert(err, NotNil)
+
+	_, err = q.WriteAt(buf, 0)
+	c.Assert(err, Equals, ErrReadOnly)
+	_, err = q.UnmapAt(512, 0)
+	c.Assert(err, Equals, ErrReadOnly)
+}
+
+func (s *TestSuite) TestCorruptClusters(c *C) {
+	// Corrupt compressed data.
+	path := copyImage(c, referenceImage, func(b []byte) []byte {
+		for i := 0; i < 16; i++ {
+			b[referenceCompressed+i] = 0xff
+		}
+		return b
+	})
+	q, err := Open(path)
+	c.Assert(err, IsNil)
+	_, err = q.ReadAt(make([]byte, 512), referenceClusterSize)
+	c.Assert(err, ErrorMatches, ".*failed to decompress the qcow2 cluster.*")
+	// The clusters that are not compressed still read.
+	buf := make([]byte, referenceClusterSize)
+	_, err = q.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, referenceCluster(0))
+	c.Assert(q.Close(), IsNil)
+
+	// An image cut before its last data clusters.
+	path = copyImage(c, referenceImage, func(b []byte) []byte {
+		return b[:7*referenceClusterSize+100]
+	})
+	q, err = Open(path)
+	c.Assert(err, IsNil)
+	defer q.Close()
+	_, err = q.ReadAt(buf, 17*referenceClusterSize)
+	c.Assert(err, ErrorMatches, "qcow2 cluster at .* is beyond the end of the image")
+	_, err = q.ReadAt(buf, referenceClusterSize)
+	c.Assert(err, ErrorMatches, ".*failed to decompress.*")
+}
+
+func (s *TestSuite) TestInvalidHeaders(c *C) {
+	put32 := func(off int, v uint32) func(b []byte) []byte {
+		return func(b []byte) []byte {
+			be.PutUint32(b[off:], v)
+			return b
+		}
+	}
+	put64 := func(off int, v uint64) func(b []byte) []byte {
+		return func(b []byte) []byte {
+			be.PutUint64(b[off:], v)
+			return b
+		}
+	}
+	for _, t := range []struct {
+		comment string
+		edit    func(b []byte) []byte
+		err     string
+	}{
+		{"empty file", func(b []byte) []byte { return nil }, ".*not a qcow2 image"},
+		{"truncated version 2 header", func(b []byte) []byte { return b[:headerV2Size-1] }, ".*not a qcow2 image"},
+		{"truncated version 3 header", func(b []byte) []byte { return b[:headerV3Size-1] },
+			".*truncated qcow2 version 3 header"},
+		{"bad magic", func(b []byte) []byte { b[3] = 0; return b }, ".*not a qcow2 image"},
+		{"version 1", put32(4, 1), ".*unsupported qcow version 1"},
+		{"version 4", put32(4, 4), ".*unsupported qcow version 4"},
+		{"small clusters", put32(20, minClusterBits-1), ".*invalid qcow2 cluster bits 8"},
+		{"large clusters", put32(20, maxClusterBits+1), ".*invalid qcow2 cluster bits 22"},
+		{"huge size", put64(24, 1<<62+1), ".*invalid qcow2 virtual size.*"},
+		{"backing file", put64(8, 512), ".*has a backing file.*"},
+		{"encryption", put32(32, 1), ".*encrypted with method 1.*"},
+		{"corrupt", put64(72, incompatCorrupt), ".*marked corrupt"},
+		{"external data file", put64(72, incompatExternalData), ".*external data file.*"},
+		{"extended L2 entries", put64(72, incompatExtendedL2), ".*extended L2 entries.*"},
+		{"zstd compression", func(b []byte) []byte {
+			be.PutUint64(b[72:], incompatCompression)
+			b[headerV3Size] = 1
+			return b
+		}, ".*compression type 1.*"},
+		{"unknown feature", put64(72, 1<<20), ".*unknown incompatible features 0x100000"},
+		{"small L1 table", put32(36, 0), ".*L1 table of 0 entries is too small.*"},
+		{"misaligned L1 table", put64(40, 3*referenceClusterSize+8), ".*L1 table offset .* is not aligned"},
+		{"L1 table beyond the image", put64(40, 100*referenceClusterSize), ".*failed to read the L1 table.*"},
+	} {
+		_, err := Open(copyImage(c, referenceImage, t.edit))
+		c.Assert(err, ErrorMatches, t.err, Commentf(t.comment))
+	}
+
+	// The dirty bit and deflate compression are fine for reading.
+	q, err := Open(copyImage(c, referenceImage, put64(72, incompatDirty|incompatCompression)))
+	c.Assert(err, IsNil)
+	c.Assert(q.Close(), IsNil)
+
+	_, err = Open(filepath.Join(c.MkDir(), "missing"))
+	c.Assert(err, NotNil)
+	isQcow, err := IsQcow(bytes.NewReader([]byte("QF")))
+	c.Assert(err, IsNil)
+	c.Assert(isQcow, Equals, false)
+}
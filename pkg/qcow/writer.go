@@ -0,0 +1,163 @@
+package qcow
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	writerClusterBits = 16
+	writerClusterSize = 1 << writerClusterBits
+	// refcountOrder makes the refcounts 16 bits
+	refcountOrder = 4
+)
+
+// Create writes the size bytes of src to a new qcow2 version 3 image at path. Clusters of src that are all zeros
+// are not allocated. The clusters are laid out as: the header, the L1 table, the data and the L2 tables in the
+// order they are met, then the refcount table and blocks.
+func Create(path string, size int64, src io.ReaderAt) (err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+
+	w := &writer{file: file}
+	if err := w.write(size, src); err != nil {
+		return errors.Wrapf(err, "failed to write qcow2 image %v", path)
+	}
+	return file.Sync()
+}
+
+type writer struct {
+	file *os.File
+	// next is the next free cluster of the image
+	next int64
+}
+
+func (w *writer) allocate(clusters int64) int64 {
+	offset := w.next * writerClusterSize
+	w.next += clusters
+	return offset
+}
+
+func (w *writer) write(size int64, src io.ReaderAt) error {
+	l2Entries := int64(writerClusterSize / 8)
+	l1Size := (size + writerClusterSize*l2Entries - 1) / (writerClusterSize * l2Entries)
+	l1Clusters := max(1, (l1Size*8+writerClusterSize-1)/writerClusterSize)
+
+	w.allocate(1)
+	l1Offset := w.allocate(l1Clusters)
+
+	// The L2 tables are written once the data is.
+	l2Tables := map[int64][]uint64{}
+	cluster := make([]byte, writerClusterSize)
+	for off := int64(0); off < size; off += writerClusterSize {
+		n, err := src.ReadAt(cluster[:min(writerClusterSize, size-off)], off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return errors.Wrapf(err, "failed to read the source at %v", off)
+		}
+		clear(cluster[n:])
+		if isZeroes(cluster) {
+			continue
+		}
+		hostOffset := w.allocate(1)
+		if _, err := w.file.WriteAt(cluster, hostOffset); err != nil {
+			return err
+		}
+		index := off / writerClusterSize
+		table, ok := l2Tables[index/l2Entries]
+		if !ok {
+			table = make([]uint64, l2Entries)
+			l2Tables[index/l2Entries] = table
+		}
+		table[index%l2Entries] = uint64(hostOffset) | entryCopied
+	}
+
+	l1 := make([]byte, l1Clusters*writerClusterSize)
+	for index, table := range l2Tables {
+		raw := make([]byte, writerClusterSize)
+		for i, entry := range table {
+			be.PutUint64(raw[i*8:], entry)
+		}
+		l2Offset := w.allocate(1)
+		if _, err := w.file.WriteAt(raw, l2Offset); err != nil {
+			return err
+		}
+		be.PutUint64(l1[index*8:], uint64(l2Offset)|entryCopied)
+	}
+	if _, err := w.file.WriteAt(l1, l1Offset); err != nil {
+		return err
+	}
+
+	refcountTableOffset, refcountTableClusters, err := w.writeRefcounts()
+	if err != nil {
+		return err
+	}
+
+	h := make([]byte, writerClusterSize)
+	copy(h, Magic)
+	be.PutUint32(h[4:], 3)
+	be.PutUint32(h[20:], writerClusterBits)
+	be.PutUint64(h[24:], uint64(size))
+	be.PutUint32(h[36:], uint32(l1Size))
+	be.PutUint64(h[40:], uint64(l1Offset))
+	be.PutUint64(h[48:], uint64(refcountTableOffset))
+	be.PutUint32(h[56:], uint32(refcountTableClusters))
+	be.PutUint32(h[96:], refcountOrder)
+	be.PutUint32(h[100:], headerV3Size)
+	_, err = w.file.WriteAt(h, 0)
+	return err
+}
+
+// writeRefcounts writes the refcount table and blocks, which give every cluster of the image, themselves
+// included, a refcount of 1.
+func (w *writer) writeRefcounts() (int64, int64, error) {
+	perBlock := int64(writerClusterSize * 8 / (1 << refcountOrder))
+	var blocks, tableClusters int64
+	for {
+		total := w.next + blocks + tableClusters
+		newBlocks := (total + perBlock - 1) / perBlock
+		newTableClusters := (newBlocks*8 + writerClusterSize - 1) / writerClusterSize
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+	total := w.next + blocks + tableClusters
+
+	tableOffset := w.allocate(tableClusters)
+	table := make([]byte, tableClusters*writerClusterSize)
+	for i := int64(0); i < blocks; i++ {
+		blockOffset := w.allocate(1)
+		be.PutUint64(table[i*8:], uint64(blockOffset))
+
+		block := make([]byte, writerClusterSize)
+		for j := int64(0); j < perBlock && i*perBlock+j < total; j++ {
+			be.PutUint16(block[j*2:], 1)
+		}
+		if _, err := w.file.WriteAt(block, blockOffset); err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := w.file.WriteAt(table, tableOffset); err != nil {
+		return 0, 0, err
+	}
+	return tableOffset, tableClusters, nil
+}
+
+var zeroCluster = make([]byte, writerClusterSize)
+
+func isZeroes(b []byte) bool {
+	return bytes.Equal(b, zeroCluster[:len(b)])
+}
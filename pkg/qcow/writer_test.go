@@ -0,0 +1,130 @@
+package qcow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+// failingReader fails the reads at or after off.
+type failingReader struct {
+	io.ReaderAt
+	off int64
+}
+
+func (r *failingReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off >= r.off {
+		return 0, errors.New("read failure")
+	}
+	return r.ReaderAt.ReadAt(buf, off)
+}
+
+// checkRefcounts checks that every cluster of the image written has a refcount of 1, and that the image has no
+// other cluster.
+func checkRefcounts(c *C, path string) {
+	b, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(len(b)%writerClusterSize, Equals, 0)
+	clusters := len(b) / writerClusterSize
+	tableOffset, tableClusters := be.Uint64(b[48:]), be.Uint32(b[56:])
+	c.Assert(be.Uint32(b[96:]), Equals, uint32(refcountOrder))
+
+	perBlock := writerClusterSize / 2
+	refcounts := 0
+	table := b[tableOffset : tableOffset+uint64(tableClusters)*writerClusterSize]
+	for i := 0; i*8 < len(table); i++ {
+		blockOffset := be.Uint64(table[i*8:])
+		if blockOffset == 0 {
+			continue
+		}
+		block := b[blockOffset : blockOffset+writerClusterSize]
+		for j := 0; j < perBlock; j++ {
+			refcount := be.Uint16(block[j*2:])
+			if i*perBlock+j < clusters {
+				c.Assert(refcount, Equals, uint16(1), Commentf("cluster %v", i*perBlock+j))
+				refcounts++
+			} else {
+				c.Assert(refcount, Equals, uint16(0), Commentf("cluster %v", i*perBlock+j))
+			}
+		}
+	}
+	c.Assert(refcounts, Equals, clusters)
+}
+
+func (s *TestSuite) TestWriterRoundTrip(c *C) {
+	dir := c.MkDir()
+	for _, size := range []int64{
+		0,
+		512,
+		writerClusterSize,
+		// Not a multiple of the cluster size, with the last cluster partly in the image.
+		5*writerClusterSize + 1000,
+		5*writerClusterSize + writerClusterSize - 1,
+	} {
+		src := make([]byte, size)
+		for i := int64(0); i < size; i++ {
+			// Every other cluster is zeros, and left unallocated.
+			if (i/writerClusterSize)%2 == 0 {
+				src[i] = byte(i%253 + 1)
+			}
+		}
+		path := filepath.Join(dir, "image.qcow2")
+		c.Assert(Create(path, size, bytes.NewReader(src)), IsNil)
+		checkRefcounts(c, path)
+
+		q, err := Open(path)
+		c.Assert(err, IsNil)
+		imageSize, err := q.Size()
+		c.Assert(err, IsNil)
+		c.Assert(imageSize, Equals, size)
+		if size > 0 {
+			buf := make([]byte, size)
+			n, err := q.ReadAt(buf, 0)
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, int(size))
+			c.Assert(buf, DeepEquals, src, Commentf("size %v", size))
+		}
+		_, err = q.ReadAt(make([]byte, 1), size)
+		c.Assert(err, Equals, io.EOF)
+		c.Assert(q.Close(), IsNil)
+
+		// The zero clusters take no space: the header, the L1 table, the data, an L2 table and the refcounts.
+		st, err := os.Stat(path)
+		c.Assert(err, IsNil)
+		clusters := (size + writerClusterSize - 1) / writerClusterSize
+		dataClusters := (clusters + 1) / 2
+		l2Clusters := min(dataClusters, 1)
+		c.Assert(st.Size(), Equals, (2+dataClusters+l2Clusters+2)*writerClusterSize, Commentf("size %v", size))
+	}
+}
+
+func (s *TestSuite) TestWriterSparseSource(c *C) {
+	// A source shorter than the image reads zeros beyond its end, as a sparse file does.
+	path := filepath.Join(c.MkDir(), "image.qcow2")
+	src := bytes.Repeat([]byte{0x5a}, writerClusterSize+100)
+	c.Assert(Create(path, 4*writerClusterSize, bytes.NewReader(src)), IsNil)
+	q, err := Open(path)
+	c.Assert(err, IsNil)
+	defer q.Close()
+	buf := make([]byte, 4*writerClusterSize)
+	_, err = q.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, append(src, make([]byte, 3*writerClusterSize-100)...))
+}
+
+func (s *TestSuite) TestWriterFailure(c *C) {
+	path := filepath.Join(c.MkDir(), "image.qcow2")
+	src := &failingReader{ReaderAt: bytes.NewReader(bytes.Repeat([]byte{1}, 4*writerClusterSize)),
+		off: 2 * writerClusterSize}
+	err := Create(path, 4*writerClusterSize, src)
+	c.Assert(err, ErrorMatches, ".*failed to read the source at 131072.*")
+	// No partial image is left behind.
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(Create(filepath.Join(c.MkDir(), "missing", "image.qcow2"), 512, bytes.NewReader(nil)), NotNil)
+}
@@ -8,11 +8,14 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	btypes "github.com/longhorn/backupstore/types"
 	butil "github.com/longhorn/backupstore/util"
 
 	"github.com/longhorn/longhorn-engine/pkg/backingfile"
+	"github.com/longhorn/longhorn-engine/pkg/tracing"
 	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
 )
 
@@ -29,6 +32,9 @@ type BackupStatus struct {
 	State         ProgressState
 	IsIncremental bool
 	IsOpened      bool
+
+	// span traces the backup from its creation until it completes or fails
+	span trace.Span
 }
 
 func NewBackup(name, volumeID, snapID string, backingFile *backingfile.BackingFile) *BackupStatus {
@@ -72,9 +78,38 @@ func (rb *BackupStatus) UpdateBackupStatus(snapID, volumeID string, state string
 	} else if rb.Error != "" {
 		rb.State = ProgressStateError
 	}
+
+	if rb.State == ProgressStateComplete || rb.State == ProgressStateError {
+		var err error
+		if rb.Error != "" {
+			err = errors.New(rb.Error)
+		}
+		rb.endTraceSpanNoLock(err)
+	}
 	return nil
 }
 
+func (rb *BackupStatus) SetTraceSpan(span trace.Span) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	rb.span = span
+}
+
+func (rb *BackupStatus) EndTraceSpan(err error) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	rb.endTraceSpanNoLock(err)
+}
+
+func (rb *BackupStatus) endTraceSpanNoLock(err error) {
+	if rb.span == nil {
+		return
+	}
+	rb.span.SetAttributes(attribute.String("backup.url", rb.BackupURL), attribute.Bool("backup.incremental", rb.IsIncremental))
+	tracing.EndSpan(rb.span, err)
+	rb.span = nil
+}
+
 func (rb *BackupStatus) HasSnapshot(snapID, volumeID string) bool {
 	rb.lock.Lock()
 	defer rb.lock.Unlock()
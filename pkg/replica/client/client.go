@@ -10,9 +10,13 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 
+	"github.com/longhorn/longhorn-engine/pkg/generated/replicarpc"
+	"github.com/longhorn/longhorn-engine/pkg/generated/syncagentrpc"
 	"github.com/longhorn/longhorn-engine/pkg/interceptor"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 	"github.com/longhorn/longhorn-engine/pkg/util"
@@ -93,7 +97,7 @@ func NewReplicaClient(address, volumeName, instanceName string) (*ReplicaClient,
 func (c *ReplicaClient) getReplicaServiceClient() (enginerpc.ReplicaServiceClient, error) {
 	err := c.replicaServiceContext.once.Do(func() error {
 		cc, err := grpc.NewClient(c.replicaServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-			interceptor.WithIdentityValidationClientInterceptor(c.volumeName, c.instanceName))
+			interceptor.WithIdentityValidationClientInterceptor(c.volumeName, c.instanceName), interceptor.WithTracingClientInterceptor())
 		if err != nil {
 			return err
 		}
@@ -114,7 +118,7 @@ func (c *ReplicaClient) getReplicaServiceClient() (enginerpc.ReplicaServiceClien
 func (c *ReplicaClient) getSyncServiceClient() (enginerpc.SyncAgentServiceClient, error) {
 	err := c.syncServiceContext.once.Do(func() error {
 		cc, err := grpc.NewClient(c.syncAgentServiceURL, grpc.WithTransportCredentials(insecure.NewCredentials()),
-			interceptor.WithIdentityValidationClientInterceptor(c.volumeName, c.instanceName))
+			interceptor.WithIdentityValidationClientInterceptor(c.volumeName, c.instanceName), interceptor.WithTracingClientInterceptor())
 		if err != nil {
 			return err
 		}
@@ -211,6 +215,66 @@ func (c *ReplicaClient) GetReplica() (*types.ReplicaInfo, error) {
 	return GetReplicaInfo(resp.Replica), nil
 }
 
+// GetMetrics returns the metrics of the replica process. They are served by replicarpc.ReplicaService, on the same
+// connection as the other replica RPCs.
+func (c *ReplicaClient) GetMetrics() (*types.ReplicaMetrics, error) {
+	if _, err := c.getReplicaServiceClient(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceCommonTimeout)
+	defer cancel()
+
+	resp, err := replicarpc.NewReplicaServiceClient(c.replicaServiceContext.cc).MetricsGet(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get metrics of replica %v", c.replicaServiceURL)
+	}
+
+	return &types.ReplicaMetrics{
+		ZeroBytesDetected: resp.ZeroBytesDetected,
+		ZeroBytesSaved:    resp.ZeroBytesSaved,
+		DataConnections:   resp.DataConnections,
+	}, nil
+}
+
+// RemoveBackingFile detaches the backing file from the flattened replica.
+func (c *ReplicaClient) RemoveBackingFile() error {
+	if _, err := c.getReplicaServiceClient(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceCommonTimeout)
+	defer cancel()
+
+	if _, err := replicarpc.NewReplicaServiceClient(c.replicaServiceContext.cc).BackingFileRemove(ctx, &emptypb.Empty{}); err != nil {
+		return errors.Wrapf(err, "failed to remove backing file from replica %v", c.replicaServiceURL)
+	}
+
+	return nil
+}
+
+// GetBackingFile returns the backing file of the replica, whose path is empty if there is none. It is nil if the
+// replica is of a version that cannot tell.
+func (c *ReplicaClient) GetBackingFile() (*types.BackingFileInfo, error) {
+	if _, err := c.getReplicaServiceClient(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceCommonTimeout)
+	defer cancel()
+
+	resp, err := replicarpc.NewReplicaServiceClient(c.replicaServiceContext.cc).BackingFileGet(ctx, &emptypb.Empty{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backing file of replica %v", c.replicaServiceURL)
+	}
+
+	return &types.BackingFileInfo{
+		Path:     resp.Path,
+		Size:     resp.Size,
+		Checksum: resp.Checksum,
+	}, nil
+}
+
 func (c *ReplicaClient) OpenReplica() error {
 	replicaServiceClient, err := c.getReplicaServiceClient()
 	if err != nil {
@@ -690,6 +754,37 @@ func (c *ReplicaClient) SnapshotPurgeStatus() (*enginerpc.SnapshotPurgeStatusRes
 	return status, nil
 }
 
+// VolumeFlatten starts copying the data of the backing file into the oldest snapshot of the replica. It is served by
+// syncagentrpc.SyncAgentService, on the same connection as the other sync agent RPCs.
+func (c *ReplicaClient) VolumeFlatten() error {
+	if _, err := c.getSyncServiceClient(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceCommonTimeout)
+	defer cancel()
+
+	if _, err := syncagentrpc.NewSyncAgentServiceClient(c.syncServiceContext.cc).VolumeFlatten(ctx, &emptypb.Empty{}); err != nil {
+		return errors.Wrap(err, "failed to start volume flatten")
+	}
+
+	return nil
+}
+
+func (c *ReplicaClient) VolumeFlattenStatus() (*syncagentrpc.VolumeFlattenStatusResponse, error) {
+	if _, err := c.getSyncServiceClient(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GRPCServiceCommonTimeout)
+	defer cancel()
+
+	status, err := syncagentrpc.NewSyncAgentServiceClient(c.syncServiceContext.cc).VolumeFlattenStatus(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get volume flatten status")
+	}
+
+	return status, nil
+}
+
 func (c *ReplicaClient) ReplicaRebuildStatus() (*enginerpc.ReplicaRebuildStatusResponse, error) {
 	syncAgentServiceClient, err := c.getSyncServiceClient()
 	if err != nil {
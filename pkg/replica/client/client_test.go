@@ -0,0 +1,80 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/longhorn/types/pkg/generated/enginerpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/generated/replicarpc"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+type testBackingFileService struct {
+	replicarpc.UnimplementedReplicaServiceServer
+}
+
+func (s *testBackingFileService) BackingFileGet(ctx context.Context, req *emptypb.Empty) (*replicarpc.BackingFile, error) {
+	return &replicarpc.BackingFile{Path: "/backing", Size: 4096, Checksum: "abc"}, nil
+}
+
+// serveReplica serves the services registered by register as a replica would, until the returned server stops.
+func serveReplica(c *C, register func(server *grpc.Server)) (string, *grpc.Server) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	server := grpc.NewServer()
+	register(server)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	c.Logf("Replica service: %v", listener.Addr())
+	return listener.Addr().String(), server
+}
+
+func (s *TestSuite) TestGetBackingFile(c *C) {
+	address, server := serveReplica(c, func(server *grpc.Server) {
+		enginerpc.RegisterReplicaServiceServer(server, &enginerpc.UnimplementedReplicaServiceServer{})
+		replicarpc.RegisterReplicaServiceServer(server, &testBackingFileService{})
+	})
+	defer server.Stop()
+	client, err := NewReplicaClient(address, "test-volume", "")
+	c.Assert(err, IsNil)
+	defer client.Close()
+	backingFile, err := client.GetBackingFile()
+	c.Assert(err, IsNil)
+	c.Assert(backingFile, DeepEquals, &types.BackingFileInfo{Path: "/backing", Size: 4096, Checksum: "abc"})
+
+	// A replica of an older version does not serve the backing file service.
+	address, oldServer := serveReplica(c, func(server *grpc.Server) {
+		enginerpc.RegisterReplicaServiceServer(server, &enginerpc.UnimplementedReplicaServiceServer{})
+	})
+	defer oldServer.Stop()
+	client, err = NewReplicaClient(address, "test-volume", "")
+	c.Assert(err, IsNil)
+	defer client.Close()
+	backingFile, err = client.GetBackingFile()
+	c.Assert(err, IsNil)
+	c.Assert(backingFile, IsNil)
+
+	// Other errors are not hidden.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	address = listener.Addr().String()
+	c.Assert(listener.Close(), IsNil)
+	client, err = NewReplicaClient(address, "test-volume", "")
+	c.Assert(err, IsNil)
+	defer client.Close()
+	_, err = client.GetBackingFile()
+	c.Assert(err, ErrorMatches, "failed to get backing file of replica .*")
+}
@@ -403,6 +403,95 @@ func (d *diffDisk) UnmapAt(unmappableDisks []string, length uint32, offset int64
 	return int(unmappedSize), nil
 }
 
+// WriteZeroesAt zeroes a range of the volume. Sectors no disk below the head has data for are punched out of the
+// head. The other sectors are overwritten with zeros in the head, since a hole there would expose the older data.
+func (d *diffDisk) WriteZeroesAt(length uint32, offset int64, isThereBackingFile bool) (int, error) {
+	if length == 0 {
+		return 0, nil
+	}
+
+	end := offset + int64(length)
+	alignedStart := (offset + d.sectorSize - 1) / d.sectorSize * d.sectorSize
+	alignedEnd := end / d.sectorSize * d.sectorSize
+	if alignedStart >= alignedEnd {
+		return d.writeZeroes(offset, end)
+	}
+	if _, err := d.writeZeroes(offset, alignedStart); err != nil {
+		return 0, err
+	}
+
+	if _, err := d.zeroSectors(alignedStart, alignedEnd, isThereBackingFile); err != nil {
+		return 0, err
+	}
+	if _, err := d.writeZeroes(alignedEnd, end); err != nil {
+		return 0, err
+	}
+	return int(length), nil
+}
+
+// zeroSectors zeroes the sectors between the aligned offsets start and end, and returns how many bytes of them were
+// punched out of the head.
+func (d *diffDisk) zeroSectors(start, end int64, isThereBackingFile bool) (int64, error) {
+	hasData, err := d.lowerDataSectors(start, end, isThereBackingFile)
+	if err != nil {
+		return 0, err
+	}
+
+	punched := int64(0)
+	head := len(d.files) - 1
+	startSector := start / d.sectorSize
+	for i := 0; i < len(hasData); {
+		j := i + 1
+		for j < len(hasData) && hasData[j] == hasData[i] {
+			j++
+		}
+		runOffset := (startSector + int64(i)) * d.sectorSize
+		runEnd := (startSector + int64(j)) * d.sectorSize
+		if hasData[i] {
+			if _, err := d.writeZeroes(runOffset, runEnd); err != nil {
+				return punched, err
+			}
+		} else {
+			if _, err := d.files[head].UnmapAt(uint32(runEnd-runOffset), runOffset); err != nil {
+				return punched, errors.Wrapf(err, "failed to punch offset %v length %v out of the head", runOffset, runEnd-runOffset)
+			}
+			for k := startSector + int64(i); k < startSector+int64(j); k++ {
+				// Let lookup find out where the sector is next time it is read.
+				d.location[k] = 0
+			}
+			punched += runEnd - runOffset
+		}
+		i = j
+	}
+	return punched, nil
+}
+
+// writeZeroes writes zeros from offset up to end.
+func (d *diffDisk) writeZeroes(offset, end int64) (int, error) {
+	if offset >= end {
+		return 0, nil
+	}
+	return util.WriteZeroBufferAt(d, uint32(end-offset), offset)
+}
+
+// lowerDataSectors tells for each sector between the aligned offsets start and end whether a disk below the head
+// may hold data for it. A backing file is assumed to hold data everywhere.
+func (d *diffDisk) lowerDataSectors(start, end int64, isThereBackingFile bool) ([]bool, error) {
+	hasData := make([]bool, (end-start)/d.sectorSize)
+	for i := len(d.files) - 2; i > 0; i-- {
+		if i == int(backingFileIndex) && isThereBackingFile {
+			for j := range hasData {
+				hasData[j] = true
+			}
+			break
+		}
+		if err := markDataSectors(d.files[i], start, end, d.sectorSize, hasData); err != nil {
+			return nil, errors.Wrapf(err, "failed to find the data of disk index %v", i)
+		}
+	}
+	return hasData, nil
+}
+
 func (d *diffDisk) initializeSectorLocation(value byte) {
 	for i := 0; i < len(d.location); i++ {
 		d.location[i] = value
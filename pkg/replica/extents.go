@@ -35,3 +35,35 @@ func LoadDiffDiskLocationList(diffDisk *diffDisk, disk types.DiffDisk, currentFi
 		start = extents[len(extents)-1].Logical + extents[len(extents)-1].Length
 	}
 }
+
+// markDataSectors sets the entries of hasData for the sectors of the disk between start and end that hold data.
+// Entry 0 is the sector at start.
+func markDataSectors(disk types.DiffDisk, start, end, sectorSize int64, hasData []bool) error {
+	fd := disk.Fd()
+
+	next := uint64(start)
+	for next < uint64(end) {
+		extents, errno := fibmap.Fiemap(fd, next, uint64(end)-next, MaxExtentsBuffer)
+		if errno != 0 {
+			return errno
+		}
+
+		if len(extents) == 0 {
+			return nil
+		}
+
+		for _, extent := range extents {
+			first := max(int64(extent.Logical), start)
+			last := min(int64(extent.Logical+extent.Length), end)
+			for i := first / sectorSize * sectorSize; i < last; i += sectorSize {
+				hasData[(i-start)/sectorSize] = true
+			}
+			if extent.Flags&fibmap.FIEMAP_EXTENT_LAST != 0 {
+				return nil
+			}
+		}
+
+		next = extents[len(extents)-1].Logical + extents[len(extents)-1].Length
+	}
+	return nil
+}
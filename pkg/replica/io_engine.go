@@ -0,0 +1,85 @@
+package replica
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/longhorn-engine/pkg/iouring"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/sparse-tools/sparse"
+)
+
+const (
+	// IOEngineSync reads and writes the disk files with one pread or pwrite per request.
+	IOEngineSync = "sync"
+	// IOEngineIOUring submits the reads and writes of concurrent requests to a shared io_uring in batches.
+	IOEngineIOUring = "io_uring"
+)
+
+// The I/O engine is set for the whole process, since a replica process serves a single replica and every disk file
+// of the replica should share the same ring.
+var (
+	ioEngineRing       *iouring.Ring
+	ioEngineSyncWrites bool
+)
+
+// SetIOEngine sets how the disk files opened from now on are read and written. If io_uring is not supported by the
+// kernel, the sync engine is used instead. If syncWrites is set, every write is followed by an fdatasync, linked to
+// the write when io_uring is used.
+func SetIOEngine(engine string, entries uint32, syncWrites bool) error {
+	var ring *iouring.Ring
+	switch engine {
+	case IOEngineSync:
+	case IOEngineIOUring:
+		var err error
+		ring, err = iouring.NewRing(entries)
+		if errors.Is(err, iouring.ErrNotSupported) {
+			logrus.WithError(err).Warnf("Falling back to I/O engine %v", IOEngineSync)
+		} else if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported I/O engine %v", engine)
+	}
+
+	if ioEngineRing != nil {
+		if err := ioEngineRing.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close io_uring")
+		}
+	}
+	ioEngineRing = ring
+	ioEngineSyncWrites = syncWrites
+	return nil
+}
+
+func openDiskFile(path string, flag int) (types.DiffDisk, error) {
+	if ioEngineRing != nil {
+		return iouring.OpenFile(ioEngineRing, path, os.O_RDWR|flag, 06666, ioEngineSyncWrites, true)
+	}
+
+	f, err := sparse.NewDirectFileIoProcessor(path, os.O_RDWR|flag, 06666, true)
+	if err != nil {
+		return nil, err
+	}
+	if ioEngineSyncWrites {
+		return &syncWriteFile{f}, nil
+	}
+	return f, nil
+}
+
+// syncWriteFile is a disk file of the sync engine whose writes are durable when they return.
+type syncWriteFile struct {
+	*sparse.DirectFileIoProcessor
+}
+
+func (f *syncWriteFile) WriteAt(data []byte, offset int64) (int, error) {
+	n, err := f.DirectFileIoProcessor.WriteAt(data, offset)
+	if err != nil {
+		return n, err
+	}
+	return n, unix.Fdatasync(int(f.Fd()))
+}
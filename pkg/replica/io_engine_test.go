@@ -0,0 +1,82 @@
+package replica
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestIOUringEngine(c *C) {
+	for _, syncWrites := range []bool{false, true} {
+		err := SetIOEngine(IOEngineIOUring, 16, syncWrites)
+		c.Assert(err, IsNil)
+		if ioEngineRing == nil {
+			c.Skip("io_uring is not supported")
+		}
+		s.testConcurrentReadWrite(c)
+	}
+
+	submitted, batches := ioEngineRing.Stats()
+	c.Logf("Submitted %v SQEs in %v batches", submitted, batches)
+	c.Assert(submitted > 0, Equals, true)
+	c.Assert(batches <= submitted, Equals, true)
+
+	err := SetIOEngine(IOEngineSync, 0, false)
+	c.Assert(err, IsNil)
+	c.Assert(ioEngineRing, IsNil)
+}
+
+func (s *TestSuite) testConcurrentReadWrite(c *C) {
+	dir, err := os.MkdirTemp("", "replica")
+	c.Assert(err, IsNil)
+	defer func() {
+		errRemove := os.RemoveAll(dir)
+		c.Assert(errRemove, IsNil)
+	}()
+
+	const blocks = 64
+	r, err := New(context.Background(), blocks*b, b, dir, nil, false, false, 250, 0)
+	c.Assert(err, IsNil)
+	defer func() {
+		errClose := r.Close()
+		c.Assert(errClose, IsNil)
+	}()
+
+	// Write the even blocks before the snapshot and the odd ones after it. The buffers of partial writes are not
+	// aligned, so they go through an aligned copy.
+	write := func(odd bool) {
+		wg := sync.WaitGroup{}
+		for i := 0; i < blocks; i++ {
+			if (i%2 == 1) != odd {
+				continue
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				buf := make([]byte, b+bs)
+				fill(buf, byte(i+1))
+				_, err := r.WriteAt(buf[bs:], int64(i*b))
+				c.Check(err, IsNil)
+			}(i)
+		}
+		wg.Wait()
+	}
+	write(false)
+	err = r.Snapshot("000", true, getNow(), nil)
+	c.Assert(err, IsNil)
+	write(true)
+
+	r, err = r.Reload()
+	c.Assert(err, IsNil)
+
+	readBuf := make([]byte, blocks*b)
+	_, err = r.ReadAt(readBuf, 0)
+	c.Assert(err, IsNil)
+	expected := make([]byte, blocks*b)
+	for i := 0; i < blocks; i++ {
+		fill(expected[i*b:(i+1)*b], byte(i+1))
+	}
+	byteEquals(c, readBuf, expected)
+}
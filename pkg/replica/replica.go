@@ -75,6 +75,9 @@ type Info struct {
 	SectorSize      int64
 	BackingFilePath string
 	BackingFile     *backingfile.BackingFile `json:"-"`
+	// BackingFileFlattened is set once the data of the backing file has been copied into the oldest snapshot, after
+	// which the replica no longer uses a backing file.
+	BackingFileFlattened bool `json:",omitempty"`
 }
 
 type disk struct {
@@ -192,6 +195,10 @@ func construct(ctx context.Context, readonly bool, size, sectorSize int64, dir,
 
 	// The backing file path can be changed, need to update it after loading
 	// the meta data.
+	if backingFile != nil && r.info.BackingFileFlattened {
+		logrus.Infof("Ignoring backing file %v since the replica has been flattened", backingFile.Path)
+		backingFile = nil
+	}
 	r.info.BackingFile = backingFile
 	if backingFile != nil {
 		r.info.BackingFilePath = backingFile.Path
@@ -304,6 +311,33 @@ func (r *Replica) Reload() (*Replica, error) {
 	return newReplica, nil
 }
 
+// RemoveBackingFile records that the replica has been flattened and returns it reopened without its backing file.
+// The oldest snapshot must already hold the data of the backing file. The caller closes r and the backing file.
+func (r *Replica) RemoveBackingFile() (*Replica, error) {
+	r.Lock()
+	if r.info.BackingFile == nil {
+		r.Unlock()
+		return r, nil
+	}
+	backingFilePath := r.info.BackingFilePath
+	r.info.BackingFileFlattened = true
+	r.info.BackingFilePath = ""
+	if err := r.writeVolumeMetaData(true, r.info.Rebuilding); err != nil {
+		r.info.BackingFileFlattened = false
+		r.info.BackingFilePath = backingFilePath
+		r.Unlock()
+		return nil, errors.Wrap(err, "failed to record the removal of the backing file")
+	}
+	r.Unlock()
+
+	newReplica, err := New(r.ctx, r.info.Size, r.info.SectorSize, r.dir, nil, r.revisionCounterDisabled, r.unmapMarkDiskChainRemoved, r.snapshotMaxCount, r.snapshotMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	newReplica.info.Dirty = r.info.Dirty
+	return newReplica, nil
+}
+
 func (r *Replica) findDisk(name string) int {
 	for i, d := range r.activeDiskData {
 		if i == 0 {
@@ -703,7 +737,7 @@ func (r *Replica) nextFile(parsePattern *regexp.Regexp, pattern, parent string)
 }
 
 func (r *Replica) openFile(name string, flag int) (types.DiffDisk, error) {
-	return sparse.NewDirectFileIoProcessor(r.diskPath(name), os.O_RDWR|flag, 06666, true)
+	return openDiskFile(r.diskPath(name), flag)
 }
 
 func (r *Replica) createNewHead(oldHead, parent, created string, size int64) (f types.DiffDisk, newDisk disk, rollbackFunc func() error, err error) {
@@ -1306,7 +1340,42 @@ func (r *Replica) WriteAt(buf []byte, offset int64) (int, error) {
 
 	r.RLock()
 	r.info.Dirty = true
-	c, err := r.volume.WriteAt(buf, offset)
+	var c int
+	var err error
+	// The disks below the head of a rebuilding replica are not synced yet, so whether they hold data for a sector
+	// is not known and the zeros must be written.
+	if zeroDetection.Load() && !r.info.Rebuilding {
+		c, err = r.volume.writeAtDetectingZeroes(buf, offset, r.isBackingFile(int(backingFileIndex)))
+	} else {
+		c, err = r.volume.WriteAt(buf, offset)
+	}
+	r.RUnlock()
+	if err != nil {
+		return c, err
+	}
+
+	if !r.revisionCounterDisabled {
+		err = <-r.revisionCounterAckChan
+	}
+
+	return c, err
+}
+
+// WriteZeroesAt zeroes a range of the volume head. See diffDisk.WriteZeroesAt.
+func (r *Replica) WriteZeroesAt(length uint32, offset int64) (int, error) {
+	if r.readOnly {
+		return 0, fmt.Errorf("cannot write zeroes on read-only replica")
+	}
+
+	go func() {
+		if !r.revisionCounterDisabled {
+			r.revisionCounterReqChan <- true
+		}
+	}()
+
+	r.RLock()
+	r.info.Dirty = true
+	c, err := r.volume.WriteZeroesAt(length, offset, r.isBackingFile(int(backingFileIndex)))
 	r.RUnlock()
 	if err != nil {
 		return c, err
@@ -1326,6 +1395,29 @@ func (r *Replica) ReadAt(buf []byte, offset int64) (int, error) {
 	return c, err
 }
 
+// Flush makes the data written to the replica so far durable.
+func (r *Replica) Flush() error {
+	if r.readOnly {
+		return fmt.Errorf("cannot flush read-only replica")
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	head := r.volume.files[len(r.volume.files)-1]
+	if f, ok := head.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			return errors.Wrapf(err, "failed to flush head disk %v", r.info.Head)
+		}
+	}
+	if r.revisionFile != nil {
+		if err := r.revisionFile.Sync(); err != nil {
+			return errors.Wrap(err, "failed to flush revision counter file")
+		}
+	}
+	return nil
+}
+
 func (r *Replica) UnmapAt(length uint32, offset int64) (n int, err error) {
 	defer func() {
 		if err != nil {
@@ -994,6 +994,95 @@ func (s *TestSuite) TestBackingFile(c *C) {
 	byteEquals(c, buf, newBuf2)
 }
 
+func (s *TestSuite) TestRemoveBackingFile(c *C) {
+	dir, err := os.MkdirTemp("", "replica")
+	c.Logf("Volume: %s", dir)
+	c.Assert(err, IsNil)
+	defer func() {
+		errRemove := os.RemoveAll(dir)
+		c.Assert(errRemove, IsNil)
+	}()
+
+	buf := make([]byte, 3*b)
+	fill(buf, 3)
+
+	f, err := NewTestBackingFile(path.Join(dir, "backing"))
+	c.Assert(err, IsNil)
+	defer func() {
+		errClose := f.Close()
+		c.Assert(errClose, IsNil)
+	}()
+	_, err = f.Write(buf)
+	c.Assert(err, IsNil)
+
+	backing := &backingfile.BackingFile{
+		Path: "backing",
+		Disk: f,
+	}
+
+	r, err := New(context.Background(), 3*b, b, dir, backing, false, false, 250, 0)
+	c.Assert(err, IsNil)
+
+	data := make([]byte, b)
+	fill(data, 5)
+	_, err = r.WriteAt(data, b)
+	c.Assert(err, IsNil)
+	err = r.Snapshot("000", true, getNow(), nil)
+	c.Assert(err, IsNil)
+
+	// Flatten the backing file into the snapshot, around the block the snapshot already has.
+	snapshot, err := os.OpenFile(path.Join(dir, "volume-snap-000.img"), os.O_WRONLY, 0)
+	c.Assert(err, IsNil)
+	_, err = snapshot.WriteAt(buf[:b], 0)
+	c.Assert(err, IsNil)
+	_, err = snapshot.WriteAt(buf[2*b:], 2*b)
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Close(), IsNil)
+
+	expected := make([]byte, 3*b)
+	fill(expected, 3)
+	fill(expected[b:2*b], 5)
+
+	newReplica, err := r.RemoveBackingFile()
+	c.Assert(err, IsNil)
+	c.Assert(newReplica, Not(Equals), r)
+	c.Assert(r.Close(), IsNil)
+	r = newReplica
+	c.Assert(r.info.BackingFile, IsNil)
+	c.Assert(r.info.BackingFileFlattened, Equals, true)
+	_, err = r.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	byteEquals(c, buf, expected)
+
+	info, err := ReadInfo(dir)
+	c.Assert(err, IsNil)
+	c.Assert(info.BackingFileFlattened, Equals, true)
+	c.Assert(info.BackingFilePath, Equals, "")
+
+	// Removing the backing file again changes nothing.
+	newReplica, err = r.RemoveBackingFile()
+	c.Assert(err, IsNil)
+	c.Assert(newReplica, Equals, r)
+	c.Assert(r.Close(), IsNil)
+
+	// A flattened replica opens without its backing file, even when it is given one, and no longer reads from it.
+	fill(data, 7)
+	for _, off := range []int64{0, b, 2 * b} {
+		_, err = f.WriteAt(data, off)
+		c.Assert(err, IsNil)
+	}
+	for _, backingFile := range []*backingfile.BackingFile{backing, nil} {
+		r, err = New(context.Background(), 3*b, b, dir, backingFile, false, false, 250, 0)
+		c.Assert(err, IsNil)
+		c.Assert(r.info.BackingFile, IsNil)
+		c.Assert(r.info.BackingFileFlattened, Equals, true)
+		_, err = r.ReadAt(buf, 0)
+		c.Assert(err, IsNil)
+		byteEquals(c, buf, expected)
+		c.Assert(r.Close(), IsNil)
+	}
+}
+
 func (s *TestSuite) partialWriteRead(c *C, totalLength, writeLength, writeOffset int64) {
 	fmt.Println("Starting partialWriteRead")
 	dir, err := os.MkdirTemp("", "replica")
@@ -1304,3 +1393,170 @@ func (s *TestSuite) TestUnmap(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(ret, Equals, 0)
 }
+
+func (s *TestSuite) TestWriteZeroes(c *C) {
+	dir, err := os.MkdirTemp("", "replica")
+	c.Assert(err, IsNil)
+	defer func() {
+		errRemove := os.RemoveAll(dir)
+		c.Assert(errRemove, IsNil)
+	}()
+
+	r, err := New(context.Background(), 8*b, b, dir, nil, false, false, 250, 0)
+	c.Assert(err, IsNil)
+	defer func() {
+		errClose := r.Close()
+		c.Assert(errClose, IsNil)
+	}()
+
+	buf := make([]byte, 4*b)
+	fill(buf, 1)
+	_, err = r.WriteAt(buf, 0)
+	c.Assert(err, IsNil)
+
+	err = r.Snapshot("000", true, getNow(), nil)
+	c.Assert(err, IsNil)
+
+	buf = make([]byte, 8*b)
+	fill(buf, 2)
+	_, err = r.WriteAt(buf, 0)
+	c.Assert(err, IsNil)
+
+	// Partial sectors at both ends, sectors 1 to 3 are in the snapshot, sectors 4 to 6 are not
+	n, err := r.WriteZeroesAt(7*b, bs)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 7*b)
+
+	expected := make([]byte, 8*b)
+	fill(expected, 2)
+	for i := bs; i < 7*b+bs; i++ {
+		expected[i] = 0
+	}
+	_, err = r.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, expected)
+
+	// Zeros are written over the snapshot data and the rest is punched out of the head
+	head := r.volume.files[len(r.volume.files)-1]
+	hasData := make([]bool, 6)
+	err = markDataSectors(head, b, 7*b, b, hasData)
+	c.Assert(err, IsNil)
+	c.Assert(hasData, DeepEquals, []bool{true, true, true, false, false, false})
+
+	err = r.Snapshot("001", true, getNow(), nil)
+	c.Assert(err, IsNil)
+	_, err = r.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, expected)
+}
+
+func (s *TestSuite) TestZeroDetection(c *C) {
+	dir, err := os.MkdirTemp("", "replica")
+	c.Assert(err, IsNil)
+	defer func() {
+		errRemove := os.RemoveAll(dir)
+		c.Assert(errRemove, IsNil)
+	}()
+
+	SetZeroDetection(true)
+	defer SetZeroDetection(false)
+
+	r, err := New(context.Background(), 8*b, b, dir, nil, false, false, 250, 0)
+	c.Assert(err, IsNil)
+	defer func() {
+		errClose := r.Close()
+		c.Assert(errClose, IsNil)
+	}()
+
+	buf := make([]byte, 4*b)
+	fill(buf, 1)
+	_, err = r.WriteAt(buf, 0)
+	c.Assert(err, IsNil)
+
+	err = r.Snapshot("000", true, getNow(), nil)
+	c.Assert(err, IsNil)
+
+	// Sectors 2 to 5 are zeros, and only sectors 2 and 3 are in the snapshot
+	detectedBefore, savedBefore := GetZeroDetectionMetrics()
+	expected := make([]byte, 8*b)
+	fill(expected[:2*b], 2)
+	fill(expected[6*b:], 2)
+	_, err = r.WriteAt(expected, 0)
+	c.Assert(err, IsNil)
+
+	buf = make([]byte, 8*b)
+	_, err = r.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, expected)
+
+	head := r.volume.files[len(r.volume.files)-1]
+	hasData := make([]bool, 8)
+	err = markDataSectors(head, 0, 8*b, b, hasData)
+	c.Assert(err, IsNil)
+	c.Assert(hasData, DeepEquals, []bool{true, true, true, true, false, false, true, true})
+
+	detected, saved := GetZeroDetectionMetrics()
+	c.Assert(detected-detectedBefore, Equals, uint64(4*b))
+	c.Assert(saved-savedBefore, Equals, uint64(2*b))
+}
+
+func (s *TestSuite) TestZeroDetectionRebuilding(c *C) {
+	sourceDir, err := os.MkdirTemp("", "replica")
+	c.Assert(err, IsNil)
+	defer func() {
+		errRemove := os.RemoveAll(sourceDir)
+		c.Assert(errRemove, IsNil)
+	}()
+	dir, err := os.MkdirTemp("", "replica")
+	c.Assert(err, IsNil)
+	defer func() {
+		errRemove := os.RemoveAll(dir)
+		c.Assert(errRemove, IsNil)
+	}()
+
+	SetZeroDetection(true)
+	defer SetZeroDetection(false)
+
+	// The healthy replica has data in its snapshot.
+	source, err := New(context.Background(), 4*b, b, sourceDir, nil, false, false, 250, 0)
+	c.Assert(err, IsNil)
+	buf := make([]byte, 4*b)
+	fill(buf, 5)
+	_, err = source.WriteAt(buf, 0)
+	c.Assert(err, IsNil)
+	err = source.Snapshot("000", true, getNow(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(source.Close(), IsNil)
+
+	// The rebuilding replica takes the same snapshot, still empty, and then gets zeros written over it.
+	r, err := New(context.Background(), 4*b, b, dir, nil, false, false, 250, 0)
+	c.Assert(err, IsNil)
+	err = r.SetRebuilding(true)
+	c.Assert(err, IsNil)
+	err = r.Snapshot("000", true, getNow(), nil)
+	c.Assert(err, IsNil)
+	_, err = r.WriteAt(make([]byte, 2*b), b)
+	c.Assert(err, IsNil)
+
+	// The sync brings the data of the snapshot.
+	data, err := os.ReadFile(path.Join(sourceDir, "volume-snap-000.img"))
+	c.Assert(err, IsNil)
+	c.Assert(os.WriteFile(path.Join(dir, "volume-snap-000.img"), data, 0644), IsNil)
+	newReplica, err := r.Reload()
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), IsNil)
+	r = newReplica
+	defer func() {
+		errClose := r.Close()
+		c.Assert(errClose, IsNil)
+	}()
+	err = r.SetRebuilding(false)
+	c.Assert(err, IsNil)
+
+	expected := make([]byte, 4*b)
+	fill(expected[:b], 5)
+	fill(expected[3*b:], 5)
+	_, err = r.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Assert(buf, DeepEquals, expected)
+}
@@ -3,6 +3,7 @@ package rpc
 import (
 	"fmt"
 	"net"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 
@@ -11,6 +12,9 @@ import (
 	"github.com/longhorn/longhorn-engine/pkg/types"
 )
 
+// dataConnections counts the connections open to the data servers of this process.
+var dataConnections atomic.Int32
+
 type DataServer struct {
 	protocol types.DataServerProtocol
 	address  string
@@ -56,12 +60,7 @@ func (s *DataServer) listenAndServeTCP() error {
 
 		logrus.Infof("New connection from: %v", conn.RemoteAddr())
 
-		go func(conn net.Conn) {
-			server := dataconn.NewServer(conn, s.s)
-			if err = server.Handle(); err != nil {
-				logrus.WithError(err).Warn("failed to handle data server")
-			}
-		}(conn)
+		go s.serve(conn)
 	}
 }
 
@@ -83,11 +82,16 @@ func (s *DataServer) listenAndServeUNIX() error {
 			continue
 		}
 		logrus.Infof("New connection from: %v", conn.RemoteAddr())
-		go func(conn net.Conn) {
-			server := dataconn.NewServer(conn, s.s)
-			if err = server.Handle(); err != nil {
-				logrus.WithError(err).Warn("failed to handle data server")
-			}
-		}(conn)
+		go s.serve(conn)
+	}
+}
+
+func (s *DataServer) serve(conn net.Conn) {
+	dataConnections.Add(1)
+	defer dataConnections.Add(-1)
+
+	server := dataconn.NewServer(conn, s.s)
+	if err := server.Handle(); err != nil {
+		logrus.WithError(err).Warn("failed to handle data server")
 	}
 }
@@ -0,0 +1,47 @@
+package rpc
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/longhorn/longhorn-engine/pkg/generated/replicarpc"
+	"github.com/longhorn/longhorn-engine/pkg/replica"
+)
+
+// ReplicaRPCServer serves replicarpc.ReplicaService. It is registered on the same gRPC server as ReplicaServer.
+type ReplicaRPCServer struct {
+	replicarpc.UnimplementedReplicaServiceServer
+	s *replica.Server
+}
+
+func NewReplicaRPCServer(s *replica.Server) *ReplicaRPCServer {
+	return &ReplicaRPCServer{s: s}
+}
+
+func (rs *ReplicaRPCServer) MetricsGet(ctx context.Context, req *emptypb.Empty) (*replicarpc.Metrics, error) {
+	detected, saved := replica.GetZeroDetectionMetrics()
+	return &replicarpc.Metrics{
+		ZeroBytesDetected: detected,
+		ZeroBytesSaved:    saved,
+		DataConnections:   uint32(dataConnections.Load()),
+	}, nil
+}
+
+func (rs *ReplicaRPCServer) BackingFileRemove(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := rs.s.RemoveBackingFile(); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (rs *ReplicaRPCServer) BackingFileGet(ctx context.Context, req *emptypb.Empty) (*replicarpc.BackingFile, error) {
+	backing := rs.s.BackingFile()
+	if backing == nil {
+		return &replicarpc.BackingFile{}, nil
+	}
+	return &replicarpc.BackingFile{
+		Path:     backing.Path,
+		Size:     backing.Size,
+		Checksum: backing.Checksum(),
+	}, nil
+}
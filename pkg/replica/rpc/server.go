@@ -15,7 +15,10 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 
+	"github.com/longhorn/longhorn-engine/pkg/generated/journalrpc"
+	"github.com/longhorn/longhorn-engine/pkg/generated/replicarpc"
 	"github.com/longhorn/longhorn-engine/pkg/interceptor"
+	"github.com/longhorn/longhorn-engine/pkg/opjournal"
 	"github.com/longhorn/longhorn-engine/pkg/replica"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 )
@@ -31,11 +34,14 @@ type ReplicaHealthCheckServer struct {
 
 func NewReplicaServer(volumeName, instanceName string, s *replica.Server) *grpc.Server {
 	rs := &ReplicaServer{s: s}
-	server := grpc.NewServer(interceptor.WithIdentityValidationReplicaServerInterceptor(volumeName, instanceName))
+	server := grpc.NewServer(interceptor.WithIdentityValidationReplicaServerInterceptor(volumeName, instanceName),
+		interceptor.WithTracingServerInterceptor())
 	enginerpc.RegisterReplicaServiceServer(server, rs)
 	healthpb.RegisterHealthServer(server, NewReplicaHealthCheckServer(rs))
 	reflection.Register(server)
 	profilerrpc.RegisterProfilerServer(server, profiler.NewServer(volumeName))
+	journalrpc.RegisterJournalServiceServer(server, opjournal.NewServer())
+	replicarpc.RegisterReplicaServiceServer(server, NewReplicaRPCServer(s))
 	return server
 }
 
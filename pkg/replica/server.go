@@ -107,6 +107,41 @@ func (s *Server) Reload() error {
 	return nil
 }
 
+// RemoveBackingFile reopens the flattened replica without its backing file, which is closed.
+func (s *Server) RemoveBackingFile() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.r == nil {
+		return fmt.Errorf("replica is not open")
+	}
+	if s.backing == nil {
+		return nil
+	}
+
+	logrus.Infof("Removing backing file %v from replica", s.backing.Path)
+	newReplica, err := s.r.RemoveBackingFile()
+	if err != nil {
+		return err
+	}
+
+	// A replica that has already been flattened ignores the backing file it is given, and is kept as is.
+	if newReplica != s.r {
+		oldReplica := s.r
+		s.r = newReplica
+		if errClose := oldReplica.Close(); errClose != nil {
+			logrus.WithError(errClose).Error("Failed to close old replica")
+		}
+	}
+
+	s.sectorSize = s.getSectorSize()
+	if errClose := s.backing.Disk.Close(); errClose != nil {
+		logrus.WithError(errClose).Warnf("Failed to close backing file %v", s.backing.Path)
+	}
+	s.backing = nil
+	return nil
+}
+
 func (s *Server) Status() (types.ReplicaState, Info) {
 	if s.r == nil {
 		info, err := ReadInfo(s.dir)
@@ -161,6 +196,18 @@ func (s *Server) Replica() *Replica {
 	return s.r
 }
 
+// BackingFile returns the backing file the replica reads from. It is nil if the replica has been flattened, even
+// though it was given one.
+func (s *Server) BackingFile() *backingfile.BackingFile {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.r != nil {
+		return s.r.Info().BackingFile
+	}
+	return s.backing
+}
+
 func (s *Server) Revert(name, created string) error {
 	s.Lock()
 	defer s.Unlock()
@@ -350,6 +397,26 @@ func (s *Server) UnmapAt(length uint32, off int64) (int, error) {
 	return s.r.UnmapAt(length, off)
 }
 
+func (s *Server) WriteZeroesAt(length uint32, off int64) (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.r == nil {
+		return 0, fmt.Errorf("replica no longer exist")
+	}
+	return s.r.WriteZeroesAt(length, off)
+}
+
+func (s *Server) Flush() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.r == nil {
+		return fmt.Errorf("replica no longer exist")
+	}
+	return s.r.Flush()
+}
+
 func (s *Server) SetRevisionCounter(counter int64) error {
 	s.Lock()
 	defer s.Unlock()
@@ -0,0 +1,76 @@
+package replica
+
+import (
+	"sync/atomic"
+
+	"github.com/longhorn/longhorn-engine/pkg/util"
+)
+
+// Zero detection is set for the whole process like the I/O engine, and so are its counters, which then survive the
+// replica being reloaded.
+var (
+	zeroDetection     atomic.Bool
+	zeroBytesDetected atomic.Uint64
+	zeroBytesSaved    atomic.Uint64
+)
+
+// SetZeroDetection sets whether the aligned all-zero sectors of writes are zeroed like WriteZeroesAt does rather
+// than written, so they are not stored in the head if no disk below it holds data for them.
+func SetZeroDetection(enabled bool) {
+	zeroDetection.Store(enabled)
+}
+
+// GetZeroDetectionMetrics returns the bytes of the all-zero sectors found in writes since the process started, and
+// how many of them were punched out of the head rather than written.
+func GetZeroDetectionMetrics() (detected, saved uint64) {
+	return zeroBytesDetected.Load(), zeroBytesSaved.Load()
+}
+
+// writeAtDetectingZeroes writes like WriteAt, except that the runs of aligned all-zero sectors are zeroed like
+// WriteZeroesAt does.
+func (d *diffDisk) writeAtDetectingZeroes(buf []byte, offset int64, isThereBackingFile bool) (int, error) {
+	end := offset + int64(len(buf))
+	alignedStart := (offset + d.sectorSize - 1) / d.sectorSize * d.sectorSize
+	alignedEnd := end / d.sectorSize * d.sectorSize
+	if alignedStart >= alignedEnd {
+		return d.WriteAt(buf, offset)
+	}
+
+	// Most writes hold data, so look for a zero sector before doing anything else.
+	firstZero := int64(-1)
+	for s := alignedStart; s < alignedEnd; s += d.sectorSize {
+		if util.IsZeroes(buf[s-offset : s-offset+d.sectorSize]) {
+			firstZero = s
+			break
+		}
+	}
+	if firstZero < 0 {
+		return d.WriteAt(buf, offset)
+	}
+
+	if _, err := d.WriteAt(buf[:firstZero-offset], offset); err != nil {
+		return 0, err
+	}
+	for s := firstZero; s < alignedEnd; {
+		zero := util.IsZeroes(buf[s-offset : s-offset+d.sectorSize])
+		runEnd := s + d.sectorSize
+		for runEnd < alignedEnd && util.IsZeroes(buf[runEnd-offset:runEnd-offset+d.sectorSize]) == zero {
+			runEnd += d.sectorSize
+		}
+		if zero {
+			punched, err := d.zeroSectors(s, runEnd, isThereBackingFile)
+			if err != nil {
+				return 0, err
+			}
+			zeroBytesDetected.Add(uint64(runEnd - s))
+			zeroBytesSaved.Add(uint64(punched))
+		} else if _, err := d.fullWriteAt(buf[s-offset:runEnd-offset], s); err != nil {
+			return 0, err
+		}
+		s = runEnd
+	}
+	if _, err := d.WriteAt(buf[alignedEnd-offset:], alignedEnd); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
@@ -106,6 +106,10 @@ func (t *Task) createBackup(replicaInController *types.ControllerReplicaInfo, ba
 		return nil, fmt.Errorf("snapshot disk %s not found on replica %s", diskName, replicaInController.Address)
 	}
 
+	if err := checkBackingImageChecksum(repClient, replicaInController.Address, backingImageChecksum); err != nil {
+		return nil, err
+	}
+
 	logrus.Infof("Backing up %s on %s, to %s", snapshot, replicaInController.Address, dest)
 
 	reply, err := repClient.CreateBackup(backupName, snapshot, dest, volumeName, backingImageName, backingImageChecksum,
@@ -120,6 +124,26 @@ func (t *Task) createBackup(replicaInController *types.ControllerReplicaInfo, ba
 	}, nil
 }
 
+// checkBackingImageChecksum makes sure the backing file of the replica is the backing image a backup refers to. There
+// is nothing to check if either has no backing file or image, or if the checksum of the backing file is not known.
+func checkBackingImageChecksum(repClient *replicaClient.ReplicaClient, address, backingImageChecksum string) error {
+	if backingImageChecksum == "" {
+		return nil
+	}
+	backingFile, err := repClient.GetBackingFile()
+	if err != nil {
+		return err
+	}
+	if backingFile == nil || backingFile.Checksum == "" {
+		return nil
+	}
+	if backingFile.Checksum != backingImageChecksum {
+		return fmt.Errorf("backing file %v of replica %s has checksum %v rather than the backing image checksum %v",
+			backingFile.Path, address, backingFile.Checksum, backingImageChecksum)
+	}
+	return nil
+}
+
 func FetchBackupStatus(client *replicaClient.ReplicaClient, backupID string, replicaAddr string) (*BackupStatusInfo, error) {
 	bs, err := client.BackupStatus(backupID)
 	if err != nil {
@@ -232,6 +256,11 @@ func (t *Task) RestoreBackup(backup string, credential map[string]string, concur
 		return taskErr
 	}
 
+	backupVolume, err := backupstore.LoadVolume(backup)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the backup volume of backup %v", backup)
+	}
+
 	if backupInfo.VolumeSize < volume.Size {
 		return fmt.Errorf("BUG: The backup volume %v size %v cannot be smaller than the DR volume %v size %v", backupInfo.VolumeName, backupInfo.VolumeSize, volume.Name, volume.Size)
 	}
@@ -248,7 +277,7 @@ func (t *Task) RestoreBackup(backup string, credential map[string]string, concur
 	for _, r := range replicas {
 		go func(replica *types.ControllerReplicaInfo) {
 			defer wg.Done()
-			err := t.restoreBackup(replica, backup, snapshotDiskName, credential, concurrentLimit)
+			err := t.restoreBackup(replica, backup, snapshotDiskName, backupVolume.BackingImageChecksum, credential, concurrentLimit)
 			if err != nil {
 				syncErrorMap.Store(replica.Address, err)
 			}
@@ -269,7 +298,7 @@ func (t *Task) RestoreBackup(backup string, credential map[string]string, concur
 	return nil
 }
 
-func (t *Task) restoreBackup(replicaInController *types.ControllerReplicaInfo, backup string, snapshotFile string,
+func (t *Task) restoreBackup(replicaInController *types.ControllerReplicaInfo, backup, snapshotFile, backingImageChecksum string,
 	credential map[string]string, concurrentLimit int) error {
 	if replicaInController.Mode == types.ERR {
 		return fmt.Errorf("cannot restore backup from replica in mode ERR")
@@ -286,6 +315,10 @@ func (t *Task) restoreBackup(replicaInController *types.ControllerReplicaInfo, b
 		}
 	}()
 
+	if err := checkBackingImageChecksum(repClient, replicaInController.Address, backingImageChecksum); err != nil {
+		return err
+	}
+
 	if err := repClient.RestoreBackup(backup, snapshotFile, credential, concurrentLimit); err != nil {
 		return err
 	}
@@ -19,6 +19,7 @@ import (
 	"github.com/moby/moby/pkg/reexec"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -34,8 +35,10 @@ import (
 	lhio "github.com/longhorn/go-common-libs/io"
 
 	"github.com/longhorn/longhorn-engine/pkg/backup"
+	"github.com/longhorn/longhorn-engine/pkg/generated/syncagentrpc"
 	"github.com/longhorn/longhorn-engine/pkg/interceptor"
 	"github.com/longhorn/longhorn-engine/pkg/replica"
+	"github.com/longhorn/longhorn-engine/pkg/tracing"
 	"github.com/longhorn/longhorn-engine/pkg/types"
 	"github.com/longhorn/longhorn-engine/pkg/util"
 
@@ -46,7 +49,7 @@ import (
 /*
  * Lock sequence
  * 1. SyncAgentServer
- * 2. BackupList, RestoreInfo or PurgeStatus (cannot be hold at the same time)
+ * 2. BackupList, RestoreInfo, PurgeStatus or FlattenStatus (cannot be hold at the same time)
  */
 
 const (
@@ -67,6 +70,7 @@ type SyncAgentServer struct {
 	isRestoring     bool
 	isRebuilding    bool
 	isCloning       bool
+	isFlattening    bool
 	replicaAddress  string
 	volumeName      string
 	instanceName    string
@@ -77,6 +81,7 @@ type SyncAgentServer struct {
 	PurgeStatus      *PurgeStatus
 	RebuildStatus    *RebuildStatus
 	CloneStatus      *CloneStatus
+	FlattenStatus    *FlattenStatus
 }
 
 type PurgeStatus struct {
@@ -101,6 +106,29 @@ func (ps *PurgeStatus) UpdateFileHandlingProgress(progress int, done bool, err e
 	}
 }
 
+type FlattenStatus struct {
+	sync.RWMutex
+	Error    string
+	Progress int
+	State    types.ProcessState
+
+	processedSize int64
+	totalSize     int64
+}
+
+func (fs *FlattenStatus) updateProgress(size int64) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.processedSize += size
+	// Avoid possible division by zero, also total 0 means nothing to be done
+	if fs.totalSize == 0 {
+		fs.Progress = 100
+	} else {
+		fs.Progress = int((float32(fs.processedSize) / float32(fs.totalSize)) * 100)
+	}
+}
+
 type RebuildStatus struct {
 	sync.RWMutex
 	Error              string
@@ -156,9 +184,12 @@ func NewSyncAgentServer(startPort, endPort int, replicaAddress, volumeName, inst
 		PurgeStatus:      &PurgeStatus{},
 		RebuildStatus:    &RebuildStatus{},
 		CloneStatus:      &CloneStatus{},
+		FlattenStatus:    &FlattenStatus{},
 	}
-	server := grpc.NewServer(interceptor.WithIdentityValidationReplicaServerInterceptor(volumeName, instanceName))
+	server := grpc.NewServer(interceptor.WithIdentityValidationReplicaServerInterceptor(volumeName, instanceName),
+		interceptor.WithTracingServerInterceptor())
 	enginerpc.RegisterSyncAgentServiceServer(server, sas)
+	syncagentrpc.RegisterSyncAgentServiceServer(server, NewSyncAgentRPCServer(sas))
 	reflection.Register(server)
 
 	// Runtime switchable pprof profiler server. Add "-sync-agent" suffix to the server name to avoid potential conflict.
@@ -209,6 +240,9 @@ func (s *SyncAgentServer) StartRestore(backupURL, requestedBackupName, snapshotD
 	if s.isRestoring {
 		return fmt.Errorf("cannot initiate backup restore as there is one already in progress")
 	}
+	if s.isFlattening {
+		return fmt.Errorf("cannot initiate backup restore as the replica is flattening")
+	}
 
 	if s.RestoreInfo == nil {
 		return fmt.Errorf("BUG: the restore status is not initialized in the sync agent server")
@@ -540,17 +574,31 @@ func (s *SyncAgentServer) fileSyncRemote(ctx context.Context, req *enginerpc.Fil
 			ops = s.RebuildStatus
 		}
 
-		port, err := s.launchReceiver("FilesSync", info.ToFileName, ops)
-		if err != nil {
-			return errors.Wrapf(err, "failed to launch receiver for file %v", info.ToFileName)
-		}
-		if err := fromClient.SendFile(info.FromFileName, req.ToHost, int32(port), int(req.FileSyncHttpClientTimeout), req.FastSync, req.GrpcTimeoutSeconds); err != nil {
-			return errors.Wrapf(err, "replica %v failed to send file %v to %v:%v", req.FromAddress, info.ToFileName, req.ToHost, port)
+		if err := s.fileSyncRemoteFile(ctx, req, info, fromClient, ops); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func (s *SyncAgentServer) fileSyncRemoteFile(ctx context.Context, req *enginerpc.FilesSyncRequest, info *enginerpc.SyncFileInfo,
+	fromClient *replicaclient.ReplicaClient, ops sparserest.SyncFileOperations) (err error) {
+	_, span := tracing.StartSpan(ctx, "SyncAgent/FilesSync/file", attribute.String("file", info.ToFileName),
+		attribute.Int64("size", info.ActualSize), attribute.String("from", req.FromAddress))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
+	port, err := s.launchReceiver("FilesSync", info.ToFileName, ops)
+	if err != nil {
+		return errors.Wrapf(err, "failed to launch receiver for file %v", info.ToFileName)
+	}
+	if err := fromClient.SendFile(info.FromFileName, req.ToHost, int32(port), int(req.FileSyncHttpClientTimeout), req.FastSync, req.GrpcTimeoutSeconds); err != nil {
+		return errors.Wrapf(err, "replica %v failed to send file %v to %v:%v", req.FromAddress, info.ToFileName, req.ToHost, port)
+	}
+	return nil
+}
+
 func (s *SyncAgentServer) PrepareRebuild(list []*enginerpc.SyncFileInfo, fromReplicaAddress string) error {
 	s.Lock()
 	defer s.Unlock()
@@ -558,6 +606,9 @@ func (s *SyncAgentServer) PrepareRebuild(list []*enginerpc.SyncFileInfo, fromRep
 	if s.isPurging {
 		return fmt.Errorf("replica is purging snapshots")
 	}
+	if s.isFlattening {
+		return fmt.Errorf("replica is flattening")
+	}
 	if s.isRebuilding {
 		return fmt.Errorf("replica is already rebuilding")
 	}
@@ -677,6 +728,9 @@ func (s *SyncAgentServer) prepareClone(fromReplicaAddress, snapshotName string,
 	if s.isCloning {
 		return fmt.Errorf("replica is cloning snapshot %v from replica address %v", cloneStatus.SnapshotName, cloneStatus.FromReplicaAddress)
 	}
+	if s.isFlattening {
+		return fmt.Errorf("replica is flattening")
+	}
 	s.isCloning = true
 
 	cloneStatus.Lock()
@@ -802,9 +856,15 @@ func (s *SyncAgentServer) BackupCreate(ctx context.Context, req *enginerpc.Backu
 		return nil, errors.Wrapf(err, "failed to add the backup object %v", backupStatus.Name)
 	}
 
+	// The backup keeps running after this call returns. Its span ends once the backup completes or fails.
+	_, span := tracing.StartJobSpan(ctx, "SyncAgent/BackupCreate/job", attribute.String("backup", backupStatus.Name),
+		attribute.String("snapshot", req.SnapshotFileName))
+	backupStatus.SetTraceSpan(span)
+
 	err = backup.DoBackupCreate(backupStatus, backupConfig)
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to create backup %v", req.BackupName)
+		backupStatus.EndTraceSpan(err)
 		return nil, err
 	}
 
@@ -917,10 +977,14 @@ func (s *SyncAgentServer) BackupRestore(ctx context.Context, req *enginerpc.Back
 		return nil, errors.Wrapf(err, "error starting backup restore")
 	}
 
+	_, span := tracing.StartJobSpan(ctx, "SyncAgent/BackupRestore/job", attribute.String("backup", req.Backup),
+		attribute.String("snapshot", req.SnapshotDiskName))
 	go func() {
-		if completeErr := s.completeBackupRestore(); completeErr != nil {
+		completeErr := s.completeBackupRestore()
+		if completeErr != nil {
 			logrus.WithError(completeErr).Warn("Failed to complete backup restore")
 		}
+		tracing.EndSpan(span, completeErr)
 	}()
 
 	return &emptypb.Empty{}, nil
@@ -1053,7 +1117,7 @@ func (s *SyncAgentServer) postIncrementalRestoreOperations(restoreStatus *replic
 
 func (s *SyncAgentServer) reloadReplica() error {
 	conn, err := grpc.NewClient(s.replicaAddress, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName))
+		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", s.replicaAddress)
 	}
@@ -1076,7 +1140,7 @@ func (s *SyncAgentServer) reloadReplica() error {
 
 func (s *SyncAgentServer) replicaRevert(name, created string) error {
 	conn, err := grpc.NewClient(s.replicaAddress, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName))
+		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", s.replicaAddress)
 	}
@@ -1125,10 +1189,13 @@ func (s *SyncAgentServer) SnapshotPurge(ctx context.Context, req *emptypb.Empty)
 		return nil, err
 	}
 
+	_, span := tracing.StartJobSpan(ctx, "SyncAgent/SnapshotPurge/job")
 	go func() {
-		if purgeErr := s.purgeSnapshots(); purgeErr != nil {
+		purgeErr := s.purgeSnapshots()
+		if purgeErr != nil {
 			logrus.WithError(purgeErr).Warn("Failed to purge snapshots")
 		}
+		tracing.EndSpan(span, purgeErr)
 	}()
 
 	return &emptypb.Empty{}, nil
@@ -1283,6 +1350,9 @@ func (s *SyncAgentServer) PreparePurge() error {
 	if s.isPurging {
 		return fmt.Errorf("replica is already purging snapshots")
 	}
+	if s.isFlattening {
+		return fmt.Errorf("replica is flattening")
+	}
 
 	s.isPurging = true
 
@@ -1386,7 +1456,7 @@ func getSnapshotsInfo(replicaClient *replicaclient.ReplicaClient) (map[string]ty
 
 func (s *SyncAgentServer) markSnapshotAsRemoved(snapshot string) error {
 	conn, err := grpc.NewClient(s.replicaAddress, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName))
+		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", s.replicaAddress)
 	}
@@ -1411,7 +1481,7 @@ func (s *SyncAgentServer) markSnapshotAsRemoved(snapshot string) error {
 
 func (s *SyncAgentServer) processRemoveSnapshot(snapshot string) error {
 	conn, err := grpc.NewClient(s.replicaAddress, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName))
+		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", s.replicaAddress)
 	}
@@ -1466,7 +1536,7 @@ func (s *SyncAgentServer) processRemoveSnapshot(snapshot string) error {
 
 func (s *SyncAgentServer) replaceDisk(source, target string) error {
 	conn, err := grpc.NewClient(s.replicaAddress, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName))
+		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", s.replicaAddress)
 	}
@@ -1492,7 +1562,7 @@ func (s *SyncAgentServer) replaceDisk(source, target string) error {
 
 func (s *SyncAgentServer) rmDisk(disk string) error {
 	conn, err := grpc.NewClient(s.replicaAddress, grpc.WithTransportCredentials(insecure.NewCredentials()),
-		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName))
+		interceptor.WithIdentityValidationClientInterceptor(s.volumeName, s.instanceName), interceptor.WithTracingClientInterceptor())
 	if err != nil {
 		return errors.Wrapf(err, "cannot connect to ReplicaService %v", s.replicaAddress)
 	}
@@ -1521,16 +1591,23 @@ func (s *SyncAgentServer) SnapshotHash(ctx context.Context, req *enginerpc.Snaps
 		return nil, fmt.Errorf("snapshot name is required")
 	}
 
+	_, span := tracing.StartJobSpan(ctx, "SyncAgent/SnapshotHash/job", attribute.String("snapshot", req.SnapshotName),
+		attribute.Bool("rehash", req.Rehash))
 	go func() {
+		var err error
+		defer func() {
+			tracing.EndSpan(span, err)
+		}()
+
 		ctx, cancel := context.WithCancel(context.Background())
 		task := replica.NewSnapshotHashJob(ctx, cancel, req.SnapshotName, req.Rehash)
 
-		if err := s.SnapshotHashList.Add(req.SnapshotName, task); err != nil {
+		if err = s.SnapshotHashList.Add(req.SnapshotName, task); err != nil {
 			logrus.WithError(err).Errorf("failed to add snapshot %v for hashing", req.SnapshotName)
 			return
 		}
 
-		if err := task.Execute(); err != nil {
+		if err = task.Execute(); err != nil {
 			logrus.WithError(err).Errorf("failed to hash snapshot %v", req.SnapshotName)
 		}
 	}()
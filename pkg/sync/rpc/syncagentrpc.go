@@ -0,0 +1,311 @@
+package rpc
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/longhorn/sparse-tools/sparse"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/longhorn/longhorn-engine/pkg/backingfile"
+	"github.com/longhorn/longhorn-engine/pkg/generated/syncagentrpc"
+	"github.com/longhorn/longhorn-engine/pkg/replica"
+	"github.com/longhorn/longhorn-engine/pkg/tracing"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+	"github.com/longhorn/longhorn-engine/pkg/util"
+
+	replicaclient "github.com/longhorn/longhorn-engine/pkg/replica/client"
+	diskutil "github.com/longhorn/longhorn-engine/pkg/util/disk"
+)
+
+const (
+	flattenBlockSize  = 4096
+	flattenBufferSize = 1 << 20
+)
+
+// SyncAgentRPCServer serves syncagentrpc.SyncAgentService. It is registered on the same gRPC server as
+// SyncAgentServer, whose state it shares.
+type SyncAgentRPCServer struct {
+	syncagentrpc.UnimplementedSyncAgentServiceServer
+	s *SyncAgentServer
+}
+
+func NewSyncAgentRPCServer(s *SyncAgentServer) *SyncAgentRPCServer {
+	return &SyncAgentRPCServer{s: s}
+}
+
+func (ss *SyncAgentRPCServer) VolumeFlatten(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	s := ss.s
+	if err := s.PrepareFlatten(); err != nil {
+		return nil, err
+	}
+
+	_, span := tracing.StartJobSpan(ctx, "SyncAgent/VolumeFlatten/job")
+	go func() {
+		flattenErr := s.flattenVolume()
+		if flattenErr != nil {
+			logrus.WithError(flattenErr).Warn("Failed to flatten volume")
+		}
+		tracing.EndSpan(span, flattenErr)
+	}()
+
+	return &emptypb.Empty{}, nil
+}
+
+func (ss *SyncAgentRPCServer) VolumeFlattenStatus(ctx context.Context, req *emptypb.Empty) (*syncagentrpc.VolumeFlattenStatusResponse, error) {
+	s := ss.s
+	isFlattening := s.IsFlattening()
+
+	s.FlattenStatus.RLock()
+	defer s.FlattenStatus.RUnlock()
+	return &syncagentrpc.VolumeFlattenStatusResponse{
+		IsFlattening: isFlattening,
+		Error:        s.FlattenStatus.Error,
+		Progress:     int32(s.FlattenStatus.Progress),
+		State:        string(s.FlattenStatus.State),
+	}, nil
+}
+
+func (s *SyncAgentServer) PrepareFlatten() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.isFlattening {
+		return fmt.Errorf("replica is already flattening")
+	}
+	if s.isPurging {
+		return fmt.Errorf("replica is purging snapshots")
+	}
+	if s.isRebuilding {
+		return fmt.Errorf("replica is rebuilding")
+	}
+	if s.isCloning {
+		return fmt.Errorf("replica is cloning a snapshot")
+	}
+	if s.isRestoring {
+		return fmt.Errorf("replica is restoring a backup")
+	}
+
+	s.isFlattening = true
+
+	s.FlattenStatus.Lock()
+	s.FlattenStatus.Error = ""
+	s.FlattenStatus.Progress = 0
+	s.FlattenStatus.State = types.ProcessStateInProgress
+	s.FlattenStatus.processedSize = 0
+	s.FlattenStatus.totalSize = 0
+	s.FlattenStatus.Unlock()
+
+	return nil
+}
+
+func (s *SyncAgentServer) FinishFlatten() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.isFlattening {
+		return fmt.Errorf("BUG: replica is not flattening")
+	}
+
+	s.isFlattening = false
+	return nil
+}
+
+func (s *SyncAgentServer) IsFlattening() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.isFlattening
+}
+
+// flattenVolume copies the backing file data that the oldest snapshot does not shadow into that snapshot, then has
+// the replica drop its backing file. Later snapshots are left alone: which of them are in the live chain can change
+// with a revert, while the oldest snapshot is under all of them.
+func (s *SyncAgentServer) flattenVolume() (err error) {
+	defer func() {
+		s.FlattenStatus.Lock()
+		if err != nil {
+			s.FlattenStatus.Error = err.Error()
+			s.FlattenStatus.State = types.ProcessStateError
+		} else {
+			s.FlattenStatus.Progress = 100
+			s.FlattenStatus.State = types.ProcessStateComplete
+		}
+		s.FlattenStatus.Unlock()
+
+		if err := s.FinishFlatten(); err != nil {
+			logrus.WithError(err).Error("Could not mark finish flatten")
+		}
+	}()
+
+	replicaClient, err := replicaclient.NewReplicaClient(s.replicaAddress, s.volumeName, s.instanceName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := replicaClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close replica client for for replica address %v", s.replicaAddress)
+		}
+	}()
+
+	info, err := replicaClient.GetReplica()
+	if err != nil {
+		return err
+	}
+	if info.BackingFile == "" {
+		logrus.Info("Replica has no backing file, nothing to flatten")
+		return nil
+	}
+
+	root, err := getRootDisk(info)
+	if err != nil {
+		return err
+	}
+	if diskutil.IsHeadDisk(root) {
+		return fmt.Errorf("no snapshot to flatten into, the volume head is the only disk of the replica")
+	}
+
+	logrus.Infof("Flattening backing file %v into disk %v", info.BackingFile, root)
+	if err := s.copyBackingFile(info.BackingFile, root); err != nil {
+		return errors.Wrapf(err, "failed to copy backing file %v into disk %v", info.BackingFile, root)
+	}
+
+	// The content of the snapshot changed, so its recorded checksum no longer holds.
+	snapshotName, err := diskutil.GetSnapshotNameFromDiskName(root)
+	if err != nil {
+		return err
+	}
+	if err := replica.DeleteSnapshotHashInfoChecksumFile(snapshotName); err != nil {
+		return errors.Wrapf(err, "failed to delete checksum file of snapshot %v", snapshotName)
+	}
+
+	return replicaClient.RemoveBackingFile()
+}
+
+// getRootDisk returns the oldest disk of the live chain of the replica.
+func getRootDisk(info *types.ReplicaInfo) (string, error) {
+	root := info.Head
+	for {
+		disk, ok := info.Disks[root]
+		if !ok {
+			return "", fmt.Errorf("cannot find disk %v in the replica", root)
+		}
+		if disk.Parent == "" || disk.Parent == info.BackingFile {
+			return root, nil
+		}
+		root = disk.Parent
+	}
+}
+
+// copyBackingFile fills the holes of the disk file with the backing file data at the same offsets. Blocks of zeros
+// are skipped, since a hole reads as zeros already.
+func (s *SyncAgentServer) copyBackingFile(backingFilePath, diskName string) (err error) {
+	backing, err := backingfile.OpenBackingFile(backingFilePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := backing.Disk.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close backing file %v", backingFilePath)
+		}
+	}()
+
+	fileIo, err := sparse.NewDirectFileIoProcessor(diskName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := fileIo.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}()
+
+	diskSize, err := fileIo.Size()
+	if err != nil {
+		return err
+	}
+	limit := min(backing.Size, diskSize)
+
+	holes, err := getFileHoles(fileIo, limit)
+	if err != nil {
+		return err
+	}
+	s.FlattenStatus.Lock()
+	for _, hole := range holes {
+		s.FlattenStatus.totalSize += hole.Len()
+	}
+	s.FlattenStatus.Unlock()
+
+	buf := sparse.AllocateAligned(flattenBufferSize)
+	for _, hole := range holes {
+		for offset := hole.Begin; offset < hole.End; offset += flattenBufferSize {
+			length := min(int64(flattenBufferSize), hole.End-offset)
+			if _, err := backing.Disk.ReadAt(buf[:length], offset); err != nil {
+				return errors.Wrapf(err, "failed to read backing file at %v", offset)
+			}
+			if err := writeNonZeroBlocks(fileIo, buf[:length], offset); err != nil {
+				return err
+			}
+			s.FlattenStatus.updateProgress(length)
+		}
+	}
+
+	return fileIo.GetFile().Sync()
+}
+
+// getFileHoles returns the holes of the file below limit.
+func getFileHoles(fileIo sparse.FileIoProcessor, limit int64) ([]sparse.Interval, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out, errc, err := fileIo.GetDataLayout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var holes []sparse.Interval
+	for interval := range out {
+		if interval.Kind != sparse.SparseHole || interval.Begin >= limit {
+			continue
+		}
+		holes = append(holes, sparse.Interval{Begin: interval.Begin, End: min(interval.End, limit)})
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return holes, nil
+}
+
+// writeNonZeroBlocks writes the runs of blocks of buf that are not all zeros at offset. The last block may be
+// shorter than the others.
+func writeNonZeroBlocks(fileIo sparse.FileIoProcessor, buf []byte, offset int64) error {
+	write := func(start, end int) error {
+		if _, err := fileIo.WriteAt(buf[start:end], offset+int64(start)); err != nil {
+			return errors.Wrapf(err, "failed to write at %v", offset+int64(start))
+		}
+		return nil
+	}
+
+	start := -1
+	for i := 0; i < len(buf); i += flattenBlockSize {
+		if !util.IsZeroes(buf[i:min(i+flattenBlockSize, len(buf))]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			if err := write(start, i); err != nil {
+				return err
+			}
+			start = -1
+		}
+	}
+	if start >= 0 {
+		return write(start, len(buf))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package rpc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/longhorn/sparse-tools/sparse"
+	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/longhorn-engine/pkg/replica"
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+// recordingFileIo records the writes done to it.
+type recordingFileIo struct {
+	sparse.FileIoProcessor
+	writes []sparse.Interval
+}
+
+func (f *recordingFileIo) WriteAt(data []byte, offset int64) (int, error) {
+	f.writes = append(f.writes, sparse.Interval{Begin: offset, End: offset + int64(len(data))})
+	return len(data), nil
+}
+
+func (s *TestSuite) TestFlattenExcludesRestore(c *C) {
+	sas := &SyncAgentServer{
+		RestoreInfo:   &replica.RestoreStatus{},
+		FlattenStatus: &FlattenStatus{},
+	}
+
+	c.Assert(sas.PrepareFlatten(), IsNil)
+	err := sas.StartRestore("s3://backupstore@us-east-1/", "backup-1", "volume-snap-000.img", 1)
+	c.Assert(err, ErrorMatches, ".*replica is flattening")
+	c.Assert(sas.IsRestoring(), Equals, false)
+	c.Assert(sas.RestoreInfo.LastRestored, Equals, "")
+	c.Assert(sas.FinishFlatten(), IsNil)
+
+	sas.isRestoring = true
+	c.Assert(sas.PrepareFlatten(), ErrorMatches, "replica is restoring a backup")
+	c.Assert(sas.IsFlattening(), Equals, false)
+}
+
+func (s *TestSuite) TestGetRootDisk(c *C) {
+	chain := func(backingFile string, parents ...string) *types.ReplicaInfo {
+		// parents are the disk names from the head, each the parent of the previous one
+		info := &types.ReplicaInfo{Head: parents[0], BackingFile: backingFile, Disks: map[string]types.DiskInfo{}}
+		for i, name := range parents {
+			parent := backingFile
+			if i+1 < len(parents) {
+				parent = parents[i+1]
+			}
+			info.Disks[name] = types.DiskInfo{Name: name, Parent: parent}
+		}
+		if backingFile != "" {
+			info.Disks[backingFile] = types.DiskInfo{Name: backingFile}
+		}
+		return info
+	}
+	broken := chain("backing.qcow2", "volume-head-002.img", "volume-snap-001.img")
+	broken.Disks["volume-snap-001.img"] = types.DiskInfo{Name: "volume-snap-001.img", Parent: "volume-snap-000.img"}
+
+	for _, t := range []struct {
+		comment string
+		info    *types.ReplicaInfo
+		root    string
+		err     string
+	}{
+		{"head only", chain("backing.qcow2", "volume-head-000.img"), "volume-head-000.img", ""},
+		{"snapshots", chain("backing.qcow2", "volume-head-002.img", "volume-snap-001.img", "volume-snap-000.img"),
+			"volume-snap-000.img", ""},
+		{"no backing file", chain("", "volume-head-001.img", "volume-snap-000.img"), "volume-snap-000.img", ""},
+		{"missing disk", broken, "", "cannot find disk volume-snap-000.img in the replica"},
+		{"missing head", &types.ReplicaInfo{Head: "volume-head-000.img"}, "",
+			"cannot find disk volume-head-000.img in the replica"},
+	} {
+		root, err := getRootDisk(t.info)
+		if t.err != "" {
+			c.Assert(err, ErrorMatches, t.err, Commentf(t.comment))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf(t.comment))
+		c.Assert(root, Equals, t.root, Commentf(t.comment))
+	}
+}
+
+func (s *TestSuite) TestWriteNonZeroBlocks(c *C) {
+	data := bytes.Repeat([]byte{1}, flattenBlockSize)
+	zero := make([]byte, flattenBlockSize)
+	var buf []byte
+	for _, block := range [][]byte{data, zero, data, data, zero, zero, data[:512]} {
+		buf = append(buf, block...)
+	}
+	// A block with a single byte set is not zeros.
+	buf[5*flattenBlockSize+100] = 1
+
+	fileIo := &recordingFileIo{}
+	c.Assert(writeNonZeroBlocks(fileIo, buf, 1<<20), IsNil)
+	c.Assert(fileIo.writes, DeepEquals, []sparse.Interval{
+		{Begin: 1 << 20, End: 1<<20 + flattenBlockSize},
+		{Begin: 1<<20 + 2*flattenBlockSize, End: 1<<20 + 4*flattenBlockSize},
+		{Begin: 1<<20 + 5*flattenBlockSize, End: 1<<20 + 6*flattenBlockSize + 512},
+	})
+
+	fileIo = &recordingFileIo{}
+	c.Assert(writeNonZeroBlocks(fileIo, make([]byte, 3*flattenBlockSize), 0), IsNil)
+	c.Assert(fileIo.writes, HasLen, 0)
+}
+
+func (s *TestSuite) TestCopyBackingFile(c *C) {
+	dir := c.MkDir()
+	const block = flattenBlockSize
+
+	// The backing file is larger than the disk, and its block 3 is zeros.
+	backing := make([]byte, 5*block)
+	for i := range backing {
+		if i/block != 3 {
+			backing[i] = byte(i/block + 1)
+		}
+	}
+	backingPath := filepath.Join(dir, "backing.img")
+	c.Assert(os.WriteFile(backingPath, backing, 0644), IsNil)
+
+	// The disk only has block 1, which shadows the backing file.
+	diskPath := filepath.Join(dir, "volume-snap-000.img")
+	disk, err := os.Create(diskPath)
+	c.Assert(err, IsNil)
+	c.Assert(disk.Truncate(4*block), IsNil)
+	_, err = disk.WriteAt(bytes.Repeat([]byte{9}, block), block)
+	c.Assert(err, IsNil)
+	c.Assert(disk.Close(), IsNil)
+
+	sas := &SyncAgentServer{FlattenStatus: &FlattenStatus{}}
+	c.Assert(sas.copyBackingFile(backingPath, diskPath), IsNil)
+
+	expected := make([]byte, 4*block)
+	copy(expected, backing)
+	copy(expected[block:], bytes.Repeat([]byte{9}, block))
+	result, err := os.ReadFile(diskPath)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, expected)
+
+	// The zero block was not written and is still a hole.
+	fileIo, err := sparse.NewDirectFileIoProcessor(diskPath, os.O_RDONLY, 0)
+	c.Assert(err, IsNil)
+	defer fileIo.Close()
+	holes, err := getFileHoles(fileIo, 4*block)
+	c.Assert(err, IsNil)
+	c.Assert(holes, DeepEquals, []sparse.Interval{{Begin: 3 * block, End: 4 * block}})
+
+	c.Assert(sas.FlattenStatus.totalSize, Equals, int64(3*block))
+	c.Assert(sas.FlattenStatus.processedSize, Equals, int64(3*block))
+}
+
+func (s *TestSuite) TestCopyBackingFileUnalignedEnd(c *C) {
+	dir := c.MkDir()
+	const block = flattenBlockSize
+
+	// The backing file ends in the middle of a block of the disk.
+	backing := bytes.Repeat([]byte{1}, 2*block+512)
+	backingPath := filepath.Join(dir, "backing.img")
+	c.Assert(os.WriteFile(backingPath, backing, 0644), IsNil)
+	diskPath := filepath.Join(dir, "volume-snap-000.img")
+	disk, err := os.Create(diskPath)
+	c.Assert(err, IsNil)
+	c.Assert(disk.Truncate(3*block), IsNil)
+	c.Assert(disk.Close(), IsNil)
+
+	sas := &SyncAgentServer{FlattenStatus: &FlattenStatus{}}
+	c.Assert(sas.copyBackingFile(backingPath, diskPath), IsNil)
+	result, err := os.ReadFile(diskPath)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, append(backing, make([]byte, block-512)...))
+}
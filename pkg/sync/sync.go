@@ -38,6 +38,13 @@ type SnapshotPurgeStatus struct {
 	State     string `json:"state"`
 }
 
+type VolumeFlattenStatus struct {
+	Error        string `json:"error"`
+	IsFlattening bool   `json:"isFlattening"`
+	Progress     int    `json:"progress"`
+	State        string `json:"state"`
+}
+
 type ReplicaRebuildStatus struct {
 	Error              string `json:"error"`
 	IsRebuilding       bool   `json:"isRebuilding"`
@@ -269,6 +276,144 @@ func (t *Task) PurgeSnapshotStatus() (map[string]*SnapshotPurgeStatus, error) {
 	return replicaStatusMap, nil
 }
 
+// FlattenVolume starts copying the backing file into the oldest snapshot of every replica, after which the replicas
+// drop the backing file. A snapshot is taken first if a replica has nothing but its volume head.
+func (t *Task) FlattenVolume() error {
+	replicas, err := t.client.ReplicaList()
+	if err != nil {
+		return errors.Wrap(err, "failed to list replicas before flattening")
+	}
+
+	needSnapshot := false
+	taskErr := NewTaskError()
+	for _, r := range replicas {
+		if r.Mode != types.RW {
+			taskErr.Append(NewReplicaError(r.Address, fmt.Errorf("cannot flatten volume because %s is in mode %s", r.Address, r.Mode)))
+			continue
+		}
+
+		// We don't know the replica's instanceName, so create a client without it.
+		repClient, err := replicaClient.NewReplicaClient(r.Address, t.client.VolumeName, "")
+		if err != nil {
+			taskErr.Append(NewReplicaError(r.Address, errors.Wrapf(err, "failed to get replica client %v before flattening", r.Address)))
+			continue
+		}
+		replica, err := repClient.GetReplica()
+		if errClose := repClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close replica client for replica address %s", r.Address)
+		}
+		if err != nil {
+			taskErr.Append(NewReplicaError(r.Address, errors.Wrapf(err, "failed to get replica %v before flattening", r.Address)))
+			continue
+		}
+		if replica.Rebuilding {
+			taskErr.Append(NewReplicaError(r.Address, fmt.Errorf("cannot flatten volume because %s is rebuilding", r.Address)))
+			continue
+		}
+		if replica.BackingFile != "" && len(replica.Chain) < 2 {
+			needSnapshot = true
+		}
+	}
+
+	if taskErr.HasError() {
+		return taskErr
+	}
+
+	if needSnapshot {
+		name, err := t.client.VolumeSnapshot("", nil, false)
+		if err != nil {
+			return errors.Wrap(err, "failed to create a snapshot to flatten into")
+		}
+		logrus.Infof("Created snapshot %v to flatten the backing file into", name)
+	}
+
+	errorMap := sync.Map{}
+	var wg sync.WaitGroup
+	wg.Add(len(replicas))
+
+	for _, r := range replicas {
+		go func(rep *types.ControllerReplicaInfo) {
+			defer wg.Done()
+
+			// We don't know the replica's instanceName, so create a client without it.
+			repClient, err := replicaClient.NewReplicaClient(rep.Address, t.client.VolumeName, "")
+			if err != nil {
+				errorMap.Store(rep.Address, errors.Wrapf(err, "failed to get replica client %v before flattening", rep.Address))
+				return
+			}
+			defer func() {
+				if errClose := repClient.Close(); errClose != nil {
+					logrus.WithError(errClose).Errorf("Failed to close replica client for replica address %s", rep.Address)
+				}
+			}()
+
+			if err := repClient.VolumeFlatten(); err != nil {
+				errorMap.Store(rep.Address, errors.Wrapf(err, "replica %v failed to execute volume flatten", rep.Address))
+				return
+			}
+		}(r)
+	}
+
+	wg.Wait()
+
+	for _, r := range replicas {
+		if v, ok := errorMap.Load(r.Address); ok {
+			taskErr.Append(NewReplicaError(r.Address, v.(error)))
+		}
+	}
+
+	if taskErr.HasError() {
+		return taskErr
+	}
+	return nil
+}
+
+func (t *Task) FlattenVolumeStatus() (map[string]*VolumeFlattenStatus, error) {
+	replicaStatusMap := make(map[string]*VolumeFlattenStatus)
+
+	replicas, err := t.client.ReplicaList()
+	if err != nil {
+		return nil, err
+	}
+
+	// clean up clients after processing
+	var clients []*replicaClient.ReplicaClient
+	defer func() {
+		for _, client := range clients {
+			_ = client.Close()
+		}
+	}()
+
+	for _, r := range replicas {
+		if r.Mode == types.ERR {
+			continue
+		}
+
+		// We don't know the replica's instanceName, so create a client without it.
+		repClient, err := replicaClient.NewReplicaClient(r.Address, t.client.VolumeName, "")
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, repClient)
+
+		status, err := repClient.VolumeFlattenStatus()
+		if err != nil {
+			replicaStatusMap[r.Address] = &VolumeFlattenStatus{
+				Error: fmt.Sprintf("failed to get volume flatten status of %v: %v", r.Address, err),
+			}
+			continue
+		}
+		replicaStatusMap[r.Address] = &VolumeFlattenStatus{
+			Error:        status.Error,
+			IsFlattening: status.IsFlattening,
+			Progress:     int(status.Progress),
+			State:        status.State,
+		}
+	}
+
+	return replicaStatusMap, nil
+}
+
 func (t *Task) isRebuilding(replicaInController *types.ControllerReplicaInfo) (bool, error) {
 	// We don't know the replica's instanceName, so create a client without it.
 	repClient, err := replicaClient.NewReplicaClient(replicaInController.Address, t.client.VolumeName, "")
@@ -454,6 +599,10 @@ func (t *Task) AddReplica(volumeSize, volumeCurrentSize int64, address, instance
 		return err
 	}
 
+	if err := t.checkBackingFile(address, instanceName); err != nil {
+		return err
+	}
+
 	logrus.Infof("Adding replica %s in WO mode", address)
 	_, err = t.client.ReplicaCreate(address, true, types.WO)
 	if err != nil {
@@ -494,6 +643,50 @@ func (t *Task) AddReplica(volumeSize, volumeCurrentSize int64, address, instance
 	return nil
 }
 
+// checkBackingFile makes sure the replica has the same backing file as the RW replicas it is about to be rebuilt from.
+func (t *Task) checkBackingFile(address, instanceName string) error {
+	client, err := replicaClient.NewReplicaClient(address, t.client.VolumeName, instanceName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := client.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close replica client for replica address %s", address)
+		}
+	}()
+
+	backingFile, err := client.GetBackingFile()
+	if err != nil {
+		return err
+	}
+
+	replicas, err := t.client.ReplicaList()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		if r.Mode != types.RW {
+			continue
+		}
+		// We don't know the replica's instanceName, so create a client without it.
+		rwClient, err := replicaClient.NewReplicaClient(r.Address, t.client.VolumeName, "")
+		if err != nil {
+			return err
+		}
+		rwBackingFile, err := rwClient.GetBackingFile()
+		if errClose := rwClient.Close(); errClose != nil {
+			logrus.WithError(errClose).Errorf("Failed to close replica client for replica address %s", r.Address)
+		}
+		if err != nil {
+			return err
+		}
+		if err := types.CheckSameBackingFile(rwBackingFile, backingFile); err != nil {
+			return errors.Wrapf(err, "replica %v does not have the backing file of RW replica %v", address, r.Address)
+		}
+	}
+	return nil
+}
+
 func (t *Task) checkAndResetFailedRebuild(address, instanceName string) error {
 	client, err := replicaClient.NewReplicaClient(address, t.client.VolumeName, instanceName)
 	if err != nil {
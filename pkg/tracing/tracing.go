@@ -0,0 +1,163 @@
+package tracing
+
+import (
+	"context"
+	"math/rand/v2"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/longhorn/longhorn-engine/pkg/meta"
+)
+
+const (
+	tracerName  = "github.com/longhorn/longhorn-engine"
+	serviceName = "longhorn-engine"
+)
+
+// commandSpanContext is the span of a one-shot CLI command, e.g. "add-replica". Most gRPC clients of this repo make
+// their calls with a context derived from context.Background(), and the command span becomes their parent so that
+// a whole command ends up in one trace.
+var commandSpanContext trace.SpanContext
+
+// dataconnSampleRatio is the fraction of dataconn requests that get a span. It is 0 unless tracing is set up, so the
+// I/O path does not pay for tracing by default.
+var dataconnSampleRatio float64
+
+type Options struct {
+	// OTLPEndpoint is the host:port of an OTLP gRPC collector, e.g. localhost:4317.
+	OTLPEndpoint string
+	// File is the path of a file to write the spans to as JSON.
+	File string
+	// SampleRatio is the fraction of traces that are sampled when there is no parent span.
+	SampleRatio float64
+	// DataconnSampleRatio is the fraction of dataconn requests that are traced.
+	DataconnSampleRatio float64
+	// Command is the longhorn sub-command this process runs, e.g. controller, replica or sync-agent.
+	Command string
+}
+
+// Setup installs the global tracer provider and the W3C trace context propagator. Nothing is exported unless an OTLP
+// endpoint or a file is specified. The returned function flushes and stops the exporter.
+func Setup(opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if opts.OTLPEndpoint == "" && opts.File == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	if opts.OTLPEndpoint != "" {
+		exporter, err = otlptracegrpc.New(context.Background(),
+			otlptracegrpc.WithEndpoint(opts.OTLPEndpoint), otlptracegrpc.WithInsecure())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create OTLP trace exporter for %v", opts.OTLPEndpoint)
+		}
+	} else {
+		file, err = os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open trace file %v", opts.File)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			_ = file.Close()
+			return nil, errors.Wrap(err, "failed to create file trace exporter")
+		}
+	}
+
+	res := resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(meta.Version),
+		semconv.ProcessPID(os.Getpid()),
+		attribute.String("longhorn.command", opts.Command),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	dataconnSampleRatio = opts.DataconnSampleRatio
+
+	logrus.Infof("Tracing is enabled with sample ratio %v and dataconn sample ratio %v",
+		opts.SampleRatio, opts.DataconnSampleRatio)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if errClose := file.Close(); errClose != nil && err == nil {
+				err = errClose
+			}
+		}
+		return err
+	}, nil
+}
+
+// Tracer returns the tracer of longhorn-engine from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// StartCommandSpan starts the span of a one-shot CLI command. It must not be used by long-running servers, since
+// every span without a parent would end up in the trace of the command.
+func StartCommandSpan(name string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := Tracer().Start(context.Background(), name, trace.WithAttributes(attrs...))
+	commandSpanContext = span.SpanContext()
+	return span
+}
+
+// ParentContext returns ctx if it carries a span, or ctx with the command span as its parent otherwise.
+func ParentContext(ctx context.Context) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() || !commandSpanContext.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, commandSpanContext)
+}
+
+// StartSpan starts a span as a child of the span in ctx, or of the command span if ctx carries none.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ParentContext(ctx), name, trace.WithAttributes(attrs...))
+}
+
+// StartJobSpan starts a span for a job that outlives the request starting it, e.g. a snapshot purge kicked off by a
+// gRPC call. The span is a new root linked to the span in ctx, so the job is not cut short by the request and the
+// two can still be found from each other.
+func StartJobSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithNewRoot(), trace.WithAttributes(attrs...)}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+	return Tracer().Start(context.Background(), name, opts...)
+}
+
+// EndSpan records err, if any, on span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SampleDataconn decides whether a dataconn request is traced.
+func SampleDataconn() bool {
+	ratio := dataconnSampleRatio
+	if ratio <= 0 {
+		return false
+	}
+	return ratio >= 1 || rand.Float64() < ratio
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"fmt"
 	"io"
 	"strings"
 	"time"
@@ -78,6 +79,18 @@ type UnmapperAt interface {
 	UnmapAt(length uint32, off int64) (n int, err error)
 }
 
+// ZeroWriterAt is implemented by the layers that can zero a range without being sent a buffer of zeros. Unlike
+// UnmapAt, the range must read back as zeros afterwards. See util.WriteZeroesAt for the layers that cannot.
+type ZeroWriterAt interface {
+	WriteZeroesAt(length uint32, off int64) (n int, err error)
+}
+
+// Flusher is implemented by the layers that can make the data written so far durable. The layers without it have
+// nothing to flush.
+type Flusher interface {
+	Flush() error
+}
+
 type DiffDisk interface {
 	ReaderWriterUnmapperAt
 	io.Closer
@@ -110,6 +123,16 @@ type Backend interface {
 	GetSnapshotCountAndSizeUsage() (int, int, int64, error)
 }
 
+// ReconnectableBackend is a backend that can connect to its replica again after the connection failed, as long as
+// the replica stayed open. Reconnect is only called while no I/O is sent to the backend, and restarts the
+// monitoring of the replica. Once it returns, no write sent on the failed connection lands on the replica anymore.
+type ReconnectableBackend interface {
+	Backend
+	Reconnect() error
+	// GetChain returns the disks of the replica, from the volume head to the oldest snapshot.
+	GetChain() ([]string, error)
+}
+
 type BackendFactory interface {
 	Create(volumeName, address string, dataServerProtocol DataServerProtocol,
 		sharedTimeouts SharedTimeouts) (Backend, error)
@@ -174,21 +197,104 @@ const (
 	EventTypeMetrics = "metrics"
 )
 
+const (
+	EventActionReplicaAdd        = "replica-add"
+	EventActionReplicaRemove     = "replica-remove"
+	EventActionReplicaModeChange = "replica-mode-change"
+	EventActionFrontendUp        = "frontend-up"
+	EventActionFrontendDown      = "frontend-down"
+	EventActionSnapshotCreate    = "snapshot-create"
+	EventActionSnapshotRevert    = "snapshot-revert"
+	EventActionExpansionStart    = "expansion-start"
+	EventActionExpansionFinish   = "expansion-finish"
+	EventActionExpansionError    = "expansion-error"
+	EventActionNoSpace           = "no-space"
+	EventActionMetrics           = "metrics"
+)
+
+// Event describes a change of the volume or its replicas. Seq increases by one for every event except metrics events,
+// so a watcher can resume from the last Seq it has seen.
+type Event struct {
+	Seq       uint64    `json:"seq"`
+	Type      string    `json:"type"`
+	Action    string    `json:"action"`
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message,omitempty"`
+
+	Replica  *Replica `json:"replica,omitempty"`
+	Frontend string   `json:"frontend,omitempty"`
+	State    State    `json:"state,omitempty"`
+	Endpoint string   `json:"endpoint,omitempty"`
+	Snapshot string   `json:"snapshot,omitempty"`
+	Size     int64    `json:"size,omitempty"`
+	Metrics  *Metrics `json:"metrics,omitempty"`
+}
+
 type Metrics struct {
 	Throughput   RWMetrics // in byte
 	TotalLatency RWMetrics // in nanoseconds
 	IOPS         RWMetrics
 }
 
+// ReplicaMetrics are the metrics of a replica process. See replicarpc.Metrics.
+type ReplicaMetrics struct {
+	ZeroBytesDetected uint64 `json:"zeroBytesDetected"`
+	ZeroBytesSaved    uint64 `json:"zeroBytesSaved"`
+	DataConnections   uint32 `json:"dataConnections"`
+}
+
+// BackingFileInfo is the backing file of a replica. See replicarpc.BackingFile.
+type BackingFileInfo struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
 type RWMetrics struct {
 	Read  uint64
 	Write uint64
 }
 
+// CheckSameBackingFile returns an error unless a replica with the backing file to can hold the data of a replica
+// with the backing file from, as told by their checksums. There is nothing to match if from has no backing file,
+// like a replica that has been flattened. A nil backing file, from a replica too old to tell, or an empty checksum,
+// not computed yet, is unknown and matches.
+func CheckSameBackingFile(from, to *BackingFileInfo) error {
+	if from == nil || to == nil || from.Path == "" {
+		return nil
+	}
+	if to.Path == "" {
+		return fmt.Errorf("no backing file while the source has backing file %v", from.Path)
+	}
+	if from.Checksum != "" && to.Checksum != "" && from.Checksum != to.Checksum {
+		return fmt.Errorf("backing file %v has checksum %v while the backing file %v of the source has checksum %v",
+			to.Path, to.Checksum, from.Path, from.Checksum)
+	}
+	return nil
+}
+
 func IsAlreadyPurgingError(err error) bool {
 	return strings.Contains(err.Error(), "already purging")
 }
 
+func MetricsToGRPCMetrics(m *Metrics) *enginerpc.Metrics {
+	metrics := &enginerpc.Metrics{
+		ReadThroughput:  m.Throughput.Read,
+		WriteThroughput: m.Throughput.Write,
+		ReadIOPS:        m.IOPS.Read,
+		WriteIOPS:       m.IOPS.Write,
+	}
+
+	if m.IOPS.Read != 0 {
+		metrics.ReadLatency = m.TotalLatency.Read / m.IOPS.Read
+	}
+	if m.IOPS.Write != 0 {
+		metrics.WriteLatency = m.TotalLatency.Write / m.IOPS.Write
+	}
+
+	return metrics
+}
+
 func ReplicaModeToGRPCReplicaMode(mode Mode) enginerpc.ReplicaMode {
 	switch mode {
 	case WO:
@@ -0,0 +1,47 @@
+package types
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) TestCheckSameBackingFile(c *C) {
+	backing := &BackingFileInfo{Path: "/var/lib/longhorn/backing-images/image/backing", Size: 4096, Checksum: "abc"}
+
+	for _, t := range []struct {
+		comment string
+		from    *BackingFileInfo
+		to      *BackingFileInfo
+		err     string
+	}{
+		{"same backing file", backing, backing, ""},
+		{"same checksum at another path", backing,
+			&BackingFileInfo{Path: "/data/backing-images/image/backing", Size: 4096, Checksum: "abc"}, ""},
+		{"source flattened", &BackingFileInfo{}, backing, ""},
+		{"neither has a backing file", &BackingFileInfo{}, &BackingFileInfo{}, ""},
+		{"target missing its backing file", backing, &BackingFileInfo{},
+			"no backing file while the source has backing file /var/lib/longhorn/backing-images/image/backing"},
+		{"checksum mismatch", backing, &BackingFileInfo{Path: "/other", Size: 4096, Checksum: "def"},
+			"backing file /other has checksum def while the backing file .* of the source has checksum abc"},
+		{"checksum not computed on the target", backing, &BackingFileInfo{Path: backing.Path, Size: 4096}, ""},
+		{"checksum not computed on the source", &BackingFileInfo{Path: backing.Path, Size: 4096}, backing, ""},
+		{"target too old to tell", backing, nil, ""},
+		{"source too old to tell", nil, backing, ""},
+		{"target too old to tell, source flattened", &BackingFileInfo{}, nil, ""},
+	} {
+		err := CheckSameBackingFile(t.from, t.to)
+		if t.err == "" {
+			c.Assert(err, IsNil, Commentf(t.comment))
+		} else {
+			c.Assert(err, ErrorMatches, t.err, Commentf(t.comment))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/longhorn/longhorn-engine/pkg/types"
+)
+
+// zeroChunkSize is the size of the buffer of zeros written by WriteZeroesAt to the layers that cannot zero a range
+// by themselves.
+const zeroChunkSize = 1 << 20
+
+var zeroChunk = make([]byte, zeroChunkSize)
+
+// WriteZeroesAt zeroes length bytes at off. It uses the WriteZeroesAt of w if w implements types.ZeroWriterAt, and
+// writes a buffer of zeros otherwise.
+func WriteZeroesAt(w io.WriterAt, length uint32, off int64) (int, error) {
+	if zw, ok := w.(types.ZeroWriterAt); ok {
+		return zw.WriteZeroesAt(length, off)
+	}
+	return WriteZeroBufferAt(w, length, off)
+}
+
+// WriteZeroBufferAt zeroes length bytes at off by writing a buffer of zeros.
+func WriteZeroBufferAt(w io.WriterAt, length uint32, off int64) (int, error) {
+	count := 0
+	for remaining := int64(length); remaining > 0; {
+		n, err := w.WriteAt(zeroChunk[:min(remaining, zeroChunkSize)], off+int64(count))
+		count += n
+		if err != nil {
+			return count, err
+		}
+		remaining -= int64(n)
+	}
+	return count, nil
+}
+
+// IsZeroes tells whether all the bytes of b are zero.
+func IsZeroes(b []byte) bool {
+	for len(b) > 0 {
+		n := min(len(b), zeroChunkSize)
+		if !bytes.Equal(b[:n], zeroChunk[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
@@ -0,0 +1,335 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	be = binary.BigEndian
+
+	// Magic is the cookie of the footer, which ends every VHD image and which dynamic images also start with
+	Magic = []byte("conectix")
+	// dynamicMagic is the cookie of the dynamic disk header
+	dynamicMagic = []byte("cxsparse")
+
+	ErrReadOnly = errors.New("vhd image is read-only")
+)
+
+const (
+	sectorSize        = 512
+	footerSize        = 512
+	dynamicHeaderSize = 1024
+
+	diskTypeFixed        = 2
+	diskTypeDynamic      = 3
+	diskTypeDifferencing = 4
+
+	// unallocatedBlock is the BAT entry of a block that is not allocated
+	unallocatedBlock = 0xffffffff
+
+	maxBlockSize = 256 << 20
+
+	// bitmapCacheSize is how many block bitmaps are kept in memory
+	bitmapCacheSize = 64
+)
+
+// Vhd is a fixed or dynamic VHD image opened read-only. Sectors that are not allocated read zeros, since
+// differencing images are not supported.
+type Vhd struct {
+	file *os.File
+
+	size int64
+	// dynamic is false for fixed images, whose data is the start of the file
+	dynamic    bool
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+
+	// lock guards the cache
+	lock        sync.Mutex
+	bitmapCache map[uint32][]byte
+}
+
+type footer struct {
+	dataOffset  uint64
+	currentSize uint64
+	diskType    uint32
+}
+
+// IsVhd tells whether r starts or ends with a valid VHD footer. A fixed image only has it at its end, so a raw
+// image could end with the cookie by chance: the checksum and the disk type must be valid as well.
+func IsVhd(r io.ReaderAt, size int64) (bool, error) {
+	for _, off := range []int64{0, size - footerSize} {
+		if off < 0 {
+			continue
+		}
+		buf := make([]byte, footerSize)
+		if _, err := r.ReadAt(buf, off); err != nil {
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+			return false, err
+		}
+		f, err := parseFooter(buf)
+		if err != nil {
+			continue
+		}
+		switch f.diskType {
+		case diskTypeFixed, diskTypeDynamic, diskTypeDifferencing:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checksum is the one's complement of the sum of the bytes of a structure, whose own checksum field is skipped.
+func checksum(buf []byte, field int) uint32 {
+	var sum uint32
+	for i, b := range buf {
+		if i >= field && i < field+4 {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+func parseFooter(buf []byte) (*footer, error) {
+	if !bytes.Equal(buf[:8], Magic) {
+		return nil, fmt.Errorf("not a vhd footer")
+	}
+	if sum := be.Uint32(buf[64:]); sum != checksum(buf, 64) {
+		return nil, fmt.Errorf("vhd footer checksum 0x%x does not match", sum)
+	}
+	f := &footer{
+		dataOffset:  be.Uint64(buf[16:]),
+		currentSize: be.Uint64(buf[48:]),
+		diskType:    be.Uint32(buf[60:]),
+	}
+	if f.currentSize%sectorSize != 0 || f.currentSize > 1<<62 {
+		return nil, fmt.Errorf("invalid vhd size %v", f.currentSize)
+	}
+	return f, nil
+}
+
+// Open opens the VHD image at path for reading.
+func Open(path string) (*Vhd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVhd(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "failed to open vhd image %v", path)
+	}
+	return v, nil
+}
+
+func newVhd(file *os.File) (*Vhd, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < footerSize {
+		return nil, fmt.Errorf("truncated vhd image")
+	}
+	buf := make([]byte, footerSize)
+	if _, err := file.ReadAt(buf, info.Size()-footerSize); err != nil {
+		return nil, errors.Wrap(err, "failed to read the vhd footer")
+	}
+	f, err := parseFooter(buf)
+	if err != nil {
+		// The copy at the start of a dynamic image is there for when the end is damaged.
+		if _, readErr := file.ReadAt(buf, 0); readErr != nil {
+			return nil, err
+		}
+		copyFooter, copyErr := parseFooter(buf)
+		if copyErr != nil {
+			return nil, err
+		}
+		f = copyFooter
+	}
+
+	v := &Vhd{
+		file: file,
+		size: int64(f.currentSize),
+	}
+	switch f.diskType {
+	case diskTypeFixed:
+		if info.Size() < v.size+footerSize {
+			return nil, fmt.Errorf("fixed vhd image of %v bytes is too short for %v bytes", info.Size(), v.size)
+		}
+		return v, nil
+	case diskTypeDynamic:
+		if err := v.readDynamicHeader(f.dataOffset); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case diskTypeDifferencing:
+		return nil, fmt.Errorf("vhd image is a differencing image, which is not supported")
+	default:
+		return nil, fmt.Errorf("unsupported vhd disk type %v", f.diskType)
+	}
+}
+
+func (v *Vhd) readDynamicHeader(offset uint64) error {
+	buf := make([]byte, dynamicHeaderSize)
+	if _, err := v.file.ReadAt(buf, int64(offset)); err != nil {
+		return errors.Wrap(err, "failed to read the vhd dynamic disk header")
+	}
+	if !bytes.Equal(buf[:8], dynamicMagic) {
+		return fmt.Errorf("invalid vhd dynamic disk header")
+	}
+	if sum := be.Uint32(buf[36:]); sum != checksum(buf, 36) {
+		return fmt.Errorf("vhd dynamic disk header checksum 0x%x does not match", sum)
+	}
+	tableOffset := be.Uint64(buf[16:])
+	entries := be.Uint32(buf[28:])
+	blockSize := int64(be.Uint32(buf[32:]))
+	if blockSize < sectorSize || blockSize > maxBlockSize || blockSize&(blockSize-1) != 0 {
+		return fmt.Errorf("invalid vhd block size %v", blockSize)
+	}
+	if need := (v.size + blockSize - 1) / blockSize; int64(entries) < need {
+		return fmt.Errorf("vhd block allocation table of %v entries is too small for %v bytes", entries, v.size)
+	}
+
+	v.dynamic = true
+	v.blockSize = blockSize
+	bitmapBytes := (blockSize/sectorSize + 7) / 8
+	v.bitmapSize = (bitmapBytes + sectorSize - 1) / sectorSize * sectorSize
+	v.bitmapCache = map[uint32][]byte{}
+	raw := make([]byte, int64(entries)*4)
+	if _, err := v.file.ReadAt(raw, int64(tableOffset)); err != nil {
+		return errors.Wrap(err, "failed to read the vhd block allocation table")
+	}
+	v.bat = make([]uint32, entries)
+	for i := range v.bat {
+		v.bat[i] = be.Uint32(raw[i*4:])
+	}
+	return nil
+}
+
+func (v *Vhd) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (v *Vhd) UnmapAt(length uint32, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// ReadAt reads the virtual disk. Reads beyond its end return io.EOF.
+func (v *Vhd) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset %v", off)
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	if !v.dynamic {
+		n, err := v.file.ReadAt(buf[:min(int64(len(buf)), v.size-off)], off)
+		if err == nil && n < len(buf) {
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	count := 0
+	for count < len(buf) && off < v.size {
+		inBlock := off & (v.blockSize - 1)
+		n := int(min(int64(len(buf)-count), v.blockSize-inBlock, v.size-off))
+		if err := v.readBlock(buf[count:count+n], off); err != nil {
+			return count, err
+		}
+		count += n
+		off += int64(n)
+	}
+	if count < len(buf) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// readBlock reads buf, which is within a single block, at off. The sectors that are not marked in the bitmap of
+// the block read zeros.
+func (v *Vhd) readBlock(buf []byte, off int64) error {
+	entry := v.bat[off/v.blockSize]
+	if entry == unallocatedBlock {
+		clear(buf)
+		return nil
+	}
+	bitmap, err := v.blockBitmap(entry)
+	if err != nil {
+		return err
+	}
+
+	inBlock := off & (v.blockSize - 1)
+	dataOffset := int64(entry)*sectorSize + v.bitmapSize
+	for start := 0; start < len(buf); {
+		sector := (inBlock + int64(start)) / sectorSize
+		present := bitmap[sector/8]&(0x80>>(sector%8)) != 0
+		// Gather the following sectors in the same state.
+		end := min(len(buf), start+int(sectorSize-(inBlock+int64(start))%sectorSize))
+		for end < len(buf) {
+			next := (inBlock + int64(end)) / sectorSize
+			if bitmap[next/8]&(0x80>>(next%8)) != 0 != present {
+				break
+			}
+			end = min(len(buf), end+sectorSize)
+		}
+
+		if !present {
+			clear(buf[start:end])
+		} else if _, err := v.file.ReadAt(buf[start:end], dataOffset+inBlock+int64(start)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("vhd block at sector %v is beyond the end of the image", entry)
+			}
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// blockBitmap returns the sector bitmap of the block at sector.
+func (v *Vhd) blockBitmap(sector uint32) ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	bitmap, ok := v.bitmapCache[sector]
+	if ok {
+		return bitmap, nil
+	}
+	bitmap = make([]byte, v.bitmapSize)
+	if _, err := v.file.ReadAt(bitmap, int64(sector)*sectorSize); err != nil {
+		return nil, errors.Wrapf(err, "failed to read the vhd block bitmap at sector %v", sector)
+	}
+	if len(v.bitmapCache) >= bitmapCacheSize {
+		for k := range v.bitmapCache {
+			delete(v.bitmapCache, k)
+			break
+		}
+	}
+	v.bitmapCache[sector] = bitmap
+	return bitmap, nil
+}
+
+func (v *Vhd) Close() error {
+	return v.file.Close()
+}
+
+// Size returns the size of the virtual disk.
+func (v *Vhd) Size() (int64, error) {
+	return v.size, nil
+}
+
+// Fd returns the descriptor of the image file. Only the layout of a fixed image is the one of the virtual disk.
+func (v *Vhd) Fd() uintptr {
+	return v.file.Fd()
+}
@@ -0,0 +1,391 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	le = binary.LittleEndian
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+	// Magic is the signature of the file type identifier every VHDX image starts with
+	Magic = []byte("vhdxfile")
+
+	headerMagic      = []byte("head")
+	regionTableMagic = []byte("regi")
+	metadataMagic    = []byte("metadata")
+
+	// Regions
+	batRegion      = guid("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	metadataRegion = guid("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	// Metadata items
+	fileParametersItem  = guid("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	virtualDiskSizeItem = guid("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	virtualDiskIDItem   = guid("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	logicalSectorItem   = guid("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	physicalSectorItem  = guid("CDA348C7-445D-4471-9CC9-E9885251C556")
+	parentLocatorItem   = guid("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+	knownMetadataItems  = [][]byte{fileParametersItem, virtualDiskSizeItem, virtualDiskIDItem, logicalSectorItem,
+		physicalSectorItem, parentLocatorItem}
+
+	zeroGUID = make([]byte, 16)
+
+	ErrReadOnly = errors.New("vhdx image is read-only")
+)
+
+const (
+	headerSize      = 4 << 10
+	header1Offset   = 64 << 10
+	header2Offset   = 128 << 10
+	regionTableSize = 64 << 10
+	region1Offset   = 192 << 10
+	region2Offset   = 256 << 10
+
+	regionEntrySize   = 32
+	metadataEntrySize = 32
+	// metadataTableSize is the size of the metadata table at the start of the metadata region
+	metadataTableSize = 64 << 10
+
+	// Flags of the region and metadata entries
+	regionRequired   = 1 << 0
+	metadataRequired = 1 << 2
+
+	// Flags of the file parameters
+	fileHasParent = 1 << 1
+
+	// Block states of the payload BAT entries
+	blockNotPresent   = 0
+	blockUndefined    = 1
+	blockZero         = 2
+	blockUnmapped     = 3
+	blockFullyPresent = 6
+	blockStateMask    = 0x7
+	// blockOffsetMask is the file offset bits of a BAT entry, in MiB
+	blockOffsetMask = ^uint64(1<<20 - 1)
+
+	minBlockSize = 1 << 20
+	maxBlockSize = 256 << 20
+	// chunkSectors is the number of sectors a sector bitmap block covers
+	chunkSectors = 1 << 23
+)
+
+// Vhdx is a dynamic or fixed VHDX image opened read-only. Blocks that are not present read zeros, since
+// differencing images are not supported.
+type Vhdx struct {
+	file *os.File
+
+	size       int64
+	blockSize  int64
+	sectorSize int64
+	chunkRatio int64
+	bat        []uint64
+}
+
+// guid returns the on-disk form of a GUID, whose first three fields are little-endian.
+func guid(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic(fmt.Sprintf("invalid GUID %v", s))
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+// IsVhdx tells whether r starts with the VHDX file type identifier.
+func IsVhdx(r io.ReaderAt) (bool, error) {
+	buf := make([]byte, len(Magic))
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(buf, Magic), nil
+}
+
+// validChecksum checks the CRC-32C of a structure whose checksum is at offset 4.
+func validChecksum(buf []byte) bool {
+	sum := le.Uint32(buf[4:])
+	c := make([]byte, len(buf))
+	copy(c, buf)
+	clear(c[4:8])
+	return crc32.Checksum(c, crc32c) == sum
+}
+
+// Open opens the VHDX image at path for reading.
+func Open(path string) (*Vhdx, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVhdx(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "failed to open vhdx image %v", path)
+	}
+	return v, nil
+}
+
+func newVhdx(file *os.File) (*Vhdx, error) {
+	if ok, err := IsVhdx(file); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("not a vhdx image")
+		}
+		return nil, err
+	}
+	if err := checkHeaders(file); err != nil {
+		return nil, err
+	}
+	regions, err := readRegionTable(file)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vhdx{file: file}
+	if err := v.readMetadata(regions[string(metadataRegion)]); err != nil {
+		return nil, err
+	}
+	if err := v.readBAT(regions[string(batRegion)]); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// checkHeaders picks the current one of the two headers and refuses the images with a log to replay.
+func checkHeaders(file *os.File) error {
+	var current []byte
+	var sequence uint64
+	for _, off := range []int64{header1Offset, header2Offset} {
+		buf := make([]byte, headerSize)
+		if _, err := file.ReadAt(buf, off); err != nil {
+			continue
+		}
+		if !bytes.Equal(buf[:4], headerMagic) || !validChecksum(buf) {
+			continue
+		}
+		if seq := le.Uint64(buf[8:]); current == nil || seq > sequence {
+			current, sequence = buf, seq
+		}
+	}
+	if current == nil {
+		return fmt.Errorf("vhdx image has no valid header")
+	}
+	if version := le.Uint16(current[66:]); version != 1 {
+		return fmt.Errorf("unsupported vhdx version %v", version)
+	}
+	if !bytes.Equal(current[48:64], zeroGUID) {
+		return fmt.Errorf("vhdx image has a log to replay, which is not supported")
+	}
+	return nil
+}
+
+type region struct {
+	offset int64
+	length int64
+}
+
+// readRegionTable returns the regions of the first valid region table by GUID.
+func readRegionTable(file *os.File) (map[string]region, error) {
+	for _, off := range []int64{region1Offset, region2Offset} {
+		buf := make([]byte, regionTableSize)
+		if _, err := file.ReadAt(buf, off); err != nil {
+			continue
+		}
+		if !bytes.Equal(buf[:4], regionTableMagic) || !validChecksum(buf) {
+			continue
+		}
+		count := int(le.Uint32(buf[8:]))
+		if 16+count*regionEntrySize > regionTableSize {
+			return nil, fmt.Errorf("vhdx region table of %v entries is too large", count)
+		}
+		regions := map[string]region{}
+		for i := 0; i < count; i++ {
+			entry := buf[16+i*regionEntrySize:]
+			id := entry[:16]
+			if !bytes.Equal(id, batRegion) && !bytes.Equal(id, metadataRegion) {
+				if le.Uint32(entry[28:])&regionRequired != 0 {
+					return nil, fmt.Errorf("vhdx image has an unknown required region")
+				}
+				continue
+			}
+			regions[string(id)] = region{offset: int64(le.Uint64(entry[16:])), length: int64(le.Uint32(entry[24:]))}
+		}
+		if _, ok := regions[string(batRegion)]; !ok {
+			return nil, fmt.Errorf("vhdx image has no block allocation table")
+		}
+		if _, ok := regions[string(metadataRegion)]; !ok {
+			return nil, fmt.Errorf("vhdx image has no metadata region")
+		}
+		return regions, nil
+	}
+	return nil, fmt.Errorf("vhdx image has no valid region table")
+}
+
+// readMetadata reads the block size, the size and the logical sector size of the virtual disk.
+func (v *Vhdx) readMetadata(r region) error {
+	if r.length < metadataTableSize {
+		return fmt.Errorf("vhdx metadata region of %v bytes is too small", r.length)
+	}
+	table := make([]byte, metadataTableSize)
+	if _, err := v.file.ReadAt(table, r.offset); err != nil {
+		return errors.Wrap(err, "failed to read the vhdx metadata table")
+	}
+	if !bytes.Equal(table[:8], metadataMagic) {
+		return fmt.Errorf("invalid vhdx metadata table")
+	}
+	count := int(le.Uint16(table[10:]))
+	if 32+count*metadataEntrySize > metadataTableSize {
+		return fmt.Errorf("vhdx metadata table of %v entries is too large", count)
+	}
+
+	items := map[string][]byte{}
+	for i := 0; i < count; i++ {
+		entry := table[32+i*metadataEntrySize:]
+		id := entry[:16]
+		offset, length := int64(le.Uint32(entry[16:])), int64(le.Uint32(entry[20:]))
+		known := false
+		for _, k := range knownMetadataItems {
+			known = known || bytes.Equal(id, k)
+		}
+		if !known {
+			if le.Uint32(entry[24:])&metadataRequired != 0 {
+				return fmt.Errorf("vhdx image has an unknown required metadata item")
+			}
+			continue
+		}
+		if length > 64<<10 || offset+length > r.length {
+			return fmt.Errorf("invalid vhdx metadata item of %v bytes at %v", length, offset)
+		}
+		item := make([]byte, length)
+		if _, err := v.file.ReadAt(item, r.offset+offset); err != nil {
+			return errors.Wrap(err, "failed to read a vhdx metadata item")
+		}
+		items[string(id)] = item
+	}
+
+	parameters := items[string(fileParametersItem)]
+	size := items[string(virtualDiskSizeItem)]
+	sectorSize := items[string(logicalSectorItem)]
+	if len(parameters) < 8 || len(size) < 8 || len(sectorSize) < 4 {
+		return fmt.Errorf("vhdx image misses required metadata")
+	}
+	if le.Uint32(parameters[4:])&fileHasParent != 0 {
+		return fmt.Errorf("vhdx image is a differencing image, which is not supported")
+	}
+	v.blockSize = int64(le.Uint32(parameters))
+	v.size = int64(le.Uint64(size))
+	v.sectorSize = int64(le.Uint32(sectorSize))
+	if v.blockSize < minBlockSize || v.blockSize > maxBlockSize || v.blockSize&(v.blockSize-1) != 0 {
+		return fmt.Errorf("invalid vhdx block size %v", v.blockSize)
+	}
+	if v.sectorSize != 512 && v.sectorSize != 4096 {
+		return fmt.Errorf("invalid vhdx logical sector size %v", v.sectorSize)
+	}
+	if v.size < 0 || v.size > 1<<62 || v.size%v.sectorSize != 0 {
+		return fmt.Errorf("invalid vhdx size %v for logical sectors of %v bytes", v.size, v.sectorSize)
+	}
+	v.chunkRatio = chunkSectors * v.sectorSize / v.blockSize
+	return nil
+}
+
+// readBAT reads the block allocation table, where a sector bitmap entry follows every chunkRatio payload entries.
+func (v *Vhdx) readBAT(r region) error {
+	blocks := (v.size + v.blockSize - 1) / v.blockSize
+	entries := blocks
+	if blocks > 0 {
+		entries += (blocks - 1) / v.chunkRatio
+	}
+	if entries*8 > r.length {
+		return fmt.Errorf("vhdx block allocation table of %v bytes is too small for %v bytes", r.length, v.size)
+	}
+	raw := make([]byte, entries*8)
+	if _, err := v.file.ReadAt(raw, r.offset); err != nil {
+		return errors.Wrap(err, "failed to read the vhdx block allocation table")
+	}
+	v.bat = make([]uint64, entries)
+	for i := range v.bat {
+		v.bat[i] = le.Uint64(raw[i*8:])
+	}
+	return nil
+}
+
+func (v *Vhdx) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (v *Vhdx) UnmapAt(length uint32, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// ReadAt reads the virtual disk. Reads beyond its end return io.EOF.
+func (v *Vhdx) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset %v", off)
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	count := 0
+	for count < len(buf) && off < v.size {
+		inBlock := off & (v.blockSize - 1)
+		n := int(min(int64(len(buf)-count), v.blockSize-inBlock, v.size-off))
+		if err := v.readBlock(buf[count:count+n], off); err != nil {
+			return count, err
+		}
+		count += n
+		off += int64(n)
+	}
+	if count < len(buf) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// readBlock reads buf, which is within a single payload block, at off.
+func (v *Vhdx) readBlock(buf []byte, off int64) error {
+	block := off / v.blockSize
+	entry := v.bat[block+block/v.chunkRatio]
+
+	switch entry & blockStateMask {
+	case blockNotPresent, blockUndefined, blockZero, blockUnmapped:
+		clear(buf)
+	case blockFullyPresent:
+		hostOffset := int64(entry&blockOffsetMask) + off&(v.blockSize-1)
+		if _, err := v.file.ReadAt(buf, hostOffset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("vhdx block at %v is beyond the end of the image", hostOffset)
+			}
+			return err
+		}
+	default:
+		return fmt.Errorf("vhdx block %v has unsupported state %v", block, entry&blockStateMask)
+	}
+	return nil
+}
+
+func (v *Vhdx) Close() error {
+	return v.file.Close()
+}
+
+// Size returns the size of the virtual disk.
+func (v *Vhdx) Size() (int64, error) {
+	return v.size, nil
+}
+
+// Fd returns the descriptor of the image file. Its layout is not the one of the virtual disk.
+func (v *Vhdx) Fd() uintptr {
+	return v.file.Fd()
+}
@@ -0,0 +1,401 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	le = binary.LittleEndian
+
+	// Magic starts every sparse extent
+	Magic = []byte{'K', 'D', 'M', 'V'}
+	// descriptorMagic starts the text descriptor of the images whose extents are in other files
+	descriptorMagic = []byte("# Disk DescriptorFile")
+
+	ErrReadOnly = errors.New("vmdk image is read-only")
+)
+
+const (
+	sectorSize = 512
+	headerSize = 512
+
+	// Header flags
+	flagZeroedGrainEntry = 1 << 2
+	flagCompressed       = 1 << 16
+
+	compressionNone    = 0
+	compressionDeflate = 1
+
+	// gdAtEnd is the grain directory offset of the header of a stream-optimized extent, whose footer has the real
+	// one
+	gdAtEnd = ^uint64(0)
+	// footerOffset is where the footer starts from the end of a stream-optimized extent: the footer marker, the
+	// footer and the end-of-stream marker take a sector each.
+	footerOffset = 2 * sectorSize
+
+	// zeroedGrain is the grain table entry of a grain that reads zeros
+	zeroedGrain = 1
+	// grainMarkerSize is the LBA and the size that precede a compressed grain
+	grainMarkerSize = 12
+
+	maxGrainSectors   = 2048
+	maxGTEntries      = 1 << 16
+	maxDescriptorSize = 1 << 20
+
+	// gtCacheSize is how many grain tables are kept in memory
+	gtCacheSize = 64
+)
+
+// Vmdk is the single sparse extent of a monolithic sparse or a stream-optimized VMDK image, opened read-only.
+// Grains that are not allocated read zeros, since images with a parent are not supported.
+type Vmdk struct {
+	file *os.File
+
+	size        int64
+	grainSize   int64
+	gtEntries   uint64
+	compressed  bool
+	zeroedGrain bool
+	gd          []uint32
+
+	// lock guards the caches
+	lock             sync.Mutex
+	gtCache          map[uint32][]uint32
+	compressedGrain  []byte
+	compressedSector uint32
+}
+
+type header struct {
+	version           uint32
+	flags             uint32
+	capacity          uint64
+	grainSize         uint64
+	descriptorOffset  uint64
+	descriptorSize    uint64
+	numGTEsPerGT      uint32
+	gdOffset          uint64
+	compressAlgorithm uint16
+}
+
+// IsVmdk tells whether r starts with a sparse extent or a text descriptor.
+func IsVmdk(r io.ReaderAt) (bool, error) {
+	buf := make([]byte, len(descriptorMagic))
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return bytes.HasPrefix(buf[:n], Magic) || bytes.Equal(buf[:n], descriptorMagic), nil
+}
+
+func parseHeader(buf []byte) (*header, error) {
+	if !bytes.Equal(buf[:4], Magic) {
+		return nil, fmt.Errorf("not a vmdk sparse extent")
+	}
+	h := &header{
+		version:           le.Uint32(buf[4:]),
+		flags:             le.Uint32(buf[8:]),
+		capacity:          le.Uint64(buf[12:]),
+		grainSize:         le.Uint64(buf[20:]),
+		descriptorOffset:  le.Uint64(buf[28:]),
+		descriptorSize:    le.Uint64(buf[36:]),
+		numGTEsPerGT:      le.Uint32(buf[44:]),
+		gdOffset:          le.Uint64(buf[56:]),
+		compressAlgorithm: le.Uint16(buf[77:]),
+	}
+	if h.version < 1 || h.version > 3 {
+		return nil, fmt.Errorf("unsupported vmdk version %v", h.version)
+	}
+	return h, nil
+}
+
+// check refuses the extents the reader cannot present faithfully.
+func (h *header) check() error {
+	if h.grainSize == 0 || h.grainSize > maxGrainSectors || h.grainSize&(h.grainSize-1) != 0 {
+		return fmt.Errorf("invalid vmdk grain size of %v sectors", h.grainSize)
+	}
+	if h.numGTEsPerGT == 0 || h.numGTEsPerGT > maxGTEntries {
+		return fmt.Errorf("invalid vmdk grain table of %v entries", h.numGTEsPerGT)
+	}
+	if h.capacity > 1<<62/sectorSize {
+		return fmt.Errorf("invalid vmdk capacity of %v sectors", h.capacity)
+	}
+	if h.flags&flagCompressed != 0 && h.compressAlgorithm != compressionDeflate {
+		return fmt.Errorf("vmdk image uses compression algorithm %v, which is not supported", h.compressAlgorithm)
+	}
+	if h.flags&flagCompressed == 0 && h.compressAlgorithm != compressionNone {
+		return fmt.Errorf("vmdk image is not compressed but names compression algorithm %v", h.compressAlgorithm)
+	}
+	return nil
+}
+
+// Open opens the VMDK image at path for reading.
+func Open(path string) (*Vmdk, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVmdk(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "failed to open vmdk image %v", path)
+	}
+	return v, nil
+}
+
+func newVmdk(file *os.File) (*Vmdk, error) {
+	buf := make([]byte, headerSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if bytes.HasPrefix(buf[:n], descriptorMagic) {
+		return nil, fmt.Errorf("vmdk descriptor refers to extents in other files, which is not supported")
+	}
+	if n < headerSize {
+		return nil, fmt.Errorf("truncated vmdk header")
+	}
+	h, err := parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if h.gdOffset == gdAtEnd {
+		// The header of a stream-optimized extent is written before the grains it counts.
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < headerSize+footerOffset {
+			return nil, fmt.Errorf("truncated stream-optimized vmdk image")
+		}
+		if _, err := file.ReadAt(buf, info.Size()-footerOffset); err != nil {
+			return nil, errors.Wrap(err, "failed to read the vmdk footer")
+		}
+		if h, err = parseHeader(buf); err != nil {
+			return nil, errors.Wrap(err, "invalid vmdk footer")
+		}
+		if h.gdOffset == gdAtEnd {
+			return nil, fmt.Errorf("vmdk footer has no grain directory")
+		}
+	}
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+	if err := checkDescriptor(file, h); err != nil {
+		return nil, err
+	}
+
+	v := &Vmdk{
+		file:             file,
+		size:             int64(h.capacity) * sectorSize,
+		grainSize:        int64(h.grainSize) * sectorSize,
+		gtEntries:        uint64(h.numGTEsPerGT),
+		compressed:       h.flags&flagCompressed != 0,
+		zeroedGrain:      h.flags&flagZeroedGrainEntry != 0,
+		gtCache:          map[uint32][]uint32{},
+		compressedSector: ^uint32(0),
+	}
+	gtCoverage := h.grainSize * uint64(h.numGTEsPerGT)
+	raw := make([]byte, (h.capacity+gtCoverage-1)/gtCoverage*4)
+	if _, err := file.ReadAt(raw, int64(h.gdOffset)*sectorSize); err != nil {
+		return nil, errors.Wrap(err, "failed to read the vmdk grain directory")
+	}
+	v.gd = make([]uint32, len(raw)/4)
+	for i := range v.gd {
+		v.gd[i] = le.Uint32(raw[i*4:])
+	}
+	return v, nil
+}
+
+// checkDescriptor refuses the images whose embedded descriptor names a parent or more than one extent.
+func checkDescriptor(file *os.File, h *header) error {
+	if h.descriptorOffset == 0 || h.descriptorSize == 0 {
+		return nil
+	}
+	length := min(h.descriptorSize*sectorSize, maxDescriptorSize)
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, int64(h.descriptorOffset)*sectorSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Wrap(err, "failed to read the vmdk descriptor")
+	}
+
+	extents := 0
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(buf[:n], "\x00")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, found := strings.Cut(line, "=")
+		if found {
+			key, value = strings.TrimSpace(key), strings.Trim(strings.TrimSpace(value), `"`)
+			switch key {
+			case "parentCID":
+				if !strings.EqualFold(value, "ffffffff") {
+					return fmt.Errorf("vmdk image has a parent, which is not supported")
+				}
+			case "createType":
+				if value != "monolithicSparse" && value != "streamOptimized" {
+					return fmt.Errorf("vmdk image of type %v is not supported", value)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "RW ") || strings.HasPrefix(line, "RDONLY ") {
+			extents++
+		}
+	}
+	if extents > 1 {
+		return fmt.Errorf("vmdk image has %v extents, only a single one is supported", extents)
+	}
+	return nil
+}
+
+func (v *Vmdk) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (v *Vmdk) UnmapAt(length uint32, off int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// ReadAt reads the virtual disk. Reads beyond its end return io.EOF.
+func (v *Vmdk) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset %v", off)
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	count := 0
+	for count < len(buf) && off < v.size {
+		inGrain := off & (v.grainSize - 1)
+		n := int(min(int64(len(buf)-count), v.grainSize-inGrain, v.size-off))
+		if err := v.readGrain(buf[count:count+n], off); err != nil {
+			return count, err
+		}
+		count += n
+		off += int64(n)
+	}
+	if count < len(buf) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// readGrain reads buf, which is within a single grain, at off.
+func (v *Vmdk) readGrain(buf []byte, off int64) error {
+	grain := uint64(off / v.grainSize)
+	entry, err := v.gtEntry(grain)
+	if err != nil {
+		return err
+	}
+	inGrain := off & (v.grainSize - 1)
+
+	switch {
+	case entry == 0 || (entry == zeroedGrain && v.zeroedGrain):
+		clear(buf)
+	case v.compressed:
+		data, err := v.compressedGrainData(entry)
+		if err != nil {
+			return err
+		}
+		copy(buf, data[inGrain:])
+	default:
+		hostOffset := int64(entry)*sectorSize + inGrain
+		if _, err := v.file.ReadAt(buf, hostOffset); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("vmdk grain at %v is beyond the end of the image", hostOffset)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// gtEntry returns the grain table entry of a grain, or 0 if its grain table is not allocated.
+func (v *Vmdk) gtEntry(grain uint64) (uint32, error) {
+	gdIndex := grain / v.gtEntries
+	if gdIndex >= uint64(len(v.gd)) {
+		return 0, fmt.Errorf("vmdk grain %v is beyond the grain directory", grain)
+	}
+	gtSector := v.gd[gdIndex]
+	if gtSector == 0 {
+		return 0, nil
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	table, ok := v.gtCache[gtSector]
+	if !ok {
+		raw := make([]byte, v.gtEntries*4)
+		if _, err := v.file.ReadAt(raw, int64(gtSector)*sectorSize); err != nil {
+			return 0, errors.Wrapf(err, "failed to read the grain table at sector %v", gtSector)
+		}
+		table = make([]uint32, v.gtEntries)
+		for i := range table {
+			table[i] = le.Uint32(raw[i*4:])
+		}
+		if len(v.gtCache) >= gtCacheSize {
+			for k := range v.gtCache {
+				delete(v.gtCache, k)
+				break
+			}
+		}
+		v.gtCache[gtSector] = table
+	}
+	return table[grain%v.gtEntries], nil
+}
+
+// compressedGrainData returns the grain stored at sector, which starts with a marker and is a zlib stream.
+func (v *Vmdk) compressedGrainData(sector uint32) ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.compressedSector == sector {
+		return v.compressedGrain, nil
+	}
+
+	marker := make([]byte, grainMarkerSize)
+	if _, err := v.file.ReadAt(marker, int64(sector)*sectorSize); err != nil {
+		return nil, errors.Wrapf(err, "failed to read the grain marker at sector %v", sector)
+	}
+	length := le.Uint32(marker[8:])
+	if int64(length) > 2*v.grainSize+sectorSize {
+		return nil, fmt.Errorf("vmdk compressed grain at sector %v of %v bytes is too large", sector, length)
+	}
+	compressed := make([]byte, length)
+	if _, err := v.file.ReadAt(compressed, int64(sector)*sectorSize+grainMarkerSize); err != nil {
+		return nil, errors.Wrapf(err, "failed to read the compressed grain at sector %v", sector)
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress the vmdk grain at sector %v", sector)
+	}
+	grain := make([]byte, v.grainSize)
+	// The last grain of the disk may be shorter.
+	if _, err := io.ReadFull(reader, grain); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, errors.Wrapf(err, "failed to decompress the vmdk grain at sector %v", sector)
+	}
+	v.compressedSector, v.compressedGrain = sector, grain
+	return grain, nil
+}
+
+func (v *Vmdk) Close() error {
+	return v.file.Close()
+}
+
+// Size returns the size of the virtual disk.
+func (v *Vmdk) Size() (int64, error) {
+	return v.size, nil
+}
+
+// Fd returns the descriptor of the image file. Its layout is not the one of the virtual disk.
+func (v *Vmdk) Fd() uintptr {
+	return v.file.Fd()
+}